@@ -2,6 +2,13 @@
 
 . exports.sh
 
+version="dev"
+while getopts "v:" opt; do
+    case $opt in
+        v) version=$OPTARG;;
+    esac
+done
+
 build_args=""
 if [ "$UPDATE" = "on" ]; then
     build_args="-u"
@@ -15,8 +22,16 @@ go get $build_args github.com/errplane/errplane-go \
     code.google.com/p/log4go \
     github.com/bmizerany/pat \
 	  github.com/pmylund/go-cache \
-    github.com/howeyc/fsnotify
+    github.com/howeyc/fsnotify \
+    github.com/boltdb/bolt \
+    golang.org/x/sys/windows/svc
+
+build_tags=""
+if [ "$FIPS" = "on" ]; then
+    build_tags="-tags fips"
+fi
 
-go build apps/agent
-go build apps/config-generator
-go build apps/sudoers-generator
+go build $build_tags -ldflags "-X main.agentVersion=$version" apps/agent
+go build $build_tags apps/config-generator
+go build $build_tags apps/sudoers-generator
+go build $build_tags apps/fake-backend
@@ -49,6 +49,7 @@ function copy_files {
     cp sudoers-generator $data_dir/
     cp opensource.md $data_dir/
     cp scripts/init.d.sh $initd_dir/errplane-agent
+    cp -r scripts/selinux scripts/apparmor $data_dir/
 }
 
 # build the x86_64 version
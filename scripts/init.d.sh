@@ -87,15 +87,18 @@ case $1 in
             log_failure_msg "$name Process is not running"
         fi
         ;;
-    # reload)
-    #     # Reload the process. Basically sending some signal to a daemon to reload its configurations.
-    #     if [ -e $pidfile ]; then
-    #         start-stop-daemon --stop --signal SIGHUSR2 --quiet --pidfile $pidfile --name $name
-    #         log_success_msg "$name process reloaded successfully"
-    #     else
-    #         log_failure_msg "$pidfile does not exists"
-    #     fi
-    #     ;;
+    reload)
+        # Reload the configuration, the agent keeps running and doesn't drop any point.
+        if [ -e $pidfile ]; then
+            if killproc -p $pidfile $daemon SIGHUP; then
+                log_success_msg "$name configuration reloaded, see the log for the settings that need a restart"
+            else
+                log_failure_msg "$name failed to reload its configuration"
+            fi
+        else
+            log_failure_msg "$pidfile does not exists"
+        fi
+        ;;
     *)
         # For invalid arguments, print the usage message.
         echo "Usage: $0 {start|stop|restart|reload|status}"
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	"runtime"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// what the agent itself did, reported as agent.<stat>
+const (
+	STAT_PLUGIN_RUNS     = "plugins.runs"         // plugin instances started
+	STAT_PLUGIN_FAILURES = "plugins.failures"     // plugin instances that couldn't be run
+	STAT_PLUGIN_TIMEOUTS = "plugins.timeouts"     // plugin instances killed after their timeout
+	STAT_PARSE_ERRORS    = "plugins.parse_errors" // plugin outputs that couldn't be parsed
+	STAT_POINTS_SENT     = "points.sent"          // points accepted by errplane
+	STAT_WRITES_SENT     = "points.writes"        // writes to errplane that succeeded
+	STAT_SEND_FAILURES   = "points.send_failures" // writes to errplane that failed
+	STAT_MISSED_RUNS     = "plugins.missed_runs"  // due plugin runs that were skipped
+
+	STAT_DIMENSION_VIOLATIONS = "points.dimension_violations" // reserved dimensions set by plugins and schema violations
+	STAT_POINTS_FILTERED      = "points.filtered"             // points dropped by the metric filters
+)
+
+var AGENT_STATS = []string{STAT_PLUGIN_RUNS, STAT_PLUGIN_FAILURES, STAT_PLUGIN_TIMEOUTS, STAT_PARSE_ERRORS, STAT_POINTS_SENT, STAT_WRITES_SENT, STAT_SEND_FAILURES, STAT_DIMENSION_VIOLATIONS, STAT_MISSED_RUNS, STAT_POINTS_FILTERED}
+
+// Counts what the agent did since it started, reported with its queue
+// depths, goroutines and memory every cycle so there's telemetry about the
+// agent itself when it misbehaves
+type AgentStats struct {
+	lock    sync.Mutex
+	counts  map[string]int64
+	running int // the plugins in flight
+}
+
+var agentStats = NewAgentStats()
+
+func NewAgentStats() *AgentStats {
+	return &AgentStats{counts: make(map[string]int64)}
+}
+
+func (self *AgentStats) Add(stat string, count int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[stat] += int64(count)
+}
+
+// returns the count of every stat since the agent started
+func (self *AgentStats) Counts() map[string]int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	counts := make(map[string]int64)
+	for _, stat := range AGENT_STATS {
+		counts[stat] = self.counts[stat]
+	}
+	return counts
+}
+
+// wraps the run of a plugin instance so the plugins in flight can be
+// reported, the runs waiting for a slot of the pool aren't counted
+func (self *AgentStats) Running(run func()) {
+	self.lock.Lock()
+	self.running++
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		self.running--
+		self.lock.Unlock()
+	}()
+	run()
+}
+
+func countPoints(writes []*errplane.JsonPoints) int {
+	count := 0
+	for _, write := range writes {
+		count += len(write.Points)
+	}
+	return count
+}
+
+// returns the gauges of the agent: the writes waiting to be sent, the
+// plugins in flight, the goroutines and the memory of the go runtime
+func (self *AgentStats) Gauges() map[string]float64 {
+	memory := runtime.MemStats{}
+	runtime.ReadMemStats(&memory)
+	self.lock.Lock()
+	running := self.running
+	self.lock.Unlock()
+	return map[string]float64{
+		"queue.spooled":   float64(spool.Depth()),
+		"queue.batched":   float64(httpBatcher.Pending()),
+		"queue.scrape":    float64(scrapeBuffer.Pending()),
+		"plugins.running": float64(running),
+		"goroutines":      float64(runtime.NumGoroutine()),
+		"memory.heap":     float64(memory.HeapAlloc),
+		"memory.sys":      float64(memory.Sys),
+	}
+}
+
+// reports the stats of the agent since the previous report and its gauges,
+// then lets the watchdog check them
+func reportAgentStats(ep *errplane.Errplane) {
+	watchdog := newConfiguredWatchdog()
+	previous := make(map[string]int64)
+	for {
+		time.Sleep(AgentConfig().Sleep)
+		now := time.Now()
+		counts := agentStats.Counts()
+		deltas := make(map[string]int64)
+		for _, stat := range AGENT_STATS {
+			deltas[stat] = counts[stat] - previous[stat]
+			report(ep, "agent."+stat, float64(deltas[stat]), now, errplane.Dimensions{"host": AgentConfig().Hostname}, nil)
+		}
+		previous = counts
+		gauges := agentStats.Gauges()
+		for gauge, value := range gauges {
+			report(ep, "agent."+gauge, value, now, errplane.Dimensions{"host": AgentConfig().Hostname}, nil)
+		}
+		watchdog.Check(deltas, gauges)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,23 +18,89 @@ import (
 )
 
 func main() {
-	configFile := flag.String("config", "/etc/errplane-agent/config.yml", "The agent config file")
+	configFile := flag.String("config", DEFAULT_CONFIG_FILE, "The agent config file")
+	pidFile := flag.String("pidfile", DEFAULT_PID_FILE, "The agent pid file")
 	flag.Parse()
 
-	pidFile := flag.String("pidfile", "/data/errplane-agent/shared/errplane-agent.pid", "The agent pid file")
-	flag.Parse()
-
-	err := InitConfig(*configFile)
+	configPath = *configFile
+	err := InitConfig(configPath)
 	if err != nil {
 		fmt.Printf("Error while reading configuration. Error: %s", err)
 		os.Exit(1)
 	}
+	InitAgentTransport()
+
+	if flag.Arg(0) == "test" {
+		// agent test <plugin> [--arg value ...]
+		if flag.NArg() < 2 {
+			fmt.Printf("Usage: %s [-config file] test <plugin name or directory> [--arg value ...]\n", os.Args[0])
+			os.Exit(1)
+		}
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(testPlugin(os.Stdout, flag.Arg(1), flag.Args()[2:]))
+	}
+
+	if flag.Arg(0) == "config" {
+		// agent config export | layers | diff <file>
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(configCommand(os.Stdout, flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "top" {
+		// agent top, talks to the running agent through its local api
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(runTop(os.Stdout))
+	}
+
+	if flag.Arg(0) == "burst" {
+		// agent burst <plugin> [-every 5s] [-for 15m] ..., talks to the running agent through its local api
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		client, err := NewLocalApiClient()
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(burstCommand(os.Stdout, client, flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "report" {
+		// agent report [-last 24h] [-html], from the local history
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(reportCommand(os.Stdout, flag.Args()[1:], time.Now()))
+	}
+
+	if flag.Arg(0) == "secrets" {
+		// agent secrets init | list | set <name> | delete <name>
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(secretsCommand(os.Stdout, os.Stdin, flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "simulate" {
+		// agent simulate -config plan.yml [-duration 1h], the plugin schedule on a virtual clock
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(simulateCommand(os.Stdout, flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "decommission" {
+		// agent decommission [-uninstall] [-force], once the agent is stopped
+		log.Close()
+		log.Global = log.NewDefaultLogger(log.WARNING)
+		os.Exit(decommissionCommand(os.Stdout, configPath, *pidFile, flag.Args()[1:]))
+	}
 
 	err = initLog()
 	if err != nil {
 		fmt.Printf("Error while reading configuration. Error: %s", err)
 		os.Exit(1)
 	}
+	startService()
 
 	if *pidFile == "" {
 		fmt.Printf("Pidfile is a required argument and cannot be empty")
@@ -44,26 +111,128 @@ func main() {
 		fmt.Printf("Error while writing to file %s. Error: %s", *pidFile, err)
 	}
 
-	ep := errplane.New(AgentConfig.AppKey, AgentConfig.Environment, AgentConfig.ApiKey)
-	ep.SetHttpHost(AgentConfig.HttpHost)
-	ep.SetUdpAddr(AgentConfig.UdpHost)
-	if AgentConfig.Proxy != "" {
-		ep.SetProxy(AgentConfig.Proxy)
+	ep := errplane.New(AgentConfig().AppKey, AgentConfig().Environment, AgentConfig().ApiKey)
+	ep.SetHttpHost(AgentConfig().HttpHost)
+	ep.SetUdpAddr(AgentConfig().UdpHost)
+	if AgentConfig().SshTunnel.Host != "" {
+		go superviseSshTunnel()
+	}
+	if proxy := ProxyUrl(); proxy != nil {
+		ep.SetProxy(proxy.String())
+	}
+	if AgentConfig().AuditLog != "" {
+		var reporter Reporter
+		if AgentConfig().AuditLogForward {
+			reporter = &GlobalDimensionsReporter{ep}
+		}
+		auditLog = NewAuditLog(AgentConfig().AuditLog, AgentConfig().AuditLogMaxSize, reporter)
+	}
+	if AgentConfig().HistoryFile != "" {
+		historyStore = NewHistoryStore(AgentConfig().HistoryFile, AgentConfig().HistoryRetention)
+		recordHistory(&HistoryEntry{Timestamp: time.Now().Unix(), Kind: HISTORY_EVENT, Name: HISTORY_AGENT_STARTED})
+		go historyStore.compactPeriodically()
+	}
+
+	if AgentConfig().LocalStore.Path != "" {
+		localStore, err = OpenLocalStore(AgentConfig().LocalStore.Path, AgentConfig().LocalStore.MaxSize)
+		if err != nil {
+			log.Error("Cannot open the local store %s, the state of the agent won't survive a restart. Error: %s", AgentConfig().LocalStore.Path, err)
+		} else {
+			if err := restoreLocalState(localStore, time.Now()); err != nil {
+				log.Error("Cannot restore the state of the agent from %s. Error: %s", AgentConfig().LocalStore.Path, err)
+			}
+			go syncLocalStore(localStore)
+		}
 	}
+
+	if AgentConfig().Spool.Dir != "" {
+		spool, err = NewSpool(AgentConfig().Spool.Dir, AgentConfig().Spool.MaxSize, AgentConfig().Spool.MaxAge)
+		if err != nil {
+			log.Error("Cannot create the spool directory %s. Error: %s", AgentConfig().Spool.Dir, err)
+			log.Close()
+			fmt.Printf("Cannot create the spool directory %s. Error: %s\n", AgentConfig().Spool.Dir, err)
+			os.Exit(1)
+		}
+		go spool.Replay(func(operation *errplane.WriteOperation) error {
+			now := time.Now()
+			operation.Writes = expirePoints(ep, SINK_ERRPLANE, operation.Writes, now)
+			if len(operation.Writes) == 0 {
+				return nil
+			}
+			stampWrites(operation.Writes, now, true)
+			if err := chaosFaults.BackendError(); err != nil {
+				return err
+			}
+			return sendBackend(operation)
+		})
+	}
+
+	if AgentConfig().Scrape.Listen != "" {
+		scrapeBuffer = NewScrapeBuffer(AgentConfig().Scrape.MaxPoints)
+		go startScrapeServer()
+	}
+
+	startKubernetes()
+	if err := startHttpBatcher(); err != nil {
+		log.Error("Cannot batch the points sent to errplane. Error: %s", err)
+	}
+
+	reportMacStatus(ep)
+	reportHostCapabilities(ep)
+	startResultStream()
+
 	ch := make(chan error)
-	go memStats(ep, ch)
-	go cpuStats(ep, ch)
-	go networkStats(ep, ch)
-	go loadAverageStats(ep, ch)
-	go diskSpaceStats(ep, ch)
-	go ioStats(ep, ch)
+	if AgentConfig().HostStats.Enabled {
+		go hostStats(ep)
+	} else {
+		go memStats(ep, ch)
+		go cpuStats(ep, ch)
+		go diskSpaceStats(ep, ch)
+		if PROC_STATS && hostCapabilities.Has(HOST_CAPABILITY_PROC) {
+			go networkStats(ep, ch)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		// windows has no load average
+		go loadAverageStats(ep, ch)
+	}
+	if PROC_STATS && hostCapabilities.Has(HOST_CAPABILITY_PROC) {
+		go ioStats(ep, ch)
+	}
 	go procStats(ep, ch)
 	go monitorProceses(ep, ch)
 	go monitorPlugins(ep)
+	go monitorHttpChecks(ep)
+	go monitorDnsChecks(ep)
+	go monitorCommandChecks(ep)
+	go watchProcesses(ep)
+	go runCollectors(ep)
+	go tailLogs(ep)
+	go collectPerfCounters(ep)
+	go monitorWindowsTargets(ep)
+	go monitorModbusDevices(ep)
+	go startMqttSubscriber(ep)
+	go sensorsStats(ep)
+	go powerStats(ep)
+	go dockerStats(ep)
+	go reportErrorCounts(ep)
+	go reportAgentStats(ep)
+	go sendHeartbeats(ep)
+	go runLoadgen(ep)
+	go watchScaleIn(ep)
+	go exportSpans()
+	go watchMacDenials(ep)
+	go updateStatusPage()
 	go checkNewPlugins()
 	go startUdpListener(ep)
+	go startRingBufferListener(ep)
+	go startGraphiteListener(ep)
+	go startStatsdListener(ep)
 	go startLocalServer()
-	detector := NewAnomaliesDetector(ep)
+	go handleReloadSignal()
+	go handleShutdownSignal()
+	detector := NewAnomaliesDetector(&GlobalDimensionsReporter{ep})
+	detector.notifier = newConfiguredNotifiers()
 	go watchLogFile(detector)
 	log.Info("Agent started successfully")
 	err = <-ch
@@ -75,7 +244,7 @@ func main() {
 
 func initLog() error {
 	level := log.DEBUG
-	switch AgentConfig.LogLevel {
+	switch AgentConfig().LogLevel {
 	case "info":
 		level = log.INFO
 	case "warn":
@@ -84,10 +253,11 @@ func initLog() error {
 		level = log.ERROR
 	}
 
-	log.AddFilter("file", level, log.NewFileLogWriter(AgentConfig.LogFile, false))
+	log.AddFilter("file", level, log.NewFileLogWriter(AgentConfig().LogFile, false))
+	log.AddFilter("recent-errors", log.ERROR, recentErrors)
 
 	var err error
-	os.Stderr, err = os.OpenFile(AgentConfig.LogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	os.Stderr, err = os.OpenFile(AgentConfig().LogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
@@ -97,11 +267,54 @@ func initLog() error {
 }
 
 func report(ep *errplane.Errplane, metric string, value float64, timestamp time.Time, dimensions errplane.Dimensions, ch chan error) bool {
-	err := ep.Report(metric, value, timestamp, "", dimensions)
+	reportWithContext(ep, metric, value, timestamp, "", dimensions)
+	return false
+}
+
+// reports a point with a context, i.e. the body of the event
+func reportWithContext(ep *errplane.Errplane, metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) {
+	recentMetrics.Add(metric, dimensions, value, timestamp)
+	dimensions = scrubDimensions(addGlobalDimensions(dimensions))
+	if !allowedByFilters(metric) || !allowedBySchemas(metric, dimensions) {
+		return
+	}
+	timestamp = timestamp.Add(chaosFaults.Skew())
+	for _, name := range seriesNames(metric, time.Now()) {
+		sendPoint(ep, name, value, timestamp, context, dimensions)
+	}
+}
+
+// sends a single point to errplane, through the batcher if http-batch is
+// enabled
+func sendPoint(ep *errplane.Errplane, metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) {
+	if httpBatcher != nil || scrapeBuffer != nil {
+		point := &errplane.JsonPoint{Value: value, Time: timestamp.Unix(), Context: context, Dimensions: dimensions}
+		operation := &errplane.WriteOperation{Writes: []*errplane.JsonPoints{&errplane.JsonPoints{Name: metric, Points: []*errplane.JsonPoint{point}}}}
+		if httpBatcher != nil {
+			httpBatcher.Add(operation)
+		} else {
+			deliverHttp(sendBackend, operation)
+		}
+		return
+	}
+	now := time.Now()
+	if delivery := pointDelivery(timestamp.Unix(), now, false); delivery != "" {
+		dimensions = withDimension(dimensions, "delivery", delivery)
+	}
+	if AgentConfig().Timestamps.Mode == TIMESTAMPS_SEND {
+		timestamp = now
+	}
+	err := chaosFaults.BackendError()
+	if err == nil {
+		err = ep.Report(metric, value, timestamp, context, dimensions)
+	}
 	if err != nil {
+		agentStats.Add(STAT_SEND_FAILURES, 1)
 		log.Error("Error while sending report. Error: %s", err)
+	} else {
+		agentStats.Add(STAT_POINTS_SENT, 1)
+		agentStats.Add(STAT_WRITES_SENT, 1)
 	}
-	return false
 }
 
 func procStats(ep *errplane.Errplane, ch chan error) {
@@ -113,11 +326,14 @@ func procStats(ep *errplane.Errplane, ch chan error) {
 		if previousStats != nil {
 			mergedStats := mergeStats(previousStats, procStats)
 
-			n := int(math.Min(float64(AgentConfig.TopNProcesses), float64(len(mergedStats))))
+			n := int(math.Min(float64(AgentConfig().TopNProcesses), float64(len(mergedStats))))
 
+			now := time.Now()
+			if historyStore != nil {
+				historyStore.RecordTop(mergedStats, n, now)
+			}
 			sort.Sort(ProcStatsSortableByCpu(mergedStats))
 			topNByCpu := mergedStats[0:n]
-			now := time.Now()
 			for _, stat := range topNByCpu {
 				if reportProcessCpuUsage(ep, nil, &stat, now, true, ch) {
 					return
@@ -133,7 +349,7 @@ func procStats(ep *errplane.Errplane, ch chan error) {
 		}
 
 		previousStats = procStats
-		time.Sleep(AgentConfig.TopNSleep)
+		time.Sleep(AgentConfig().TopNSleep)
 	}
 }
 
@@ -169,14 +385,14 @@ func reportProcessMetric(ep *errplane.Errplane, monitoredProcess *Process, stat
 	if monitoredProcess != nil {
 		dimensions = errplane.Dimensions{
 			"nickname": monitoredProcess.Nickname,
-			"host":     AgentConfig.Hostname,
+			"host":     AgentConfig().Hostname,
 		}
 	} else {
 		dimensions = errplane.Dimensions{
 			"pid":     strconv.Itoa(stat.pid),
 			"name":    stat.name,
 			"cmdline": strings.Join(stat.args, " "),
-			"host":    AgentConfig.Hostname,
+			"host":    AgentConfig().Hostname,
 		}
 	}
 
@@ -214,7 +430,7 @@ func ioStats(ep *errplane.Errplane, ch chan error) {
 				millisecondsElapsed := timestamp.Sub(prevTimeStamp).Nanoseconds() / int64(time.Millisecond)
 				utilization := float64(diskUsage.TotalIOTime-prevDiskUsage.TotalIOTime) / float64(millisecondsElapsed) * 100
 
-				dimensions := errplane.Dimensions{"host": AgentConfig.Hostname, "device": diskUsage.Name}
+				dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "device": diskUsage.Name}
 
 				if report(ep, "server.stats.io.utilization", float64(utilization), timestamp, dimensions, ch) {
 					return
@@ -224,7 +440,7 @@ func ioStats(ep *errplane.Errplane, ch chan error) {
 
 		prevDiskUsages = diskUsages
 		prevTimeStamp = timestamp
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -244,7 +460,7 @@ func memStats(ep *errplane.Errplane, ch chan error) {
 			return
 		}
 
-		dimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
 		timestamp := time.Now()
 
 		used := float64(mem.Used)
@@ -271,7 +487,7 @@ func memStats(ep *errplane.Errplane, ch chan error) {
 			return
 		}
 
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -289,7 +505,7 @@ func diskSpaceStats(ep *errplane.Errplane, ch chan error) {
 			usage := sigar.FileSystemUsage{}
 			usage.Get(dir_name)
 
-			dimensions := errplane.Dimensions{"host": AgentConfig.Hostname, "device": fs.DevName}
+			dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "device": fs.DevName}
 
 			used := float64(usage.Total)
 			usedPercentage := usage.UsePercent()
@@ -299,7 +515,7 @@ func diskSpaceStats(ep *errplane.Errplane, ch chan error) {
 				return
 			}
 		}
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -318,7 +534,7 @@ func cpuStats(ep *errplane.Errplane, ch chan error) {
 		}
 
 		if !skipFirst {
-			dimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+			dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
 
 			total := float64(cpu.Total() - prevCpu.Total())
 
@@ -342,7 +558,7 @@ func cpuStats(ep *errplane.Errplane, ch chan error) {
 		}
 		skipFirst = false
 		prevCpu = cpu
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -356,7 +572,7 @@ func loadAverageStats(ep *errplane.Errplane, ch chan error) {
 			return
 		}
 
-		dimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
 
 		if report(ep, "server.stats.loadavg.1m", loadAvg[0], timestamp, dimensions, ch) ||
 			report(ep, "server.stats.loadavg.5m", loadAvg[1], timestamp, dimensions, ch) ||
@@ -364,7 +580,7 @@ func loadAverageStats(ep *errplane.Errplane, ch chan error) {
 			return
 		}
 
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -385,7 +601,7 @@ func networkStats(ep *errplane.Errplane, ch chan error) {
 				continue
 			}
 
-			dimensions := errplane.Dimensions{"host": AgentConfig.Hostname, "device": name}
+			dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "device": name}
 
 			rxBytes := float64(utilization.rxBytes - prevNetwork[name].rxBytes)
 			rxPackets := float64(utilization.rxPackets - prevNetwork[name].rxPackets)
@@ -409,6 +625,6 @@ func networkStats(ep *errplane.Errplane, ch chan error) {
 			}
 		}
 		prevNetwork = network
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type AgentStatsSuite struct {
+	previous *AgentStats
+}
+
+var _ = Suite(&AgentStatsSuite{})
+
+func (self *AgentStatsSuite) SetUpTest(c *C) {
+	self.previous = agentStats
+	agentStats = NewAgentStats()
+}
+
+func (self *AgentStatsSuite) TearDownTest(c *C) {
+	agentStats = self.previous
+}
+
+func (self *AgentStatsSuite) TestCounts(c *C) {
+	agentStats.Add(STAT_PLUGIN_RUNS, 1)
+	agentStats.Add(STAT_PLUGIN_RUNS, 1)
+	agentStats.Add(STAT_POINTS_SENT, 10)
+
+	counts := agentStats.Counts()
+	c.Assert(counts, HasLen, len(AGENT_STATS))
+	c.Assert(counts[STAT_PLUGIN_RUNS], Equals, int64(2))
+	c.Assert(counts[STAT_POINTS_SENT], Equals, int64(10))
+	c.Assert(counts[STAT_SEND_FAILURES], Equals, int64(0))
+}
+
+func (self *AgentStatsSuite) TestDeliveries(c *C) {
+	ok := func(*errplane.WriteOperation) error { return nil }
+	failing := func(*errplane.WriteOperation) error { return fmt.Errorf("connection refused") }
+
+	c.Assert(deliverHttp(ok, batchWrite("cpu", 1, 2)), IsNil)
+	c.Assert(deliverHttp(ok, batchWrite("mem", 3)), IsNil)
+	c.Assert(deliverHttp(failing, batchWrite("mem", 3)), NotNil)
+
+	counts := agentStats.Counts()
+	c.Assert(counts[STAT_POINTS_SENT], Equals, int64(3))
+	c.Assert(counts[STAT_SEND_FAILURES], Equals, int64(1))
+}
+
+func (self *AgentStatsSuite) TestGauges(c *C) {
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(100, time.Hour, nil)
+	httpBatcher.Add(batchWrite("cpu", 1, 2))
+
+	started, finished := make(chan bool), make(chan bool)
+	go agentStats.Running(func() {
+		started <- true
+		<-finished
+	})
+	<-started
+
+	gauges := agentStats.Gauges()
+	c.Assert(gauges["queue.batched"], Equals, 2.0)
+	c.Assert(gauges["queue.spooled"], Equals, 0.0)
+	c.Assert(gauges["plugins.running"], Equals, 1.0)
+	c.Assert(gauges["goroutines"] > 0, Equals, true)
+	c.Assert(gauges["memory.heap"] > 0, Equals, true)
+
+	finished <- true
+	httpBatcher = nil
+	for i := 0; i < 100 && agentStats.Gauges()["plugins.running"] > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	gauges = agentStats.Gauges()
+	c.Assert(gauges["plugins.running"], Equals, 0.0)
+	c.Assert(gauges["queue.batched"], Equals, 0.0)
+}
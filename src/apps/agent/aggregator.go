@@ -49,7 +49,7 @@ func convertToInternalWriteOperation(operation *common.WriteOperation) *errplane
 
 func handler(ep *errplane.Errplane) aggregator.WriteOperationHandler {
 	return func(operation *common.WriteOperation) {
-		if err := ep.SendHttp(convertToInternalWriteOperation(operation)); err != nil {
+		if err := sendHttp(ep, convertToInternalWriteOperation(operation)); err != nil {
 			log.Error("Cannot send data to the Errplane. Error: %s", err)
 		}
 	}
@@ -57,7 +57,7 @@ func handler(ep *errplane.Errplane) aggregator.WriteOperationHandler {
 
 func startUdpListener(ep *errplane.Errplane) {
 	log.Info("Starting data aggregator...")
-	theAggregator := aggregator.NewAggregator(AgentConfig.FlushInterval/time.Second, handler(ep), AgentConfig.ApiKey, AgentConfig.Percentiles, true)
-	udpReceiver := aggregator.NewUdpReceiver(AgentConfig.UdpAddr, handler(ep), theAggregator)
+	theAggregator := aggregator.NewAggregator(AgentConfig().FlushInterval/time.Second, handler(ep), AgentConfig().ApiKey, AgentConfig().Percentiles, true)
+	udpReceiver := aggregator.NewUdpReceiver(AgentConfig().UdpAddr, handler(ep), theAggregator)
 	udpReceiver.ListenAndReceive()
 }
@@ -48,6 +48,7 @@ type Detector interface {
 type AnomaliesDetector struct {
 	config   *monitoring.MonitorConfig
 	reporter Reporter
+	notifier *NotificationDispatcher
 }
 
 type Reporter interface {
@@ -55,7 +56,7 @@ type Reporter interface {
 }
 
 func NewAnomaliesDetector(reporter Reporter) *AnomaliesDetector {
-	detector := &AnomaliesDetector{nil, reporter}
+	detector := &AnomaliesDetector{nil, reporter, nil}
 	go detector.updateMonitorConfig()
 	return detector
 }
@@ -69,7 +70,7 @@ func (self *AnomaliesDetector) updateMonitorConfig() {
 		} else {
 			self.config = config
 		}
-		time.Sleep(utils.AgentConfig.Sleep)
+		time.Sleep(utils.AgentConfig().Sleep)
 	}
 }
 
@@ -95,7 +96,7 @@ func (self *AnomaliesDetector) Report(metricName string, value float64, context
 
 	for _, monitor := range self.config.Monitors {
 		if monitor.StatName == metricName {
-			self.reportMetricEvent(monitor, value)
+			self.reportMetricEvent(monitor, value, dimensions)
 			continue
 		}
 
@@ -118,13 +119,28 @@ func (self *AnomaliesDetector) Report(metricName string, value float64, context
 			continue
 		}
 		status := dimensions["status"]
-		self.reportPluginEvent(monitor, pluginName, status)
+		self.reportPluginEvent(monitor, pluginName, status, dimensions)
 		// stop processing any further plugin monitor
 		break
 	}
 }
 
-func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, name string, status string) {
+// returns the message configured for the given stat or plugin in
+// alert-messages interpolated with the point dimensions and the given values
+func alertMessage(name string, dimensions errplane.Dimensions, values map[string]interface{}) string {
+	template, ok := utils.AgentConfig().AlertMessages[name]
+	if !ok {
+		return ""
+	}
+	for key, value := range dimensions {
+		if _, ok := values[key]; !ok {
+			values[key] = value
+		}
+	}
+	return interpolateMessage(template, values)
+}
+
+func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, name string, status string, pointDimensions errplane.Dimensions) {
 	// we have a monitor that matches the given filename
 	for _, condition := range monitor.Conditions {
 		ok, err := regexp.MatchString(condition.AlertOnMatch, status)
@@ -134,8 +150,10 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 		}
 		// split lines and see if any one of them matches
 		key := fmt.Sprintf("%#v/%#v", monitor, condition)
+		title := fmt.Sprintf("Plugin %s is %s", name, status)
 		if !ok {
 			eventCache.Delete(key)
+			self.notifier.Resolve(&Notification{Key: notificationKey(key), Title: fmt.Sprintf("Plugin %s is %s", name, status)})
 			return
 		}
 
@@ -150,11 +168,25 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 		metricEvents.events = append(metricEvents.events, &Event{time.Now()})
 
 		if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
-			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", errplane.Dimensions{
+			dimensions := errplane.Dimensions{
 				"PluginName":   name,
 				"AlertOnMatch": condition.AlertOnMatch,
 				"OnlyAfter":    condition.OnlyAfter.String(),
+			}
+			if instance := pointDimensions["instance"]; instance != "" {
+				dimensions["instance"] = instance
+			}
+			message := alertMessage(name, pointDimensions, map[string]interface{}{
+				"plugin":     name,
+				"status":     status,
+				"only_after": condition.OnlyAfter.String(),
 			})
+			if message != "" {
+				dimensions["message"] = message
+				title = message
+			}
+			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", dimensions)
+			self.notifier.Alert(&Notification{Key: notificationKey(key), Title: title, Severity: "critical", Dimensions: dimensions})
 		}
 
 		// remove all events that are older than "OnlyAfter"
@@ -170,13 +202,14 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 	}
 }
 
-func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, value float64) {
+func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, value float64, pointDimensions errplane.Dimensions) {
 	// we have a monitor that matches the given filename
 	for _, condition := range monitor.Conditions {
 		// split lines and see if any one of them matches
 		key := fmt.Sprintf("%#v/%#v", monitor, condition)
 		if value < condition.AlertThreshold {
 			eventCache.Delete(key)
+			self.notifier.Resolve(&Notification{Key: notificationKey(key), Title: fmt.Sprintf("%s is back below %v", monitor.StatName, condition.AlertThreshold)})
 			return
 		}
 
@@ -191,12 +224,25 @@ func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, va
 		metricEvents.events = append(metricEvents.events, &Event{time.Now()})
 
 		if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
-			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", errplane.Dimensions{
+			dimensions := errplane.Dimensions{
 				"StatName":       monitor.StatName,
 				"AlertWhen":      condition.AlertWhen.String(),
 				"AlertThreshold": strconv.FormatFloat(condition.AlertThreshold, 'f', -1, 64),
 				"OnlyAfter":      condition.OnlyAfter.String(),
+			}
+			title := fmt.Sprintf("%s is %s %v for more than %s", monitor.StatName, condition.AlertWhen, condition.AlertThreshold, condition.OnlyAfter)
+			message := alertMessage(monitor.StatName, pointDimensions, map[string]interface{}{
+				"stat":       monitor.StatName,
+				"value":      value,
+				"threshold":  condition.AlertThreshold,
+				"only_after": condition.OnlyAfter.String(),
 			})
+			if message != "" {
+				dimensions["message"] = message
+				title = message
+			}
+			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", dimensions)
+			self.notifier.Alert(&Notification{Key: notificationKey(key), Title: title, Severity: "critical", Dimensions: dimensions})
 		}
 
 		// remove all events that are older than "OnlyAfter"
@@ -212,6 +258,11 @@ func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, va
 	}
 }
 
+// the keys of the event cache are too long to be used as dedup keys
+func notificationKey(key string) string {
+	return configHash(key)[:16]
+}
+
 func (self *AnomaliesDetector) ReportLogEvent(filename string, oldLines []string, newLines []string) {
 	// log.Debug("Inside ReportLogEvent")
 
@@ -293,13 +344,16 @@ func (self *AnomaliesDetector) ReportLogEvent(filename string, oldLines []string
 					context = strings.Join(event.before, "\n") + "\n" + event.lines + "\n" + strings.Join(event.after, "\n")
 				}
 
-				self.reporter.Report("errplane.anomalies", float64(len(logEvents.events)), time.Now(), context, errplane.Dimensions{
+				dimensions := errplane.Dimensions{
 					"LogFile":        monitor.LogName,
 					"AlertWhen":      condition.AlertWhen.String(),
 					"AlertThreshold": strconv.FormatFloat(condition.AlertThreshold, 'f', -1, 64),
 					"AlertOnMatch":   condition.AlertOnMatch,
 					"OnlyAfter":      condition.OnlyAfter.String(),
-				})
+				}
+				self.reporter.Report("errplane.anomalies", float64(len(logEvents.events)), time.Now(), context, dimensions)
+				title := fmt.Sprintf("%d lines matching '%s' in %s", len(logEvents.events), condition.AlertOnMatch, monitor.LogName)
+				self.notifier.Alert(&Notification{Key: notificationKey(key), Title: title, Body: context, Severity: "warning", Dimensions: dimensions})
 			}
 		}
 	}
@@ -43,7 +43,8 @@ func (self *LogMonitoringSuite) SetUpSuite(c *C) {
 	self.reporter = &ReporterMock{}
 	self.detector = NewAnomaliesDetector(self.reporter)
 	ioutil.WriteFile("/tmp/foo.txt", nil, 0644)
-	AgentConfig.Sleep = 1 * time.Second
+	// not restored, the watcher goroutine keeps running after the suite
+	setTestConfig(func(config *Config) { config.Sleep = 1 * time.Second })
 	go watchLogFile(self.detector)
 }
 
@@ -183,15 +184,16 @@ func (self *LogMonitoringSuite) TestMetricMonitoring(c *C) {
 }
 
 func (self *LogMonitoringSuite) TestPluginMonitoring(c *C) {
-	self.detector.Report("plugins.redis.status", 1.0, "", errplane.Dimensions{"status": "critical"})
+	self.detector.Report("plugins.redis.status", 1.0, "", errplane.Dimensions{"status": "critical", "instance": "cache"})
 
 	time.Sleep(2 * time.Second)
 
-	self.detector.Report("plugins.redis.status", 1.0, "", errplane.Dimensions{"status": "critical"})
+	self.detector.Report("plugins.redis.status", 1.0, "", errplane.Dimensions{"status": "critical", "instance": "cache"})
 
 	c.Assert(self.reporter.events, HasLen, 1)
 	c.Assert(self.reporter.events[0].value, Equals, 1.0)
 	c.Assert(self.reporter.events[0].dimensions["PluginName"], Equals, "redis")
+	c.Assert(self.reporter.events[0].dimensions["instance"], Equals, "cache")
 	c.Assert(self.reporter.events[0].dimensions["AlertOnMatch"], Equals, "critical")
 	c.Assert(self.reporter.events[0].dimensions["OnlyAfter"], Equals, "2s")
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	. "utils"
+)
+
+// the scopes a token can be granted on the local api
+const (
+	SCOPE_READ      = "read"      // status and introspection
+	SCOPE_WRITE     = "write"     // submit metrics, passive checks and events
+	SCOPE_PROCESSES = "processes" // stop, start and restart monitored processes
+	SCOPE_SCRAPE    = "scrape"    // pull the points in scrape mode
+	SCOPE_ADMIN     = "admin"     // reload the configuration and run remote commands, implies all other scopes
+)
+
+const (
+	TOKEN_HEADER = "X-Errplane-Token"
+)
+
+// wraps the given handler and only lets through requests that are
+// authenticated with a token (or client certificate) that has the given
+// scope. If no tokens are configured all requests are allowed, which
+// preserves the behavior of older agents listening on localhost only.
+func authorize(scope string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(AgentConfig().ApiTokens) == 0 {
+			handler(w, req)
+			return
+		}
+
+		token := findApiToken(req)
+		if token == nil {
+			log.Warn("Unauthenticated request to %s from %s", req.URL.Path, req.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !hasScope(token, scope) {
+			log.Warn("Token %s isn't allowed to access %s, it needs the %s scope", token.Name, req.URL.Path, scope)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler(w, req)
+	})
+}
+
+func findApiToken(req *http.Request) *ApiToken {
+	value := req.Header.Get(TOKEN_HEADER)
+	if value == "" {
+		value = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+
+	commonName := ""
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		commonName = req.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	for _, token := range AgentConfig().ApiTokens {
+		if token.Token != "" && subtle.ConstantTimeCompare([]byte(token.Token), []byte(value)) == 1 {
+			return token
+		}
+		if token.CommonName != "" && token.CommonName == commonName {
+			return token
+		}
+	}
+	return nil
+}
+
+func hasScope(token *ApiToken, scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope || s == SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// wraps the listener with tls if a certificate is configured, requiring
+// client certificates if a client ca is configured as well
+func apiListener(listener net.Listener) (net.Listener, error) {
+	if AgentConfig().ApiTlsCert == "" {
+		return listener, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(AgentConfig().ApiTlsCert, AgentConfig().ApiTlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := TlsConfig()
+	config.Certificates = []tls.Certificate{cert}
+
+	if AgentConfig().ApiClientCa != "" {
+		ca, err := ioutil.ReadFile(AgentConfig().ApiClientCa)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Cannot parse any certificate from %s", AgentConfig().ApiClientCa)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.NewListener(listener, config), nil
+}
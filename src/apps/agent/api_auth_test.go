@@ -0,0 +1,42 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	. "utils"
+)
+
+type ApiAuthSuite struct{}
+
+var _ = Suite(&ApiAuthSuite{})
+
+func (self *ApiAuthSuite) requestStatus(scope, token string) int {
+	handler := authorize(scope, func(w http.ResponseWriter, req *http.Request) {})
+	req, _ := http.NewRequest("GET", "/restart_process/mysqld", nil)
+	if token != "" {
+		req.Header.Set(TOKEN_HEADER, token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func (self *ApiAuthSuite) TestNoTokensConfigured(c *C) {
+	c.Assert(self.requestStatus(SCOPE_PROCESSES, ""), Equals, http.StatusOK)
+}
+
+func (self *ApiAuthSuite) TestScopes(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.ApiTokens = []*ApiToken{
+			&ApiToken{Name: "metrics", Token: "metrics-token", Scopes: []string{SCOPE_WRITE}},
+			&ApiToken{Name: "ops", Token: "ops-token", Scopes: []string{SCOPE_ADMIN}},
+		}
+	})()
+
+	c.Assert(self.requestStatus(SCOPE_PROCESSES, ""), Equals, http.StatusUnauthorized)
+	c.Assert(self.requestStatus(SCOPE_PROCESSES, "wrong-token"), Equals, http.StatusUnauthorized)
+	c.Assert(self.requestStatus(SCOPE_PROCESSES, "metrics-token"), Equals, http.StatusForbidden)
+	c.Assert(self.requestStatus(SCOPE_WRITE, "metrics-token"), Equals, http.StatusOK)
+	c.Assert(self.requestStatus(SCOPE_PROCESSES, "ops-token"), Equals, http.StatusOK)
+}
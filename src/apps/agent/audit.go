@@ -0,0 +1,136 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	AUDIT_LOG_BACKUPS = 5
+)
+
+type AuditEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`  // who triggered the change, e.g. the config service or a local api token
+	Action    string `json:"action"` // e.g. config_changed, restart_process
+	OldHash   string `json:"old_hash,omitempty"`
+	NewHash   string `json:"new_hash,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+}
+
+// Append only log of every configuration change and remote command, the
+// file is rotated when it grows beyond maxSize and every entry is
+// optionally forwarded to errplane as an event
+type AuditLog struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	reporter Reporter
+}
+
+var auditLog *AuditLog
+
+func NewAuditLog(path string, maxSize int64, reporter Reporter) *AuditLog {
+	return &AuditLog{path: path, maxSize: maxSize, reporter: reporter}
+}
+
+func audit(actor, action, oldHash, newHash, payload string) {
+	recordHistory(&HistoryEntry{Timestamp: time.Now().Unix(), Kind: HISTORY_EVENT, Name: action, Message: "by " + actor})
+	if auditLog == nil {
+		return
+	}
+	auditLog.Record(&AuditEntry{time.Now().Unix(), actor, action, oldHash, newHash, payload})
+}
+
+func (self *AuditLog) Record(entry *AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("Cannot marshal audit entry. Error: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.rotate(int64(len(data))); err != nil {
+		log.Error("Cannot rotate audit log %s. Error: %s", self.path, err)
+	}
+
+	file, err := os.OpenFile(self.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Cannot open audit log %s. Error: %s", self.path, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		log.Error("Cannot write to audit log %s. Error: %s", self.path, err)
+	}
+
+	if self.reporter != nil {
+		self.reporter.Report("agent.audit", 1.0, time.Unix(entry.Timestamp, 0), entry.Payload, errplane.Dimensions{
+			"host":     AgentConfig().Hostname,
+			"actor":    entry.Actor,
+			"action":   entry.Action,
+			"old_hash": entry.OldHash,
+			"new_hash": entry.NewHash,
+		})
+	}
+}
+
+// shifts audit.log to audit.log.1, audit.log.1 to audit.log.2, etc. if
+// writing size more bytes will exceed the max size
+func (self *AuditLog) rotate(size int64) error {
+	if self.maxSize <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(self.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size()+size <= self.maxSize {
+		return nil
+	}
+
+	for i := AUDIT_LOG_BACKUPS - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", self.path, i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", self.path, i+1)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(self.path, self.path+".1")
+}
+
+// returns the name of the token used to authenticate the request or the
+// remote address if the api isn't protected by tokens
+func requestActor(req *http.Request) string {
+	if token := findApiToken(req); token != nil {
+		return "token:" + token.Name
+	}
+	return "local:" + req.RemoteAddr
+}
+
+func configHash(config interface{}) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	. "utils"
+)
+
+// The configuration and the plugins fetched from the backend
+type BackendRefresh struct {
+	Config  *AgentConfiguration
+	Err     error // the configuration couldn't be fetched
+	Plugins map[string]*PluginMetadata
+}
+
+// Fetches the configuration and the plugins from the backend in the
+// background, one fetch at a time, so the plugins scheduler keeps running
+// the current ones while the backend can't be resolved or doesn't answer
+type BackendRefresher struct {
+	fetch    func() *BackendRefresh
+	results  chan *BackendRefresh
+	fetching bool
+}
+
+func NewBackendRefresher(fetch func() *BackendRefresh) *BackendRefresher {
+	return &BackendRefresher{fetch: fetch, results: make(chan *BackendRefresh, 1)}
+}
+
+func fetchBackendRefresh() *BackendRefresh {
+	config, err := GetPluginsToRun()
+	return &BackendRefresh{config, err, getAvailablePlugins()}
+}
+
+// starts a fetch, returns false if the previous one is still running
+func (self *BackendRefresher) Start() bool {
+	if self.fetching {
+		return false
+	}
+	self.fetching = true
+	go func() {
+		self.results <- self.fetch()
+	}()
+	return true
+}
+
+// returns the result of the fetch if it's done, nil otherwise
+func (self *BackendRefresher) Done() *BackendRefresh {
+	select {
+	case refresh := <-self.results:
+		self.fetching = false
+		return refresh
+	default:
+		return nil
+	}
+}
+
+// The hash of the last configuration the backend sent, reported with the
+// heartbeat
+type ConfigRevision struct {
+	lock sync.RWMutex
+	hash string
+}
+
+var backendConfigRevision = &ConfigRevision{}
+
+func (self *ConfigRevision) Set(hash string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.hash = hash
+}
+
+// returns an empty hash until the backend answered
+func (self *ConfigRevision) Get() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.hash
+}
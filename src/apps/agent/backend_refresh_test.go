@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type BackendRefreshSuite struct{}
+
+var _ = Suite(&BackendRefreshSuite{})
+
+func waitForRefresh(refresher *BackendRefresher) *BackendRefresh {
+	for i := 0; i < 100; i++ {
+		if refresh := refresher.Done(); refresh != nil {
+			return refresh
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (self *BackendRefreshSuite) TestSlowBackendDoesntBlock(c *C) {
+	release := make(chan bool)
+	fetches := 0
+	refresher := NewBackendRefresher(func() *BackendRefresh {
+		fetches++
+		<-release
+		return &BackendRefresh{Config: &AgentConfiguration{}}
+	})
+
+	c.Assert(refresher.Start(), Equals, true)
+	c.Assert(refresher.Done(), IsNil)
+	// only one fetch is in flight
+	c.Assert(refresher.Start(), Equals, false)
+
+	release <- true
+	refresh := waitForRefresh(refresher)
+	c.Assert(refresh, NotNil)
+	c.Assert(refresh.Config, NotNil)
+	c.Assert(fetches, Equals, 1)
+
+	c.Assert(refresher.Start(), Equals, true)
+	release <- true
+	c.Assert(waitForRefresh(refresher), NotNil)
+	c.Assert(fetches, Equals, 2)
+}
+
+func (self *BackendRefreshSuite) TestFailedFetch(c *C) {
+	refresher := NewBackendRefresher(func() *BackendRefresh {
+		return &BackendRefresh{Err: fmt.Errorf("no such host")}
+	})
+	c.Assert(refresher.Start(), Equals, true)
+	refresh := waitForRefresh(refresher)
+	c.Assert(refresh, NotNil)
+	c.Assert(refresh.Err, ErrorMatches, "no such host")
+	c.Assert(refresher.Start(), Equals, true)
+}
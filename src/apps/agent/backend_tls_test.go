@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"time"
+	. "utils"
+)
+
+type BackendTlsSuite struct {
+	dir      string
+	previous *Config
+}
+
+var _ = Suite(&BackendTlsSuite{})
+
+func (self *BackendTlsSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+	self.previous = AgentConfig()
+	config := *self.previous
+	SetAgentConfig(&config)
+}
+
+func (self *BackendTlsSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+	InitAgentTransport()
+}
+
+// writes a certificate signed by the parent (self signed if nil) and its
+// key as pem files
+func (self *BackendTlsSuite) certificate(c *C, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+	certificate, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return certificate, key
+}
+
+func (self *BackendTlsSuite) writeConfig(c *C, backendTls string) string {
+	filename := path.Join(self.dir, "config.yml")
+	content := "sleep: 10s\nflush-interval: 10s\ntop-n-sleep: 1m\nmonitored-sleep: 10s\n" + backendTls
+	c.Assert(ioutil.WriteFile(filename, []byte(content), 0644), IsNil)
+	return filename
+}
+
+func (self *BackendTlsSuite) TestMutualTls(c *C) {
+	ca, caKey := self.certificate(c, "ca", nil, nil)
+	self.certificate(c, "agent", ca, caKey)
+
+	clientCas := x509.NewCertPool()
+	clientCas.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCas}
+	server.StartTLS()
+	defer server.Close()
+	serverCa := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "backend-ca.pem"), serverCa, 0644), IsNil)
+
+	// the backend requires a client certificate
+	c.Assert(InitConfig(self.writeConfig(c, "backend-tls: {ca: "+path.Join(self.dir, "backend-ca.pem")+", min-version: '1.2'}\n")), IsNil)
+	InitAgentTransport()
+	_, err := (&http.Client{Transport: AgentTransport()}).Get(server.URL)
+	c.Assert(err, NotNil)
+
+	c.Assert(InitConfig(self.writeConfig(c, "backend-tls:\n"+
+		"  ca: "+path.Join(self.dir, "backend-ca.pem")+"\n"+
+		"  cert: "+path.Join(self.dir, "agent.pem")+"\n"+
+		"  key: "+path.Join(self.dir, "agent-key.pem")+"\n")), IsNil)
+	InitAgentTransport()
+	resp, err := (&http.Client{Transport: AgentTransport()}).Get(server.URL)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(BackendTlsClientConfig().Certificates, HasLen, 1)
+	// the libraries using the default transport keep the go defaults
+	c.Assert(http.DefaultTransport.(*http.Transport).TLSClientConfig, IsNil)
+}
+
+func (self *BackendTlsSuite) TestInvalidConfig(c *C) {
+	_, err := ParseConfig(self.writeConfig(c, "backend-tls: {cert: /etc/agent.pem}\n"))
+	c.Assert(err, ErrorMatches, "backend-tls.cert and backend-tls.key must be set together")
+	_, err = ParseConfig(self.writeConfig(c, "backend-tls: {min-version: '1.4'}\n"))
+	c.Assert(err, ErrorMatches, "Unknown tls version '1.4'.*")
+	_, err = ParseConfig(self.writeConfig(c, "backend-tls: {min-version: '1.3', max-version: '1.2'}\n"))
+	c.Assert(err, ErrorMatches, "backend-tls.min-version 1.3 is greater than max-version 1.2")
+	_, err = ParseConfig(self.writeConfig(c, "backend-tls: {ca: "+path.Join(self.dir, "config.yml")+"}\n"))
+	c.Assert(err, ErrorMatches, "Cannot find any certificate in .*")
+
+	config, err := ParseConfig(self.writeConfig(c, "backend-tls: {min-version: '1.2'}\n"))
+	c.Assert(err, IsNil)
+	c.Assert(config.BackendTls.MinVersion, Equals, uint16(tls.VersionTLS12))
+}
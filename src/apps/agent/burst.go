@@ -0,0 +1,234 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	BURST_MAX_DURATION = 4 * time.Hour
+	BURST_MIN_INTERVAL = PLUGIN_SCHEDULER_RESOLUTION
+)
+
+// A burst runs the instances of a plugin more often, and optionally asks
+// them to be verbose, until it expires, e.g. every 5s for 15m while
+// debugging an incident
+type Burst struct {
+	Id       string        `json:"id"`
+	Plugin   string        `json:"plugin"`
+	Instance string        `json:"instance,omitempty"` // the name or the identity of the instance, empty for all of them
+	Interval time.Duration `json:"interval"`
+	Verbose  bool          `json:"verbose"`
+	Author   string        `json:"author"`
+	Created  time.Time     `json:"created"`
+	Expires  time.Time     `json:"expires"`
+}
+
+func (self *Burst) Matches(pluginName string, instance *Instance) bool {
+	if self.Plugin != pluginName {
+		return false
+	}
+	return self.Instance == "" || self.Instance == instance.Name || self.Instance == instanceId(pluginName, instance)
+}
+
+type Bursts struct {
+	lock   sync.Mutex
+	bursts map[string]*Burst
+}
+
+var bursts = NewBursts()
+
+func NewBursts() *Bursts {
+	return &Bursts{bursts: make(map[string]*Burst)}
+}
+
+func (self *Bursts) Add(plugin, instance, author string, interval, duration time.Duration, verbose bool) (*Burst, error) {
+	if plugin == "" {
+		return nil, fmt.Errorf("The plugin cannot be empty")
+	}
+	if interval < BURST_MIN_INTERVAL {
+		return nil, fmt.Errorf("The burst interval must be at least %s", BURST_MIN_INTERVAL)
+	}
+	if duration <= 0 || duration > BURST_MAX_DURATION {
+		return nil, fmt.Errorf("The burst duration must be positive and at most %s", BURST_MAX_DURATION)
+	}
+
+	now := time.Now()
+	burst := &Burst{newSilenceId(), plugin, instance, interval, verbose, author, now, now.Add(duration)}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.bursts[burst.Id] = burst
+	return burst, nil
+}
+
+func (self *Bursts) Remove(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.bursts[id]
+	delete(self.bursts, id)
+	return ok
+}
+
+// returns the active bursts sorted by expiration and forgets about the
+// expired ones, the instances go back to their interval on their own
+func (self *Bursts) List() []*Burst {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	list := make([]*Burst, 0, len(self.bursts))
+	for id, burst := range self.bursts {
+		if !burst.Expires.After(now) {
+			log.Info("Burst %s of plugin %s expired", id, burst.Plugin)
+			delete(self.bursts, id)
+			continue
+		}
+		list = append(list, burst)
+	}
+	sort.Sort(BurstsSortableByExpiration(list))
+	return list
+}
+
+// returns the interval of the instance during the given bursts matching
+// it, or its own interval if it's shorter, and whether it should be verbose
+func applyBursts(active []*Burst, pluginName string, instance *Instance, interval time.Duration) (time.Duration, bool) {
+	verbose := false
+	for _, burst := range active {
+		if !burst.Matches(pluginName, instance) {
+			continue
+		}
+		if burst.Interval < interval {
+			interval = burst.Interval
+		}
+		verbose = verbose || burst.Verbose
+	}
+	return interval, verbose
+}
+
+type BurstsSortableByExpiration []*Burst
+
+func (self BurstsSortableByExpiration) Len() int { return len(self) }
+func (self BurstsSortableByExpiration) Less(i, j int) bool {
+	return self[i].Expires.Before(self[j].Expires)
+}
+func (self BurstsSortableByExpiration) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+func listBursts(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, bursts.List())
+}
+
+func addBurst(w http.ResponseWriter, req *http.Request) {
+	plugin, instance := req.FormValue("plugin"), req.FormValue("instance")
+	interval, err := time.ParseDuration(req.FormValue("every"))
+	if err != nil {
+		http.Error(w, "Invalid interval", http.StatusBadRequest)
+		return
+	}
+	duration, err := time.ParseDuration(req.FormValue("for"))
+	if err != nil {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+	verbose := req.FormValue("verbose") == "true"
+
+	if len(pluginRegistry.Find(plugin, instance)) == 0 {
+		http.Error(w, fmt.Sprintf("No instance of plugin '%s' is scheduled", plugin), http.StatusNotFound)
+		return
+	}
+
+	actor := requestActor(req)
+	burst, err := bursts.Add(plugin, instance, actor, interval, duration, verbose)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit(actor, "add_burst", "", "", fmt.Sprintf("id=%s plugin=%s instance=%s interval=%s duration=%s verbose=%t",
+		burst.Id, plugin, instance, interval, duration, verbose))
+	log.Info("Running plugin %s every %s until %s", plugin, interval, burst.Expires)
+	writeJson(w, http.StatusOK, burst)
+}
+
+func removeBurst(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+
+	audit(requestActor(req), "remove_burst", "", "", fmt.Sprintf("id=%s", id))
+
+	if !bursts.Remove(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Info("Removed burst %s", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// agent burst <plugin> [-instance name] [-every 5s] [-for 15m] [-verbose],
+// agent burst list and agent burst stop <id>, talks to the running agent
+// through its local api
+func burstCommand(out io.Writer, client *LocalApiClient, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(out, "Usage: burst <plugin> [-instance name] [-every 5s] [-for 15m] [-verbose] | list | stop <id>\n")
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		list := make([]*Burst, 0)
+		if err := client.Get("/bursts", &list); err != nil {
+			fmt.Fprintf(out, "Cannot list the bursts. Error: %s\n", err)
+			return 1
+		}
+		for _, burst := range list {
+			instance := burst.Instance
+			if instance == "" {
+				instance = "*"
+			}
+			fmt.Fprintf(out, "%s  %s/%s  every %s  until %s  verbose %t  by %s\n", burst.Id, burst.Plugin, instance,
+				burst.Interval, burst.Expires.Format(time.RFC3339), burst.Verbose, burst.Author)
+		}
+		return 0
+	case "stop":
+		if len(args) != 2 {
+			fmt.Fprintf(out, "Usage: burst stop <id>\n")
+			return 2
+		}
+		if err := client.Do("DELETE", "/bursts/"+url.QueryEscape(args[1]), nil, nil); err != nil {
+			fmt.Fprintf(out, "Cannot stop burst %s. Error: %s\n", args[1], err)
+			return 1
+		}
+		return 0
+	}
+
+	flags := flag.NewFlagSet("burst", flag.ContinueOnError)
+	flags.SetOutput(out)
+	instance := flags.String("instance", "", "The name or the identity of the instance, all of them by default")
+	every := flags.Duration("every", 5*time.Second, "How often the instances run during the burst")
+	duration := flags.Duration("for", 15*time.Minute, "How long the burst lasts")
+	verbose := flags.Bool("verbose", false, "Run the plugin with ERRPLANE_VERBOSE=1 and log its output")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	form := url.Values{
+		"plugin":   {args[0]},
+		"instance": {*instance},
+		"every":    {every.String()},
+		"for":      {duration.String()},
+		"verbose":  {fmt.Sprintf("%t", *verbose)},
+	}
+	burst := &Burst{}
+	if err := client.Post("/bursts", form, burst); err != nil {
+		fmt.Fprintf(out, "Cannot start the burst. Error: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "Burst %s: plugin %s runs every %s until %s\n", burst.Id, burst.Plugin, burst.Interval, burst.Expires.Format(time.RFC3339))
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	. "utils"
+)
+
+type BurstSuite struct{}
+
+var _ = Suite(&BurstSuite{})
+
+func (self *BurstSuite) TestBursts(c *C) {
+	registry := NewBursts()
+	_, err := registry.Add("", "", "test", 5*time.Second, time.Minute, false)
+	c.Assert(err, NotNil)
+	_, err = registry.Add("mysql", "", "test", time.Millisecond, time.Minute, false)
+	c.Assert(err, NotNil)
+	_, err = registry.Add("mysql", "", "test", 5*time.Second, 24*time.Hour, false)
+	c.Assert(err, NotNil)
+
+	db1 := &Instance{Name: "db1", Args: map[string]string{"host": "db1"}}
+	db2 := &Instance{Args: map[string]string{"host": "db2"}}
+	all, err := registry.Add("mysql", "", "test", 10*time.Second, time.Minute, false)
+	c.Assert(err, IsNil)
+	_, err = registry.Add("mysql", instanceId("mysql", db2), "test", 5*time.Second, time.Minute, true)
+	c.Assert(err, IsNil)
+	c.Assert(registry.List(), HasLen, 2)
+
+	interval, verbose := applyBursts(registry.List(), "mysql", db1, time.Minute)
+	c.Assert(interval, Equals, 10*time.Second)
+	c.Assert(verbose, Equals, false)
+	interval, verbose = applyBursts(registry.List(), "mysql", db2, time.Minute)
+	c.Assert(interval, Equals, 5*time.Second)
+	c.Assert(verbose, Equals, true)
+	// an instance already running more often keeps its interval
+	interval, _ = applyBursts(registry.List(), "mysql", db1, time.Second)
+	c.Assert(interval, Equals, time.Second)
+	interval, _ = applyBursts(registry.List(), "redis", DEFAULT_INSTANCES[0], time.Minute)
+	c.Assert(interval, Equals, time.Minute)
+
+	c.Assert(registry.Remove(all.Id), Equals, true)
+	c.Assert(registry.Remove(all.Id), Equals, false)
+	interval, _ = applyBursts(registry.List(), "mysql", db1, time.Minute)
+	c.Assert(interval, Equals, time.Minute)
+
+	// expired bursts revert on their own
+	registry.bursts["expired"] = &Burst{Id: "expired", Plugin: "redis", Interval: time.Second, Expires: time.Now().Add(-time.Second)}
+	c.Assert(registry.List(), HasLen, 1)
+}
+
+func (self *BurstSuite) TestBurstCommand(c *C) {
+	defer func() { pluginRegistry = NewPluginRegistry(); bursts = NewBursts() }()
+	pluginRegistry.SetScheduled([]*ScheduledPlugin{
+		&ScheduledPlugin{"mysql/1", &PluginMetadata{Name: "mysql"}, DEFAULT_INSTANCES[0], time.Minute},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			listBursts(w, req)
+		case "POST":
+			addBurst(w, req)
+		}
+	}))
+	defer server.Close()
+	client := &LocalApiClient{&http.Client{}, server.URL, ""}
+
+	out := bytes.NewBufferString("")
+	c.Assert(burstCommand(out, client, []string{"mysql", "-every", "5s", "-for", "10m", "-verbose"}), Equals, 0)
+	c.Assert(out.String(), Matches, "Burst [0-9a-f]+: plugin mysql runs every 5s until .*\n")
+	c.Assert(bursts.List(), HasLen, 1)
+	c.Assert(bursts.List()[0].Verbose, Equals, true)
+
+	out.Reset()
+	c.Assert(burstCommand(out, client, []string{"list"}), Equals, 0)
+	c.Assert(out.String(), Matches, "[0-9a-f]+  mysql/\\*  every 5s  until .*  verbose true  by .*\n")
+
+	out.Reset()
+	c.Assert(burstCommand(out, client, []string{"postgres"}), Equals, 1)
+	c.Assert(out.String(), Matches, "(?s).*No instance of plugin 'postgres' is scheduled.*")
+	c.Assert(burstCommand(out, client, nil), Equals, 2)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the failures that can be simulated in chaos mode
+const (
+	CHAOS_PLUGIN_TIMEOUT = "plugin-timeout" // the plugin instances time out without running
+	CHAOS_PARSE_ERROR    = "parse-error"    // the output of the plugin instances can't be parsed
+	CHAOS_BACKEND_ERROR  = "backend-error"  // the backend answers 500 to the points, they're spooled
+	CHAOS_CLOCK_SKEW     = "clock-skew"     // the timestamps of the points are shifted by the skew
+)
+
+const CHAOS_MAX_DURATION = time.Hour
+
+var CHAOS_KINDS = []string{CHAOS_PLUGIN_TIMEOUT, CHAOS_PARSE_ERROR, CHAOS_BACKEND_ERROR, CHAOS_CLOCK_SKEW}
+
+// A simulated failure, active until it expires, used in integration tests
+// and staging to check the alerts and the spool end to end
+type ChaosFault struct {
+	Id       string        `json:"id"`
+	Kind     string        `json:"kind"`
+	Plugin   string        `json:"plugin,omitempty"`   // the plugin failing, empty for all of them
+	Instance string        `json:"instance,omitempty"` // the name or the identity of the instance, empty for all of them
+	Skew     time.Duration `json:"skew,omitempty"`
+	Author   string        `json:"author"`
+	Created  time.Time     `json:"created"`
+	Expires  time.Time     `json:"expires"`
+}
+
+func (self *ChaosFault) Matches(kind, pluginName string, instance *Instance) bool {
+	if self.Kind != kind {
+		return false
+	}
+	if self.Plugin != "" && self.Plugin != pluginName {
+		return false
+	}
+	return self.Instance == "" || self.Instance == instance.Name || self.Instance == instanceId(pluginName, instance)
+}
+
+type ChaosFaults struct {
+	lock   sync.Mutex
+	faults map[string]*ChaosFault
+}
+
+var chaosFaults = NewChaosFaults()
+
+func NewChaosFaults() *ChaosFaults {
+	return &ChaosFaults{faults: make(map[string]*ChaosFault)}
+}
+
+func (self *ChaosFaults) Add(kind, plugin, instance, author string, skew, duration time.Duration) (*ChaosFault, error) {
+	known := false
+	for _, k := range CHAOS_KINDS {
+		known = known || k == kind
+	}
+	if !known {
+		return nil, fmt.Errorf("Unknown fault '%s'", kind)
+	}
+	if kind == CHAOS_CLOCK_SKEW && skew == 0 {
+		return nil, fmt.Errorf("The clock skew cannot be 0")
+	}
+	if duration <= 0 || duration > CHAOS_MAX_DURATION {
+		return nil, fmt.Errorf("The fault duration must be positive and at most %s", CHAOS_MAX_DURATION)
+	}
+
+	now := time.Now()
+	fault := &ChaosFault{newSilenceId(), kind, plugin, instance, skew, author, now, now.Add(duration)}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.faults[fault.Id] = fault
+	return fault, nil
+}
+
+func (self *ChaosFaults) Remove(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.faults[id]
+	delete(self.faults, id)
+	return ok
+}
+
+// returns the active faults sorted by expiration and forgets about the
+// expired ones
+func (self *ChaosFaults) List() []*ChaosFault {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	list := make([]*ChaosFault, 0, len(self.faults))
+	for id, fault := range self.faults {
+		if !fault.Expires.After(now) {
+			log.Info("Simulated %s %s expired", fault.Kind, id)
+			delete(self.faults, id)
+			continue
+		}
+		list = append(list, fault)
+	}
+	sort.Sort(ChaosFaultsSortableByExpiration(list))
+	return list
+}
+
+// returns the first active fault of the kind matching the instance, nil
+// if there's none or chaos mode is disabled
+func (self *ChaosFaults) Match(kind, pluginName string, instance *Instance) *ChaosFault {
+	if !AgentConfig().ChaosMode {
+		return nil
+	}
+	if instance == nil {
+		instance = &Instance{}
+	}
+	for _, fault := range self.List() {
+		if fault.Matches(kind, pluginName, instance) {
+			return fault
+		}
+	}
+	return nil
+}
+
+// returns the error the backend answers while a backend-error is active
+func (self *ChaosFaults) BackendError() error {
+	if fault := self.Match(CHAOS_BACKEND_ERROR, "", nil); fault != nil {
+		return fmt.Errorf("Received status code 500 (simulated by %s)", fault.Id)
+	}
+	return nil
+}
+
+// returns how much the timestamps of the points are shifted
+func (self *ChaosFaults) Skew() time.Duration {
+	if fault := self.Match(CHAOS_CLOCK_SKEW, "", nil); fault != nil {
+		return fault.Skew
+	}
+	return 0
+}
+
+type ChaosFaultsSortableByExpiration []*ChaosFault
+
+func (self ChaosFaultsSortableByExpiration) Len() int { return len(self) }
+func (self ChaosFaultsSortableByExpiration) Less(i, j int) bool {
+	return self[i].Expires.Before(self[j].Expires)
+}
+func (self ChaosFaultsSortableByExpiration) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// the chaos api doesn't exist unless chaos-mode is set
+func chaosEnabled(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !AgentConfig().ChaosMode {
+			http.NotFound(w, req)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func listChaosFaults(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, chaosFaults.List())
+}
+
+func addChaosFault(w http.ResponseWriter, req *http.Request) {
+	kind, plugin, instance := req.FormValue("fault"), req.FormValue("plugin"), req.FormValue("instance")
+	duration, err := time.ParseDuration(req.FormValue("for"))
+	if err != nil {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+	var skew time.Duration
+	if req.FormValue("skew") != "" {
+		if skew, err = time.ParseDuration(req.FormValue("skew")); err != nil {
+			http.Error(w, "Invalid skew", http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor := requestActor(req)
+	fault, err := chaosFaults.Add(kind, plugin, instance, actor, skew, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit(actor, "add_chaos_fault", "", "", fmt.Sprintf("id=%s fault=%s plugin=%s instance=%s skew=%s duration=%s",
+		fault.Id, kind, plugin, instance, skew, duration))
+	log.Warn("Simulating %s until %s", kind, fault.Expires)
+	writeJson(w, http.StatusOK, fault)
+}
+
+func removeChaosFault(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+
+	audit(requestActor(req), "remove_chaos_fault", "", "", fmt.Sprintf("id=%s", id))
+
+	if !chaosFaults.Remove(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Info("Removed simulated fault %s", id)
+	w.WriteHeader(http.StatusOK)
+}
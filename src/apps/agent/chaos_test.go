@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type ChaosSuite struct{}
+
+var _ = Suite(&ChaosSuite{})
+
+func (self *ChaosSuite) TearDownTest(c *C) {
+	chaosFaults = NewChaosFaults()
+}
+
+func (self *ChaosSuite) TestFaults(c *C) {
+	defer setTestConfig(func(config *Config) { config.ChaosMode = true })()
+	registry := NewChaosFaults()
+	_, err := registry.Add("disk-full", "", "", "test", 0, time.Minute)
+	c.Assert(err, NotNil)
+	_, err = registry.Add(CHAOS_CLOCK_SKEW, "", "", "test", 0, time.Minute)
+	c.Assert(err, NotNil)
+	_, err = registry.Add(CHAOS_BACKEND_ERROR, "", "", "test", 0, 24*time.Hour)
+	c.Assert(err, NotNil)
+
+	db1 := &Instance{Name: "db1", Args: map[string]string{"host": "db1"}}
+	db2 := &Instance{Args: map[string]string{"host": "db2"}}
+	timeout, err := registry.Add(CHAOS_PLUGIN_TIMEOUT, "mysql", instanceId("mysql", db2), "test", 0, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(registry.Match(CHAOS_PLUGIN_TIMEOUT, "mysql", db2), Equals, timeout)
+	c.Assert(registry.Match(CHAOS_PLUGIN_TIMEOUT, "mysql", db1), IsNil)
+	c.Assert(registry.Match(CHAOS_PARSE_ERROR, "mysql", db2), IsNil)
+
+	c.Assert(registry.Skew(), Equals, time.Duration(0))
+	_, err = registry.Add(CHAOS_CLOCK_SKEW, "", "", "test", -10*time.Minute, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(registry.Skew(), Equals, -10*time.Minute)
+
+	// nothing is simulated outside of chaos mode
+	setTestConfig(func(config *Config) { config.ChaosMode = false })
+	c.Assert(registry.Match(CHAOS_PLUGIN_TIMEOUT, "mysql", db2), IsNil)
+	c.Assert(registry.Skew(), Equals, time.Duration(0))
+
+	setTestConfig(func(config *Config) { config.ChaosMode = true })
+	c.Assert(registry.Remove(timeout.Id), Equals, true)
+	c.Assert(registry.Match(CHAOS_PLUGIN_TIMEOUT, "mysql", db2), IsNil)
+
+	registry.faults["expired"] = &ChaosFault{Id: "expired", Kind: CHAOS_BACKEND_ERROR, Expires: time.Now().Add(-time.Second)}
+	c.Assert(registry.BackendError(), IsNil)
+	c.Assert(registry.List(), HasLen, 1)
+}
+
+func (self *ChaosSuite) TestBackendErrorsAreSpooled(c *C) {
+	previous := spool
+	defer func() { spool = previous }()
+	var err error
+	spool, err = NewSpool(c.MkDir(), 1024*1024, time.Hour)
+	c.Assert(err, IsNil)
+
+	defer setTestConfig(func(config *Config) { config.ChaosMode = true })()
+	_, err = chaosFaults.Add(CHAOS_BACKEND_ERROR, "", "", "test", 0, time.Minute)
+	c.Assert(err, IsNil)
+
+	sent := 0
+	send := func(operation *errplane.WriteOperation) error {
+		sent++
+		return nil
+	}
+	c.Assert(deliverHttp(send, spooledOperation("a")), IsNil)
+	c.Assert(sent, Equals, 0)
+	c.Assert(spool.Depth(), Equals, 1)
+}
+
+func (self *ChaosSuite) TestApiIsHiddenOutsideOfChaosMode(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		chaosEnabled(addChaosFault)(w, req)
+	}))
+	defer server.Close()
+	form := url.Values{"fault": {CHAOS_PARSE_ERROR}, "plugin": {"mysql"}, "for": {"5m"}}
+
+	resp, err := http.Post(server.URL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	defer setTestConfig(func(config *Config) { config.ChaosMode = true })()
+	resp, err = http.Post(server.URL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(chaosFaults.Match(CHAOS_PARSE_ERROR, "mysql", DEFAULT_INSTANCES[0]), NotNil)
+	c.Assert(chaosFaults.List()[0].Plugin, Equals, "mysql")
+}
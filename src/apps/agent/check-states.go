@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// the kinds of checks the agent runs
+const (
+	CHECK_PLUGIN  = "plugin"
+	CHECK_HTTP    = "http"
+	CHECK_DNS     = "dns"
+	CHECK_PROCESS = "process"
+	CHECK_COMMAND = "command"
+	CHECK_WINDOWS = "windows"
+	CHECK_MODBUS  = "modbus"
+	CHECK_POWER   = "power"
+)
+
+type CheckState struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Instance  string    `json:"instance,omitempty"`
+	State     string    `json:"state"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// The last known state of every check the agent ran, used to summarize the
+// health of the host
+type CheckStates struct {
+	lock   sync.RWMutex
+	states map[string]*CheckState
+}
+
+var checkStates = NewCheckStates()
+
+func NewCheckStates() *CheckStates {
+	return &CheckStates{states: make(map[string]*CheckState)}
+}
+
+func (self *CheckStates) Set(kind, name, instance, state, msg string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := kind + "/" + name + "/" + instance
+	now := time.Now()
+	if previous, ok := self.states[key]; !ok || previous.State != state {
+		recordHistory(&HistoryEntry{Timestamp: now.Unix(), Kind: HISTORY_STATE, Name: key, State: state, Message: msg})
+	}
+	self.states[key] = &CheckState{kind, name, instance, state, msg, now}
+}
+
+// returns a copy of the check states sorted by kind, name and instance
+func (self *CheckStates) List() []*CheckState {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	keys := make([]string, 0, len(self.states))
+	for key, _ := range self.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	states := make([]*CheckState, 0, len(keys))
+	for _, key := range keys {
+		state := *self.states[key]
+		states = append(states, &state)
+	}
+	return states
+}
+
+var stateSeverity = map[string]int{"ok": 0, "unknown": 1, "warning": 2, STATUS_FLAPPING: 2, "critical": 3}
+
+// returns the worst state of all checks
+func worstState(states []*CheckState) string {
+	worst := "ok"
+	for _, state := range states {
+		if stateSeverity[state.State] > stateSeverity[worst] {
+			worst = state.State
+		}
+	}
+	return worst
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !cgo
+// +build !linux !cgo
+
+package main
+
+import (
+	"fmt"
+	. "utils"
+)
+
+func openCollector(filename string) (Collector, error) {
+	return nil, fmt.Errorf("Cannot load %s, collectors are only supported by linux builds with cgo", filename)
+}
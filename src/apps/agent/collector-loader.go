@@ -0,0 +1,38 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+	. "utils"
+)
+
+// opens a collector built with `go build -buildmode=plugin`, the .so must be
+// built with the same go version and utils package as the agent
+func openCollector(filename string) (Collector, error) {
+	so, err := plugin.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := so.Lookup("CollectorApiVersion")
+	if err != nil {
+		return nil, err
+	}
+	if version, ok := symbol.(*int); !ok || *version != COLLECTOR_API_VERSION {
+		return nil, fmt.Errorf("%s isn't built for the collector api version %d", filename, COLLECTOR_API_VERSION)
+	}
+	symbol, err = so.Lookup("Collector")
+	if err != nil {
+		return nil, err
+	}
+	// the exported variable is looked up as a pointer to it
+	if collector, ok := symbol.(*Collector); ok {
+		return *collector, nil
+	}
+	if collector, ok := symbol.(Collector); ok {
+		return collector, nil
+	}
+	return nil, fmt.Errorf("Collector in %s doesn't implement the collector interface", filename)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+var collectorFileRegex = regexp.MustCompile(`^([a-zA-Z0-9_]+)-([0-9]+(?:\.[0-9]+)*)\.so$`)
+
+// returns the name and version of a collector file, e.g. oracle-1.2.0.so
+func parseCollectorFile(filename string) (string, string, bool) {
+	match := collectorFileRegex.FindStringSubmatch(filename)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// compares two dotted versions numerically, 1.10 is newer than 1.9
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// a .so runs inside the agent, it must be owned by root or the agent user
+// and writable by nobody else
+func checkTrustedFile(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", filename)
+	}
+	if uid, ok := fileOwner(info); ok && uid != 0 && uid != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d", filename, uid)
+	}
+	return nil
+}
+
+type LoadedCollector struct {
+	Name      string
+	Version   string
+	Path      string
+	Collector Collector
+}
+
+// The collectors loaded from the collectors-dir. A newer version of a
+// collector dropped in the directory replaces the running one on the next
+// scan and a removed collector stops being run. Go can't unload a plugin,
+// the replaced versions stay in memory until the agent restarts
+type CollectorRegistry struct {
+	lock       sync.Mutex
+	open       func(filename string) (Collector, error)
+	collectors map[string]*LoadedCollector
+	failed     map[string]bool // the files that couldn't be loaded, not retried
+}
+
+func NewCollectorRegistry(open func(filename string) (Collector, error)) *CollectorRegistry {
+	return &CollectorRegistry{open: open, collectors: make(map[string]*LoadedCollector), failed: make(map[string]bool)}
+}
+
+// returns the latest version of every collector in the directory
+func latestCollectorFiles(dir string) (map[string]*LoadedCollector, error) {
+	if err := checkTrustedFile(dir); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*LoadedCollector)
+	for _, info := range infos {
+		name, version, ok := parseCollectorFile(info.Name())
+		if !ok || info.IsDir() {
+			continue
+		}
+		if current, ok := latest[name]; ok && compareVersions(current.Version, version) >= 0 {
+			continue
+		}
+		latest[name] = &LoadedCollector{Name: name, Version: version, Path: path.Join(dir, info.Name())}
+	}
+	return latest, nil
+}
+
+func (self *CollectorRegistry) Scan(dir string) error {
+	latest, err := latestCollectorFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for name, loaded := range self.collectors {
+		if _, ok := latest[name]; !ok {
+			log.Info("Collector %s %s was removed, not running it anymore", name, loaded.Version)
+			delete(self.collectors, name)
+		}
+	}
+	for name, candidate := range latest {
+		if loaded, ok := self.collectors[name]; ok && loaded.Version == candidate.Version || self.failed[candidate.Path] {
+			continue
+		}
+		if err := self.load(candidate); err != nil {
+			log.Error("Cannot load collector %s. Error: %s", candidate.Path, ExecError(err))
+			self.failed[candidate.Path] = true
+			continue
+		}
+		log.Info("Loaded collector %s %s", name, candidate.Version)
+		self.collectors[name] = candidate
+	}
+	return nil
+}
+
+func (self *CollectorRegistry) load(candidate *LoadedCollector) (err error) {
+	if err := checkTrustedFile(candidate.Path); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	collector, err := self.open(candidate.Path)
+	if err != nil {
+		return err
+	}
+	if err := collector.Init(AgentConfig().CollectorsConfig[candidate.Name]); err != nil {
+		return err
+	}
+	candidate.Collector = collector
+	return nil
+}
+
+func (self *CollectorRegistry) Loaded() []*LoadedCollector {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	loaded := make([]*LoadedCollector, 0, len(self.collectors))
+	for _, collector := range self.collectors {
+		loaded = append(loaded, collector)
+	}
+	return loaded
+}
+
+// runs a collector, a panic in the collector is returned as an error
+// instead of crashing the agent
+func runCollector(loaded *LoadedCollector, now time.Time) (points []*CollectedPoint, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return loaded.Collector.Collect(now)
+}
+
+func runCollectors(ep *errplane.Errplane) {
+	registry := NewCollectorRegistry(openCollector)
+	for {
+		if AgentConfig().CollectorsDir != "" {
+			if err := registry.Scan(AgentConfig().CollectorsDir); err != nil {
+				log.Error("Cannot scan the collectors in %s. Error: %s", AgentConfig().CollectorsDir, err)
+			}
+		}
+		now := time.Now()
+		for _, loaded := range registry.Loaded() {
+			if subsystems.IsStopped(SUBSYSTEM_COLLECTOR + loaded.Name) {
+				continue
+			}
+			points, err := runCollector(loaded, now)
+			if err != nil {
+				log.Error("Collector %s %s failed. Error: %s", loaded.Name, loaded.Version, ExecError(err))
+				continue
+			}
+			for _, point := range points {
+				dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "collector_version": loaded.Version}
+				for name, value := range point.Dimensions {
+					dimensions[name] = value
+				}
+				reportWithContext(ep, loaded.Name+"."+point.Name, point.Value, now, point.Context, dimensions)
+			}
+		}
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type CollectorsSuite struct{}
+
+var _ = Suite(&CollectorsSuite{})
+
+type fakeCollector struct {
+	version string
+	config  map[string]string
+}
+
+func (self *fakeCollector) Init(config map[string]string) error {
+	self.config = config
+	return nil
+}
+
+func (self *fakeCollector) Collect(now time.Time) ([]*CollectedPoint, error) {
+	if self.version == "0.0.1" {
+		panic("boom")
+	}
+	return []*CollectedPoint{{Name: "sessions", Value: 1}}, nil
+}
+
+func (self *CollectorsSuite) TestVersions(c *C) {
+	name, version, ok := parseCollectorFile("oracle_db-1.10.2.so")
+	c.Assert(ok, Equals, true)
+	c.Assert(name, Equals, "oracle_db")
+	c.Assert(version, Equals, "1.10.2")
+	_, _, ok = parseCollectorFile("oracle.so")
+	c.Assert(ok, Equals, false)
+
+	c.Assert(compareVersions("1.10", "1.9"), Equals, 1)
+	c.Assert(compareVersions("1.0", "1"), Equals, 0)
+	c.Assert(compareVersions("1.2", "1.2.1"), Equals, -1)
+}
+
+func (self *CollectorsSuite) TestScan(c *C) {
+	dir := c.MkDir()
+	write := func(filename string, mode os.FileMode) {
+		c.Assert(ioutil.WriteFile(path.Join(dir, filename), nil, mode), IsNil)
+		c.Assert(os.Chmod(path.Join(dir, filename), mode), IsNil)
+	}
+	opened := make([]string, 0)
+	registry := NewCollectorRegistry(func(filename string) (Collector, error) {
+		opened = append(opened, path.Base(filename))
+		name, version, _ := parseCollectorFile(path.Base(filename))
+		if name == "broken" {
+			return nil, fmt.Errorf("plugin was built with a different version of package utils")
+		}
+		return &fakeCollector{version: version}, nil
+	})
+
+	write("oracle-1.9.so", 0644)
+	write("oracle-1.10.so", 0644)
+	write("broken-1.0.so", 0644)
+	write("unsafe-1.0.so", 0666)
+	write("README", 0644)
+	c.Assert(registry.Scan(dir), IsNil)
+	c.Assert(registry.Scan(dir), IsNil)
+	c.Assert(opened, HasLen, 2)
+	loaded := registry.Loaded()
+	c.Assert(loaded, HasLen, 1)
+	c.Assert(loaded[0].Version, Equals, "1.10")
+
+	// a newer version replaces the running one, a removed one is stopped
+	write("oracle-2.0.so", 0644)
+	c.Assert(registry.Scan(dir), IsNil)
+	c.Assert(registry.Loaded()[0].Version, Equals, "2.0")
+	for _, filename := range []string{"oracle-1.9.so", "oracle-1.10.so", "oracle-2.0.so"} {
+		c.Assert(os.Remove(path.Join(dir, filename)), IsNil)
+	}
+	c.Assert(registry.Scan(dir), IsNil)
+	c.Assert(registry.Loaded(), HasLen, 0)
+}
+
+func (self *CollectorsSuite) TestPanickingCollector(c *C) {
+	_, err := runCollector(&LoadedCollector{Name: "oracle", Collector: &fakeCollector{version: "0.0.1"}}, time.Now())
+	c.Assert(err, ErrorMatches, "panic: boom")
+	points, err := runCollector(&LoadedCollector{Name: "oracle", Collector: &fakeCollector{version: "1.0"}}, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 1)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"os/exec"
+	"time"
+	. "utils"
+)
+
+func monitorCommandChecks(ep *errplane.Errplane) {
+	for {
+		for _, check := range AgentConfig().CommandChecks {
+			go runCommandCheck(ep, check)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+// runs the command and maps its exit code to ok or critical, the output of
+// the command is returned for the metrics
+func commandCheckState(check *CommandCheck) (PluginStateOutput, string, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", check.Command)
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return CRITICAL, fmt.Sprintf("Command timed out after %s", check.Timeout), nil
+	}
+
+	exitStatus := 0
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return UNKNOWN, fmt.Sprintf("Cannot run command. Error: %s", err), nil
+		}
+		exitStatus = (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus()
+	}
+
+	succeeded := exitStatus == 0
+	if succeeded != check.Invert {
+		return OK, "", output
+	}
+	return CRITICAL, fmt.Sprintf("Command exited with status %d", exitStatus), output
+}
+
+// A metric parsed from the output of a command check
+type CommandCheckValue struct {
+	metric string
+	value  float64
+	unit   string
+}
+
+// parses the metrics of the check from the output of the command, the
+// metrics that can't be found or parsed are logged and skipped
+func commandCheckValues(check *CommandCheck, output []byte) []*CommandCheckValue {
+	values := make([]*CommandCheckValue, 0, len(check.Metrics))
+	for _, metric := range check.Metrics {
+		raw := string(output)
+		if metric.Regex != nil {
+			match := metric.Regex.FindStringSubmatch(raw)
+			if match == nil {
+				log.Warn("Metric %s of command check %s isn't in the output of the command", metric.Name, check.Name)
+				continue
+			}
+			raw = match[0]
+			if len(match) > 1 {
+				raw = match[1]
+			}
+		}
+		value, unit, err := parseHumanValue(raw, metric.DecimalSeparator)
+		if err != nil {
+			log.Warn("Cannot parse metric %s of command check %s. Error: %s", metric.Name, check.Name, err)
+			continue
+		}
+		values = append(values, &CommandCheckValue{metric.Name, value, unit})
+	}
+	return values
+}
+
+// reports the status as server.checks.command.status and the metrics as
+// server.checks.command.<metric>, with the unit they were normalized to
+func runCommandCheck(ep *errplane.Errplane, check *CommandCheck) {
+	timestamp := time.Now()
+	state, msg, output := commandCheckState(check)
+	if state != OK {
+		log.Debug("Command check %s is %s. %s", check.Name, state.String(), msg)
+	}
+
+	checkStates.Set(CHECK_COMMAND, check.Name, "", state.String(), msg)
+	report(ep, "server.checks.command.status", 1.0, timestamp, errplane.Dimensions{
+		"host":       AgentConfig().Hostname,
+		"check":      check.Name,
+		"status":     state.String(),
+		"status_msg": msg,
+	}, nil)
+
+	if output == nil {
+		return
+	}
+	for _, value := range commandCheckValues(check, output) {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "check": check.Name}
+		if value.unit != "" {
+			dimensions["unit"] = value.unit
+		}
+		report(ep, "server.checks.command."+value.metric, value.value, timestamp, dimensions, nil)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"regexp"
+	"time"
+	. "utils"
+)
+
+type CommandCheckSuite struct{}
+
+var _ = Suite(&CommandCheckSuite{})
+
+func (self *CommandCheckSuite) TestExitCodeMapping(c *C) {
+	check := &CommandCheck{Name: "test", Command: "true", Timeout: time.Second}
+	state, _, _ := commandCheckState(check)
+	c.Assert(state, Equals, OK)
+
+	check.Command = "exit 3"
+	state, msg, _ := commandCheckState(check)
+	c.Assert(state, Equals, CRITICAL)
+	c.Assert(msg, Equals, "Command exited with status 3")
+
+	check.Invert = true
+	state, _, _ = commandCheckState(check)
+	c.Assert(state, Equals, OK)
+
+	check.Command = "true"
+	state, _, _ = commandCheckState(check)
+	c.Assert(state, Equals, CRITICAL)
+}
+
+func (self *CommandCheckSuite) TestTimeout(c *C) {
+	check := &CommandCheck{Name: "test", Command: "sleep 5", Timeout: 100 * time.Millisecond}
+	state, msg, _ := commandCheckState(check)
+	c.Assert(state, Equals, CRITICAL)
+	c.Assert(msg, Matches, "Command timed out.*")
+}
+
+func (self *CommandCheckSuite) TestHumanValues(c *C) {
+	for raw, expected := range map[string]float64{
+		"1.2G":    1.2 * (1 << 30),
+		"512K":    512 * 1024,
+		"3.5 MiB": 3.5 * (1 << 20),
+		"345ms":   0.345,
+		"2h":      7200,
+		"5m":      300,
+		"3 days":  3 * 86400,
+		"87%":     87,
+		"1,234.5": 1234.5,
+		"-42":     -42,
+		" 17\n":   17,
+	} {
+		value, _, err := parseHumanValue(raw, ".")
+		c.Assert(err, IsNil, Commentf("value: %s", raw))
+		c.Assert(value, Equals, expected, Commentf("value: %s", raw))
+	}
+
+	value, unit, err := parseHumanValue("1.234,5K", ",")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, 1234.5*1024)
+	c.Assert(unit, Equals, UNIT_BYTES)
+	value, _, _ = parseHumanValue("1,2G", ",")
+	c.Assert(value, Equals, 1.2*(1<<30))
+	_, unit, _ = parseHumanValue("87%", ".")
+	c.Assert(unit, Equals, UNIT_PERCENT)
+	_, unit, _ = parseHumanValue("42", ".")
+	c.Assert(unit, Equals, "")
+
+	_, _, err = parseHumanValue("12 parsecs", ".")
+	c.Assert(err, ErrorMatches, "Unknown unit 'parsecs'.*")
+	_, _, err = parseHumanValue("n/a", ".")
+	c.Assert(err, ErrorMatches, ".*isn't a number")
+}
+
+func (self *CommandCheckSuite) TestMetrics(c *C) {
+	check := &CommandCheck{Name: "disk", Command: "printf '/dev/sda1  20G  17G  3.1G  85%% /'", Timeout: time.Second, Metrics: []*CommandMetric{
+		&CommandMetric{Name: "used", Regex: regexp.MustCompile(`^\S+\s+\S+\s+(\S+)`), DecimalSeparator: "."},
+		&CommandMetric{Name: "used_percent", Regex: regexp.MustCompile(`\d+%`), DecimalSeparator: "."},
+		&CommandMetric{Name: "inodes", Regex: regexp.MustCompile(`inodes (\d+)`), DecimalSeparator: "."},
+	}}
+	state, _, output := commandCheckState(check)
+	c.Assert(state, Equals, OK)
+
+	values := commandCheckValues(check, output)
+	c.Assert(values, HasLen, 2)
+	c.Assert(*values[0], Equals, CommandCheckValue{"used", 17 * (1 << 30), UNIT_BYTES})
+	c.Assert(*values[1], Equals, CommandCheckValue{"used_percent", 85, UNIT_PERCENT})
+}
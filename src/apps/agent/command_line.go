@@ -2,6 +2,7 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"fmt"
 	"github.com/bmizerany/pat"
 	"github.com/pmylund/go-cache"
 	"io/ioutil"
@@ -23,19 +24,54 @@ func startLocalServer() {
 
 	m := pat.New()
 
-	m.Get("/stop_monitoring/:process", http.HandlerFunc(stopMonitoring))
-	m.Get("/start_monitoring/:process", http.HandlerFunc(startMonitoring))
-	m.Get("/restart_process/:process", http.HandlerFunc(restartProcess))
+	m.Get("/stop_monitoring/:process", authorize(SCOPE_PROCESSES, stopMonitoring))
+	m.Get("/start_monitoring/:process", authorize(SCOPE_PROCESSES, startMonitoring))
+	m.Get("/restart_process/:process", authorize(SCOPE_PROCESSES, restartProcess))
+	m.Get("/silences", authorize(SCOPE_READ, listSilences))
+	m.Post("/silences", authorize(SCOPE_WRITE, addSilence))
+	m.Del("/silences/:id", authorize(SCOPE_WRITE, removeSilence))
+	m.Get("/plugins", authorize(SCOPE_READ, listPlugins))
+	m.Get("/plugins/:plugin", authorize(SCOPE_READ, showPlugin))
+	m.Post("/plugins/:plugin/run", authorize(SCOPE_ADMIN, runPluginNow))
+	m.Get("/maintenance", authorize(SCOPE_READ, listMaintenance))
+	m.Post("/maintenance", authorize(SCOPE_WRITE, addMaintenance))
+	m.Del("/maintenance/:id", authorize(SCOPE_WRITE, removeMaintenance))
+	m.Get("/bursts", authorize(SCOPE_READ, listBursts))
+	m.Post("/bursts", authorize(SCOPE_ADMIN, addBurst))
+	m.Del("/bursts/:id", authorize(SCOPE_ADMIN, removeBurst))
+	m.Get("/alerts", authorize(SCOPE_READ, listAlerts))
+	m.Get("/subsystems", authorize(SCOPE_READ, listSubsystems))
+	m.Post("/subsystems/:subsystem/stop", authorize(SCOPE_ADMIN, stopSubsystem))
+	m.Post("/subsystems/:subsystem/start", authorize(SCOPE_ADMIN, startSubsystem))
+	m.Get("/chaos", authorize(SCOPE_READ, chaosEnabled(listChaosFaults)))
+	m.Post("/chaos", authorize(SCOPE_ADMIN, chaosEnabled(addChaosFault)))
+	m.Del("/chaos/:id", authorize(SCOPE_ADMIN, chaosEnabled(removeChaosFault)))
+	m.Get("/config", authorize(SCOPE_READ, dumpConfig))
+	m.Post("/config/reload", authorize(SCOPE_ADMIN, reloadConfigNow))
+	m.Get("/health", authorize(SCOPE_READ, agentHealth))
+	m.Get("/errors", authorize(SCOPE_READ, listRecentErrors))
+	m.Get("/dashboard", http.HandlerFunc(dashboard))
+	m.Get("/dashboard/data", authorize(SCOPE_READ, dashboardData))
 
 	// Register this pat with the default serve mux so that other packages
 	// may also be exported. (i.e. /debug/pprof/*)
 	http.Handle("/", m)
+	if AgentConfig().ApiSocket != "" {
+		go serveUnixSocket(AgentConfig().ApiSocket)
+	}
+
 	c, err := net.Listen("tcp4", "localhost:")
 	if err != nil {
 		log.Error("Error while opening port for listening: %s", err)
 		return
 	}
 
+	c, err = apiListener(c)
+	if err != nil {
+		log.Error("Error while setting up tls for the local api. Error: %s", err)
+		return
+	}
+
 	_, port, _ := net.SplitHostPort(c.Addr().String())
 	if err := ioutil.WriteFile(PORT_FILE, []byte(port), 0644); err != nil {
 		log.Error("Error while writing port number to %s", PORT_FILE)
@@ -116,6 +152,8 @@ func stopMonitoring(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	audit(requestActor(req), "stop_monitoring", "", "", fmt.Sprintf("process=%s duration=%s", processName, duration))
+
 	if err := snoozeProcess(processName, timeDuration); err != nil {
 		log.Warn("Error while snoozing process. Error: %s", err)
 		if _, ok := err.(*InvalidProcessName); ok {
@@ -132,6 +170,8 @@ func stopMonitoring(w http.ResponseWriter, req *http.Request) {
 func startMonitoring(w http.ResponseWriter, req *http.Request) {
 	processName := req.URL.Query().Get(":process")
 
+	audit(requestActor(req), "start_monitoring", "", "", fmt.Sprintf("process=%s", processName))
+
 	if err := unsnoozeProcess(processName); err != nil {
 		log.Warn("Error while unsnoozing process. Error: %s", err)
 		if _, ok := err.(*InvalidProcessName); ok {
@@ -148,6 +188,8 @@ func startMonitoring(w http.ResponseWriter, req *http.Request) {
 func restartProcess(w http.ResponseWriter, req *http.Request) {
 	processName := req.URL.Query().Get(":process")
 
+	audit(requestActor(req), "restart_process", "", "", fmt.Sprintf("process=%s", processName))
+
 	process, err := getProcess(processName)
 
 	if err != nil {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// A new backend configuration on probation, the last good configuration is
+// kept to revert to it if the plugin failures spike before the bake period
+// is over
+type ConfigBake struct {
+	previous     *AgentConfiguration
+	previousHash string
+	hash         string
+	started      time.Time
+	baseline     float64          // the failure rate of the previous configuration
+	counts       map[string]int64 // the agent stats when the new configuration was applied
+	rate         float64          // the failure rate that got the configuration reverted
+}
+
+// Bakes the configurations applied by the plugins scheduler, only used by
+// its goroutine
+type ConfigBaker struct {
+	bake     *ConfigBake      // the configuration baking, nil if none is
+	applied  map[string]int64 // the agent stats when the current configuration was applied
+	rejected string           // the hash of the configuration reverted, ignored until the backend changes it
+}
+
+func NewConfigBaker() *ConfigBaker {
+	return &ConfigBaker{applied: make(map[string]int64)}
+}
+
+// returns the ratio of the plugin runs that failed, timed out or printed an
+// output that couldn't be parsed between the since and the counts stats,
+// and the number of such runs
+func pluginFailureRate(counts, since map[string]int64) (float64, int64) {
+	failures := int64(0)
+	for _, stat := range []string{STAT_PLUGIN_FAILURES, STAT_PLUGIN_TIMEOUTS, STAT_PARSE_ERRORS} {
+		failures += counts[stat] - since[stat]
+	}
+	runs := counts[STAT_PLUGIN_RUNS] - since[STAT_PLUGIN_RUNS]
+	if runs <= 0 {
+		return 0, failures
+	}
+	return float64(failures) / float64(runs), failures
+}
+
+// returns false if the backend still serves the configuration that was
+// reverted, any other configuration can be applied again
+func (self *ConfigBaker) Accept(hash string) bool {
+	if hash == self.rejected {
+		return false
+	}
+	self.rejected = ""
+	return true
+}
+
+// starts baking the configuration that was just applied, the first one the
+// backend sends isn't baked. A configuration replacing one that's still
+// baking is baked from the start with the same last good configuration.
+func (self *ConfigBaker) Applied(previous *AgentConfiguration, previousHash, hash string, now time.Time, counts map[string]int64) {
+	defer func() { self.applied = counts }()
+	if AgentConfig().ConfigBake.Period <= 0 || previous == nil || previousHash == "" {
+		return
+	}
+	if self.bake != nil {
+		self.bake.hash, self.bake.started, self.bake.counts = hash, now, counts
+		return
+	}
+	baseline, _ := pluginFailureRate(counts, self.applied)
+	self.bake = &ConfigBake{
+		previous:     previous,
+		previousHash: previousHash,
+		hash:         hash,
+		started:      now,
+		baseline:     baseline,
+		counts:       counts,
+	}
+	log.Info("Baking the configuration %s for %s", shortHash(hash), AgentConfig().ConfigBake.Period)
+}
+
+// returns the bake of the configuration to revert to the last good one if
+// the plugin failures spiked since it was applied, nil otherwise
+func (self *ConfigBaker) Check(now time.Time, counts map[string]int64) *ConfigBake {
+	bake := self.bake
+	if bake == nil {
+		return nil
+	}
+
+	config := &AgentConfig().ConfigBake
+	rate, failures := pluginFailureRate(counts, bake.counts)
+	if failures >= config.MinFailures && rate > bake.baseline*config.FailureSpike {
+		bake.rate = rate
+		self.bake, self.applied, self.rejected = nil, counts, bake.hash
+		return bake
+	}
+	if now.Sub(bake.started) >= config.Period {
+		log.Info("The configuration %s baked for %s, keeping it", shortHash(bake.hash), config.Period)
+		self.bake = nil
+	}
+	return nil
+}
+
+// the configuration was reverted, it's logged, audited and reported as an
+// agent.config_reverted event, and the previous configuration is cached
+// again so a restart doesn't run the reverted one
+func reportConfigRevert(ep *errplane.Errplane, bake *ConfigBake) {
+	body := fmt.Sprintf("%.0f%% of the plugin runs failed since the configuration %s was applied, %.0f%% failed with the configuration %s",
+		bake.rate*100, shortHash(bake.hash), bake.baseline*100, shortHash(bake.previousHash))
+	log.Error("Reverted the configuration %s to %s. %s", shortHash(bake.hash), shortHash(bake.previousHash), body)
+	audit("agent", "config_reverted", bake.hash, bake.previousHash, body)
+
+	context, _ := json.Marshal(&eventAnnotation{"Configuration reverted", body, EVENT_SEVERITY_CRITICAL})
+	reportWithContext(ep, "agent.config_reverted", 1.0, time.Now(), string(context), errplane.Dimensions{
+		"host":     AgentConfig().Hostname,
+		"severity": EVENT_SEVERITY_CRITICAL,
+	})
+	CacheAgentConfiguration(bake.previous)
+}
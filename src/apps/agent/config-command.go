@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"sort"
+	"strings"
+	. "utils"
+)
+
+// The effective configuration of the agent, the local configuration file
+// with the defaults applied and the plugins and processes configured on
+// the backend
+type ConfigExport struct {
+	Agent   Config              `yaml:"agent"`
+	Backend *AgentConfiguration `yaml:"backend,omitempty"`
+}
+
+// returns the effective configuration without the secrets, the backend
+// part only has the local plugins if it cannot be fetched
+func exportConfig() (*ConfigExport, error) {
+	export := &ConfigExport{Agent: redactedConfig()}
+	backend, err := GetPluginsToRun()
+	export.Backend = MergeLocalPlugins(backend, LocalPlugins.Get(), AgentConfig().LocalPluginsMode)
+	if err != nil {
+		return export, fmt.Errorf("Cannot get the configuration from the backend. Error: %s", err)
+	}
+	return export, nil
+}
+
+// flattens a yaml document to its leaves, e.g. agent.http-checks[0].url
+func flattenYaml(prefix string, value interface{}, leaves map[string]string) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, child := range v {
+			name := fmt.Sprint(key)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenYaml(name, child, leaves)
+		}
+	case []interface{}:
+		for idx, child := range v {
+			flattenYaml(fmt.Sprintf("%s[%d]", prefix, idx), child, leaves)
+		}
+	case nil:
+		// empty values and missing values are the same thing
+	default:
+		leaves[prefix] = fmt.Sprint(v)
+	}
+}
+
+type ConfigDifference struct {
+	Key         string
+	Golden      string
+	Effective   string
+	InGolden    bool
+	InEffective bool
+}
+
+func (self *ConfigDifference) String() string {
+	switch {
+	case !self.InGolden:
+		return fmt.Sprintf("+ %s: %s", self.Key, self.Effective)
+	case !self.InEffective:
+		return fmt.Sprintf("- %s: %s", self.Key, self.Golden)
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", self.Key, self.Golden, self.Effective)
+	}
+}
+
+// returns the differences between two exported configurations, sorted by key
+func diffConfigs(golden, effective []byte) ([]*ConfigDifference, error) {
+	var goldenDoc, effectiveDoc interface{}
+	if err := goyaml.Unmarshal(golden, &goldenDoc); err != nil {
+		return nil, fmt.Errorf("Cannot parse the golden configuration. Error: %s", err)
+	}
+	if err := goyaml.Unmarshal(effective, &effectiveDoc); err != nil {
+		return nil, fmt.Errorf("Cannot parse the effective configuration. Error: %s", err)
+	}
+
+	goldenLeaves, effectiveLeaves := make(map[string]string), make(map[string]string)
+	flattenYaml("", goldenDoc, goldenLeaves)
+	flattenYaml("", effectiveDoc, effectiveLeaves)
+
+	keys := make([]string, 0, len(goldenLeaves))
+	for key, _ := range goldenLeaves {
+		keys = append(keys, key)
+	}
+	for key, _ := range effectiveLeaves {
+		if _, ok := goldenLeaves[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	differences := make([]*ConfigDifference, 0)
+	for _, key := range keys {
+		goldenValue, inGolden := goldenLeaves[key]
+		effectiveValue, inEffective := effectiveLeaves[key]
+		if inGolden && inEffective && goldenValue == effectiveValue {
+			continue
+		}
+		differences = append(differences, &ConfigDifference{key, goldenValue, effectiveValue, inGolden, inEffective})
+	}
+	return differences, nil
+}
+
+// returns the origin of the backend setting, the layer the plugin or the
+// process comes from
+func backendOrigin(key string, backend *AgentConfiguration) string {
+	var origin string
+	if strings.HasPrefix(key, "backend.plugins.") {
+		name := strings.TrimPrefix(key, "backend.plugins.")
+		if idx := strings.IndexAny(name, ".["); idx >= 0 {
+			name = name[:idx]
+		}
+		origin = backend.Origins["plugins."+name]
+	} else if strings.HasPrefix(key, "backend.processes[") {
+		var idx int
+		if _, err := fmt.Sscanf(key, "backend.processes[%d]", &idx); err == nil && idx < len(backend.Processes) {
+			origin = backend.Origins["processes."+backend.Processes[idx].Nickname]
+		}
+	}
+	if origin == "" {
+		return "backend"
+	}
+	return origin
+}
+
+// returns where every setting of the exported configuration comes from,
+// the last layer setting it to its effective value. The settings none of
+// the layers has are defaults.
+func settingOrigins(leaves map[string]string, layers []*ConfigLayer, backend *AgentConfiguration) map[string]string {
+	layerLeaves := make([]map[string]string, 0, len(layers))
+	for _, layer := range layers {
+		flattened := make(map[string]string)
+		flattenYaml("agent", layer.Content, flattened)
+		layerLeaves = append(layerLeaves, flattened)
+	}
+
+	origins := make(map[string]string, len(leaves))
+	for key, value := range leaves {
+		if strings.HasPrefix(key, "backend.") && backend != nil {
+			origins[key] = backendOrigin(key, backend)
+			continue
+		}
+		origins[key] = "default"
+		for idx := len(layers) - 1; idx >= 0; idx-- {
+			// the secrets are redacted, the layer setting them is the origin
+			if layerValue, ok := layerLeaves[idx][key]; ok && (layerValue == value || value == REDACTED) {
+				origins[key] = layers[idx].Name
+				break
+			}
+		}
+	}
+	return origins
+}
+
+// agent config export, agent config layers and agent config diff <file>.
+// The diff exits with 0 if the configurations are the same, 1 if they
+// differ and 2 on errors, like diff(1).
+func configCommand(out io.Writer, args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "diff" && args[0] != "layers") || (args[0] == "diff" && len(args) < 2) {
+		fmt.Fprintf(out, "Usage: agent [-config file] config export\n       agent [-config file] config layers\n"+
+			"       agent [-config file] config diff <exported golden config>\n")
+		return 2
+	}
+
+	export, err := exportConfig()
+	if err != nil {
+		// still useful without the backend, e.g. to review a local change
+		fmt.Fprintf(out, "# %s\n", err)
+	}
+	data, err := goyaml.Marshal(export)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot serialize the configuration. Error: %s\n", err)
+		return 2
+	}
+
+	if args[0] == "export" {
+		out.Write(data)
+		return 0
+	}
+
+	if args[0] == "layers" {
+		var doc interface{}
+		if err := goyaml.Unmarshal(data, &doc); err != nil {
+			fmt.Fprintf(out, "Cannot parse the configuration. Error: %s\n", err)
+			return 2
+		}
+		leaves := make(map[string]string)
+		flattenYaml("", doc, leaves)
+		origins := settingOrigins(leaves, AgentConfig().Layers, export.Backend)
+
+		keys := make([]string, 0, len(leaves))
+		for key, _ := range leaves {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s: %s  # %s\n", key, leaves[key], origins[key])
+		}
+		return 0
+	}
+
+	golden, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		fmt.Fprintf(out, "Cannot read %s. Error: %s\n", args[1], err)
+		return 2
+	}
+	differences, err := diffConfigs(golden, data)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+		return 2
+	}
+	for _, difference := range differences {
+		fmt.Fprintf(out, "%s\n", difference)
+	}
+	if len(differences) > 0 {
+		return 1
+	}
+	return 0
+}
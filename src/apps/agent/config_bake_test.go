@@ -0,0 +1,55 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type ConfigBakeSuite struct{}
+
+var _ = Suite(&ConfigBakeSuite{})
+
+func (self *ConfigBakeSuite) TestConfigBake(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.ConfigBake = ConfigBakeConfig{Period: time.Minute, FailureSpike: 2, MinFailures: 5}
+	})()
+
+	good := &AgentConfiguration{Processes: []*Process{&Process{Nickname: "nginx"}}}
+	baker := NewConfigBaker()
+	now := time.Now()
+
+	// the first configuration of the backend isn't baked
+	c.Assert(baker.Accept("good"), Equals, true)
+	baker.Applied(nil, "", "good", now, map[string]int64{})
+	c.Assert(baker.bake, IsNil)
+
+	// 1 failure in 10 runs with the good configuration, then 6 in 10
+	baker.Applied(good, "good", "bad", now, map[string]int64{STAT_PLUGIN_RUNS: 10, STAT_PLUGIN_FAILURES: 1})
+	c.Assert(baker.bake, NotNil)
+	c.Assert(baker.bake.baseline, Equals, 0.1)
+
+	c.Assert(baker.Check(now, map[string]int64{STAT_PLUGIN_RUNS: 20, STAT_PLUGIN_FAILURES: 2, STAT_PLUGIN_TIMEOUTS: 1}), IsNil)
+	bake := baker.Check(now, map[string]int64{STAT_PLUGIN_RUNS: 20, STAT_PLUGIN_FAILURES: 5, STAT_PARSE_ERRORS: 2})
+	c.Assert(bake, NotNil)
+	c.Assert(bake.rate, Equals, 0.6)
+	c.Assert(bake.previous, Equals, good)
+	c.Assert(bake.previousHash, Equals, "good")
+	c.Assert(baker.bake, IsNil)
+
+	// the backend still serving the reverted configuration doesn't apply it again
+	c.Assert(baker.Accept("bad"), Equals, false)
+	c.Assert(baker.Accept("fixed"), Equals, true)
+	c.Assert(baker.Accept("bad"), Equals, true)
+
+	// a bake without a spike ends after the period
+	baker.Applied(good, "good", "fixed", now, map[string]int64{STAT_PLUGIN_RUNS: 30})
+	c.Assert(baker.bake, NotNil)
+	c.Assert(baker.Check(now.Add(2*time.Minute), map[string]int64{STAT_PLUGIN_RUNS: 40, STAT_PLUGIN_FAILURES: 1}), IsNil)
+	c.Assert(baker.bake, IsNil)
+
+	// nothing is baked without a period
+	setTestConfig(func(config *Config) { config.ConfigBake.Period = 0 })
+	baker.Applied(good, "fixed", "other", now, map[string]int64{})
+	c.Assert(baker.bake, IsNil)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	. "utils"
+)
+
+type ConfigCacheSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&ConfigCacheSuite{})
+
+func (self *ConfigCacheSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	config.ConfigCache = path.Join(c.MkDir(), "backend-configuration.json")
+	SetAgentConfig(&config)
+}
+
+func (self *ConfigCacheSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+}
+
+func (self *ConfigCacheSuite) TestCacheLastGoodConfiguration(c *C) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"plugins": {"mysql": [{"Name": "db1", "Env": {"MYSQL_PWD": "secret"}}]}}`))
+	}))
+	defer server.Close()
+	setTestConfig(func(config *Config) { config.ConfigService = server.Listener.Addr().String() })
+
+	_, err := GetCachedPluginsToRun()
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = GetPluginsToRun()
+	c.Assert(err, IsNil)
+	info, err := os.Stat(AgentConfig().ConfigCache)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// the backend fails after a restart, the cached configuration is run
+	status = http.StatusInternalServerError
+	_, err = GetPluginsToRun()
+	c.Assert(err, NotNil)
+	config, err := GetCachedPluginsToRun()
+	c.Assert(err, IsNil)
+	c.Assert(config.Plugins["mysql"][0].Name, Equals, "db1")
+}
+
+func (self *ConfigCacheSuite) TestNoConfigCache(c *C) {
+	setTestConfig(func(config *Config) { config.NoConfigCache = true })
+	c.Assert(ioutil.WriteFile(AgentConfig().ConfigCache, []byte(`{"plugins": {}}`), 0600), IsNil)
+	_, err := GetCachedPluginsToRun()
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	. "utils"
+)
+
+type ConfigCommandSuite struct{}
+
+var _ = Suite(&ConfigCommandSuite{})
+
+func (self *ConfigCommandSuite) TestDiffConfigs(c *C) {
+	golden := []byte(`
+agent:
+  sleep: 10s
+  http-checks:
+  - name: api
+    url: http://localhost/api
+  - name: web
+    url: http://localhost/
+backend:
+  plugins:
+    redis:
+    - args:
+        port: "6379"
+`)
+	effective := []byte(`
+agent:
+  sleep: 20s
+  http-checks:
+  - name: api
+    url: http://localhost/api
+  log-level: debug
+backend:
+  plugins:
+    redis:
+    - args:
+        port: "6379"
+`)
+	differences, err := diffConfigs(golden, effective)
+	c.Assert(err, IsNil)
+	lines := make([]string, 0, len(differences))
+	for _, difference := range differences {
+		lines = append(lines, difference.String())
+	}
+	c.Assert(lines, DeepEquals, []string{
+		"- agent.http-checks[1].name: web",
+		"- agent.http-checks[1].url: http://localhost/",
+		"+ agent.log-level: debug",
+		"~ agent.sleep: 10s -> 20s",
+	})
+
+	differences, err = diffConfigs(golden, golden)
+	c.Assert(err, IsNil)
+	c.Assert(differences, HasLen, 0)
+}
+
+func (self *ConfigCommandSuite) TestSettingOrigins(c *C) {
+	layers := []*ConfigLayer{
+		&ConfigLayer{Name: "config.yml", Content: map[interface{}]interface{}{"sleep": "10s", "api-key": "secret", "log-level": "info"}},
+		&ConfigLayer{Name: "web.yml", Content: map[interface{}]interface{}{"log-level": "debug"}},
+	}
+	backend := &AgentConfiguration{
+		Processes: []*Process{&Process{Nickname: "nginx"}},
+		Origins:   map[string]string{"plugins.redis": "role:cache", "processes.nginx": "backend"},
+	}
+	leaves := map[string]string{
+		"agent.sleep":                     "10s",
+		"agent.api-key":                   REDACTED,
+		"agent.log-level":                 "debug",
+		"agent.top-n-processes":           "10",
+		"backend.plugins.redis[0].name":   "cache",
+		"backend.processes[0].nickname":   "nginx",
+		"backend.plugins.unknown[0].name": "foo",
+	}
+	c.Assert(settingOrigins(leaves, layers, backend), DeepEquals, map[string]string{
+		"agent.sleep":                     "config.yml",
+		"agent.api-key":                   "config.yml",
+		"agent.log-level":                 "web.yml",
+		"agent.top-n-processes":           "default",
+		"backend.plugins.redis[0].name":   "role:cache",
+		"backend.processes[0].nickname":   "backend",
+		"backend.plugins.unknown[0].name": "backend",
+	})
+}
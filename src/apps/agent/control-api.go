@@ -0,0 +1,335 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goyaml"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	REDACTED = "****"
+)
+
+var agentStart = time.Now()
+
+// The last run of a plugin instance as seen by the agent
+type PluginRun struct {
+	Output     string        `json:"output"`
+	ExitStatus int           `json:"exit_status"`
+	TimedOut   bool          `json:"timed_out,omitempty"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// The plugin instances the scheduler runs and their last run, shared
+// between the scheduler and the local api
+type PluginRegistry struct {
+	lock      sync.RWMutex
+	scheduled []*ScheduledPlugin
+	runs      map[string][]*PluginRun // the runs of the last hour, oldest first
+	triggers  chan string
+	reloads   chan bool
+}
+
+var pluginRegistry = NewPluginRegistry()
+
+func NewPluginRegistry() *PluginRegistry {
+	return &PluginRegistry{
+		scheduled: make([]*ScheduledPlugin, 0),
+		runs:      make(map[string][]*PluginRun),
+		triggers:  make(chan string, 100),
+		reloads:   make(chan bool, 1),
+	}
+}
+
+func (self *PluginRegistry) SetScheduled(scheduled []*ScheduledPlugin) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.scheduled = scheduled
+}
+
+// returns the scheduled instances of the plugin, or all of them if the
+// plugin name is empty. The instance can be either the name or the
+// identity of the instance, an empty instance matches all of them.
+func (self *PluginRegistry) Find(plugin, instance string) []*ScheduledPlugin {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	found := make([]*ScheduledPlugin, 0)
+	for _, s := range self.scheduled {
+		if plugin != "" && s.plugin.Name != plugin {
+			continue
+		}
+		if instance != "" && s.instance.Name != instance && instanceId(s.plugin.Name, s.instance) != instance {
+			continue
+		}
+		found = append(found, s)
+	}
+	return found
+}
+
+func (self *PluginRegistry) RecordRun(key string, run *PluginRun) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	runs := self.runs[key]
+	threshold := run.Start.Add(-DASHBOARD_HISTORY)
+	for len(runs) > 0 && runs[0].Start.Before(threshold) {
+		runs = runs[1:]
+	}
+	self.runs[key] = append(runs, run)
+}
+
+func (self *PluginRegistry) LastRun(key string) *PluginRun {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	runs := self.runs[key]
+	if len(runs) == 0 {
+		return nil
+	}
+	return runs[len(runs)-1]
+}
+
+// returns the runs of the instance during the last hour
+func (self *PluginRegistry) Runs(key string) []*PluginRun {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return append([]*PluginRun{}, self.runs[key]...)
+}
+
+// asks the scheduler to run the instance on its next tick, returns false
+// if too many runs are already waiting
+func (self *PluginRegistry) Trigger(key string) bool {
+	select {
+	case self.triggers <- key:
+		return true
+	default:
+		return false
+	}
+}
+
+// returns the instances that were triggered since the last call
+func (self *PluginRegistry) Triggered() map[string]bool {
+	triggered := make(map[string]bool)
+	for {
+		select {
+		case key := <-self.triggers:
+			triggered[key] = true
+		default:
+			return triggered
+		}
+	}
+}
+
+// asks the scheduler to refresh its configuration on its next tick
+func (self *PluginRegistry) Reload() {
+	select {
+	case self.reloads <- true:
+	default:
+		// a reload is already pending
+	}
+}
+
+// returns true if a reload was asked since the last call
+func (self *PluginRegistry) Reloaded() bool {
+	select {
+	case <-self.reloads:
+		return true
+	default:
+		return false
+	}
+}
+
+type PluginStatus struct {
+	Plugin     string        `json:"plugin"`
+	Instance   string        `json:"instance,omitempty"`
+	InstanceId string        `json:"instance_id"`
+	Interval   time.Duration `json:"interval"`
+	Timeout    time.Duration `json:"timeout"`
+	State      *CheckState   `json:"state,omitempty"`
+	LastRun    *PluginRun    `json:"last_run,omitempty"`
+	Runs       []*PluginRun  `json:"runs,omitempty"`
+}
+
+func pluginStatusesWithRuns(scheduled []*ScheduledPlugin) []*PluginStatus {
+	statuses := pluginStatuses(scheduled)
+	for idx, s := range scheduled {
+		statuses[idx].Runs = pluginRegistry.Runs(s.key)
+	}
+	return statuses
+}
+
+func pluginStatuses(scheduled []*ScheduledPlugin) []*PluginStatus {
+	states := make(map[string]*CheckState)
+	for _, state := range checkStates.List() {
+		if state.Kind == CHECK_PLUGIN {
+			states[state.Name+"/"+state.Instance] = state
+		}
+	}
+
+	statuses := make([]*PluginStatus, 0, len(scheduled))
+	for _, s := range scheduled {
+		id := instanceId(s.plugin.Name, s.instance)
+		statuses = append(statuses, &PluginStatus{
+			Plugin:     s.plugin.Name,
+			Instance:   s.instance.Name,
+			InstanceId: id,
+			Interval:   s.interval,
+			Timeout:    pluginTimeout(s.plugin, s.instance),
+			State:      states[s.plugin.Name+"/"+instanceLabel(id, s.instance)],
+			LastRun:    pluginRegistry.LastRun(s.key),
+		})
+	}
+	return statuses
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func listPlugins(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, pluginStatuses(pluginRegistry.Find("", "")))
+}
+
+func showPlugin(w http.ResponseWriter, req *http.Request) {
+	scheduled := pluginRegistry.Find(req.URL.Query().Get(":plugin"), req.URL.Query().Get("instance"))
+	if len(scheduled) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, pluginStatuses(scheduled))
+}
+
+func runPluginNow(w http.ResponseWriter, req *http.Request) {
+	plugin, instance := req.URL.Query().Get(":plugin"), req.FormValue("instance")
+
+	audit(requestActor(req), "run_plugin", "", "", fmt.Sprintf("plugin=%s instance=%s", plugin, instance))
+
+	scheduled := pluginRegistry.Find(plugin, instance)
+	if len(scheduled) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	for _, s := range scheduled {
+		if !pluginRegistry.Trigger(s.key) {
+			http.Error(w, "Too many runs are waiting", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	log.Info("Triggered %d instances of plugin %s", len(scheduled), plugin)
+	writeJson(w, http.StatusAccepted, pluginStatuses(scheduled))
+}
+
+// returns a copy of the agent configuration without the secrets
+func redactedConfig() Config {
+	config := *AgentConfig()
+	if config.ApiKey != "" {
+		config.ApiKey = REDACTED
+	}
+
+	tokens := make([]*ApiToken, 0, len(config.ApiTokens))
+	for _, token := range config.ApiTokens {
+		redacted := *token
+		if redacted.Token != "" {
+			redacted.Token = REDACTED
+		}
+		tokens = append(tokens, &redacted)
+	}
+	config.ApiTokens = tokens
+
+	targets := make([]*WindowsTarget, 0, len(config.WindowsTargets))
+	for _, target := range config.WindowsTargets {
+		redacted := *target
+		redacted.Password = REDACTED
+		targets = append(targets, &redacted)
+	}
+	config.WindowsTargets = targets
+
+	for _, secret := range []*string{
+		&config.Mqtt.Password,
+		&config.Notifiers.SmtpPassword,
+		&config.Notifiers.PagerDutyRoutingKey,
+		&config.Notifiers.SlackWebhook,
+		&config.StatusPage.SecretKey,
+		&config.Scrubbing.Salt,
+	} {
+		if *secret != "" {
+			*secret = REDACTED
+		}
+	}
+	return config
+}
+
+func dumpConfig(w http.ResponseWriter, req *http.Request) {
+	data, err := goyaml.Marshal(redactedConfig())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(data)
+}
+
+type AgentHealth struct {
+	Status      string           `json:"status"`
+	Uptime      float64          `json:"uptime"` // in seconds
+	Checks      int              `json:"checks"`
+	Plugins     int              `json:"plugins"`
+	SendQueue   int              `json:"send_queue"`   // the number of spooled write operations
+	Errors      int              `json:"errors"`       // the number of recent errors, see /errors
+	ErrorCounts map[string]int64 `json:"error_counts"` // the number of errors of every category since the agent started
+	Stats       map[string]int64 `json:"stats"`        // the agent.* counters since the agent started
+
+	MissingCapabilities map[string]string `json:"missing_capabilities,omitempty"` // the host capabilities missing and why
+}
+
+func agentHealth(w http.ResponseWriter, req *http.Request) {
+	states := checkStates.List()
+	writeJson(w, http.StatusOK, &AgentHealth{
+		Status:      worstState(states),
+		Uptime:      time.Now().Sub(agentStart).Seconds(),
+		Checks:      len(states),
+		Plugins:     len(pluginRegistry.Find("", "")),
+		SendQueue:   spool.Depth(),
+		Errors:      len(recentErrors.List()),
+		ErrorCounts: ErrorCounts(),
+		Stats:       agentStats.Counts(),
+
+		MissingCapabilities: hostCapabilities.Missing(),
+	})
+}
+
+// serves the local api on a unix socket as well, access is controlled by
+// the permissions of the socket
+func serveUnixSocket(socket string) {
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Error("Cannot listen on %s. Error: %s", socket, err)
+		return
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		log.Error("Cannot change the permissions of %s. Error: %s", socket, err)
+		listener.Close()
+		return
+	}
+
+	log.Info("Started listening for command on %s", socket)
+	if err := http.Serve(listener, nil); err != nil {
+		log.Error("Cannot serve the local api on %s. Error: %s", socket, err)
+	}
+}
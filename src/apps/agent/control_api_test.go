@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	. "utils"
+)
+
+type ControlApiSuite struct{}
+
+var _ = Suite(&ControlApiSuite{})
+
+func (self *ControlApiSuite) TestPluginRegistry(c *C) {
+	registry := NewPluginRegistry()
+	mysql := &PluginMetadata{Name: "mysql"}
+	db1 := &Instance{Name: "db1", Args: map[string]string{"host": "db1"}}
+	db2 := &Instance{Args: map[string]string{"host": "db2"}}
+	registry.SetScheduled([]*ScheduledPlugin{
+		&ScheduledPlugin{"mysql/1", mysql, db1, 0},
+		&ScheduledPlugin{"mysql/2", mysql, db2, 0},
+		&ScheduledPlugin{"redis/3", &PluginMetadata{Name: "redis"}, DEFAULT_INSTANCES[0], 0},
+	})
+
+	c.Assert(registry.Find("", ""), HasLen, 3)
+	c.Assert(registry.Find("mysql", ""), HasLen, 2)
+	c.Assert(registry.Find("mysql", "db1"), HasLen, 1)
+	c.Assert(registry.Find("mysql", instanceId("mysql", db2)), HasLen, 1)
+	c.Assert(registry.Find("postgres", ""), HasLen, 0)
+
+	c.Assert(registry.Trigger("mysql/1"), Equals, true)
+	c.Assert(registry.Triggered(), DeepEquals, map[string]bool{"mysql/1": true})
+	c.Assert(registry.Triggered(), HasLen, 0)
+}
+
+func (self *ControlApiSuite) TestRedactedConfig(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.ApiKey = "secret"
+		config.ApiTokens = []*ApiToken{&ApiToken{Name: "ops", Token: "secret"}}
+		config.Mqtt.Password = "secret"
+	})()
+
+	config := redactedConfig()
+	c.Assert(config.ApiKey, Equals, REDACTED)
+	c.Assert(config.ApiTokens[0].Token, Equals, REDACTED)
+	c.Assert(config.ApiTokens[0].Name, Equals, "ops")
+	c.Assert(config.Mqtt.Password, Equals, REDACTED)
+	c.Assert(config.Notifiers.SmtpPassword, Equals, "")
+	// the agent configuration is left untouched
+	c.Assert(AgentConfig().ApiTokens[0].Token, Equals, "secret")
+}
+
+func (self *ControlApiSuite) TestHealth(c *C) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/health", nil)
+	agentHealth(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	health := &AgentHealth{}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), health), IsNil)
+	c.Assert(health.Status, Not(Equals), "")
+	c.Assert(health.Uptime > 0, Equals, true)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	DASHBOARD_HISTORY    = time.Hour
+	DASHBOARD_MAX_SERIES = 500
+)
+
+// the host metrics kept in memory for the dashboard
+var DASHBOARD_METRIC_PREFIXES = []string{"server.stats.", "host."}
+
+type MetricSample struct {
+	Time  int64   `json:"t"`
+	Value float64 `json:"v"`
+}
+
+// The host metrics reported during the last hour, kept in memory so the
+// dashboard works while the backend is unreachable
+type RecentMetrics struct {
+	lock   sync.Mutex
+	series map[string][]*MetricSample
+}
+
+var recentMetrics = NewRecentMetrics()
+
+func NewRecentMetrics() *RecentMetrics {
+	return &RecentMetrics{series: make(map[string][]*MetricSample)}
+}
+
+// returns the name of the series, the metric followed by the dimensions
+// other than the host, e.g. server.stats.disk.used device=/dev/sda1
+func seriesName(metric string, dimensions errplane.Dimensions) string {
+	keys := make([]string, 0, len(dimensions))
+	for key, _ := range dimensions {
+		if key != "host" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	name := metric
+	for _, key := range keys {
+		name += " " + key + "=" + dimensions[key]
+	}
+	return name
+}
+
+func (self *RecentMetrics) Add(metric string, dimensions errplane.Dimensions, value float64, timestamp time.Time) {
+	kept := false
+	for _, prefix := range DASHBOARD_METRIC_PREFIXES {
+		if strings.HasPrefix(metric, prefix) {
+			kept = true
+			break
+		}
+	}
+	if !kept {
+		return
+	}
+
+	name := seriesName(metric, dimensions)
+	threshold := timestamp.Add(-DASHBOARD_HISTORY).Unix()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	samples, ok := self.series[name]
+	if !ok && len(self.series) >= DASHBOARD_MAX_SERIES {
+		return
+	}
+	for len(samples) > 0 && samples[0].Time < threshold {
+		samples = samples[1:]
+	}
+	self.series[name] = append(samples, &MetricSample{timestamp.Unix(), value})
+}
+
+func (self *RecentMetrics) AddWrites(writes []*errplane.JsonPoints) {
+	for _, write := range writes {
+		for _, point := range write.Points {
+			self.Add(write.Name, point.Dimensions, point.Value, time.Unix(point.Time, 0))
+		}
+	}
+}
+
+// restores a series saved before a restart, the samples older than the
+// dashboard history are dropped
+func (self *RecentMetrics) Restore(name string, samples []*MetricSample, now time.Time) {
+	threshold := now.Add(-DASHBOARD_HISTORY).Unix()
+	kept := make([]*MetricSample, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Time >= threshold {
+			kept = append(kept, sample)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.series[name]; !ok && len(self.series) >= DASHBOARD_MAX_SERIES {
+		return
+	}
+	self.series[name] = append(kept, self.series[name]...)
+}
+
+// returns a copy of the series
+func (self *RecentMetrics) Series() map[string][]*MetricSample {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	series := make(map[string][]*MetricSample, len(self.series))
+	for name, samples := range self.series {
+		series[name] = append([]*MetricSample{}, samples...)
+	}
+	return series
+}
+
+type DashboardData struct {
+	Host    string                     `json:"host"`
+	State   string                     `json:"state"`
+	Checks  []*CheckState              `json:"checks"`
+	Plugins []*PluginStatus            `json:"plugins"`
+	Metrics map[string][]*MetricSample `json:"metrics"`
+}
+
+func dashboardData(w http.ResponseWriter, req *http.Request) {
+	checks := checkStates.List()
+	writeJson(w, http.StatusOK, &DashboardData{
+		Host:    AgentConfig().Hostname,
+		State:   worstState(checks),
+		Checks:  checks,
+		Plugins: pluginStatusesWithRuns(pluginRegistry.Find("", "")),
+		Metrics: recentMetrics.Series(),
+	})
+}
+
+func dashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHtml))
+}
+
+// polls /dashboard/data and renders the checks, the plugin runs and a
+// sparkline per metric, doesn't depend on anything outside the agent
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>errplane agent</title>
+  <style>
+    body { font-family: sans-serif; margin: 20px; }
+    .ok { color: #2a2; } .warning { color: #c80; } .critical { color: #c22; } .unknown { color: #888; }
+    td, th { padding: 4px 12px; text-align: left; vertical-align: top; }
+    .metric { display: inline-block; width: 260px; margin: 0 12px 12px 0; font-size: 12px; }
+    .metric svg { width: 260px; height: 50px; background: #f6f6f6; }
+    .runs span { display: inline-block; width: 6px; height: 14px; margin-right: 1px; }
+    .runs .ok { background: #2a2; } .runs .warning { background: #c80; } .runs .critical { background: #c22; }
+    .runs .unknown { background: #888; }
+  </style>
+</head>
+<body>
+  <h1><span id="host"></span> is <span id="state"></span></h1>
+  <h2>Checks</h2>
+  <table id="checks"></table>
+  <h2>Plugins</h2>
+  <table id="plugins"></table>
+  <h2>Metrics (last hour)</h2>
+  <div id="metrics"></div>
+  <script>
+    function text(value) {
+      var div = document.createElement("div");
+      div.textContent = value === undefined || value === null ? "" : value;
+      return div.innerHTML;
+    }
+
+    function stateOf(run) {
+      if (run.timed_out) return "unknown";
+      return ["ok", "warning", "critical"][run.exit_status] || "unknown";
+    }
+
+    function sparkline(samples) {
+      if (samples.length < 2) return "<svg></svg>";
+      var min = Math.min.apply(null, samples.map(function(s) { return s.v; }));
+      var max = Math.max.apply(null, samples.map(function(s) { return s.v; }));
+      var start = samples[0].t, end = samples[samples.length - 1].t;
+      var points = samples.map(function(s) {
+        var x = (s.t - start) / Math.max(end - start, 1) * 260;
+        var y = 48 - (s.v - min) / Math.max(max - min, 1e-9) * 46;
+        return x.toFixed(1) + "," + y.toFixed(1);
+      });
+      return '<svg viewBox="0 0 260 50"><polyline fill="none" stroke="#36c" points="' + points.join(" ") + '"/></svg>';
+    }
+
+    function render(data) {
+      document.getElementById("host").textContent = data.host;
+      var state = document.getElementById("state");
+      state.textContent = data.state;
+      state.className = data.state;
+
+      document.getElementById("checks").innerHTML = "<tr><th>Check</th><th>Instance</th><th>State</th><th>Message</th></tr>" +
+        data.checks.map(function(c) {
+          return "<tr><td>" + text(c.kind + " " + c.name) + "</td><td>" + text(c.instance) + '</td><td class="' + text(c.state) +
+            '">' + text(c.state) + "</td><td>" + text(c.message) + "</td></tr>";
+        }).join("");
+
+      document.getElementById("plugins").innerHTML = "<tr><th>Plugin</th><th>Instance</th><th>Runs</th><th>Last output</th></tr>" +
+        data.plugins.map(function(p) {
+          var runs = (p.runs || []).map(function(r) {
+            return '<span class="' + stateOf(r) + '" title="' + text(r.start + " " + (r.duration / 1e9).toFixed(2) + "s") + '"></span>';
+          }).join("");
+          var last = p.last_run ? p.last_run.output : "";
+          return "<tr><td>" + text(p.plugin) + "</td><td>" + text(p.instance || p.instance_id) + '</td><td class="runs">' + runs +
+            "</td><td><pre>" + text(last) + "</pre></td></tr>";
+        }).join("");
+
+      var names = Object.keys(data.metrics).sort();
+      document.getElementById("metrics").innerHTML = names.map(function(name) {
+        var samples = data.metrics[name];
+        var last = samples.length ? samples[samples.length - 1].v : "";
+        return '<div class="metric">' + text(name) + " <b>" + text(last === "" ? "" : last.toFixed(2)) + "</b>" + sparkline(samples) + "</div>";
+      }).join("");
+    }
+
+    function refresh() {
+      var req = new XMLHttpRequest();
+      req.onload = function() {
+        if (req.status == 200) render(JSON.parse(req.responseText));
+      };
+      req.open("GET", "/dashboard/data");
+      // the page is served to anyone, the data requires a token with the read scope if the api uses tokens
+      var token = /[?&]token=([^&]+)/.exec(window.location.search);
+      if (token) req.setRequestHeader("X-Errplane-Token", decodeURIComponent(token[1]));
+      req.send();
+    }
+
+    refresh();
+    setInterval(refresh, 10000);
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type DashboardSuite struct{}
+
+var _ = Suite(&DashboardSuite{})
+
+func (self *DashboardSuite) TestRecentMetrics(c *C) {
+	metrics := NewRecentMetrics()
+	now := time.Now()
+	dimensions := errplane.Dimensions{"host": "web1", "device": "/dev/sda1"}
+	metrics.Add("server.stats.disk.used", dimensions, 1, now.Add(-2*time.Hour))
+	metrics.Add("server.stats.disk.used", dimensions, 2, now.Add(-time.Minute))
+	metrics.Add("server.stats.disk.used", dimensions, 3, now)
+	metrics.Add("plugins.mysql.status", errplane.Dimensions{"host": "web1"}, 1, now)
+
+	series := metrics.Series()
+	c.Assert(series, HasLen, 1)
+	// the sample older than an hour is dropped
+	samples := series["server.stats.disk.used device=/dev/sda1"]
+	c.Assert(samples, HasLen, 2)
+	c.Assert(samples[0].Value, Equals, 2.0)
+	c.Assert(samples[1].Value, Equals, 3.0)
+}
+
+func (self *DashboardSuite) TestPluginRunHistory(c *C) {
+	registry := NewPluginRegistry()
+	now := time.Now()
+	registry.RecordRun("mysql/abc", &PluginRun{ExitStatus: 0, Start: now.Add(-90 * time.Minute)})
+	registry.RecordRun("mysql/abc", &PluginRun{ExitStatus: 1, Start: now.Add(-time.Minute)})
+	registry.RecordRun("mysql/abc", &PluginRun{ExitStatus: 2, Start: now})
+
+	runs := registry.Runs("mysql/abc")
+	c.Assert(runs, HasLen, 2)
+	c.Assert(runs[0].ExitStatus, Equals, 1)
+	c.Assert(registry.LastRun("mysql/abc").ExitStatus, Equals, 2)
+	c.Assert(registry.LastRun("redis/def"), IsNil)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"os"
+	"os/exec"
+	. "utils"
+)
+
+// the files and directories of the agent that hold state or credentials,
+// removed when the host is decommissioned. The plugins and the logs stay
+// unless the agent is uninstalled.
+func decommissionPaths(configFile, pidFile string) []string {
+	paths := []string{
+		AgentConfig().Spool.Dir,
+		AgentConfig().ConfigCache,
+		AgentConfig().HistoryFile,
+		AgentConfig().LocalStore.Path,
+		AgentConfig().Secrets.File,
+		AgentConfig().Secrets.KeyFile,
+		AgentConfig().BackendTls.Key,
+		AgentConfig().ApiTlsKey,
+		AgentConfig().RingBuffer,
+		pidFile,
+		configFile, // it has the api key
+	}
+	nonEmpty := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			nonEmpty = append(nonEmpty, path)
+		}
+	}
+	return nonEmpty
+}
+
+// removes the paths, the ones that don't exist are skipped
+func removeLocalState(out io.Writer, paths []string) error {
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Removed %s\n", path)
+	}
+	return nil
+}
+
+// sends the points spooled while the backend was unreachable, returns the
+// number of write operations left in the spool
+func flushSpool(spool *Spool, send func(*errplane.WriteOperation) error) int {
+	if spool == nil {
+		return 0
+	}
+	spool.replayOnce(send)
+	return spool.Depth()
+}
+
+// removes the agent package with the package manager it was installed with
+func uninstallAgent(out io.Writer) error {
+	for _, command := range [][]string{{"dpkg", "--purge", "errplane-agent"}, {"rpm", "-e", "errplane-agent"}} {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout, cmd.Stderr = out, out
+		return cmd.Run()
+	}
+	return fmt.Errorf("Neither dpkg nor rpm was found, remove the agent manually")
+}
+
+// Retires the host when it's terminated, e.g. a cloud instance: sends the
+// spooled points, marks the host retired on the config service so it
+// doesn't alert as down, removes the local state and credentials and,
+// with -uninstall, the agent package. The agent must be stopped first.
+func decommissionCommand(out io.Writer, configFile, pidFile string, args []string) int {
+	flags := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	flags.SetOutput(out)
+	uninstall := flags.Bool("uninstall", false, "Remove the agent package as well")
+	force := flags.Bool("force", false, "Go on when the spooled points can't be sent or the config service can't be reached")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintf(out, "Usage: agent decommission [-uninstall] [-force]\n")
+		return 2
+	}
+
+	// any answer of the local api, even without a token, means the agent runs
+	if client, err := NewLocalApiClient(); err == nil {
+		if resp, err := client.client.Get(client.baseUrl + "/health"); err == nil {
+			resp.Body.Close()
+			fmt.Fprintln(out, "The agent is running, stop it before decommissioning the host")
+			return 1
+		}
+	}
+
+	if AgentConfig().Spool.Dir != "" {
+		spool, err := NewSpool(AgentConfig().Spool.Dir, AgentConfig().Spool.MaxSize, AgentConfig().Spool.MaxAge)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot open the spool %s. Error: %s\n", AgentConfig().Spool.Dir, err)
+			return 1
+		}
+		left := flushSpool(spool, sendBackend)
+		if left > 0 && !*force {
+			fmt.Fprintf(out, "%d spooled writes couldn't be sent, run again when the backend is reachable or use -force to drop them\n", left)
+			return 1
+		}
+		fmt.Fprintf(out, "Sent the spooled points, %d writes dropped\n", left)
+	}
+
+	if err := RetireHost(); err != nil {
+		fmt.Fprintf(out, "Cannot retire %s on the config service. Error: %s\n", AgentConfig().Hostname, err)
+		if !*force {
+			return 1
+		}
+	} else {
+		fmt.Fprintf(out, "Retired %s on the config service\n", AgentConfig().Hostname)
+	}
+
+	if err := removeLocalState(out, decommissionPaths(configFile, pidFile)); err != nil {
+		fmt.Fprintf(out, "Cannot remove the local state. Error: %s\n", err)
+		return 1
+	}
+
+	if *uninstall {
+		if err := uninstallAgent(out); err != nil {
+			fmt.Fprintf(out, "Cannot uninstall the agent. Error: %s\n", err)
+			return 1
+		}
+	}
+	fmt.Fprintf(out, "Decommissioned %s\n", AgentConfig().Hostname)
+	return 0
+}
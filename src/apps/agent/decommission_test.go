@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type DecommissionSuite struct{}
+
+var _ = Suite(&DecommissionSuite{})
+
+func (self *DecommissionSuite) TestRemoveLocalState(c *C) {
+	dir := c.MkDir()
+	defer setTestConfig(func(config *Config) {
+		config.Spool.Dir = path.Join(dir, "spool")
+		config.ConfigCache = path.Join(dir, "backend-config.json")
+		config.HistoryFile = path.Join(dir, "history")
+		config.LocalStore.Path = ""
+		config.Secrets = SecretsConfig{File: path.Join(dir, "secrets"), KeyFile: path.Join(dir, "secrets.key")}
+		config.BackendTls.Key, config.ApiTlsKey, config.RingBuffer = "", "", ""
+	})()
+
+	paths := decommissionPaths(path.Join(dir, "config.yml"), path.Join(dir, "agent.pid"))
+	c.Assert(paths, HasLen, 7)
+	c.Assert(paths[len(paths)-1], Equals, path.Join(dir, "config.yml"))
+
+	c.Assert(os.MkdirAll(path.Join(AgentConfig().Spool.Dir, "nested"), 0700), IsNil)
+	for _, file := range []string{AgentConfig().ConfigCache, AgentConfig().Secrets.File, path.Join(dir, "config.yml"), path.Join(dir, "plugin.log")} {
+		c.Assert(ioutil.WriteFile(file, []byte("x"), 0600), IsNil)
+	}
+	out := &bytes.Buffer{}
+	c.Assert(removeLocalState(out, paths), IsNil)
+	left, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(left, HasLen, 1)
+	c.Assert(left[0].Name(), Equals, "plugin.log")
+	c.Assert(out.String(), Matches, "(?s)Removed .*/spool\n.*Removed .*/config.yml\n")
+}
+
+func (self *DecommissionSuite) TestFlushSpool(c *C) {
+	spool, err := NewSpool(c.MkDir(), 1024*1024, time.Hour)
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(spool.Enqueue(&errplane.WriteOperation{Writes: []*errplane.JsonPoints{&errplane.JsonPoints{Name: "cpu"}}}), IsNil)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	sent := 0
+	failAfterOne := func(operation *errplane.WriteOperation) error {
+		if sent == 1 {
+			return fmt.Errorf("unreachable")
+		}
+		sent++
+		return nil
+	}
+	c.Assert(flushSpool(spool, failAfterOne), Equals, 2)
+	c.Assert(flushSpool(spool, func(*errplane.WriteOperation) error { return nil }), Equals, 0)
+	c.Assert(flushSpool(nil, nil), Equals, 0)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"strconv"
+	. "utils"
+)
+
+// the dimensions set by the agent, a plugin can't override them
+var RESERVED_DIMENSIONS = []string{"host", "instance", "instance_id", "status", "status_msg"}
+
+// removes the reserved dimensions a plugin printed with its points and
+// sets the host, so every point of a plugin is attributed to this agent
+func enforceReservedDimensions(plugin string, writes []*errplane.JsonPoints) {
+	for _, write := range writes {
+		for _, point := range write.Points {
+			if point.Dimensions == nil {
+				point.Dimensions = errplane.Dimensions{}
+			}
+			for _, name := range RESERVED_DIMENSIONS {
+				if _, ok := point.Dimensions[name]; ok {
+					log.Debug("Plugin %s set the reserved dimension %s of %s, ignoring it", plugin, name, write.Name)
+					agentStats.Add(STAT_DIMENSION_VIOLATIONS, 1)
+					delete(point.Dimensions, name)
+				}
+			}
+			point.Dimensions["host"] = AgentConfig().Hostname
+		}
+	}
+}
+
+func checkDimensionType(kind, value string) bool {
+	var err error
+	switch kind {
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	}
+	return err == nil
+}
+
+// returns whether the point must be dropped and why the dimensions of the
+// metric violate the dimension schemas, the error is nil if they don't
+func checkDimensionSchemas(metric string, dimensions errplane.Dimensions) (bool, error) {
+	for _, schema := range AgentConfig().DimensionSchemas {
+		if !schema.Metric.MatchString(metric) {
+			continue
+		}
+		for _, name := range schema.Required {
+			if _, ok := dimensions[name]; !ok {
+				return schema.Drop, fmt.Errorf("%s is missing the required dimension %s", metric, name)
+			}
+		}
+		for name, kind := range schema.Types {
+			if value, ok := dimensions[name]; ok && !checkDimensionType(kind, value) {
+				return schema.Drop, fmt.Errorf("dimension %s of %s isn't of type %s: %s", name, metric, kind, value)
+			}
+		}
+	}
+	return false, nil
+}
+
+// counts the points violating the dimension schemas and returns the writes
+// without the points that must be dropped
+func applyDimensionSchemas(writes []*errplane.JsonPoints) []*errplane.JsonPoints {
+	if len(AgentConfig().DimensionSchemas) == 0 {
+		return writes
+	}
+	kept := make([]*errplane.JsonPoints, 0, len(writes))
+	for _, write := range writes {
+		points := make([]*errplane.JsonPoint, 0, len(write.Points))
+		for _, point := range write.Points {
+			if allowedBySchemas(write.Name, point.Dimensions) {
+				points = append(points, point)
+			}
+		}
+		if len(points) > 0 {
+			write.Points = points
+			kept = append(kept, write)
+		}
+	}
+	return kept
+}
+
+func allowedBySchemas(metric string, dimensions errplane.Dimensions) bool {
+	drop, err := checkDimensionSchemas(metric, dimensions)
+	if err == nil {
+		return true
+	}
+	agentStats.Add(STAT_DIMENSION_VIOLATIONS, 1)
+	if drop {
+		log.Debug("Dropping a point, %s", err)
+		return false
+	}
+	log.Debug("Dimension schema violation, %s", err)
+	return true
+}
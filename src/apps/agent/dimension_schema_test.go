@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"regexp"
+	. "utils"
+)
+
+type DimensionSchemaSuite struct {
+	previousConfig *Config
+	previousStats  *AgentStats
+}
+
+var _ = Suite(&DimensionSchemaSuite{})
+
+func (self *DimensionSchemaSuite) SetUpTest(c *C) {
+	self.previousConfig, self.previousStats = AgentConfig(), agentStats
+	SetAgentConfig(&Config{Hostname: "web1"})
+	agentStats = NewAgentStats()
+}
+
+func (self *DimensionSchemaSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previousConfig)
+	agentStats = self.previousStats
+}
+
+func (self *DimensionSchemaSuite) TestReservedDimensions(c *C) {
+	writes := []*errplane.JsonPoints{batchWrite("connections", 1, 2).Writes[0]}
+	writes[0].Points[0].Dimensions = errplane.Dimensions{"host": "db1", "status": "ok", "database": "users"}
+	enforceReservedDimensions("mysql", writes)
+
+	c.Assert(writes[0].Points[0].Dimensions, DeepEquals, errplane.Dimensions{"host": "web1", "database": "users"})
+	c.Assert(writes[0].Points[1].Dimensions, DeepEquals, errplane.Dimensions{"host": "web1"})
+	c.Assert(agentStats.Counts()[STAT_DIMENSION_VIOLATIONS], Equals, int64(2))
+}
+
+func (self *DimensionSchemaSuite) TestSchemas(c *C) {
+	setTestConfig(func(config *Config) {
+		config.DimensionSchemas = []*DimensionSchema{
+			{Metric: regexp.MustCompile(`^plugins\.mysql\.`), Required: []string{"database"}, Drop: true},
+			{Metric: regexp.MustCompile(`^plugins\.`), Types: map[string]string{"port": "int"}},
+		}
+	})
+
+	writes := []*errplane.JsonPoints{batchWrite("plugins.mysql.connections", 1, 2).Writes[0], batchWrite("plugins.redis.keys", 3).Writes[0]}
+	writes[0].Points[0].Dimensions = errplane.Dimensions{"database": "users", "port": "3306"}
+	writes[1].Points[0].Dimensions = errplane.Dimensions{"port": "default"}
+	writes = applyDimensionSchemas(writes)
+
+	// the point missing the database is dropped, the wrong port is only counted
+	c.Assert(writes, HasLen, 2)
+	c.Assert(writes[0].Points, HasLen, 1)
+	c.Assert(writes[0].Points[0].Value, Equals, 1.0)
+	c.Assert(writes[1].Points, HasLen, 1)
+	c.Assert(agentStats.Counts()[STAT_DIMENSION_VIOLATIONS], Equals, int64(2))
+
+	drop, err := checkDimensionSchemas("plugins.mysql.queries", errplane.Dimensions{"database": "users", "port": "x"})
+	c.Assert(drop, Equals, false)
+	c.Assert(err, ErrorMatches, "dimension port of plugins.mysql.queries isn't of type int: x")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/rand"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	. "utils"
+)
+
+func monitorDnsChecks(ep *errplane.Errplane) {
+	for {
+		for _, check := range AgentConfig().DnsChecks {
+			runDnsCheck(ep, check)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+const (
+	DNS_TYPE_A    = 1
+	DNS_TYPE_AAAA = 28
+	DNS_CLASS_IN  = 1
+)
+
+// returns the addresses of the A and AAAA records of the hostname. The
+// queries are sent to the resolver itself, the go resolver would answer
+// from the hosts file first and give every resolver the same answer.
+func queryResolver(address, hostname string, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	addrs := make([]string, 0)
+	for _, recordType := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		query, err := dnsQuery(hostname, recordType)
+		if err != nil {
+			return nil, err
+		}
+		response, err := exchangeDns("udp", address, query, deadline)
+		if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+			// truncated, the answer only fits in a tcp response
+			response, err = exchangeDns("tcp", address, query, deadline)
+		}
+		if err != nil {
+			return nil, err
+		}
+		answers, err := parseDnsResponse(response, query[:2])
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, answers...)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no such host")
+	}
+	return addrs, nil
+}
+
+// returns a recursive query for the records of the hostname
+func dnsQuery(hostname string, recordType uint16) ([]byte, error) {
+	id := make([]byte, 2)
+	rand.Read(id)
+	query := append(id, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(hostname, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid hostname '%s'", hostname)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = append(query, byte(recordType>>8), byte(recordType), 0, DNS_CLASS_IN)
+	return query, nil
+}
+
+// sends the query and returns the response, over tcp the messages are
+// prefixed by their length
+func exchangeDns(network, address string, query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout(network, address, deadline.Sub(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if network == "tcp" {
+		query = append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		response := make([]byte, int(length[0])<<8|int(length[1]))
+		_, err := io.ReadFull(conn, response)
+		return response, err
+	}
+	response := make([]byte, 65535)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		// a late response to a previous query is ignored
+		if n >= 2 && response[0] == query[0] && response[1] == query[1] {
+			return response[:n], nil
+		}
+	}
+}
+
+// returns the addresses of the A and AAAA records of the answer section
+func parseDnsResponse(response, id []byte) ([]string, error) {
+	if len(response) < 12 || response[0] != id[0] || response[1] != id[1] {
+		return nil, fmt.Errorf("Invalid dns response")
+	}
+	switch rcode := response[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, fmt.Errorf("no such host")
+	default:
+		return nil, fmt.Errorf("The resolver answered with rcode %d", rcode)
+	}
+
+	questions := int(response[4])<<8 | int(response[5])
+	answers := int(response[6])<<8 | int(response[7])
+	offset := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if offset, err = skipDnsName(response, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+
+	addrs := make([]string, 0, answers)
+	for i := 0; i < answers; i++ {
+		if offset, err = skipDnsName(response, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(response) {
+			return nil, fmt.Errorf("Invalid dns response")
+		}
+		recordType := uint16(response[offset])<<8 | uint16(response[offset+1])
+		length := int(response[offset+8])<<8 | int(response[offset+9])
+		offset += 10
+		if offset+length > len(response) {
+			return nil, fmt.Errorf("Invalid dns response")
+		}
+		// the cnames the resolver followed are skipped
+		if (recordType == DNS_TYPE_A && length == net.IPv4len) || (recordType == DNS_TYPE_AAAA && length == net.IPv6len) {
+			addrs = append(addrs, net.IP(response[offset:offset+length]).String())
+		}
+		offset += length
+	}
+	return addrs, nil
+}
+
+// returns the offset following the name starting at offset
+func skipDnsName(message []byte, offset int) (int, error) {
+	for offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			// a pointer to a previous name ends the name
+			return offset + 2, nil
+		default:
+			offset += 1 + length
+		}
+	}
+	return 0, fmt.Errorf("Invalid dns response")
+}
+
+func runDnsCheck(ep *errplane.Errplane, check *DnsCheck) {
+	timestamp := time.Now()
+	answers := make(map[string][]string)
+	state := OK
+	msg := ""
+
+	for _, address := range check.Resolvers {
+		addrs, err := queryResolver(address, check.Hostname, check.Timeout)
+
+		dimensions := errplane.Dimensions{
+			"host":     AgentConfig().Hostname,
+			"check":    check.Name,
+			"hostname": check.Hostname,
+			"resolver": address,
+		}
+
+		if err != nil {
+			log.Warn("Cannot resolve %s using %s. Error: %s", check.Hostname, address, err)
+			state = CRITICAL
+			msg = fmt.Sprintf("Cannot resolve %s using %s", check.Hostname, address)
+			continue
+		}
+
+		answers[address] = addrs
+		report(ep, "server.checks.dns.answers", float64(len(addrs)), timestamp, dimensions, nil)
+	}
+
+	if state == OK {
+		if consistent, divergence := compareDnsAnswers(answers, check.AllowedAnswers); !consistent {
+			state = CRITICAL
+			msg = divergence
+		}
+	}
+
+	checkStates.Set(CHECK_DNS, check.Name, "", state.String(), msg)
+	report(ep, "server.checks.dns.status", 1.0, timestamp, errplane.Dimensions{
+		"host":       AgentConfig().Hostname,
+		"check":      check.Name,
+		"hostname":   check.Hostname,
+		"status":     state.String(),
+		"status_msg": msg,
+	}, nil)
+}
+
+// compares the answers of the different resolvers ignoring the allowed
+// answers, returns false and a description of the divergence if any two
+// resolvers disagree
+func compareDnsAnswers(answers map[string][]string, allowed []string) (bool, string) {
+	allowedSet := make(map[string]bool)
+	for _, answer := range allowed {
+		allowedSet[answer] = true
+	}
+
+	resolvers := make([]string, 0, len(answers))
+	for resolver, _ := range answers {
+		resolvers = append(resolvers, resolver)
+	}
+	sort.Strings(resolvers)
+
+	var referenceResolver, reference string
+	for idx, resolver := range resolvers {
+		filtered := make([]string, 0, len(answers[resolver]))
+		for _, answer := range answers[resolver] {
+			if !allowedSet[answer] {
+				filtered = append(filtered, answer)
+			}
+		}
+		sort.Strings(filtered)
+		joined := strings.Join(filtered, ",")
+
+		if idx == 0 {
+			referenceResolver, reference = resolver, joined
+			continue
+		}
+
+		if joined != reference {
+			return false, fmt.Sprintf("%s answered [%s] but %s answered [%s]", referenceResolver, reference, resolver, joined)
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net"
+	"time"
+)
+
+type DnsCheckSuite struct{}
+
+var _ = Suite(&DnsCheckSuite{})
+
+func (self *DnsCheckSuite) TestConsistentAnswers(c *C) {
+	answers := map[string][]string{
+		"8.8.8.8:53":  []string{"1.2.3.4", "1.2.3.5"},
+		"1.1.1.1:53":  []string{"1.2.3.5", "1.2.3.4"},
+		"10.0.0.2:53": []string{"1.2.3.4", "1.2.3.5", "10.0.0.10"},
+	}
+	consistent, msg := compareDnsAnswers(answers, nil)
+	c.Assert(consistent, Equals, false)
+	c.Assert(msg, Equals, "1.1.1.1:53 answered [1.2.3.4,1.2.3.5] but 10.0.0.2:53 answered [1.2.3.4,1.2.3.5,10.0.0.10]")
+
+	// the internal address is expected to show up only on the internal resolver
+	consistent, _ = compareDnsAnswers(answers, []string{"10.0.0.10"})
+	c.Assert(consistent, Equals, true)
+}
+
+// starts a resolver answering every A query with the address
+func fakeResolver(c *C, address string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		query := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(query)
+			if err != nil {
+				return
+			}
+			response := append([]byte{}, query[:n]...)
+			response[2], response[3] = 0x81, 0x80
+			if response[n-3] == DNS_TYPE_A {
+				response[7] = 1
+				response = append(response, 0xc0, 12, 0, DNS_TYPE_A, 0, DNS_CLASS_IN, 0, 0, 0, 60, 0, 4)
+				response = append(response, net.ParseIP(address).To4()...)
+			}
+			conn.WriteTo(response, from)
+		}
+	}()
+	return conn
+}
+
+func (self *DnsCheckSuite) TestHostsFileIgnored(c *C) {
+	// localhost is in the hosts file, the go resolver would answer
+	// 127.0.0.1 for both resolvers
+	firstConn, secondConn := fakeResolver(c, "10.0.0.1"), fakeResolver(c, "10.0.0.2")
+	defer firstConn.Close()
+	defer secondConn.Close()
+	first, second := firstConn.LocalAddr().String(), secondConn.LocalAddr().String()
+	answers := make(map[string][]string)
+	for _, resolver := range []string{first, second} {
+		addrs, err := queryResolver(resolver, "localhost", time.Second)
+		c.Assert(err, IsNil)
+		answers[resolver] = addrs
+	}
+	c.Assert(answers[first], DeepEquals, []string{"10.0.0.1"})
+	consistent, _ := compareDnsAnswers(answers, nil)
+	c.Assert(consistent, Equals, false)
+}
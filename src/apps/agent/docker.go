@@ -0,0 +1,290 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// collects the stats of the containers from the docker daemon, over its
+// unix socket, and reports their state changes as events
+
+const DOCKER_TIMEOUT = 10 * time.Second
+
+type DockerContainer struct {
+	Id     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`  // e.g. running, exited, paused
+	Status string            `json:"Status"` // e.g. Exited (1) 2 minutes ago
+}
+
+// the name of the container without the leading slash
+func (self *DockerContainer) Name() string {
+	if len(self.Names) == 0 {
+		return self.Id
+	}
+	return strings.TrimPrefix(self.Names[0], "/")
+}
+
+type DockerCpuStats struct {
+	CpuUsage struct {
+		TotalUsage  uint64   `json:"total_usage"`
+		PercpuUsage []uint64 `json:"percpu_usage"`
+	} `json:"cpu_usage"`
+	SystemUsage uint64 `json:"system_cpu_usage"`
+	OnlineCpus  int    `json:"online_cpus"`
+}
+
+type DockerStats struct {
+	CpuStats    DockerCpuStats `json:"cpu_stats"`
+	PreCpuStats DockerCpuStats `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes   uint64 `json:"rx_bytes"`
+		RxPackets uint64 `json:"rx_packets"`
+		RxErrors  uint64 `json:"rx_errors"`
+		TxBytes   uint64 `json:"tx_bytes"`
+		TxPackets uint64 `json:"tx_packets"`
+		TxErrors  uint64 `json:"tx_errors"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IoServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+// the counters of a container, reported as the difference with the
+// previous collection like the network stats of the host
+type DockerCounters struct {
+	rxBytes, rxPackets, rxErrors uint64
+	txBytes, txPackets, txErrors uint64
+	readBytes, writeBytes        uint64
+}
+
+func (self *DockerStats) Counters() *DockerCounters {
+	counters := &DockerCounters{}
+	for _, network := range self.Networks {
+		counters.rxBytes += network.RxBytes
+		counters.rxPackets += network.RxPackets
+		counters.rxErrors += network.RxErrors
+		counters.txBytes += network.TxBytes
+		counters.txPackets += network.TxPackets
+		counters.txErrors += network.TxErrors
+	}
+	for _, io := range self.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(io.Op) {
+		case "read":
+			counters.readBytes += io.Value
+		case "write":
+			counters.writeBytes += io.Value
+		}
+	}
+	return counters
+}
+
+// the cpu usage of the container in percent of one cpu, computed the way
+// docker stats does it
+func (self *DockerStats) CpuPercent() float64 {
+	cpuDelta := float64(self.CpuStats.CpuUsage.TotalUsage) - float64(self.PreCpuStats.CpuUsage.TotalUsage)
+	systemDelta := float64(self.CpuStats.SystemUsage) - float64(self.PreCpuStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+	cpus := self.CpuStats.OnlineCpus
+	if cpus == 0 {
+		cpus = len(self.CpuStats.CpuUsage.PercpuUsage)
+	}
+	return cpuDelta / systemDelta * float64(cpus) * 100
+}
+
+// the memory used by the container, without the page cache
+func (self *DockerStats) MemoryUsed() float64 {
+	used := self.MemoryStats.Usage
+	if cache := self.MemoryStats.Stats["cache"]; cache < used {
+		used -= cache
+	}
+	return float64(used)
+}
+
+type DockerClient struct {
+	client  *http.Client
+	baseUrl string
+}
+
+func NewDockerClient(socket string) *DockerClient {
+	transport := &http.Transport{Dial: func(network, addr string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}}
+	return &DockerClient{&http.Client{Transport: transport, Timeout: DOCKER_TIMEOUT}, "http://docker"}
+}
+
+func (self *DockerClient) get(path string, value interface{}) error {
+	resp, err := self.client.Get(self.baseUrl + path)
+	if err != nil {
+		return NetworkError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NetworkError(fmt.Errorf("Received status code %d from the docker daemon for %s", resp.StatusCode, path))
+	}
+	return ParseError(json.NewDecoder(resp.Body).Decode(value))
+}
+
+// returns all the containers, the stopped ones included
+func (self *DockerClient) Containers() ([]*DockerContainer, error) {
+	containers := make([]*DockerContainer, 0)
+	if err := self.get("/containers/json?all=1", &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (self *DockerClient) Stats(id string) (*DockerStats, error) {
+	stats := &DockerStats{}
+	if err := self.get("/containers/"+url.QueryEscape(id)+"/stats?stream=false", stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func dockerDimensions(container *DockerContainer) errplane.Dimensions {
+	dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "container": container.Name(), "image": container.Image}
+	if pod, ok := container.Labels[KUBERNETES_POD_NAME_LABEL]; ok {
+		dimensions["pod"] = pod
+		dimensions["namespace"] = container.Labels[KUBERNETES_POD_NAMESPACE_LABEL]
+	}
+	for _, label := range AgentConfig().Docker.Labels {
+		if value, ok := container.Labels[label]; ok {
+			if _, ok := dimensions[label]; !ok {
+				dimensions[label] = value
+			}
+		}
+	}
+	return dimensions
+}
+
+type DockerTransition struct {
+	container *DockerContainer
+	previous  string // the previous state, removed if the container doesn't exist anymore
+	current   string
+}
+
+// compares the states of the containers with the previous collection, the
+// containers created since are reported with an empty previous state
+func dockerTransitions(previous map[string]*DockerContainer, containers []*DockerContainer) []*DockerTransition {
+	transitions := make([]*DockerTransition, 0)
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		seen[container.Id] = true
+		before, ok := previous[container.Id]
+		if !ok {
+			transitions = append(transitions, &DockerTransition{container, "", container.State})
+			continue
+		}
+		if before.State != container.State {
+			transitions = append(transitions, &DockerTransition{container, before.State, container.State})
+		}
+	}
+	for id, container := range previous {
+		if !seen[id] {
+			transitions = append(transitions, &DockerTransition{container, container.State, "removed"})
+		}
+	}
+	return transitions
+}
+
+func dockerStats(ep *errplane.Errplane) {
+	if !AgentConfig().Docker.Enabled || !hostCapabilities.Has(HOST_CAPABILITY_DOCKER) {
+		return
+	}
+
+	client := NewDockerClient(AgentConfig().Docker.Socket)
+	var previous map[string]*DockerContainer
+	prevCounters := make(map[string]*DockerCounters)
+
+	for {
+		containers, err := client.Containers()
+		if err != nil {
+			log.Error("Cannot list the docker containers. Error: %s", err)
+			time.Sleep(AgentConfig().Sleep)
+			continue
+		}
+
+		now := time.Now()
+		// the containers running when the agent starts aren't transitions
+		if previous != nil {
+			for _, transition := range dockerTransitions(previous, containers) {
+				reportDockerTransition(ep, transition, now)
+			}
+		}
+		previous = make(map[string]*DockerContainer, len(containers))
+		for _, container := range containers {
+			previous[container.Id] = container
+		}
+
+		counters := make(map[string]*DockerCounters)
+		for _, container := range containers {
+			if container.State != "running" {
+				continue
+			}
+			stats, err := client.Stats(container.Id)
+			if err != nil {
+				log.Error("Cannot get the stats of container %s. Error: %s", container.Name(), err)
+				continue
+			}
+			counters[container.Id] = stats.Counters()
+			reportDockerStats(ep, container, stats, counters[container.Id], prevCounters[container.Id], now)
+		}
+		prevCounters = counters
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+func reportDockerStats(ep *errplane.Errplane, container *DockerContainer, stats *DockerStats, counters, prevCounters *DockerCounters, now time.Time) {
+	dimensions := dockerDimensions(container)
+	report(ep, "server.docker.cpu", stats.CpuPercent(), now, dimensions, nil)
+	report(ep, "server.docker.memory.used", stats.MemoryUsed(), now, dimensions, nil)
+	if stats.MemoryStats.Limit > 0 {
+		report(ep, "server.docker.memory.limit", float64(stats.MemoryStats.Limit), now, dimensions, nil)
+	}
+	// the counters restart with the container
+	if prevCounters == nil || counters.rxBytes < prevCounters.rxBytes || counters.readBytes < prevCounters.readBytes {
+		return
+	}
+	report(ep, "server.docker.network.rxBytes", float64(counters.rxBytes-prevCounters.rxBytes), now, dimensions, nil)
+	report(ep, "server.docker.network.rxPackets", float64(counters.rxPackets-prevCounters.rxPackets), now, dimensions, nil)
+	report(ep, "server.docker.network.rxErrors", float64(counters.rxErrors-prevCounters.rxErrors), now, dimensions, nil)
+	report(ep, "server.docker.network.txBytes", float64(counters.txBytes-prevCounters.txBytes), now, dimensions, nil)
+	report(ep, "server.docker.network.txPackets", float64(counters.txPackets-prevCounters.txPackets), now, dimensions, nil)
+	report(ep, "server.docker.network.txErrors", float64(counters.txErrors-prevCounters.txErrors), now, dimensions, nil)
+	report(ep, "server.docker.blkio.readBytes", float64(counters.readBytes-prevCounters.readBytes), now, dimensions, nil)
+	report(ep, "server.docker.blkio.writeBytes", float64(counters.writeBytes-prevCounters.writeBytes), now, dimensions, nil)
+}
+
+func reportDockerTransition(ep *errplane.Errplane, transition *DockerTransition, now time.Time) {
+	container := transition.container
+	log.Info("Container %s changed from '%s' to '%s'", container.Name(), transition.previous, transition.current)
+	recordHistory(&HistoryEntry{Timestamp: now.Unix(), Kind: HISTORY_EVENT, Name: "Container " + container.Name(),
+		State: transition.current, Message: container.Status})
+
+	dimensions := dockerDimensions(container)
+	dimensions["state"] = transition.current
+	dimensions["previous_state"] = transition.previous
+	reportWithContext(ep, "server.docker.events", 1.0, now, container.Status, dimensions)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	. "utils"
+)
+
+type DockerSuite struct{}
+
+var _ = Suite(&DockerSuite{})
+
+const dockerStatsResponse = `{
+  "cpu_stats": {"cpu_usage": {"total_usage": 300000000, "percpu_usage": [150000000, 150000000]}, "system_cpu_usage": 2000000000, "online_cpus": 2},
+  "precpu_stats": {"cpu_usage": {"total_usage": 100000000}, "system_cpu_usage": 1000000000},
+  "memory_stats": {"usage": 104857600, "limit": 536870912, "stats": {"cache": 4857600}},
+  "networks": {"eth0": {"rx_bytes": 1000, "tx_bytes": 500, "rx_packets": 10}, "eth1": {"rx_bytes": 24, "tx_bytes": 12}},
+  "blkio_stats": {"io_service_bytes_recursive": [
+    {"major": 8, "minor": 0, "op": "Read", "value": 4096},
+    {"major": 8, "minor": 0, "op": "Write", "value": 8192},
+    {"major": 8, "minor": 0, "op": "Total", "value": 12288}
+  ]}
+}`
+
+func (self *DockerSuite) TestStats(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			c.Assert(r.URL.Query().Get("all"), Equals, "1")
+			fmt.Fprint(w, `[{"Id": "abc", "Names": ["/web"], "Image": "nginx:1.7", "Labels": {"service": "frontend"}, "State": "running", "Status": "Up 2 hours"}]`)
+		case "/containers/abc/stats":
+			fmt.Fprint(w, dockerStatsResponse)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := &DockerClient{&http.Client{}, server.URL}
+
+	containers, err := client.Containers()
+	c.Assert(err, IsNil)
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].Name(), Equals, "web")
+
+	stats, err := client.Stats("abc")
+	c.Assert(err, IsNil)
+	c.Assert(stats.CpuPercent(), Equals, 40.0)
+	c.Assert(stats.MemoryUsed(), Equals, 100000000.0)
+	counters := stats.Counters()
+	c.Assert(counters.rxBytes, Equals, uint64(1024))
+	c.Assert(counters.txBytes, Equals, uint64(512))
+	c.Assert(counters.readBytes, Equals, uint64(4096))
+	c.Assert(counters.writeBytes, Equals, uint64(8192))
+
+	_, err = client.Stats("missing")
+	c.Assert(err, NotNil)
+}
+
+func (self *DockerSuite) TestLabelDimensions(c *C) {
+	defer setTestConfig(func(config *Config) { config.Docker.Labels = []string{"service", "team", "host"} })()
+
+	dimensions := dockerDimensions(&DockerContainer{Names: []string{"/web"}, Image: "nginx", Labels: map[string]string{
+		"service": "frontend", "version": "3", "host": "other",
+	}})
+	c.Assert(dimensions["container"], Equals, "web")
+	c.Assert(dimensions["image"], Equals, "nginx")
+	c.Assert(dimensions["service"], Equals, "frontend")
+	c.Assert(dimensions["host"], Equals, AgentConfig().Hostname)
+	_, ok := dimensions["version"]
+	c.Assert(ok, Equals, false)
+	_, ok = dimensions["team"]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *DockerSuite) TestTransitions(c *C) {
+	previous := map[string]*DockerContainer{
+		"a": &DockerContainer{Id: "a", State: "running"},
+		"b": &DockerContainer{Id: "b", State: "running"},
+		"c": &DockerContainer{Id: "c", State: "exited"},
+	}
+	transitions := dockerTransitions(previous, []*DockerContainer{
+		&DockerContainer{Id: "a", State: "running"},
+		&DockerContainer{Id: "b", State: "exited"},
+		&DockerContainer{Id: "d", State: "running"},
+	})
+
+	changes := make([]string, 0, len(transitions))
+	for _, transition := range transitions {
+		changes = append(changes, transition.container.Id+":"+transition.previous+"->"+transition.current)
+	}
+	sort.Strings(changes)
+	c.Assert(changes, DeepEquals, []string{"b:running->exited", "c:exited->removed", "d:->running"})
+}
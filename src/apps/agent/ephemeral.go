@@ -0,0 +1,146 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+const (
+	EPHEMERAL_METADATA_TIMEOUT = 2 * time.Second
+	EPHEMERAL_TOKEN_TTL        = "60" // in seconds, a token is requested every poll
+)
+
+var deregisterOnce sync.Once
+
+// removes the ephemeral host from the config service, once whatever
+// stopped it first
+func deregisterHost(reason string) {
+	deregisterOnce.Do(func() {
+		if err := DeregisterHost(); err != nil {
+			log.Error("Cannot deregister %s (%s). Error: %s", AgentConfig().Hostname, reason, err)
+			return
+		}
+		log.Info("Deregistered %s (%s)", AgentConfig().Hostname, reason)
+	})
+}
+
+// returns an IMDSv2 session token, empty if the metadata service doesn't
+// issue them and only answers IMDSv1 requests
+func metadataToken(client *http.Client, tokenUrl string) string {
+	if tokenUrl == "" {
+		return ""
+	}
+	req, err := http.NewRequest("PUT", tokenUrl, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", EPHEMERAL_TOKEN_TTL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// returns the lifecycle state of the instance in the metadata, empty if
+// the metadata doesn't have one, e.g. the instance isn't in an autoscaling
+// group. The request carries an IMDSv2 token when the token url issues one.
+func lifecycleState(client *http.Client, url, tokenUrl string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := metadataToken(client, tokenUrl); token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("The metadata service answered %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func isScaleIn(state string, states []string) bool {
+	for _, s := range states {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
+
+// polls the lifecycle state of the instance and deregisters it once it's
+// being scaled in, so the backend doesn't alert when it stops reporting.
+// The scale in is reported as an agent.scale_in event.
+func watchScaleIn(ep *errplane.Errplane) {
+	config := &AgentConfig().Ephemeral
+	if !config.Enabled {
+		return
+	}
+	client := &http.Client{Timeout: EPHEMERAL_METADATA_TIMEOUT}
+	for {
+		state, err := lifecycleState(client, config.MetadataUrl, config.TokenUrl)
+		if err != nil {
+			log.Debug("Cannot get the lifecycle state from %s. Error: %s", config.MetadataUrl, err)
+		} else if isScaleIn(state, config.ScaleInStates) {
+			log.Warn("The instance is being scaled in, lifecycle state %s", state)
+			context, _ := json.Marshal(&eventAnnotation{"Scale in", "Lifecycle state " + state, EVENT_SEVERITY_INFO})
+			reportWithContext(ep, "agent.scale_in", 1.0, time.Now(), string(context), errplane.Dimensions{
+				"host":     AgentConfig().Hostname,
+				"severity": EVENT_SEVERITY_INFO,
+			})
+			deregisterHost("scaled in")
+			return
+		}
+		time.Sleep(config.PollInterval)
+	}
+}
+
+// deregisters an ephemeral host when the agent is stopped cleanly, the
+// batched points are flushed first
+func handleShutdownSignal() {
+	if !AgentConfig().Ephemeral.Enabled {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	log.Info("Received %s, shutting down", sig)
+	if httpBatcher != nil {
+		httpBatcher.Flush()
+	}
+	deregisterHost("stopped")
+	log.Close()
+	time.Sleep(1 * time.Second) // give the logger a chance to close and write to the file
+	os.Exit(0)
+}
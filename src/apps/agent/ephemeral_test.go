@@ -0,0 +1,73 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	. "utils"
+)
+
+type EphemeralSuite struct{}
+
+var _ = Suite(&EphemeralSuite{})
+
+func (self *EphemeralSuite) TestLifecycleState(c *C) {
+	state, status := "InService", http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// IMDSv2, the state is only returned with a token
+		if req.Method == "PUT" && req.URL.Path == "/token" {
+			w.Write([]byte("secret-token"))
+			return
+		}
+		if req.Header.Get("X-aws-ec2-metadata-token") != "secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if state == "" {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(state + "\n"))
+	}))
+	defer server.Close()
+
+	states := []string{"Terminated", "Detached"}
+	current, err := lifecycleState(http.DefaultClient, server.URL+"/state", server.URL+"/token")
+	c.Assert(err, IsNil)
+	c.Assert(current, Equals, "InService")
+	c.Assert(isScaleIn(current, states), Equals, false)
+
+	state = "Terminated"
+	current, _ = lifecycleState(http.DefaultClient, server.URL+"/state", server.URL+"/token")
+	c.Assert(isScaleIn(current, states), Equals, true)
+
+	// the errors aren't states
+	_, err = lifecycleState(http.DefaultClient, server.URL+"/state", "")
+	c.Assert(err, ErrorMatches, "The metadata service answered 401.*")
+	status = http.StatusInternalServerError
+	_, err = lifecycleState(http.DefaultClient, server.URL+"/state", server.URL+"/token")
+	c.Assert(err, ErrorMatches, "The metadata service answered 500.*")
+
+	// not in an autoscaling group
+	state = ""
+	current, err = lifecycleState(http.DefaultClient, server.URL+"/state", server.URL+"/token")
+	c.Assert(err, IsNil)
+	c.Assert(current, Equals, "")
+}
+
+func (self *EphemeralSuite) TestDeregisterHost(c *C) {
+	var method, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method, path = req.Method, req.URL.Path
+	}))
+	defer server.Close()
+	defer setTestConfig(func(config *Config) {
+		config.ConfigService = server.Listener.Addr().String()
+		config.Hostname = "web-1a2b"
+	})()
+
+	c.Assert(DeregisterHost(), IsNil)
+	c.Assert(method, Equals, "DELETE")
+	c.Assert(path, Matches, "/databases/.*/agent/web-1a2b")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	. "utils"
+)
+
+// returns the ipv4 address of the interface used for the default route,
+// or the first non loopback ipv4 address
+func primaryIpv4() string {
+	// connecting a udp socket doesn't send anything
+	if conn, err := net.Dial("udp4", "8.8.8.8:53"); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
+
+// the facts that are known on every host, ip is the host ip chosen with
+// the host-ip preferences and ip.<interface> the address of every interface
+func builtinFacts() map[string]string {
+	primary, interfaces := hostIps.Get()
+	facts := map[string]string{
+		"hostname":     AgentConfig().Hostname,
+		"primary_ipv4": primaryIpv4(),
+		"ip":           primary,
+		"os":           runtime.GOOS,
+		"arch":         runtime.GOARCH,
+		"cpus":         strconv.Itoa(runtime.NumCPU()),
+	}
+	for name, ip := range interfaces {
+		facts["ip."+name] = ip
+	}
+	return facts
+}
+
+func lookupFact(name string) (string, error) {
+	if value, ok := AgentConfig().Facts[name]; ok {
+		return value, nil
+	}
+	if value, ok := builtinFacts()[name]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("Unknown fact '%s'", name)
+}
+
+var argTemplateFuncs = template.FuncMap{
+	"fact":         lookupFact,
+	"hostname":     func() string { return AgentConfig().Hostname },
+	"primary_ipv4": primaryIpv4,
+	"secret":       lookupSecret,
+}
+
+// renders the templates in the argument, e.g. --socket {{fact "mysql.socket"}}
+func renderArg(value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New("arg").Funcs(argTemplateFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+	buffer := bytes.NewBufferString("")
+	if err := tmpl.Execute(buffer, nil); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// returns a copy of the instance with the templates in its arguments rendered
+func renderInstanceArgs(instance *Instance) (*Instance, error) {
+	if instance.Remote != nil && len(secretArgNames(instance)) > 0 {
+		return nil, fmt.Errorf("Secrets can't be passed to remote instances")
+	}
+	rendered := *instance
+	rendered.Args = make(map[string]string)
+	for name, value := range instance.Args {
+		var err error
+		if rendered.Args[name], err = renderArg(value); err != nil {
+			return nil, fmt.Errorf("Cannot render argument %s. Error: %s", name, err)
+		}
+	}
+	rendered.ArgsList = make([]string, len(instance.ArgsList))
+	for idx, value := range instance.ArgsList {
+		if usesSecret(value) {
+			return nil, fmt.Errorf("Secrets can't be passed as positional arguments, they would show in ps")
+		}
+		var err error
+		if rendered.ArgsList[idx], err = renderArg(value); err != nil {
+			return nil, fmt.Errorf("Cannot render argument '%s'. Error: %s", value, err)
+		}
+	}
+	if instance.Env != nil {
+		rendered.Env = make(map[string]string)
+		for name, value := range instance.Env {
+			var err error
+			if rendered.Env[name], err = renderArg(value); err != nil {
+				return nil, fmt.Errorf("Cannot render environment variable %s. Error: %s", name, err)
+			}
+		}
+	}
+	return &rendered, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the status reported for the instances that are flapping, the status of
+// the run is in the flapping_status dimension
+const STATUS_FLAPPING = "flapping"
+
+// the statuses of the last runs of a plugin instance, oldest first
+type StatusHistory struct {
+	statuses []string
+	flapping bool
+}
+
+// returns the ratio of the runs in the history whose status differs from
+// the previous run
+func (self *StatusHistory) changeRatio() float64 {
+	if len(self.statuses) < 2 {
+		return 0
+	}
+	changes := 0
+	for idx := 1; idx < len(self.statuses); idx++ {
+		if self.statuses[idx] != self.statuses[idx-1] {
+			changes++
+		}
+	}
+	return float64(changes) / float64(len(self.statuses)-1)
+}
+
+type FlapDetector struct {
+	lock      sync.Mutex
+	histories map[string]*StatusHistory
+}
+
+var flapDetector = NewFlapDetector()
+
+func NewFlapDetector() *FlapDetector {
+	return &FlapDetector{histories: make(map[string]*StatusHistory)}
+}
+
+// records the status of a run of the instance and returns whether it's
+// flapping and whether it started or stopped flapping with this run. An
+// instance only starts flapping once its window is full.
+func (self *FlapDetector) Record(key, status string, config *FlappingConfig) (bool, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	history := self.histories[key]
+	if history == nil {
+		history = &StatusHistory{}
+		self.histories[key] = history
+	}
+	history.statuses = append(history.statuses, status)
+	if len(history.statuses) > config.Window {
+		history.statuses = history.statuses[len(history.statuses)-config.Window:]
+	}
+
+	ratio := history.changeRatio()
+	switch {
+	case !history.flapping && len(history.statuses) == config.Window && ratio > config.High:
+		history.flapping = true
+		return true, true
+	case history.flapping && ratio < config.Low:
+		history.flapping = false
+		return false, true
+	}
+	return history.flapping, false
+}
+
+// replaces the status of the dimensions by flapping while the instance is
+// flapping and reports plugins.<name>.flapping events when it starts and
+// stops. Returns the status to record for the check.
+func dampenFlapping(ep *errplane.Errplane, plugin *PluginMetadata, id string, dimensions errplane.Dimensions) string {
+	status := dimensions["status"]
+	if !AgentConfig().Flapping.Enabled {
+		return status
+	}
+	flapping, changed := flapDetector.Record(plugin.Name+"/"+id, status, &AgentConfig().Flapping)
+	if changed {
+		title := fmt.Sprintf("%s stopped flapping", plugin.Name)
+		severity := EVENT_SEVERITY_INFO
+		if flapping {
+			title = fmt.Sprintf("%s is flapping", plugin.Name)
+			severity = EVENT_SEVERITY_WARNING
+		}
+		if instance := dimensions["instance"]; instance != "" {
+			title += ", instance " + instance
+		}
+		log.Info("%s. Status %s", title, status)
+		context, _ := json.Marshal(&eventAnnotation{title, "", severity})
+		eventDimensions := errplane.Dimensions{"flapping": fmt.Sprint(flapping), "severity": severity}
+		for _, name := range []string{"host", "instance", "instance_id"} {
+			if value, ok := dimensions[name]; ok {
+				eventDimensions[name] = value
+			}
+		}
+		reportWithContext(ep, fmt.Sprintf("plugins.%s.flapping", plugin.Name), 1.0, time.Now(), string(context), eventDimensions)
+	}
+	if !flapping {
+		return status
+	}
+	dimensions["status"] = STATUS_FLAPPING
+	dimensions["flapping_status"] = status
+	return STATUS_FLAPPING
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type FlappingSuite struct{}
+
+var _ = Suite(&FlappingSuite{})
+
+func (self *FlappingSuite) TestFlapDetector(c *C) {
+	config := &FlappingConfig{Enabled: true, Window: 5, High: 0.5, Low: 0.25}
+	detector := NewFlapDetector()
+	record := func(status string) (bool, bool) { return detector.Record("mysql/abc", status, config) }
+
+	// the window must be full before the instance flaps
+	for _, status := range []string{"ok", "critical", "ok", "critical"} {
+		flapping, changed := record(status)
+		c.Assert(flapping, Equals, false)
+		c.Assert(changed, Equals, false)
+	}
+	flapping, changed := record("ok")
+	c.Assert(flapping, Equals, true)
+	c.Assert(changed, Equals, true)
+
+	// it keeps flapping until less than a quarter of the runs changed
+	flapping, changed = record("ok")
+	c.Assert(flapping, Equals, true)
+	c.Assert(changed, Equals, false)
+	record("ok")
+	flapping, _ = record("ok")
+	c.Assert(flapping, Equals, true)
+	flapping, changed = record("ok")
+	c.Assert(flapping, Equals, false)
+	c.Assert(changed, Equals, true)
+
+	flapping, _ = detector.Record("mysql/other", "critical", config)
+	c.Assert(flapping, Equals, false)
+}
+
+func (self *FlappingSuite) TestDampenFlapping(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.Flapping = FlappingConfig{Enabled: true, Window: 3, High: 0.5, Low: 0.25}
+	})()
+	defer func() { flapDetector = NewFlapDetector() }()
+	previousBatcher := httpBatcher
+	defer func() { httpBatcher = previousBatcher }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+
+	plugin := &PluginMetadata{Name: "mysql"}
+	statuses := []string{}
+	for _, status := range []string{"ok", "critical", "ok"} {
+		dimensions := errplane.Dimensions{"host": "db1", "instance": "replica", "status": status}
+		statuses = append(statuses, dampenFlapping(nil, plugin, "abc", dimensions))
+		if status == "ok" && len(statuses) == 3 {
+			c.Assert(dimensions["status"], Equals, STATUS_FLAPPING)
+			c.Assert(dimensions["flapping_status"], Equals, "ok")
+		}
+	}
+	c.Assert(statuses, DeepEquals, []string{"ok", "critical", STATUS_FLAPPING})
+	writes := httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.mysql.flapping")
+	c.Assert(writes[0].Points, HasLen, 1)
+	c.Assert(writes[0].Points[0].Dimensions["flapping"], Equals, "true")
+	c.Assert(writes[0].Points[0].Dimensions["instance"], Equals, "replica")
+}
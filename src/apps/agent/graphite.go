@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	GRAPHITE_MAX_PACKET_SIZE = 64 * 1024
+	GRAPHITE_READ_TIMEOUT    = 5 * time.Minute
+	GRAPHITE_MAX_BATCH_SIZE  = 5000
+)
+
+// parses a line of the graphite plaintext protocol, `metric value
+// timestamp`, the metric can have graphite tags, e.g.
+// disk.used;mount=/data 12.5 1400000000. A missing timestamp or -1 is now.
+func parseGraphiteLine(line string, now time.Time) (string, errplane.Dimensions, *errplane.JsonPoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", nil, nil, fmt.Errorf("Expected 'metric value timestamp', got '%s'", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", nil, nil, fmt.Errorf("Invalid value '%s'", fields[1])
+	}
+
+	timestamp := now.Unix()
+	if len(fields) == 3 && fields[2] != "-1" {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("Invalid timestamp '%s'", fields[2])
+		}
+		timestamp = int64(seconds)
+	}
+
+	tags := strings.Split(fields[0], ";")
+	name := tags[0]
+	if name == "" {
+		return "", nil, nil, fmt.Errorf("Empty metric name in '%s'", line)
+	}
+	dimensions := errplane.Dimensions{}
+	for _, tag := range tags[1:] {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", nil, nil, fmt.Errorf("Invalid tag '%s'", tag)
+		}
+		dimensions[parts[0]] = parts[1]
+	}
+	return name, dimensions, &errplane.JsonPoint{Value: value, Time: timestamp, Dimensions: dimensions}, nil
+}
+
+// Batches the points received by the graphite listener, they're sent every
+// flush interval or as soon as a batch is full
+type GraphiteBatch struct {
+	lock   sync.Mutex
+	writes map[string]*errplane.JsonPoints
+	size   int
+	send   func(*errplane.WriteOperation) error
+}
+
+func NewGraphiteBatch(send func(*errplane.WriteOperation) error) *GraphiteBatch {
+	return &GraphiteBatch{writes: make(map[string]*errplane.JsonPoints), send: send}
+}
+
+func (self *GraphiteBatch) Add(line string, now time.Time) error {
+	name, dimensions, point, err := parseGraphiteLine(line, now)
+	if err != nil {
+		return ParseError(err)
+	}
+	// the host tag of a relayed point wins over the host of the agent
+	if _, ok := dimensions["host"]; !ok {
+		dimensions["host"] = AgentConfig().Hostname
+	}
+	name = AgentConfig().Graphite.Prefix + name
+
+	self.lock.Lock()
+	write, ok := self.writes[name]
+	if !ok {
+		write = &errplane.JsonPoints{Name: name, Points: make([]*errplane.JsonPoint, 0, 1)}
+		self.writes[name] = write
+	}
+	write.Points = append(write.Points, point)
+	self.size++
+	full := self.size >= GRAPHITE_MAX_BATCH_SIZE
+	self.lock.Unlock()
+
+	if full {
+		self.Flush()
+	}
+	return nil
+}
+
+func (self *GraphiteBatch) Flush() {
+	self.lock.Lock()
+	if self.size == 0 {
+		self.lock.Unlock()
+		return
+	}
+	operation := &errplane.WriteOperation{Writes: make([]*errplane.JsonPoints, 0, len(self.writes))}
+	for _, write := range self.writes {
+		operation.Writes = append(operation.Writes, write)
+	}
+	self.writes = make(map[string]*errplane.JsonPoints)
+	self.size = 0
+	self.lock.Unlock()
+
+	if err := self.send(operation); err != nil {
+		log.Error("Cannot send graphite points. Error: %s", err)
+	}
+}
+
+// reads graphite lines until the reader is closed or fails
+func (self *GraphiteBatch) Consume(reader io.Reader, source string) error {
+	// lines longer than bufio.MaxScanTokenSize (64KB) stop the scanner
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := self.Add(line, time.Now()); err != nil {
+			log.Debug("Ignoring graphite line from %s. Error: %s", source, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func serveGraphiteTcp(listener net.Listener, batch *GraphiteBatch) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Error("Cannot accept graphite connections on %s. Error: %s", listener.Addr(), err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(GRAPHITE_READ_TIMEOUT))
+			reader := &deadlineReader{conn}
+			if err := batch.Consume(reader, conn.RemoteAddr().String()); err != nil {
+				log.Debug("Graphite connection from %s closed. Error: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// extends the read deadline of an idle connection after every read
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (self *deadlineReader) Read(p []byte) (int, error) {
+	n, err := self.conn.Read(p)
+	self.conn.SetReadDeadline(time.Now().Add(GRAPHITE_READ_TIMEOUT))
+	return n, err
+}
+
+func serveGraphiteUdp(conn net.PacketConn, batch *GraphiteBatch) {
+	buffer := make([]byte, GRAPHITE_MAX_PACKET_SIZE)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Error("Cannot read graphite packets on %s. Error: %s", conn.LocalAddr(), err)
+			return
+		}
+		// a packet can have several lines
+		batch.Consume(strings.NewReader(string(buffer[:n])), addr.String())
+	}
+}
+
+// accepts the graphite plaintext protocol over tcp and udp and relays the
+// points through the agent with the host dimension
+func startGraphiteListener(ep *errplane.Errplane) {
+	address := AgentConfig().Graphite.Listen
+	if address == "" {
+		return
+	}
+
+	batch := NewGraphiteBatch(func(operation *errplane.WriteOperation) error {
+		return sendHttp(ep, operation)
+	})
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Error("Cannot listen for graphite on tcp %s. Error: %s", address, err)
+		return
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Error("Cannot listen for graphite on udp %s. Error: %s", address, err)
+		listener.Close()
+		return
+	}
+	log.Info("Relaying graphite metrics received on %s", address)
+
+	go serveGraphiteTcp(listener, batch)
+	go serveGraphiteUdp(conn, batch)
+	for {
+		time.Sleep(AgentConfig().FlushInterval)
+		batch.Flush()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type GraphiteSuite struct{}
+
+var _ = Suite(&GraphiteSuite{})
+
+func (self *GraphiteSuite) TestParseGraphiteLine(c *C) {
+	now := time.Unix(1400000100, 0)
+	name, dimensions, point, err := parseGraphiteLine("app.requests 12.5 1400000000", now)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "app.requests")
+	c.Assert(dimensions, HasLen, 0)
+	c.Assert(point.Value, Equals, 12.5)
+	c.Assert(point.Time, Equals, int64(1400000000))
+
+	name, dimensions, point, err = parseGraphiteLine("disk.used;mount=/data;dc=east 3 -1", now)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "disk.used")
+	c.Assert(dimensions, DeepEquals, errplane.Dimensions{"mount": "/data", "dc": "east"})
+	c.Assert(point.Time, Equals, now.Unix())
+
+	for _, line := range []string{"app.requests", "app.requests abc 1", "app.requests nan", "app.requests 1 2 3", ";a=b 1", "a;b 1"} {
+		_, _, _, err := parseGraphiteLine(line, now)
+		c.Assert(err, NotNil, Commentf("line %s", line))
+	}
+}
+
+func (self *GraphiteSuite) TestGraphiteBatch(c *C) {
+	defer setTestConfig(func(config *Config) { config.Graphite.Prefix = "graphite." })()
+	operations := make([]*errplane.WriteOperation, 0)
+	batch := NewGraphiteBatch(func(operation *errplane.WriteOperation) error {
+		operations = append(operations, operation)
+		return nil
+	})
+
+	input := "app.requests 1 1400000000\n\ngarbage\napp.requests 2 1400000010\napp.errors;host=web2 3 1400000010\n"
+	c.Assert(batch.Consume(strings.NewReader(input), "test"), IsNil)
+	batch.Flush()
+	batch.Flush()
+	c.Assert(operations, HasLen, 1)
+
+	writes := make(map[string]*errplane.JsonPoints)
+	for _, write := range operations[0].Writes {
+		writes[write.Name] = write
+	}
+	c.Assert(writes["graphite.app.requests"].Points, HasLen, 2)
+	c.Assert(writes["graphite.app.requests"].Points[0].Dimensions["host"], Equals, AgentConfig().Hostname)
+	c.Assert(writes["graphite.app.errors"].Points[0].Dimensions["host"], Equals, "web2")
+}
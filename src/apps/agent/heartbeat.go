@@ -0,0 +1,86 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"github.com/errplane/errplane-go"
+	"launchpad.net/goyaml"
+	"net/http"
+	"time"
+	. "utils"
+)
+
+const HEARTBEAT_URL_TIMEOUT = 10 * time.Second
+
+// What the heartbeat says about the agent. The config revisions are the
+// start of the hashes of the config file and of the backend configuration,
+// so an agent running a stale configuration stands out.
+type Heartbeat struct {
+	Version               string  `json:"version"`
+	Uptime                float64 `json:"uptime"` // in seconds
+	ConfigRevision        string  `json:"config_revision"`
+	BackendConfigRevision string  `json:"backend_config_revision,omitempty"`
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// the hash of the config file with its layers and defaults, from its yaml
+// since the layers can't be marshalled to json
+func agentConfigRevision() string {
+	data, err := goyaml.Marshal(*AgentConfig())
+	if err != nil {
+		return ""
+	}
+	return configHash(string(data))
+}
+
+func newHeartbeat(now time.Time) *Heartbeat {
+	return &Heartbeat{
+		Version:               agentVersion,
+		Uptime:                now.Sub(agentStart).Seconds(),
+		ConfigRevision:        shortHash(agentConfigRevision()),
+		BackendConfigRevision: shortHash(backendConfigRevision.Get()),
+	}
+}
+
+// reports agent.heartbeat every heartbeat interval whatever the plugins are
+// doing, the value is the uptime and the context the heartbeat as json.
+// The url of the config is fetched as well so a system outside errplane
+// can tell the agent stopped
+func sendHeartbeats(ep *errplane.Errplane) {
+	if AgentConfig().Heartbeat.Disabled {
+		return
+	}
+	client := &http.Client{Timeout: HEARTBEAT_URL_TIMEOUT}
+	for {
+		now := time.Now()
+		heartbeat := newHeartbeat(now)
+		context, _ := json.Marshal(heartbeat)
+		dimensions := errplane.Dimensions{
+			"host":    AgentConfig().Hostname,
+			"version": agentVersion,
+		}
+		if AgentConfig().Ephemeral.Enabled {
+			dimensions["ephemeral"] = "true"
+		}
+		reportWithContext(ep, "agent.heartbeat", heartbeat.Uptime, now, string(context), dimensions)
+
+		if url := AgentConfig().Heartbeat.Url; url != "" {
+			if resp, err := client.Get(url); err != nil {
+				log.Warn("Cannot get the heartbeat url. Error: %s", NetworkError(err))
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					log.Warn("Received status code %d from the heartbeat url", resp.StatusCode)
+				}
+			}
+		}
+
+		time.Sleep(AgentConfig().Heartbeat.Interval)
+	}
+}
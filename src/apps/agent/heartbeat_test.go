@@ -0,0 +1,27 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type HeartbeatSuite struct{}
+
+var _ = Suite(&HeartbeatSuite{})
+
+func (self *HeartbeatSuite) TestNewHeartbeat(c *C) {
+	defer func(version string) { agentVersion = version }(agentVersion)
+	agentVersion = "1.4.2"
+	previous := backendConfigRevision
+	defer func() { backendConfigRevision = previous }()
+	backendConfigRevision = &ConfigRevision{}
+
+	heartbeat := newHeartbeat(agentStart.Add(90 * time.Second))
+	c.Assert(heartbeat.Version, Equals, "1.4.2")
+	c.Assert(heartbeat.Uptime, Equals, 90.0)
+	c.Assert(heartbeat.ConfigRevision, HasLen, 12)
+	c.Assert(heartbeat.BackendConfigRevision, Equals, "")
+
+	backendConfigRevision.Set(configHash(map[string]string{"plugins": "mysql"}))
+	c.Assert(newHeartbeat(time.Now()).BackendConfigRevision, HasLen, 12)
+}
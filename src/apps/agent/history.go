@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the kinds of history entries
+const (
+	HISTORY_STATE = "state" // a check changed state
+	HISTORY_TOP   = "top"   // the usage of one of the top processes
+	HISTORY_EVENT = "event" // e.g. an alert was sent or the configuration changed
+)
+
+const (
+	HISTORY_AGENT_STARTED    = "Agent started"
+	HISTORY_TOP_INTERVAL     = 10 * time.Minute
+	HISTORY_COMPACT_INTERVAL = time.Hour
+)
+
+type HistoryEntry struct {
+	Timestamp int64   `json:"timestamp"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"` // the check (kind/name/instance), the process or the title of the event
+	State     string  `json:"state,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	Cpu       float64 `json:"cpu,omitempty"`    // percent
+	Memory    float64 `json:"memory,omitempty"` // resident bytes
+}
+
+// Keeps the state changes of the checks, the usage of the top processes
+// and the notable events in a local file, one json entry per line, so a
+// report can be generated on hosts that can't reach the backend. Entries
+// older than the retention are dropped every hour.
+type HistoryStore struct {
+	lock      sync.Mutex
+	path      string
+	retention time.Duration
+	lastTop   time.Time
+}
+
+var historyStore *HistoryStore
+
+func NewHistoryStore(path string, retention time.Duration) *HistoryStore {
+	return &HistoryStore{path: path, retention: retention}
+}
+
+func recordHistory(entry *HistoryEntry) {
+	if historyStore == nil {
+		return
+	}
+	historyStore.Record(entry)
+}
+
+func (self *HistoryStore) Record(entry *HistoryEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("Cannot marshal history entry. Error: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	file, err := os.OpenFile(self.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Cannot open history %s. Error: %s", self.path, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		log.Error("Cannot write to history %s. Error: %s", self.path, err)
+	}
+}
+
+// records the usage of the n processes using the most cpu and the n using
+// the most memory, at most every HISTORY_TOP_INTERVAL
+func (self *HistoryStore) RecordTop(stats []MergedProcStat, n int, now time.Time) {
+	self.lock.Lock()
+	if now.Sub(self.lastTop) < HISTORY_TOP_INTERVAL {
+		self.lock.Unlock()
+		return
+	}
+	self.lastTop = now
+	self.lock.Unlock()
+
+	sorted := make([]MergedProcStat, len(stats))
+	copy(sorted, stats)
+	if n > len(sorted) {
+		n = len(sorted)
+	}
+	top := make(map[int]MergedProcStat)
+	sort.Sort(ProcStatsSortableByCpu(sorted))
+	for _, stat := range sorted[:n] {
+		top[stat.pid] = stat
+	}
+	sort.Sort(ProcStatsSortableByMem(sorted))
+	for _, stat := range sorted[:n] {
+		top[stat.pid] = stat
+	}
+	for _, stat := range top {
+		self.Record(&HistoryEntry{Timestamp: now.Unix(), Kind: HISTORY_TOP, Name: stat.name, Cpu: stat.cpuUsage, Memory: stat.memUsage})
+	}
+}
+
+// drops the entries older than the retention
+func (self *HistoryStore) Compact(now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entries, err := readHistory(self.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := now.Add(-self.retention).Unix()
+	file, err := os.OpenFile(self.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if entry.Timestamp < cutoff {
+			continue
+		}
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(self.path+".tmp", self.path)
+}
+
+func (self *HistoryStore) compactPeriodically() {
+	for {
+		if err := self.Compact(time.Now()); err != nil {
+			log.Error("Cannot drop the old entries of history %s. Error: %s", self.path, err)
+		}
+		time.Sleep(HISTORY_COMPACT_INTERVAL)
+	}
+}
+
+// reads the entries of the history in the order they were recorded, the
+// lines that can't be parsed, e.g. truncated by a crash, are skipped
+func readHistory(path string) ([]*HistoryEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*HistoryEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// what the host lets the agent do, probed once at startup. A plugin can
+// require them in its info.yml like the agent capabilities.
+const (
+	HOST_CAPABILITY_ROOT        = "root"        // the agent runs as root
+	HOST_CAPABILITY_PROC        = "proc"        // the stats in /proc are readable
+	HOST_CAPABILITY_DOCKER      = "docker"      // the docker socket accepts connections
+	HOST_CAPABILITY_RAW_SOCKETS = "raw-sockets" // icmp sockets can be opened, e.g. to ping
+)
+
+const HOST_CAPABILITY_PROBE_TIMEOUT = 5 * time.Second
+
+// what's disabled when a capability is missing
+var HOST_CAPABILITY_DEPENDENTS = map[string]string{
+	HOST_CAPABILITY_ROOT:        "the plugins requiring root",
+	HOST_CAPABILITY_PROC:        "the network, disk io and process watch collectors",
+	HOST_CAPABILITY_DOCKER:      "the docker collector",
+	HOST_CAPABILITY_RAW_SOCKETS: "the plugins requiring raw-sockets",
+}
+
+// the probed capabilities and why they're missing, nil if they're there
+type HostCapabilities map[string]error
+
+// the capabilities that weren't probed, e.g. docker when the docker
+// collector isn't enabled, are assumed to be there
+var hostCapabilities = HostCapabilities{}
+
+func isHostCapability(name string) bool {
+	_, ok := HOST_CAPABILITY_DEPENDENTS[name]
+	return ok
+}
+
+func (self HostCapabilities) Has(name string) bool {
+	return self[name] == nil
+}
+
+// returns the missing capabilities and why they're missing
+func (self HostCapabilities) Missing() map[string]string {
+	missing := make(map[string]string)
+	for name, err := range self {
+		if err != nil {
+			missing[name] = err.Error()
+		}
+	}
+	return missing
+}
+
+func probeRoot() error {
+	if uid := os.Geteuid(); uid != 0 {
+		return fmt.Errorf("running as uid %d", uid)
+	}
+	return nil
+}
+
+func probeProc(root string) error {
+	for _, file := range []string{"self/stat", "net/dev", "diskstats"} {
+		if _, err := ioutil.ReadFile(filepath.Join(root, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func probeDocker(socket string) error {
+	conn, err := net.DialTimeout("unix", socket, HOST_CAPABILITY_PROBE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeRawSockets() error {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probes the capabilities that make sense on this host with this config
+func probeHostCapabilities() HostCapabilities {
+	capabilities := HostCapabilities{}
+	if runtime.GOOS != "windows" {
+		capabilities[HOST_CAPABILITY_ROOT] = probeRoot()
+		capabilities[HOST_CAPABILITY_RAW_SOCKETS] = probeRawSockets()
+	}
+	if PROC_STATS {
+		capabilities[HOST_CAPABILITY_PROC] = probeProc(procRoot)
+	}
+	if AgentConfig().Docker.Enabled {
+		capabilities[HOST_CAPABILITY_DOCKER] = probeDocker(AgentConfig().Docker.Socket)
+	}
+	return capabilities
+}
+
+// one line with every probed capability, why the missing ones are missing
+// and what's disabled because of them
+func (self HostCapabilities) Summary() string {
+	names := make([]string, 0, len(self))
+	for name := range self {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	disabled := make([]string, 0)
+	for _, name := range names {
+		if err := self[name]; err != nil {
+			parts = append(parts, fmt.Sprintf("%s missing (%s)", name, err))
+			disabled = append(disabled, HOST_CAPABILITY_DEPENDENTS[name])
+			continue
+		}
+		parts = append(parts, name+" ok")
+	}
+	summary := "Capabilities: " + strings.Join(parts, ", ")
+	if len(disabled) > 0 {
+		summary += ". Disabled " + strings.Join(disabled, ", ")
+	}
+	return summary
+}
+
+// probes the capabilities before the collectors start, logs them in a
+// single line and reports them as agent.capabilities with a dimension per
+// capability
+func reportHostCapabilities(ep *errplane.Errplane) {
+	hostCapabilities = probeHostCapabilities()
+	if len(hostCapabilities.Missing()) > 0 {
+		log.Warn("%s", hostCapabilities.Summary())
+	} else {
+		log.Info("%s", hostCapabilities.Summary())
+	}
+
+	dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+	for name := range hostCapabilities {
+		dimensions[name] = fmt.Sprint(hostCapabilities.Has(name))
+	}
+	report(ep, "agent.capabilities", 1.0, time.Now(), dimensions, nil)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the addresses are looked up again after this, e.g. after a dhcp renewal
+const HOST_IPS_TTL = time.Minute
+
+type InterfaceAddress struct {
+	Interface string
+	Ip        net.IP
+}
+
+// returns the ipv4 addresses of the interfaces that are up, sorted by
+// interface name
+func interfaceAddresses(config *HostIpConfig) ([]*InterfaceAddress, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]*InterfaceAddress, 0)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || matchesAny(config.IgnoreInterfaces, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				addresses = append(addresses, &InterfaceAddress{iface.Name, ipNet.IP})
+			}
+		}
+	}
+	sort.Sort(AddressesSortableByInterface(addresses))
+	return addresses, nil
+}
+
+type AddressesSortableByInterface []*InterfaceAddress
+
+func (self AddressesSortableByInterface) Len() int { return len(self) }
+func (self AddressesSortableByInterface) Less(i, j int) bool {
+	return self[i].Interface < self[j].Interface
+}
+func (self AddressesSortableByInterface) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// the position of the first pattern or subnet matching the address, len if
+// none does
+func interfaceRank(config *HostIpConfig, address *InterfaceAddress) int {
+	for idx, pattern := range config.Interfaces {
+		if matchesAny([]string{pattern}, address.Interface) {
+			return idx
+		}
+	}
+	return len(config.Interfaces)
+}
+
+func subnetRank(config *HostIpConfig, address *InterfaceAddress) int {
+	for idx, subnet := range config.Subnets {
+		if subnet.Contains(address.Ip) {
+			return idx
+		}
+	}
+	return len(config.Subnets)
+}
+
+// picks the host ip among the addresses following the preferences of the
+// config, the address of the default route wins the ties
+func selectHostIp(config *HostIpConfig, addresses []*InterfaceAddress, defaultRoute string) string {
+	if len(config.Interfaces) == 0 && len(config.Subnets) == 0 {
+		return defaultRoute
+	}
+
+	var best *InterfaceAddress
+	bestInterface, bestSubnet := len(config.Interfaces), len(config.Subnets)
+	for _, address := range addresses {
+		byInterface, bySubnet := interfaceRank(config, address), subnetRank(config, address)
+		if len(config.Interfaces) > 0 && byInterface == len(config.Interfaces) {
+			continue
+		}
+		if len(config.Interfaces) == 0 && bySubnet == len(config.Subnets) {
+			continue
+		}
+		if best == nil || byInterface < bestInterface || byInterface == bestInterface && bySubnet < bestSubnet ||
+			byInterface == bestInterface && bySubnet == bestSubnet && address.Ip.String() == defaultRoute {
+			best, bestInterface, bestSubnet = address, byInterface, bySubnet
+		}
+	}
+	if best == nil {
+		return defaultRoute
+	}
+	return best.Ip.String()
+}
+
+// The host ip and the address of every interface, looked up at most once
+// per HOST_IPS_TTL
+type HostIps struct {
+	lock       sync.Mutex
+	primary    string
+	interfaces map[string]string
+	updated    time.Time
+}
+
+var hostIps = &HostIps{}
+
+// returns the host ip and the first address of every interface
+func (self *HostIps) Get() (string, map[string]string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if time.Now().Sub(self.updated) < HOST_IPS_TTL {
+		return self.primary, self.interfaces
+	}
+
+	self.updated = time.Now()
+	config := &AgentConfig().HostIp
+	addresses, err := interfaceAddresses(config)
+	if err != nil {
+		log.Error("Cannot list the addresses of the interfaces. Error: %s", err)
+		return self.primary, self.interfaces
+	}
+	self.primary = selectHostIp(config, addresses, primaryIpv4())
+	self.interfaces = make(map[string]string)
+	for _, address := range addresses {
+		if _, ok := self.interfaces[address.Interface]; !ok {
+			self.interfaces[address.Interface] = address.Ip.String()
+		}
+	}
+	return self.primary, self.interfaces
+}
+
+// forgets the addresses, e.g. after the host-ip config was reloaded
+func (self *HostIps) Clear() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.updated = time.Time{}
+}
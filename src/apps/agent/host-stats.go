@@ -0,0 +1,245 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"github.com/errplane/gosigar"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// Collects the host.cpu.*, host.mem.*, host.disk.* and host.net.* stats in
+// process and sends them in a single write per sleep instead of one report
+// per metric. Replaces the server.stats.* cpu, memory, disk and network
+// stats when enabled.
+type HostStatsCollector struct {
+	writes       []*errplane.JsonPoints
+	writesByName map[string]*errplane.JsonPoints
+	timestamp    time.Time
+	prevCpus     []sigar.Cpu
+	prevNetwork  NetworkUtilization
+	prevTime     time.Time
+}
+
+func NewHostStatsCollector() *HostStatsCollector {
+	return &HostStatsCollector{}
+}
+
+func hostStats(ep *errplane.Errplane) {
+	collector := NewHostStatsCollector()
+	for {
+		writes := collector.Collect()
+		if len(writes) > 0 {
+			if err := sendHttp(ep, &errplane.WriteOperation{Writes: writes}); err != nil {
+				log.Error("Cannot send host stats. Error: %s", err)
+			}
+		}
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+func (self *HostStatsCollector) add(name string, value float64, dimensions errplane.Dimensions) {
+	write := self.writesByName[name]
+	if write == nil {
+		write = &errplane.JsonPoints{Name: name}
+		self.writesByName[name] = write
+		self.writes = append(self.writes, write)
+	}
+	dimensions["host"] = AgentConfig().Hostname
+	write.Points = append(write.Points, &errplane.JsonPoint{Value: value, Time: self.timestamp.Unix(), Dimensions: dimensions})
+}
+
+// returns the points of this sample, the cpu and network rates are only
+// available from the second sample on
+func (self *HostStatsCollector) Collect() []*errplane.JsonPoints {
+	self.writes = make([]*errplane.JsonPoints, 0)
+	self.writesByName = make(map[string]*errplane.JsonPoints)
+	self.timestamp = time.Now()
+
+	self.collectCpu()
+	self.collectMem()
+	self.collectDisks()
+	if PROC_STATS {
+		self.collectNetwork()
+	}
+
+	self.prevTime = self.timestamp
+	return self.writes
+}
+
+func (self *HostStatsCollector) collectCpu() {
+	cpu := sigar.Cpu{}
+	if err := cpu.Get(); err != nil {
+		log.Error("Cannot get cpu stats. Error: %s", err)
+		return
+	}
+	cpus := []sigar.Cpu{cpu}
+	if AgentConfig().HostStats.PerCpu {
+		list := sigar.CpuList{}
+		if err := list.Get(); err != nil {
+			log.Error("Cannot get per cpu stats. Error: %s", err)
+		} else {
+			cpus = append(cpus, list.List...)
+		}
+	}
+
+	if len(self.prevCpus) == len(cpus) {
+		for idx, cpu := range cpus {
+			name := "total"
+			if idx > 0 {
+				name = strconv.Itoa(idx - 1)
+			}
+			for state, value := range cpuPercentages(self.prevCpus[idx], cpu) {
+				self.add("host.cpu."+state, value, errplane.Dimensions{"cpu": name})
+			}
+		}
+	}
+	self.prevCpus = cpus
+}
+
+// returns the percentage of time spent in each state between the two samples
+func cpuPercentages(prev, cpu sigar.Cpu) map[string]float64 {
+	total := float64(cpu.Total() - prev.Total())
+	if total <= 0 {
+		return nil
+	}
+	return map[string]float64{
+		"user":    float64(cpu.User-prev.User) / total * 100,
+		"nice":    float64(cpu.Nice-prev.Nice) / total * 100,
+		"sys":     float64(cpu.Sys-prev.Sys) / total * 100,
+		"idle":    float64(cpu.Idle-prev.Idle) / total * 100,
+		"wait":    float64(cpu.Wait-prev.Wait) / total * 100,
+		"irq":     float64(cpu.Irq-prev.Irq) / total * 100,
+		"softirq": float64(cpu.SoftIrq-prev.SoftIrq) / total * 100,
+		"stolen":  float64(cpu.Stolen-prev.Stolen) / total * 100,
+	}
+}
+
+func (self *HostStatsCollector) collectMem() {
+	mem := sigar.Mem{}
+	if err := mem.Get(); err != nil {
+		log.Error("Cannot get memory stats. Error: %s", err)
+		return
+	}
+	self.add("host.mem.total", float64(mem.Total), errplane.Dimensions{})
+	self.add("host.mem.free", float64(mem.Free), errplane.Dimensions{})
+	self.add("host.mem.used", float64(mem.Used), errplane.Dimensions{})
+	self.add("host.mem.actual_used", float64(mem.ActualUsed), errplane.Dimensions{})
+	if mem.Total > 0 {
+		self.add("host.mem.used_percentage", float64(mem.ActualUsed)/float64(mem.Total)*100, errplane.Dimensions{})
+	}
+
+	swap := sigar.Swap{}
+	if err := swap.Get(); err != nil {
+		log.Error("Cannot get swap stats. Error: %s", err)
+		return
+	}
+	if swap.Total > 0 {
+		self.add("host.mem.swap_used", float64(swap.Used), errplane.Dimensions{})
+		self.add("host.mem.swap_free", float64(swap.Free), errplane.Dimensions{})
+		self.add("host.mem.swap_used_percentage", float64(swap.Used)/float64(swap.Total)*100, errplane.Dimensions{})
+	}
+}
+
+func (self *HostStatsCollector) collectDisks() {
+	fslist := sigar.FileSystemList{}
+	if err := fslist.Get(); err != nil {
+		log.Error("Cannot list the filesystems. Error: %s", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, fs := range fslist.List {
+		if ignoredFsType(fs.SysTypeName) || seen[fs.DevName] {
+			// skip the pseudo filesystems and the bind mounts of the same device
+			continue
+		}
+		seen[fs.DevName] = true
+
+		usage := sigar.FileSystemUsage{}
+		if err := usage.Get(fs.DirName); err != nil {
+			log.Debug("Cannot get the usage of %s. Error: %s", fs.DirName, err)
+			continue
+		}
+		dimensions := func() errplane.Dimensions {
+			return errplane.Dimensions{"device": fs.DevName, "mount": fs.DirName}
+		}
+		self.add("host.disk.total", float64(usage.Total), dimensions())
+		self.add("host.disk.used", float64(usage.Used), dimensions())
+		self.add("host.disk.free", float64(usage.Avail), dimensions())
+		self.add("host.disk.used_percentage", usage.UsePercent(), dimensions())
+	}
+}
+
+func ignoredFsType(fsType string) bool {
+	for _, ignored := range AgentConfig().HostStats.IgnoreFsTypes {
+		if fsType == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+func ignoredInterface(name string) bool {
+	for _, prefix := range AgentConfig().HostStats.IgnoreInterfaces {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *HostStatsCollector) collectNetwork() {
+	network := NetworkUtilization{}
+	if err := network.Get(); err != nil {
+		log.Error("Cannot get network stats. Error: %s", err)
+		return
+	}
+
+	if self.prevNetwork != nil {
+		seconds := self.timestamp.Sub(self.prevTime).Seconds()
+		for name, rates := range networkRates(self.prevNetwork, network, seconds) {
+			for metric, value := range rates {
+				self.add("host.net."+metric, value, errplane.Dimensions{"device": name})
+			}
+		}
+	}
+	self.prevNetwork = network
+}
+
+// returns the per second rates of the interfaces that aren't ignored,
+// counters that went backwards (e.g. the interface was recreated) are
+// skipped
+func networkRates(prev, network NetworkUtilization, seconds float64) map[string]map[string]float64 {
+	rates := make(map[string]map[string]float64)
+	if seconds <= 0 {
+		return rates
+	}
+	for name, utilization := range network {
+		previous := prev[name]
+		if previous == nil || ignoredInterface(name) {
+			continue
+		}
+		counters := map[string][2]int64{
+			"rx_bytes":   {previous.rxBytes, utilization.rxBytes},
+			"rx_packets": {previous.rxPackets, utilization.rxPackets},
+			"rx_errors":  {previous.rxErrors, utilization.rxErrors},
+			"rx_dropped": {previous.rxDroppedPackets, utilization.rxDroppedPackets},
+			"tx_bytes":   {previous.txBytes, utilization.txBytes},
+			"tx_packets": {previous.txPackets, utilization.txPackets},
+			"tx_errors":  {previous.txErrors, utilization.txErrors},
+			"tx_dropped": {previous.txDroppedPackets, utilization.txDroppedPackets},
+		}
+		deviceRates := make(map[string]float64)
+		for metric, values := range counters {
+			if values[1] < values[0] {
+				continue
+			}
+			deviceRates[metric] = float64(values[1]-values[0]) / seconds
+		}
+		rates[name] = deviceRates
+	}
+	return rates
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	. "utils"
+)
+
+type HostCapabilitiesSuite struct{}
+
+var _ = Suite(&HostCapabilitiesSuite{})
+
+func (self *HostCapabilitiesSuite) TestProbeProc(c *C) {
+	root := c.MkDir()
+	c.Assert(probeProc(root), NotNil)
+
+	for _, file := range []string{"self/stat", "net/dev", "diskstats"} {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(root, file)), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(root, file), []byte("1"), 0644), IsNil)
+	}
+	c.Assert(probeProc(root), IsNil)
+}
+
+func (self *HostCapabilitiesSuite) TestProbeDocker(c *C) {
+	c.Assert(probeDocker(filepath.Join(c.MkDir(), "docker.sock")), NotNil)
+}
+
+func (self *HostCapabilitiesSuite) TestSummary(c *C) {
+	capabilities := HostCapabilities{
+		HOST_CAPABILITY_ROOT:   fmt.Errorf("running as uid 998"),
+		HOST_CAPABILITY_PROC:   nil,
+		HOST_CAPABILITY_DOCKER: fmt.Errorf("permission denied"),
+	}
+	c.Assert(capabilities.Summary(), Equals, "Capabilities: docker missing (permission denied), proc ok, root missing (running as uid 998). "+
+		"Disabled the docker collector, the plugins requiring root")
+	c.Assert(capabilities.Missing(), DeepEquals, map[string]string{"root": "running as uid 998", "docker": "permission denied"})
+	c.Assert(capabilities.Has(HOST_CAPABILITY_PROC), Equals, true)
+	c.Assert(capabilities.Has(HOST_CAPABILITY_DOCKER), Equals, false)
+	// not probed
+	c.Assert(capabilities.Has(HOST_CAPABILITY_RAW_SOCKETS), Equals, true)
+
+	c.Assert(HostCapabilities{HOST_CAPABILITY_PROC: nil}.Summary(), Equals, "Capabilities: proc ok")
+}
+
+func (self *HostCapabilitiesSuite) TestPluginsRequiringCapabilities(c *C) {
+	previous := hostCapabilities
+	defer func() { hostCapabilities = previous }()
+	hostCapabilities = HostCapabilities{HOST_CAPABILITY_RAW_SOCKETS: fmt.Errorf("operation not permitted"), HOST_CAPABILITY_ROOT: nil}
+
+	c.Assert(checkPluginCompatibility(&PluginMetadata{Capabilities: []string{HOST_CAPABILITY_ROOT}}), IsNil)
+	c.Assert(checkPluginCompatibility(&PluginMetadata{Capabilities: []string{CAPABILITY_JSON_OUTPUT, HOST_CAPABILITY_RAW_SOCKETS}}), ErrorMatches,
+		"The plugin requires raw-sockets, which this host doesn't have: operation not permitted")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"net"
+	"time"
+	. "utils"
+)
+
+type HostIpSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&HostIpSuite{})
+
+func (self *HostIpSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	config.Dimensions = nil
+	SetAgentConfig(&config)
+}
+
+func (self *HostIpSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+	hostIps = &HostIps{}
+}
+
+func (self *HostIpSuite) TestSelectHostIp(c *C) {
+	addresses := []*InterfaceAddress{
+		&InterfaceAddress{"bond0", net.ParseIP("192.168.1.10")},
+		&InterfaceAddress{"eth0", net.ParseIP("10.0.0.5")},
+		&InterfaceAddress{"eth1", net.ParseIP("172.16.0.5")},
+	}
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, storage, _ := net.ParseCIDR("172.16.0.0/12")
+
+	// without preference the default route wins
+	c.Assert(selectHostIp(&HostIpConfig{}, addresses, "192.168.1.10"), Equals, "192.168.1.10")
+
+	config := &HostIpConfig{Interfaces: []string{"eth*"}}
+	c.Assert(selectHostIp(config, addresses, "192.168.1.10"), Equals, "10.0.0.5")
+	c.Assert(selectHostIp(config, addresses, "172.16.0.5"), Equals, "172.16.0.5")
+
+	config = &HostIpConfig{Interfaces: []string{"eth*"}, Subnets: []*net.IPNet{storage, private}}
+	c.Assert(selectHostIp(config, addresses, "10.0.0.5"), Equals, "172.16.0.5")
+
+	config = &HostIpConfig{Subnets: []*net.IPNet{private}}
+	c.Assert(selectHostIp(config, addresses, "192.168.1.10"), Equals, "10.0.0.5")
+
+	// nothing matches the preferences
+	config = &HostIpConfig{Interfaces: []string{"ib0"}}
+	c.Assert(selectHostIp(config, addresses, "192.168.1.10"), Equals, "192.168.1.10")
+}
+
+func (self *HostIpSuite) TestIpDimensions(c *C) {
+	hostIps = &HostIps{primary: "10.0.0.5", interfaces: map[string]string{"eth0": "10.0.0.5", "eth1": "172.16.0.5"}, updated: time.Now()}
+	c.Assert(addGlobalDimensions(nil), IsNil)
+
+	setTestConfig(func(config *Config) { config.HostIp.Dimension = true })
+	c.Assert(addGlobalDimensions(errplane.Dimensions{"host": "db1"}), DeepEquals, errplane.Dimensions{"host": "db1", "ip": "10.0.0.5"})
+	c.Assert(addGlobalDimensions(errplane.Dimensions{"ip": "10.1.1.1"}), DeepEquals, errplane.Dimensions{"ip": "10.1.1.1"})
+
+	setTestConfig(func(config *Config) { config.HostIp.InterfaceDimensions = true })
+	c.Assert(addGlobalDimensions(nil), DeepEquals, errplane.Dimensions{"ip": "10.0.0.5", "ip_eth0": "10.0.0.5", "ip_eth1": "172.16.0.5"})
+
+	value, err := lookupFact("ip.eth1")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "172.16.0.5")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/errplane/gosigar"
+	. "launchpad.net/gocheck"
+	. "utils"
+)
+
+type HostStatsSuite struct{}
+
+var _ = Suite(&HostStatsSuite{})
+
+func (self *HostStatsSuite) TestCpuPercentages(c *C) {
+	prev := sigar.Cpu{User: 100, Sys: 50, Idle: 850}
+	cpu := sigar.Cpu{User: 150, Sys: 75, Idle: 1275}
+	percentages := cpuPercentages(prev, cpu)
+	c.Assert(percentages["user"], Equals, 10.0)
+	c.Assert(percentages["sys"], Equals, 5.0)
+	c.Assert(percentages["idle"], Equals, 85.0)
+
+	c.Assert(cpuPercentages(cpu, cpu), IsNil)
+}
+
+func (self *HostStatsSuite) TestNetworkRates(c *C) {
+	defer setTestConfig(func(config *Config) { config.HostStats.IgnoreInterfaces = []string{"lo", "veth"} })()
+
+	prev := NetworkUtilization{
+		"eth0":     &DeviceNetworkUtilization{rxBytes: 1000, txBytes: 5000},
+		"lo":       &DeviceNetworkUtilization{rxBytes: 1000},
+		"veth1234": &DeviceNetworkUtilization{rxBytes: 1000},
+	}
+	network := NetworkUtilization{
+		"eth0":     &DeviceNetworkUtilization{rxBytes: 3000, txBytes: 4000},
+		"eth1":     &DeviceNetworkUtilization{rxBytes: 3000},
+		"lo":       &DeviceNetworkUtilization{rxBytes: 2000},
+		"veth1234": &DeviceNetworkUtilization{rxBytes: 2000},
+	}
+	rates := networkRates(prev, network, 10)
+	c.Assert(rates, HasLen, 1)
+	c.Assert(rates["eth0"]["rx_bytes"], Equals, 200.0)
+	// the tx counter went backwards
+	_, ok := rates["eth0"]["tx_bytes"]
+	c.Assert(ok, Equals, false)
+}
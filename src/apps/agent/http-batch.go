@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const HTTP_BATCH_TIMEOUT = 30 * time.Second
+
+// Coalesces the points of the plugins, the checks and the listeners into
+// batches sent by a single goroutine, as soon as a batch has max points or
+// when its oldest point waited max latency
+type HttpBatcher struct {
+	lock       sync.Mutex
+	writes     map[string]*errplane.JsonPoints
+	size       int
+	oldest     time.Time
+	maxPoints  int
+	maxLatency time.Duration
+	full       chan bool
+	send       func(*errplane.WriteOperation) error
+}
+
+var httpBatcher *HttpBatcher
+
+func NewHttpBatcher(maxPoints int, maxLatency time.Duration, send func(*errplane.WriteOperation) error) *HttpBatcher {
+	return &HttpBatcher{
+		writes:     make(map[string]*errplane.JsonPoints),
+		maxPoints:  maxPoints,
+		maxLatency: maxLatency,
+		full:       make(chan bool, 1),
+		send:       send,
+	}
+}
+
+func (self *HttpBatcher) Add(operation *errplane.WriteOperation) {
+	self.lock.Lock()
+	if self.size == 0 {
+		self.oldest = time.Now()
+	}
+	for _, write := range operation.Writes {
+		batched, ok := self.writes[write.Name]
+		if !ok {
+			batched = &errplane.JsonPoints{Name: write.Name, Points: make([]*errplane.JsonPoint, 0, len(write.Points))}
+			self.writes[write.Name] = batched
+		}
+		batched.Points = append(batched.Points, write.Points...)
+		self.size += len(write.Points)
+	}
+	full := self.size >= self.maxPoints
+	self.lock.Unlock()
+
+	if full {
+		// the flush goroutine may already be sending the batch
+		select {
+		case self.full <- true:
+		default:
+		}
+	}
+}
+
+// returns the number of points waiting for the next batch, 0 if http-batch
+// is disabled
+func (self *HttpBatcher) Pending() int {
+	if self == nil {
+		return 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.size
+}
+
+// returns the points waiting to be sent and starts a new batch
+func (self *HttpBatcher) take() *errplane.WriteOperation {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.size == 0 {
+		return nil
+	}
+	operation := &errplane.WriteOperation{Writes: make([]*errplane.JsonPoints, 0, len(self.writes))}
+	for _, write := range self.writes {
+		operation.Writes = append(operation.Writes, write)
+	}
+	self.writes = make(map[string]*errplane.JsonPoints)
+	self.size = 0
+	return operation
+}
+
+func (self *HttpBatcher) Flush() {
+	operation := self.take()
+	if operation == nil {
+		return
+	}
+	if err := self.send(operation); err != nil {
+		log.Error("Cannot send a batch of points. Error: %s", err)
+	}
+}
+
+// how long until the oldest point waited max latency
+func (self *HttpBatcher) wait(now time.Time) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.size == 0 {
+		return self.maxLatency
+	}
+	wait := self.oldest.Add(self.maxLatency).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (self *HttpBatcher) Run() {
+	for {
+		select {
+		case <-self.full:
+		case <-time.After(self.wait(time.Now())):
+			// the batch may have started after the timer was set
+			if self.wait(time.Now()) > 0 {
+				continue
+			}
+		}
+		self.Flush()
+	}
+}
+
+// the client of the requests to the backend, the agent transport when nil
+var backendClient *http.Client
+
+// sends the points to the backend through the agent transport, the same
+// request errplane-go makes. The body is gzip compressed if http-batch.gzip
+// is set.
+func sendBackend(operation *errplane.WriteOperation) error {
+	data, err := json.Marshal(operation.Writes)
+	if err != nil {
+		return err
+	}
+	body := bytes.NewBuffer(nil)
+	gzipped := AgentConfig().HttpBatch.Gzip
+	if gzipped {
+		writer := gzip.NewWriter(body)
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	} else {
+		body.Write(data)
+	}
+
+	// https unless http-host has a scheme, e.g. http://localhost:8090 for the fake backend
+	host := AgentConfig().HttpHost
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	address := fmt.Sprintf("%s/databases/%s/points?api_key=%s", host,
+		url.QueryEscape(AgentConfig().Database()), url.QueryEscape(AgentConfig().ApiKey))
+	req, err := http.NewRequest("POST", address, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	client := backendClient
+	if client == nil {
+		client = &http.Client{Transport: AgentTransport(), Timeout: HTTP_BATCH_TIMEOUT}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Received status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// batches the points sent with sendHttp if http-batch is enabled
+func startHttpBatcher() error {
+	config := AgentConfig().HttpBatch
+	if !config.Enabled {
+		return nil
+	}
+
+	httpBatcher = NewHttpBatcher(config.MaxPoints, config.MaxLatency, func(operation *errplane.WriteOperation) error {
+		return deliverHttp(sendBackend, operation)
+	})
+	go httpBatcher.Run()
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/tls"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type HttpCheckResult struct {
+	state        PluginStateOutput
+	msg          string
+	protocol     string // e.g. HTTP/2.0
+	alpn         string // the protocol negotiated during the tls handshake
+	tlsVersion   string
+	h3Advertised bool
+	statusCode   int
+	responseTime time.Duration
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+func monitorHttpChecks(ep *errplane.Errplane) {
+	// the last protocol version negotiated for each check, used to detect downgrades
+	previousProtocols := make(map[string]string)
+
+	for {
+		for _, check := range AgentConfig().HttpChecks {
+			result := runHttpCheck(check, newHttpCheckClient(check))
+			if previous := previousProtocols[check.Name]; result.state == OK && isProtocolDowngrade(previous, result.protocol) {
+				result.state = CRITICAL
+				result.msg = fmt.Sprintf("Protocol downgraded from %s to %s", previous, result.protocol)
+			}
+			if result.protocol != "" {
+				previousProtocols[check.Name] = result.protocol
+			}
+			reportHttpCheck(ep, check, result)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+// returns the client of a single run of the check, the connection is closed
+// after the run instead of being kept idle until the next one
+func newHttpCheckClient(check *HttpCheck) *http.Client {
+	tlsConfig := TlsConfig()
+	tlsConfig.NextProtos = check.Protocols
+	transport := &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true, Proxy: http.ProxyFromEnvironment}
+	if proxy := ProxyUrl(); proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	h2 := false
+	for _, protocol := range check.Protocols {
+		if protocol == "h2" {
+			h2 = true
+		}
+	}
+	if h2 {
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		// a non-nil empty map disables the builtin http/2 support
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{Transport: transport, Timeout: check.Timeout}
+}
+
+func runHttpCheck(check *HttpCheck, client *http.Client) *HttpCheckResult {
+	start := time.Now()
+	resp, err := client.Get(check.Url)
+	if err != nil {
+		return &HttpCheckResult{state: CRITICAL, msg: err.Error()}
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	result := &HttpCheckResult{
+		state:        OK,
+		msg:          resp.Status,
+		protocol:     resp.Proto,
+		statusCode:   resp.StatusCode,
+		responseTime: time.Since(start),
+		h3Advertised: strings.Contains(resp.Header.Get("Alt-Svc"), "h3"),
+	}
+
+	if resp.TLS != nil {
+		result.alpn = resp.TLS.NegotiatedProtocol
+		result.tlsVersion = tlsVersions[resp.TLS.Version]
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		result.state = CRITICAL
+	case resp.StatusCode >= 400:
+		result.state = WARNING
+	}
+
+	if result.state != OK || check.ExpectedProtocol == "" || check.ExpectedProtocol == resp.Proto {
+		return result
+	}
+
+	// the agent can't speak QUIC, the best it can do is check whether the
+	// endpoint advertises http/3 using the Alt-Svc header
+	if strings.HasPrefix(check.ExpectedProtocol, "HTTP/3") {
+		if !result.h3Advertised {
+			result.state = CRITICAL
+			result.msg = fmt.Sprintf("Expected %s but the endpoint doesn't advertise h3", check.ExpectedProtocol)
+		}
+		return result
+	}
+
+	result.state = CRITICAL
+	result.msg = fmt.Sprintf("Expected %s but negotiated %s", check.ExpectedProtocol, resp.Proto)
+	return result
+}
+
+// returns true if current is an older http version than previous, e.g. HTTP/1.1 and HTTP/2.0
+func isProtocolDowngrade(previous, current string) bool {
+	if previous == "" || current == "" {
+		return false
+	}
+	previousMajor, previousMinor, ok := http.ParseHTTPVersion(previous)
+	if !ok {
+		return false
+	}
+	currentMajor, currentMinor, ok := http.ParseHTTPVersion(current)
+	if !ok {
+		return false
+	}
+	return currentMajor < previousMajor || (currentMajor == previousMajor && currentMinor < previousMinor)
+}
+
+func reportHttpCheck(ep *errplane.Errplane, check *HttpCheck, result *HttpCheckResult) {
+	log.Debug("Http check %s returned %#v", check.Name, result)
+
+	timestamp := time.Now()
+	dimensions := errplane.Dimensions{
+		"host":          AgentConfig().Hostname,
+		"check":         check.Name,
+		"url":           check.Url,
+		"status":        result.state.String(),
+		"status_msg":    result.msg,
+		"protocol":      result.protocol,
+		"alpn":          result.alpn,
+		"tls_version":   result.tlsVersion,
+		"h3_advertised": fmt.Sprintf("%v", result.h3Advertised),
+	}
+
+	report(ep, "server.checks.http.status", 1.0, timestamp, dimensions, nil)
+	checkStates.Set(CHECK_HTTP, check.Name, "", result.state.String(), result.msg)
+	if result.statusCode != 0 {
+		report(ep, "server.checks.http.response_time", result.responseTime.Seconds()*1000, timestamp, dimensions, nil)
+	}
+}
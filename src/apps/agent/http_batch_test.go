@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type HttpBatchSuite struct{}
+
+var _ = Suite(&HttpBatchSuite{})
+
+func batchWrite(name string, values ...float64) *errplane.WriteOperation {
+	points := make([]*errplane.JsonPoint, 0, len(values))
+	for _, value := range values {
+		points = append(points, &errplane.JsonPoint{Value: value})
+	}
+	return &errplane.WriteOperation{Writes: []*errplane.JsonPoints{&errplane.JsonPoints{Name: name, Points: points}}}
+}
+
+func (self *HttpBatchSuite) TestBatching(c *C) {
+	sent := make(chan *errplane.WriteOperation, 10)
+	batcher := NewHttpBatcher(4, time.Hour, func(operation *errplane.WriteOperation) error {
+		sent <- operation
+		return nil
+	})
+	c.Assert(batcher.wait(time.Now()), Equals, time.Hour)
+
+	batcher.Add(batchWrite("plugins.redis.status", 1))
+	batcher.Add(batchWrite("plugins.mysql.status", 1))
+	batcher.Add(batchWrite("plugins.redis.status", 1))
+	c.Assert(batcher.wait(time.Now().Add(time.Hour)), Equals, time.Duration(0))
+	go batcher.Run()
+
+	// the batch is sent as soon as it's full
+	batcher.Add(batchWrite("plugins.mysql.connections", 10))
+	select {
+	case operation := <-sent:
+		c.Assert(operation.Writes, HasLen, 3)
+		points := 0
+		for _, write := range operation.Writes {
+			if write.Name == "plugins.redis.status" {
+				c.Assert(write.Points, HasLen, 2)
+			}
+			points += len(write.Points)
+		}
+		c.Assert(points, Equals, 4)
+	case <-time.After(5 * time.Second):
+		c.Fatal("The full batch wasn't sent")
+	}
+
+	batcher.Flush()
+	c.Assert(sent, HasLen, 0)
+}
+
+func (self *HttpBatchSuite) TestMaxLatency(c *C) {
+	sent := make(chan *errplane.WriteOperation, 10)
+	batcher := NewHttpBatcher(1000, 50*time.Millisecond, func(operation *errplane.WriteOperation) error {
+		sent <- operation
+		return nil
+	})
+	go batcher.Run()
+	batcher.Add(batchWrite("plugins.redis.status", 1))
+	select {
+	case operation := <-sent:
+		c.Assert(operation.Writes, HasLen, 1)
+	case <-time.After(5 * time.Second):
+		c.Fatal("The batch wasn't sent after max latency")
+	}
+}
+
+func (self *HttpBatchSuite) TestSendGzip(c *C) {
+	received := make(chan []*errplane.JsonPoints, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, Equals, "/databases/appprod/points")
+		c.Check(req.URL.Query().Get("api_key"), Equals, "key")
+		c.Check(req.Header.Get("Content-Encoding"), Equals, "gzip")
+		reader, err := gzip.NewReader(req.Body)
+		c.Assert(err, IsNil)
+		writes := make([]*errplane.JsonPoints, 0)
+		c.Check(json.NewDecoder(reader).Decode(&writes), IsNil)
+		received <- writes
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	defer setTestConfig(func(config *Config) {
+		config.HttpHost = strings.TrimPrefix(server.URL, "https://")
+		config.AppKey, config.Environment, config.ApiKey = "app", "prod", "key"
+		config.HttpBatch.Gzip = true
+	})()
+	backendClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer func() { backendClient = nil }()
+
+	c.Assert(sendBackend(batchWrite("plugins.redis.status", 1, 2)), IsNil)
+	writes := <-received
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Points, HasLen, 2)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	. "utils"
+)
+
+type HttpCheckSuite struct{}
+
+var _ = Suite(&HttpCheckSuite{})
+
+func (self *HttpCheckSuite) TestProtocolDowngrade(c *C) {
+	c.Assert(isProtocolDowngrade("HTTP/2.0", "HTTP/1.1"), Equals, true)
+	c.Assert(isProtocolDowngrade("HTTP/1.1", "HTTP/2.0"), Equals, false)
+	c.Assert(isProtocolDowngrade("HTTP/1.1", "HTTP/1.0"), Equals, true)
+	c.Assert(isProtocolDowngrade("", "HTTP/1.0"), Equals, false)
+}
+
+func (self *HttpCheckSuite) TestClient(c *C) {
+	defer setTestConfig(func(config *Config) { config.Proxy = "proxy.example.com:3128" })()
+
+	transport := newHttpCheckClient(&HttpCheck{Name: "test", Url: "https://example.com/"}).Transport.(*http.Transport)
+	c.Assert(transport.DisableKeepAlives, Equals, true)
+	request, _ := http.NewRequest("GET", "https://example.com/", nil)
+	proxy, err := transport.Proxy(request)
+	c.Assert(err, IsNil)
+	c.Assert(proxy.String(), Equals, "http://proxy.example.com:3128")
+}
+
+func (self *HttpCheckSuite) TestExpectedProtocol(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":443"; ma=86400`)
+	}))
+	defer server.Close()
+
+	// the test server only speaks http/1.1
+	check := &HttpCheck{Name: "test", Url: server.URL, ExpectedProtocol: "HTTP/2.0", Timeout: time.Second}
+	result := runHttpCheck(check, server.Client())
+	c.Assert(result.state, Equals, CRITICAL)
+	c.Assert(result.protocol, Equals, "HTTP/1.1")
+	c.Assert(result.h3Advertised, Equals, true)
+	c.Assert(result.tlsVersion, Not(Equals), "")
+
+	check.ExpectedProtocol = "HTTP/1.1"
+	result = runHttpCheck(check, server.Client())
+	c.Assert(result.state, Equals, OK)
+
+	check.ExpectedProtocol = "HTTP/3.0"
+	result = runHttpCheck(check, server.Client())
+	c.Assert(result.state, Equals, OK)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the units the human readable values are normalized to
+const (
+	UNIT_BYTES   = "bytes"
+	UNIT_SECONDS = "seconds"
+	UNIT_PERCENT = "percent"
+)
+
+// the value is multiplied by the factor and divided by the divisor, so the
+// fractions of a second are exact, e.g. 345ms is 0.345
+type humanUnit struct {
+	factor  float64
+	divisor float64
+	unit    string
+}
+
+// The suffixes are case sensitive, m is minutes and M mebibytes. The sizes
+// are in powers of 1024 like df -h and du -h print them.
+var HUMAN_UNITS = map[string]humanUnit{
+	"%":    {1, 1, UNIT_PERCENT},
+	"B":    {1, 1, UNIT_BYTES},
+	"K":    {1 << 10, 1, UNIT_BYTES},
+	"k":    {1 << 10, 1, UNIT_BYTES},
+	"KB":   {1 << 10, 1, UNIT_BYTES},
+	"KiB":  {1 << 10, 1, UNIT_BYTES},
+	"M":    {1 << 20, 1, UNIT_BYTES},
+	"MB":   {1 << 20, 1, UNIT_BYTES},
+	"MiB":  {1 << 20, 1, UNIT_BYTES},
+	"G":    {1 << 30, 1, UNIT_BYTES},
+	"GB":   {1 << 30, 1, UNIT_BYTES},
+	"GiB":  {1 << 30, 1, UNIT_BYTES},
+	"T":    {1 << 40, 1, UNIT_BYTES},
+	"TB":   {1 << 40, 1, UNIT_BYTES},
+	"TiB":  {1 << 40, 1, UNIT_BYTES},
+	"P":    {1 << 50, 1, UNIT_BYTES},
+	"PB":   {1 << 50, 1, UNIT_BYTES},
+	"PiB":  {1 << 50, 1, UNIT_BYTES},
+	"ns":   {1, 1e9, UNIT_SECONDS},
+	"us":   {1, 1e6, UNIT_SECONDS},
+	"µs":   {1, 1e6, UNIT_SECONDS},
+	"ms":   {1, 1e3, UNIT_SECONDS},
+	"s":    {1, 1, UNIT_SECONDS},
+	"sec":  {1, 1, UNIT_SECONDS},
+	"m":    {60, 1, UNIT_SECONDS},
+	"min":  {60, 1, UNIT_SECONDS},
+	"h":    {3600, 1, UNIT_SECONDS},
+	"d":    {86400, 1, UNIT_SECONDS},
+	"day":  {86400, 1, UNIT_SECONDS},
+	"days": {86400, 1, UNIT_SECONDS},
+}
+
+// a number, possibly with thousands separators, and a suffix
+var humanValueRegex = regexp.MustCompile(`^([-+]?[0-9.,'\x{a0}\x{202f} ]*[0-9])\s*(\S*)$`)
+
+// Parses a human readable value like 1.2G, 345ms or 87% into its value in
+// bytes, seconds or percent and the unit, empty for a plain number. The
+// separator that isn't the decimal one groups the thousands, e.g. 1,2G and
+// 1.234,5 with a decimal comma.
+func parseHumanValue(raw, decimalSeparator string) (float64, string, error) {
+	match := humanValueRegex.FindStringSubmatch(strings.TrimSpace(raw))
+	if match == nil {
+		return 0, "", fmt.Errorf("'%s' isn't a number", raw)
+	}
+
+	number := match[1]
+	thousandsSeparator := ","
+	if decimalSeparator == "," {
+		thousandsSeparator = "."
+	}
+	for _, separator := range []string{thousandsSeparator, "'", " ", "\u00a0", "\u202f"} {
+		number = strings.Replace(number, separator, "", -1)
+	}
+	number = strings.Replace(number, decimalSeparator, ".", 1)
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("'%s' isn't a number", raw)
+	}
+
+	if match[2] == "" {
+		return value, "", nil
+	}
+	unit, ok := HUMAN_UNITS[match[2]]
+	if !ok {
+		return 0, "", fmt.Errorf("Unknown unit '%s' of '%s'", match[2], raw)
+	}
+	return value * unit.factor / unit.divisor, unit.unit, nil
+}
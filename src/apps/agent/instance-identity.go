@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "utils"
+)
+
+// Returns the identity of a plugin instance, a stable hash of the plugin
+// name and the instance arguments. Unlike the instance name it's never
+// empty and instances with different arguments never share it, so it's used
+// to schedule the instances and to cache their output.
+func instanceId(pluginName string, instance *Instance) string {
+	return configHash([]interface{}{pluginName, instance.Args, instance.ArgsList, instance.Remote})[:12]
+}
+
+// the instance name, or the instance identity for unnamed instances
+func instanceLabel(id string, instance *Instance) string {
+	if instance.Name != "" {
+		return instance.Name
+	}
+	return id
+}
+
+// adds the instance name (if any) and the instance identity to the
+// dimensions, the identity is left out if the agent is configured to keep
+// the series it reported before the identity was introduced
+func addInstanceDimensions(dimensions errplane.Dimensions, id string, instance *Instance) {
+	if instance.Name != "" {
+		dimensions["instance"] = instance.Name
+	}
+	if !AgentConfig().LegacyInstanceDimensions {
+		dimensions["instance_id"] = id
+	}
+	for key, value := range instance.Dimensions {
+		if _, ok := dimensions[key]; !ok {
+			dimensions[key] = value
+		}
+	}
+}
@@ -0,0 +1,160 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"fakebackend"
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+	. "utils"
+)
+
+// Runs the agent binary against the fake backend with the sample plugins,
+// see test.sh --integration
+type IntegrationSuite struct {
+	binary   string
+	hostname string
+	dir      string
+	backend  *fakebackend.Backend
+	server   *httptest.Server
+	agent    *exec.Cmd
+}
+
+var _ = Suite(&IntegrationSuite{})
+
+const (
+	INTEGRATION_SAMPLE_PLUGINS = "../../fakebackend/sample-plugins"
+	INTEGRATION_TIMEOUT        = 30 * time.Second
+)
+
+func (self *IntegrationSuite) SetUpSuite(c *C) {
+	self.binary = path.Join(c.MkDir(), "errplane-agent")
+	out, err := exec.Command("go", "build", "-o", self.binary, "apps/agent").CombinedOutput()
+	c.Assert(err, IsNil, Commentf("Cannot build the agent: %s", out))
+	self.hostname, err = os.Hostname()
+	c.Assert(err, IsNil)
+}
+
+func (self *IntegrationSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+	self.backend = fakebackend.New("appintegration", "key")
+	c.Assert(self.backend.AddPlugins("1", INTEGRATION_SAMPLE_PLUGINS), IsNil)
+	self.server = httptest.NewServer(self.backend)
+	self.agent = nil
+}
+
+func (self *IntegrationSuite) TearDownTest(c *C) {
+	if self.agent != nil {
+		self.agent.Process.Kill()
+		self.agent.Wait()
+	}
+	self.server.Close()
+	if c.Failed() {
+		log, _ := ioutil.ReadFile(path.Join(self.dir, "agent.log"))
+		c.Logf("agent log:\n%s", log)
+	}
+}
+
+func (self *IntegrationSuite) startAgent(c *C) {
+	host := self.server.Listener.Addr().String()
+	config := fmt.Sprintf(`
+app-key: app
+environment: integration
+api-key: key
+udp-host: %[1]s
+http-host: http://%[1]s
+config-service: %[1]s
+percentiles: [90.0]
+flush-interval: 1s
+udp-addr: 127.0.0.1:0
+sleep: 1s
+top-n-processes: 1
+top-n-sleep: 1s
+monitored-sleep: 1s
+log-file: %[2]s/agent.log
+log-level: debug
+plugins-dir: %[2]s/plugins
+custom-plugins-dir: %[2]s/custom-plugins
+http-batch:
+  enabled: true
+  max-latency: 200ms
+  gzip: true
+`, host, self.dir)
+	for _, dir := range []string{"plugins", "custom-plugins"} {
+		c.Assert(os.Mkdir(path.Join(self.dir, dir), 0755), IsNil)
+	}
+	configFile := path.Join(self.dir, "config.yml")
+	c.Assert(ioutil.WriteFile(configFile, []byte(config), 0644), IsNil)
+
+	self.agent = exec.Command(self.binary, "-config", configFile, "-pidfile", path.Join(self.dir, "agent.pid"))
+	// like the daemon, some collectors read proc/... relative to /
+	self.agent.Dir = "/"
+	c.Assert(self.agent.Start(), IsNil)
+}
+
+// waits until the agent posts the plugins it would monitor
+func (self *IntegrationSuite) waitForStatus(c *C, plugins ...string) {
+	deadline := time.Now().Add(INTEGRATION_TIMEOUT)
+	var status *AgentStatus
+	for time.Now().Before(deadline) {
+		status = self.backend.Status(self.hostname)
+		if status != nil && fmt.Sprint(status.Plugins) == fmt.Sprint(plugins) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatalf("The agent didn't post the status %v, the last one is %#v", plugins, status)
+}
+
+func (self *IntegrationSuite) TestInstallAndDetectPlugins(c *C) {
+	self.startAgent(c)
+
+	// hello's should_monitor succeeds, absent's fails
+	self.waitForStatus(c, "hello")
+
+	version, err := ioutil.ReadFile(path.Join(self.dir, "plugins", "version"))
+	c.Assert(err, IsNil)
+	c.Assert(string(version), Equals, "1")
+	_, err = os.Stat(path.Join(self.dir, "plugins", "1", "hello", "status"))
+	c.Assert(err, IsNil)
+}
+
+func (self *IntegrationSuite) TestScheduleAndReport(c *C) {
+	self.backend.SetConfiguration("", &AgentConfiguration{Plugins: map[string][]*Instance{
+		"hello": []*Instance{&Instance{Name: "french", Args: map[string]string{"greeting": "bonjour"}}},
+	}})
+	self.startAgent(c)
+
+	statuses := self.backend.WaitForPoints("plugins.hello.status", 2, INTEGRATION_TIMEOUT)
+	c.Assert(len(statuses) >= 2, Equals, true)
+	c.Assert(statuses[0].Dimensions["status"], Equals, "ok")
+	c.Assert(statuses[0].Dimensions["status_msg"], Equals, "OK: bonjour")
+	c.Assert(statuses[0].Dimensions["host"], Equals, self.hostname)
+
+	greetings := self.backend.WaitForPoints("plugins.hello.greetings", 1, INTEGRATION_TIMEOUT)
+	c.Assert(greetings, Not(HasLen), 0)
+	c.Assert(greetings[0].Value, Equals, 1.0)
+
+	// the configured plugins aren't offered again
+	self.waitForStatus(c)
+}
+
+func (self *IntegrationSuite) TestWritesFailing(c *C) {
+	self.backend.SetWriteStatus(500)
+	self.backend.SetConfiguration("", &AgentConfiguration{Plugins: map[string][]*Instance{"hello": []*Instance{&Instance{}}}})
+	self.startAgent(c)
+	self.waitForStatus(c)
+	c.Assert(self.backend.Points(""), HasLen, 0)
+
+	// the agent keeps running and reports once the backend recovers
+	self.backend.SetWriteStatus(200)
+	c.Assert(self.backend.WaitForPoints("plugins.hello.status", 1, INTEGRATION_TIMEOUT), Not(HasLen), 0)
+	c.Assert(self.agent.ProcessState, IsNil)
+}
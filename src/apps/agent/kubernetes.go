@@ -0,0 +1,249 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// kubernetes support, when the agent runs as a daemonset the points get the
+// node as a dimension and the plugin instances listed in the annotations of
+// the pods of the node run with the namespace and the pod as dimensions
+
+const (
+	KUBERNETES_TIMEOUT             = 10 * time.Second
+	KUBERNETES_POD_NAME_LABEL      = "io.kubernetes.pod.name" // set by the kubelet on the docker containers
+	KUBERNETES_POD_NAMESPACE_LABEL = "io.kubernetes.pod.namespace"
+	KUBERNETES_HOST_PLACEHOLDER    = "%%host%%" // replaced by the ip of the pod in the annotated instances
+)
+
+var KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type KubernetesPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type KubernetesPodList struct {
+	Items []*KubernetesPod `json:"items"`
+}
+
+// the node the agent runs on, empty outside of kubernetes
+var kubernetesNode string
+
+func kubernetesDetected() bool {
+	return !AgentConfig().Kubernetes.Disabled && os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// the name of the node from the config, or from the downward api, e.g.
+// env: [{name: NODE_NAME, valueFrom: {fieldRef: {fieldPath: spec.nodeName}}}]
+func kubernetesNodeName() string {
+	if AgentConfig().Kubernetes.NodeName != "" {
+		return AgentConfig().Kubernetes.NodeName
+	}
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name
+	}
+	return AgentConfig().Hostname
+}
+
+// Lists the pods of the node from the kubelet or from the api server with
+// the service account of the agent
+type KubernetesClient struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func NewKubernetesClient(node string) (*KubernetesClient, error) {
+	token, err := ioutil.ReadFile(path.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "token"))
+	if err != nil {
+		return nil, ConfigError(err)
+	}
+	tlsConfig := TlsConfig()
+	if ca, err := ioutil.ReadFile(path.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+
+	address := AgentConfig().Kubernetes.KubeletUrl + "/pods"
+	if AgentConfig().Kubernetes.KubeletUrl == "" {
+		server := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+		address = fmt.Sprintf("https://%s/api/v1/pods?fieldSelector=%s", server, url.QueryEscape("spec.nodeName="+node))
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: KUBERNETES_TIMEOUT}
+	return &KubernetesClient{client, address, strings.TrimSpace(string(token))}, nil
+}
+
+func (self *KubernetesClient) Pods() ([]*KubernetesPod, error) {
+	req, err := http.NewRequest("GET", self.url, nil)
+	if err != nil {
+		return nil, ConfigError(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+self.token)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, NetworkError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NetworkError(fmt.Errorf("Received status code %d from %s", resp.StatusCode, self.url))
+	}
+	list := &KubernetesPodList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, ParseError(err)
+	}
+	return list.Items, nil
+}
+
+// anyone allowed to create a pod can annotate it, the instances can't use
+// the secrets or the facts of the agent, nor run on other hosts
+func checkPodInstance(instance *Instance) error {
+	if instance.Remote != nil {
+		return fmt.Errorf("Remote instances can't be configured in pod annotations")
+	}
+	values := append([]string{}, instance.ArgsList...)
+	for _, value := range instance.Args {
+		values = append(values, value)
+	}
+	for _, value := range instance.Env {
+		values = append(values, value)
+	}
+	for _, value := range values {
+		if strings.Contains(value, "{{") {
+			return fmt.Errorf("Templates can't be used in pod annotations")
+		}
+	}
+	return nil
+}
+
+// returns the plugin instances listed in the annotation of the running
+// pods, e.g. errplane.io/plugins: '{"redis": [{"name": "cache", "args":
+// {"host": "%%host%%"}}]}'. The instances are named after their pod.
+func podInstances(pods []*KubernetesPod, annotation string) map[string][]*Instance {
+	plugins := make(map[string][]*Instance)
+	for _, pod := range pods {
+		value, ok := pod.Metadata.Annotations[annotation]
+		if !ok || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		podName := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+
+		annotated := make(map[string][]*Instance)
+		if err := json.Unmarshal([]byte(value), &annotated); err != nil {
+			log.Warn("Invalid %s annotation of pod %s. Error: %s", annotation, podName, ParseError(err))
+			continue
+		}
+		for name, instances := range annotated {
+			if len(instances) == 0 {
+				instances = []*Instance{&Instance{}}
+			}
+			for _, instance := range instances {
+				if err := checkPodInstance(instance); err != nil {
+					log.Warn("Ignoring instance '%s' of plugin %s of pod %s. Error: %s", instance.Name, name, podName, ConfigError(err))
+					continue
+				}
+				replacer := strings.NewReplacer(KUBERNETES_HOST_PLACEHOLDER, pod.Status.PodIP)
+				for key, arg := range instance.Args {
+					instance.Args[key] = replacer.Replace(arg)
+				}
+				for idx, arg := range instance.ArgsList {
+					instance.ArgsList[idx] = replacer.Replace(arg)
+				}
+				if instance.Name == "" {
+					instance.Name = podName
+				} else {
+					instance.Name = podName + "/" + instance.Name
+				}
+				instance.Dimensions = map[string]string{"namespace": pod.Metadata.Namespace, "pod": pod.Metadata.Name}
+				plugins[name] = append(plugins[name], instance)
+			}
+		}
+	}
+	return plugins
+}
+
+// The plugin instances of the pod annotations, refreshed every sleep
+type PodInstances struct {
+	lock    sync.Mutex
+	plugins map[string][]*Instance
+}
+
+var podPlugins = &PodInstances{plugins: make(map[string][]*Instance)}
+
+func (self *PodInstances) Set(plugins map[string][]*Instance) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.plugins = plugins
+}
+
+// returns the instances of the backend configuration and the instances of
+// the pods, a plugin without instances in the configuration keeps running
+// its default instance
+func (self *PodInstances) Merge(configured map[string][]*Instance) map[string][]*Instance {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.plugins) == 0 {
+		return configured
+	}
+
+	merged := make(map[string][]*Instance, len(configured))
+	for name, instances := range configured {
+		if len(instances) == 0 {
+			instances = DEFAULT_INSTANCES
+		}
+		merged[name] = append([]*Instance{}, instances...)
+	}
+	for name, instances := range self.plugins {
+		merged[name] = append(merged[name], instances...)
+	}
+	return merged
+}
+
+// detects kubernetes and watches the pods of the node
+func startKubernetes() {
+	if !kubernetesDetected() {
+		return
+	}
+	kubernetesNode = kubernetesNodeName()
+	log.Info("Running in kubernetes on node %s", kubernetesNode)
+
+	client, err := NewKubernetesClient(kubernetesNode)
+	if err != nil {
+		log.Error("Cannot list the pods of node %s, the pod annotations are ignored. Error: %s", kubernetesNode, err)
+		return
+	}
+	go func() {
+		for {
+			pods, err := client.Pods()
+			if err != nil {
+				log.Error("Cannot list the pods of node %s. Error: %s", kubernetesNode, err)
+			} else {
+				podPlugins.Set(podInstances(pods, AgentConfig().Kubernetes.Annotation))
+			}
+			time.Sleep(AgentConfig().Sleep)
+		}
+	}()
+}
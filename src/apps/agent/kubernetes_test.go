@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	. "utils"
+)
+
+type KubernetesSuite struct{}
+
+var _ = Suite(&KubernetesSuite{})
+
+const kubernetesPodsResponse = `{"items": [
+  {"metadata": {"name": "cache-1", "namespace": "shop", "annotations": {"errplane.io/plugins": "{\"redis\": [{\"name\": \"cache\", \"args\": {\"host\": \"%%host%%\", \"port\": \"6379\"}}]}"}},
+   "spec": {"nodeName": "node-1"}, "status": {"phase": "Running", "podIP": "10.1.2.3"}},
+  {"metadata": {"name": "cache-2", "namespace": "shop", "annotations": {"errplane.io/plugins": "{\"redis\": [{\"args\": {\"host\": \"%%host%%\"}}]}"}},
+   "spec": {"nodeName": "node-1"}, "status": {"phase": "Pending"}},
+  {"metadata": {"name": "web-1", "namespace": "shop", "annotations": {"errplane.io/plugins": "{\"http\": [{\"args\": {\"password\": \"{{secret \\\"db\\\"}}\"}}], \"nginx\": []}"}},
+   "spec": {"nodeName": "node-1"}, "status": {"phase": "Running", "podIP": "10.1.2.4"}},
+  {"metadata": {"name": "broken", "namespace": "shop", "annotations": {"errplane.io/plugins": "not json"}},
+   "spec": {"nodeName": "node-1"}, "status": {"phase": "Running", "podIP": "10.1.2.5"}}
+]}`
+
+func (self *KubernetesSuite) TestPodInstances(c *C) {
+	KUBERNETES_SERVICE_ACCOUNT_DIR = c.MkDir()
+	defer func() { KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount" }()
+	c.Assert(ioutil.WriteFile(path.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "token"), []byte("secret-token\n"), 0600), IsNil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/pods" || req.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, kubernetesPodsResponse)
+	}))
+	defer server.Close()
+	defer setTestConfig(func(config *Config) { config.Kubernetes.KubeletUrl = server.URL })()
+
+	client, err := NewKubernetesClient("node-1")
+	c.Assert(err, IsNil)
+	pods, err := client.Pods()
+	c.Assert(err, IsNil)
+	c.Assert(pods, HasLen, 4)
+
+	plugins := podInstances(pods, "errplane.io/plugins")
+	c.Assert(plugins["redis"], HasLen, 1)
+	redis := plugins["redis"][0]
+	c.Assert(redis.Name, Equals, "shop/cache-1/cache")
+	c.Assert(redis.Args, DeepEquals, map[string]string{"host": "10.1.2.3", "port": "6379"})
+	c.Assert(redis.Dimensions, DeepEquals, map[string]string{"namespace": "shop", "pod": "cache-1"})
+	// the annotations can't reach the secrets of the agent
+	c.Assert(plugins["http"], HasLen, 0)
+	c.Assert(plugins["nginx"], HasLen, 1)
+	c.Assert(plugins["nginx"][0].Name, Equals, "shop/web-1")
+}
+
+func (self *KubernetesSuite) TestMergeWithTheConfiguration(c *C) {
+	instances := &PodInstances{plugins: map[string][]*Instance{"redis": []*Instance{&Instance{Name: "shop/cache-1"}}}}
+	configured := map[string][]*Instance{"redis": []*Instance{}, "mysql": []*Instance{&Instance{Name: "db"}}}
+
+	merged := instances.Merge(configured)
+	c.Assert(merged["mysql"], HasLen, 1)
+	// the default instance keeps running next to the ones of the pods
+	c.Assert(merged["redis"], HasLen, 2)
+	c.Assert(merged["redis"][0], Equals, DEFAULT_INSTANCES[0])
+	c.Assert(merged["redis"][1].Name, Equals, "shop/cache-1")
+	c.Assert(configured["redis"], HasLen, 0)
+}
+
+func (self *KubernetesSuite) TestNodeDimension(c *C) {
+	defer func() { kubernetesNode = "" }()
+	kubernetesNode = "node-1"
+
+	dimensions := addGlobalDimensions(nil)
+	c.Assert(dimensions["node"], Equals, "node-1")
+	dimensions = addGlobalDimensions(map[string]string{"node": "other"})
+	c.Assert(dimensions["node"], Equals, "other")
+}
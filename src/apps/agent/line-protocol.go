@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsing of the influxdb line protocol, e.g.
+// cpu,host=server01,region=us-west usage_idle=92.5,usage_user=5i 1434055562000000000
+
+// splits the string on the separator ignoring escaped separators and, if
+// quotes is set, separators between double quotes
+func splitUnescaped(str string, separator byte, quotes bool) []string {
+	parts := make([]string, 0)
+	quoted := false
+	start := 0
+	for i := 0; i < len(str); i++ {
+		switch {
+		case str[i] == '\\':
+			i++
+		case quotes && str[i] == '"':
+			quoted = !quoted
+		case !quoted && str[i] == separator:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, str[start:])
+}
+
+func unescapeLineProtocol(str string) string {
+	if strings.IndexByte(str, '\\') < 0 {
+		return str
+	}
+	unescaped := make([]byte, 0, len(str))
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+1 < len(str) {
+			switch str[i+1] {
+			case ',', '=', ' ', '"', '\\':
+				i++
+			}
+		}
+		unescaped = append(unescaped, str[i])
+	}
+	return string(unescaped)
+}
+
+// returns the numeric value of the field, booleans are converted to 0 or 1
+// and strings aren't supported
+func parseFieldValue(value string) (float64, error) {
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	if strings.HasPrefix(value, "\"") {
+		return 0, fmt.Errorf("String fields aren't supported")
+	}
+	switch value[len(value)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return float64(i), err
+	case 'u':
+		u, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		return float64(u), err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+type LineProtocolPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64
+	timestamp   time.Time
+}
+
+func parseLineProtocol(line string, now time.Time) (*LineProtocolPoint, error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("Expected a measurement, fields and an optional timestamp")
+	}
+
+	point := &LineProtocolPoint{tags: make(map[string]string), fields: make(map[string]float64), timestamp: now}
+
+	keys := splitUnescaped(sections[0], ',', false)
+	point.measurement = unescapeLineProtocol(keys[0])
+	if point.measurement == "" {
+		return nil, fmt.Errorf("Missing measurement")
+	}
+	for _, tag := range keys[1:] {
+		keyValue := splitUnescaped(tag, '=', false)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, fmt.Errorf("Invalid tag '%s'", tag)
+		}
+		point.tags[unescapeLineProtocol(keyValue[0])] = unescapeLineProtocol(keyValue[1])
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		keyValue := splitUnescaped(field, '=', true)
+		if len(keyValue) != 2 || keyValue[0] == "" || keyValue[1] == "" {
+			return nil, fmt.Errorf("Invalid field '%s'", field)
+		}
+		value, err := parseFieldValue(keyValue[1])
+		if err != nil {
+			// skip string fields and keep the numeric ones
+			continue
+		}
+		point.fields[unescapeLineProtocol(keyValue[0])] = value
+	}
+
+	if len(sections) == 3 {
+		nanoseconds, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp '%s'", sections[2])
+		}
+		point.timestamp = time.Unix(0, nanoseconds)
+	}
+	return point, nil
+}
+
+// converts the points to errplane writes, each field is reported as
+// <measurement>.<field> (or just <measurement> for a field named value)
+// and the tags are kept as dimensions
+func lineProtocolWrites(points []*LineProtocolPoint) []*errplane.JsonPoints {
+	writes := make([]*errplane.JsonPoints, 0)
+	writesByName := make(map[string]*errplane.JsonPoints)
+	for _, point := range points {
+		fields := make([]string, 0, len(point.fields))
+		for field, _ := range point.fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			value := point.fields[field]
+			name := point.measurement + "." + field
+			if field == "value" {
+				name = point.measurement
+			}
+			write := writesByName[name]
+			if write == nil {
+				write = &errplane.JsonPoints{Name: name}
+				writesByName[name] = write
+				writes = append(writes, write)
+			}
+			dimensions := make(errplane.Dimensions)
+			for key, value := range point.tags {
+				dimensions[key] = value
+			}
+			write.Points = append(write.Points, &errplane.JsonPoint{Value: value, Time: point.timestamp.Unix(), Dimensions: dimensions})
+		}
+	}
+	return writes
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/errplane/gosigar"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -14,6 +15,16 @@ const (
 )
 
 func (self *LoadAverage) Get() error {
+	if !PROC_STATS {
+		// sigar asks the kernel with sysctl on freebsd and macos
+		load := sigar.LoadAverage{}
+		if err := load.Get(); err != nil {
+			return err
+		}
+		self[0], self[1], self[2] = load.One, load.Five, load.Fifteen
+		return nil
+	}
+
 	statFile, err := ioutil.ReadFile(LOAD_AVG_FILE)
 	if err != nil {
 		return err
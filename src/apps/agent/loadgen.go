@@ -0,0 +1,80 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"math/rand"
+	"time"
+	. "utils"
+)
+
+// Generates the synthetic points of the loadgen config, cycling through the
+// series of every metric so each of them gets the same share of the rate
+type LoadGenerator struct {
+	config *LoadgenConfig
+	next   int
+}
+
+func NewLoadGenerator(config *LoadgenConfig) *LoadGenerator {
+	return &LoadGenerator{config: config}
+}
+
+// the number of distinct series the generator sends
+func (self *LoadGenerator) Cardinality() int {
+	return self.config.Metrics * self.config.Series
+}
+
+// returns the next count points, grouped by metric
+func (self *LoadGenerator) Next(now time.Time, count int) []*errplane.JsonPoints {
+	writes := make([]*errplane.JsonPoints, 0, self.config.Metrics)
+	writesByName := make(map[string]*errplane.JsonPoints)
+	cardinality := self.Cardinality()
+	for i := 0; i < count; i++ {
+		metric, series := self.next%self.config.Metrics, self.next/self.config.Metrics
+		self.next = (self.next + 1) % cardinality
+
+		name := fmt.Sprintf("%s.metric%d", self.config.Prefix, metric)
+		write := writesByName[name]
+		if write == nil {
+			write = &errplane.JsonPoints{Name: name}
+			writesByName[name] = write
+			writes = append(writes, write)
+		}
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		for d := 0; d < self.config.Dimensions; d++ {
+			dimensions[fmt.Sprintf("d%d", d)] = fmt.Sprintf("v%d", series)
+		}
+		write.Points = append(write.Points, &errplane.JsonPoint{Value: rand.Float64() * 100, Time: now.Unix(), Dimensions: dimensions})
+	}
+	return writes
+}
+
+// sends loadgen.rate points every second through the same pipeline as the
+// plugins and the collectors (dimensions, scrubbing, batching, spooling...)
+// until loadgen.duration elapsed. The loadgen subsystem can be stopped with
+// the local api to pause it.
+func runLoadgen(ep *errplane.Errplane) {
+	config := &AgentConfig().Loadgen
+	if config.Metrics <= 0 {
+		return
+	}
+
+	generator := NewLoadGenerator(config)
+	started := time.Now()
+	log.Warn("Sending %d synthetic points per second over %d series prefixed with %s", config.Rate, generator.Cardinality(), config.Prefix)
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+		if config.Duration > 0 && now.Sub(started) >= config.Duration {
+			log.Info("Load generation finished after %s", config.Duration)
+			return
+		}
+		if subsystems.IsStopped(SUBSYSTEM_LOADGEN) {
+			continue
+		}
+		if err := sendHttp(ep, &errplane.WriteOperation{Writes: generator.Next(now, config.Rate)}); err != nil {
+			log.Error("Cannot send the synthetic points. Error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type LoadgenSuite struct{}
+
+var _ = Suite(&LoadgenSuite{})
+
+func (self *LoadgenSuite) TestGenerator(c *C) {
+	generator := NewLoadGenerator(&LoadgenConfig{Metrics: 2, Dimensions: 3, Series: 2, Rate: 6, Prefix: "lg"})
+	c.Assert(generator.Cardinality(), Equals, 4)
+
+	now := time.Now()
+	writes := generator.Next(now, 6)
+	c.Assert(writes, HasLen, 2)
+	c.Assert(writes[0].Name, Equals, "lg.metric0")
+	c.Assert(writes[1].Name, Equals, "lg.metric1")
+	c.Assert(writes[0].Points, HasLen, 3)
+	c.Assert(writes[1].Points, HasLen, 3)
+
+	point := writes[0].Points[1]
+	c.Assert(point.Time, Equals, now.Unix())
+	c.Assert(point.Dimensions, HasLen, 4)
+	c.Assert(point.Dimensions["d0"], Equals, "v1")
+	c.Assert(point.Dimensions["d2"], Equals, "v1")
+	c.Assert(point.Value >= 0 && point.Value < 100, Equals, true)
+
+	// the series wrap around, the next call goes on where this one stopped
+	c.Assert(writes[0].Points[2].Dimensions["d0"], Equals, "v0")
+	writes = generator.Next(now, 1)
+	c.Assert(writes[0].Name, Equals, "lg.metric0")
+	c.Assert(writes[0].Points[0].Dimensions["d1"], Equals, "v1")
+}
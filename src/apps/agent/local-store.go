@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"sort"
+	"time"
+)
+
+const (
+	STORE_RUN_HISTORY   = "run-history"
+	STORE_RATES         = "rates"
+	STORE_METRICS       = "recent-metrics"
+	STORE_SYNC_INTERVAL = time.Minute
+	STORE_OPEN_TIMEOUT  = time.Second // another agent may be holding the database
+	// a rate computed from an older state would be averaged over the downtime
+	STORE_RATE_MAX_AGE = 15 * time.Minute
+)
+
+var STORE_BUCKETS = []string{STORE_RUN_HISTORY, STORE_RATES, STORE_METRICS}
+
+type storedEntry struct {
+	Updated int64           `json:"updated"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// the metrics the next rates of a plugin instance are computed from
+type storedRate struct {
+	Timestamp int64              `json:"timestamp"`
+	Metrics   map[string]float64 `json:"metrics"`
+}
+
+// Persists the state the agent keeps in memory, the run durations of the
+// plugins, the metrics the rates are computed from and the metrics of the
+// dashboard, so a restart doesn't lose them. Every entry remembers when it
+// last changed, the least recently changed entries are dropped when the
+// entries grow beyond the maximum size.
+type LocalStore struct {
+	db      *bolt.DB
+	maxSize int64
+}
+
+var localStore *LocalStore
+
+func OpenLocalStore(path string, maxSize int64) (*LocalStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: STORE_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range STORE_BUCKETS {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &LocalStore{db, maxSize}, nil
+}
+
+func (self *LocalStore) Close() error {
+	return self.db.Close()
+}
+
+// stores the values in the bucket, the entries whose value didn't change
+// keep their update time
+func (self *LocalStore) Save(bucket string, values map[string]interface{}, now time.Time) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for key, value := range values {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			previous := &storedEntry{}
+			if existing := b.Get([]byte(key)); existing != nil && json.Unmarshal(existing, previous) == nil && bytes.Equal(previous.Value, data) {
+				continue
+			}
+			entry, err := json.Marshal(&storedEntry{now.Unix(), data})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), entry); err != nil {
+				return err
+			}
+		}
+		return self.trim(tx)
+	})
+}
+
+// calls fn with every entry of the bucket, the entries that can't be
+// parsed are skipped
+func (self *LocalStore) Load(bucket string, fn func(key string, value []byte, updated time.Time) error) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(key, value []byte) error {
+			entry := &storedEntry{}
+			if err := json.Unmarshal(value, entry); err != nil {
+				return nil
+			}
+			return fn(string(key), entry.Value, time.Unix(entry.Updated, 0))
+		})
+	})
+}
+
+type storeKey struct {
+	bucket  string
+	key     string
+	updated int64
+	size    int64
+}
+
+type storeKeysByUpdate []*storeKey
+
+func (self storeKeysByUpdate) Len() int           { return len(self) }
+func (self storeKeysByUpdate) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self storeKeysByUpdate) Less(i, j int) bool { return self[i].updated < self[j].updated }
+
+// drops the least recently updated entries until the entries fit in the
+// maximum size
+func (self *LocalStore) trim(tx *bolt.Tx) error {
+	var size int64
+	keys := make([]*storeKey, 0)
+	for _, name := range STORE_BUCKETS {
+		bucket := name
+		tx.Bucket([]byte(bucket)).ForEach(func(key, value []byte) error {
+			// the entries that can't be parsed are updated at 0, i.e. dropped first
+			entry := &storedEntry{}
+			json.Unmarshal(value, entry)
+			keys = append(keys, &storeKey{bucket, string(key), entry.Updated, int64(len(key) + len(value))})
+			size += int64(len(key) + len(value))
+			return nil
+		})
+	}
+	if size <= self.maxSize {
+		return nil
+	}
+
+	sort.Sort(storeKeysByUpdate(keys))
+	for _, key := range keys {
+		if size <= self.maxSize {
+			break
+		}
+		if err := tx.Bucket([]byte(key.bucket)).Delete([]byte(key.key)); err != nil {
+			return err
+		}
+		size -= key.size
+	}
+	return nil
+}
+
+// saves the in memory state of the agent
+func saveLocalState(store *LocalStore, now time.Time) error {
+	durations := make(map[string]interface{})
+	for key, duration := range runHistory.Durations() {
+		durations[key] = int64(duration)
+	}
+	if err := store.Save(STORE_RUN_HISTORY, durations, now); err != nil {
+		return err
+	}
+
+	rates := make(map[string]interface{})
+	for key, output := range rateStates.Outputs() {
+		rates[key] = &storedRate{output.timestamp.Unix(), output.metrics}
+	}
+	if err := store.Save(STORE_RATES, rates, now); err != nil {
+		return err
+	}
+
+	series := make(map[string]interface{})
+	for name, samples := range recentMetrics.Series() {
+		series[name] = samples
+	}
+	return store.Save(STORE_METRICS, series, now)
+}
+
+// restores the state saved before the agent was restarted
+func restoreLocalState(store *LocalStore, now time.Time) error {
+	err := store.Load(STORE_RUN_HISTORY, func(key string, value []byte, updated time.Time) error {
+		var duration int64
+		if json.Unmarshal(value, &duration) == nil {
+			runHistory.Record(key, time.Duration(duration))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.Load(STORE_RATES, func(key string, value []byte, updated time.Time) error {
+		rate := &storedRate{}
+		if json.Unmarshal(value, rate) != nil || now.Sub(time.Unix(rate.Timestamp, 0)) > STORE_RATE_MAX_AGE {
+			return nil
+		}
+		rateStates.Set(key, &PluginOutput{metrics: rate.Metrics, timestamp: time.Unix(rate.Timestamp, 0)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.Load(STORE_METRICS, func(key string, value []byte, updated time.Time) error {
+		samples := make([]*MetricSample, 0)
+		if json.Unmarshal(value, &samples) == nil {
+			recentMetrics.Restore(key, samples, now)
+		}
+		return nil
+	})
+}
+
+func syncLocalStore(store *LocalStore) {
+	for {
+		time.Sleep(STORE_SYNC_INTERVAL)
+		if err := saveLocalState(store, time.Now()); err != nil {
+			log.Error("Cannot save the state of the agent to the local store. Error: %s", err)
+		}
+	}
+}
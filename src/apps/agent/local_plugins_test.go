@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	. "utils"
+)
+
+type LocalPluginsSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&LocalPluginsSuite{})
+
+func (self *LocalPluginsSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	SetAgentConfig(&config)
+}
+
+func (self *LocalPluginsSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+	LocalPlugins = &LocalPluginsFile{}
+}
+
+func (self *LocalPluginsSuite) TestMergeLocalPlugins(c *C) {
+	file := path.Join(c.MkDir(), "plugins.yml")
+	setTestConfig(func(config *Config) { config.LocalPlugins = file })
+	c.Assert(ioutil.WriteFile(AgentConfig().LocalPlugins, []byte(`
+plugins:
+  mysql:
+    - name: local-db
+      args:
+        port: "3307"
+  redis:
+    - name: cache
+processes:
+  - name: nginx
+    nickname: nginx
+    start: service nginx start
+`), 0644), IsNil)
+
+	// the local plugins run alone until the backend answers
+	local := LocalPlugins.Get()
+	c.Assert(local, NotNil)
+	config := MergeLocalPlugins(nil, local, LOCAL_PLUGINS_REMOTE)
+	c.Assert(config.Plugins["mysql"][0].Args, DeepEquals, map[string]string{"port": "3307"})
+	c.Assert(config.Processes[0].StartCmd, Equals, "service nginx start")
+	c.Assert(config.Origins["plugins.redis"], Equals, LOCAL_PLUGINS_ORIGIN)
+	c.Assert(MergeLocalPlugins(nil, local, LOCAL_PLUGINS_FALLBACK).Plugins, HasLen, 2)
+
+	remote := &AgentConfiguration{
+		Plugins:   map[string][]*Instance{"mysql": []*Instance{&Instance{Name: "db"}}},
+		Processes: []*Process{&Process{Name: "nginx", Nickname: "nginx", StartCmd: "nginx"}},
+		Origins:   map[string]string{"plugins.mysql": "backend"},
+	}
+	config = MergeLocalPlugins(remote, local, LOCAL_PLUGINS_REMOTE)
+	c.Assert(config.Plugins["mysql"][0].Name, Equals, "db")
+	c.Assert(config.Plugins["redis"], HasLen, 1)
+	c.Assert(config.Processes, HasLen, 1)
+	c.Assert(config.Processes[0].StartCmd, Equals, "nginx")
+
+	config = MergeLocalPlugins(remote, local, LOCAL_PLUGINS_LOCAL)
+	c.Assert(config.Plugins["mysql"][0].Name, Equals, "local-db")
+	c.Assert(config.Origins["plugins.mysql"], Equals, LOCAL_PLUGINS_ORIGIN)
+	c.Assert(config.Processes[0].StartCmd, Equals, "service nginx start")
+	c.Assert(remote.Plugins["mysql"][0].Name, Equals, "db")
+
+	c.Assert(MergeLocalPlugins(remote, local, LOCAL_PLUGINS_FALLBACK), Equals, remote)
+
+	// a broken file keeps the previous plugins
+	c.Assert(ioutil.WriteFile(AgentConfig().LocalPlugins, []byte("plugins: [\n"), 0644), IsNil)
+	c.Assert(LocalPlugins.Get(), Equals, local)
+
+	setTestConfig(func(config *Config) { config.LocalPlugins = "" })
+	c.Assert(LocalPlugins.Get(), IsNil)
+}
+
+func (self *LocalPluginsSuite) TestEmptyListRemovesPlugin(c *C) {
+	local, err := ParseLocalPlugins([]byte("plugins:\n  mysql: []\n"))
+	c.Assert(err, IsNil)
+	remote := &AgentConfiguration{Plugins: map[string][]*Instance{"mysql": []*Instance{&Instance{Name: "db"}}}}
+	c.Assert(MergeLocalPlugins(remote, local, LOCAL_PLUGINS_REMOTE).Plugins, HasLen, 1)
+	c.Assert(MergeLocalPlugins(remote, local, LOCAL_PLUGINS_LOCAL).Plugins, HasLen, 0)
+}
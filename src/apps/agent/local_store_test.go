@@ -0,0 +1,85 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"path/filepath"
+	"time"
+)
+
+type LocalStoreSuite struct{}
+
+var _ = Suite(&LocalStoreSuite{})
+
+func (self *LocalStoreSuite) SetUpTest(c *C) {
+	runHistory = NewRunHistory()
+	rateStates = NewRateStates()
+	recentMetrics = NewRecentMetrics()
+}
+
+func (self *LocalStoreSuite) TestRestoreAfterRestart(c *C) {
+	path := filepath.Join(c.MkDir(), "agent.db")
+	now := time.Unix(1400000000, 0)
+
+	store, err := OpenLocalStore(path, 1024*1024)
+	c.Assert(err, IsNil)
+	runHistory.Record("mysql/db1", 3*time.Second)
+	rateStates.Set("mysql/db1", &PluginOutput{metrics: map[string]float64{"queries": 10}, timestamp: now.Add(-time.Minute)})
+	rateStates.Set("redis/cache", &PluginOutput{metrics: map[string]float64{"hits": 5}, timestamp: now.Add(-time.Hour)})
+	recentMetrics.Restore("server.stats.cpu.user", []*MetricSample{&MetricSample{now.Add(-2 * time.Hour).Unix(), 1}, &MetricSample{now.Unix(), 2}}, now.Add(-2*time.Hour))
+	c.Assert(saveLocalState(store, now), IsNil)
+	c.Assert(store.Close(), IsNil)
+
+	self.SetUpTest(c)
+	store, err = OpenLocalStore(path, 1024*1024)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	c.Assert(restoreLocalState(store, now), IsNil)
+
+	c.Assert(runHistory.Duration("mysql/db1"), Equals, 3*time.Second)
+	output, ok := rateStates.Get("mysql/db1")
+	c.Assert(ok, Equals, true)
+	c.Assert(output.metrics, DeepEquals, map[string]float64{"queries": 10})
+	c.Assert(output.timestamp.Equal(now.Add(-time.Minute)), Equals, true)
+	// the rate would be averaged over the downtime
+	_, ok = rateStates.Get("redis/cache")
+	c.Assert(ok, Equals, false)
+	// the samples older than the dashboard history are dropped
+	c.Assert(recentMetrics.Series()["server.stats.cpu.user"], DeepEquals, []*MetricSample{&MetricSample{now.Unix(), 2}})
+}
+
+func (self *LocalStoreSuite) TestUnchangedEntriesKeepTheirUpdateTime(c *C) {
+	store, err := OpenLocalStore(filepath.Join(c.MkDir(), "agent.db"), 1024*1024)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	now := time.Unix(1400000000, 0)
+	c.Assert(store.Save(STORE_RUN_HISTORY, map[string]interface{}{"a": 1, "b": 2}, now), IsNil)
+	c.Assert(store.Save(STORE_RUN_HISTORY, map[string]interface{}{"a": 1, "b": 3}, now.Add(time.Minute)), IsNil)
+
+	updates := make(map[string]time.Time)
+	c.Assert(store.Load(STORE_RUN_HISTORY, func(key string, value []byte, updated time.Time) error {
+		updates[key] = updated
+		return nil
+	}), IsNil)
+	c.Assert(updates["a"].Equal(now), Equals, true)
+	c.Assert(updates["b"].Equal(now.Add(time.Minute)), Equals, true)
+}
+
+func (self *LocalStoreSuite) TestDropTheLeastRecentlyUpdatedEntries(c *C) {
+	// room for about two entries
+	store, err := OpenLocalStore(filepath.Join(c.MkDir(), "agent.db"), 80)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	now := time.Unix(1400000000, 0)
+	for i, key := range []string{"a", "b", "c"} {
+		c.Assert(store.Save(STORE_RUN_HISTORY, map[string]interface{}{key: i}, now.Add(time.Duration(i)*time.Minute)), IsNil)
+	}
+
+	keys := make([]string, 0)
+	c.Assert(store.Load(STORE_RUN_HISTORY, func(key string, value []byte, updated time.Time) error {
+		keys = append(keys, key)
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{"b", "c"})
+}
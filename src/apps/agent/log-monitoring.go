@@ -139,7 +139,7 @@ func watchLogFile(detector Detector) {
 			watcher.RemoveWatch(path)
 		}
 
-		time.Sleep(AgentConfig.Sleep)
+		time.Sleep(AgentConfig().Sleep)
 	}
 
 	done := make(chan bool)
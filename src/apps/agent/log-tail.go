@@ -0,0 +1,216 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// the matching lines reported as events per pattern and sleep, the count
+// is still accurate past it
+const MAX_LOG_EVENTS = 10
+
+// Reads the lines appended to a file. The file is kept open so the end of
+// a rotated file is read before following the new one, a truncated file
+// is read from the start
+type LogTailer struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo // of the open file, to tell when the path is another file
+	offset  int64
+	partial string // the last line until its newline is written
+	missing bool   // the file didn't exist, it's read from the start once created
+}
+
+func NewLogTailer(path string) *LogTailer {
+	return &LogTailer{path: path}
+}
+
+func (self *LogTailer) open(fromStart bool) error {
+	file, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file, self.info, self.offset, self.partial = file, info, 0, ""
+	// the lines written before the agent started aren't counted
+	if !fromStart {
+		self.offset = info.Size()
+	}
+	return nil
+}
+
+func (self *LogTailer) read() ([]string, error) {
+	if _, err := self.file.Seek(self.offset, 0); err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(self.file)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	self.offset += int64(len(raw))
+	lines := strings.Split(self.partial+string(raw), "\n")
+	self.partial = lines[len(lines)-1]
+	return lines[:len(lines)-1], nil
+}
+
+// returns the complete lines written since the previous call
+func (self *LogTailer) Lines() ([]string, error) {
+	if self.file == nil {
+		if err := self.open(self.missing); err != nil {
+			self.missing = os.IsNotExist(err)
+			return nil, err
+		}
+		return self.read()
+	}
+
+	info, err := os.Stat(self.path)
+	if err != nil {
+		// rotated and not created yet, finish the old file
+		return self.read()
+	}
+	if !os.SameFile(info, self.info) {
+		lines, err := self.read()
+		if err != nil {
+			return nil, err
+		}
+		if self.partial != "" {
+			lines = append(lines, self.partial)
+		}
+		self.Close()
+		log.Info("Log file %s was rotated", self.path)
+		if err := self.open(true); err != nil {
+			self.missing = true
+			return lines, err
+		}
+		more, err := self.read()
+		return append(lines, more...), err
+	}
+	if info.Size() < self.offset {
+		log.Info("Log file %s was truncated", self.path)
+		self.offset, self.partial = 0, ""
+	}
+	return self.read()
+}
+
+func (self *LogTailer) Close() {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+}
+
+// What matched a pattern since the previous report
+type LogPatternMatches struct {
+	Count  int
+	Sums   map[string]float64
+	Counts map[string]int
+	Max    map[string]float64
+	Events []string
+}
+
+func matchLogLines(patterns []*LogPattern, lines []string, matches map[string]*LogPatternMatches) {
+	for _, pattern := range patterns {
+		current := matches[pattern.Name]
+		if current == nil {
+			current = &LogPatternMatches{Sums: make(map[string]float64), Counts: make(map[string]int), Max: make(map[string]float64)}
+			matches[pattern.Name] = current
+		}
+		groups := pattern.Regex.SubexpNames()
+		for _, line := range lines {
+			submatches := pattern.Regex.FindStringSubmatch(line)
+			if submatches == nil {
+				continue
+			}
+			current.Count++
+			if pattern.Critical && len(current.Events) < MAX_LOG_EVENTS {
+				current.Events = append(current.Events, line)
+			}
+			for i, group := range groups {
+				if group == "" {
+					continue
+				}
+				value, err := strconv.ParseFloat(submatches[i], 64)
+				if err != nil {
+					continue
+				}
+				if current.Counts[group] == 0 || value > current.Max[group] {
+					current.Max[group] = value
+				}
+				current.Sums[group] += value
+				current.Counts[group]++
+			}
+		}
+	}
+}
+
+func reportLogMatches(ep *errplane.Errplane, path string, matches map[string]*LogPatternMatches, now time.Time) {
+	for name, current := range matches {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "file": path}
+		report(ep, "logs."+name+".count", float64(current.Count), now, dimensions, nil)
+		for group, count := range current.Counts {
+			report(ep, "logs."+name+"."+group, current.Sums[group]/float64(count), now, dimensions, nil)
+			report(ep, "logs."+name+"."+group+".max", current.Max[group], now, dimensions, nil)
+		}
+		for _, line := range current.Events {
+			reportWithContext(ep, "logs."+name+".events", 1.0, now, line, errplane.Dimensions{
+				"host":     AgentConfig().Hostname,
+				"file":     path,
+				"severity": "critical",
+			})
+		}
+	}
+}
+
+// tails the files of the log-tails section and reports what matched every
+// sleep, a file that doesn't exist yet is retried every sleep
+func tailLogs(ep *errplane.Errplane) {
+	tailers := make(map[string]*LogTailer)
+	for {
+		time.Sleep(AgentConfig().Sleep)
+		if subsystems.IsStopped(SUBSYSTEM_LOG_TAILER) {
+			// the lines written while stopped aren't counted
+			for path, tailer := range tailers {
+				tailer.Close()
+				delete(tailers, path)
+			}
+			continue
+		}
+		now := time.Now()
+		configured := make(map[string]bool)
+		for _, tail := range AgentConfig().LogTails {
+			configured[tail.Path] = true
+			tailer := tailers[tail.Path]
+			if tailer == nil {
+				tailer = NewLogTailer(tail.Path)
+				tailers[tail.Path] = tailer
+			}
+			lines, err := tailer.Lines()
+			if err != nil {
+				log.Error("Cannot tail %s. Error: %s", tail.Path, err)
+				if len(lines) == 0 {
+					continue
+				}
+			}
+			matches := make(map[string]*LogPatternMatches)
+			matchLogLines(tail.Patterns, lines, matches)
+			reportLogMatches(ep, tail.Path, matches, now)
+		}
+		for path, tailer := range tailers {
+			if !configured[path] {
+				tailer.Close()
+				delete(tailers, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"regexp"
+	. "utils"
+)
+
+type LogTailSuite struct{}
+
+var _ = Suite(&LogTailSuite{})
+
+func appendToFile(c *C, filename, content string) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	c.Assert(err, IsNil)
+}
+
+func (self *LogTailSuite) TestRotation(c *C) {
+	filename := path.Join(c.MkDir(), "app.log")
+	tailer := NewLogTailer(filename)
+	defer tailer.Close()
+
+	// the file is read from the start once created
+	_, err := tailer.Lines()
+	c.Assert(err, NotNil)
+	appendToFile(c, filename, "first\nsecond\nthi")
+	lines, err := tailer.Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{"first", "second"})
+
+	// the end of the rotated file is read before the new one
+	appendToFile(c, filename, "rd\nfourth\n")
+	c.Assert(os.Rename(filename, filename+".1"), IsNil)
+	appendToFile(c, filename, "fifth\n")
+	lines, err = tailer.Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{"third", "fourth", "fifth"})
+
+	c.Assert(ioutil.WriteFile(filename, []byte("6th\n"), 0644), IsNil)
+	lines, err = tailer.Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{"6th"})
+}
+
+func (self *LogTailSuite) TestSkipsExistingLines(c *C) {
+	filename := path.Join(c.MkDir(), "app.log")
+	appendToFile(c, filename, "old\n")
+	tailer := NewLogTailer(filename)
+	defer tailer.Close()
+	lines, err := tailer.Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, HasLen, 0)
+	appendToFile(c, filename, "new\n")
+	lines, err = tailer.Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{"new"})
+}
+
+func (self *LogTailSuite) TestMatches(c *C) {
+	patterns := []*LogPattern{
+		{Name: "requests", Regex: regexp.MustCompile(`GET .* (?P<latency>[0-9.]+)ms`)},
+		{Name: "oom", Regex: regexp.MustCompile(`OutOfMemoryError`), Critical: true},
+	}
+	matches := make(map[string]*LogPatternMatches)
+	matchLogLines(patterns, []string{
+		"GET /users 20ms",
+		"GET /orders 40.5ms",
+		"GET /health -ms",
+		"java.lang.OutOfMemoryError: Java heap space",
+	}, matches)
+
+	c.Assert(matches["requests"].Count, Equals, 2)
+	c.Assert(matches["requests"].Sums["latency"], Equals, 60.5)
+	c.Assert(matches["requests"].Max["latency"], Equals, 40.5)
+	c.Assert(matches["requests"].Events, HasLen, 0)
+	c.Assert(matches["oom"].Count, Equals, 1)
+	c.Assert(matches["oom"].Events, DeepEquals, []string{"java.lang.OutOfMemoryError: Java heap space"})
+}
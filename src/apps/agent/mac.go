@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// mandatory access control (selinux and apparmor) support
+
+const (
+	SELINUX_ENFORCE_FILE  = "/sys/fs/selinux/enforce"
+	APPARMOR_ENABLED_FILE = "/sys/module/apparmor/parameters/enabled"
+	CURRENT_LABEL_FILE    = "/proc/self/attr/current"
+)
+
+type MacStatus struct {
+	selinux  string // enforcing, permissive or disabled
+	apparmor string // enabled or disabled
+	label    string // the selinux context or apparmor profile of the agent
+}
+
+func readTrimmed(filename string) string {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(string(content), "\x00"))
+}
+
+func detectMac() *MacStatus {
+	status := &MacStatus{selinux: "disabled", apparmor: "disabled"}
+
+	switch readTrimmed(SELINUX_ENFORCE_FILE) {
+	case "1":
+		status.selinux = "enforcing"
+	case "0":
+		status.selinux = "permissive"
+	}
+
+	if readTrimmed(APPARMOR_ENABLED_FILE) == "Y" {
+		status.apparmor = "enabled"
+	}
+
+	status.label = readTrimmed(CURRENT_LABEL_FILE)
+	return status
+}
+
+// the access control of the host, detected at startup and read by the
+// plugin runs
+var macStatus = struct {
+	sync.Mutex
+	status *MacStatus
+}{}
+
+// returns the command and arguments that should be used to run the
+// plugin, running it in the configured selinux context or apparmor
+// profile if mandatory access control is active on this host
+func macCommand(cmdPath string, args []string) (string, []string) {
+	macStatus.Lock()
+	status := macStatus.status
+	macStatus.Unlock()
+	if status == nil {
+		return cmdPath, args
+	}
+
+	if status.selinux == "enforcing" && AgentConfig().PluginSelinuxContext != "" {
+		return "runcon", append([]string{AgentConfig().PluginSelinuxContext, cmdPath}, args...)
+	}
+
+	if status.apparmor == "enabled" && AgentConfig().PluginApparmorProfile != "" {
+		return "aa-exec", append([]string{"-p", AgentConfig().PluginApparmorProfile, "--", cmdPath}, args...)
+	}
+
+	return cmdPath, args
+}
+
+func reportMacStatus(ep *errplane.Errplane) {
+	status := detectMac()
+	macStatus.Lock()
+	macStatus.status = status
+	macStatus.Unlock()
+	log.Info("selinux is %s, apparmor is %s, agent label: '%s'", status.selinux, status.apparmor, status.label)
+
+	report(ep, "agent.mac", 1.0, time.Now(), errplane.Dimensions{
+		"host":     AgentConfig().Hostname,
+		"selinux":  status.selinux,
+		"apparmor": status.apparmor,
+		"label":    status.label,
+	}, nil)
+}
+
+// returns true if the given audit/kernel log line is an selinux or apparmor
+// denial that affects the agent or one of its plugins
+func isAgentDenial(line string) bool {
+	if !strings.Contains(line, "avc:  denied") && !strings.Contains(line, "apparmor=\"DENIED\"") {
+		return false
+	}
+
+	patterns := []string{"errplane", AgentConfig().PluginsDir, AgentConfig().CustomPluginsDir}
+	if AgentConfig().PluginSelinuxContext != "" {
+		patterns = append(patterns, AgentConfig().PluginSelinuxContext)
+	}
+	if AgentConfig().PluginApparmorProfile != "" {
+		patterns = append(patterns, AgentConfig().PluginApparmorProfile)
+	}
+
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the access control that denied the operation and the denied
+// operation, e.g. selinux and "read write" or apparmor and "open"
+func parseMacDenial(line string) (string, string) {
+	if i := strings.Index(line, "avc:  denied"); i >= 0 {
+		rest := line[i:]
+		start, end := strings.Index(rest, "{"), strings.Index(rest, "}")
+		if start < 0 || end < start {
+			return "selinux", ""
+		}
+		return "selinux", strings.TrimSpace(rest[start+1 : end])
+	}
+
+	operation := ""
+	if i := strings.Index(line, `operation="`); i >= 0 {
+		rest := line[i+len(`operation="`):]
+		if end := strings.Index(rest, `"`); end >= 0 {
+			operation = rest[:end]
+		}
+	}
+	return "apparmor", operation
+}
+
+// tails the audit log and reports every denial affecting the agent as an
+// event, the log is checked every AgentConfig().Sleep. The line is the
+// context of the event, its pids, paths and timestamps would make every
+// denial a new series.
+func watchMacDenials(ep *errplane.Errplane) {
+	if AgentConfig().MacDenialsLog == "" {
+		return
+	}
+
+	offset, err := getSize(AgentConfig().MacDenialsLog)
+	if err != nil {
+		log.Warn("Cannot read %s, denials won't be reported. Error: %s", AgentConfig().MacDenialsLog, err)
+	}
+
+	sampler := newConfiguredSampler()
+
+	for {
+		time.Sleep(AgentConfig().Sleep)
+
+		size, err := getSize(AgentConfig().MacDenialsLog)
+		if err != nil {
+			continue
+		}
+		if size < offset {
+			// the log was rotated
+			offset = 0
+		}
+
+		file, err := os.Open(AgentConfig().MacDenialsLog)
+		if err != nil {
+			log.Error("Cannot open %s. Error: %s", AgentConfig().MacDenialsLog, err)
+			continue
+		}
+		file.Seek(offset, 0)
+		scanner := bufio.NewScanner(io.LimitReader(file, size-offset))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !isAgentDenial(line) {
+				continue
+			}
+			log.Warn("Access control denial: %s", line)
+			keep, scale := sampler.Sample("agent.mac.denials")
+			if !keep {
+				continue
+			}
+			mac, operation := parseMacDenial(line)
+			dimensions := errplane.Dimensions{
+				"host":      AgentConfig().Hostname,
+				"mac":       mac,
+				"operation": operation,
+			}
+			if scale != 1 {
+				dimensions[SAMPLING_DIMENSION] = formatScale(scale)
+			}
+			reportWithContext(ep, "agent.mac.denials", 1.0, time.Now(), line, dimensions)
+		}
+		offset = size
+		file.Close()
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type MacSuite struct{}
+
+var _ = Suite(&MacSuite{})
+
+func (self *MacSuite) TestParseDenial(c *C) {
+	mac, operation := parseMacDenial(`type=AVC msg=audit(1400000000.123:456): avc:  denied  { read write } for  pid=1234 comm="check_mysql" name="mysql.sock" scontext=system_u:system_r:errplane_plugin_t:s0 tclass=sock_file`)
+	c.Assert(mac, Equals, "selinux")
+	c.Assert(operation, Equals, "read write")
+
+	mac, operation = parseMacDenial(`audit: type=1400 audit(1400000000.123:457): apparmor="DENIED" operation="open" profile="errplane-plugin" name="/etc/shadow" pid=1234 comm="check_users"`)
+	c.Assert(mac, Equals, "apparmor")
+	c.Assert(operation, Equals, "open")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const MAX_MAINTENANCE_DURATION = 7 * 24 * time.Hour
+
+// A maintenance window opened with the local api, e.g. by a deploy script,
+// until it expires or it's removed. The plugin and the instance are shell
+// globs, the whole host is in maintenance if both are empty.
+type Maintenance struct {
+	Id       string    `json:"id"`
+	Plugin   string    `json:"plugin,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Mode     string    `json:"mode"`
+	Comment  string    `json:"comment,omitempty"`
+	Author   string    `json:"author"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// whether the plugins and instances patterns cover the instance of the
+// plugin, no patterns match everything. An empty plugin, e.g. an alert
+// that isn't about a plugin, is only covered by the host wide windows.
+func maintenanceMatches(plugins, instances []string, plugin, instance string) bool {
+	if plugin == "" {
+		return len(plugins) == 0 && len(instances) == 0
+	}
+	return (len(plugins) == 0 || matchesAny(plugins, plugin)) && (len(instances) == 0 || matchesAny(instances, instance))
+}
+
+func maintenancePatterns(pattern string) []string {
+	if pattern == "" {
+		return nil
+	}
+	return []string{pattern}
+}
+
+type Maintenances struct {
+	lock         sync.Mutex
+	maintenances map[string]*Maintenance
+}
+
+var maintenances = NewMaintenances()
+
+func NewMaintenances() *Maintenances {
+	return &Maintenances{maintenances: make(map[string]*Maintenance)}
+}
+
+func (self *Maintenances) Add(plugin, instance, mode, comment, author string, duration time.Duration) (*Maintenance, error) {
+	switch mode {
+	case "":
+		mode = MAINTENANCE_TAG
+	case MAINTENANCE_TAG, MAINTENANCE_SUPPRESS:
+	default:
+		return nil, fmt.Errorf("Unknown maintenance mode '%s', must be %s or %s", mode, MAINTENANCE_TAG, MAINTENANCE_SUPPRESS)
+	}
+	for _, pattern := range []string{plugin, instance} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s'. Error: %s", pattern, err)
+		}
+	}
+	if duration <= 0 || duration > MAX_MAINTENANCE_DURATION {
+		return nil, fmt.Errorf("The maintenance duration must be positive and at most %s", MAX_MAINTENANCE_DURATION)
+	}
+
+	now := time.Now()
+	maintenance := &Maintenance{newSilenceId(), plugin, instance, mode, comment, author, now, now.Add(duration)}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maintenances[maintenance.Id] = maintenance
+	return maintenance, nil
+}
+
+func (self *Maintenances) Remove(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.maintenances[id]
+	delete(self.maintenances, id)
+	return ok
+}
+
+// returns the active maintenance windows sorted by expiration, the ones
+// from the config have a config-<index> id. Forgets about the expired ones.
+func (self *Maintenances) List(now time.Time) []*Maintenance {
+	self.lock.Lock()
+	list := make([]*Maintenance, 0, len(self.maintenances))
+	for id, maintenance := range self.maintenances {
+		if !maintenance.Expires.After(now) {
+			delete(self.maintenances, id)
+			continue
+		}
+		list = append(list, maintenance)
+	}
+	self.lock.Unlock()
+
+	for idx, window := range AgentConfig().Maintenance {
+		if !window.Active(now) {
+			continue
+		}
+		list = append(list, &Maintenance{
+			Id:       fmt.Sprintf("config-%d", idx),
+			Plugin:   strings.Join(window.Plugins, ","),
+			Instance: strings.Join(window.Instances, ","),
+			Mode:     window.Mode,
+			Comment:  window.Comment,
+			Author:   "config",
+			Expires:  window.End(now),
+		})
+	}
+	sort.Sort(MaintenancesSortableByExpiration(list))
+	return list
+}
+
+// returns what the maintenance windows covering the instance of the
+// plugin do: suppress if any suppresses, tag if any is open, an empty
+// string if the instance isn't in maintenance
+func (self *Maintenances) Find(plugin, instance string, now time.Time) string {
+	mode := ""
+	for _, window := range AgentConfig().Maintenance {
+		if window.Active(now) && maintenanceMatches(window.Plugins, window.Instances, plugin, instance) {
+			if window.Mode == MAINTENANCE_SUPPRESS {
+				return MAINTENANCE_SUPPRESS
+			}
+			mode = window.Mode
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, maintenance := range self.maintenances {
+		if !maintenance.Expires.After(now) || !maintenanceMatches(maintenancePatterns(maintenance.Plugin), maintenancePatterns(maintenance.Instance), plugin, instance) {
+			continue
+		}
+		if maintenance.Mode == MAINTENANCE_SUPPRESS {
+			return MAINTENANCE_SUPPRESS
+		}
+		mode = maintenance.Mode
+	}
+	return mode
+}
+
+// adds maintenance=true to the dimensions if the instance of the plugin is
+// in maintenance and returns the maintenance mode
+func tagMaintenance(plugin, instance string, dimensions errplane.Dimensions) string {
+	mode := maintenances.Find(plugin, instance, time.Now())
+	if mode != "" {
+		dimensions["maintenance"] = "true"
+	}
+	return mode
+}
+
+type MaintenancesSortableByExpiration []*Maintenance
+
+func (self MaintenancesSortableByExpiration) Len() int { return len(self) }
+func (self MaintenancesSortableByExpiration) Less(i, j int) bool {
+	return self[i].Expires.Before(self[j].Expires)
+}
+func (self MaintenancesSortableByExpiration) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+func listMaintenance(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, maintenances.List(time.Now()))
+}
+
+func addMaintenance(w http.ResponseWriter, req *http.Request) {
+	duration, err := time.ParseDuration(req.FormValue("for"))
+	if err != nil {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(req)
+	plugin, instance, mode := req.FormValue("plugin"), req.FormValue("instance"), req.FormValue("mode")
+	maintenance, err := maintenances.Add(plugin, instance, mode, req.FormValue("comment"), actor, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit(actor, "add_maintenance", "", "", fmt.Sprintf("id=%s plugin=%s instance=%s mode=%s duration=%s", maintenance.Id, plugin, instance, maintenance.Mode, duration))
+	log.Info("Maintenance %s of plugin '%s' instance '%s' until %s", maintenance.Mode, plugin, instance, maintenance.Expires)
+	writeJson(w, http.StatusOK, maintenance)
+}
+
+func removeMaintenance(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+
+	audit(requestActor(req), "remove_maintenance", "", "", fmt.Sprintf("id=%s", id))
+
+	if !maintenances.Remove(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Info("Removed maintenance %s", id)
+	w.WriteHeader(http.StatusOK)
+}
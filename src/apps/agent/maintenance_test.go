@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type MaintenanceSuite struct{}
+
+var _ = Suite(&MaintenanceSuite{})
+
+func (self *MaintenanceSuite) TestActive(c *C) {
+	start := time.Date(2027, 1, 10, 2, 0, 0, 0, time.UTC)
+	once := &MaintenanceWindow{Start: start, Duration: time.Hour}
+	c.Assert(once.Active(start.Add(-time.Second)), Equals, false)
+	c.Assert(once.Active(start), Equals, true)
+	c.Assert(once.Active(start.Add(time.Hour)), Equals, false)
+	c.Assert(once.End(start.Add(time.Minute)), Equals, start.Add(time.Hour))
+
+	// every day from 23:30 to 00:30
+	daily := &MaintenanceWindow{Daily: 23*time.Hour + 30*time.Minute, Duration: time.Hour}
+	c.Assert(daily.Active(time.Date(2027, 1, 10, 23, 45, 0, 0, time.UTC)), Equals, true)
+	c.Assert(daily.Active(time.Date(2027, 1, 11, 0, 15, 0, 0, time.UTC)), Equals, true)
+	c.Assert(daily.Active(time.Date(2027, 1, 11, 0, 30, 0, 0, time.UTC)), Equals, false)
+	c.Assert(daily.Active(time.Date(2027, 1, 11, 12, 0, 0, 0, time.UTC)), Equals, false)
+	c.Assert(daily.End(time.Date(2027, 1, 11, 0, 15, 0, 0, time.UTC)), Equals, time.Date(2027, 1, 11, 0, 30, 0, 0, time.UTC))
+}
+
+func (self *MaintenanceSuite) TestFind(c *C) {
+	now := time.Now()
+	defer setTestConfig(func(config *Config) {
+		config.Maintenance = []*MaintenanceWindow{
+			&MaintenanceWindow{Plugins: []string{"mysql*"}, Mode: MAINTENANCE_TAG, Start: now.Add(-time.Minute), Duration: time.Hour},
+			&MaintenanceWindow{Mode: MAINTENANCE_SUPPRESS, Start: now.Add(time.Hour), Duration: time.Hour},
+		}
+	})()
+
+	m := NewMaintenances()
+	c.Assert(m.Find("mysql", "replica", now), Equals, MAINTENANCE_TAG)
+	c.Assert(m.Find("redis", "", now), Equals, "")
+	// alerts that aren't about a plugin are only covered by host wide windows
+	c.Assert(m.Find("", "", now), Equals, "")
+
+	maintenance, err := m.Add("mysql", "replica*", MAINTENANCE_SUPPRESS, "deploy", "test", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(m.Find("mysql", "replica-1", now), Equals, MAINTENANCE_SUPPRESS)
+	c.Assert(m.Find("mysql", "primary", now), Equals, MAINTENANCE_TAG)
+
+	list := m.List(now)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].Id, Equals, "config-0")
+	c.Assert(list[0].Plugin, Equals, "mysql*")
+	c.Assert(list[1], Equals, maintenance)
+
+	c.Assert(m.Remove(maintenance.Id), Equals, true)
+	c.Assert(m.Find("mysql", "replica-1", now), Equals, MAINTENANCE_TAG)
+
+	// the whole host
+	_, err = m.Add("", "", "", "", "test", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(m.Find("", "", now), Equals, MAINTENANCE_TAG)
+	c.Assert(m.Find("redis", "", now), Equals, MAINTENANCE_TAG)
+
+	_, err = m.Add("mysql", "", "silence", "", "test", time.Hour)
+	c.Assert(err, ErrorMatches, "Unknown maintenance mode.*")
+	_, err = m.Add("[mysql", "", "", "", "test", time.Hour)
+	c.Assert(err, ErrorMatches, "Invalid pattern.*")
+	_, err = m.Add("mysql", "", "", "", "test", 0)
+	c.Assert(err, NotNil)
+}
+
+func (self *MaintenanceSuite) TestHostMaintenanceTagsPoints(c *C) {
+	previousMaintenances := maintenances
+	defer func() { maintenances = previousMaintenances }()
+	maintenances = NewMaintenances()
+	defer setTestConfig(func(config *Config) { config.Dimensions = nil })()
+
+	c.Assert(addGlobalDimensions(nil), IsNil)
+	_, err := maintenances.Add("", "", MAINTENANCE_TAG, "", "test", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(addGlobalDimensions(errplane.Dimensions{"host": "myhost"}), DeepEquals, errplane.Dimensions{"host": "myhost", "maintenance": "true"})
+}
+
+func (self *MaintenanceSuite) TestInstanceMaintenanceSuppressesAlerts(c *C) {
+	previousMaintenances := maintenances
+	defer func() { maintenances = previousMaintenances }()
+	maintenances = NewMaintenances()
+
+	_, err := maintenances.Add("mysql", "replica*", MAINTENANCE_SUPPRESS, "", "test", time.Hour)
+	c.Assert(err, IsNil)
+
+	notifier := &recordingNotifier{done: make(chan bool, 10)}
+	dispatcher := NewNotificationDispatcher([]Notifier{notifier}, time.Hour)
+	dispatcher.Alert(&Notification{Key: "replica", Title: "replica", Dimensions: map[string]string{"PluginName": "mysql", "instance": "replica-1"}})
+	dispatcher.Alert(&Notification{Key: "primary", Title: "primary", Dimensions: map[string]string{"PluginName": "mysql", "instance": "primary"}})
+	<-notifier.done
+
+	c.Assert(notifier.notifications, HasLen, 1)
+	c.Assert(notifier.notifications[0].Key, Equals, "primary")
+}
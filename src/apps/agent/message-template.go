@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	. "utils"
+)
+
+var placeholderRegex = regexp.MustCompile(`{{\s*([^{}:\s]+)\s*(?::\s*(\d+)\s*)?}}`)
+
+// Interpolates the values in a status message template, e.g.
+// "disk / is {{used_pct}}% full, {{free_gb:1}}GB free". The optional
+// number after the colon is the number of decimals numeric values are
+// rounded to. Placeholders without a value are kept as is so a typo in the
+// template is visible in the message.
+func interpolateMessage(template string, values map[string]interface{}) string {
+	return placeholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		matches := placeholderRegex.FindStringSubmatch(placeholder)
+		value, ok := values[matches[1]]
+		if !ok {
+			return placeholder
+		}
+
+		precision := -1
+		if matches[2] != "" {
+			precision, _ = strconv.Atoi(matches[2])
+		}
+
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', precision, 64)
+		case string:
+			return v
+		default:
+			return fmt.Sprintf("%v", v)
+		}
+	})
+}
+
+// the values a plugin status message template can use: the plugin metrics
+// (errplane or nagios output), its status, the first line of its output,
+// the instance name and the host name
+func pluginMessageValues(output *PluginOutput, instance *Instance) map[string]interface{} {
+	values := map[string]interface{}{
+		"status":   output.state.String(),
+		"output":   output.msg,
+		"instance": instance.Name,
+		"host":     AgentConfig().Hostname,
+	}
+	for _, write := range output.points {
+		if len(write.Points) > 0 {
+			values[write.Name] = write.Points[0].Value
+		}
+	}
+	for name, value := range output.metrics {
+		values[name] = value
+	}
+	return values
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	. "utils"
+)
+
+// returns whether the global metric filter lets the metric be sent, the
+// dropped points are counted
+func allowedByFilters(metric string) bool {
+	if AgentConfig().MetricFilters.Allows(metric) {
+		return true
+	}
+	agentStats.Add(STAT_POINTS_FILTERED, 1)
+	return false
+}
+
+// returns the writes whose metric the global metric filter lets through
+func filterWrites(writes []*errplane.JsonPoints) []*errplane.JsonPoints {
+	if AgentConfig().MetricFilters.Empty() {
+		return writes
+	}
+	kept := make([]*errplane.JsonPoints, 0, len(writes))
+	for _, write := range writes {
+		if AgentConfig().MetricFilters.Allows(write.Name) {
+			kept = append(kept, write)
+			continue
+		}
+		agentStats.Add(STAT_POINTS_FILTERED, len(write.Points))
+	}
+	return kept
+}
+
+// returns the writes printed by the plugin that its metric filter lets
+// through, the names are the ones the plugin printed
+func filterPluginWrites(plugin string, writes []*errplane.JsonPoints) []*errplane.JsonPoints {
+	filter := AgentConfig().MetricFilters.Plugins[plugin]
+	if filter == nil {
+		return writes
+	}
+	kept := make([]*errplane.JsonPoints, 0, len(writes))
+	for _, write := range writes {
+		if filter.Allows(write.Name) {
+			kept = append(kept, write)
+			continue
+		}
+		log.Debug("Dropping metric %s of plugin %s, it's filtered out", write.Name, plugin)
+		agentStats.Add(STAT_POINTS_FILTERED, len(write.Points))
+	}
+	return kept
+}
+
+// removes the nagios perfdata the metric filter of the plugin doesn't let
+// through
+func filterPluginMetrics(plugin string, metrics map[string]float64) {
+	filter := AgentConfig().MetricFilters.Plugins[plugin]
+	if filter == nil {
+		return
+	}
+	for name := range metrics {
+		if !filter.Allows(name) {
+			log.Debug("Dropping metric %s of plugin %s, it's filtered out", name, plugin)
+			agentStats.Add(STAT_POINTS_FILTERED, 1)
+			delete(metrics, name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	. "utils"
+)
+
+type MetricFiltersSuite struct{}
+
+var _ = Suite(&MetricFiltersSuite{})
+
+func metricFilter(c *C, include, exclude []string) *MetricFilter {
+	filter := &MetricFilter{}
+	for _, raw := range include {
+		pattern, err := ParseMetricPattern(raw)
+		c.Assert(err, IsNil)
+		filter.Include = append(filter.Include, pattern)
+	}
+	for _, raw := range exclude {
+		pattern, err := ParseMetricPattern(raw)
+		c.Assert(err, IsNil)
+		filter.Exclude = append(filter.Exclude, pattern)
+	}
+	return filter
+}
+
+func (self *MetricFiltersSuite) TestAllows(c *C) {
+	filter := metricFilter(c, []string{"threads_*", "/^connections$/"}, []string{"/_cached$/"})
+	c.Assert(filter.Allows("threads_running"), Equals, true)
+	c.Assert(filter.Allows("threads_cached"), Equals, false)
+	c.Assert(filter.Allows("connections"), Equals, true)
+	c.Assert(filter.Allows("max_connections"), Equals, false)
+
+	c.Assert(metricFilter(c, nil, []string{"debug.*"}).Allows("cpu"), Equals, true)
+	c.Assert((&MetricFilter{}).Allows("cpu"), Equals, true)
+
+	_, err := ParseMetricPattern("/[a-/")
+	c.Assert(err, ErrorMatches, "Invalid metric regex.*")
+	_, err = ParseMetricPattern("[a-")
+	c.Assert(err, ErrorMatches, "Invalid metric pattern.*")
+}
+
+func (self *MetricFiltersSuite) TestFilters(c *C) {
+	previousStats := agentStats
+	defer func() { agentStats = previousStats }()
+	agentStats = NewAgentStats()
+	defer setTestConfig(func(config *Config) {
+		config.MetricFilters = MetricFiltersConfig{
+			MetricFilter: *metricFilter(c, nil, []string{"plugins.*.debug_*"}),
+			Plugins:      map[string]*MetricFilter{"mysql": metricFilter(c, []string{"threads_*"}, nil)},
+		}
+	})()
+
+	writes := filterPluginWrites("mysql", []*errplane.JsonPoints{batchWrite("threads_running", 1).Writes[0], batchWrite("questions", 2, 3).Writes[0]})
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "threads_running")
+	c.Assert(filterPluginWrites("redis", []*errplane.JsonPoints{batchWrite("questions", 2).Writes[0]}), HasLen, 1)
+
+	metrics := map[string]float64{"threads_running": 1, "uptime": 2}
+	filterPluginMetrics("mysql", metrics)
+	c.Assert(metrics, DeepEquals, map[string]float64{"threads_running": 1})
+
+	writes = filterWrites([]*errplane.JsonPoints{batchWrite("plugins.redis.debug_keys", 1).Writes[0], batchWrite("plugins.redis.keys", 2).Writes[0]})
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.redis.keys")
+	c.Assert(allowedByFilters("plugins.mysql.debug_locks"), Equals, false)
+
+	c.Assert(agentStats.Counts()[STAT_POINTS_FILTERED], Equals, int64(5))
+}
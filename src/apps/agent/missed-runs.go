@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// why a due plugin run didn't happen
+const (
+	MISSED_OVERRUN      = "overrun"      // the previous run was still in progress
+	MISSED_INCOMPATIBLE = "incompatible" // the plugin needs a newer agent or a capability it doesn't have
+)
+
+var MISSED_MESSAGES = map[string]string{
+	MISSED_OVERRUN:      "Skipped, the previous run is still in progress",
+	MISSED_INCOMPATIBLE: "Skipped, the plugin is incompatible with this agent",
+}
+
+func missedMarkersEnabled(plugin *PluginMetadata) bool {
+	return plugin.MissedMarkers || matchesAny(AgentConfig().MissedMarkers, plugin.Name)
+}
+
+// counts the missed run and, if the plugin asked for it, reports a marker
+// point in its series so a dashboard can tell a skipped run from a dead
+// agent, the reason is a dimension and the context says why
+func reportMissedRun(ep *errplane.Errplane, plugin *PluginMetadata, instance *Instance, reason string, timestamp time.Time) {
+	agentStats.Add(STAT_MISSED_RUNS, 1)
+	if !missedMarkersEnabled(plugin) {
+		return
+	}
+	id := instanceId(plugin.Name, instance)
+	dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "reason": reason}
+	addInstanceDimensions(dimensions, id, instance)
+	reportWithContext(ep, fmt.Sprintf("plugins.%s.missed", plugin.Name), 1.0, timestamp, MISSED_MESSAGES[reason], dimensions)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/binary"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"math"
+	"net"
+	"time"
+	. "utils"
+)
+
+const (
+	MODBUS_READ_HOLDING_REGISTERS = 3
+	MODBUS_READ_INPUT_REGISTERS   = 4
+)
+
+type ModbusError struct {
+	function byte
+	code     byte
+}
+
+func (self *ModbusError) Error() string {
+	return fmt.Sprintf("Modbus exception %d for function %d", self.code, self.function)
+}
+
+// A minimal modbus tcp client that can read holding and input registers
+type ModbusClient struct {
+	conn        net.Conn
+	unitId      byte
+	timeout     time.Duration
+	transaction uint16
+}
+
+func NewModbusClient(device *ModbusDevice) (*ModbusClient, error) {
+	conn, err := net.DialTimeout("tcp", device.Address, device.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ModbusClient{conn: conn, unitId: device.UnitId, timeout: device.Timeout}, nil
+}
+
+func (self *ModbusClient) Close() error {
+	return self.conn.Close()
+}
+
+func (self *ModbusClient) ReadRegisters(function byte, address, count uint16) ([]uint16, error) {
+	self.transaction++
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint16(request[0:], self.transaction)
+	binary.BigEndian.PutUint16(request[2:], 0) // protocol id
+	binary.BigEndian.PutUint16(request[4:], 6) // length of the unit id and the pdu
+	request[6] = self.unitId
+	request[7] = function
+	binary.BigEndian.PutUint16(request[8:], address)
+	binary.BigEndian.PutUint16(request[10:], count)
+
+	self.conn.SetDeadline(time.Now().Add(self.timeout))
+	if _, err := self.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(self.conn, header); err != nil {
+		return nil, err
+	}
+	if transaction := binary.BigEndian.Uint16(header[0:]); transaction != self.transaction {
+		return nil, fmt.Errorf("Expected transaction %d but received %d", self.transaction, transaction)
+	}
+	// the unit id, the function and the byte count or the exception code
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 || length > 256 {
+		return nil, fmt.Errorf("Invalid response length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(self.conn, pdu); err != nil {
+		return nil, err
+	}
+
+	if pdu[0] == function|0x80 {
+		return nil, &ModbusError{function, pdu[1]}
+	}
+	if pdu[0] != function || len(pdu) < 2 || int(pdu[1]) != int(count)*2 || len(pdu) < 2+int(count)*2 {
+		return nil, fmt.Errorf("Unexpected response to function %d", function)
+	}
+
+	registers := make([]uint16, count)
+	for idx := range registers {
+		registers[idx] = binary.BigEndian.Uint16(pdu[2+idx*2:])
+	}
+	return registers, nil
+}
+
+// reads the register and converts it according to its format, scale and offset
+func readModbusRegister(client *ModbusClient, register *ModbusRegister) (float64, error) {
+	function := byte(MODBUS_READ_HOLDING_REGISTERS)
+	if register.Type == "input" {
+		function = MODBUS_READ_INPUT_REGISTERS
+	}
+	count := uint16(1)
+	switch register.Format {
+	case "uint32", "int32", "float32":
+		count = 2
+	}
+
+	registers, err := client.ReadRegisters(function, register.Address, count)
+	if err != nil {
+		return 0, err
+	}
+	return decodeModbusRegisters(register, registers)*register.Scale + register.Offset, nil
+}
+
+func decodeModbusRegisters(register *ModbusRegister, registers []uint16) float64 {
+	var raw uint32
+	if len(registers) == 2 {
+		if register.WordOrder == "little" {
+			raw = uint32(registers[1])<<16 | uint32(registers[0])
+		} else {
+			raw = uint32(registers[0])<<16 | uint32(registers[1])
+		}
+	}
+
+	switch register.Format {
+	case "int16":
+		return float64(int16(registers[0]))
+	case "uint32":
+		return float64(raw)
+	case "int32":
+		return float64(int32(raw))
+	case "float32":
+		return float64(math.Float32frombits(raw))
+	default:
+		return float64(registers[0])
+	}
+}
+
+func monitorModbusDevices(ep *errplane.Errplane) {
+	if len(AgentConfig().ModbusDevices) == 0 {
+		return
+	}
+
+	for {
+		for _, device := range AgentConfig().ModbusDevices {
+			go collectModbusDevice(ep, device)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+func collectModbusDevice(ep *errplane.Errplane, device *ModbusDevice) {
+	client, err := NewModbusClient(device)
+	if err != nil {
+		log.Error("Cannot connect to modbus device %s. Error: %s", device.Name, NetworkError(err))
+		checkStates.Set(CHECK_MODBUS, device.Name, "", "unknown", err.Error())
+		return
+	}
+	defer client.Close()
+
+	timestamp := time.Now()
+	state, msg := OK, ""
+	for _, register := range device.Registers {
+		value, err := readModbusRegister(client, register)
+		if err != nil {
+			log.Error("Cannot read register %s of modbus device %s. Error: %s", register.Name, device.Name, NetworkError(err))
+			state, msg = UNKNOWN, fmt.Sprintf("Cannot read register %s", register.Name)
+			if _, ok := err.(*ModbusError); !ok {
+				// the connection is probably in a bad state
+				break
+			}
+			continue
+		}
+
+		dimensions := errplane.Dimensions{
+			"host":   AgentConfig().Hostname,
+			"device": device.Name,
+		}
+		for key, value := range register.Dimensions {
+			dimensions[key] = value
+		}
+		report(ep, "modbus."+register.Name, value, timestamp, dimensions, nil)
+	}
+	checkStates.Set(CHECK_MODBUS, device.Name, "", state.String(), msg)
+}
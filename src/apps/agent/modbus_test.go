@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	. "launchpad.net/gocheck"
+	"math"
+	"net"
+	"time"
+	. "utils"
+)
+
+type ModbusSuite struct{}
+
+var _ = Suite(&ModbusSuite{})
+
+// a fake device whose register n contains n*10, except for register 99
+// which returns an illegal address exception and register 98 which returns
+// a response without the byte count
+func startFakeModbusDevice(c *C) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			request := make([]byte, 12)
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			function := request[7]
+			address := binary.BigEndian.Uint16(request[8:])
+			count := binary.BigEndian.Uint16(request[10:])
+
+			pdu := []byte{function, byte(count * 2)}
+			if address == 99 {
+				pdu = []byte{function | 0x80, 2}
+			} else if address == 98 {
+				pdu = []byte{function | 0x80}
+			} else {
+				for idx := uint16(0); idx < count; idx++ {
+					pdu = append(pdu, 0, 0)
+					binary.BigEndian.PutUint16(pdu[len(pdu)-2:], (address+idx)*10)
+				}
+			}
+			response := make([]byte, 7, 7+len(pdu))
+			copy(response, request[0:4])
+			binary.BigEndian.PutUint16(response[4:], uint16(len(pdu)+1))
+			response[6] = request[6]
+			conn.Write(append(response, pdu...))
+		}
+	}()
+	return listener
+}
+
+func (self *ModbusSuite) TestReadRegisters(c *C) {
+	listener := startFakeModbusDevice(c)
+	defer listener.Close()
+
+	client, err := NewModbusClient(&ModbusDevice{Name: "test", Address: listener.Addr().String(), UnitId: 1, Timeout: time.Second})
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	value, err := readModbusRegister(client, &ModbusRegister{Name: "temp", Type: "input", Address: 12, Format: "uint16", Scale: 0.1})
+	c.Assert(err, IsNil)
+	c.Assert(math.Abs(value-12) < 1e-9, Equals, true)
+
+	value, err = readModbusRegister(client, &ModbusRegister{Name: "counter", Address: 1, Format: "uint32", Scale: 1})
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, float64(10<<16|20))
+
+	_, err = readModbusRegister(client, &ModbusRegister{Name: "missing", Address: 99, Format: "uint16", Scale: 1})
+	c.Assert(err, FitsTypeOf, &ModbusError{})
+	_, err = readModbusRegister(client, &ModbusRegister{Name: "truncated", Address: 98, Format: "uint16", Scale: 1})
+	c.Assert(err, ErrorMatches, "Invalid response length 2")
+}
+
+func (self *ModbusSuite) TestDecodeRegisters(c *C) {
+	bits := math.Float32bits(21.5)
+	high, low := uint16(bits>>16), uint16(bits)
+
+	c.Assert(decodeModbusRegisters(&ModbusRegister{Format: "float32"}, []uint16{high, low}), Equals, 21.5)
+	c.Assert(decodeModbusRegisters(&ModbusRegister{Format: "float32", WordOrder: "little"}, []uint16{low, high}), Equals, 21.5)
+	c.Assert(decodeModbusRegisters(&ModbusRegister{Format: "int16"}, []uint16{0xFFFF}), Equals, -1.0)
+	c.Assert(decodeModbusRegisters(&ModbusRegister{Format: "int32"}, []uint16{0xFFFF, 0xFFFE}), Equals, -2.0)
+}
@@ -81,6 +81,11 @@ func monitorProceses(ep *errplane.Errplane, ch chan error) {
 				}
 
 				monitoredProcess.LastStatus = status
+				if status == UP {
+					checkStates.Set(CHECK_PROCESS, monitoredProcess.Nickname, "", "ok", "")
+				} else {
+					checkStates.Set(CHECK_PROCESS, monitoredProcess.Nickname, "", "critical", "process is down")
+				}
 				// process is still up, or is still down. Do nothing in both cases.
 			}
 
@@ -101,7 +106,7 @@ func monitorProceses(ep *errplane.Errplane, ch chan error) {
 		previousProcessesSnapshot = processes
 		previousProcessesSnapshotByPid = processesByPid
 
-		time.Sleep(AgentConfig.MonitoredSleep)
+		time.Sleep(AgentConfig().MonitoredSleep)
 	}
 }
 
@@ -219,8 +224,8 @@ func reportProcessEvent(ep *errplane.Errplane, process *Process, regex, status s
 		return
 	}
 
-	ep.Report("server.process.monitoring", 1.0, time.Now(), "", errplane.Dimensions{
-		"host":     AgentConfig.Hostname,
+	reportWithContext(ep, "server.process.monitoring", 1.0, time.Now(), "", errplane.Dimensions{
+		"host":     AgentConfig().Hostname,
 		"nickname": process.Nickname,
 		"status":   status,
 	})
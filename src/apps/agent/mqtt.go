@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	log "code.google.com/p/log4go"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// a minimal mqtt 3.1.1 client that can only subscribe
+
+const (
+	MQTT_CONNECT    = 1
+	MQTT_CONNACK    = 2
+	MQTT_PUBLISH    = 3
+	MQTT_PUBACK     = 4
+	MQTT_SUBSCRIBE  = 8
+	MQTT_SUBACK     = 9
+	MQTT_PINGREQ    = 12
+	MQTT_PINGRESP   = 13
+	MQTT_KEEP_ALIVE = 60 // seconds
+)
+
+type MqttPacket struct {
+	kind    byte
+	flags   byte
+	payload []byte
+}
+
+func mqttString(str string) []byte {
+	encoded := make([]byte, 2, 2+len(str))
+	binary.BigEndian.PutUint16(encoded, uint16(len(str)))
+	return append(encoded, str...)
+}
+
+func writeMqttPacket(writer io.Writer, kind, flags byte, payload []byte) error {
+	packet := []byte{kind<<4 | flags}
+	length := len(payload)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := writer.Write(append(packet, payload...))
+	return err
+}
+
+func readMqttPacket(reader *bufio.Reader) (*MqttPacket, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("Invalid remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return &MqttPacket{header >> 4, header & 0x0F, payload}, nil
+}
+
+// returns the topic, the packet id (0 for qos 0) and the message of a publish packet
+func parseMqttPublish(packet *MqttPacket) (string, uint16, []byte, error) {
+	if len(packet.payload) < 2 {
+		return "", 0, nil, fmt.Errorf("Publish packet too short")
+	}
+	topicLength := int(binary.BigEndian.Uint16(packet.payload))
+	offset := 2 + topicLength
+	if len(packet.payload) < offset {
+		return "", 0, nil, fmt.Errorf("Publish packet too short")
+	}
+	topic := string(packet.payload[2:offset])
+	var packetId uint16
+	if qos := (packet.flags >> 1) & 0x03; qos > 0 {
+		if len(packet.payload) < offset+2 {
+			return "", 0, nil, fmt.Errorf("Publish packet too short")
+		}
+		packetId = binary.BigEndian.Uint16(packet.payload[offset:])
+		offset += 2
+	}
+	return topic, packetId, packet.payload[offset:], nil
+}
+
+// returns the values of the wildcards if the topic matches the filter
+func matchMqttTopic(filter, topic string) ([]string, bool) {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	values := make([]string, 0)
+	for idx, level := range filterLevels {
+		switch {
+		case level == "#":
+			return append(values, strings.Join(topicLevels[idx:], "/")), true
+		case idx >= len(topicLevels):
+			return nil, false
+		case level == "+":
+			values = append(values, topicLevels[idx])
+		case level != topicLevels[idx]:
+			return nil, false
+		}
+	}
+	return values, len(filterLevels) == len(topicLevels)
+}
+
+var jsonPathTokenRegex = regexp.MustCompile(`\.([^.\[\]]+)|\[(\d+)\]|\['([^']+)'\]`)
+
+// returns the value at the given path (e.g. $.sensors[0].temperature) of
+// the json document
+func jsonPathLookup(document interface{}, path string) (interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("Json path must start with $")
+	}
+	rest := path[1:]
+	value := document
+	for rest != "" {
+		matches := jsonPathTokenRegex.FindStringSubmatch(rest)
+		if matches == nil || !strings.HasPrefix(rest, matches[0]) {
+			return nil, fmt.Errorf("Invalid json path %s", path)
+		}
+		rest = rest[len(matches[0]):]
+
+		if matches[2] != "" {
+			idx, _ := strconv.Atoi(matches[2])
+			array, ok := value.([]interface{})
+			if !ok || idx >= len(array) {
+				return nil, fmt.Errorf("No element %d at %s", idx, path)
+			}
+			value = array[idx]
+			continue
+		}
+
+		key := matches[1] + matches[3]
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("No key %s at %s", key, path)
+		}
+		if value, ok = object[key]; !ok {
+			return nil, fmt.Errorf("No key %s at %s", key, path)
+		}
+	}
+	return value, nil
+}
+
+// extracts the numeric value of the message
+func mqttMessageValue(subscription *MqttSubscription, message []byte) (float64, error) {
+	if subscription.JsonPath == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(message)), 64)
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return 0, err
+	}
+	value, err := jsonPathLookup(document, subscription.JsonPath)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("The value at %s isn't a number", subscription.JsonPath)
+	}
+}
+
+func connectMqtt(config *MqttConfig) (net.Conn, *bufio.Reader, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if config.Tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.Broker, TlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", config.Broker)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := byte(0x02) // clean session
+	payload := mqttString(config.ClientId)
+	if config.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(config.Username)...)
+		if config.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(config.Password)...)
+		}
+	}
+	variableHeader := append(mqttString("MQTT"), 4, flags, 0, MQTT_KEEP_ALIVE)
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := writeMqttPacket(conn, MQTT_CONNECT, 0, append(variableHeader, payload...)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	packet, err := readMqttPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if packet.kind != MQTT_CONNACK || len(packet.payload) < 2 || packet.payload[1] != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Connection refused by the broker")
+	}
+
+	subscribe := []byte{0, 1} // packet id
+	for _, subscription := range config.Subscriptions {
+		subscribe = append(subscribe, mqttString(subscription.Topic)...)
+		subscribe = append(subscribe, subscription.Qos)
+	}
+	if err := writeMqttPacket(conn, MQTT_SUBSCRIBE, 0x02, subscribe); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+func handleMqttMessage(ep *errplane.Errplane, config *MqttConfig, topic string, message []byte) {
+	for _, subscription := range config.Subscriptions {
+		wildcards, ok := matchMqttTopic(subscription.Topic, topic)
+		if !ok {
+			continue
+		}
+
+		value, err := mqttMessageValue(subscription, message)
+		if err != nil {
+			log.Debug("Cannot extract a number from the message published on %s. Error: %s", topic, err)
+			continue
+		}
+
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "topic": topic}
+		for idx, name := range subscription.TopicDimensions {
+			if idx < len(wildcards) {
+				dimensions[name] = wildcards[idx]
+			}
+		}
+		report(ep, subscription.Metric, value, time.Now(), dimensions, nil)
+	}
+}
+
+// reads the messages until the connection fails
+func consumeMqtt(ep *errplane.Errplane, config *MqttConfig, conn net.Conn, reader *bufio.Reader) error {
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(MQTT_KEEP_ALIVE / 2 * time.Second):
+				writeMqttPacket(conn, MQTT_PINGREQ, 0, nil)
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * MQTT_KEEP_ALIVE * time.Second))
+		packet, err := readMqttPacket(reader)
+		if err != nil {
+			return err
+		}
+
+		switch packet.kind {
+		case MQTT_SUBACK:
+			if len(packet.payload) < 2 {
+				return fmt.Errorf("Suback packet too short")
+			}
+			for _, code := range packet.payload[2:] {
+				if code == 0x80 {
+					log.Error("The mqtt broker refused one of the subscriptions")
+				}
+			}
+		case MQTT_PUBLISH:
+			topic, packetId, message, err := parseMqttPublish(packet)
+			if err != nil {
+				return err
+			}
+			if packetId != 0 {
+				ack := make([]byte, 2)
+				binary.BigEndian.PutUint16(ack, packetId)
+				writeMqttPacket(conn, MQTT_PUBACK, 0, ack)
+			}
+			handleMqttMessage(ep, config, topic, message)
+		}
+	}
+}
+
+func startMqttSubscriber(ep *errplane.Errplane) {
+	config := &AgentConfig().Mqtt
+	if config.Broker == "" || len(config.Subscriptions) == 0 {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		conn, reader, err := connectMqtt(config)
+		if err != nil {
+			log.Error("Cannot connect to the mqtt broker %s. Error: %s", config.Broker, NetworkError(err))
+		} else {
+			log.Info("Subscribed to %d mqtt topics on %s", len(config.Subscriptions), config.Broker)
+			backoff = time.Second
+			err = consumeMqtt(ep, config, conn, reader)
+			conn.Close()
+			log.Error("Lost the connection to the mqtt broker %s. Error: %s", config.Broker, NetworkError(err))
+		}
+
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	. "utils"
+)
+
+type MqttSuite struct{}
+
+var _ = Suite(&MqttSuite{})
+
+func (self *MqttSuite) TestTopicMatching(c *C) {
+	values, ok := matchMqttTopic("factory/+/+/temperature", "factory/paris/press-1/temperature")
+	c.Assert(ok, Equals, true)
+	c.Assert(values, DeepEquals, []string{"paris", "press-1"})
+
+	values, ok = matchMqttTopic("factory/#", "factory/paris/press-1")
+	c.Assert(ok, Equals, true)
+	c.Assert(values, DeepEquals, []string{"paris/press-1"})
+
+	_, ok = matchMqttTopic("factory/+/temperature", "factory/paris/press-1/temperature")
+	c.Assert(ok, Equals, false)
+	_, ok = matchMqttTopic("factory/+/+/temperature", "factory/paris/temperature")
+	c.Assert(ok, Equals, false)
+}
+
+func (self *MqttSuite) TestMessageValue(c *C) {
+	value, err := mqttMessageValue(&MqttSubscription{}, []byte(" 21.5\n"))
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, 21.5)
+
+	message := []byte(`{"sensors": [{"temperature": 21.5}, {"reading": {"value": "42"}}], "on": true}`)
+	value, err = mqttMessageValue(&MqttSubscription{JsonPath: "$.sensors[0].temperature"}, message)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, 21.5)
+	value, err = mqttMessageValue(&MqttSubscription{JsonPath: "$.sensors[1]['reading'].value"}, message)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, 42.0)
+	value, err = mqttMessageValue(&MqttSubscription{JsonPath: "$.on"}, message)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, 1.0)
+
+	_, err = mqttMessageValue(&MqttSubscription{JsonPath: "$.sensors[2].temperature"}, message)
+	c.Assert(err, NotNil)
+	_, err = mqttMessageValue(&MqttSubscription{JsonPath: "$.sensors"}, message)
+	c.Assert(err, NotNil)
+
+	var document interface{}
+	json.Unmarshal(message, &document)
+	_, err = jsonPathLookup(document, "sensors")
+	c.Assert(err, NotNil)
+}
+
+func (self *MqttSuite) TestPublishPacket(c *C) {
+	payload := append(mqttString("factory/paris/temperature"), 0, 7)
+	payload = append(payload, bytes.Repeat([]byte("1"), 200)...)
+
+	buffer := bytes.NewBuffer(nil)
+	c.Assert(writeMqttPacket(buffer, MQTT_PUBLISH, 0x02, payload), IsNil)
+
+	packet, err := readMqttPacket(bufio.NewReader(buffer))
+	c.Assert(err, IsNil)
+	c.Assert(packet.kind, Equals, byte(MQTT_PUBLISH))
+
+	topic, packetId, message, err := parseMqttPublish(packet)
+	c.Assert(err, IsNil)
+	c.Assert(topic, Equals, "factory/paris/temperature")
+	c.Assert(packetId, Equals, uint16(7))
+	c.Assert(message, HasLen, 200)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	PAGERDUTY_EVENTS_URL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+type Notification struct {
+	Key        string // identifies the alert so resolve notifications match the trigger
+	Title      string
+	Body       string
+	Severity   string // warning or critical
+	Resolved   bool
+	Dimensions map[string]string
+}
+
+type Notifier interface {
+	Name() string
+	Notify(notification *Notification) error
+}
+
+func postJson(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Received status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type PagerDutyNotifier struct {
+	routingKey string
+	url        string
+}
+
+func (self *PagerDutyNotifier) Name() string { return "pagerduty" }
+
+func (self *PagerDutyNotifier) Notify(notification *Notification) error {
+	action := "trigger"
+	if notification.Resolved {
+		action = "resolve"
+	}
+	return postJson(self.url, map[string]interface{}{
+		"routing_key":  self.routingKey,
+		"event_action": action,
+		"dedup_key":    notification.Key,
+		"payload": map[string]interface{}{
+			"summary":        notification.Title,
+			"source":         AgentConfig().Hostname,
+			"severity":       notification.Severity,
+			"custom_details": notification.Dimensions,
+		},
+	})
+}
+
+type SlackNotifier struct {
+	webhook string
+}
+
+func (self *SlackNotifier) Name() string { return "slack" }
+
+func (self *SlackNotifier) Notify(notification *Notification) error {
+	text := fmt.Sprintf(":rotating_light: [%s] %s", AgentConfig().Hostname, notification.Title)
+	if notification.Resolved {
+		text = fmt.Sprintf(":white_check_mark: [%s] Resolved: %s", AgentConfig().Hostname, notification.Title)
+	}
+	if notification.Body != "" {
+		text += "\n```" + notification.Body + "```"
+	}
+	return postJson(self.webhook, map[string]string{"text": text})
+}
+
+type EmailNotifier struct {
+	config *NotifiersConfig
+}
+
+func (self *EmailNotifier) Name() string { return "email" }
+
+func (self *EmailNotifier) Notify(notification *Notification) error {
+	subject := fmt.Sprintf("[%s] %s", AgentConfig().Hostname, notification.Title)
+	if notification.Resolved {
+		subject = fmt.Sprintf("[%s] Resolved: %s", AgentConfig().Hostname, notification.Title)
+	}
+
+	body := bytes.NewBufferString("")
+	fmt.Fprintf(body, "From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n", self.config.EmailFrom, strings.Join(self.config.EmailTo, ", "), subject)
+	keys := make([]string, 0, len(notification.Dimensions))
+	for key, _ := range notification.Dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(body, "%s: %s\r\n", key, notification.Dimensions[key])
+	}
+	fmt.Fprintf(body, "\r\n%s\r\n", notification.Body)
+
+	var auth smtp.Auth
+	if self.config.SmtpUsername != "" {
+		host, _, _ := net.SplitHostPort(self.config.SmtpHost)
+		auth = smtp.PlainAuth("", self.config.SmtpUsername, self.config.SmtpPassword, host)
+	}
+	return smtp.SendMail(self.config.SmtpHost, auth, self.config.EmailFrom, self.config.EmailTo, body.Bytes())
+}
+
+// Sends alert and resolve notifications to all the configured notifiers,
+// an alert with the same key is sent at most once every throttle period
+// and a resolve notification is only sent for alerts that were sent
+type NotificationDispatcher struct {
+	lock      sync.Mutex
+	notifiers []Notifier
+	throttle  time.Duration
+	lastSent  map[string]time.Time
+}
+
+func NewNotificationDispatcher(notifiers []Notifier, throttle time.Duration) *NotificationDispatcher {
+	return &NotificationDispatcher{notifiers: notifiers, throttle: throttle, lastSent: make(map[string]time.Time)}
+}
+
+func newConfiguredNotifiers() *NotificationDispatcher {
+	config := &AgentConfig().Notifiers
+	notifiers := make([]Notifier, 0)
+	if config.PagerDutyRoutingKey != "" {
+		notifiers = append(notifiers, &PagerDutyNotifier{config.PagerDutyRoutingKey, PAGERDUTY_EVENTS_URL})
+	}
+	if config.SlackWebhook != "" {
+		notifiers = append(notifiers, &SlackNotifier{config.SlackWebhook})
+	}
+	if config.SmtpHost != "" && len(config.EmailTo) > 0 {
+		notifiers = append(notifiers, &EmailNotifier{config})
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return NewNotificationDispatcher(notifiers, config.Throttle)
+}
+
+func (self *NotificationDispatcher) Alert(notification *Notification) {
+	if self == nil {
+		return
+	}
+
+	if silence := silences.Find(notification); silence != nil {
+		log.Debug("Not sending notification '%s', it's silenced by %s until %s", notification.Title, silence.Id, silence.Expires)
+		return
+	}
+
+	if maintenances.Find(notification.Dimensions["PluginName"], notification.Dimensions["instance"], time.Now()) != "" {
+		log.Debug("Not sending notification '%s', it's in a maintenance window", notification.Title)
+		return
+	}
+
+	self.lock.Lock()
+	if last, ok := self.lastSent[notification.Key]; ok && time.Now().Sub(last) < self.throttle {
+		self.lock.Unlock()
+		log.Debug("Not sending notification '%s', it was sent at %s", notification.Title, last)
+		return
+	}
+	self.lastSent[notification.Key] = time.Now()
+	self.lock.Unlock()
+
+	self.send(notification)
+}
+
+func (self *NotificationDispatcher) Resolve(notification *Notification) {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	if _, ok := self.lastSent[notification.Key]; !ok {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.lastSent, notification.Key)
+	self.lock.Unlock()
+
+	notification.Resolved = true
+	self.send(notification)
+}
+
+func (self *NotificationDispatcher) send(notification *Notification) {
+	// the silences match the dimensions before they're scrubbed
+	scrubbed := *notification
+	scrubbed.Dimensions = scrubDimensions(notification.Dimensions)
+	notification = &scrubbed
+	state := notification.Severity
+	if notification.Resolved {
+		state = "resolved"
+	}
+	recordHistory(&HistoryEntry{Timestamp: time.Now().Unix(), Kind: HISTORY_EVENT, Name: notification.Title, State: state})
+	for _, notifier := range self.notifiers {
+		go func(notifier Notifier) {
+			if err := notifier.Notify(notification); err != nil {
+				log.Error("Cannot send notification '%s' using %s. Error: %s", notification.Title, notifier.Name(), err)
+			}
+		}(notifier)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"sync"
+	"time"
+)
+
+type NotifiersSuite struct{}
+
+var _ = Suite(&NotifiersSuite{})
+
+type recordingNotifier struct {
+	lock          sync.Mutex
+	notifications []*Notification
+	done          chan bool
+}
+
+func (self *recordingNotifier) Name() string { return "recording" }
+
+func (self *recordingNotifier) Notify(notification *Notification) error {
+	self.lock.Lock()
+	self.notifications = append(self.notifications, notification)
+	self.lock.Unlock()
+	self.done <- true
+	return nil
+}
+
+func (self *NotifiersSuite) TestThrottleAndResolve(c *C) {
+	notifier := &recordingNotifier{done: make(chan bool, 10)}
+	dispatcher := NewNotificationDispatcher([]Notifier{notifier}, time.Hour)
+
+	// resolving an alert that was never sent is a no-op
+	dispatcher.Resolve(&Notification{Key: "foo", Title: "foo"})
+	dispatcher.Alert(&Notification{Key: "foo", Title: "foo"})
+	dispatcher.Alert(&Notification{Key: "foo", Title: "foo"})
+	<-notifier.done
+	dispatcher.Resolve(&Notification{Key: "foo", Title: "foo"})
+	<-notifier.done
+
+	c.Assert(notifier.notifications, HasLen, 2)
+	c.Assert(notifier.notifications[0].Resolved, Equals, false)
+	c.Assert(notifier.notifications[1].Resolved, Equals, true)
+
+	// the alert can be sent again once resolved
+	dispatcher.Alert(&Notification{Key: "foo", Title: "foo"})
+	<-notifier.done
+	c.Assert(notifier.notifications, HasLen, 3)
+}
+
+func (self *NotifiersSuite) TestNilDispatcher(c *C) {
+	var dispatcher *NotificationDispatcher
+	dispatcher.Alert(&Notification{Key: "foo"})
+	dispatcher.Resolve(&Notification{Key: "foo"})
+}
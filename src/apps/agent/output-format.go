@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// the versions of the errplane output schema, set with format_version in
+// the info.yml of the plugin
+const (
+	FORMAT_VERSION_PIPE   = 1 // status | json points, points on the following lines
+	FORMAT_VERSION_JSON   = 2 // a single json document
+	FORMAT_VERSION_NDJSON = 3 // a json header line followed by a json write per line
+)
+
+// the versions the agent can parse, the plugin is told which one it's
+// expected to print in ERRPLANE_FORMAT_VERSION
+var SUPPORTED_FORMAT_VERSIONS = []int{FORMAT_VERSION_PIPE, FORMAT_VERSION_JSON, FORMAT_VERSION_NDJSON}
+
+// the version 2 output, and the header line of the version 3 output
+type versionedOutput struct {
+	FormatVersion *int                   `json:"format_version"`
+	Status        string                 `json:"status"`
+	Writes        []*errplane.JsonPoints `json:"writes"`
+	Events        []*PluginEvent         `json:"events"`
+}
+
+// a line of the version 3 output, either a write or an event
+type ndjsonLine struct {
+	errplane.JsonPoints
+	Event *PluginEvent `json:"event"`
+}
+
+// returns the version of the errplane output of the plugin, 1 if the
+// info.yml doesn't have one
+func pluginFormatVersion(plugin *PluginMetadata) int {
+	if plugin.FormatVersion == 0 {
+		return FORMAT_VERSION_PIPE
+	}
+	return plugin.FormatVersion
+}
+
+func validateFormatVersion(plugin *PluginMetadata) error {
+	if plugin.FormatVersion == 0 {
+		return nil
+	}
+	if plugin.Output != "errplane" {
+		return fmt.Errorf("Plugin %s has a format_version but only the errplane output is versioned", plugin.Name)
+	}
+	for _, version := range SUPPORTED_FORMAT_VERSIONS {
+		if version == plugin.FormatVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("Plugin %s has format_version %d, the agent supports %s", plugin.Name, plugin.FormatVersion, formatVersionsList())
+}
+
+func formatVersionsList() string {
+	versions := make([]string, 0, len(SUPPORTED_FORMAT_VERSIONS))
+	for _, version := range SUPPORTED_FORMAT_VERSIONS {
+		versions = append(versions, strconv.Itoa(version))
+	}
+	return strings.Join(versions, ", ")
+}
+
+// the environment variables telling the plugin which output the agent expects
+func formatVersionEnv(plugin *PluginMetadata) []string {
+	if plugin.Output != "errplane" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("ERRPLANE_FORMAT_VERSION=%d", pluginFormatVersion(plugin)),
+		"ERRPLANE_FORMAT_VERSIONS=" + strings.Replace(formatVersionsList(), " ", "", -1),
+	}
+}
+
+func formatVersionMismatch(expected int, actual *int) error {
+	if actual == nil {
+		return fmt.Errorf("Expected an output with format_version %d, the output doesn't have a format_version", expected)
+	}
+	return fmt.Errorf("Expected an output with format_version %d (from info.yml), the plugin printed format_version %d", expected, *actual)
+}
+
+// parses the errplane output in the version declared in the info.yml of
+// the plugin, an output printed in another version is an error
+func parseVersionedErrplaneOutput(plugin *PluginMetadata, cmdState ProcessState, allOutput string) (*PluginOutput, error) {
+	version := pluginFormatVersion(plugin)
+	allOutput = strings.TrimSpace(allOutput)
+	firstLine := strings.TrimSpace(strings.SplitN(allOutput, "\n", 2)[0])
+
+	switch version {
+	case FORMAT_VERSION_PIPE:
+		// a versioned output would be reported as an unparseable status
+		if strings.HasPrefix(firstLine, "{") {
+			header := &versionedOutput{}
+			if json.Unmarshal([]byte(firstLine), header) == nil && header.FormatVersion != nil {
+				return nil, formatVersionMismatch(version, header.FormatVersion)
+			}
+		}
+		return parseErrplaneOutput(cmdState, allOutput)
+	case FORMAT_VERSION_JSON:
+		output := &versionedOutput{}
+		if err := json.Unmarshal([]byte(allOutput), output); err != nil {
+			return nil, fmt.Errorf("Cannot parse the format_version 2 output. Error: %s", err)
+		}
+		if output.FormatVersion == nil || *output.FormatVersion != version {
+			return nil, formatVersionMismatch(version, output.FormatVersion)
+		}
+		if output.Writes == nil {
+			output.Writes = make([]*errplane.JsonPoints, 0)
+		}
+		if err := checkPluginEvents(output.Events); err != nil {
+			return nil, err
+		}
+		return &PluginOutput{pluginState(cmdState.ExitStatus()), output.Status, output.Writes, nil, output.Events, time.Now(), cmdState.ExitStatus()}, nil
+	case FORMAT_VERSION_NDJSON:
+		lines := strings.Split(allOutput, "\n")
+		header := &versionedOutput{}
+		if err := json.Unmarshal([]byte(firstLine), header); err != nil {
+			return nil, fmt.Errorf("Cannot parse the header line of the format_version 3 output. Error: %s", err)
+		}
+		if header.FormatVersion == nil || *header.FormatVersion != version {
+			return nil, formatVersionMismatch(version, header.FormatVersion)
+		}
+		writes := make([]*errplane.JsonPoints, 0, len(lines)-1)
+		var events []*PluginEvent
+		for idx, line := range lines[1:] {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			parsed := &ndjsonLine{}
+			if err := json.Unmarshal([]byte(line), parsed); err != nil {
+				return nil, fmt.Errorf("Cannot parse line %d of the format_version 3 output. Error: %s", idx+2, err)
+			}
+			if parsed.Event != nil {
+				events = append(events, parsed.Event)
+				continue
+			}
+			write := parsed.JsonPoints
+			writes = append(writes, &write)
+		}
+		if err := checkPluginEvents(events); err != nil {
+			return nil, err
+		}
+		return &PluginOutput{pluginState(cmdState.ExitStatus()), header.Status, writes, nil, events, time.Now(), cmdState.ExitStatus()}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported format_version %d, the agent supports %s", version, formatVersionsList())
+	}
+}
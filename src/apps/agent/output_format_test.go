@@ -0,0 +1,97 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type OutputFormatSuite struct{}
+
+var _ = Suite(&OutputFormatSuite{})
+
+func (self *OutputFormatSuite) TestJsonOutput(c *C) {
+	plugin := &PluginMetadata{Name: "queues", Output: "errplane", FormatVersion: 2}
+	msg := `{"format_version": 2, "status": "OK", "writes": [{"n": "jobs", "p": [{"v": 1}]}]}`
+	output, err := parsePluginOutput(plugin, &FakeProcessState{1}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, PluginStateOutput(1))
+	c.Assert(output.msg, Equals, "OK")
+	c.Assert(output.points, HasLen, 1)
+	c.Assert(output.points[0].Name, Equals, "jobs")
+	c.Assert(pluginDetail(plugin, msg), Equals, "")
+}
+
+func (self *OutputFormatSuite) TestNdjsonOutput(c *C) {
+	plugin := &PluginMetadata{Name: "queues", Output: "errplane", FormatVersion: 3}
+	msg := "{\"format_version\": 3, \"status\": \"OK\"}\n{\"n\": \"jobs\", \"p\": [{\"v\": 1}]}\n\n{\"n\": \"workers\", \"p\": [{\"v\": 2}]}\n"
+	output, err := parsePluginOutput(plugin, &FakeProcessState{0}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.msg, Equals, "OK")
+	c.Assert(output.points, HasLen, 2)
+	c.Assert(output.points[1].Points[0].Value, Equals, 2.0)
+
+	_, err = parsePluginOutput(plugin, &FakeProcessState{0}, "{\"format_version\": 3, \"status\": \"OK\"}\nnot json")
+	c.Assert(err, ErrorMatches, "Cannot parse line 2 of the format_version 3 output.*")
+}
+
+func (self *OutputFormatSuite) TestEvents(c *C) {
+	plugin := &PluginMetadata{Name: "backup", Output: "errplane", FormatVersion: 2}
+	msg := `{"format_version": 2, "status": "OK", "events": [{"title": "Backup finished", "body": "12GB in 4m", "d": {"db": "users", "host": "other"}}]}`
+	output, err := parsePluginOutput(plugin, &FakeProcessState{0}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.points, HasLen, 0)
+	c.Assert(output.events, HasLen, 1)
+	c.Assert(output.events[0].Severity, Equals, EVENT_SEVERITY_INFO)
+
+	write := pluginEventsWrite(plugin, "abc", &Instance{Name: "nightly"}, output.events, time.Unix(1400000000, 0))
+	c.Assert(write.Name, Equals, "plugins.backup.events")
+	c.Assert(write.Points, HasLen, 1)
+	c.Assert(write.Points[0].Time, Equals, int64(1400000000))
+	c.Assert(write.Points[0].Context, Equals, `{"title":"Backup finished","body":"12GB in 4m","severity":"info"}`)
+	c.Assert(write.Points[0].Dimensions["host"], Equals, AgentConfig().Hostname)
+	c.Assert(write.Points[0].Dimensions["db"], Equals, "users")
+	c.Assert(write.Points[0].Dimensions["instance"], Equals, "nightly")
+	c.Assert(write.Points[0].Dimensions["severity"], Equals, EVENT_SEVERITY_INFO)
+
+	plugin.FormatVersion = 3
+	msg = "{\"format_version\": 3, \"status\": \"OK\"}\n{\"n\": \"size\", \"p\": [{\"v\": 12}]}\n{\"event\": {\"title\": \"RAID degraded\", \"severity\": \"critical\", \"t\": 1400000000}}\n"
+	output, err = parsePluginOutput(plugin, &FakeProcessState{0}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.points, HasLen, 1)
+	c.Assert(output.points[0].Name, Equals, "size")
+	c.Assert(output.events, HasLen, 1)
+	c.Assert(output.events[0].Title, Equals, "RAID degraded")
+	c.Assert(output.events[0].Time, Equals, int64(1400000000))
+
+	_, err = parsePluginOutput(plugin, &FakeProcessState{0}, "{\"format_version\": 3}\n{\"event\": {\"title\": \"x\", \"severity\": \"fatal\"}}")
+	c.Assert(err, ErrorMatches, "Unknown severity 'fatal' of event 1.*")
+	_, err = parsePluginOutput(plugin, &FakeProcessState{0}, "{\"format_version\": 3}\n{\"event\": {\"body\": \"x\"}}")
+	c.Assert(err, ErrorMatches, "Missing title of event 1")
+}
+
+func (self *OutputFormatSuite) TestVersionMismatch(c *C) {
+	v1 := &PluginMetadata{Name: "queues", Output: "errplane"}
+	_, err := parsePluginOutput(v1, &FakeProcessState{0}, `{"format_version": 2, "status": "OK"}`)
+	c.Assert(err, ErrorMatches, "Expected an output with format_version 1 \\(from info.yml\\), the plugin printed format_version 2")
+
+	v2 := &PluginMetadata{Name: "queues", Output: "errplane", FormatVersion: 2}
+	_, err = parsePluginOutput(v2, &FakeProcessState{0}, `{"format_version": 3, "status": "OK"}`)
+	c.Assert(err, ErrorMatches, ".*the plugin printed format_version 3")
+	_, err = parsePluginOutput(v2, &FakeProcessState{0}, `{"status": "OK"}`)
+	c.Assert(err, ErrorMatches, ".*the output doesn't have a format_version")
+	_, err = parsePluginOutput(v2, &FakeProcessState{0}, "OK | [{\"n\": \"jobs\", \"p\": [{\"v\": 1}]}]")
+	c.Assert(err, ErrorMatches, "Cannot parse the format_version 2 output.*")
+}
+
+func (self *OutputFormatSuite) TestValidateFormatVersion(c *C) {
+	c.Assert(validateFormatVersion(&PluginMetadata{Name: "queues", Output: "errplane"}), IsNil)
+	c.Assert(validateFormatVersion(&PluginMetadata{Name: "queues", Output: "errplane", FormatVersion: 3}), IsNil)
+	c.Assert(validateFormatVersion(&PluginMetadata{Name: "queues", Output: "errplane", FormatVersion: 4}), ErrorMatches,
+		"Plugin queues has format_version 4, the agent supports 1, 2, 3")
+	c.Assert(validateFormatVersion(&PluginMetadata{Name: "disk", Output: "nagios", FormatVersion: 2}), NotNil)
+
+	c.Assert(formatVersionEnv(&PluginMetadata{Output: "errplane", FormatVersion: 2}), DeepEquals,
+		[]string{"ERRPLANE_FORMAT_VERSION=2", "ERRPLANE_FORMAT_VERSIONS=1,2,3"})
+	c.Assert(formatVersionEnv(&PluginMetadata{Output: "nagios"}), IsNil)
+}
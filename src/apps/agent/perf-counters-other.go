@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	. "utils"
+)
+
+func openPerfQuery(counters []*PerfCounter) (PerfQuery, error) {
+	return nil, fmt.Errorf("The performance counters are only available on windows")
+}
@@ -0,0 +1,90 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"syscall"
+	"unsafe"
+	. "utils"
+)
+
+const (
+	PDH_FMT_DOUBLE      = 0x00000200
+	PDH_CSTATUS_VALID   = 0x00000000
+	PDH_CSTATUS_NEWDATA = 0x00000001
+)
+
+var (
+	pdh                         = syscall.NewLazyDLL("pdh.dll")
+	pdhOpenQuery                = pdh.NewProc("PdhOpenQueryW")
+	pdhAddEnglishCounter        = pdh.NewProc("PdhAddEnglishCounterW")
+	pdhCollectQueryData         = pdh.NewProc("PdhCollectQueryData")
+	pdhGetFormattedCounterValue = pdh.NewProc("PdhGetFormattedCounterValue")
+	pdhCloseQuery               = pdh.NewProc("PdhCloseQuery")
+)
+
+// PDH_FMT_COUNTERVALUE with the double of the union, aligned on 8 bytes
+type pdhCounterValue struct {
+	CStatus     uint32
+	_           uint32
+	DoubleValue float64
+}
+
+type PdhQuery struct {
+	handle   uintptr
+	counters map[string]uintptr
+}
+
+func pdhError(function string, status uintptr) error {
+	return fmt.Errorf("%s failed with status 0x%08x", function, uint32(status))
+}
+
+// adds the counters to a pdh query, the counters that don't exist on this
+// host are logged and skipped
+func openPerfQuery(counters []*PerfCounter) (PerfQuery, error) {
+	if err := pdh.Load(); err != nil {
+		return nil, err
+	}
+	query := &PdhQuery{counters: make(map[string]uintptr)}
+	if status, _, _ := pdhOpenQuery.Call(0, 0, uintptr(unsafe.Pointer(&query.handle))); status != 0 {
+		return nil, pdhError("PdhOpenQuery", status)
+	}
+	for _, counter := range counters {
+		path, err := syscall.UTF16PtrFromString(counter.Path)
+		if err != nil {
+			return nil, err
+		}
+		var handle uintptr
+		if status, _, _ := pdhAddEnglishCounter.Call(query.handle, uintptr(unsafe.Pointer(path)), 0, uintptr(unsafe.Pointer(&handle))); status != 0 {
+			log.Error("Cannot add the performance counter %s. Error: %s", counter.Path, pdhError("PdhAddEnglishCounter", status))
+			continue
+		}
+		query.counters[counter.Name] = handle
+	}
+	// the first sample of the rate counters
+	pdhCollectQueryData.Call(query.handle)
+	return query, nil
+}
+
+func (self *PdhQuery) Collect() (map[string]float64, error) {
+	if status, _, _ := pdhCollectQueryData.Call(self.handle); status != 0 {
+		return nil, pdhError("PdhCollectQueryData", status)
+	}
+	values := make(map[string]float64)
+	for name, handle := range self.counters {
+		var value pdhCounterValue
+		status, _, _ := pdhGetFormattedCounterValue.Call(handle, PDH_FMT_DOUBLE, 0, uintptr(unsafe.Pointer(&value)))
+		if status != 0 || (value.CStatus != PDH_CSTATUS_VALID && value.CStatus != PDH_CSTATUS_NEWDATA) {
+			continue
+		}
+		values[name] = value.DoubleValue
+	}
+	return values, nil
+}
+
+func (self *PdhQuery) Close() {
+	pdhCloseQuery.Call(self.handle)
+}
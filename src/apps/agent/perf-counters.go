@@ -0,0 +1,41 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// The performance counters of windows queried together, the rate counters
+// (e.g. % Processor Time) need two samples so they're reported from the
+// second collection
+type PerfQuery interface {
+	// returns the value of the counters that have one, by name
+	Collect() (map[string]float64, error)
+	Close()
+}
+
+func collectPerfCounters(ep *errplane.Errplane) {
+	if len(AgentConfig().PerfCounters) == 0 {
+		return
+	}
+	query, err := openPerfQuery(AgentConfig().PerfCounters)
+	if err != nil {
+		log.Error("Cannot query the performance counters. Error: %s", err)
+		return
+	}
+	defer query.Close()
+	for {
+		values, err := query.Collect()
+		if err != nil {
+			log.Error("Cannot collect the performance counters. Error: %s", err)
+		}
+		now := time.Now()
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		for name, value := range values {
+			report(ep, "server.perf."+name, value, now, dimensions, nil)
+		}
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+var envNameRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+func validateArgumentType(argument *PluginArgument, value string) error {
+	var err error
+	switch argument.Type {
+	case "", "string":
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "duration":
+		_, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("Argument %s has an unknown type '%s'", argument.Name, argument.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("Argument %s must be of type %s, got '%s'", argument.Name, argument.Type, value)
+	}
+	return nil
+}
+
+// validates the arguments of the instance against the arguments declared
+// in the plugin info.yml and returns them with the defaults filled in.
+// Plugins that don't declare their arguments accept anything.
+func validatePluginArgs(plugin *PluginMetadata, instance *Instance) (map[string]string, error) {
+	if len(plugin.Arguments) == 0 {
+		return instance.Args, nil
+	}
+	return validateDeclaredValues(plugin.Arguments, instance.Args, "argument")
+}
+
+// validates the environment variables of the instance against the ones
+// declared in the plugin info.yml and returns them as NAME=value with the
+// defaults filled in. Plugins that don't declare their environment accept
+// anything but the ERRPLANE_ variables the agent sets itself.
+func validatePluginEnv(plugin *PluginMetadata, instance *Instance) ([]string, error) {
+	if len(instance.Env) > 0 && instance.Remote != nil {
+		return nil, fmt.Errorf("Environment variables can't be passed to remote instances")
+	}
+	for name, _ := range instance.Env {
+		if !envNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("Invalid environment variable name '%s'", name)
+		}
+		if strings.HasPrefix(name, "ERRPLANE_") {
+			return nil, fmt.Errorf("Environment variable '%s' is reserved for the agent", name)
+		}
+	}
+
+	values := instance.Env
+	if len(plugin.Environment) > 0 {
+		var err error
+		if values, err = validateDeclaredValues(plugin.Environment, instance.Env, "environment variable"); err != nil {
+			return nil, err
+		}
+	}
+	env := make([]string, 0, len(values))
+	for _, name := range sortedArgNames(values) {
+		env = append(env, name+"="+values[name])
+	}
+	return env, nil
+}
+
+func validateDeclaredValues(arguments []*PluginArgument, values map[string]string, kind string) (map[string]string, error) {
+	declared := make(map[string]*PluginArgument)
+	for _, argument := range arguments {
+		declared[argument.Name] = argument
+	}
+	for name, _ := range values {
+		if declared[name] == nil {
+			return nil, fmt.Errorf("Unknown %s '%s'", kind, name)
+		}
+	}
+
+	validated := make(map[string]string)
+	for _, argument := range arguments {
+		value, ok := values[argument.Name]
+		if !ok {
+			if argument.Required {
+				return nil, fmt.Errorf("Missing required %s '%s'", kind, argument.Name)
+			}
+			if argument.DefaultValue == "" {
+				continue
+			}
+			value = argument.DefaultValue
+		}
+		if err := validateArgumentType(argument, value); err != nil {
+			return nil, err
+		}
+		validated[argument.Name] = value
+	}
+	return validated, nil
+}
+
+// returns the command line arguments of the plugin as they should be
+// logged, i.e. with the values of the secret arguments masked
+func loggableArgs(plugin *PluginMetadata, args []string) string {
+	secrets := make(map[string]bool)
+	for _, argument := range plugin.Arguments {
+		if argument.Secret {
+			secrets["--"+argument.Name] = true
+		}
+	}
+
+	loggable := make([]string, len(args))
+	copy(loggable, args)
+	for idx := 1; idx < len(loggable); idx++ {
+		if secrets[loggable[idx-1]] {
+			loggable[idx] = "****"
+		}
+	}
+	return strings.Join(loggable, " ")
+}
+
+// the arguments are passed in a stable order
+func sortedArgNames(args map[string]string) []string {
+	names := make([]string, 0, len(args))
+	for name, _ := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"fmt"
 	"io/ioutil"
 	"launchpad.net/goyaml"
 	"os"
@@ -51,9 +52,16 @@ func checkNewPlugins() {
 		}
 
 		// update the agent information
-		SendPluginStatus(&AgentStatus{availablePlugins, time.Now().Unix()})
-
-		time.Sleep(AgentConfig.Sleep)
+		SendPluginStatus(&AgentStatus{
+			Plugins:      availablePlugins,
+			Timestamp:    time.Now().Unix(),
+			Version:      agentVersion,
+			Incompatible: incompatiblePlugins(plugins),
+			Ephemeral:    AgentConfig().Ephemeral.Enabled,
+			Heartbeat:    int64(AgentConfig().Heartbeat.Interval.Seconds()),
+		})
+
+		time.Sleep(AgentConfig().Sleep)
 	}
 }
 
@@ -65,23 +73,19 @@ func getAvailablePlugins() map[string]*PluginMetadata {
 
 	latestVersion, err := GetCurrentPluginsVersion()
 	if err != nil {
+		// keep running the installed plugins until the backend is reachable
 		log.Error("Cannot current plugins version. Error: %s", err)
-		return nil
+		latestVersion = version
 	}
 
 	if string(version) != string(latestVersion) {
+		audit("config-service", "plugins_installed", "", "", fmt.Sprintf("%s -> %s", version, latestVersion))
 		InstallPlugin(latestVersion)
 	}
 
-	pluginsDir := path.Join(PLUGINS_DIR, string(latestVersion))
-	plugins, err := getPluginsInfo(pluginsDir)
-	if err != nil {
-		log.Error("Cannot list directory '%s'. Error: %s", pluginsDir, err)
-		return nil
-	}
-	customPlugins, err := getPluginsInfo(CUSTOM_PLUGINS_DIR)
+	plugins, customPlugins, err := listInstalledPlugins(latestVersion)
 	if err != nil {
-		log.Error("Cannot list directory '%s'. Error: %s", CUSTOM_PLUGINS_DIR, err)
+		log.Error("%s", err)
 		return nil
 	}
 
@@ -109,6 +113,45 @@ func getAvailablePlugins() map[string]*PluginMetadata {
 		}
 	}
 
+	return mergeCustomPlugins(plugins, customPlugins)
+}
+
+// returns the plugins already installed without talking to the backend,
+// they run at boot until the backend answers
+func getInstalledPlugins() map[string]*PluginMetadata {
+	version, err := GetInstalledPluginsVersion()
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Cannot read the installed plugins version. Error: %s", err)
+		return nil
+	}
+	plugins, customPlugins, err := listInstalledPlugins(version)
+	if err != nil {
+		log.Error("%s", err)
+		return nil
+	}
+	return mergeCustomPlugins(plugins, customPlugins)
+}
+
+// lists the plugins of the given version, if any is installed, and the
+// custom plugins
+func listInstalledPlugins(version string) (map[string]*PluginMetadata, map[string]*PluginMetadata, error) {
+	plugins := make(map[string]*PluginMetadata)
+	if version != "" {
+		pluginsDir := path.Join(AgentConfig().PluginsDir, version)
+		var err error
+		plugins, err = getPluginsInfo(pluginsDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot list directory '%s'. Error: %s", pluginsDir, err)
+		}
+	}
+	customPlugins, err := getPluginsInfo(AgentConfig().CustomPluginsDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot list directory '%s'. Error: %s", AgentConfig().CustomPluginsDir, err)
+	}
+	return plugins, customPlugins, nil
+}
+
+func mergeCustomPlugins(plugins, customPlugins map[string]*PluginMetadata) map[string]*PluginMetadata {
 	// custom plugins take precendence
 	for name, info := range customPlugins {
 		info.IsCustom = true
@@ -157,6 +200,44 @@ func parsePluginInfo(dirname string) (*PluginMetadata, error) {
 	}
 	metadata.Name = path.Base(dirname)
 	metadata.Path = dirname
+	if metadata.RawInterval != "" {
+		metadata.Interval, err = time.ParseDuration(metadata.RawInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if metadata.RawTimeout != "" {
+		metadata.Timeout, err = time.ParseDuration(metadata.RawTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, probe := range metadata.Probes {
+		if probe.Name == "" || probe.Command == "" {
+			return nil, fmt.Errorf("The probes of plugin %s must have a name and a command", metadata.Name)
+		}
+		probe.Ttl = PROBE_DEFAULT_TTL
+		if probe.RawTtl != "" {
+			probe.Ttl, err = time.ParseDuration(probe.RawTtl)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := validateFormatVersion(&metadata); err != nil {
+		return nil, err
+	}
+	if metadata.MinAgentVersion != "" && !agentVersionRegex.MatchString(metadata.MinAgentVersion) {
+		return nil, fmt.Errorf("Invalid min_agent_version '%s', must be a dotted version, e.g. 1.4.0", metadata.MinAgentVersion)
+	}
+	switch metadata.OutputValidation {
+	case "", OUTPUT_VALIDATION_LENIENT, OUTPUT_VALIDATION_STRICT:
+	default:
+		return nil, fmt.Errorf("Unknown output validation '%s', must be lenient or strict", metadata.OutputValidation)
+	}
+	if err := metadata.Limits.Validate(); err != nil {
+		return nil, err
+	}
 
 	return &metadata, nil
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	. "utils"
+)
+
+var agentVersionRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// set by build.sh with -ldflags "-X main.agentVersion=<version>", the
+// min_agent_version of the plugins isn't checked by dev builds
+var agentVersion = "dev"
+
+// the capabilities a plugin can require in its info.yml, with the host
+// capabilities
+const (
+	CAPABILITY_JSON_OUTPUT   = "json-output"   // format_version 2
+	CAPABILITY_NDJSON_OUTPUT = "ndjson-output" // format_version 3
+	CAPABILITY_LIMITS        = "limits"        // the limits of info.yml are enforced
+	CAPABILITY_RUN_AS        = "run-as"        // the run_as of info.yml is honored
+	CAPABILITY_SECRETS       = "secrets"       // {{secret "name"}} in the arguments
+	CAPABILITY_PROBES        = "probes"        // the shared probes of the agent config
+	CAPABILITY_REMOTE        = "remote"        // instances run on a remote host over ssh
+	CAPABILITY_EVENTS        = "events"        // the events of the json outputs
+)
+
+var AGENT_CAPABILITIES = []string{
+	CAPABILITY_JSON_OUTPUT,
+	CAPABILITY_NDJSON_OUTPUT,
+	CAPABILITY_LIMITS,
+	CAPABILITY_RUN_AS,
+	CAPABILITY_SECRETS,
+	CAPABILITY_PROBES,
+	CAPABILITY_REMOTE,
+	CAPABILITY_EVENTS,
+}
+
+func hasCapability(capability string) bool {
+	for _, c := range AGENT_CAPABILITIES {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// returns why this agent can't run the plugin, nil if it can
+func checkPluginCompatibility(plugin *PluginMetadata) error {
+	if plugin.MinAgentVersion != "" && agentVersion != "dev" && compareVersions(agentVersion, plugin.MinAgentVersion) < 0 {
+		return fmt.Errorf("The plugin requires agent %s or newer, this agent is %s", plugin.MinAgentVersion, agentVersion)
+	}
+	missing := make([]string, 0)
+	for _, capability := range plugin.Capabilities {
+		if isHostCapability(capability) {
+			if err := hostCapabilities[capability]; err != nil {
+				return fmt.Errorf("The plugin requires %s, which this host doesn't have: %s", capability, err)
+			}
+			continue
+		}
+		if !hasCapability(capability) {
+			missing = append(missing, capability)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The plugin requires %s, which this agent (%s) doesn't support", strings.Join(missing, ", "), agentVersion)
+	}
+	return nil
+}
+
+// returns the plugins this agent can't run and why, reported to the config
+// service with the agent status
+func incompatiblePlugins(plugins map[string]*PluginMetadata) map[string]string {
+	incompatible := make(map[string]string)
+	for name, plugin := range plugins {
+		if err := checkPluginCompatibility(plugin); err != nil {
+			incompatible[name] = err.Error()
+		}
+	}
+	return incompatible
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// the severities of the plugin events, info when the plugin doesn't say
+const (
+	EVENT_SEVERITY_INFO     = "info"
+	EVENT_SEVERITY_WARNING  = "warning"
+	EVENT_SEVERITY_CRITICAL = "critical"
+)
+
+// A discrete event printed by a plugin with the json outputs, e.g. a deploy,
+// a finished backup or a degraded raid array. It's forwarded as an
+// annotation, plugins.<name>.events with the title, body and severity in the
+// context, rather than as a metric.
+type PluginEvent struct {
+	Title      string              `json:"title"`
+	Body       string              `json:"body,omitempty"`
+	Severity   string              `json:"severity,omitempty"`
+	Time       int64               `json:"t,omitempty"`
+	Dimensions errplane.Dimensions `json:"d,omitempty"`
+}
+
+// the context of the annotation
+type eventAnnotation struct {
+	Title    string `json:"title"`
+	Body     string `json:"body,omitempty"`
+	Severity string `json:"severity"`
+}
+
+// checks the events of an output and sets the default severity
+func checkPluginEvents(events []*PluginEvent) error {
+	for idx, event := range events {
+		if event == nil || event.Title == "" {
+			return fmt.Errorf("Missing title of event %d", idx+1)
+		}
+		switch event.Severity {
+		case "":
+			event.Severity = EVENT_SEVERITY_INFO
+		case EVENT_SEVERITY_INFO, EVENT_SEVERITY_WARNING, EVENT_SEVERITY_CRITICAL:
+		default:
+			return fmt.Errorf("Unknown severity '%s' of event %d, must be %s, %s or %s", event.Severity, idx+1,
+				EVENT_SEVERITY_INFO, EVENT_SEVERITY_WARNING, EVENT_SEVERITY_CRITICAL)
+		}
+	}
+	return nil
+}
+
+// returns the plugins.<name>.events write of the events, the dimensions of
+// the plugin instance and the severity are added to the event dimensions
+func pluginEventsWrite(plugin *PluginMetadata, id string, instance *Instance, events []*PluginEvent, now time.Time) *errplane.JsonPoints {
+	write := &errplane.JsonPoints{Name: fmt.Sprintf("plugins.%s.events", plugin.Name)}
+	for _, event := range events {
+		context, _ := json.Marshal(&eventAnnotation{event.Title, event.Body, event.Severity})
+		timestamp := event.Time
+		if timestamp == 0 {
+			timestamp = now.Unix()
+		}
+		write.Points = append(write.Points, &errplane.JsonPoint{Value: 1.0, Time: timestamp, Context: string(context), Dimensions: event.Dimensions})
+	}
+	enforceReservedDimensions(plugin.Name, []*errplane.JsonPoints{write})
+	for idx, point := range write.Points {
+		addInstanceDimensions(point.Dimensions, id, instance)
+		point.Dimensions["severity"] = events[idx].Severity
+	}
+	return write
+}
@@ -0,0 +1,194 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+// the period of the cgroup cpu quota, in microseconds
+const CGROUP_CPU_PERIOD = 100000
+
+// The cgroup of the limited plugins, set up by the first limited run. The
+// plugins are limited with rlimits instead if it can't be set up, e.g.
+// without cgroup v2 or when the agent doesn't run as root.
+var pluginCgroups = struct {
+	sync.Mutex
+	setUp bool
+	err   error
+}{}
+
+func writeCgroupFile(dir, name, value string) error {
+	return ioutil.WriteFile(path.Join(dir, name), []byte(value), 0644)
+}
+
+func setUpPluginCgroup() error {
+	pluginCgroups.Lock()
+	defer pluginCgroups.Unlock()
+	if pluginCgroups.setUp {
+		return pluginCgroups.err
+	}
+	pluginCgroups.setUp = true
+	pluginCgroups.err = func() error {
+		root := AgentConfig().PluginCgroup
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+			return fmt.Errorf("cgroup v2 isn't mounted on /sys/fs/cgroup")
+		}
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+		// the controllers must be enabled by the parent before the cgroup can
+		// enable them for the runs
+		writeCgroupFile(path.Dir(root), "cgroup.subtree_control", "+cpu +memory")
+		return writeCgroupFile(root, "cgroup.subtree_control", "+cpu +memory")
+	}()
+	if pluginCgroups.err != nil {
+		log.Warn("Cannot use the cgroup %s for the plugin limits, using rlimits instead. Error: %s", AgentConfig().PluginCgroup, pluginCgroups.err)
+	}
+	return pluginCgroups.err
+}
+
+// The confinement of a plugin run, either a cgroup of its own or the
+// rlimits set by prlimit before it execs the plugin
+type PluginConfinement struct {
+	limits PluginLimits
+	cgroup string   // the directory of the cgroup of the run, empty with rlimits
+	fd     *os.File // the cgroup the plugin is started in
+}
+
+// confines the plugin command to the limits, returns the command to run,
+// e.g. wrapped with prlimit, and nil if the plugin isn't limited
+func confinePlugin(plugin *PluginMetadata, timeout time.Duration, name string, args []string) (*PluginConfinement, string, []string, error) {
+	limits := pluginLimits(plugin)
+	if limits.Cpu == 0 && limits.Memory == 0 {
+		return nil, name, args, nil
+	}
+	if setUpPluginCgroup() == nil {
+		confinement, err := newPluginCgroup(plugin, limits)
+		if err == nil {
+			return confinement, name, args, nil
+		}
+		log.Warn("Cannot create a cgroup for plugin %s, using rlimits instead. Error: %s", plugin.Name, err)
+	}
+	name, args, err := rlimitCommand(limits, timeout, name, args)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return &PluginConfinement{limits: limits}, name, args, nil
+}
+
+func newPluginCgroup(plugin *PluginMetadata, limits PluginLimits) (*PluginConfinement, error) {
+	dir := path.Join(AgentConfig().PluginCgroup, plugin.Name+"-"+randomHex(4))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	confinement := &PluginConfinement{limits: limits, cgroup: dir}
+	err := func() error {
+		if limits.Memory > 0 {
+			if err := writeCgroupFile(dir, "memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+				return err
+			}
+			// killed instead of swapping, not every kernel accounts swap
+			writeCgroupFile(dir, "memory.swap.max", "0")
+		}
+		if limits.Cpu > 0 {
+			quota := int(math.Max(1000, limits.Cpu*CGROUP_CPU_PERIOD))
+			if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, CGROUP_CPU_PERIOD)); err != nil {
+				return err
+			}
+		}
+		var err error
+		confinement.fd, err = os.Open(dir)
+		return err
+	}()
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return confinement, nil
+}
+
+// wraps the command with prlimit. The cpu limit becomes the cpu time the
+// plugin can use at that rate until its timeout, the memory limit the size
+// of its address space.
+func rlimitCommand(limits PluginLimits, timeout time.Duration, name string, args []string) (string, []string, error) {
+	prlimit, err := exec.LookPath("prlimit")
+	if err != nil {
+		return "", nil, ExecError(fmt.Errorf("Cannot limit the plugin without cgroup v2 or prlimit (util-linux)"))
+	}
+	limitArgs := make([]string, 0, len(args)+4)
+	if limits.Memory > 0 {
+		limitArgs = append(limitArgs, fmt.Sprintf("--as=%d", limits.Memory))
+	}
+	if limits.Cpu > 0 {
+		// SIGXCPU at the soft limit, the kernel sends SIGKILL instead when
+		// the soft and hard limits are the same
+		seconds := int64(math.Ceil(limits.Cpu * timeout.Seconds()))
+		limitArgs = append(limitArgs, fmt.Sprintf("--cpu=%d:%d", seconds, seconds+1))
+	}
+	limitArgs = append(limitArgs, "--", name)
+	return prlimit, append(limitArgs, args...), nil
+}
+
+// starts the plugin in its cgroup
+func (self *PluginConfinement) Apply(attributes *syscall.SysProcAttr) {
+	if self == nil || self.fd == nil {
+		return
+	}
+	attributes.UseCgroupFD = true
+	attributes.CgroupFD = int(self.fd.Fd())
+}
+
+// returns the limit the plugin was killed for, empty if it wasn't
+func (self *PluginConfinement) Exceeded(state *os.ProcessState) string {
+	if self == nil || state == nil {
+		return ""
+	}
+	if self.cgroup != "" {
+		events, err := ioutil.ReadFile(path.Join(self.cgroup, "memory.events"))
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(events), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+				return LIMIT_MEMORY
+			}
+		}
+		return ""
+	}
+	// the address space limit makes the allocations fail instead
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGXCPU {
+		return LIMIT_CPU
+	}
+	return ""
+}
+
+// kills what's left of the plugin and removes its cgroup
+func (self *PluginConfinement) Release() {
+	if self == nil || self.cgroup == "" {
+		return
+	}
+	self.fd.Close()
+	writeCgroupFile(self.cgroup, "cgroup.kill", "1")
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(self.cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Warn("Cannot remove the cgroup %s of a plugin run", self.cgroup)
+}
@@ -0,0 +1,58 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+// The rlimits of a plugin run, set by the shell before it execs the plugin.
+// There are no cgroups on freebsd and macos.
+type PluginConfinement struct {
+	limits PluginLimits
+}
+
+func confinePlugin(plugin *PluginMetadata, timeout time.Duration, name string, args []string) (*PluginConfinement, string, []string, error) {
+	limits := pluginLimits(plugin)
+	if limits.Cpu == 0 && limits.Memory == 0 {
+		return nil, name, args, nil
+	}
+	name, args = rlimitCommand(limits, timeout, name, args)
+	return &PluginConfinement{limits: limits}, name, args, nil
+}
+
+// wraps the command with the ulimit of the shell. The cpu limit becomes the
+// cpu time the plugin can use at that rate until its timeout, only the soft
+// limit is set so the plugin gets SIGXCPU, the memory limit the size of its
+// address space in kilobytes.
+func rlimitCommand(limits PluginLimits, timeout time.Duration, name string, args []string) (string, []string) {
+	script := ""
+	if limits.Memory > 0 {
+		script += fmt.Sprintf("ulimit -v %d && ", limits.Memory/1024)
+	}
+	if limits.Cpu > 0 {
+		script += fmt.Sprintf("ulimit -S -t %d && ", int64(math.Ceil(limits.Cpu*timeout.Seconds())))
+	}
+	return "/bin/sh", append([]string{"-c", script + `exec "$0" "$@"`, name}, args...)
+}
+
+func (self *PluginConfinement) Apply(attributes *syscall.SysProcAttr) {}
+
+// returns the limit the plugin was killed for, empty if it wasn't
+func (self *PluginConfinement) Exceeded(state *os.ProcessState) string {
+	if self == nil || state == nil {
+		return ""
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGXCPU {
+		return LIMIT_CPU
+	}
+	return ""
+}
+
+func (self *PluginConfinement) Release() {}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+// the plugins can't be limited on windows yet
+type PluginConfinement struct{}
+
+func confinePlugin(plugin *PluginMetadata, timeout time.Duration, name string, args []string) (*PluginConfinement, string, []string, error) {
+	limits := pluginLimits(plugin)
+	if limits.Cpu == 0 && limits.Memory == 0 {
+		return nil, name, args, nil
+	}
+	return nil, "", nil, ConfigError(fmt.Errorf("Cannot limit plugin %s, the plugin limits aren't supported on windows", plugin.Name))
+}
+
+func (self *PluginConfinement) Apply(attributes *syscall.SysProcAttr) {}
+
+func (self *PluginConfinement) Exceeded(state *os.ProcessState) string {
+	return ""
+}
+
+func (self *PluginConfinement) Release() {}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// what a plugin was killed for going beyond
+const (
+	LIMIT_MEMORY = "memory"
+	LIMIT_CPU    = "cpu"
+)
+
+// returns the limits of the plugin, the ones of its info.yml override the
+// plugin-limits of the agent config
+func pluginLimits(plugin *PluginMetadata) PluginLimits {
+	limits := AgentConfig().PluginLimits
+	if plugin.Limits.Cpu > 0 {
+		limits.Cpu = plugin.Limits.Cpu
+	}
+	if plugin.Limits.Memory > 0 {
+		limits.Memory = plugin.Limits.Memory
+	}
+	return limits
+}
+
+// reports the plugin killed for going beyond its limit, a memory kill as
+// plugins.<name>.oom_killed, and its status as unknown
+func reportPluginLimitKill(ep *errplane.Errplane, plugin *PluginMetadata, instance *Instance, id, label string, limits PluginLimits, limit, traceId string) {
+	var msg string
+	if limit == LIMIT_MEMORY {
+		msg = fmt.Sprintf("Killed after going beyond its memory limit of %d bytes", limits.Memory)
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		addInstanceDimensions(dimensions, id, instance)
+		report(ep, fmt.Sprintf("plugins.%s.oom_killed", plugin.Name), 1.0, time.Now(), dimensions, nil)
+	} else {
+		msg = fmt.Sprintf("Killed after using its cpu limit of %g cpus until its timeout", limits.Cpu)
+	}
+	log.Warn("[trace %s] Plugin %s instance '%s': %s", traceId, plugin.Name, label, ExecError(fmt.Errorf("%s", msg)))
+	agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+	checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", msg)
+	reportUnknownStatus(ep, plugin, instance, msg, traceId)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	. "utils"
+)
+
+const (
+	MAX_DETAIL_SIZE = 4096
+)
+
+// csi sequences (colors, cursor movements) and osc sequences (window titles, hyperlinks)
+var ansiEscapeRegex = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+
+// Cleans up the human output of a plugin, decodes invalid utf-8 as
+// latin-1 (which is what most legacy plugins emit), strips the ansi escape
+// sequences and control characters and normalizes the line endings
+func sanitizePluginOutput(output []byte) string {
+	var str string
+	if utf8.Valid(output) {
+		str = string(output)
+	} else {
+		runes := make([]rune, 0, len(output))
+		for len(output) > 0 {
+			r, size := utf8.DecodeRune(output)
+			if r == utf8.RuneError && size == 1 {
+				r = rune(output[0])
+			}
+			runes = append(runes, r)
+			output = output[size:]
+		}
+		str = string(runes)
+	}
+
+	str = ansiEscapeRegex.ReplaceAllString(str, "")
+	str = strings.Replace(str, "\r\n", "\n", -1)
+	str = strings.Replace(str, "\r", "\n", -1)
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, strings.TrimPrefix(str, "\ufeff"))
+}
+
+// returns the first line of the output, which is the summary the plugin
+// status is parsed from, and the remaining lines which are reported as the
+// detail of the status
+func splitPluginOutput(output string) (string, string) {
+	lines := strings.SplitN(output, "\n", 2)
+	if len(lines) == 1 {
+		return lines[0], ""
+	}
+	return lines[0], truncateUtf8(strings.TrimSpace(lines[1]), MAX_DETAIL_SIZE)
+}
+
+// returns the detail reported with the status of the plugin, the lines
+// following the first one that aren't metrics
+func pluginDetail(plugin *PluginMetadata, output string) string {
+	lines := strings.Split(output, "\n")
+	if len(lines) < 2 {
+		return ""
+	}
+
+	var detail string
+	switch plugin.Output {
+	case "influxdb", "prometheus":
+		// all the lines are points, there's no detail
+		return ""
+	case "nagios":
+		detail, _ = splitNagiosLongOutput(lines[1:])
+	case "errplane":
+		if pluginFormatVersion(plugin) != FORMAT_VERSION_PIPE {
+			// the json outputs have no detail
+			return ""
+		}
+		detail, _ = splitErrplaneLongOutput(lines[1:])
+	default:
+		detail = strings.Join(lines[1:], "\n")
+	}
+	return truncateUtf8(strings.TrimSpace(detail), MAX_DETAIL_SIZE)
+}
+
+// splits the lines following the first one of a nagios output into the long
+// output and the perfdata. A | on one of the lines starts the perfdata which
+// continues until the end of the output, one or more metrics per line, e.g.
+//
+//	DISK OK | /=2643MB
+//	/ 15272 MB (77%);
+//	/boot 68 MB (69%); | /boot=68MB
+//	/home=69357MB
+func splitNagiosLongOutput(lines []string) (string, string) {
+	longOutput := make([]string, 0, len(lines))
+	perfdata := make([]string, 0)
+	for idx, line := range lines {
+		if i := strings.Index(line, "|"); i >= 0 {
+			longOutput = append(longOutput, line[:i])
+			perfdata = append(append(perfdata, line[i+1:]), lines[idx+1:]...)
+			break
+		}
+		longOutput = append(longOutput, line)
+	}
+	return strings.TrimSpace(strings.Join(longOutput, "\n")), strings.TrimSpace(strings.Join(perfdata, " "))
+}
+
+// splits the lines following the first one of an errplane output into the
+// human readable detail and the lines of points, which start with [ or {
+func splitErrplaneLongOutput(lines []string) (string, []string) {
+	detail := make([]string, 0, len(lines))
+	points := make([]string, 0)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+			points = append(points, trimmed)
+			continue
+		}
+		detail = append(detail, line)
+	}
+	return strings.TrimSpace(strings.Join(detail, "\n")), points
+}
+
+// truncates the string to at most size bytes without splitting a character
+func truncateUtf8(str string, size int) string {
+	if len(str) <= size {
+		return str
+	}
+	for size > 0 && !utf8.RuneStart(str[size]) {
+		size--
+	}
+	return str[:size]
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"sync"
+	. "utils"
+)
+
+// Bounds the number of plugins running at the same time. Every plugin
+// instance runs at most once at a time, a run that's due while the
+// previous one is still in flight is either skipped or queued (at most one
+// queued run per instance).
+type PluginPool struct {
+	lock     sync.Mutex
+	slots    chan bool
+	overlap  string
+	inFlight map[string]bool
+	queued   map[string]func()
+}
+
+func NewPluginPool(maxConcurrency int, overlap string) *PluginPool {
+	return &PluginPool{
+		slots:    make(chan bool, maxConcurrency),
+		overlap:  overlap,
+		inFlight: make(map[string]bool),
+		queued:   make(map[string]func()),
+	}
+}
+
+func newConfiguredPluginPool() *PluginPool {
+	return NewPluginPool(AgentConfig().PluginConcurrency.MaxConcurrency, AgentConfig().PluginConcurrency.Overlap)
+}
+
+// runs the function once a slot is available, returns false if the run was
+// skipped because the previous run with the same key is still in flight
+func (self *PluginPool) Submit(key string, run func()) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.inFlight[key] {
+		if self.overlap != PLUGIN_OVERLAP_QUEUE {
+			log.Warn("Skipping %s, the previous run is still in progress", key)
+			return false
+		}
+		self.queued[key] = run
+		return true
+	}
+
+	self.inFlight[key] = true
+	go self.work(key, run)
+	return true
+}
+
+func (self *PluginPool) work(key string, run func()) {
+	for run != nil {
+		self.slots <- true
+		run()
+		<-self.slots
+
+		self.lock.Lock()
+		run = self.queued[key]
+		delete(self.queued, key)
+		if run == nil {
+			delete(self.inFlight, key)
+		}
+		self.lock.Unlock()
+	}
+}
+
+// returns the number of instances that are running or waiting for a slot
+func (self *PluginPool) InFlight() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.inFlight)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// the status scripts a windows plugin can have, in the order they're
+// looked up
+var WINDOWS_STATUS_SCRIPTS = []string{"status.exe", "status.ps1", "status.bat", "status.cmd"}
+
+// returns the status script of the plugin, status on unix and the first of
+// the windows status scripts that exists on windows
+func pluginStatusScript(dir string, goos string) string {
+	if goos != "windows" {
+		return path.Join(dir, "status")
+	}
+	for _, name := range WINDOWS_STATUS_SCRIPTS {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, WINDOWS_STATUS_SCRIPTS[0])
+}
+
+// returns the command running the script, powershell and batch scripts
+// aren't executables on windows and are run by their interpreter
+func scriptCommand(script string, args []string) (string, []string) {
+	switch strings.ToLower(filepath.Ext(script)) {
+	case ".ps1":
+		return "powershell.exe", append([]string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", script}, args...)
+	case ".bat", ".cmd":
+		return "cmd.exe", append([]string{"/C", script}, args...)
+	}
+	return script, args
+}
+
+func statusScript(dir string) string {
+	return pluginStatusScript(dir, runtime.GOOS)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// finds the plugin with the given name in the custom and the installed
+// plugins, the name can also be the directory of a plugin that isn't
+// installed yet
+func findPlugin(name string) (*PluginMetadata, error) {
+	if _, err := os.Stat(path.Join(name, "info.yml")); err == nil {
+		return parsePluginInfo(name)
+	}
+
+	dirs := []string{path.Join(AgentConfig().CustomPluginsDir, name)}
+	if version, err := GetInstalledPluginsVersion(); err == nil {
+		dirs = append(dirs, path.Join(AgentConfig().PluginsDir, strings.TrimSpace(version), name))
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(path.Join(dir, "info.yml")); err == nil {
+			return parsePluginInfo(dir)
+		}
+	}
+	return nil, fmt.Errorf("Cannot find plugin '%s' in %s", name, strings.Join(dirs, ", "))
+}
+
+// the command line arguments of the test command, --name value pairs are
+// the instance arguments and anything else is passed as is
+func testInstance(args []string) *Instance {
+	instance := &Instance{Args: make(map[string]string), ArgsList: make([]string, 0), Env: make(map[string]string)}
+	for idx := 0; idx < len(args); idx++ {
+		if strings.HasPrefix(args[idx], "--") && idx+1 < len(args) {
+			instance.Args[strings.TrimPrefix(args[idx], "--")] = args[idx+1]
+			idx++
+			continue
+		}
+		instance.ArgsList = append(instance.ArgsList, args[idx])
+	}
+	return instance
+}
+
+// returns the points the agent would report for the output of the plugin
+func pluginOutputWrites(plugin *PluginMetadata, id string, instance *Instance, output *PluginOutput) []*errplane.JsonPoints {
+	timestamp := output.timestamp.Unix()
+	dimensions := errplane.Dimensions{
+		"host":       AgentConfig().Hostname,
+		"status":     output.state.String(),
+		"status_msg": output.msg,
+	}
+	addExitCodeDimension(dimensions, output)
+	addInstanceDimensions(dimensions, id, instance)
+	writes := []*errplane.JsonPoints{&errplane.JsonPoints{
+		Name:   fmt.Sprintf("plugins.%s.status", plugin.Name),
+		Points: []*errplane.JsonPoint{&errplane.JsonPoint{Value: 1, Time: timestamp, Dimensions: dimensions}},
+	}}
+
+	for _, write := range output.points {
+		points := make([]*errplane.JsonPoint, 0, len(write.Points))
+		for _, point := range write.Points {
+			dimensions := errplane.Dimensions{}
+			for key, value := range point.Dimensions {
+				dimensions[key] = value
+			}
+			addInstanceDimensions(dimensions, id, instance)
+			points = append(points, &errplane.JsonPoint{Value: point.Value, Time: point.Time, Dimensions: dimensions})
+		}
+		writes = append(writes, &errplane.JsonPoints{Name: fmt.Sprintf("plugins.%s.%s", plugin.Name, write.Name), Points: points})
+	}
+
+	names := make([]string, 0, len(output.metrics))
+	for name, _ := range output.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		addInstanceDimensions(dimensions, id, instance)
+		writes = append(writes, &errplane.JsonPoints{
+			Name:   fmt.Sprintf("plugins.%s.%s", plugin.Name, name),
+			Points: []*errplane.JsonPoint{&errplane.JsonPoint{Value: output.metrics[name], Time: timestamp, Dimensions: dimensions}},
+		})
+	}
+	return writes
+}
+
+func formatDimensions(dimensions errplane.Dimensions) string {
+	keys := make([]string, 0, len(dimensions))
+	for key, _ := range dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, dimensions[key]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// runs the plugin once in the foreground and prints its raw output, the
+// parsed output and the points the agent would report. Nothing is sent to
+// errplane. Returns 0 if the plugin ran and its output could be parsed.
+func testPlugin(out io.Writer, name string, args []string) int {
+	plugin, err := findPlugin(name)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+		return 1
+	}
+
+	// the declared environment variables come from the environment of the command
+	instance := testInstance(args)
+	secretArgs := secretArgNames(instance)
+	for _, variable := range plugin.Environment {
+		if value := os.Getenv(variable.Name); value != "" {
+			instance.Env[variable.Name] = value
+		}
+	}
+	instance, err = renderInstanceArgs(instance)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot render the arguments. Error: %s\n", err)
+		return 1
+	}
+	instanceArgs, err := validatePluginArgs(plugin, instance)
+	if err != nil {
+		fmt.Fprintf(out, "Invalid arguments. Error: %s\n", err)
+		return 1
+	}
+	cmdArgs, secretsEnv := pluginCommandArgs(instance, instanceArgs, secretArgs)
+
+	cmdPath := path.Join(plugin.Path, "status")
+	timeout := pluginTimeout(plugin, instance)
+	fmt.Fprintf(out, "Plugin:    %s (%s, output %s, timeout %s)\n", plugin.Name, plugin.Path, plugin.Output, timeout)
+	fmt.Fprintf(out, "Command:   %s %s\n", cmdPath, loggableArgs(plugin, cmdArgs))
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd := exec.Command(cmdPath, cmdArgs...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	instanceEnv, err := validatePluginEnv(plugin, instance)
+	if err != nil {
+		fmt.Fprintf(out, "Invalid environment. Error: %s\n", err)
+		return 1
+	}
+	env := append(formatVersionEnv(plugin), instanceEnv...)
+	env = append(env, secretsEnv...)
+	if len(plugin.Probes) > 0 {
+		probesEnv, err := pluginProbesEnv(path.Join(os.TempDir(), "errplane-agent-probes"), plugin)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot run the probes. Error: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(out, "Probes:    %s\n", strings.Join(probesEnv, " "))
+		env = append(env, probesEnv...)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(out, "Cannot run the plugin. Error: %s\n", err)
+		return 1
+	}
+	ch := make(chan error, 1)
+	killed := make(chan bool, 1)
+	go func() { killed <- killPlugin(cmdPath, cmd, ch, timeout) }()
+	ch <- cmd.Wait()
+	timedOut := <-killed
+
+	state := &ProcessStateWrapper{cmd.ProcessState}
+	fmt.Fprintf(out, "Exit:      %d after %s\n", state.ExitStatus(), time.Now().Sub(start))
+	if timedOut {
+		fmt.Fprintf(out, "Timed out: killed after %s\n", timeout)
+	}
+	fmt.Fprintf(out, "\n--- stdout\n%s\n--- stderr\n%s\n", revealedSecrets.Redact(stdout.String()), revealedSecrets.Redact(stderr.String()))
+
+	sanitizedOutput := sanitizePluginOutput(stdout.Bytes())
+	output, err := parseValidatedPluginOutput(plugin, state, sanitizedOutput)
+	if err != nil {
+		fmt.Fprintf(out, "--- parsed output\nCannot parse the output. Error: %s\n", err)
+		return 1
+	}
+	if plugin.StatusMessage != "" {
+		output.msg = interpolateMessage(plugin.StatusMessage, pluginMessageValues(output, instance))
+	}
+
+	fmt.Fprintf(out, "--- parsed output\nstate:   %s\nmessage: %s\n", output.state.String(), output.msg)
+	if detail := pluginDetail(plugin, sanitizedOutput); detail != "" {
+		fmt.Fprintf(out, "detail:  %s\n", detail)
+	}
+
+	fmt.Fprintf(out, "\n--- would report (not sent)\n")
+	for _, write := range pluginOutputWrites(plugin, instanceId(plugin.Name, instance), instance, output) {
+		for _, point := range write.Points {
+			fmt.Fprintf(out, "%s %v %s\n", write.Name, point.Value, formatDimensions(point.Dimensions))
+		}
+	}
+	return 0
+}
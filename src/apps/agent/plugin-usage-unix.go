@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func timevalSeconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
+
+// returns the usage of the exited plugin, nil if the platform doesn't
+// report it
+func pluginUsage(state *os.ProcessState) *PluginUsage {
+	if state == nil {
+		return nil
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return nil
+	}
+	// ru_maxrss is in kilobytes on linux and freebsd, in bytes on macos
+	maxRss := int64(rusage.Maxrss) * 1024
+	if runtime.GOOS == "darwin" {
+		maxRss = int64(rusage.Maxrss)
+	}
+	return &PluginUsage{timevalSeconds(rusage.Utime), timevalSeconds(rusage.Stime), maxRss}
+}
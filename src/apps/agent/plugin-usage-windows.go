@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// a duration in a FILETIME is in 100ns units
+func filetimeSeconds(ft syscall.Filetime) float64 {
+	return float64(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) / 1e7
+}
+
+func pluginUsage(state *os.ProcessState) *PluginUsage {
+	if state == nil {
+		return nil
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return nil
+	}
+	return &PluginUsage{filetimeSeconds(rusage.UserTime), filetimeSeconds(rusage.KernelTime), 0}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// The resources used by a plugin run and the children it waited for, from
+// the rusage wait4 returned when the plugin exited (the process times on
+// windows)
+type PluginUsage struct {
+	UserCpu float64 // in seconds
+	SysCpu  float64 // in seconds
+	MaxRss  int64   // in bytes
+}
+
+// reports the usage as plugins.<name>.self.*, so the cost of the monitoring
+// itself shows up and the heavyweight plugins can be found
+func reportPluginUsage(ep *errplane.Errplane, plugin *PluginMetadata, id string, instance *Instance, usage *PluginUsage) {
+	if usage == nil {
+		return
+	}
+	now := time.Now()
+	values := map[string]float64{"cpu_user": usage.UserCpu, "cpu_sys": usage.SysCpu}
+	// windows doesn't report the memory of the exited process
+	if usage.MaxRss > 0 {
+		values["max_rss"] = float64(usage.MaxRss)
+	}
+	for name, value := range values {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		addInstanceDimensions(dimensions, id, instance)
+		report(ep, fmt.Sprintf("plugins.%s.self.%s", plugin.Name, name), value, now, dimensions, nil)
+	}
+}
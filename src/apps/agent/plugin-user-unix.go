@@ -0,0 +1,85 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The credentials a plugin runs with, and the environment of its user so
+// the plugin doesn't write to the home of the agent user
+type PluginUser struct {
+	Credential *syscall.Credential
+	Env        []string
+}
+
+// looks up a user or user:group, the group defaults to the primary group of
+// the user and the supplementary groups are kept. Returns nil if the agent
+// already runs as that user.
+func lookupPluginUser(runAs string) (*PluginUser, error) {
+	if runAs == "" {
+		return nil, nil
+	}
+	name, groupName := runAs, ""
+	if i := strings.Index(runAs, ":"); i >= 0 {
+		name, groupName = runAs[:i], runAs[i+1:]
+	}
+	account, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find the run_as user '%s'. Error: %s", name, err)
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid uid %s of user '%s'", account.Uid, name)
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gid %s of user '%s'", account.Gid, name)
+	}
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find the run_as group '%s'. Error: %s", groupName, err)
+		}
+		if gid, err = strconv.ParseUint(group.Gid, 10, 32); err != nil {
+			return nil, fmt.Errorf("Invalid gid %s of group '%s'", group.Gid, groupName)
+		}
+	}
+
+	if int(uid) == os.Geteuid() && int(gid) == os.Getegid() {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("The agent must run as root to run plugins as '%s'", runAs)
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIds, err := account.GroupIds(); err == nil {
+		for _, groupId := range groupIds {
+			if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+	env := []string{"USER=" + account.Username, "LOGNAME=" + account.Username, "HOME=" + account.HomeDir}
+	return &PluginUser{credential, env}, nil
+}
+
+// runs the command with the credentials and the environment of the user
+func (self *PluginUser) Apply(cmd *exec.Cmd) {
+	if self == nil {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.SysProcAttr.Credential = self.Credential
+	cmd.Env = append(cmd.Env, self.Env...)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Windows has no setuid, the plugins run as the account of the agent
+// service
+type PluginUser struct{}
+
+func lookupPluginUser(runAs string) (*PluginUser, error) {
+	if runAs == "" {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Plugins can't run as '%s' on windows, run the agent service as that account instead", runAs)
+}
+
+func (self *PluginUser) Apply(cmd *exec.Cmd) {}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	. "utils"
+)
+
+// returns the user (or user:group) the plugin runs as, the run_as of its
+// info.yml overrides the one of the agent config
+func pluginRunAs(plugin *PluginMetadata) string {
+	if plugin.RunAs != "" {
+		return plugin.RunAs
+	}
+	return AgentConfig().PluginRunAs
+}
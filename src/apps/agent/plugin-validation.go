@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// A problem with the output of a plugin and where it is. Path is the
+// location in a json document, e.g. [0].p[1].v, when the problem isn't
+// the syntax.
+type OutputError struct {
+	Line     int
+	Column   int
+	Path     string
+	Expected string
+	Found    string
+}
+
+func (self *OutputError) Error() string {
+	position := fmt.Sprintf("line %d", self.Line)
+	if self.Column > 0 {
+		position += fmt.Sprintf(", column %d", self.Column)
+	}
+	if self.Path != "" {
+		position += ", at " + self.Path
+	}
+	return fmt.Sprintf("%s: expected %s, found %s", position, self.Expected, self.Found)
+}
+
+const PERFDATA_SEPARATORS = " ;=|"
+
+var (
+	// the performance data of the nagios plugin development guidelines,
+	// 'label'=value[UOM];[warn];[crit];[min];[max]
+	perfdataValueRegex = regexp.MustCompile(`^(-?[0-9]*\.?[0-9]+|U)`)
+	perfdataUnitRegex  = regexp.MustCompile(`^(us|ms|s|%|KB|MB|GB|TB|B|c)`)
+	perfdataRangeRegex = regexp.MustCompile(`^@?((~|-?[0-9]*\.?[0-9]+)?:)?(-?[0-9]*\.?[0-9]+)?`)
+	perfdataNumRegex   = regexp.MustCompile(`^(-?[0-9]*\.?[0-9]+)?`)
+)
+
+// the validation of the plugin, set in info.yml or for all the plugins in
+// the agent config
+func pluginOutputValidation(plugin *PluginMetadata) string {
+	if plugin.OutputValidation != "" {
+		return plugin.OutputValidation
+	}
+	return AgentConfig().OutputValidation
+}
+
+// checks the output against the spec of the plugin output type, nil for the
+// types that have no spec the lenient parsers don't already enforce
+func validatePluginOutput(plugin *PluginMetadata, output string) error {
+	switch plugin.Output {
+	case "nagios":
+		return validateNagiosOutput(output)
+	case "errplane":
+		switch pluginFormatVersion(plugin) {
+		case FORMAT_VERSION_JSON:
+			return validateJsonOutput(output)
+		case FORMAT_VERSION_NDJSON:
+			return validateNdjsonOutput(output)
+		}
+		return validatePipeOutput(output)
+	}
+	return nil
+}
+
+// describes what's at idx, the end of the line, a separator or the token
+// up to the next separator
+func foundToken(text string, idx int) string {
+	if idx >= len(text) {
+		return "the end of the line"
+	}
+	end := idx + 1
+	if !strings.ContainsRune(PERFDATA_SEPARATORS, rune(text[idx])) {
+		for end < len(text) && !strings.ContainsRune(PERFDATA_SEPARATORS, rune(text[end])) {
+			end++
+		}
+	}
+	return "'" + text[idx:end] + "'"
+}
+
+func validateNagiosOutput(output string) error {
+	lines := strings.Split(output, "\n")
+	inPerfdata := false
+	for idx, line := range lines {
+		start := 0
+		if !inPerfdata {
+			pipe := strings.Index(line, "|")
+			if pipe < 0 {
+				continue
+			}
+			start, inPerfdata = pipe+1, true
+		}
+		if pipe := strings.Index(line[start:], "|"); pipe >= 0 {
+			return &OutputError{Line: idx + 1, Column: start + pipe + 1, Expected: "a single | before the performance data", Found: "another '|'"}
+		}
+		if err := validatePerfdata(line, start, idx+1); err != nil {
+			return err
+		}
+		// the performance data of the first line doesn't continue on the next one
+		if idx == 0 {
+			inPerfdata = false
+		}
+	}
+	return nil
+}
+
+// validates the space separated 'label'=value[UOM];[warn];[crit];[min];[max]
+// of the line from idx
+func validatePerfdata(text string, idx, line int) error {
+	fail := func(idx int, expected string) error {
+		return &OutputError{Line: line, Column: idx + 1, Expected: expected, Found: foundToken(text, idx)}
+	}
+
+	for {
+		for idx < len(text) && text[idx] == ' ' {
+			idx++
+		}
+		if idx >= len(text) {
+			return nil
+		}
+
+		// the label, quoted if it contains spaces, '' is a quote in a quoted label
+		if text[idx] == '\'' {
+			idx++
+			for {
+				if idx >= len(text) {
+					return fail(idx, "a closing ' after the label")
+				}
+				if text[idx] == '\'' {
+					if idx+1 < len(text) && text[idx+1] == '\'' {
+						idx += 2
+						continue
+					}
+					idx++
+					break
+				}
+				idx++
+			}
+		} else {
+			start := idx
+			for idx < len(text) && text[idx] != '=' && text[idx] != ' ' {
+				idx++
+			}
+			if idx == start {
+				return fail(idx, "a label")
+			}
+		}
+		if idx >= len(text) || text[idx] != '=' {
+			return fail(idx, "'=' after the label")
+		}
+		idx++
+
+		value := perfdataValueRegex.FindString(text[idx:])
+		if value == "" {
+			return fail(idx, "a number")
+		}
+		idx += len(value)
+		idx += len(perfdataUnitRegex.FindString(text[idx:]))
+		if idx < len(text) && text[idx] != ';' && text[idx] != ' ' {
+			return fail(idx, "a unit of measurement (s, ms, us, %, B, KB, MB, GB, TB or c), ';' or a space")
+		}
+
+		// warn and crit are ranges, min and max numbers
+		for field := 0; field < 4 && idx < len(text) && text[idx] == ';'; field++ {
+			idx++
+			regex, expected := perfdataRangeRegex, "a range"
+			if field >= 2 {
+				regex, expected = perfdataNumRegex, "a number"
+			}
+			idx += len(regex.FindString(text[idx:]))
+			if idx < len(text) && text[idx] != ';' && text[idx] != ' ' {
+				return fail(idx, expected+", ';' or a space")
+			}
+		}
+		if idx < len(text) && text[idx] != ' ' {
+			return fail(idx, "a space after max")
+		}
+	}
+}
+
+// the kind of a decoded json value for the errors
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
+
+// decodes the json document that starts at line and column of the output,
+// syntax errors point to the character the decoder stopped at
+func decodeOutputJson(document string, line, column int) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal([]byte(document), &value)
+	if err == nil {
+		return value, nil
+	}
+	syntaxErr, ok := err.(*json.SyntaxError)
+	if !ok {
+		return nil, err
+	}
+
+	// the decoder stopped after the offending character, or at the end
+	offset := int(syntaxErr.Offset) - 1
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(document) || strings.HasPrefix(syntaxErr.Error(), "unexpected end") {
+		offset = len(document)
+	}
+	before := document[:offset]
+	if newlines := strings.Count(before, "\n"); newlines > 0 {
+		line += newlines
+		column = 1
+		before = before[strings.LastIndex(before, "\n")+1:]
+	}
+	expected := "valid json"
+	found := "the end of the output"
+	if offset < len(document) {
+		found = fmt.Sprintf("'%c'", document[offset])
+	}
+	if idx := strings.Index(syntaxErr.Error(), "looking for "); idx >= 0 {
+		expected = syntaxErr.Error()[idx+len("looking for "):]
+	} else if strings.Contains(syntaxErr.Error(), "after top-level value") {
+		expected = "the end of the json"
+	} else if strings.Contains(syntaxErr.Error(), "after object key:value pair") {
+		expected = "',' or '}'"
+	} else if strings.Contains(syntaxErr.Error(), "after object key") {
+		expected = "':' after the object key"
+	} else if strings.Contains(syntaxErr.Error(), "after array element") {
+		expected = "',' or ']'"
+	} else if strings.Contains(syntaxErr.Error(), "unexpected end") {
+		expected = "the rest of the json"
+	}
+	return nil, &OutputError{Line: line, Column: column + len(before), Expected: expected, Found: found}
+}
+
+// checks the fields of a json object, fields maps the known fields to
+// whether they're required
+func checkJsonObject(value interface{}, line int, path string, fields map[string]bool) (map[string]interface{}, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, &OutputError{Line: line, Path: pathOrRoot(path), Expected: "an object", Found: jsonKind(value)}
+	}
+	for _, name := range sortedJsonKeys(object) {
+		if _, known := fields[name]; !known {
+			return nil, &OutputError{Line: line, Path: path + "." + name, Expected: "one of the fields " + strings.Join(sortedFieldNames(fields), ", "), Found: "an unknown field"}
+		}
+	}
+	for _, name := range sortedFieldNames(fields) {
+		if _, found := object[name]; fields[name] && !found {
+			return nil, &OutputError{Line: line, Path: path + "." + name, Expected: "the required field " + name, Found: "no such field"}
+		}
+	}
+	return object, nil
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+	return path
+}
+
+func sortedJsonKeys(object map[string]interface{}) []string {
+	names := make([]string, 0, len(object))
+	for name, _ := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedFieldNames(fields map[string]bool) []string {
+	names := make([]string, 0, len(fields))
+	for name, _ := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkJsonKind(value interface{}, line int, path, kind string) error {
+	if jsonKind(value) != kind {
+		return &OutputError{Line: line, Path: path, Expected: kind, Found: jsonKind(value)}
+	}
+	return nil
+}
+
+// checks t is a timestamp in seconds, a timestamp in milliseconds is the
+// usual mistake
+func checkJsonTimestamp(value interface{}, line int, path string) error {
+	if err := checkJsonKind(value, line, path, "a number"); err != nil {
+		return err
+	}
+	timestamp := value.(float64)
+	if timestamp != math.Trunc(timestamp) || timestamp < 0 {
+		return &OutputError{Line: line, Path: path, Expected: "a positive integer", Found: fmt.Sprint(timestamp)}
+	}
+	if timestamp > float64(time.Now().Add(24*time.Hour).Unix()) {
+		return &OutputError{Line: line, Path: path, Expected: "seconds since the epoch", Found: fmt.Sprintf("%.0f, milliseconds?", timestamp)}
+	}
+	return nil
+}
+
+func checkJsonDimensions(value interface{}, line int, path string) error {
+	dimensions, ok := value.(map[string]interface{})
+	if !ok {
+		return &OutputError{Line: line, Path: path, Expected: "an object", Found: jsonKind(value)}
+	}
+	for _, name := range sortedJsonKeys(dimensions) {
+		if err := checkJsonKind(dimensions[name], line, path+"."+name, "a string"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checks a list of writes, [{"n": "name", "p": [{"v": 1, "t": 1400000000, "c": "context", "d": {}}]}]
+func checkJsonWrites(value interface{}, line int, path string) error {
+	writes, ok := value.([]interface{})
+	if !ok {
+		return &OutputError{Line: line, Path: pathOrRoot(path), Expected: "an array of writes", Found: jsonKind(value)}
+	}
+	for idx, value := range writes {
+		if err := checkJsonWrite(value, line, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checks a single write, {"n": "name", "p": [...]}
+func checkJsonWrite(value interface{}, line int, path string) error {
+	write, err := checkJsonObject(value, line, path, map[string]bool{"n": true, "p": true})
+	if err != nil {
+		return err
+	}
+	if name, ok := write["n"].(string); !ok || name == "" {
+		return &OutputError{Line: line, Path: path + ".n", Expected: "a metric name", Found: jsonKind(write["n"])}
+	}
+	points, ok := write["p"].([]interface{})
+	if !ok {
+		return &OutputError{Line: line, Path: path + ".p", Expected: "an array of points", Found: jsonKind(write["p"])}
+	}
+	for idx, value := range points {
+		pointPath := fmt.Sprintf("%s.p[%d]", path, idx)
+		point, err := checkJsonObject(value, line, pointPath, map[string]bool{"v": true, "t": false, "c": false, "d": false})
+		if err != nil {
+			return err
+		}
+		if err := checkJsonPoint(point, line, pointPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a line of points is either an array of writes or a single write
+func checkJsonLine(value interface{}, line int) error {
+	if _, ok := value.(map[string]interface{}); ok {
+		return checkJsonWrite(value, line, "")
+	}
+	return checkJsonWrites(value, line, "")
+}
+
+func checkJsonPoint(point map[string]interface{}, line int, path string) error {
+	if err := checkJsonKind(point["v"], line, path+".v", "a number"); err != nil {
+		return err
+	}
+	if value, ok := point["t"]; ok {
+		if err := checkJsonTimestamp(value, line, path+".t"); err != nil {
+			return err
+		}
+	}
+	if value, ok := point["c"]; ok {
+		if err := checkJsonKind(value, line, path+".c", "a string"); err != nil {
+			return err
+		}
+	}
+	if value, ok := point["d"]; ok {
+		return checkJsonDimensions(value, line, path+".d")
+	}
+	return nil
+}
+
+// checks an event, {"title": "Backup finished", "body": "...", "severity": "info", "t": 1400000000, "d": {}}
+func checkJsonEvent(value interface{}, line int, path string) error {
+	event, err := checkJsonObject(value, line, path, map[string]bool{"title": true, "body": false, "severity": false, "t": false, "d": false})
+	if err != nil {
+		return err
+	}
+	if title, ok := event["title"].(string); !ok || title == "" {
+		return &OutputError{Line: line, Path: path + ".title", Expected: "a title", Found: jsonKind(event["title"])}
+	}
+	if value, ok := event["body"]; ok {
+		if err := checkJsonKind(value, line, path+".body", "a string"); err != nil {
+			return err
+		}
+	}
+	if value, ok := event["severity"]; ok {
+		switch value {
+		case EVENT_SEVERITY_INFO, EVENT_SEVERITY_WARNING, EVENT_SEVERITY_CRITICAL:
+		default:
+			return &OutputError{Line: line, Path: path + ".severity", Expected: "info, warning or critical", Found: fmt.Sprint(value)}
+		}
+	}
+	if value, ok := event["t"]; ok {
+		if err := checkJsonTimestamp(value, line, path+".t"); err != nil {
+			return err
+		}
+	}
+	if value, ok := event["d"]; ok {
+		return checkJsonDimensions(value, line, path+".d")
+	}
+	return nil
+}
+
+func checkFormatVersion(header map[string]interface{}, line int, expected int) error {
+	if version, ok := header["format_version"].(float64); !ok || int(version) != expected {
+		return &OutputError{Line: line, Path: ".format_version", Expected: fmt.Sprintf("%d as declared in info.yml", expected), Found: fmt.Sprint(header["format_version"])}
+	}
+	if status, ok := header["status"]; ok {
+		return checkJsonKind(status, line, ".status", "a string")
+	}
+	return nil
+}
+
+// OK | [{"n": "connections", "p": [{"v": 12}]}] followed by the detail and
+// lines of writes
+func validatePipeOutput(output string) error {
+	lines := strings.Split(output, "\n")
+	if pipe := strings.Index(lines[0], "|"); pipe >= 0 {
+		document := lines[0][pipe+1:]
+		column := pipe + 2 + len(document) - len(strings.TrimLeft(document, " "))
+		value, err := decodeOutputJson(strings.TrimSpace(document), 1, column)
+		if err != nil {
+			return err
+		}
+		if err := checkJsonLine(value, 1); err != nil {
+			return err
+		}
+	}
+	for idx, line := range lines[1:] {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "{") {
+			// the text of the detail
+			continue
+		}
+		value, err := decodeOutputJson(trimmed, idx+2, strings.IndexAny(line, "[{")+1)
+		if err != nil {
+			return err
+		}
+		if err := checkJsonLine(value, idx+2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// {"format_version": 2, "status": "OK", "writes": [...], "events": [...]}
+func validateJsonOutput(output string) error {
+	value, err := decodeOutputJson(output, 1, 1)
+	if err != nil {
+		return err
+	}
+	document, err := checkJsonObject(value, 1, "", map[string]bool{"format_version": true, "status": false, "writes": false, "events": false})
+	if err != nil {
+		return err
+	}
+	if err := checkFormatVersion(document, 1, FORMAT_VERSION_JSON); err != nil {
+		return err
+	}
+	if writes, ok := document["writes"]; ok {
+		if err := checkJsonWrites(writes, 1, ".writes"); err != nil {
+			return err
+		}
+	}
+	if value, ok := document["events"]; ok {
+		events, ok := value.([]interface{})
+		if !ok {
+			return &OutputError{Line: 1, Path: ".events", Expected: "an array of events", Found: jsonKind(value)}
+		}
+		for idx, event := range events {
+			if err := checkJsonEvent(event, 1, fmt.Sprintf(".events[%d]", idx)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// a {"format_version": 3, "status": "OK"} header followed by a
+// {"n": "connections", "p": [{"v": 12}]} write or a
+// {"event": {"title": "Backup finished"}} event per line
+func validateNdjsonOutput(output string) error {
+	for idx, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		value, err := decodeOutputJson(line, idx+1, 1)
+		if err != nil {
+			return err
+		}
+		if idx == 0 {
+			header, err := checkJsonObject(value, 1, "", map[string]bool{"format_version": true, "status": false})
+			if err != nil {
+				return err
+			}
+			if err := checkFormatVersion(header, 1, FORMAT_VERSION_NDJSON); err != nil {
+				return err
+			}
+			continue
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			if _, ok := object["event"]; ok {
+				if _, err := checkJsonObject(value, idx+1, "", map[string]bool{"event": true}); err != nil {
+					return err
+				}
+				if err := checkJsonEvent(object["event"], idx+1, ".event"); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := checkJsonWrite(value, idx+1, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parses the output of the plugin, and validates it if the validation of
+// the plugin is strict. The validation error is returned instead of the
+// parser error when it tells where the output is wrong.
+func parseValidatedPluginOutput(plugin *PluginMetadata, cmdState ProcessState, output string) (*PluginOutput, error) {
+	parsed, err := parsePluginOutput(plugin, cmdState, output)
+	if err != nil {
+		if validationErr := validatePluginOutput(plugin, output); validationErr != nil {
+			return nil, validationErr
+		}
+		return nil, err
+	}
+	if pluginOutputValidation(plugin) == OUTPUT_VALIDATION_STRICT {
+		if err := validatePluginOutput(plugin, output); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// the output was rejected, counted so a fleet dashboard shows the plugins
+// printing garbage
+func reportMalformedOutput(ep *errplane.Errplane, plugin *PluginMetadata, id string, instance *Instance, err error) {
+	dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "plugin": plugin.Name}
+	addInstanceDimensions(dimensions, id, instance)
+	report(ep, "agent.plugins.malformed_output", 1.0, time.Now(), dimensions, nil)
+	agentStats.Add(STAT_PARSE_ERRORS, 1)
+	checkStates.Set(CHECK_PLUGIN, plugin.Name, instanceLabel(id, instance), "unknown", "Cannot parse the output. "+err.Error())
+}
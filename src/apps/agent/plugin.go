@@ -6,14 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/errplane/errplane-go"
-	"github.com/pmylund/go-cache"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	. "utils"
@@ -21,6 +20,11 @@ import (
 
 type PluginStateOutput int
 
+const (
+	PLUGIN_SCHEDULER_RESOLUTION = time.Second
+	PLUGIN_DEFAULT_TIMEOUT      = 30 * time.Second
+)
+
 type ProcessState interface {
 	ExitStatus() int
 }
@@ -29,8 +33,9 @@ type ProcessStateWrapper struct {
 	status *os.ProcessState
 }
 
+// the exit code of the plugin, -1 if it was killed by a signal
 func (self *ProcessStateWrapper) ExitStatus() int {
-	return self.status.Sys().(syscall.WaitStatus).ExitStatus()
+	return self.status.ExitCode()
 }
 
 func (p *PluginStateOutput) String() string {
@@ -44,7 +49,26 @@ func (p *PluginStateOutput) String() string {
 	case UNKNOWN:
 		return "unknown"
 	default:
-		panic(fmt.Errorf("WTF unknown state %d", *p))
+		return "unknown"
+	}
+}
+
+// maps the exit code of a plugin to its state, the codes other than the
+// nagios ones (0 to 3) and the plugins killed by a signal (-1) are unknown
+func pluginState(exitCode int) PluginStateOutput {
+	state := PluginStateOutput(exitCode)
+	switch state {
+	case OK, WARNING, CRITICAL, UNKNOWN:
+		return state
+	default:
+		return UNKNOWN
+	}
+}
+
+// adds the raw exit code of the plugins whose exit code was mapped to unknown
+func addExitCodeDimension(dimensions errplane.Dimensions, output *PluginOutput) {
+	if pluginState(output.exitCode) != PluginStateOutput(output.exitCode) {
+		dimensions["exit_code"] = strconv.Itoa(output.exitCode)
 	}
 }
 
@@ -56,232 +80,762 @@ const (
 )
 
 var (
-	DEFAULT_INSTANCE  = &Instance{"default", nil, nil}
-	DEFAULT_INSTANCES = []*Instance{&Instance{"", nil, nil}}
-	OutputCache       = cache.New(0, 0)
+	// plugins with no instances run once with no arguments, the instance
+	// has no name and is only identified by its instance id
+	DEFAULT_INSTANCES = []*Instance{&Instance{}}
+	rateStates        = NewRateStates()
 )
 
+// The previous metrics of every plugin instance the rates are computed from
+type RateStates struct {
+	lock    sync.Mutex
+	outputs map[string]*PluginOutput
+}
+
+func NewRateStates() *RateStates {
+	return &RateStates{outputs: make(map[string]*PluginOutput)}
+}
+
+func (self *RateStates) Get(key string) (*PluginOutput, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	output, ok := self.outputs[key]
+	return output, ok
+}
+
+func (self *RateStates) Set(key string, output *PluginOutput) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.outputs[key] = output
+}
+
+// returns a copy of the previous metrics
+func (self *RateStates) Outputs() map[string]*PluginOutput {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	outputs := make(map[string]*PluginOutput, len(self.outputs))
+	for key, output := range self.outputs {
+		outputs[key] = output
+	}
+	return outputs
+}
+
 type PluginOutput struct {
 	state     PluginStateOutput
 	msg       string
 	points    []*errplane.JsonPoints
 	metrics   map[string]float64
+	events    []*PluginEvent
 	timestamp time.Time
+	exitCode  int // the raw exit code of the plugin, the state of the codes other than 0 to 3 is unknown
 }
 
-// handles running plugins
+type ScheduledPlugin struct {
+	key      string
+	plugin   *PluginMetadata
+	instance *Instance
+	interval time.Duration
+}
+
+// returns how often the instance of the plugin runs, the interval of the
+// instance overrides the one in the plugin info.yml which overrides the
+// agent sleep
+func pluginInterval(plugin *PluginMetadata, instance *Instance) time.Duration {
+	if instance.Interval != "" {
+		interval, err := time.ParseDuration(instance.Interval)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Warn("Invalid interval '%s' for instance '%s' of plugin %s", instance.Interval, instance.Name, plugin.Name)
+	}
+	if plugin.Interval > 0 {
+		return plugin.Interval
+	}
+	return AgentConfig().Sleep
+}
+
+// returns by how much a run of the instance can move so the instances of
+// the plugins don't all start at once, the jitter of the instance
+// overrides the plugin-concurrency jitter. It's at most half the interval.
+func pluginJitter(plugin *PluginMetadata, instance *Instance, interval time.Duration) time.Duration {
+	jitter := time.Duration(AgentConfig().PluginConcurrency.Jitter * float64(interval))
+	if instance.Jitter != "" {
+		parsed, err := time.ParseDuration(instance.Jitter)
+		if err == nil && parsed >= 0 {
+			jitter = parsed
+		} else {
+			log.Warn("Invalid jitter '%s' for instance '%s' of plugin %s", instance.Jitter, instance.Name, plugin.Name)
+		}
+	}
+	if jitter > interval/2 {
+		return interval / 2
+	}
+	return jitter
+}
+
+// returns how long the instance of the plugin can run before it's killed,
+// the timeout of the instance overrides the one in the plugin info.yml
+func pluginTimeout(plugin *PluginMetadata, instance *Instance) time.Duration {
+	if instance.Timeout != "" {
+		timeout, err := time.ParseDuration(instance.Timeout)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Warn("Invalid timeout '%s' for instance '%s' of plugin %s", instance.Timeout, instance.Name, plugin.Name)
+	}
+	if plugin.Timeout > 0 {
+		return plugin.Timeout
+	}
+	return PLUGIN_DEFAULT_TIMEOUT
+}
+
+func schedulePlugins(config *AgentConfiguration, plugins map[string]*PluginMetadata) []*ScheduledPlugin {
+	scheduled := make([]*ScheduledPlugin, 0)
+	for name, instances := range podPlugins.Merge(config.Plugins) {
+		plugin, ok := plugins[name]
+		if !ok {
+			log.Error("Cannot find plugin '%s'", name)
+			continue
+		}
+
+		if len(instances) == 0 {
+			instances = DEFAULT_INSTANCES
+		}
+
+		seen := make(map[string]string)
+		for _, instance := range instances {
+			id := instanceId(name, instance)
+			if other, ok := seen[id]; ok {
+				log.Warn("Instance '%s' of plugin %s has the same arguments as instance '%s', ignoring it", instance.Name, name, other)
+				continue
+			}
+			seen[id] = instance.Name
+			scheduled = append(scheduled, &ScheduledPlugin{name + "/" + id, plugin, instance, pluginInterval(plugin, instance)})
+		}
+	}
+	return scheduled
+}
+
+// handles running plugins, the configuration is refreshed every sleep and
+// each plugin instance runs on its own interval, the instances that are due
+// at the same time are started longest first
 func monitorPlugins(ep *errplane.Errplane) {
 	var previousConfig *AgentConfiguration
-	var plugins map[string]*PluginMetadata
+	var previousHash string
+	var lastRefresh time.Time
+	var scheduled []*ScheduledPlugin
+	var available map[string]*PluginMetadata
+	lastRuns := make(map[string]time.Time)
+	pool := newConfiguredPluginPool()
+	history := runHistory
+	refresher := NewBackendRefresher(fetchBackendRefresh)
+	baker := NewConfigBaker()
+
+	// don't wait for the backend at boot, run the last configuration it sent
+	// and the local plugins with the installed plugins until it answers
+	cached, err := GetCachedPluginsToRun()
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Cannot read the cached configuration %s. Error: %s", AgentConfig().ConfigCache, err)
+	}
+	if config := MergeLocalPlugins(cached, LocalPlugins.Get(), AgentConfig().LocalPluginsMode); config != nil {
+		if plugins := getInstalledPlugins(); plugins != nil {
+			log.Info("Running the %d plugins of the cached and local configuration until the backend answers", len(config.Plugins))
+			previousConfig = cached
+			scheduled = schedulePlugins(config, plugins)
+			pluginRegistry.SetScheduled(scheduled)
+		}
+	}
 
 	for {
-		config, err := GetPluginsToRun()
-		if err != nil {
-			log.Error("Error while getting configuration from backend. Error: %s", err)
-			if previousConfig == nil {
-				goto sleep
+		now := time.Now()
+
+		if pluginRegistry.Reloaded() {
+			// the runs in flight finish in the previous pool
+			if concurrency := AgentConfig().PluginConcurrency; concurrency.MaxConcurrency != cap(pool.slots) || concurrency.Overlap != pool.overlap {
+				pool = newConfiguredPluginPool()
 			}
-			config = previousConfig
+			lastRefresh = time.Time{}
 		}
 
-		log.Debug("Iterating through %d plugins", len(config.Plugins))
+		if now.Sub(lastRefresh) >= AgentConfig().Sleep && refresher.Start() {
+			lastRefresh = now
+		}
 
-		// get the list of plugins that should be turned from the config service
-		plugins = getAvailablePlugins()
+		if refresh := refresher.Done(); refresh != nil {
+			config := refresh.Config
+			if refresh.Err != nil {
+				log.Error("Error while getting configuration from backend. Error: %s", NetworkError(refresh.Err))
+				config = previousConfig
+			} else if hash := configHash(config); !baker.Accept(hash) {
+				log.Debug("Ignoring the configuration %s reverted after its bake", shortHash(hash))
+				config = previousConfig
+			} else if hash != previousHash {
+				audit("config-service", "config_changed", previousHash, hash, "")
+				baker.Applied(previousConfig, previousHash, hash, now, agentStats.Counts())
+				previousHash = hash
+				backendConfigRevision.Set(hash)
+			}
+			previousConfig = config
+			available = refresh.Plugins
+
+			// the local plugins run alone until the backend answered once
+			config = MergeLocalPlugins(config, LocalPlugins.Get(), AgentConfig().LocalPluginsMode)
+			if config != nil {
+				log.Debug("Scheduling %d plugins", len(config.Plugins))
+				// get the list of plugins that should be turned from the config service
+				scheduled = schedulePlugins(config, refresh.Plugins)
+				pluginRegistry.SetScheduled(scheduled)
+			}
 
-		for name, instances := range config.Plugins {
-			plugin, ok := plugins[name]
-			if !ok {
-				log.Error("Cannot find plugin '%s'. Error: %s", name, err)
-				continue
+			if overrun := history.Overrun(scheduled, AgentConfig().Sleep, AgentConfig().PluginConcurrency.MaxConcurrency); overrun > 0 {
+				log.Warn("The plugins take %s more than the %s sleep to run", overrun, AgentConfig().Sleep)
+				report(ep, "agent.plugins.cycle_overrun", overrun.Seconds(), now, errplane.Dimensions{"host": AgentConfig().Hostname}, nil)
 			}
+		}
 
-			if len(instances) == 0 {
-				instances = DEFAULT_INSTANCES
+		// revert a new configuration if the plugin failures spiked
+		if bake := baker.Check(now, agentStats.Counts()); bake != nil {
+			reportConfigRevert(ep, bake)
+			previousConfig, previousHash = bake.previous, bake.previousHash
+			backendConfigRevision.Set(previousHash)
+			if config := MergeLocalPlugins(previousConfig, LocalPlugins.Get(), AgentConfig().LocalPluginsMode); config != nil && available != nil {
+				scheduled = schedulePlugins(config, available)
+				pluginRegistry.SetScheduled(scheduled)
 			}
+		}
 
-			for _, instance := range instances {
-				go runPlugin(ep, instance, plugin)
+		// instances triggered from the local api run right away
+		triggered := pluginRegistry.Triggered()
+		activeBursts := bursts.List()
+		if AgentConfig().PluginConcurrency.Stagger {
+			staggerFirstRuns(scheduled, lastRuns, now)
+		}
+		due := make([]*ScheduledPlugin, 0)
+		for _, s := range scheduled {
+			interval, _ := applyBursts(activeBursts, s.plugin.Name, s.instance, s.interval)
+			if !triggered[s.key] && now.Sub(lastRuns[s.key]) < interval {
+				continue
 			}
+			lastRuns[s.key] = jitterRun(now, pluginJitter(s.plugin, s.instance, interval))
+			due = append(due, s)
 		}
 
-	sleep:
-		time.Sleep(AgentConfig.Sleep)
+		history.Sort(due)
+		var cycle *Span
+		if len(due) > 0 {
+			// the runs are children of the cycle, the time until they
+			// start is the time they waited for a slot
+			cycle = NewSpan(nil, "plugins cycle")
+			cycle.Attributes["due"] = strconv.Itoa(len(due))
+		}
+		for _, s := range due {
+			key, instance, plugin := s.key, s.instance, s.plugin
+			submitted := pool.Submit(key, func() {
+				start := time.Now()
+				agentStats.Running(func() { runPlugin(ep, instance, plugin, cycle) })
+				history.Record(key, time.Now().Sub(start))
+			})
+			if !submitted {
+				reportMissedRun(ep, plugin, instance, MISSED_OVERRUN, now)
+			}
+		}
+		if cycle != nil {
+			cycle.Finish()
+		}
+
+		time.Sleep(PLUGIN_SCHEDULER_RESOLUTION)
 	}
 }
 
-func runPlugin(ep *errplane.Errplane, instance *Instance, plugin *PluginMetadata) {
-	args := instance.ArgsList
-	for name, value := range instance.Args {
-		args = append(args, "--"+name, value)
+// runs the plugin in a span of the parent, the scheduling cycle, or in a
+// trace of its own if the parent is nil. The plugin gets the span in
+// TRACEPARENT and the errors it causes are logged with its trace id.
+func runPlugin(ep *errplane.Errplane, instance *Instance, plugin *PluginMetadata, parent *Span) {
+	id := instanceId(plugin.Name, instance)
+	label := instanceLabel(id, instance)
+	span := NewSpan(parent, "plugin "+plugin.Name)
+	span.Attributes["plugin"] = plugin.Name
+	span.Attributes["instance_id"] = id
+	if instance.Name != "" {
+		span.Attributes["instance"] = instance.Name
+	}
+	defer span.Finish()
+	_, verbose := applyBursts(bursts.List(), plugin.Name, instance, 0)
+	secretArgs := secretArgNames(instance)
+
+	if err := checkPluginCompatibility(plugin); err != nil {
+		log.Error("[trace %s] Cannot run instance '%s' of plugin %s. Error: %s", span.TraceId, label, plugin.Name, ConfigError(err))
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
+		reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+		reportMissedRun(ep, plugin, instance, MISSED_INCOMPATIBLE, time.Now())
+		return
+	}
+
+	rendered, err := renderInstanceArgs(instance)
+	if err != nil {
+		log.Error("[trace %s] Cannot render the arguments of instance '%s' of plugin %s. Error: %s", span.TraceId, label, plugin.Name, ConfigError(err))
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
+		reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+		return
+	}
+	instance = rendered
+	instanceArgs, err := validatePluginArgs(plugin, instance)
+	if err != nil {
+		log.Error("[trace %s] Invalid arguments for instance '%s' of plugin %s. Error: %s", span.TraceId, label, plugin.Name, ConfigError(err))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+		reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+		return
+	}
+
+	args, secretsEnv := pluginCommandArgs(instance, instanceArgs, secretArgs)
+	instanceEnv, err := validatePluginEnv(plugin, instance)
+	if err != nil {
+		log.Error("[trace %s] Invalid environment for instance '%s' of plugin %s. Error: %s", span.TraceId, label, plugin.Name, ConfigError(err))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+		reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+		return
+	}
+	env := append(formatVersionEnv(plugin), instanceEnv...)
+	env = append(env, secretsEnv...)
+	env = append(env, "TRACEPARENT="+span.Traceparent())
+	if verbose {
+		env = append(env, "ERRPLANE_VERBOSE=1")
+	}
+	if len(plugin.Probes) > 0 {
+		probesEnv, err := pluginProbesEnv(PROBES_DIR, plugin)
+		if err != nil {
+			log.Error("[trace %s] Cannot run the probes of plugin %s. Error: %s", span.TraceId, plugin.Name, ExecError(err))
+			agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+			span.Fail(err.Error())
+			checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+			reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+			return
+		}
+		env = append(env, probesEnv...)
+	}
+
+	cmdPath := statusScript(plugin.Path)
+	log.Debug("Running command %s %s", cmdPath, loggableArgs(plugin, args))
+	var name string
+	var cmdArgs []string
+	container := ""
+	if instance.Remote != nil {
+		var err error
+		name, cmdArgs, err = remoteCommand(plugin, instance.Remote, cmdPath, args)
+		if err != nil {
+			log.Error("[trace %s] Cannot copy plugin %s to %s. Error: %s", span.TraceId, plugin.Name, instance.Remote.Host, NetworkError(err))
+			agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+			span.Fail(err.Error())
+			checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+			reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+			return
+		}
+	} else {
+		name, cmdArgs, container = sandboxCommand(plugin, cmdPath, args, env)
+		if container == "" {
+			name, cmdArgs = macCommand(scriptCommand(cmdPath, args))
+		}
+	}
+	if fault := chaosFaults.Match(CHAOS_PLUGIN_TIMEOUT, plugin.Name, instance); fault != nil {
+		timeout := pluginTimeout(plugin, instance)
+		log.Error("[trace %s] %s", span.TraceId, ExecError(fmt.Errorf("Plugin %s killed because it took more than %s to execute (simulated by %s)", cmdPath, timeout, fault.Id)))
+		span.Fail("simulated timeout")
+		reportPluginTimeout(ep, plugin, instance, id, label, timeout, span.TraceId)
+		return
+	}
+	var runAs *PluginUser
+	var confinement *PluginConfinement
+	if container == "" && instance.Remote == nil {
+		// sandboxed plugins run as the user and with the limits of their
+		// container
+		if runAs, err = lookupPluginUser(pluginRunAs(plugin)); err != nil {
+			log.Error("[trace %s] Cannot run plugin %s. Error: %s", span.TraceId, plugin.Name, ConfigError(err))
+			agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+			span.Fail(err.Error())
+			checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+			reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+			return
+		}
+		if confinement, name, cmdArgs, err = confinePlugin(plugin, pluginTimeout(plugin, instance), name, cmdArgs); err != nil {
+			log.Error("[trace %s] Cannot limit plugin %s. Error: %s", span.TraceId, plugin.Name, err)
+			agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+			span.Fail(err.Error())
+			checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", err.Error())
+			reportUnknownStatus(ep, plugin, instance, err.Error(), span.TraceId)
+			return
+		}
+		defer confinement.Release()
+	}
+	cmd := exec.Command(name, cmdArgs...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
-	log.Debug("Running command %s %s", path.Join(plugin.Path, "status"), strings.Join(args, " "))
-	cmdPath := path.Join(plugin.Path, "status")
-	cmd := exec.Command(cmdPath, args...)
+	if runAs != nil || confinement != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		runAs.Apply(cmd)
+		confinement.Apply(cmd.SysProcAttr)
+	}
+	start := time.Now()
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Error("Cannot run plugin %s. Error: %s", cmd, err)
+		log.Error("[trace %s] Cannot run plugin %s. Error: %s", span.TraceId, cmd, ExecError(err))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
 		return
 	}
 
 	if err := cmd.Start(); err != nil {
-		log.Error("Cannot run plugin %s. Error: %s", cmdPath, err)
+		log.Error("[trace %s] Cannot run plugin %s. Error: %s", span.TraceId, cmdPath, ExecError(err))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
 		return
 	}
+	agentStats.Add(STAT_PLUGIN_RUNS, 1)
 
-	ch := make(chan error)
-	go killPlugin(cmdPath, cmd, ch)
+	timeout := pluginTimeout(plugin, instance)
+	ch := make(chan error, 1)
+	killed := make(chan bool, 1)
+	go func() { killed <- killPlugin(cmdPath, cmd, ch, timeout) }()
 
-	output, err := ioutil.ReadAll(stdout)
+	rawOutput, err := ioutil.ReadAll(stdout)
 	if err != nil {
-		log.Error("Error while reading output from plugin %s. Error: %s", cmdPath, err)
+		log.Error("[trace %s] Error while reading output from plugin %s. Error: %s", span.TraceId, cmdPath, ExecError(err))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail(err.Error())
 		ch <- err
 		return
 	}
 
-	lines := strings.Split(string(output), "\n")
+	sanitizedOutput := sanitizePluginOutput(rawOutput)
+	firstLine, _ := splitPluginOutput(sanitizedOutput)
+	detail := pluginDetail(plugin, sanitizedOutput)
+	if verbose {
+		log.Info("Output of instance '%s' of plugin %s during the burst:\n%s", label, plugin.Name, revealedSecrets.Redact(sanitizedOutput))
+	}
 
 	err = cmd.Wait()
 	ch <- err
 
-	if len(lines) > 0 {
-		log.Debug("output of plugin %s is %s", cmdPath, lines[0])
-		firstLine := lines[0]
-		output, err := parsePluginOutput(plugin, &ProcessStateWrapper{cmd.ProcessState}, firstLine)
-		if err != nil {
-			log.Error("Cannot parse plugin %s output. Output: %s. Error: %s", cmdPath, firstLine, err)
-			return
-		}
+	if container != "" && !cmd.ProcessState.Exited() {
+		removeSandbox(plugin, container)
+	}
+	if container == "" && instance.Remote == nil {
+		// the usage of a sandboxed or remote plugin is the one of the
+		// container runtime or the ssh client
+		reportPluginUsage(ep, plugin, id, instance, pluginUsage(cmd.ProcessState))
+	}
+
+	timedOut := <-killed
+	pluginRegistry.RecordRun(plugin.Name+"/"+id, &PluginRun{
+		Output:     revealedSecrets.Redact(sanitizedOutput),
+		ExitStatus: (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus(),
+		TimedOut:   timedOut,
+		Start:      start,
+		Duration:   time.Now().Sub(start),
+	})
+
+	if timedOut {
+		span.Fail(fmt.Sprintf("Killed after %s", timeout))
+		reportPluginTimeout(ep, plugin, instance, id, label, timeout, span.TraceId)
+		return
+	}
+	if limit := confinement.Exceeded(cmd.ProcessState); limit != "" {
+		span.Fail("Killed for going beyond its " + limit + " limit")
+		reportPluginLimitKill(ep, plugin, instance, id, label, pluginLimits(plugin), limit, span.TraceId)
+		return
+	}
 
-		log.Debug("parsed output is %#v", output)
+	if instance.Remote != nil && cmd.ProcessState.Exited() && (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus() == SSH_ERROR_STATUS {
+		log.Error("[trace %s] %s", span.TraceId, NetworkError(fmt.Errorf("Cannot run plugin %s on %s, ssh failed", plugin.Name, instance.Remote.Host)))
+		agentStats.Add(STAT_PLUGIN_FAILURES, 1)
+		span.Fail("ssh failed")
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", "Cannot connect to "+instance.Remote.Host)
+		reportUnknownStatus(ep, plugin, instance, "Cannot connect to "+instance.Remote.Host, span.TraceId)
+		return
+	}
 
-		// status are printed to plugins.<plugin-name>.status with a value of 1 and dimension status that is either ok, warning, critical or unknown
-		// other metrics are written to plugins.<plugin-name>.<metric-name> with the given value
-		// all metrics have the host name as a dimension
+	log.Debug("output of plugin %s is %s", cmdPath, revealedSecrets.Redact(firstLine))
+	output, err := parseValidatedPluginOutput(plugin, &ProcessStateWrapper{cmd.ProcessState}, sanitizedOutput)
+	if fault := chaosFaults.Match(CHAOS_PARSE_ERROR, plugin.Name, instance); fault != nil {
+		output, err = nil, fmt.Errorf("Simulated by %s", fault.Id)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s", revealedSecrets.Redact(err.Error()))
+		log.Error("[trace %s] Cannot parse plugin %s output. Output: %s. Error: %s", span.TraceId, cmdPath, revealedSecrets.Redact(firstLine), ParseError(err))
+		span.Fail(err.Error())
+		reportMalformedOutput(ep, plugin, id, instance, err)
+		return
+	}
 
-		dimensions := errplane.Dimensions{
-			"host":       AgentConfig.Hostname,
-			"status":     output.state.String(),
-			"status_msg": output.msg,
-		}
-		if instance.Name != "" {
-			dimensions["instance"] = instance.Name
-		}
+	log.Debug("parsed output is %s", revealedSecrets.Redact(fmt.Sprintf("%#v", output)))
 
-		report(ep, fmt.Sprintf("plugins.%s.status", plugin.Name), 1.0, time.Now(), dimensions, nil)
+	// status are printed to plugins.<plugin-name>.status with a value of 1 and dimension status that is either ok, warning, critical or unknown
+	// other metrics are written to plugins.<plugin-name>.<metric-name> with the given value
+	// all metrics have the host name as a dimension
 
-		// create a map from metric name to current value
-		currentValues := make(map[string]float64)
-		log.Debug("Calculating the rates for plugin %s %v", plugin.Name, plugin.CalculateRates)
+	if plugin.StatusMessage != "" {
+		output.msg = interpolateMessage(plugin.StatusMessage, pluginMessageValues(output, instance))
+	}
 
-		// process the errplane output
-		if output.points != nil {
-			// add the plugins.<plugin-name>.<instance-name> to the metric names
-			// if the instance name isn't empty add it to the dimensions
-			for _, write := range output.points {
-				for _, metric := range plugin.CalculateRates {
-					ok, err := regexp.MatchString(metric, write.Name)
-					if err != nil {
-						log.Error("Invalid regex %s. Error: %s", metric, err)
-						continue
-					}
-					if ok && len(write.Points) > 0 {
-						currentValues[write.Name] = write.Points[0].Value
-					}
-				}
+	dimensions := errplane.Dimensions{
+		"host":       AgentConfig().Hostname,
+		"status":     output.state.String(),
+		"status_msg": output.msg,
+	}
+	addExitCodeDimension(dimensions, output)
+	if output.state != OK {
+		// tells which run to look for in the logs and the traces
+		detail = traceContext(detail, span.TraceId)
+		span.Fail(output.state.String() + ": " + output.msg)
+	}
+	addInstanceDimensions(dimensions, id, instance)
+	maintenance := tagMaintenance(plugin.Name, instance.Name, dimensions)
+	status := dampenFlapping(ep, plugin, id, dimensions)
+
+	if maintenance == MAINTENANCE_SUPPRESS {
+		log.Debug("Not reporting the status of plugin %s, it's in maintenance", plugin.Name)
+	} else {
+		reportWithContext(ep, fmt.Sprintf("plugins.%s.status", plugin.Name), 1.0, time.Now(), detail, dimensions)
+		checkStates.Set(CHECK_PLUGIN, plugin.Name, label, status, output.msg)
+	}
 
-				write.Name = fmt.Sprintf("plugins.%s.%s", plugin.Name, write.Name)
-				if instance.Name != "" {
-					for _, point := range write.Points {
-						point.Dimensions["instance"] = instance.Name
-					}
+	// create a map from metric name to current value
+	currentValues := make(map[string]float64)
+	log.Debug("Calculating the rates for plugin %s %v", plugin.Name, plugin.CalculateRates)
+
+	// process the errplane output
+	if output.points != nil {
+		enforceReservedDimensions(plugin.Name, output.points)
+		output.points = filterPluginWrites(plugin.Name, output.points)
+		// add the plugins.<plugin-name>.<instance-name> to the metric names
+		// and add the instance name and identity to the dimensions
+		for _, write := range output.points {
+			for _, metric := range plugin.CalculateRates {
+				ok, err := regexp.MatchString(metric, write.Name)
+				if err != nil {
+					log.Error("Invalid regex %s. Error: %s", metric, err)
+					continue
+				}
+				if ok && len(write.Points) > 0 {
+					currentValues[write.Name] = write.Points[0].Value
 				}
 			}
 
-			ep.SendHttp(&errplane.WriteOperation{Writes: output.points})
+			write.Name = fmt.Sprintf("plugins.%s.%s", plugin.Name, write.Name)
+			for _, point := range write.Points {
+				if point.Dimensions == nil {
+					point.Dimensions = errplane.Dimensions{}
+				}
+				addInstanceDimensions(point.Dimensions, id, instance)
+				if maintenance != "" {
+					point.Dimensions["maintenance"] = "true"
+				}
+				alertStates.Evaluate(ep, write.Name, point.Value, point.Dimensions, time.Now())
+			}
 		}
 
-		// process nagios output
-		if output.metrics != nil {
-			dimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
-			if instance.Name != "" {
-				dimensions["instance"] = instance.Name
-			}
-			for name, value := range output.metrics {
-				for _, metric := range plugin.CalculateRates {
-					ok, err := regexp.MatchString(metric, name)
-					if err != nil {
-						log.Error("Invalid regex %s. Error: %s", metric, err)
-						continue
-					}
-					if ok {
-						currentValues[name] = value
-					}
+		sendHttp(ep, &errplane.WriteOperation{Writes: output.points})
+	}
+
+	// forward the events as annotations
+	if len(output.events) > 0 {
+		sendHttp(ep, &errplane.WriteOperation{Writes: []*errplane.JsonPoints{pluginEventsWrite(plugin, id, instance, output.events, time.Now())}})
+	}
 
+	// process nagios output
+	filterPluginMetrics(plugin.Name, output.metrics)
+	if output.metrics != nil {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+		addInstanceDimensions(dimensions, id, instance)
+		if maintenance != "" {
+			dimensions["maintenance"] = "true"
+		}
+		for name, value := range output.metrics {
+			for _, metric := range plugin.CalculateRates {
+				ok, err := regexp.MatchString(metric, name)
+				if err != nil {
+					log.Error("Invalid regex %s. Error: %s", metric, err)
+					continue
+				}
+				if ok {
+					currentValues[name] = value
 				}
-				report(ep, fmt.Sprintf("plugins.%s.%s", plugin.Name, name), value, time.Now(), dimensions, nil)
+
 			}
+			metric := fmt.Sprintf("plugins.%s.%s", plugin.Name, name)
+			report(ep, metric, value, time.Now(), dimensions, nil)
+			alertStates.Evaluate(ep, metric, value, dimensions, time.Now())
 		}
+	}
+
+	resultStream.Publish(newPluginResult(plugin, id, instance, output))
+
+	log.Debug("Current values: %v", currentValues)
 
-		log.Debug("Current values: %v", currentValues)
+	// calculate the rate of change
+	cacheKey := fmt.Sprintf("%s/%s", plugin.Name, id)
+	previousOutput, ok := rateStates.Get(cacheKey)
+	defer rateStates.Set(cacheKey, output)
+	log.Debug("Previous output for %s is %v", plugin.Name, previousOutput)
+	if !ok {
+		return
+	}
 
-		// calculate the rate of change
-		cacheKey := fmt.Sprintf("%s/%s", plugin.Name, instance.Name)
-		_previousOutput, ok := OutputCache.Get(cacheKey)
-		defer OutputCache.Set(cacheKey, output, -1)
-		log.Debug("Previous output for %s is %v", plugin.Name, _previousOutput)
+	timeDiff := output.timestamp.Sub(previousOutput.timestamp).Seconds()
+	for name, value := range previousOutput.metrics {
+		currentValue, ok := currentValues[name]
 		if !ok {
-			return
+			continue
 		}
 
-		previousOutput := _previousOutput.(*PluginOutput)
-		timeDiff := output.timestamp.Sub(previousOutput.timestamp).Seconds()
-		for name, value := range previousOutput.metrics {
-			currentValue, ok := currentValues[name]
-			if !ok {
-				continue
+		rate, reset := counterRate(value, currentValue, timeDiff)
+		rateDimensions := dimensions
+		if reset {
+			log.Debug("Counter %s of plugin %s was reset from %f to %f", name, plugin.Name, value, currentValue)
+			rateDimensions = errplane.Dimensions{"rate_reset": "true"}
+			for key, value := range dimensions {
+				rateDimensions[key] = value
 			}
-
-			diff := currentValue - value
-			diff = diff / timeDiff
-			report(ep, fmt.Sprintf("plugins.%s.%s.rate", plugin.Name, name), diff, time.Now(), dimensions, nil)
 		}
+		report(ep, fmt.Sprintf("plugins.%s.%s.rate", plugin.Name, name), rate, time.Now(), rateDimensions, nil)
+	}
+}
+
+// returns the rate of change per second of a counter. A counter lower than
+// its previous value was reset (e.g. the process restarted or a 32 bits
+// counter wrapped around), it's assumed to have started again from zero,
+// i.e. the current value is the increase.
+func counterRate(previous, current, seconds float64) (rate float64, reset bool) {
+	if current < previous {
+		return current / seconds, true
 	}
+	return (current - previous) / seconds, false
 }
 
-func parsePluginOutput(plugin *PluginMetadata, cmdState ProcessState, firstLine string) (*PluginOutput, error) {
+// reports the unknown status of a run that couldn't start, e.g. because an
+// argument uses a fact the host doesn't have
+func reportUnknownStatus(ep *errplane.Errplane, plugin *PluginMetadata, instance *Instance, msg, traceId string) {
+	dimensions := errplane.Dimensions{
+		"host":       AgentConfig().Hostname,
+		"status":     "unknown",
+		"status_msg": msg,
+	}
+	if instance.Name != "" {
+		dimensions["instance"] = instance.Name
+	}
+	reportWithContext(ep, fmt.Sprintf("plugins.%s.status", plugin.Name), 1.0, time.Now(), traceContext("", traceId), dimensions)
+}
+
+// appends the trace id of the run to the context of its status. It isn't a
+// dimension, every run would start a new series
+func traceContext(context, traceId string) string {
+	if context == "" {
+		return "trace_id: " + traceId
+	}
+	return context + "\ntrace_id: " + traceId
+}
+
+func parsePluginOutput(plugin *PluginMetadata, cmdState ProcessState, allOutput string) (*PluginOutput, error) {
 	outputType := plugin.Output
 	switch outputType {
 	case "nagios":
-		return parseNagiosOutput(cmdState, firstLine)
+		return parseNagiosOutput(cmdState, allOutput)
 	case "errplane":
-		return parseErrplaneOutput(cmdState, firstLine)
+		return parseVersionedErrplaneOutput(plugin, cmdState, allOutput)
+	case "exit-code":
+		return parseExitCodeOutput(cmdState)
+	case "influxdb":
+		return parseInfluxdbOutput(cmdState, allOutput)
+	case "prometheus":
+		return parsePrometheusOutput(cmdState, allOutput)
 	default:
-		return nil, fmt.Errorf("Unknown plugin output type '%s', supported types are 'errplane' and 'nagios'", outputType)
+		return nil, fmt.Errorf("Unknown plugin output type '%s', supported types are 'errplane', 'nagios', 'exit-code', 'influxdb' and 'prometheus'", outputType)
 	}
 }
 
-func parseErrplaneOutput(cmdState ProcessState, firstLine string) (*PluginOutput, error) {
+// every line of the output is a point in the influxdb line protocol, the
+// status is the exit code of the plugin
+func parseInfluxdbOutput(cmdState ProcessState, allOutput string) (*PluginOutput, error) {
+	now := time.Now()
+	points := make([]*LineProtocolPoint, 0)
+	var lastErr error
+	for _, line := range strings.Split(allOutput, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseLineProtocol(line, now)
+		if err != nil {
+			log.Debug("Cannot parse line '%s'. Error: %s", line, err)
+			lastErr = err
+			continue
+		}
+		points = append(points, point)
+	}
+
+	if len(points) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return &PluginOutput{pluginState(cmdState.ExitStatus()), "", lineProtocolWrites(points), nil, nil, now, cmdState.ExitStatus()}, nil
+}
+
+// the output is ignored, the plugin is ok if it exits with 0 and critical otherwise
+func parseExitCodeOutput(cmdState ProcessState) (*PluginOutput, error) {
+	if exitStatus := cmdState.ExitStatus(); exitStatus != 0 {
+		return &PluginOutput{CRITICAL, fmt.Sprintf("Exited with status %d", exitStatus), nil, nil, nil, time.Now(), exitStatus}, nil
+	}
+	return &PluginOutput{OK, "", nil, nil, nil, time.Now(), 0}, nil
+}
+
+// the first line is the status followed by a json array of points, e.g.
+// `OK | [{"n": "connections", "p": [{"v": 10}]}]`. Every
+// following line starting with [ or { is more points, either an array or
+// a single write.
+func parseErrplaneOutput(cmdState ProcessState, allOutput string) (*PluginOutput, error) {
 	exitStatus := cmdState.ExitStatus()
-	firstLine = strings.TrimSpace(firstLine)
-	statusAndMetrics := strings.Split(firstLine, "|")
+	lines := strings.Split(strings.TrimSpace(allOutput), "\n")
+	statusAndMetrics := strings.SplitN(strings.TrimSpace(lines[0]), "|", 2)
 	status := strings.TrimSpace(statusAndMetrics[0])
 	writes := make([]*errplane.JsonPoints, 0)
-	metric := strings.TrimSpace(statusAndMetrics[1])
 
-	err := json.Unmarshal([]byte(metric), &writes)
-	if err != nil {
-		return nil, err
+	_, pointLines := splitErrplaneLongOutput(lines[1:])
+	if len(statusAndMetrics) == 2 {
+		pointLines = append([]string{strings.TrimSpace(statusAndMetrics[1])}, pointLines...)
+	}
+	for _, line := range pointLines {
+		if strings.HasPrefix(line, "{") {
+			write := &errplane.JsonPoints{}
+			if err := json.Unmarshal([]byte(line), write); err != nil {
+				return nil, err
+			}
+			writes = append(writes, write)
+			continue
+		}
+		lineWrites := make([]*errplane.JsonPoints, 0)
+		if err := json.Unmarshal([]byte(line), &lineWrites); err != nil {
+			return nil, err
+		}
+		writes = append(writes, lineWrites...)
 	}
 
-	return &PluginOutput{PluginStateOutput(exitStatus), status, writes, nil, time.Now()}, nil
+	return &PluginOutput{pluginState(exitStatus), status, writes, nil, nil, time.Now(), exitStatus}, nil
 }
 
-func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput, error) {
-	firstLine = strings.TrimSpace(firstLine)
+// the first line is the status optionally followed by the perfdata, the
+// long output can continue the perfdata, see splitNagiosLongOutput
+func parseNagiosOutput(cmdState ProcessState, allOutput string) (*PluginOutput, error) {
+	lines := strings.Split(strings.TrimSpace(allOutput), "\n")
 
-	statusAndMetrics := strings.Split(firstLine, "|")
+	statusAndMetrics := strings.Split(strings.TrimSpace(lines[0]), "|")
 	switch len(statusAndMetrics) {
 	case 1, 2: // that's fine, anything else is an error
 	default:
@@ -291,11 +845,14 @@ func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput,
 	exitStatus := cmdState.ExitStatus()
 	status := strings.TrimSpace(statusAndMetrics[0])
 
-	if len(statusAndMetrics) == 1 {
-		return &PluginOutput{PluginStateOutput(exitStatus), status, nil, nil, time.Now()}, nil
+	_, metricsLine := splitNagiosLongOutput(lines[1:])
+	if len(statusAndMetrics) == 2 {
+		metricsLine = strings.TrimSpace(statusAndMetrics[1] + " " + metricsLine)
 	}
 
-	metricsLine := strings.TrimSpace(statusAndMetrics[1])
+	if metricsLine == "" {
+		return &PluginOutput{pluginState(exitStatus), status, nil, nil, nil, time.Now(), exitStatus}, nil
+	}
 
 	type ParserState int
 	const (
@@ -401,21 +958,36 @@ func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput,
 		}
 	}
 
-	return &PluginOutput{PluginStateOutput(exitStatus), status, nil, metricsMap, time.Now()}, nil
+	return &PluginOutput{pluginState(exitStatus), status, nil, metricsMap, nil, time.Now(), exitStatus}, nil
+}
+
+// reports the instance as unknown and counts the timeout
+func reportPluginTimeout(ep *errplane.Errplane, plugin *PluginMetadata, instance *Instance, id, label string, timeout time.Duration, traceId string) {
+	msg := fmt.Sprintf("Timed out after %s", timeout)
+	dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+	addInstanceDimensions(dimensions, id, instance)
+	report(ep, fmt.Sprintf("plugins.%s.timeouts", plugin.Name), 1.0, time.Now(), dimensions, nil)
+	agentStats.Add(STAT_PLUGIN_TIMEOUTS, 1)
+	checkStates.Set(CHECK_PLUGIN, plugin.Name, label, "unknown", msg)
+	reportUnknownStatus(ep, plugin, instance, msg, traceId)
 }
 
-func killPlugin(cmdPath string, cmd *exec.Cmd, ch chan error) {
+// kills the plugin if it doesn't exit within the timeout, returns true if
+// the plugin was killed because it timed out
+func killPlugin(cmdPath string, cmd *exec.Cmd, ch chan error, timeout time.Duration) bool {
 	select {
 	case err := <-ch:
 		if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Exited() {
 			log.Error("plugin %s didn't die gracefully. Killing it.", cmdPath)
 			cmd.Process.Kill()
 		}
-	case <-time.After(AgentConfig.Sleep):
+		return false
+	case <-time.After(timeout):
 		err := cmd.Process.Kill()
 		if err != nil {
 			log.Error("Cannot kill plugin %s. Error: %s", cmdPath, err)
 		}
-		log.Error("Plugin %s killed because it took more than %s to execute", cmdPath, AgentConfig.Sleep)
+		log.Error("%s", ExecError(fmt.Errorf("Plugin %s killed because it took more than %s to execute", cmdPath, timeout)))
+		return true
 	}
 }
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"path"
+	"time"
+	. "utils"
+)
+
+func (self *AgentSuite) TestPluginLimits(c *C) {
+	defer setTestConfig(func(config *Config) { config.PluginLimits = PluginLimits{Cpu: 0.5, Memory: 1 << 30} })()
+	dir := c.MkDir()
+	plugin := &PluginMetadata{Name: "spin", Path: dir, Output: "nagios", Timeout: 2 * time.Second, Limits: PluginLimits{Cpu: 0.25}}
+	c.Assert(pluginLimits(plugin), Equals, PluginLimits{Cpu: 0.25, Memory: 1 << 30})
+
+	if _, err := exec.LookPath("prlimit"); err != nil {
+		c.Skip("prlimit isn't installed")
+	}
+	name, args, err := rlimitCommand(pluginLimits(plugin), plugin.Timeout, "/bin/sh", []string{"status"})
+	c.Assert(err, IsNil)
+	c.Assert(path.Base(name), Equals, "prlimit")
+	c.Assert(args, DeepEquals, []string{"--as=1073741824", "--cpu=1:2", "--", "/bin/sh", "status"})
+
+	// spins until it used the second of cpu it's allowed until its timeout
+	pluginCgroups.Lock()
+	pluginCgroups.setUp, pluginCgroups.err = true, fmt.Errorf("no cgroup in tests")
+	pluginCgroups.Unlock()
+	defer func() {
+		pluginCgroups.Lock()
+		pluginCgroups.setUp, pluginCgroups.err = false, nil
+		pluginCgroups.Unlock()
+	}()
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte("#!/bin/sh\nwhile :; do :; done\n"), 0755), IsNil)
+	plugin.Limits, plugin.Timeout = PluginLimits{Cpu: 0.2}, 5*time.Second
+	setTestConfig(func(config *Config) { config.PluginLimits = PluginLimits{} })
+
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+	runPlugin(nil, &Instance{}, plugin, nil)
+	var status *errplane.JsonPoint
+	for _, write := range httpBatcher.take().Writes {
+		if write.Name == "plugins.spin.status" {
+			status = write.Points[0]
+		}
+	}
+	c.Assert(status, NotNil)
+	c.Assert(status.Dimensions["status"], Equals, "unknown")
+	c.Assert(status.Dimensions["status_msg"], Matches, "Killed after using its cpu limit of 0.2 cpus.*")
+}
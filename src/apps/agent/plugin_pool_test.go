@@ -0,0 +1,65 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"sync"
+	"time"
+	. "utils"
+)
+
+type PluginPoolSuite struct{}
+
+var _ = Suite(&PluginPoolSuite{})
+
+func (self *PluginPoolSuite) TestConcurrencyLimit(c *C) {
+	pool := NewPluginPool(2, PLUGIN_OVERLAP_SKIP)
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		wg.Add(1)
+		pool.Submit(key, func() {
+			defer wg.Done()
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+	c.Assert(maxRunning, Equals, 2)
+}
+
+func (self *PluginPoolSuite) TestOverlap(c *C) {
+	for _, overlap := range []string{PLUGIN_OVERLAP_SKIP, PLUGIN_OVERLAP_QUEUE} {
+		pool := NewPluginPool(10, overlap)
+		release := make(chan bool)
+		runs := make(chan bool, 10)
+		run := func() {
+			runs <- true
+			<-release
+		}
+
+		c.Assert(pool.Submit("mysql/", run), Equals, true)
+		<-runs
+		// the first run is still in flight, queued runs are coalesced
+		c.Assert(pool.Submit("mysql/", run), Equals, overlap == PLUGIN_OVERLAP_QUEUE)
+		c.Assert(pool.Submit("mysql/", run), Equals, overlap == PLUGIN_OVERLAP_QUEUE)
+		release <- true
+
+		if overlap == PLUGIN_OVERLAP_QUEUE {
+			<-runs
+			release <- true
+		}
+		for pool.InFlight() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(runs, HasLen, 0)
+	}
+}
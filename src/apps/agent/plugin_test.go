@@ -1,11 +1,18 @@
 package main
 
 import (
+	"github.com/errplane/errplane-go"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"os"
+	"os/exec"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	. "utils"
 )
 
 // Hook up gocheck into the gotest runner.
@@ -13,6 +20,18 @@ func Test(t *testing.T) {
 	TestingT(t)
 }
 
+// installs a copy of the agent configuration with the changes and returns
+// the function restoring the previous configuration. The configuration
+// returned by AgentConfig() is shared with the goroutines of the agent and
+// must not be modified.
+func setTestConfig(change func(config *Config)) func() {
+	previous := AgentConfig()
+	config := *previous
+	change(&config)
+	SetAgentConfig(&config)
+	return func() { SetAgentConfig(previous) }
+}
+
 type AgentSuite struct{}
 
 var _ = Suite(&AgentSuite{})
@@ -90,3 +109,466 @@ func (self *AgentSuite) TestNagiosOutputParsing(c *C) {
 	c.Assert(output.metrics["total_connections_received"], Equals, 1728.0)
 	c.Assert(output.metrics["lru_clock"], Equals, 1231438.0)
 }
+
+func (self *AgentSuite) TestUnknownExitCodes(c *C) {
+	for _, exitCode := range []int{4, 127, 255, -1} {
+		output, err := parseNagiosOutput(&FakeProcessState{exitCode}, "command not found")
+		c.Assert(err, IsNil)
+		c.Assert(output.state, Equals, UNKNOWN)
+		c.Assert(output.state.String(), Equals, "unknown")
+
+		dimensions := errplane.Dimensions{}
+		addExitCodeDimension(dimensions, output)
+		c.Assert(dimensions["exit_code"], Equals, strconv.Itoa(exitCode))
+	}
+
+	// the nagios exit codes don't need the dimension
+	output, err := parseNagiosOutput(&FakeProcessState{2}, "Critical: process not running")
+	c.Assert(err, IsNil)
+	dimensions := errplane.Dimensions{}
+	addExitCodeDimension(dimensions, output)
+	c.Assert(dimensions, HasLen, 0)
+
+	state := PluginStateOutput(42)
+	c.Assert(state.String(), Equals, "unknown")
+}
+
+func (self *AgentSuite) TestMultiLineOutputParsing(c *C) {
+	nagios := &PluginMetadata{Name: "disk", Output: "nagios"}
+	msg := "DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);\n/boot 68 MB (69%); | /boot=68MB;88;93;0;98\n/home=69357MB;253404;253409;0;253414\n"
+	output, err := parsePluginOutput(nagios, &FakeProcessState{0}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.msg, Equals, "DISK OK - free space: / 3326 MB (56%);")
+	c.Assert(output.metrics, DeepEquals, map[string]float64{"/": 2643, "/boot": 68, "/home": 69357})
+	c.Assert(pluginDetail(nagios, msg), Equals, "/ 15272 MB (77%);\n/boot 68 MB (69%);")
+
+	errplanePlugin := &PluginMetadata{Name: "queues", Output: "errplane"}
+	msg = "OK | [{\"n\": \"jobs\", \"p\": [{\"v\": 1}]}]\n3 queues checked\n" +
+		"[{\"n\": \"workers\", \"p\": [{\"v\": 2}]}]\n{\"n\": \"failed\", \"p\": [{\"v\": 3}]}\n"
+	output, err = parsePluginOutput(errplanePlugin, &FakeProcessState{0}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.msg, Equals, "OK")
+	c.Assert(output.points, HasLen, 3)
+	c.Assert(output.points[1].Name, Equals, "workers")
+	c.Assert(output.points[2].Points[0].Value, Equals, 3.0)
+	c.Assert(pluginDetail(errplanePlugin, msg), Equals, "3 queues checked")
+
+	_, err = parsePluginOutput(errplanePlugin, &FakeProcessState{0}, "OK\n[not json")
+	c.Assert(err, NotNil)
+}
+
+func (self *AgentSuite) TestStatusMessageInterpolation(c *C) {
+	output, err := parseNagiosOutput(&FakeProcessState{1}, "DISK WARNING|used_pct=91.234% free_gb=12.5GB")
+	c.Assert(err, IsNil)
+	values := pluginMessageValues(output, &Instance{Name: "root"})
+
+	msg := interpolateMessage("disk {{instance}} is {{used_pct:1}}% full, {{ free_gb }}GB free ({{status}})", values)
+	c.Assert(msg, Equals, "disk root is 91.2% full, 12.5GB free (warning)")
+
+	// unknown placeholders are left untouched
+	c.Assert(interpolateMessage("{{output}}, {{foo}}", values), Equals, "DISK WARNING, {{foo}}")
+}
+
+func (self *AgentSuite) TestPluginOutputSanitizing(c *C) {
+	output := sanitizePluginOutput([]byte("\x1b[1;31mCRITICAL\x1b[0m: caf\xe9 is down\r\nline 2\x07\r\n\x1b]0;title\x07line 3\n"))
+	summary, detail := splitPluginOutput(output)
+	c.Assert(summary, Equals, "CRITICAL: café is down")
+	c.Assert(detail, Equals, "line 2\nline 3")
+
+	// valid utf-8 is left untouched
+	summary, detail = splitPluginOutput(sanitizePluginOutput([]byte("OK: 日本語 ✓")))
+	c.Assert(summary, Equals, "OK: 日本語 ✓")
+	c.Assert(detail, Equals, "")
+
+	c.Assert(truncateUtf8("日本語", 4), Equals, "日")
+	c.Assert(truncateUtf8("abc", 4), Equals, "abc")
+}
+
+func (self *AgentSuite) TestSandboxCommand(c *C) {
+	plugin := &PluginMetadata{Name: "mysql", Path: "/data/errplane-agent/plugins/mysql"}
+
+	_, _, container := sandboxCommand(plugin, "/data/errplane-agent/plugins/mysql/status", nil, nil)
+	c.Assert(container, Equals, "")
+
+	defer setTestConfig(func(config *Config) {
+		config.PluginSandboxes = map[string]*PluginSandbox{
+			"mysql": &PluginSandbox{Runtime: "podman", Image: "python:2.7", Mounts: []string{"/var/lib/mysql"}, Network: "none"},
+		}
+	})()
+	name, args, container := sandboxCommand(plugin, "/data/errplane-agent/plugins/mysql/status", []string{"--port", "3306"}, []string{"MYSQL_PWD=secret"})
+	c.Assert(name, Equals, "podman")
+	c.Assert(container, Matches, "errplane-plugin-mysql-[0-9a-f]{8}")
+	joined := strings.Join(args, " ")
+	c.Assert(strings.Contains(joined, "-v /var/lib/mysql:/var/lib/mysql:ro"), Equals, true)
+	c.Assert(strings.Contains(joined, "-v /data/errplane-agent/plugins/mysql:/data/errplane-agent/plugins/mysql:ro"), Equals, true)
+	c.Assert(strings.Contains(joined, "-e MYSQL_PWD "), Equals, true)
+	c.Assert(strings.Contains(joined, "secret"), Equals, false)
+	c.Assert(strings.HasSuffix(joined, "--entrypoint /data/errplane-agent/plugins/mysql/status python:2.7 --port 3306"), Equals, true)
+}
+
+func (self *AgentSuite) TestRemoteCommand(c *C) {
+	plugin := &PluginMetadata{Name: "switch", Path: "/data/errplane-agent/plugins/switch"}
+	remote := &RemoteTarget{Host: "switch1", User: "monitor", Port: 2222, Key: "/etc/errplane-agent/id_rsa", Command: "show status"}
+
+	name, args, err := remoteCommand(plugin, remote, "/data/errplane-agent/plugins/switch/status", []string{"--it's", "quoted"})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "ssh")
+	c.Assert(args, DeepEquals, []string{
+		"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-p", "2222", "-i", "/etc/errplane-agent/id_rsa",
+		"monitor@switch1", `show status '--it'\''s' 'quoted'`,
+	})
+}
+
+func (self *AgentSuite) TestInfluxdbOutputParsing(c *C) {
+	output := `# comment
+cpu,host=server\ 01,region=us-west usage_idle=92.5,usage_user=5i,running=true,note="a, b" 1434055562000000000
+temperature value=21.5
+invalid line
+`
+	parsed, err := parseInfluxdbOutput(&FakeProcessState{0}, output)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.state, Equals, OK)
+	c.Assert(parsed.points, HasLen, 4)
+
+	c.Assert(parsed.points[0].Name, Equals, "cpu.running")
+	c.Assert(parsed.points[0].Points[0].Value, Equals, 1.0)
+	c.Assert(parsed.points[1].Name, Equals, "cpu.usage_idle")
+	c.Assert(parsed.points[1].Points[0].Value, Equals, 92.5)
+	c.Assert(parsed.points[1].Points[0].Time, Equals, int64(1434055562))
+	c.Assert(parsed.points[1].Points[0].Dimensions["host"], Equals, "server 01")
+	c.Assert(parsed.points[1].Points[0].Dimensions["region"], Equals, "us-west")
+	c.Assert(parsed.points[2].Name, Equals, "cpu.usage_user")
+	c.Assert(parsed.points[2].Points[0].Value, Equals, 5.0)
+	c.Assert(parsed.points[3].Name, Equals, "temperature")
+	c.Assert(parsed.points[3].Points[0].Value, Equals, 21.5)
+
+	_, err = parseInfluxdbOutput(&FakeProcessState{0}, "invalid line")
+	c.Assert(err, NotNil)
+}
+
+func (self *AgentSuite) TestPluginInterval(c *C) {
+	defer setTestConfig(func(config *Config) { config.Sleep = 10 * time.Second })()
+
+	disk := &PluginMetadata{Name: "disk", Interval: 5 * time.Minute}
+	redis := &PluginMetadata{Name: "redis"}
+	config := &AgentConfiguration{Plugins: map[string][]*Instance{
+		"disk": nil,
+		"redis": []*Instance{
+			&Instance{Name: "cache", Args: map[string]string{"port": "6379"}},
+			&Instance{Name: "queue", Args: map[string]string{"port": "6380"}, Interval: "1m"},
+			&Instance{Name: "typo", Args: map[string]string{"port": "6381"}, Interval: "1x"},
+			&Instance{Name: "duplicate", Args: map[string]string{"port": "6379"}},
+		},
+		"missing": nil,
+	}}
+
+	scheduled := schedulePlugins(config, map[string]*PluginMetadata{"disk": disk, "redis": redis})
+	intervals := make(map[string]time.Duration)
+	for _, s := range scheduled {
+		c.Assert(s.key, Equals, s.plugin.Name+"/"+instanceId(s.plugin.Name, s.instance))
+		intervals[s.plugin.Name+"/"+s.instance.Name] = s.interval
+	}
+	c.Assert(intervals, DeepEquals, map[string]time.Duration{
+		"disk/":       5 * time.Minute,
+		"redis/cache": 10 * time.Second,
+		"redis/queue": time.Minute,
+		"redis/typo":  10 * time.Second,
+	})
+}
+
+func (self *AgentSuite) TestPluginTimeout(c *C) {
+	dir := path.Join(c.MkDir(), "slow")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\ntimeout: 2m\n"), 0644), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Timeout, Equals, 2*time.Minute)
+
+	c.Assert(pluginTimeout(plugin, &Instance{}), Equals, 2*time.Minute)
+	c.Assert(pluginTimeout(plugin, &Instance{Timeout: "5s"}), Equals, 5*time.Second)
+	c.Assert(pluginTimeout(plugin, &Instance{Timeout: "5x"}), Equals, 2*time.Minute)
+	c.Assert(pluginTimeout(&PluginMetadata{Name: "fast"}, &Instance{}), Equals, PLUGIN_DEFAULT_TIMEOUT)
+
+	cmd := exec.Command("sleep", "10")
+	c.Assert(cmd.Start(), IsNil)
+	ch := make(chan error, 1)
+	c.Assert(killPlugin("sleep", cmd, ch, 100*time.Millisecond), Equals, true)
+	cmd.Wait()
+
+	cmd = exec.Command("true")
+	c.Assert(cmd.Start(), IsNil)
+	ch <- cmd.Wait()
+	c.Assert(killPlugin("true", cmd, ch, time.Minute), Equals, false)
+}
+
+func (self *AgentSuite) TestPluginUsage(c *C) {
+	c.Assert(pluginUsage(nil), IsNil)
+
+	// the usage includes the children the plugin waited for
+	cmd := exec.Command("sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done; true")
+	c.Assert(cmd.Run(), IsNil)
+	usage := pluginUsage(cmd.ProcessState)
+	c.Assert(usage, NotNil)
+	c.Assert(usage.UserCpu+usage.SysCpu > 0, Equals, true)
+	c.Assert(usage.MaxRss > 0, Equals, true)
+}
+
+func (self *AgentSuite) TestCounterRate(c *C) {
+	rate, reset := counterRate(100, 160, 30)
+	c.Assert(rate, Equals, 2.0)
+	c.Assert(reset, Equals, false)
+
+	// the process restarted, the counter started again from zero
+	rate, reset = counterRate(4294967000, 60, 30)
+	c.Assert(rate, Equals, 2.0)
+	c.Assert(reset, Equals, true)
+}
+
+func (self *AgentSuite) TestPrometheusOutputParsing(c *C) {
+	output := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+# TYPE temperature gauge
+temperature{sensor="a \"quoted\" \\ name"} 21.5
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 24054
+request_duration_seconds_bucket{le="+Inf"} 33444
+request_duration_seconds_sum 53423
+request_duration_seconds_count 33444
+nan_metric NaN
+`
+	parsed, err := parsePrometheusOutput(&FakeProcessState{0}, output)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.points, HasLen, 5)
+
+	c.Assert(parsed.points[0].Name, Equals, "http_requests_total")
+	c.Assert(parsed.points[0].Points, HasLen, 2)
+	c.Assert(parsed.points[0].Points[1].Value, Equals, 3.0)
+	c.Assert(parsed.points[0].Points[1].Time, Equals, int64(1395066363))
+	c.Assert(parsed.points[0].Points[1].Dimensions, DeepEquals, errplane.Dimensions{"method": "post", "code": "400"})
+
+	c.Assert(parsed.points[1].Points[0].Dimensions["sensor"], Equals, `a "quoted" \ name`)
+	c.Assert(parsed.points[2].Name, Equals, "request_duration_seconds_bucket")
+	c.Assert(parsed.points[2].Points[1].Dimensions["le"], Equals, "+Inf")
+	c.Assert(parsed.points[4].Name, Equals, "request_duration_seconds_count")
+
+	_, err = parsePrometheusOutput(&FakeProcessState{0}, `broken{label="x} 1`)
+	c.Assert(err, NotNil)
+}
+
+func (self *AgentSuite) TestPluginArgsValidation(c *C) {
+	content := `output: nagios
+arguments:
+  - name: host
+    required: true
+  - name: port
+    type: int
+    default_value: "3306"
+  - name: password
+    secret: true
+`
+	dir := path.Join(c.MkDir(), "mysql")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte(content), 0644), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Arguments, HasLen, 3)
+
+	args, err := validatePluginArgs(plugin, &Instance{Args: map[string]string{"host": "db1", "password": "secret"}})
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, map[string]string{"host": "db1", "port": "3306", "password": "secret"})
+
+	_, err = validatePluginArgs(plugin, &Instance{Args: map[string]string{"port": "3306"}})
+	c.Assert(err, ErrorMatches, "Missing required argument 'host'")
+	_, err = validatePluginArgs(plugin, &Instance{Args: map[string]string{"host": "db1", "port": "abc"}})
+	c.Assert(err, ErrorMatches, "Argument port must be of type int, got 'abc'")
+	_, err = validatePluginArgs(plugin, &Instance{Args: map[string]string{"host": "db1", "prot": "3306"}})
+	c.Assert(err, ErrorMatches, "Unknown argument 'prot'")
+
+	// the instance isn't run and reported as unknown
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+	runPlugin(nil, &Instance{Name: "replica", Args: map[string]string{"port": "3306"}}, plugin, nil)
+	writes := httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.mysql.status")
+	c.Assert(writes[0].Points[0].Dimensions["status"], Equals, "unknown")
+	c.Assert(writes[0].Points[0].Dimensions["status_msg"], Equals, "Missing required argument 'host'")
+
+	c.Assert(loggableArgs(plugin, []string{"--host", "db1", "--password", "secret"}), Equals, "--host db1 --password ****")
+}
+
+func (self *AgentSuite) TestPluginEnvValidation(c *C) {
+	content := `output: nagios
+environment:
+  - name: MYSQL_PWD
+    required: true
+    secret: true
+  - name: MYSQL_PORT
+    type: int
+    default_value: "3306"
+`
+	dir := path.Join(c.MkDir(), "mysql")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte(content), 0644), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Environment, HasLen, 2)
+
+	env, err := validatePluginEnv(plugin, &Instance{Env: map[string]string{"MYSQL_PWD": "secret"}})
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, []string{"MYSQL_PORT=3306", "MYSQL_PWD=secret"})
+
+	_, err = validatePluginEnv(plugin, &Instance{})
+	c.Assert(err, ErrorMatches, "Missing required environment variable 'MYSQL_PWD'")
+	_, err = validatePluginEnv(plugin, &Instance{Env: map[string]string{"MYSQL_PWD": "secret", "MYSQL_HOST": "db1"}})
+	c.Assert(err, ErrorMatches, "Unknown environment variable 'MYSQL_HOST'")
+	_, err = validatePluginEnv(plugin, &Instance{Env: map[string]string{"MYSQL_PWD": "secret"}, Remote: &RemoteTarget{Host: "db1"}})
+	c.Assert(err, NotNil)
+
+	// undeclared environments accept anything but the variables of the agent
+	undeclared := &PluginMetadata{Name: "redis", Output: "nagios"}
+	env, err = validatePluginEnv(undeclared, &Instance{Env: map[string]string{"REDISCLI_AUTH": "secret"}})
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, []string{"REDISCLI_AUTH=secret"})
+	_, err = validatePluginEnv(undeclared, &Instance{Env: map[string]string{"ERRPLANE_FORMAT_VERSION": "2"}})
+	c.Assert(err, ErrorMatches, "Environment variable 'ERRPLANE_FORMAT_VERSION' is reserved for the agent")
+	_, err = validatePluginEnv(undeclared, &Instance{Env: map[string]string{"NOT-VALID": "1"}})
+	c.Assert(err, ErrorMatches, "Invalid environment variable name 'NOT-VALID'")
+
+	// the instance isn't run and reported as unknown
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+	runPlugin(nil, &Instance{Name: "replica"}, plugin, nil)
+	writes := httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.mysql.status")
+	c.Assert(writes[0].Points[0].Dimensions["status"], Equals, "unknown")
+	c.Assert(writes[0].Points[0].Dimensions["status_msg"], Equals, "Missing required environment variable 'MYSQL_PWD'")
+}
+
+func (self *AgentSuite) TestArgsTemplating(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.Facts = map[string]string{"mysql.socket": "/var/run/mysqld/mysqld.sock"}
+	})()
+
+	instance := &Instance{Args: map[string]string{"socket": `{{fact "mysql.socket"}}`}, ArgsList: []string{"--os", `{{fact "os"}}`}}
+	rendered, err := renderInstanceArgs(instance)
+	c.Assert(err, IsNil)
+	c.Assert(rendered.Args, DeepEquals, map[string]string{"socket": "/var/run/mysqld/mysqld.sock"})
+	c.Assert(rendered.ArgsList, DeepEquals, []string{"--os", runtime.GOOS})
+	// the original instance is left untouched
+	c.Assert(instance.Args["socket"], Equals, `{{fact "mysql.socket"}}`)
+
+	_, err = renderInstanceArgs(&Instance{Args: map[string]string{"socket": `{{fact "postgres.socket"}}`}})
+	c.Assert(err, ErrorMatches, ".*Unknown fact 'postgres.socket'")
+}
+
+func (self *AgentSuite) TestInstanceIdentity(c *C) {
+	id := instanceId("mysql", &Instance{Args: map[string]string{"host": "db1", "port": "3306"}})
+	c.Assert(id, HasLen, 12)
+	// the name isn't part of the identity, the arguments are
+	c.Assert(instanceId("mysql", &Instance{Name: "db1", Args: map[string]string{"port": "3306", "host": "db1"}}), Equals, id)
+	c.Assert(instanceId("mysql", &Instance{Args: map[string]string{"host": "db2", "port": "3306"}}), Not(Equals), id)
+	c.Assert(instanceId("postgres", &Instance{Args: map[string]string{"host": "db1", "port": "3306"}}), Not(Equals), id)
+
+	dimensions := errplane.Dimensions{}
+	addInstanceDimensions(dimensions, id, DEFAULT_INSTANCES[0])
+	c.Assert(dimensions, DeepEquals, errplane.Dimensions{"instance_id": id})
+
+	defer setTestConfig(func(config *Config) { config.LegacyInstanceDimensions = true })()
+	dimensions = errplane.Dimensions{}
+	addInstanceDimensions(dimensions, id, &Instance{Name: "db1"})
+	c.Assert(dimensions, DeepEquals, errplane.Dimensions{"instance": "db1"})
+}
+
+func (self *AgentSuite) TestWindowsStatusScripts(c *C) {
+	dir := c.MkDir()
+	c.Assert(pluginStatusScript(dir, "linux"), Equals, path.Join(dir, "status"))
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status.bat"), nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status.ps1"), nil, 0644), IsNil)
+	script := pluginStatusScript(dir, "windows")
+	c.Assert(script, Equals, path.Join(dir, "status.ps1"))
+
+	name, args := scriptCommand(script, []string{"-host", "db1"})
+	c.Assert(name, Equals, "powershell.exe")
+	c.Assert(args, DeepEquals, []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", script, "-host", "db1"})
+	name, args = scriptCommand(`C:\plugins\iis\STATUS.CMD`, nil)
+	c.Assert(name, Equals, "cmd.exe")
+	c.Assert(args, DeepEquals, []string{"/C", `C:\plugins\iis\STATUS.CMD`})
+	name, _ = scriptCommand(path.Join(dir, "status"), nil)
+	c.Assert(name, Equals, path.Join(dir, "status"))
+}
+
+func (self *AgentSuite) TestPluginCompatibility(c *C) {
+	defer func(version string) { agentVersion = version }(agentVersion)
+	agentVersion = "1.4.2"
+
+	dir := path.Join(c.MkDir(), "compat-new")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\nmin_agent_version: 1.10.0\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte("#!/bin/sh\necho 'OK: all good'\n"), 0755), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(checkPluginCompatibility(plugin), ErrorMatches, "The plugin requires agent 1.10.0 or newer, this agent is 1.4.2")
+
+	// the plugin isn't run and reported as unknown
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+	runPlugin(nil, &Instance{}, plugin, nil)
+	writes := httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.compat-new.status")
+	c.Assert(writes[0].Points[0].Dimensions["status"], Equals, "unknown")
+	c.Assert(writes[0].Points[0].Dimensions["status_msg"], Matches, "The plugin requires agent 1.10.0.*")
+
+	plugin.MinAgentVersion = "1.4"
+	plugin.Capabilities = []string{CAPABILITY_JSON_OUTPUT, "daemon-mode"}
+	c.Assert(checkPluginCompatibility(plugin), ErrorMatches, "The plugin requires daemon-mode, which this agent \\(1.4.2\\) doesn't support")
+	plugin.Capabilities = []string{CAPABILITY_JSON_OUTPUT}
+	c.Assert(checkPluginCompatibility(plugin), IsNil)
+
+	incompatible := incompatiblePlugins(map[string]*PluginMetadata{
+		"mysql": plugin,
+		"redis": &PluginMetadata{Name: "redis", MinAgentVersion: "2.0"},
+	})
+	c.Assert(incompatible, HasLen, 1)
+	c.Assert(incompatible["redis"], Matches, ".*agent 2.0 or newer.*")
+
+	agentVersion = "dev"
+	c.Assert(checkPluginCompatibility(&PluginMetadata{MinAgentVersion: "2.0"}), IsNil)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\nmin_agent_version: latest\n"), 0644), IsNil)
+	_, err = parsePluginInfo(dir)
+	c.Assert(err, ErrorMatches, "Invalid min_agent_version 'latest'.*")
+}
+
+func (self *AgentSuite) TestMissedRunMarkers(c *C) {
+	defer setTestConfig(func(config *Config) { config.MissedMarkers = nil })()
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+
+	mysql := &PluginMetadata{Name: "mysql"}
+	reportMissedRun(nil, mysql, &Instance{Name: "db1"}, MISSED_OVERRUN, time.Now())
+	c.Assert(httpBatcher.take(), IsNil)
+
+	setTestConfig(func(config *Config) { config.MissedMarkers = []string{"my*"} })
+	reportMissedRun(nil, mysql, &Instance{Name: "db1"}, MISSED_OVERRUN, time.Now())
+	writes := httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.mysql.missed")
+	c.Assert(writes[0].Points[0].Context, Equals, "Skipped, the previous run is still in progress")
+	c.Assert(writes[0].Points[0].Dimensions["reason"], Equals, MISSED_OVERRUN)
+	c.Assert(writes[0].Points[0].Dimensions["instance"], Equals, "db1")
+
+	redis := &PluginMetadata{Name: "redis", MissedMarkers: true}
+	reportMissedRun(nil, redis, &Instance{}, MISSED_INCOMPATIBLE, time.Now())
+	writes = httpBatcher.take().Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Name, Equals, "plugins.redis.missed")
+}
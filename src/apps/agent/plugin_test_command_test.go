@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+)
+
+type PluginTestCommandSuite struct{}
+
+var _ = Suite(&PluginTestCommandSuite{})
+
+func (self *PluginTestCommandSuite) TestTestPlugin(c *C) {
+	dir := path.Join(c.MkDir(), "load")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\n"), 0644), IsNil)
+	script := "#!/bin/sh\necho \"WARNING: load is $2|load=1.5\"\necho oops >&2\nexit 1\n"
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte(script), 0755), IsNil)
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(testPlugin(out, dir, []string{"--threshold", "high"}), Equals, 0)
+	c.Assert(out.String(), Matches, "(?s).*Exit:      1 after.*")
+	c.Assert(out.String(), Matches, "(?s).*--- stderr\noops\n.*")
+	c.Assert(out.String(), Matches, "(?s).*state:   warning\nmessage: WARNING: load is high\n.*")
+	c.Assert(out.String(), Matches, `(?s).*plugins\.load\.load 1\.5 host=.*`)
+
+	out.Reset()
+	c.Assert(testPlugin(out, path.Join(c.MkDir(), "missing"), nil), Equals, 1)
+}
+
+func (self *PluginTestCommandSuite) TestTestInstance(c *C) {
+	instance := testInstance([]string{"--port", "6379", "-v", "--flag"})
+	c.Assert(instance.Args, DeepEquals, map[string]string{"port": "6379"})
+	c.Assert(instance.ArgsList, DeepEquals, []string{"-v", "--flag"})
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"os/user"
+	"path"
+	"time"
+	. "utils"
+)
+
+func (self *AgentSuite) TestRunAs(c *C) {
+	defer setTestConfig(func(config *Config) { config.PluginRunAs = "nagios" })()
+	c.Assert(pluginRunAs(&PluginMetadata{}), Equals, "nagios")
+	c.Assert(pluginRunAs(&PluginMetadata{RunAs: "mysql:monitor"}), Equals, "mysql:monitor")
+
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	runAs, err := lookupPluginUser(current.Username)
+	c.Assert(err, IsNil)
+	c.Assert(runAs, IsNil)
+	_, err = lookupPluginUser("no-such-user")
+	c.Assert(err, ErrorMatches, "Cannot find the run_as user 'no-such-user'.*")
+	if os.Geteuid() != 0 {
+		_, err = lookupPluginUser("nobody")
+		c.Assert(err, ErrorMatches, "The agent must run as root to run plugins as 'nobody'")
+		return
+	}
+
+	nobody, err := user.Lookup("nobody")
+	c.Assert(err, IsNil)
+	// the parents of c.MkDir() aren't readable by nobody
+	dir, err := ioutil.TempDir("", "run-as")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	c.Assert(os.Chmod(dir, 0755), IsNil)
+	script := "#!/bin/sh\necho \"OK: running as $(id -u) in $HOME\"\n"
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte(script), 0755), IsNil)
+	plugin := &PluginMetadata{Name: "whoami", Path: dir, Output: "nagios", RunAs: "nobody"}
+
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+	runPlugin(nil, &Instance{}, plugin, nil)
+	var status *errplane.JsonPoint
+	for _, write := range httpBatcher.take().Writes {
+		if write.Name == "plugins.whoami.status" {
+			status = write.Points[0]
+		}
+	}
+	c.Assert(status, NotNil)
+	c.Assert(status.Dimensions["status_msg"], Matches, ".*running as "+nobody.Uid+" in "+nobody.HomeDir+".*")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	. "utils"
+)
+
+type OutputValidationSuite struct{}
+
+var _ = Suite(&OutputValidationSuite{})
+
+func (self *OutputValidationSuite) TestNagiosOutput(c *C) {
+	for _, output := range []string{
+		"OK",
+		"OK | time=0.06s;1;5;0 size=1024B;;;0 'free space'=56%;@10:20;~:5 count=3c",
+		"DISK OK | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);\n/boot 68 MB (69%); | /boot=68MB;88;93;0;98\n/home=69357MB",
+		"OK | 'it''s'=1 load=U",
+	} {
+		c.Assert(validateNagiosOutput(output), IsNil, Commentf(output))
+	}
+
+	for output, message := range map[string]string{
+		"OK | time=12x":                "line 1, column 13: expected a unit of measurement .*, found 'x'",
+		"OK | time 12":                 "line 1, column 10: expected '=' after the label, found ' '",
+		"OK | time=":                   "line 1, column 11: expected a number, found the end of the line",
+		"OK | time=1s;abc":             "line 1, column 14: expected a range, ';' or a space, found 'abc'",
+		"OK | time=1s;1;2;0;10;3":      "line 1, column 22: expected a space after max, found ';'",
+		"OK | 'free space=1":           "line 1, column 19: expected a closing ' after the label, found the end of the line",
+		"OK | a=1 | b=2":               "line 1, column 10: expected a single \\| before the performance data, found another '\\|'",
+		"OK\ndetail | a=1\nb=one":      "line 3, column 3: expected a number, found 'one'",
+		"OK | =1":                      "line 1, column 6: expected a label, found '='",
+		"OK | size=10Mb;;;0;100 age=1": "line 1, column 13: expected a unit of measurement .*, found 'Mb'",
+	} {
+		c.Assert(validateNagiosOutput(output), ErrorMatches, message, Commentf(output))
+	}
+}
+
+func (self *OutputValidationSuite) TestErrplaneOutput(c *C) {
+	pipe := &PluginMetadata{Output: "errplane"}
+	c.Assert(validatePluginOutput(pipe, `OK | [{"n": "connections", "p": [{"v": 12, "t": 1400000000, "d": {"db": "users"}}]}]`), IsNil)
+	c.Assert(validatePluginOutput(pipe, "OK\nsome detail\n[{\"n\": \"connections\", \"p\": [{\"v\": 12}]}]\n{\"n\": \"queries\", \"p\": [{\"v\": 3}]}"), IsNil)
+
+	for output, message := range map[string]string{
+		`OK | [{"n": "connections", "p": [{"v": 12}]]`:         `line 1, column 44: expected ',' or '}', found ']'`,
+		`OK | [{"n": "connections", "p": [{"v": "12"}]}]`:      `line 1, at \[0\]\.p\[0\]\.v: expected a number, found a string`,
+		`OK | [{"n": "connections", "p": [{"v": 1, "x": 2}]}]`: `line 1, at \[0\]\.p\[0\]\.x: expected one of the fields c, d, t, v, found an unknown field`,
+		`OK | [{"p": []}]`:          `line 1, at \[0\]\.n: expected the required field n, found no such field`,
+		`OK | [{"n": "", "p": []}]`: `line 1, at \[0\]\.n: expected a metric name, found a string`,
+		`OK | {"n": "connections"}`: `line 1, at \.p: expected the required field p, found no such field`,
+		`OK | 12`:                   `line 1, at the top level: expected an array of writes, found a number`,
+		`OK | [{"n": "c", "p": [{"v": 1, "t": 1400000000000}]}]`:                  `line 1, at \[0\]\.p\[0\]\.t: expected seconds since the epoch, found 1400000000000, milliseconds\?`,
+		`OK | [{"n": "c", "p": [{"v": 1, "d": {"db": 1}}]}]`:                      `line 1, at \[0\]\.p\[0\]\.d\.db: expected a string, found a number`,
+		"OK\n[{\"n\": \"c\", \"p\": [{\"v\": 1}]}]\n  [{\"n\": \"c\" \"p\": []}]": `line 3, column 14: expected ',' or '}', found '"'`,
+	} {
+		c.Assert(validatePluginOutput(pipe, output), ErrorMatches, message, Commentf(output))
+	}
+
+	json := &PluginMetadata{Output: "errplane", FormatVersion: FORMAT_VERSION_JSON}
+	c.Assert(validatePluginOutput(json, `{"format_version": 2, "status": "OK", "writes": [{"n": "c", "p": [{"v": 1}]}]}`), IsNil)
+	c.Assert(validatePluginOutput(json, "{\"format_version\": 2,\n \"status\": \"OK\",\n \"writes\": [}"), ErrorMatches, `line 3, column 13: expected beginning of value, found '}'`)
+	c.Assert(validatePluginOutput(json, `{"format_version": 2, "events": [{"title": "Deploy", "d": {"version": 2}}]}`), ErrorMatches, `line 1, at \.events\[0\]\.d\.version: expected a string, found a number`)
+	c.Assert(validatePluginOutput(json, `{"format_version": 1, "status": "OK"}`), ErrorMatches, `line 1, at \.format_version: expected 2 as declared in info.yml, found 1`)
+	c.Assert(validatePluginOutput(json, `{"format_version": 2, "writes": [{"n": "c", "p": [{"v": 1}]}`), ErrorMatches, `line 1, column 61: expected the rest of the json, found the end of the output`)
+
+	ndjson := &PluginMetadata{Output: "errplane", FormatVersion: FORMAT_VERSION_NDJSON}
+	c.Assert(validatePluginOutput(ndjson, "{\"format_version\": 3, \"status\": \"OK\"}\n{\"n\": \"c\", \"p\": [{\"v\": 1, \"d\": {\"db\": \"users\"}}]}\n"), IsNil)
+	c.Assert(validatePluginOutput(ndjson, "{\"format_version\": 3}\n{\"n\": \"c\", \"p\": [{\"v\": 1}]}\n{\"n\": \"c\"}"), ErrorMatches, `line 3, at \.p: expected the required field p, found no such field`)
+	c.Assert(validatePluginOutput(ndjson, "{\"format_version\": 3}\n{\"event\": {\"title\": \"Deploy\", \"severity\": \"warning\"}}"), IsNil)
+	c.Assert(validatePluginOutput(ndjson, "{\"format_version\": 3}\n{\"event\": {\"title\": \"Deploy\", \"severity\": \"high\"}}"), ErrorMatches, `line 2, at \.event\.severity: expected info, warning or critical, found high`)
+	c.Assert(validatePluginOutput(ndjson, "{\"format_version\": 3}\n{\"n\": \"c\", \"p\": []} x"), ErrorMatches, `line 2, column 21: expected the end of the json, found 'x'`)
+
+	// no spec to check
+	c.Assert(validatePluginOutput(&PluginMetadata{Output: "exit-code"}, "anything | goes"), IsNil)
+}
+
+func (self *OutputValidationSuite) TestStrictValidation(c *C) {
+	plugin := &PluginMetadata{Name: "sloppy", Output: "nagios"}
+	output := "OK | time=12x size=10"
+
+	// the parser skips what it cannot read
+	defer setTestConfig(func(config *Config) { config.OutputValidation = OUTPUT_VALIDATION_LENIENT })()
+	parsed, err := parseValidatedPluginOutput(plugin, &FakeProcessState{0}, output)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.metrics, DeepEquals, map[string]float64{"size": 10})
+
+	setTestConfig(func(config *Config) { config.OutputValidation = OUTPUT_VALIDATION_STRICT })
+	_, err = parseValidatedPluginOutput(plugin, &FakeProcessState{0}, output)
+	c.Assert(err, ErrorMatches, "line 1, column 13: expected a unit of measurement .*, found 'x'")
+
+	// info.yml overrides the agent config
+	plugin.OutputValidation = OUTPUT_VALIDATION_LENIENT
+	_, err = parseValidatedPluginOutput(plugin, &FakeProcessState{0}, output)
+	c.Assert(err, IsNil)
+
+	// the position is reported in either mode when the parser gives up
+	_, err = parseValidatedPluginOutput(&PluginMetadata{Output: "errplane"}, &FakeProcessState{0}, `OK | [{"n": "c", "p": [{"v": 1}]]`)
+	c.Assert(err, ErrorMatches, `line 1, column 33: expected ',' or '}', found ']'`)
+}
+
+func (self *OutputValidationSuite) TestTestPluginShowsTheValidationError(c *C) {
+	dir := path.Join(c.MkDir(), "sloppy")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\noutput-validation: strict\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte("#!/bin/sh\necho 'OK | time=12x'\n"), 0755), IsNil)
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(testPlugin(out, dir, nil), Equals, 1)
+	c.Assert(out.String(), Matches, `(?s).*--- parsed output\nCannot parse the output. Error: line 1, column 13: expected a unit of measurement .*, found 'x'.*`)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+var POWER_SUPPLY_DIR = "/sys/class/power_supply"
+
+type PowerSource struct {
+	name      string
+	onBattery bool
+	charge    float64 // percentage, -1 if unknown
+	runtime   float64 // estimated seconds left on battery, -1 if unknown
+}
+
+func readPowerSupplyFile(dir, name string) string {
+	return readTrimmed(path.Join(dir, name))
+}
+
+func readPowerSupplyValue(dir, name string) (float64, bool) {
+	value, err := strconv.ParseFloat(readPowerSupplyFile(dir, name), 64)
+	return value, err == nil
+}
+
+// reads the batteries and upses exposed in sysfs
+func sysfsPowerSources() []*PowerSource {
+	infos, err := ioutil.ReadDir(POWER_SUPPLY_DIR)
+	if err != nil {
+		return nil
+	}
+
+	sources := make([]*PowerSource, 0)
+	for _, info := range infos {
+		dir := path.Join(POWER_SUPPLY_DIR, info.Name())
+		switch readPowerSupplyFile(dir, "type") {
+		case "Battery", "UPS":
+		default:
+			continue
+		}
+		if readPowerSupplyFile(dir, "scope") == "Device" {
+			// batteries of mice, keyboards, etc.
+			continue
+		}
+
+		source := &PowerSource{name: info.Name(), charge: -1, runtime: -1}
+		source.onBattery = readPowerSupplyFile(dir, "status") == "Discharging"
+		if capacity, ok := readPowerSupplyValue(dir, "capacity"); ok {
+			source.charge = capacity
+		}
+		if !source.onBattery {
+			sources = append(sources, source)
+			continue
+		}
+
+		// the estimated runtime is the remaining energy (or charge)
+		// divided by the current power (or current) draw
+		if seconds, ok := readPowerSupplyValue(dir, "time_to_empty_now"); ok {
+			source.runtime = seconds
+		} else if energy, ok := readPowerSupplyValue(dir, "energy_now"); ok {
+			if power, ok := readPowerSupplyValue(dir, "power_now"); ok && power > 0 {
+				source.runtime = energy / power * 3600
+			}
+		} else if charge, ok := readPowerSupplyValue(dir, "charge_now"); ok {
+			if current, ok := readPowerSupplyValue(dir, "current_now"); ok && current > 0 {
+				source.runtime = charge / current * 3600
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// parses the output of upsc, e.g.
+// battery.charge: 100
+// battery.runtime: 1800
+// ups.status: OL CHRG
+func parseUpscOutput(name string, output []byte) *PowerSource {
+	source := &PowerSource{name: name, charge: -1, runtime: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "battery.charge":
+			if charge, err := strconv.ParseFloat(value, 64); err == nil {
+				source.charge = charge
+			}
+		case "battery.runtime":
+			if runtime, err := strconv.ParseFloat(value, 64); err == nil {
+				source.runtime = runtime
+			}
+		case "ups.status":
+			for _, flag := range strings.Fields(value) {
+				if flag == "OB" {
+					source.onBattery = true
+				}
+			}
+		}
+	}
+	return source
+}
+
+func nutPowerSources() []*PowerSource {
+	sources := make([]*PowerSource, 0, len(AgentConfig().Power.NutUps))
+	for _, ups := range AgentConfig().Power.NutUps {
+		output, err := exec.Command("upsc", ups).Output()
+		if err != nil {
+			log.Error("Cannot query ups %s. Error: %s", ups, err)
+			continue
+		}
+		sources = append(sources, parseUpscOutput(ups, output))
+	}
+	return sources
+}
+
+// returns the state of the source given how long it's been running on battery
+func powerState(source *PowerSource, onBatterySince time.Time, now time.Time) (PluginStateOutput, string) {
+	if !source.onBattery {
+		return OK, ""
+	}
+	duration := now.Sub(onBatterySince)
+	msg := fmt.Sprintf("Running on battery for %s", duration/time.Second*time.Second)
+	if duration >= AgentConfig().Power.OnBatteryCriticalAfter {
+		return CRITICAL, msg
+	}
+	return WARNING, msg
+}
+
+func powerStats(ep *errplane.Errplane) {
+	onBatterySince := make(map[string]time.Time)
+
+	for {
+		sources := append(sysfsPowerSources(), nutPowerSources()...)
+		if len(sources) == 0 && len(AgentConfig().Power.NutUps) == 0 {
+			// nothing to monitor on this host
+			return
+		}
+
+		now := time.Now()
+		for _, source := range sources {
+			dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "source": source.name}
+
+			onBattery := 0.0
+			if source.onBattery {
+				onBattery = 1
+				if _, ok := onBatterySince[source.name]; !ok {
+					onBatterySince[source.name] = now
+				}
+			} else {
+				delete(onBatterySince, source.name)
+			}
+			report(ep, "server.power.on_battery", onBattery, now, dimensions, nil)
+			if source.charge >= 0 {
+				report(ep, "server.power.battery.charge", source.charge, now, dimensions, nil)
+			}
+			if source.runtime >= 0 {
+				report(ep, "server.power.battery.runtime", source.runtime, now, dimensions, nil)
+			}
+
+			state, msg := powerState(source, onBatterySince[source.name], now)
+			checkStates.Set(CHECK_POWER, source.name, "", state.String(), msg)
+			report(ep, "server.power.status", 1.0, now, errplane.Dimensions{
+				"host":       AgentConfig().Hostname,
+				"source":     source.name,
+				"status":     state.String(),
+				"status_msg": msg,
+			}, nil)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type PowerSuite struct{}
+
+var _ = Suite(&PowerSuite{})
+
+func writePowerSupply(c *C, dir string, files map[string]string) {
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(path.Join(dir, name), []byte(content+"\n"), 0644), IsNil)
+	}
+}
+
+func (self *PowerSuite) TestSysfsPowerSources(c *C) {
+	POWER_SUPPLY_DIR = c.MkDir()
+	defer func() { POWER_SUPPLY_DIR = "/sys/class/power_supply" }()
+
+	writePowerSupply(c, path.Join(POWER_SUPPLY_DIR, "AC"), map[string]string{"type": "Mains", "online": "0"})
+	writePowerSupply(c, path.Join(POWER_SUPPLY_DIR, "BAT0"), map[string]string{
+		"type": "Battery", "status": "Discharging", "capacity": "80", "energy_now": "40000000", "power_now": "10000000",
+	})
+	writePowerSupply(c, path.Join(POWER_SUPPLY_DIR, "hid-mouse"), map[string]string{"type": "Battery", "scope": "Device", "capacity": "10"})
+
+	sources := sysfsPowerSources()
+	c.Assert(sources, HasLen, 1)
+	c.Assert(sources[0].name, Equals, "BAT0")
+	c.Assert(sources[0].onBattery, Equals, true)
+	c.Assert(sources[0].charge, Equals, 80.0)
+	c.Assert(sources[0].runtime, Equals, 4*3600.0)
+}
+
+func (self *PowerSuite) TestUpscOutput(c *C) {
+	source := parseUpscOutput("ups@localhost", []byte("battery.charge: 95\nbattery.runtime: 1800\nups.status: OB DISCHRG\n"))
+	c.Assert(source.onBattery, Equals, true)
+	c.Assert(source.charge, Equals, 95.0)
+	c.Assert(source.runtime, Equals, 1800.0)
+
+	source = parseUpscOutput("ups@localhost", []byte("battery.charge: 100\nups.status: OL CHRG\n"))
+	c.Assert(source.onBattery, Equals, false)
+	c.Assert(source.runtime, Equals, -1.0)
+}
+
+func (self *PowerSuite) TestPowerState(c *C) {
+	defer setTestConfig(func(config *Config) { config.Power.OnBatteryCriticalAfter = 5 * time.Minute })()
+	now := time.Now()
+
+	state, _ := powerState(&PowerSource{onBattery: false}, time.Time{}, now)
+	c.Assert(state, Equals, OK)
+	state, _ = powerState(&PowerSource{onBattery: true}, now.Add(-time.Minute), now)
+	c.Assert(state, Equals, WARNING)
+	state, msg := powerState(&PowerSource{onBattery: true}, now.Add(-10*time.Minute), now)
+	c.Assert(state, Equals, CRITICAL)
+	c.Assert(msg, Equals, "Running on battery for 10m0s")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	PROBE_DEFAULT_TTL = 30 * time.Second
+	PROBES_DIR        = "/data/errplane-agent/shared/probes"
+)
+
+type probeResult struct {
+	lock    sync.Mutex // held while the probe runs, the other readers wait for its result
+	output  []byte
+	expires time.Time
+}
+
+// Caches the output of expensive probes shared by several plugins or
+// collectors, e.g. docker ps or a cloud api call, so they run at most once
+// per ttl whatever the number of readers
+type ProbeCache struct {
+	lock    sync.Mutex
+	results map[string]*probeResult
+}
+
+var probeCache = NewProbeCache()
+
+func NewProbeCache() *ProbeCache {
+	return &ProbeCache{results: make(map[string]*probeResult)}
+}
+
+// returns the cached output of the probe, or runs it if the output is
+// older than the ttl. Concurrent readers of an expired probe wait for a
+// single run. Failures aren't cached.
+func (self *ProbeCache) Get(key string, ttl time.Duration, probe func() ([]byte, error)) ([]byte, error) {
+	self.lock.Lock()
+	result, ok := self.results[key]
+	if !ok {
+		result = &probeResult{}
+		self.results[key] = result
+	}
+	self.lock.Unlock()
+
+	result.lock.Lock()
+	defer result.lock.Unlock()
+
+	if time.Now().Before(result.expires) {
+		return result.output, nil
+	}
+	output, err := probe()
+	if err != nil {
+		return nil, err
+	}
+	result.output, result.expires = output, time.Now().Add(ttl)
+	return output, nil
+}
+
+// the environment variable the plugin finds the output of the probe in,
+// e.g. ERRPLANE_PROBE_DOCKER_PS
+func probeEnvName(name string) string {
+	return "ERRPLANE_PROBE_" + envNameSuffix(name)
+}
+
+// upper cases the name and replaces anything but letters and digits with _
+func envNameSuffix(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// runs the probes of the plugin that aren't cached and returns the
+// environment variables pointing to their output. Two plugins share a
+// probe if they have the same name and command.
+func pluginProbesEnv(dir string, plugin *PluginMetadata) ([]string, error) {
+	env := make([]string, 0, len(plugin.Probes))
+	for _, probe := range plugin.Probes {
+		command := probe.Command
+		hash := sha256.Sum256([]byte(command))
+		file := path.Join(dir, fmt.Sprintf("%s-%x", probe.Name, hash[:4]))
+		_, err := probeCache.Get(probe.Name+"\x00"+command, probe.Ttl, func() ([]byte, error) {
+			log.Debug("Running probe %s of plugin %s", probe.Name, plugin.Name)
+			output, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				return nil, fmt.Errorf("Probe %s failed. Error: %s", probe.Name, err)
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+			// the plugins may be reading the previous output, replace it atomically
+			if err := ioutil.WriteFile(file+".tmp", output, 0644); err != nil {
+				return nil, err
+			}
+			return output, os.Rename(file+".tmp", file)
+		})
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, probeEnvName(probe.Name)+"="+file)
+	}
+	return env, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+type ProbeCacheSuite struct{}
+
+var _ = Suite(&ProbeCacheSuite{})
+
+func (self *ProbeCacheSuite) TestProbeRunsOncePerTtl(c *C) {
+	cache := NewProbeCache()
+	var lock sync.Mutex
+	runs := 0
+	probe := func() ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		time.Sleep(10 * time.Millisecond)
+		return []byte("output"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output, err := cache.Get("docker-ps", 50*time.Millisecond, probe)
+			c.Check(err, IsNil)
+			c.Check(string(output), Equals, "output")
+		}()
+	}
+	wg.Wait()
+	c.Assert(runs, Equals, 1)
+
+	time.Sleep(60 * time.Millisecond)
+	cache.Get("docker-ps", 50*time.Millisecond, probe)
+	c.Assert(runs, Equals, 2)
+}
+
+func (self *ProbeCacheSuite) TestPluginProbesEnv(c *C) {
+	dir := c.MkDir()
+	probe := &PluginProbe{Name: "docker-ps", Command: "echo containers", Ttl: time.Minute}
+	env, err := pluginProbesEnv(dir, &PluginMetadata{Name: "docker", Probes: []*PluginProbe{probe}})
+	c.Assert(err, IsNil)
+	c.Assert(env, HasLen, 1)
+	parts := strings.SplitN(env[0], "=", 2)
+	c.Assert(parts[0], Equals, "ERRPLANE_PROBE_DOCKER_PS")
+	content, err := ioutil.ReadFile(parts[1])
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "containers\n")
+
+	// another plugin with the same probe reuses the output
+	other, err := pluginProbesEnv(dir, &PluginMetadata{Name: "containers", Probes: []*PluginProbe{probe}})
+	c.Assert(err, IsNil)
+	c.Assert(other, DeepEquals, env)
+
+	failing := &PluginProbe{Name: "broken", Command: "exit 1", Ttl: time.Minute}
+	_, err = pluginProbesEnv(dir, &PluginMetadata{Name: "broken", Probes: []*PluginProbe{failing}})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,7 @@
+//go:build linux
+// +build linux
+
+package main
+
+// the disk io, network and watched process stats are read from /proc
+const PROC_STATS = true
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// there's no /proc with the disk io, network and process stats, sigar
+// collects the other system metrics
+const PROC_STATS = false
@@ -0,0 +1,311 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// the clock ticks per second of the cpu times in /proc/<pid>/stat
+const PROC_CLOCK_TICKS = 100
+
+var procRoot = "/proc"
+
+// A process as read from /proc, the pid and the start time identify it
+// since pids are reused
+type WatchedProcess struct {
+	Pid       int
+	Name      string
+	Cmdline   string
+	Uid       string
+	StartTime uint64 // in clock ticks since boot
+	CpuTicks  uint64 // user and system
+	Rss       int64  // in bytes
+	Threads   int
+	Fds       int
+}
+
+func (self *WatchedProcess) Id() string {
+	return fmt.Sprintf("%d:%d", self.Pid, self.StartTime)
+}
+
+func readWatchedProcess(pid int) (*WatchedProcess, error) {
+	dir := path.Join(procRoot, strconv.Itoa(pid))
+	stat, err := ioutil.ReadFile(path.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// the name is between parentheses and can contain spaces and parentheses
+	open, closing := strings.Index(string(stat), "("), strings.LastIndex(string(stat), ")")
+	if open < 0 || closing < open {
+		return nil, fmt.Errorf("%s/stat doesn't have the expected format", dir)
+	}
+	fields := strings.Fields(string(stat[closing+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("%s/stat doesn't have the expected format. Expected at least 22 fields found %d", dir, len(fields)+2)
+	}
+	process := &WatchedProcess{Pid: pid, Name: string(stat[open+1 : closing])}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	process.CpuTicks = utime + stime
+	process.StartTime, _ = strconv.ParseUint(fields[19], 10, 64)
+
+	status, err := ioutil.ReadFile(path.Join(dir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		values := strings.Fields(line)
+		if len(values) < 2 {
+			continue
+		}
+		switch values[0] {
+		case "Uid:":
+			process.Uid = values[1]
+		case "Threads:":
+			process.Threads, _ = strconv.Atoi(values[1])
+		case "VmRSS:":
+			rss, _ := strconv.ParseInt(values[1], 10, 64)
+			process.Rss = rss * 1024
+		}
+	}
+
+	if cmdline, err := ioutil.ReadFile(path.Join(dir, "cmdline")); err == nil {
+		process.Cmdline = strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+	}
+	// the descriptors of the processes of other users can't be listed
+	// unless the agent runs as root
+	if fds, err := ioutil.ReadDir(path.Join(dir, "fd")); err == nil {
+		process.Fds = len(fds)
+	}
+	return process, nil
+}
+
+// reads the processes in /proc, the ones that exit meanwhile are skipped
+func readWatchedProcesses() ([]*WatchedProcess, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	processes := make([]*WatchedProcess, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if process, err := readWatchedProcess(pid); err == nil {
+			processes = append(processes, process)
+		}
+	}
+	return processes, nil
+}
+
+// returns the uid of the user, the user is taken as a uid if it's not found
+func lookupUid(name string) string {
+	if account, err := user.Lookup(name); err == nil {
+		return account.Uid
+	}
+	return name
+}
+
+// returns the processes of the watch, sorted by pid
+func matchWatchedProcesses(watch *ProcessWatch, processes []*WatchedProcess) []*WatchedProcess {
+	pid := 0
+	if watch.Pidfile != "" {
+		content, err := ioutil.ReadFile(watch.Pidfile)
+		if err != nil {
+			log.Debug("Cannot read the pidfile %s of process %s. Error: %s", watch.Pidfile, watch.Name, err)
+			return nil
+		}
+		if pid, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+			log.Warn("Invalid pidfile %s of process %s", watch.Pidfile, watch.Name)
+			return nil
+		}
+	}
+	uid := ""
+	if watch.User != "" {
+		uid = lookupUid(watch.User)
+	}
+
+	matched := make([]*WatchedProcess, 0)
+	for _, process := range processes {
+		switch {
+		case uid != "" && process.Uid != uid:
+		case pid != 0 && process.Pid != pid:
+		case watch.NameRegex != nil && !watch.NameRegex.MatchString(process.Name):
+		case watch.Cmdline != nil && !watch.Cmdline.MatchString(process.Cmdline):
+		default:
+			matched = append(matched, process)
+		}
+	}
+	sort.Sort(WatchedProcessesSortableByPid(matched))
+	return matched
+}
+
+type WatchedProcessesSortableByPid []*WatchedProcess
+
+func (self WatchedProcessesSortableByPid) Len() int           { return len(self) }
+func (self WatchedProcessesSortableByPid) Less(i, j int) bool { return self[i].Pid < self[j].Pid }
+func (self WatchedProcessesSortableByPid) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// the events of a watch
+const (
+	PROCESS_EVENT_UP        = "up"
+	PROCESS_EVENT_DOWN      = "down"
+	PROCESS_EVENT_RESTARTED = "restarted" // a process was replaced, e.g. it changed pid
+)
+
+type ProcessEvent struct {
+	Watch   string
+	Event   string
+	Message string
+}
+
+// The usage of the processes of a watch, the cpu in percent of a cpu
+type ProcessWatchUsage struct {
+	Count   int
+	Cpu     float64
+	Rss     int64
+	Fds     int
+	Threads int
+}
+
+// Compares every snapshot of the processes of the watches with the
+// previous one to find the processes that went away or were replaced and
+// the cpu they used in between
+type ProcessWatcher struct {
+	previous     map[string]map[string]*WatchedProcess // by watch and process id
+	previousTime time.Time
+}
+
+func NewProcessWatcher() *ProcessWatcher {
+	return &ProcessWatcher{previous: make(map[string]map[string]*WatchedProcess)}
+}
+
+func describeProcesses(processes map[string]*WatchedProcess) string {
+	pids := make([]int, 0, len(processes))
+	for _, process := range processes {
+		pids = append(pids, process.Pid)
+	}
+	sort.Ints(pids)
+	descriptions := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		descriptions = append(descriptions, strconv.Itoa(pid))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// returns the usage of every watch and the events since the previous
+// snapshot, there are no events for the first snapshot of a watch
+func (self *ProcessWatcher) Check(watches []*ProcessWatch, processes []*WatchedProcess, now time.Time) (map[string]*ProcessWatchUsage, []*ProcessEvent) {
+	usages := make(map[string]*ProcessWatchUsage)
+	events := make([]*ProcessEvent, 0)
+	current := make(map[string]map[string]*WatchedProcess)
+	seconds := now.Sub(self.previousTime).Seconds()
+
+	for _, watch := range watches {
+		matched := make(map[string]*WatchedProcess)
+		usage := &ProcessWatchUsage{}
+		previous, known := self.previous[watch.Name]
+		for _, process := range matchWatchedProcesses(watch, processes) {
+			matched[process.Id()] = process
+			usage.Count++
+			usage.Rss += process.Rss
+			usage.Fds += process.Fds
+			usage.Threads += process.Threads
+			if before, ok := previous[process.Id()]; ok && seconds > 0 && process.CpuTicks >= before.CpuTicks {
+				usage.Cpu += float64(process.CpuTicks-before.CpuTicks) / PROC_CLOCK_TICKS / seconds * 100
+			}
+		}
+		current[watch.Name] = matched
+		usages[watch.Name] = usage
+		if !known {
+			continue
+		}
+
+		gone := make(map[string]*WatchedProcess)
+		for id, process := range previous {
+			if _, ok := matched[id]; !ok {
+				gone[id] = process
+			}
+		}
+		switch {
+		case len(previous) > 0 && len(matched) == 0:
+			events = append(events, &ProcessEvent{watch.Name, PROCESS_EVENT_DOWN, fmt.Sprintf("Process %s (pid %s) disappeared", watch.Name, describeProcesses(previous))})
+		case len(previous) == 0 && len(matched) > 0:
+			events = append(events, &ProcessEvent{watch.Name, PROCESS_EVENT_UP, fmt.Sprintf("Process %s is running (pid %s)", watch.Name, describeProcesses(matched))})
+		case len(gone) > 0:
+			events = append(events, &ProcessEvent{watch.Name, PROCESS_EVENT_RESTARTED, fmt.Sprintf("Process %s changed from pid %s to pid %s", watch.Name, describeProcesses(previous), describeProcesses(matched))})
+		}
+	}
+
+	self.previous = current
+	self.previousTime = now
+	return usages, events
+}
+
+func reportProcessWatches(ep *errplane.Errplane, usages map[string]*ProcessWatchUsage, events []*ProcessEvent, now time.Time) {
+	for name, usage := range usages {
+		dimensions := errplane.Dimensions{"host": AgentConfig().Hostname, "process": name}
+		up := 0.0
+		if usage.Count > 0 {
+			up = 1
+			checkStates.Set(CHECK_PROCESS, name, "", "ok", "")
+		} else {
+			checkStates.Set(CHECK_PROCESS, name, "", "critical", "process is down")
+		}
+		report(ep, "server.processes.up", up, now, dimensions, nil)
+		report(ep, "server.processes.count", float64(usage.Count), now, dimensions, nil)
+		if usage.Count == 0 {
+			continue
+		}
+		report(ep, "server.processes.cpu", usage.Cpu, now, dimensions, nil)
+		report(ep, "server.processes.rss", float64(usage.Rss), now, dimensions, nil)
+		report(ep, "server.processes.fds", float64(usage.Fds), now, dimensions, nil)
+		report(ep, "server.processes.threads", float64(usage.Threads), now, dimensions, nil)
+	}
+	for _, event := range events {
+		log.Info(event.Message)
+		reportWithContext(ep, "server.processes.events", 1.0, now, event.Message, errplane.Dimensions{
+			"host":    AgentConfig().Hostname,
+			"process": event.Watch,
+			"event":   event.Event,
+		})
+	}
+}
+
+// watches the processes of the processes section every monitored-sleep
+func watchProcesses(ep *errplane.Errplane) {
+	if !PROC_STATS {
+		if len(AgentConfig().Processes) > 0 {
+			log.Warn("The processes can only be watched on linux")
+		}
+		return
+	}
+	if !hostCapabilities.Has(HOST_CAPABILITY_PROC) {
+		// the missing capability is logged at startup
+		return
+	}
+	watcher := NewProcessWatcher()
+	for {
+		if len(AgentConfig().Processes) > 0 {
+			processes, err := readWatchedProcesses()
+			if err != nil {
+				log.Error("Cannot list the processes in %s. Error: %s", procRoot, err)
+			} else {
+				now := time.Now()
+				usages, events := watcher.Check(AgentConfig().Processes, processes, now)
+				reportProcessWatches(ep, usages, events, now)
+			}
+		}
+		time.Sleep(AgentConfig().MonitoredSleep)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+	. "utils"
+)
+
+type ProcessWatchSuite struct {
+	previousRoot string
+}
+
+var _ = Suite(&ProcessWatchSuite{})
+
+func (self *ProcessWatchSuite) SetUpTest(c *C) {
+	self.previousRoot = procRoot
+	procRoot = c.MkDir()
+}
+
+func (self *ProcessWatchSuite) TearDownTest(c *C) {
+	procRoot = self.previousRoot
+}
+
+// writes a fake /proc/<pid> with the given cpu ticks and start time
+func (self *ProcessWatchSuite) writeProcess(c *C, pid int, name, uid string, ticks, start uint64, args ...string) {
+	dir := path.Join(procRoot, strconv.Itoa(pid))
+	c.Assert(os.MkdirAll(path.Join(dir, "fd"), 0755), IsNil)
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 3 0 %d 1000 200\n", pid, name, pid, pid, ticks, ticks, start)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "stat"), []byte(stat), 0644), IsNil)
+	status := fmt.Sprintf("Name:\t%s\nUid:\t%s\t%s\t%s\t%s\nThreads:\t3\nVmRSS:\t   2048 kB\n", name, uid, uid, uid, uid)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte(status), 0644), IsNil)
+	cmdline := ""
+	for _, arg := range args {
+		cmdline += arg + "\x00"
+	}
+	c.Assert(ioutil.WriteFile(path.Join(dir, "cmdline"), []byte(cmdline), 0644), IsNil)
+	for i := 0; i < 4; i++ {
+		c.Assert(ioutil.WriteFile(path.Join(dir, "fd", strconv.Itoa(i)), nil, 0644), IsNil)
+	}
+}
+
+func (self *ProcessWatchSuite) TestReadProcess(c *C) {
+	self.writeProcess(c, 42, "my (worker)", "1000", 50, 12345, "/usr/bin/worker", "--queue", "mail")
+	process, err := readWatchedProcess(42)
+	c.Assert(err, IsNil)
+	c.Assert(process, DeepEquals, &WatchedProcess{Pid: 42, Name: "my (worker)", Cmdline: "/usr/bin/worker --queue mail", Uid: "1000",
+		StartTime: 12345, CpuTicks: 100, Rss: 2048 * 1024, Threads: 3, Fds: 4})
+}
+
+func (self *ProcessWatchSuite) TestMatching(c *C) {
+	self.writeProcess(c, 10, "nginx", "0", 0, 1, "nginx: master process")
+	self.writeProcess(c, 11, "nginx", "33", 0, 2, "nginx: worker process")
+	self.writeProcess(c, 12, "java", "1000", 0, 3, "java", "-jar", "/opt/app/app.jar")
+	processes, err := readWatchedProcesses()
+	c.Assert(err, IsNil)
+	c.Assert(processes, HasLen, 3)
+
+	pids := func(watch *ProcessWatch) []int {
+		matched := make([]int, 0)
+		for _, process := range matchWatchedProcesses(watch, processes) {
+			matched = append(matched, process.Pid)
+		}
+		return matched
+	}
+	c.Assert(pids(&ProcessWatch{Name: "nginx", NameRegex: regexp.MustCompile("^nginx$")}), DeepEquals, []int{10, 11})
+	c.Assert(pids(&ProcessWatch{Name: "nginx", NameRegex: regexp.MustCompile("^nginx$"), User: "0"}), DeepEquals, []int{10})
+	c.Assert(pids(&ProcessWatch{Name: "app", Cmdline: regexp.MustCompile(`app\.jar`)}), DeepEquals, []int{12})
+
+	pidfile := path.Join(c.MkDir(), "app.pid")
+	c.Assert(ioutil.WriteFile(pidfile, []byte("11\n"), 0644), IsNil)
+	c.Assert(pids(&ProcessWatch{Name: "worker", Pidfile: pidfile}), DeepEquals, []int{11})
+	c.Assert(pids(&ProcessWatch{Name: "missing", Pidfile: pidfile + ".missing"}), DeepEquals, []int{})
+}
+
+func (self *ProcessWatchSuite) TestEvents(c *C) {
+	watches := []*ProcessWatch{&ProcessWatch{Name: "app", Cmdline: regexp.MustCompile(`app\.jar`)}}
+	watcher := NewProcessWatcher()
+	now := time.Now()
+	check := func(seconds int) (*ProcessWatchUsage, []*ProcessEvent) {
+		processes, err := readWatchedProcesses()
+		c.Assert(err, IsNil)
+		usages, events := watcher.Check(watches, processes, now.Add(time.Duration(seconds)*time.Second))
+		return usages["app"], events
+	}
+
+	self.writeProcess(c, 12, "java", "1000", 100, 3, "java", "-jar", "app.jar")
+	usage, events := check(0)
+	c.Assert(usage.Count, Equals, 1)
+	c.Assert(events, HasLen, 0)
+
+	// 200 more ticks (user and system) in 10 seconds is 20% of a cpu
+	self.writeProcess(c, 12, "java", "1000", 200, 3, "java", "-jar", "app.jar")
+	usage, events = check(10)
+	c.Assert(usage.Cpu, Equals, 20.0)
+	c.Assert(usage.Rss, Equals, int64(2048*1024))
+	c.Assert(usage.Fds, Equals, 4)
+	c.Assert(events, HasLen, 0)
+
+	// same pid but started again
+	self.writeProcess(c, 12, "java", "1000", 10, 500, "java", "-jar", "app.jar")
+	usage, events = check(20)
+	c.Assert(usage.Cpu, Equals, 0.0)
+	c.Assert(events, DeepEquals, []*ProcessEvent{&ProcessEvent{"app", PROCESS_EVENT_RESTARTED, "Process app changed from pid 12 to pid 12"}})
+
+	c.Assert(os.RemoveAll(path.Join(procRoot, "12")), IsNil)
+	usage, events = check(30)
+	c.Assert(usage.Count, Equals, 0)
+	c.Assert(events, DeepEquals, []*ProcessEvent{&ProcessEvent{"app", PROCESS_EVENT_DOWN, "Process app (pid 12) disappeared"}})
+
+	self.writeProcess(c, 13, "java", "1000", 0, 600, "java", "-jar", "app.jar")
+	_, events = check(40)
+	c.Assert(events, DeepEquals, []*ProcessEvent{&ProcessEvent{"app", PROCESS_EVENT_UP, "Process app is running (pid 13)"}})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsing of the prometheus text exposition format, e.g.
+// # TYPE http_requests_total counter
+// http_requests_total{method="post",code="200"} 1027 1395066363000
+
+// parses the labels between the braces, returns the labels and the rest of the line
+func parsePrometheusLabels(str string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		str = strings.TrimLeft(str, " \t,")
+		if strings.HasPrefix(str, "}") {
+			return labels, str[1:], nil
+		}
+
+		idx := strings.Index(str, "=")
+		if idx <= 0 {
+			return nil, "", fmt.Errorf("Invalid labels")
+		}
+		name := strings.TrimSpace(str[:idx])
+		str = strings.TrimLeft(str[idx+1:], " \t")
+		if !strings.HasPrefix(str, "\"") {
+			return nil, "", fmt.Errorf("Label %s value isn't quoted", name)
+		}
+
+		value := make([]byte, 0)
+		i := 1
+		for ; i < len(str) && str[i] != '"'; i++ {
+			if str[i] == '\\' && i+1 < len(str) {
+				i++
+				switch str[i] {
+				case 'n':
+					value = append(value, '\n')
+				default:
+					value = append(value, str[i])
+				}
+				continue
+			}
+			value = append(value, str[i])
+		}
+		if i == len(str) {
+			return nil, "", fmt.Errorf("Label %s value isn't terminated", name)
+		}
+		labels[name] = string(value)
+		str = str[i+1:]
+	}
+}
+
+func parsePrometheusSample(line string, now time.Time) (string, map[string]string, float64, time.Time, error) {
+	idx := strings.IndexAny(line, "{ \t")
+	if idx <= 0 {
+		return "", nil, 0, now, fmt.Errorf("Missing value")
+	}
+	name := line[:idx]
+	rest := line[idx:]
+
+	labels := make(map[string]string)
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		labels, rest, err = parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return "", nil, 0, now, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "", nil, 0, now, fmt.Errorf("Expected a value and an optional timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, now, err
+	}
+	timestamp := now
+	if len(fields) == 2 {
+		milliseconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", nil, 0, now, err
+		}
+		timestamp = time.Unix(0, milliseconds*int64(time.Millisecond))
+	}
+	return name, labels, value, timestamp, nil
+}
+
+// every sample of the output is a point, the labels are kept as dimensions
+// and the histogram and summary series (_bucket, _sum, _count) are reported
+// as is. The status is the exit code of the plugin.
+func parsePrometheusOutput(cmdState ProcessState, allOutput string) (*PluginOutput, error) {
+	now := time.Now()
+	writes := make([]*errplane.JsonPoints, 0)
+	writesByName := make(map[string]*errplane.JsonPoints)
+	var lastErr error
+
+	for _, line := range strings.Split(allOutput, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value, timestamp, err := parsePrometheusSample(line, now)
+		if err != nil {
+			lastErr = fmt.Errorf("Cannot parse line '%s'. Error: %s", line, err)
+			continue
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		write := writesByName[name]
+		if write == nil {
+			write = &errplane.JsonPoints{Name: name}
+			writesByName[name] = write
+			writes = append(writes, write)
+		}
+		write.Points = append(write.Points, &errplane.JsonPoint{Value: value, Time: timestamp.Unix(), Dimensions: errplane.Dimensions(labels)})
+	}
+
+	if len(writes) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return &PluginOutput{pluginState(cmdState.ExitStatus()), "", writes, nil, nil, now, cmdState.ExitStatus()}, nil
+}
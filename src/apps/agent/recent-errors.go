@@ -0,0 +1,75 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	RECENT_ERRORS_SIZE = 50
+)
+
+type RecentError struct {
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	Message   string    `json:"message"`
+}
+
+// A log4go writer keeping the last errors logged by the agent in memory so
+// they can be inspected through the local api
+type RecentErrors struct {
+	lock    sync.Mutex
+	size    int
+	entries []*RecentError
+}
+
+var recentErrors = NewRecentErrors(RECENT_ERRORS_SIZE)
+
+func NewRecentErrors(size int) *RecentErrors {
+	return &RecentErrors{size: size, entries: make([]*RecentError, 0, size)}
+}
+
+func (self *RecentErrors) LogWrite(record *log.LogRecord) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.entries) == self.size {
+		self.entries = self.entries[1:]
+	}
+	self.entries = append(self.entries, &RecentError{record.Created, record.Source, record.Message})
+}
+
+func (self *RecentErrors) Close() {}
+
+// returns the recent errors, oldest first
+func (self *RecentErrors) List() []*RecentError {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*RecentError{}, self.entries...)
+}
+
+func listRecentErrors(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, recentErrors.List())
+}
+
+// reports the number of errors of every category since the previous
+// report, e.g. network errors on all the hosts point at the backend while
+// exec and parse errors point at the plugins
+func reportErrorCounts(ep *errplane.Errplane) {
+	previous := make(map[string]int64)
+	for {
+		time.Sleep(AgentConfig().Sleep)
+		now := time.Now()
+		counts := ErrorCounts()
+		for _, category := range ERROR_CATEGORIES {
+			report(ep, "agent.errors", float64(counts[category]-previous[category]), now, errplane.Dimensions{
+				"host":     AgentConfig().Hostname,
+				"category": category,
+			}, nil)
+		}
+		previous = counts
+	}
+}
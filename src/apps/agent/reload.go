@@ -0,0 +1,123 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	. "utils"
+)
+
+// the settings that are only read when the agent starts, changing them
+// requires a restart
+var RESTART_ONLY_SETTINGS = []string{
+	"udp-host", "http-host", "api-key", "app-key", "environment", "proxy", "log-file", "log-level",
+	"flush-interval", "percentiles", "udp-addr", "host-stats.enabled", "mqtt", "spool", "plugin-results-socket",
+	"api-tokens", "api-tls-cert", "api-tls-key", "api-client-ca", "api-socket", "audit-log", "audit-log-max-size",
+	"audit-log-forward", "fips-mode", "ring-buffer", "ring-buffer-size", "ring-buffer-group", "sampling", "notifiers", "graphite", "statsd",
+	"history-file", "history-retention", "http-batch", "local-store", "docker", "kubernetes", "backend-tls",
+	"scrape", "plugin-cgroup", "ssh-tunnel", "status-page", "mac-denials-log", "windows-targets", "modbus-devices",
+	"sensors", "watchdog", "perf-counters", "heartbeat", "loadgen", "ephemeral",
+}
+
+// the path of the configuration file the agent was started with
+var configPath string
+
+var reloadLock sync.Mutex
+
+type ReloadResult struct {
+	Changed        []string `json:"changed"`         // the settings that changed
+	RestartPending []string `json:"restart_pending"` // the changed settings that only take effect after a restart
+}
+
+// returns the settings that differ between the two configurations
+func changedSettings(previous, current *Config) ([]string, error) {
+	previousData, err := goyaml.Marshal(previous)
+	if err != nil {
+		return nil, err
+	}
+	currentData, err := goyaml.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	differences, err := diffConfigs(previousData, currentData)
+	if err != nil {
+		return nil, err
+	}
+	changed := make([]string, 0, len(differences))
+	for _, difference := range differences {
+		changed = append(changed, difference.Key)
+	}
+	return changed, nil
+}
+
+func restartOnly(setting string) bool {
+	for _, prefix := range RESTART_ONLY_SETTINGS {
+		if setting == prefix || strings.HasPrefix(setting, prefix+".") || strings.HasPrefix(setting, prefix+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// reloads the configuration file without restarting the agent. The checks
+// pick up the new configuration on their next run and the plugin scheduler
+// refreshes its configuration right away, the runs in flight and the
+// points waiting to be sent are kept. If the configuration is invalid the
+// agent keeps the current one.
+func reloadConfig(actor string) (*ReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous := AgentConfig()
+	if err := InitConfig(configPath); err != nil {
+		log.Error("Cannot reload the configuration from %s, keeping the current one. Error: %s", configPath, err)
+		return nil, err
+	}
+
+	result := &ReloadResult{Changed: []string{}, RestartPending: []string{}}
+	changed, err := changedSettings(previous, AgentConfig())
+	if err != nil {
+		log.Error("Cannot compare the configurations. Error: %s", err)
+	} else {
+		result.Changed = changed
+	}
+	for _, setting := range result.Changed {
+		if restartOnly(setting) {
+			result.RestartPending = append(result.RestartPending, setting)
+		}
+	}
+
+	audit(actor, "reload_config", configHash(previous), configHash(AgentConfig()), strings.Join(result.Changed, ","))
+	pluginRegistry.Reload()
+	hostIps.Clear()
+	alertStates.Prune()
+	log.Info("Reloaded the configuration from %s, %d settings changed", configPath, len(result.Changed))
+	if len(result.RestartPending) > 0 {
+		log.Warn("The agent must be restarted for these settings to take effect: %s", strings.Join(result.RestartPending, ", "))
+	}
+	return result, nil
+}
+
+// reloads the configuration on SIGHUP
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for _ = range signals {
+		log.Info("Received SIGHUP, reloading the configuration")
+		reloadConfig("signal:SIGHUP")
+	}
+}
+
+func reloadConfigNow(w http.ResponseWriter, req *http.Request) {
+	result, err := reloadConfig(requestActor(req))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, http.StatusOK, result)
+}
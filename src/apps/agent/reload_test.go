@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	"time"
+	. "utils"
+)
+
+type ReloadSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&ReloadSuite{})
+
+func (self *ReloadSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	SetAgentConfig(&config)
+}
+
+func (self *ReloadSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+	configPath = ""
+	pluginRegistry.Reloaded()
+}
+
+func writeTestConfig(c *C, file, sleep, logFile string) {
+	content := "sleep: " + sleep + "\nflush-interval: 10s\ntop-n-sleep: 1m\nmonitored-sleep: 10s\nlog-file: " + logFile + "\n"
+	c.Assert(ioutil.WriteFile(file, []byte(content), 0644), IsNil)
+}
+
+func (self *ReloadSuite) TestReloadConfig(c *C) {
+	configPath = path.Join(c.MkDir(), "config.yml")
+	writeTestConfig(c, configPath, "10s", "/tmp/agent.log")
+	c.Assert(InitConfig(configPath), IsNil)
+	pluginRegistry.Reloaded()
+	before, transport := AgentConfig(), AgentTransport()
+
+	writeTestConfig(c, configPath, "20s", "/tmp/other.log")
+	result, err := reloadConfig("test")
+	c.Assert(err, IsNil)
+	// the configuration the goroutines already hold isn't written over
+	c.Assert(before.Sleep, Equals, 10*time.Second)
+	// the transport the goroutines share is only built at startup
+	c.Assert(AgentTransport() == transport, Equals, true)
+	c.Assert(result.Changed, DeepEquals, []string{"log-file", "sleep"})
+	c.Assert(result.RestartPending, DeepEquals, []string{"log-file"})
+	c.Assert(AgentConfig().Sleep, Equals, 20*time.Second)
+	c.Assert(pluginRegistry.Reloaded(), Equals, true)
+
+	// an invalid configuration keeps the current one
+	writeTestConfig(c, configPath, "forever", "/tmp/other.log")
+	_, err = reloadConfig("test")
+	c.Assert(err, NotNil)
+	c.Assert(AgentConfig().Sleep, Equals, 20*time.Second)
+	c.Assert(pluginRegistry.Reloaded(), Equals, false)
+}
+
+func (self *ReloadSuite) TestRestartOnly(c *C) {
+	c.Assert(restartOnly("log-file"), Equals, true)
+	c.Assert(restartOnly("mqtt.broker"), Equals, true)
+	c.Assert(restartOnly("api-tokens[0].scopes[1]"), Equals, true)
+	c.Assert(restartOnly("modbus-devices[0].address"), Equals, true)
+	c.Assert(restartOnly("api-key-file"), Equals, false)
+	c.Assert(restartOnly("http-checks[0].url"), Equals, false)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	. "utils"
+)
+
+const (
+	REMOTE_PLUGINS_DIR = "/tmp/errplane-agent-plugins"
+	SSH_ERROR_STATUS   = 255 // ssh exits with 255 if it cannot connect or authenticate
+)
+
+// the plugins already copied to the remote hosts
+var (
+	remotePluginsLock sync.Mutex
+	remotePlugins     = make(map[string]bool)
+)
+
+func sshDestination(remote *RemoteTarget) string {
+	if remote.User != "" {
+		return remote.User + "@" + remote.Host
+	}
+	return remote.Host
+}
+
+// options shared by ssh and scp, never prompt for a password or a host key
+func sshOptions(remote *RemoteTarget, portFlag string) []string {
+	options := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	if remote.Port != 0 {
+		options = append(options, portFlag, strconv.Itoa(remote.Port))
+	}
+	if remote.Key != "" {
+		options = append(options, "-i", remote.Key)
+	}
+	return options
+}
+
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// copies the plugin directory to the remote host unless it was already
+// copied since the agent started
+func copyPlugin(plugin *PluginMetadata, remote *RemoteTarget) error {
+	key := fmt.Sprintf("%s:%d/%s/%s", sshDestination(remote), remote.Port, plugin.Name, plugin.Verion)
+
+	remotePluginsLock.Lock()
+	defer remotePluginsLock.Unlock()
+	if remotePlugins[key] {
+		return nil
+	}
+
+	args := append(sshOptions(remote, "-p"), sshDestination(remote), "mkdir -p "+REMOTE_PLUGINS_DIR)
+	if output, err := exec.Command("ssh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s. Output: %s", err, output)
+	}
+
+	args = append(sshOptions(remote, "-P"), "-q", "-r", plugin.Path, sshDestination(remote)+":"+REMOTE_PLUGINS_DIR+"/")
+	if output, err := exec.Command("scp", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s. Output: %s", err, output)
+	}
+
+	log.Info("Copied plugin %s to %s", plugin.Name, remote.Host)
+	remotePlugins[key] = true
+	return nil
+}
+
+// returns the ssh command that runs the plugin (or the configured command)
+// on the remote host, the output is parsed locally as usual
+func remoteCommand(plugin *PluginMetadata, remote *RemoteTarget, cmdPath string, args []string) (string, []string, error) {
+	command := remote.Command
+	if command == "" {
+		if err := copyPlugin(plugin, remote); err != nil {
+			return "", nil, err
+		}
+		command = shellQuote(path.Join(REMOTE_PLUGINS_DIR, path.Base(plugin.Path), path.Base(cmdPath)))
+	}
+
+	for _, arg := range args {
+		command += " " + shellQuote(arg)
+	}
+	return "ssh", append(sshOptions(remote, "-p"), sshDestination(remote), command), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+	. "utils"
+)
+
+const REPORT_MAX_EVENTS = 100
+
+type CheckAvailability struct {
+	Check        string
+	State        string  // the last known state
+	Availability float64 // percent of the observed time the check was ok
+	Observed     time.Duration
+	Warning      time.Duration
+	Critical     time.Duration
+	Unknown      time.Duration
+	Changes      int
+}
+
+type ProcessUsage struct {
+	Name      string
+	Cpu       float64 // average percent
+	MaxMemory float64 // bytes
+	Samples   int
+}
+
+type HostReport struct {
+	Host          string
+	From          time.Time
+	To            time.Time
+	Checks        []*CheckAvailability
+	Processes     []*ProcessUsage
+	Events        []*HistoryEntry // the most recent first
+	DroppedEvents int
+}
+
+// summarizes the history between from and to. The state of a check before
+// from is the last state it changed to, the time the agent was stopped
+// isn't observed.
+func buildReport(entries []*HistoryEntry, from, to time.Time) *HostReport {
+	report := &HostReport{Host: AgentConfig().Hostname, From: from, To: to}
+
+	type checkTimeline struct {
+		availability *CheckAvailability
+		state        string // empty while the agent is stopped
+		since        int64
+		ok           time.Duration
+	}
+	checks := make(map[string]*checkTimeline)
+	processes := make(map[string]*ProcessUsage)
+	start, end := from.Unix(), to.Unix()
+
+	// accounts for the time the check spent in its current state up to until
+	closeState := func(timeline *checkTimeline, until int64) {
+		if timeline.state == "" {
+			return
+		}
+		since := timeline.since
+		if since < start {
+			since = start
+		}
+		if until <= since {
+			return
+		}
+		duration := time.Duration(until-since) * time.Second
+		timeline.availability.Observed += duration
+		switch timeline.state {
+		case "ok":
+			timeline.ok += duration
+		case "warning":
+			timeline.availability.Warning += duration
+		case "critical":
+			timeline.availability.Critical += duration
+		default:
+			timeline.availability.Unknown += duration
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Timestamp > end {
+			break
+		}
+		inWindow := entry.Timestamp >= start
+
+		switch entry.Kind {
+		case HISTORY_STATE:
+			timeline, ok := checks[entry.Name]
+			if !ok {
+				timeline = &checkTimeline{availability: &CheckAvailability{Check: entry.Name}}
+				checks[entry.Name] = timeline
+			}
+			closeState(timeline, entry.Timestamp)
+			if inWindow && timeline.state != "" && timeline.state != entry.State {
+				timeline.availability.Changes++
+			}
+			timeline.state, timeline.since = entry.State, entry.Timestamp
+			timeline.availability.State = entry.State
+			if inWindow && entry.State == "critical" {
+				report.Events = append(report.Events, entry)
+			}
+		case HISTORY_TOP:
+			if !inWindow {
+				continue
+			}
+			usage, ok := processes[entry.Name]
+			if !ok {
+				usage = &ProcessUsage{Name: entry.Name}
+				processes[entry.Name] = usage
+			}
+			// a running average, the samples are taken at a fixed interval
+			usage.Samples++
+			usage.Cpu += (entry.Cpu - usage.Cpu) / float64(usage.Samples)
+			if entry.Memory > usage.MaxMemory {
+				usage.MaxMemory = entry.Memory
+			}
+		case HISTORY_EVENT:
+			if entry.Name == HISTORY_AGENT_STARTED {
+				for _, timeline := range checks {
+					closeState(timeline, entry.Timestamp)
+					timeline.state = ""
+				}
+			}
+			if inWindow {
+				report.Events = append(report.Events, entry)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(checks))
+	for name, timeline := range checks {
+		closeState(timeline, end)
+		if timeline.availability.Observed == 0 {
+			continue
+		}
+		timeline.availability.Availability = 100 * float64(timeline.ok) / float64(timeline.availability.Observed)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Checks = append(report.Checks, checks[name].availability)
+	}
+
+	for _, usage := range processes {
+		report.Processes = append(report.Processes, usage)
+	}
+	sort.Sort(processesByCpu(report.Processes))
+	if len(report.Processes) > AgentConfig().TopNProcesses && AgentConfig().TopNProcesses > 0 {
+		report.Processes = report.Processes[:AgentConfig().TopNProcesses]
+	}
+
+	// the most recent events first
+	for i, j := 0, len(report.Events)-1; i < j; i, j = i+1, j-1 {
+		report.Events[i], report.Events[j] = report.Events[j], report.Events[i]
+	}
+	if len(report.Events) > REPORT_MAX_EVENTS {
+		report.DroppedEvents = len(report.Events) - REPORT_MAX_EVENTS
+		report.Events = report.Events[:REPORT_MAX_EVENTS]
+	}
+	return report
+}
+
+type processesByCpu []*ProcessUsage
+
+func (self processesByCpu) Len() int           { return len(self) }
+func (self processesByCpu) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self processesByCpu) Less(i, j int) bool { return self[i].Cpu > self[j].Cpu }
+
+func formatReportDuration(duration time.Duration) string {
+	return (duration / time.Second * time.Second).String()
+}
+
+func formatReportTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format("2006-01-02 15:04:05")
+}
+
+func renderTextReport(report *HostReport) string {
+	buffer := bytes.NewBufferString("")
+	fmt.Fprintf(buffer, "Report for %s from %s to %s\n", report.Host,
+		report.From.Format("2006-01-02 15:04:05"), report.To.Format("2006-01-02 15:04:05 MST"))
+
+	fmt.Fprintf(buffer, "\nAvailability\n")
+	writer := tabwriter.NewWriter(buffer, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "CHECK\tSTATE\tAVAILABILITY\tWARNING\tCRITICAL\tUNKNOWN\tCHANGES\n")
+	for _, check := range report.Checks {
+		fmt.Fprintf(writer, "%s\t%s\t%.2f%%\t%s\t%s\t%s\t%d\n", check.Check, check.State, check.Availability,
+			formatReportDuration(check.Warning), formatReportDuration(check.Critical), formatReportDuration(check.Unknown), check.Changes)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(buffer, "\nTop processes\n")
+	writer = tabwriter.NewWriter(buffer, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "PROCESS\tAVG CPU\tMAX MEMORY\n")
+	for _, process := range report.Processes {
+		fmt.Fprintf(writer, "%s\t%.1f%%\t%.1f MB\n", process.Name, process.Cpu, process.MaxMemory/(1024*1024))
+	}
+	writer.Flush()
+
+	fmt.Fprintf(buffer, "\nEvents\n")
+	for _, event := range report.Events {
+		fmt.Fprintf(buffer, "%s  %s\n", formatReportTime(event.Timestamp), reportEventText(event))
+	}
+	if report.DroppedEvents > 0 {
+		fmt.Fprintf(buffer, "... and %d older events\n", report.DroppedEvents)
+	}
+	return buffer.String()
+}
+
+func reportEventText(event *HistoryEntry) string {
+	text := event.Name
+	if event.Kind == HISTORY_STATE {
+		text = event.Name + " became " + event.State
+	} else if event.State != "" {
+		text += " (" + event.State + ")"
+	}
+	if event.Message != "" {
+		text += ": " + event.Message
+	}
+	return text
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"duration": formatReportDuration,
+	"time":     formatReportTime,
+	"event":    reportEventText,
+	"mb":       func(value float64) string { return fmt.Sprintf("%.1f MB", value/(1024*1024)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.Host}} report</title>
+  <style>
+    body { font-family: sans-serif; }
+    .ok { color: #2a2; } .warning { color: #c80; } .critical { color: #c22; } .unknown { color: #888; }
+    td, th { padding: 4px 12px; text-align: left; }
+  </style>
+</head>
+<body>
+  <h1>{{.Host}}</h1>
+  <p>From {{.From.Format "2006-01-02 15:04:05"}} to {{.To.Format "2006-01-02 15:04:05 MST"}}</p>
+  <h2>Availability</h2>
+  <table>
+    <tr><th>Check</th><th>State</th><th>Availability</th><th>Warning</th><th>Critical</th><th>Unknown</th><th>Changes</th></tr>
+    {{range .Checks}}<tr>
+      <td>{{.Check}}</td><td class="{{.State}}">{{.State}}</td><td>{{printf "%.2f" .Availability}}%</td><td>{{duration .Warning}}</td><td>{{duration .Critical}}</td><td>{{duration .Unknown}}</td><td>{{.Changes}}</td>
+    </tr>{{end}}
+  </table>
+  <h2>Top processes</h2>
+  <table>
+    <tr><th>Process</th><th>Average cpu</th><th>Max memory</th></tr>
+    {{range .Processes}}<tr>
+      <td>{{.Name}}</td><td>{{printf "%.1f" .Cpu}}%</td><td>{{mb .MaxMemory}}</td>
+    </tr>{{end}}
+  </table>
+  <h2>Events</h2>
+  <table>
+    {{range .Events}}<tr><td>{{time .Timestamp}}</td><td>{{event .}}</td></tr>{{end}}
+  </table>
+  {{if .DroppedEvents}}<p>... and {{.DroppedEvents}} older events</p>{{end}}
+</body>
+</html>
+`))
+
+// agent report [-last 24h] [-html], summarizes the local history without
+// the backend or the running agent
+func reportCommand(out io.Writer, args []string, now time.Time) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	flags.SetOutput(out)
+	last := flags.Duration("last", 24*time.Hour, "The period the report covers")
+	html := flags.Bool("html", false, "Render the report as html instead of text")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if AgentConfig().HistoryFile == "" {
+		fmt.Fprintf(out, "The history isn't configured, set history-file\n")
+		return 1
+	}
+	entries, err := readHistory(AgentConfig().HistoryFile)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot read the history. Error: %s\n", err)
+		return 1
+	}
+
+	report := buildReport(entries, now.Add(-*last), now)
+	if !*html {
+		fmt.Fprint(out, renderTextReport(report))
+		return 0
+	}
+	if err := reportTemplate.Execute(out, report); err != nil {
+		fmt.Fprintf(out, "Cannot render the report. Error: %s\n", err)
+		return 1
+	}
+	return 0
+}
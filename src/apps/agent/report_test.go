@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	. "launchpad.net/gocheck"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type ReportSuite struct{}
+
+var _ = Suite(&ReportSuite{})
+
+func (self *ReportSuite) TestAvailability(c *C) {
+	now := time.Unix(1400000000, 0)
+	at := func(ago time.Duration) int64 { return now.Add(-ago).Unix() }
+	entries := []*HistoryEntry{
+		// the state before the report starts counts from the start
+		&HistoryEntry{Timestamp: at(30 * time.Hour), Kind: HISTORY_STATE, Name: "http/api/", State: "ok"},
+		&HistoryEntry{Timestamp: at(12 * time.Hour), Kind: HISTORY_STATE, Name: "http/api/", State: "critical", Message: "timeout"},
+		&HistoryEntry{Timestamp: at(6 * time.Hour), Kind: HISTORY_STATE, Name: "http/api/", State: "ok"},
+		&HistoryEntry{Timestamp: at(20 * time.Hour), Kind: HISTORY_TOP, Name: "postgres", Cpu: 10, Memory: 100},
+		&HistoryEntry{Timestamp: at(10 * time.Hour), Kind: HISTORY_TOP, Name: "postgres", Cpu: 30, Memory: 300},
+		&HistoryEntry{Timestamp: at(10 * time.Hour), Kind: HISTORY_TOP, Name: "nginx", Cpu: 5, Memory: 50},
+		// the checks aren't observed while the agent is stopped
+		&HistoryEntry{Timestamp: at(4 * time.Hour), Kind: HISTORY_EVENT, Name: "reload_config", Message: "by signal:SIGHUP"},
+		&HistoryEntry{Timestamp: at(2 * time.Hour), Kind: HISTORY_EVENT, Name: HISTORY_AGENT_STARTED},
+		&HistoryEntry{Timestamp: at(time.Hour), Kind: HISTORY_STATE, Name: "http/api/", State: "ok"},
+	}
+
+	report := buildReport(entries, now.Add(-24*time.Hour), now)
+	c.Assert(report.Checks, HasLen, 1)
+	check := report.Checks[0]
+	c.Assert(check.Check, Equals, "http/api/")
+	c.Assert(check.State, Equals, "ok")
+	c.Assert(check.Observed, Equals, 23*time.Hour)
+	c.Assert(check.Critical, Equals, 6*time.Hour)
+	c.Assert(check.Changes, Equals, 2)
+	c.Assert(int(check.Availability*100), Equals, 7391)
+
+	c.Assert(report.Processes, HasLen, 2)
+	c.Assert(report.Processes[0].Name, Equals, "postgres")
+	c.Assert(report.Processes[0].Cpu, Equals, 20.0)
+	c.Assert(report.Processes[0].MaxMemory, Equals, 300.0)
+
+	c.Assert(report.Events, HasLen, 3)
+	c.Assert(report.Events[0].Name, Equals, HISTORY_AGENT_STARTED)
+	c.Assert(reportEventText(report.Events[2]), Equals, "http/api/ became critical: timeout")
+
+	text := renderTextReport(report)
+	c.Assert(strings.Contains(text, "73.91%"), Equals, true)
+	c.Assert(strings.Contains(text, "reload_config: by signal:SIGHUP"), Equals, true)
+}
+
+func (self *ReportSuite) TestHistoryStore(c *C) {
+	defer setTestConfig(func(config *Config) { config.HistoryFile = path.Join(c.MkDir(), "history.log") })()
+	store := NewHistoryStore(AgentConfig().HistoryFile, time.Hour)
+	now := time.Now()
+	store.Record(&HistoryEntry{Timestamp: now.Add(-2 * time.Hour).Unix(), Kind: HISTORY_EVENT, Name: "old"})
+	store.Record(&HistoryEntry{Timestamp: now.Add(-30 * time.Minute).Unix(), Kind: HISTORY_STATE, Name: "dns/local/", State: "warning"})
+	store.RecordTop([]MergedProcStat{{pid: 1, name: "init", cpuUsage: 1}, {pid: 2, name: "java", memUsage: 1024}}, 1, now)
+	// the top processes are recorded every HISTORY_TOP_INTERVAL
+	store.RecordTop([]MergedProcStat{{pid: 1, name: "init", cpuUsage: 1}}, 1, now.Add(time.Minute))
+
+	entries, err := readHistory(AgentConfig().HistoryFile)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 4)
+
+	c.Assert(store.Compact(now), IsNil)
+	entries, err = readHistory(AgentConfig().HistoryFile)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Assert(entries[0].Name, Equals, "dns/local/")
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(reportCommand(out, []string{"-last", "1h", "-html"}, now), Equals, 0)
+	c.Assert(strings.Contains(out.String(), "<td>dns/local/</td>"), Equals, true)
+	c.Assert(strings.Contains(out.String(), "<td>java</td>"), Equals, true)
+}
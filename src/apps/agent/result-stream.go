@@ -0,0 +1,140 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"github.com/errplane/errplane-go"
+	"net"
+	"os"
+	"sync"
+	. "utils"
+)
+
+const (
+	// the number of results a subscriber can lag behind before results are
+	// dropped for it
+	RESULT_STREAM_BUFFER = 100
+)
+
+// A parsed plugin result, published as a single json line
+type PluginResult struct {
+	Plugin     string                 `json:"plugin"`
+	Instance   string                 `json:"instance,omitempty"`
+	InstanceId string                 `json:"instance_id"`
+	Host       string                 `json:"host"`
+	State      string                 `json:"state"`
+	Message    string                 `json:"message"`
+	Metrics    map[string]float64     `json:"metrics,omitempty"`
+	Points     []*errplane.JsonPoints `json:"points,omitempty"`
+	Timestamp  int64                  `json:"timestamp"`
+}
+
+// Publishes the plugin results to every process connected to a unix
+// socket, one json object per line. Slow subscribers miss results instead
+// of slowing down the plugins.
+type ResultStream struct {
+	lock        sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+var resultStream *ResultStream
+
+func NewResultStream() *ResultStream {
+	return &ResultStream{subscribers: make(map[chan []byte]bool)}
+}
+
+// listens on the configured socket and publishes the results from there on
+func startResultStream() {
+	if AgentConfig().PluginResultsSocket == "" {
+		return
+	}
+
+	socket := AgentConfig().PluginResultsSocket
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Error("Cannot listen on %s. Error: %s", socket, err)
+		return
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		log.Error("Cannot change the permissions of %s. Error: %s", socket, err)
+		listener.Close()
+		return
+	}
+
+	resultStream = NewResultStream()
+	log.Info("Publishing plugin results on %s", socket)
+	go resultStream.Serve(listener)
+}
+
+func (self *ResultStream) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Error("Cannot accept connections on %s. Error: %s", listener.Addr(), err)
+			return
+		}
+		go self.subscribe(conn)
+	}
+}
+
+func (self *ResultStream) subscribe(conn net.Conn) {
+	defer conn.Close()
+
+	ch := make(chan []byte, RESULT_STREAM_BUFFER)
+	self.lock.Lock()
+	self.subscribers[ch] = true
+	self.lock.Unlock()
+
+	defer func() {
+		self.lock.Lock()
+		delete(self.subscribers, ch)
+		self.lock.Unlock()
+	}()
+
+	for line := range ch {
+		if _, err := conn.Write(line); err != nil {
+			log.Debug("Subscriber of the plugin results went away. Error: %s", err)
+			return
+		}
+	}
+}
+
+// sends the result to all the subscribers, a nil stream (no socket
+// configured) ignores the results
+func (self *ResultStream) Publish(result *PluginResult) {
+	if self == nil {
+		return
+	}
+
+	line, err := json.Marshal(result)
+	if err != nil {
+		log.Error("Cannot serialize the result of plugin %s. Error: %s", result.Plugin, err)
+		return
+	}
+	line = append(line, '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for ch, _ := range self.subscribers {
+		select {
+		case ch <- line:
+		default:
+			log.Debug("Dropping the result of plugin %s for a slow subscriber", result.Plugin)
+		}
+	}
+}
+
+func newPluginResult(plugin *PluginMetadata, id string, instance *Instance, output *PluginOutput) *PluginResult {
+	return &PluginResult{
+		Plugin:     plugin.Name,
+		Instance:   instance.Name,
+		InstanceId: id,
+		Host:       AgentConfig().Hostname,
+		State:      output.state.String(),
+		Message:    output.msg,
+		Metrics:    output.metrics,
+		Points:     output.points,
+		Timestamp:  output.timestamp.Unix(),
+	}
+}
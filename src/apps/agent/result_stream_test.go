@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net"
+	"path"
+	"time"
+	. "utils"
+)
+
+type ResultStreamSuite struct{}
+
+var _ = Suite(&ResultStreamSuite{})
+
+func (self *ResultStreamSuite) TestPublish(c *C) {
+	socket := path.Join(c.MkDir(), "results.sock")
+	listener, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	stream := NewResultStream()
+	go stream.Serve(listener)
+
+	conn, err := net.Dial("unix", socket)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	for i := 0; i < 1000; i++ {
+		stream.lock.Lock()
+		subscribers := len(stream.subscribers)
+		stream.lock.Unlock()
+		if subscribers == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	output := &PluginOutput{WARNING, "replication lag", nil, map[string]float64{"lag": 12}, nil, time.Unix(1400000000, 0), 1}
+	stream.Publish(newPluginResult(&PluginMetadata{Name: "mysql"}, "abc", &Instance{Name: "replica"}, output))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	c.Assert(err, IsNil)
+	result := &PluginResult{}
+	c.Assert(json.Unmarshal(line, result), IsNil)
+	c.Assert(result.Plugin, Equals, "mysql")
+	c.Assert(result.Instance, Equals, "replica")
+	c.Assert(result.InstanceId, Equals, "abc")
+	c.Assert(result.State, Equals, "warning")
+	c.Assert(result.Metrics, DeepEquals, map[string]float64{"lag": 12})
+	c.Assert(result.Timestamp, Equals, int64(1400000000))
+
+	// publishing without a socket is a noop
+	var noStream *ResultStream
+	noStream.Publish(result)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"os"
+	"os/user"
+	"ringbuffer"
+	"strconv"
+	"time"
+	. "utils"
+)
+
+const (
+	RING_BUFFER_POLL_INTERVAL = 10 * time.Millisecond
+)
+
+// gives the file to the group, so its members can write to it
+func chownGroup(path, name string) error {
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, -1, gid)
+}
+
+// drains the shared memory ring buffer that applications write to using
+// the ringbuffer package and sends the points every flush interval
+func startRingBufferListener(ep *errplane.Errplane) {
+	if AgentConfig().RingBuffer == "" {
+		return
+	}
+
+	ring, err := ringbuffer.Create(AgentConfig().RingBuffer, AgentConfig().RingBufferSize)
+	if err != nil {
+		log.Error("Cannot create ring buffer %s. Error: %s", AgentConfig().RingBuffer, err)
+		return
+	}
+	if group := AgentConfig().RingBufferGroup; group != "" {
+		if err := chownGroup(AgentConfig().RingBuffer, group); err != nil {
+			log.Error("Cannot give ring buffer %s to group %s, only the agent group can write to it. Error: %s", AgentConfig().RingBuffer, group, err)
+		}
+	}
+	log.Info("Reading points from ring buffer %s", AgentConfig().RingBuffer)
+
+	// in tail sampling mode each metric keeps at most this many points per flush
+	reservoirSize := 0
+	if AgentConfig().Sampling.Mode == SAMPLING_TAIL {
+		reservoirSize = int(AgentConfig().Sampling.MaxEventsPerSecond * AgentConfig().FlushInterval.Seconds())
+	}
+	sampler := newConfiguredSampler()
+
+	reservoirs := make(map[string]*Reservoir)
+	lastFlush := time.Now()
+
+	for {
+		read := 0
+		for point := ring.Read(); point != nil; point = ring.Read() {
+			read++
+			keep, scale := sampler.Sample(point.Name)
+			if !keep {
+				continue
+			}
+			dimensions := errplane.Dimensions{"host": AgentConfig().Hostname}
+			if scale != 1 {
+				dimensions[SAMPLING_DIMENSION] = formatScale(scale)
+			}
+
+			reservoir := reservoirs[point.Name]
+			if reservoir == nil {
+				reservoir = NewReservoir(reservoirSize)
+				reservoirs[point.Name] = reservoir
+			}
+			reservoir.Add(&errplane.JsonPoint{
+				Value:      point.Value,
+				Time:       point.Timestamp.Unix(),
+				Dimensions: dimensions,
+			})
+		}
+
+		if len(reservoirs) > 0 && time.Now().Sub(lastFlush) >= AgentConfig().FlushInterval {
+			operation := &errplane.WriteOperation{Writes: make([]*errplane.JsonPoints, 0, len(reservoirs))}
+			for name, reservoir := range reservoirs {
+				items, scale := reservoir.Items()
+				write := &errplane.JsonPoints{Name: name, Points: make([]*errplane.JsonPoint, 0, len(items))}
+				for _, item := range items {
+					point := item.(*errplane.JsonPoint)
+					if scale != 1 {
+						point.Dimensions[SAMPLING_DIMENSION] = formatScale(scale)
+					}
+					write.Points = append(write.Points, point)
+				}
+				operation.Writes = append(operation.Writes, write)
+			}
+			if err := sendHttp(ep, operation); err != nil {
+				log.Error("Cannot send ring buffer points. Error: %s", err)
+			}
+			reservoirs = make(map[string]*Reservoir)
+			lastFlush = time.Now()
+		}
+
+		if read == 0 {
+			time.Sleep(RING_BUFFER_POLL_INTERVAL)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeps a moving average of the run duration of every plugin instance so
+// the scheduler can start the longest runs first and tell when the work
+// doesn't fit in the sleep interval.
+type RunHistory struct {
+	lock      sync.Mutex
+	durations map[string]time.Duration
+}
+
+var runHistory = NewRunHistory()
+
+func NewRunHistory() *RunHistory {
+	return &RunHistory{durations: make(map[string]time.Duration)}
+}
+
+func (self *RunHistory) Record(key string, duration time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	previous, ok := self.durations[key]
+	if !ok {
+		self.durations[key] = duration
+		return
+	}
+	// weigh the last run at 25%, a single slow run doesn't reorder everything
+	self.durations[key] = (previous*3 + duration) / 4
+}
+
+// returns the average run duration of the instance, 0 if it never ran
+func (self *RunHistory) Duration(key string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.durations[key]
+}
+
+// returns a copy of the average run durations
+func (self *RunHistory) Durations() map[string]time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	durations := make(map[string]time.Duration, len(self.durations))
+	for key, duration := range self.durations {
+		durations[key] = duration
+	}
+	return durations
+}
+
+// sorts the due plugins longest first, when the pool is full the short
+// runs fill the gaps left by the long ones instead of the long ones
+// starting last and stretching the cycle
+func (self *RunHistory) Sort(due []*ScheduledPlugin) {
+	sort.Stable(&byDuration{due, self})
+}
+
+// returns how far the work of a sleep cycle overruns the cycle given the
+// number of plugins that can run at the same time, 0 if it fits
+func (self *RunHistory) Overrun(scheduled []*ScheduledPlugin, cycle time.Duration, concurrency int) time.Duration {
+	var work, longest time.Duration
+	for _, s := range scheduled {
+		if s.interval <= 0 {
+			continue
+		}
+		duration := self.Duration(s.key)
+		if duration > longest {
+			longest = duration
+		}
+		// the number of times the instance runs per cycle
+		work += time.Duration(float64(duration) * float64(cycle) / float64(s.interval))
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	wallTime := work / time.Duration(concurrency)
+	if longest > wallTime {
+		wallTime = longest
+	}
+	if wallTime <= cycle {
+		return 0
+	}
+	return wallTime - cycle
+}
+
+// spreads the first runs of the instances that never ran over their
+// interval, so the instances of the plugins added together (or all of them
+// when the agent starts) don't start at the same time
+func staggerFirstRuns(scheduled []*ScheduledPlugin, lastRuns map[string]time.Time, now time.Time) {
+	first := make([]*ScheduledPlugin, 0)
+	for _, s := range scheduled {
+		if _, ok := lastRuns[s.key]; !ok {
+			first = append(first, s)
+		}
+	}
+	sort.Sort(byKey(first))
+	for i, s := range first {
+		// the first instance runs right away, the last one almost an
+		// interval later
+		offset := time.Duration(int64(s.interval) * int64(i) / int64(len(first)))
+		lastRuns[s.key] = now.Add(offset - s.interval)
+	}
+}
+
+// returns the time the next run of an instance is counted from, moved by
+// a random amount up to the jitter either way so the runs keep their
+// interval on average but drift apart instead of starting in lockstep
+func jitterRun(now time.Time, jitter time.Duration) time.Time {
+	if jitter <= 0 {
+		return now
+	}
+	return now.Add(time.Duration((rand.Float64()*2 - 1) * float64(jitter)))
+}
+
+type byKey []*ScheduledPlugin
+
+func (self byKey) Len() int           { return len(self) }
+func (self byKey) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self byKey) Less(i, j int) bool { return self[i].key < self[j].key }
+
+type byDuration struct {
+	plugins []*ScheduledPlugin
+	history *RunHistory
+}
+
+func (self *byDuration) Len() int {
+	return len(self.plugins)
+}
+
+func (self *byDuration) Swap(i, j int) {
+	self.plugins[i], self.plugins[j] = self.plugins[j], self.plugins[i]
+}
+
+func (self *byDuration) Less(i, j int) bool {
+	return self.history.Duration(self.plugins[i].key) > self.history.Duration(self.plugins[j].key)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type RunHistorySuite struct{}
+
+var _ = Suite(&RunHistorySuite{})
+
+func (self *RunHistorySuite) TestLongestFirst(c *C) {
+	history := NewRunHistory()
+	history.Record("mysql/a", 2*time.Second)
+	history.Record("redis/b", 10*time.Second)
+	history.Record("redis/b", 2*time.Second)
+	c.Assert(history.Duration("redis/b"), Equals, 8*time.Second)
+
+	due := []*ScheduledPlugin{
+		&ScheduledPlugin{key: "new/c"},
+		&ScheduledPlugin{key: "mysql/a"},
+		&ScheduledPlugin{key: "redis/b"},
+	}
+	history.Sort(due)
+	c.Assert(due[0].key, Equals, "redis/b")
+	c.Assert(due[1].key, Equals, "mysql/a")
+	c.Assert(due[2].key, Equals, "new/c")
+}
+
+func (self *RunHistorySuite) TestOverrun(c *C) {
+	history := NewRunHistory()
+	scheduled := []*ScheduledPlugin{
+		&ScheduledPlugin{key: "a", interval: time.Minute},
+		&ScheduledPlugin{key: "b", interval: time.Minute},
+		&ScheduledPlugin{key: "c", interval: 30 * time.Second},
+	}
+	history.Record("a", 40*time.Second)
+	history.Record("b", 40*time.Second)
+	history.Record("c", 20*time.Second)
+
+	// 40s + 40s + 2 * 20s of work in a minute
+	c.Assert(history.Overrun(scheduled, time.Minute, 2), Equals, time.Duration(0))
+	c.Assert(history.Overrun(scheduled, time.Minute, 1), Equals, time.Minute)
+
+	// a single run longer than the cycle never fits
+	history.Record("a", 10*time.Minute)
+	c.Assert(history.Overrun(scheduled, time.Minute, 10) > 0, Equals, true)
+}
+
+func (self *RunHistorySuite) TestStagger(c *C) {
+	now := time.Now()
+	lastRuns := map[string]time.Time{"redis/a": now.Add(-time.Second)}
+	scheduled := []*ScheduledPlugin{
+		&ScheduledPlugin{key: "mysql/c", interval: time.Minute},
+		&ScheduledPlugin{key: "redis/a", interval: time.Minute},
+		&ScheduledPlugin{key: "mysql/b", interval: time.Minute},
+		&ScheduledPlugin{key: "mysql/d", interval: 2 * time.Minute},
+	}
+	staggerFirstRuns(scheduled, lastRuns, now)
+	// the instances that already ran keep their schedule
+	c.Assert(lastRuns["redis/a"], Equals, now.Add(-time.Second))
+	c.Assert(lastRuns["mysql/b"], Equals, now.Add(-time.Minute))
+	c.Assert(lastRuns["mysql/c"], Equals, now.Add(20*time.Second-time.Minute))
+	c.Assert(lastRuns["mysql/d"], Equals, now.Add(80*time.Second-2*time.Minute))
+}
+
+func (self *RunHistorySuite) TestJitter(c *C) {
+	mysql := &PluginMetadata{Name: "mysql"}
+	defer setTestConfig(func(config *Config) { config.PluginConcurrency.Jitter = 0.1 })()
+	c.Assert(pluginJitter(mysql, &Instance{}, time.Minute), Equals, 6*time.Second)
+	c.Assert(pluginJitter(mysql, &Instance{Jitter: "10s"}, time.Minute), Equals, 10*time.Second)
+	// at most half the interval
+	c.Assert(pluginJitter(mysql, &Instance{Jitter: "1m"}, time.Minute), Equals, 30*time.Second)
+	c.Assert(pluginJitter(mysql, &Instance{Jitter: "0s"}, time.Minute), Equals, time.Duration(0))
+	c.Assert(pluginJitter(mysql, &Instance{Jitter: "soon"}, time.Minute), Equals, 6*time.Second)
+
+	now := time.Now()
+	c.Assert(jitterRun(now, 0), Equals, now)
+	moved := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		run := jitterRun(now, 6*time.Second)
+		c.Assert(run.Sub(now) >= -6*time.Second && run.Sub(now) <= 6*time.Second, Equals, true)
+		moved[run] = true
+	}
+	c.Assert(len(moved) > 1, Equals, true)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	SAMPLING_HEAD = "head"
+	SAMPLING_TAIL = "tail"
+
+	SAMPLING_DIMENSION = "sampling_scale"
+)
+
+// Head sampling of event streams. The first events of every second are
+// always kept, once a stream goes beyond the configured rate the events
+// are kept with the probability limit/rate and scaled accordingly, so the
+// sum of the scales is an unbiased estimate of the real number of events.
+// The streams that were idle for a whole window are forgotten, their
+// previous window had no events.
+type Sampler struct {
+	lock    sync.Mutex
+	limit   float64 // events per second
+	streams map[string]*sampledStream
+	swept   time.Time // the last time the idle streams were removed
+}
+
+type sampledStream struct {
+	windowStart  time.Time
+	seen         int
+	previousSeen int
+}
+
+func NewSampler(limit float64) *Sampler {
+	return &Sampler{limit: limit, streams: make(map[string]*sampledStream)}
+}
+
+// returns whether the event should be kept and the scale the kept event
+// stands for. A sampler with no limit keeps everything.
+func (self *Sampler) Sample(stream string) (bool, float64) {
+	if self == nil || self.limit <= 0 {
+		return true, 1
+	}
+	return self.sample(stream, time.Now())
+}
+
+func (self *Sampler) sample(stream string, now time.Time) (bool, float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if now.Sub(self.swept) >= time.Second {
+		for name, s := range self.streams {
+			if now.Sub(s.windowStart) >= 2*time.Second {
+				delete(self.streams, name)
+			}
+		}
+		self.swept = now
+	}
+
+	s := self.streams[stream]
+	if s == nil {
+		s = &sampledStream{windowStart: now}
+		self.streams[stream] = s
+	}
+	if now.Sub(s.windowStart) >= time.Second {
+		s.previousSeen = s.seen
+		s.seen = 0
+		s.windowStart = now
+	}
+	s.seen++
+
+	if float64(s.seen) <= self.limit {
+		return true, 1
+	}
+
+	// estimate the rate from the previous window if it was busier
+	rate := float64(s.seen)
+	if float64(s.previousSeen) > rate {
+		rate = float64(s.previousSeen)
+	}
+	probability := self.limit / rate
+	if rand.Float64() >= probability {
+		return false, 0
+	}
+	return true, 1 / probability
+}
+
+// Tail sampling, keeps a uniform random sample of at most size items
+// out of all the items added (Algorithm R) so memory is bounded no matter
+// how many items are added between two flushes.
+type Reservoir struct {
+	size  int
+	seen  int
+	items []interface{}
+}
+
+func NewReservoir(size int) *Reservoir {
+	return &Reservoir{size: size}
+}
+
+func (self *Reservoir) Add(item interface{}) {
+	self.seen++
+	if self.size <= 0 || len(self.items) < self.size {
+		self.items = append(self.items, item)
+		return
+	}
+	if idx := rand.Intn(self.seen); idx < self.size {
+		self.items[idx] = item
+	}
+}
+
+// returns the sampled items and the scale each item stands for
+func (self *Reservoir) Items() ([]interface{}, float64) {
+	if len(self.items) == 0 {
+		return nil, 1
+	}
+	return self.items, float64(self.seen) / float64(len(self.items))
+}
+
+func formatScale(scale float64) string {
+	return strconv.FormatFloat(scale, 'f', -1, 64)
+}
+
+func newConfiguredSampler() *Sampler {
+	if AgentConfig().Sampling.Mode != SAMPLING_HEAD {
+		return nil
+	}
+	return NewSampler(AgentConfig().Sampling.MaxEventsPerSecond)
+}
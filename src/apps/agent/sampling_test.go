@@ -0,0 +1,63 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type SamplingSuite struct{}
+
+var _ = Suite(&SamplingSuite{})
+
+func (self *SamplingSuite) TestHeadSampling(c *C) {
+	sampler := NewSampler(100)
+	kept := 0
+	total := 0.0
+	for i := 0; i < 10000; i++ {
+		keep, scale := sampler.Sample("logs")
+		if keep {
+			kept++
+			total += scale
+		}
+	}
+	c.Assert(kept < 1000, Equals, true)
+	// the scales should add up to roughly the number of events
+	c.Assert(total > 7000 && total < 13000, Equals, true, Commentf("total: %f", total))
+
+	var noSampling *Sampler
+	keep, scale := noSampling.Sample("logs")
+	c.Assert(keep, Equals, true)
+	c.Assert(scale, Equals, 1.0)
+}
+
+func (self *SamplingSuite) TestIdleStreams(c *C) {
+	sampler := NewSampler(100)
+	now := time.Now()
+	sampler.sample("logs /var/log/a", now)
+	sampler.sample("logs /var/log/b", now.Add(1500*time.Millisecond))
+	c.Assert(sampler.streams, HasLen, 2)
+
+	// a is idle for more than a window, b for less than one
+	sampler.sample("logs /var/log/c", now.Add(2500*time.Millisecond))
+	c.Assert(sampler.streams, HasLen, 2)
+	_, ok := sampler.streams["logs /var/log/a"]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *SamplingSuite) TestReservoir(c *C) {
+	reservoir := NewReservoir(10)
+	for i := 0; i < 1000; i++ {
+		reservoir.Add(i)
+	}
+	items, scale := reservoir.Items()
+	c.Assert(items, HasLen, 10)
+	c.Assert(scale, Equals, 100.0)
+
+	unbounded := NewReservoir(0)
+	for i := 0; i < 1000; i++ {
+		unbounded.Add(i)
+	}
+	items, scale = unbounded.Items()
+	c.Assert(items, HasLen, 1000)
+	c.Assert(scale, Equals, 1.0)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/hex"
+	"os/exec"
+	"strings"
+	. "utils"
+)
+
+// returns the command and arguments that run the plugin in a transient
+// container and the name of the container, or an empty name if the plugin
+// isn't sandboxed. The container has a read-only root file system and
+// only sees the plugin directory and the configured mounts (read-only).
+func sandboxCommand(plugin *PluginMetadata, cmdPath string, args []string, env []string) (string, []string, string) {
+	sandbox := AgentConfig().PluginSandboxes[plugin.Name]
+	if sandbox == nil {
+		return "", nil, ""
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	container := "errplane-plugin-" + plugin.Name + "-" + hex.EncodeToString(suffix)
+
+	runArgs := []string{
+		"run", "--rm", "-i",
+		"--name", container,
+		"--read-only",
+		"--network", sandbox.Network,
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"--tmpfs", "/tmp",
+		"-v", plugin.Path + ":" + plugin.Path + ":ro",
+	}
+	for _, mount := range sandbox.Mounts {
+		runArgs = append(runArgs, "-v", mount+":"+mount+":ro")
+	}
+	if sandbox.Memory != "" {
+		runArgs = append(runArgs, "--memory", sandbox.Memory)
+	}
+	// only the names, the runtime client passes the values from its own
+	// environment so they don't show up in the process list
+	for _, variable := range env {
+		runArgs = append(runArgs, "-e", strings.SplitN(variable, "=", 2)[0])
+	}
+	runArgs = append(runArgs, "--entrypoint", cmdPath, sandbox.Image)
+	return sandbox.Runtime, append(runArgs, args...), container
+}
+
+// killing the runtime client doesn't stop the container, make sure it's
+// gone if the plugin was killed
+func removeSandbox(plugin *PluginMetadata, container string) {
+	runtime := AgentConfig().PluginSandboxes[plugin.Name].Runtime
+	if err := exec.Command(runtime, "rm", "-f", container).Run(); err != nil {
+		log.Error("Cannot remove the container %s of plugin %s. Error: %s", container, plugin.Name, err)
+	}
+}
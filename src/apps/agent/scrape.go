@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/bmizerany/pat"
+	"github.com/errplane/errplane-go"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	. "utils"
+)
+
+type scrapedPoint struct {
+	sequence int64
+	name     string
+	point    *errplane.JsonPoint
+}
+
+// The points waiting for the backend to pull them in scrape mode, numbered
+// so the backend acknowledges the ones it stored by pulling the points
+// after them. The latest value of every series is kept as well for
+// prometheus compatible scrapers, which don't acknowledge anything.
+type ScrapeBuffer struct {
+	lock      sync.Mutex
+	maxPoints int
+	points    []*scrapedPoint
+	sequence  int64
+	pulled    int64 // the sequence of the last point the backend pulled
+	dropped   int64
+	latest    map[string]*scrapedPoint
+}
+
+var scrapeBuffer *ScrapeBuffer
+
+func NewScrapeBuffer(maxPoints int) *ScrapeBuffer {
+	return &ScrapeBuffer{maxPoints: maxPoints, latest: make(map[string]*scrapedPoint)}
+}
+
+func (self *ScrapeBuffer) Add(writes []*errplane.JsonPoints) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, write := range writes {
+		for _, point := range write.Points {
+			self.sequence++
+			scraped := &scrapedPoint{self.sequence, write.Name, point}
+			self.points = append(self.points, scraped)
+			key := seriesName(write.Name, point.Dimensions) + " host=" + point.Dimensions["host"]
+			if _, ok := self.latest[key]; ok || len(self.latest) < self.maxPoints {
+				self.latest[key] = scraped
+			}
+		}
+	}
+	if overflow := len(self.points) - self.maxPoints; overflow > 0 {
+		log.Warn("The scrape buffer is full, dropping the %d oldest points. Is the backend pulling them?", overflow)
+		for _, scraped := range self.points[:overflow] {
+			// the points already pulled aren't lost, the backend
+			// acknowledges them on its next pull
+			if scraped.sequence > self.pulled {
+				self.dropped++
+			}
+		}
+		self.points = self.points[overflow:]
+	}
+}
+
+// returns the number of points waiting to be pulled
+func (self *ScrapeBuffer) Pending() int {
+	if self == nil {
+		return 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.points)
+}
+
+// The response of /points, the backend passes the sequence of the last
+// point it stored as ?after= on the next pull. Dropped counts the points
+// lost since the agent started because the buffer was full before the
+// backend pulled them.
+type ScrapedWrites struct {
+	Sequence int64                  `json:"sequence"`
+	Dropped  int64                  `json:"dropped"`
+	Writes   []*errplane.JsonPoints `json:"writes"`
+}
+
+// forgets the points up to the given sequence and returns the ones after it
+func (self *ScrapeBuffer) After(sequence int64) *ScrapedWrites {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	acknowledged := sort.Search(len(self.points), func(i int) bool { return self.points[i].sequence > sequence })
+	self.points = self.points[acknowledged:]
+
+	result := &ScrapedWrites{Sequence: sequence, Dropped: self.dropped, Writes: make([]*errplane.JsonPoints, 0)}
+	var write *errplane.JsonPoints
+	for _, scraped := range self.points {
+		if write == nil || write.Name != scraped.name {
+			write = &errplane.JsonPoints{Name: scraped.name}
+			result.Writes = append(result.Writes, write)
+		}
+		write.Points = append(write.Points, scraped.point)
+		result.Sequence = scraped.sequence
+	}
+	if result.Sequence > self.pulled {
+		self.pulled = result.Sequence
+	}
+	return result
+}
+
+// returns the name with the characters prometheus doesn't allow replaced
+// by underscores, e.g. server.stats.cpu.user becomes server_stats_cpu_user
+func prometheusName(name string, allowColons bool) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || (i > 0 && c >= '0' && c <= '9') || (allowColons && c == ':')
+		if !valid {
+			sanitized[i] = '_'
+		}
+	}
+	return string(sanitized)
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writes the latest value of every series in the prometheus text format
+func (self *ScrapeBuffer) WriteMetrics(buffer *bytes.Buffer) {
+	self.lock.Lock()
+	keys := make([]string, 0, len(self.latest))
+	for key := range self.latest {
+		keys = append(keys, key)
+	}
+	latest := make(map[string]*scrapedPoint, len(self.latest))
+	for key, scraped := range self.latest {
+		latest[key] = scraped
+	}
+	self.lock.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		scraped := latest[key]
+		buffer.WriteString(prometheusName(scraped.name, true))
+		if len(scraped.point.Dimensions) > 0 {
+			names := make([]string, 0, len(scraped.point.Dimensions))
+			for name := range scraped.point.Dimensions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			labels := make([]string, 0, len(names))
+			for _, name := range names {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, prometheusName(name, false), prometheusEscaper.Replace(scraped.point.Dimensions[name])))
+			}
+			fmt.Fprintf(buffer, "{%s}", strings.Join(labels, ","))
+		}
+		fmt.Fprintf(buffer, " %s", strconv.FormatFloat(scraped.point.Value, 'g', -1, 64))
+		if scraped.point.Time != 0 {
+			fmt.Fprintf(buffer, " %d", scraped.point.Time*1000)
+		}
+		buffer.WriteString("\n")
+	}
+}
+
+func servePoints(w http.ResponseWriter, req *http.Request) {
+	var sequence int64
+	if after := req.URL.Query().Get("after"); after != "" {
+		var err error
+		if sequence, err = strconv.ParseInt(after, 10, 64); err != nil {
+			http.Error(w, "Invalid sequence", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJson(w, http.StatusOK, scrapeBuffer.After(sequence))
+}
+
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	buffer := bytes.NewBuffer(nil)
+	scrapeBuffer.WriteMetrics(buffer)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
+
+// serves the points on scrape.listen, with the tls and the tokens of the
+// local api
+func startScrapeServer() {
+	m := pat.New()
+	m.Get("/points", authorize(SCOPE_SCRAPE, servePoints))
+	m.Get("/metrics", authorize(SCOPE_SCRAPE, serveMetrics))
+
+	listener, err := net.Listen("tcp", AgentConfig().Scrape.Listen)
+	if err != nil {
+		log.Error("Cannot listen on %s for the scrape requests. Error: %s", AgentConfig().Scrape.Listen, err)
+		return
+	}
+	if listener, err = apiListener(listener); err != nil {
+		log.Error("Error while setting up tls for the scrape requests. Error: %s", err)
+		return
+	}
+	log.Info("Serving the points to pull on %s", listener.Addr())
+	if err := http.Serve(listener, m); err != nil {
+		log.Error("Cannot serve the points to pull on %s. Error: %s", AgentConfig().Scrape.Listen, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	. "utils"
+)
+
+type ScrapeSuite struct{}
+
+var _ = Suite(&ScrapeSuite{})
+
+func (self *ScrapeSuite) TearDownTest(c *C) {
+	scrapeBuffer = nil
+}
+
+func (self *ScrapeSuite) TestAcknowledgements(c *C) {
+	buffer := NewScrapeBuffer(3)
+	buffer.Add([]*errplane.JsonPoints{batchWrite("cpu", 1, 2).Writes[0], batchWrite("mem", 3).Writes[0]})
+
+	pulled := buffer.After(0)
+	c.Assert(pulled.Sequence, Equals, int64(3))
+	c.Assert(pulled.Writes, HasLen, 2)
+	c.Assert(pulled.Writes[0].Points, HasLen, 2)
+	// not acknowledged yet
+	c.Assert(buffer.After(0).Writes, HasLen, 2)
+
+	buffer.Add([]*errplane.JsonPoints{batchWrite("cpu", 4).Writes[0]})
+	pulled = buffer.After(3)
+	// the point dropped to make room had been pulled, it isn't lost
+	c.Assert(pulled.Dropped, Equals, int64(0))
+	c.Assert(pulled.Sequence, Equals, int64(4))
+	c.Assert(pulled.Writes, HasLen, 1)
+	c.Assert(pulled.Writes[0].Points[0].Value, Equals, 4.0)
+	c.Assert(buffer.Pending(), Equals, 1)
+
+	// nothing new
+	pulled = buffer.After(4)
+	c.Assert(pulled.Sequence, Equals, int64(4))
+	c.Assert(pulled.Writes, HasLen, 0)
+
+	// the oldest points are dropped when the backend doesn't pull them
+	buffer.Add([]*errplane.JsonPoints{batchWrite("cpu", 5, 6, 7, 8).Writes[0]})
+	pulled = buffer.After(4)
+	c.Assert(pulled.Dropped, Equals, int64(1))
+	c.Assert(pulled.Writes[0].Points, HasLen, 3)
+	c.Assert(pulled.Writes[0].Points[0].Value, Equals, 6.0)
+}
+
+func (self *ScrapeSuite) TestDelivery(c *C) {
+	scrapeBuffer = NewScrapeBuffer(10)
+	failing := func(*errplane.WriteOperation) error { return fmt.Errorf("outbound connections are forbidden") }
+	c.Assert(deliverHttp(failing, batchWrite("cpu", 1, 2)), IsNil)
+	// the anomalies aren't sent either
+	reporter := &ReporterMock{}
+	(&GlobalDimensionsReporter{reporter}).Report("errplane.anomalies", 1, time.Now(), "", errplane.Dimensions{"host": "web1"})
+	c.Assert(reporter.events, HasLen, 0)
+	c.Assert(scrapeBuffer.Pending(), Equals, 3)
+	pulled := scrapeBuffer.After(0)
+	c.Assert(pulled.Writes, HasLen, 2)
+	c.Assert(pulled.Writes[1].Name, Equals, "errplane.anomalies")
+}
+
+func (self *ScrapeSuite) TestMetrics(c *C) {
+	buffer := NewScrapeBuffer(10)
+	buffer.Add([]*errplane.JsonPoints{
+		&errplane.JsonPoints{Name: "server.stats.cpu.user", Points: []*errplane.JsonPoint{
+			&errplane.JsonPoint{Value: 1, Time: 1400000000, Dimensions: errplane.Dimensions{"host": "web1"}},
+			&errplane.JsonPoint{Value: 2.5, Time: 1400000010, Dimensions: errplane.Dimensions{"host": "web1"}},
+		}},
+		&errplane.JsonPoints{Name: "plugins.mysql.status", Points: []*errplane.JsonPoint{
+			&errplane.JsonPoint{Value: math.Inf(1), Dimensions: errplane.Dimensions{"host": "web1", "status-msg": "say \"hi\""}},
+		}},
+	})
+	out := bytes.NewBuffer(nil)
+	buffer.WriteMetrics(out)
+	c.Assert(out.String(), Equals, `plugins_mysql_status{host="web1",status_msg="say \"hi\""} +Inf`+"\n"+
+		`server_stats_cpu_user{host="web1"} 2.5 1400000010000`+"\n")
+}
+
+func (self *ScrapeSuite) TestAuthentication(c *C) {
+	scrapeBuffer = NewScrapeBuffer(10)
+	scrapeBuffer.Add([]*errplane.JsonPoints{batchWrite("cpu", 1).Writes[0]})
+	defer setTestConfig(func(config *Config) {
+		config.ApiTokens = []*ApiToken{
+			&ApiToken{Name: "backend", Token: "backend-token", Scopes: []string{SCOPE_SCRAPE}},
+			&ApiToken{Name: "metrics", Token: "metrics-token", Scopes: []string{SCOPE_WRITE}},
+		}
+	})()
+	handler := authorize(SCOPE_SCRAPE, servePoints)
+	request := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/points?after=0", nil)
+		req.Header.Set(TOKEN_HEADER, token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	c.Assert(request("metrics-token").Code, Equals, http.StatusForbidden)
+	recorder := request("backend-token")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	pulled := &ScrapedWrites{}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), pulled), IsNil)
+	c.Assert(pulled.Sequence, Equals, int64(1))
+	c.Assert(pulled.Writes[0].Name, Equals, "cpu")
+}
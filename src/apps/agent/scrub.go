@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"path"
+	"sort"
+	. "utils"
+)
+
+func matchesAny(globs []string, key string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the first 16 hex characters of the salted sha256 of the value,
+// the same value always has the same hash so the series are kept
+func hashDimension(salt, value string) string {
+	hash := sha256.Sum256([]byte(salt + value))
+	return fmt.Sprintf("%x", hash[:8])
+}
+
+// applies the scrubbing configuration to the dimensions of a point or an
+// alert that is about to leave the host: the dimensions that aren't
+// allowed or are dropped are removed, the hashed ones are replaced by
+// their hash and the matches of the patterns in the other values are
+// replaced by [pattern name]. Returns a copy, the dimensions are left
+// untouched.
+func scrubDimensions(dimensions errplane.Dimensions) errplane.Dimensions {
+	config := &AgentConfig().Scrubbing
+	if dimensions == nil || (len(config.Allow) == 0 && len(config.Drop) == 0 && len(config.Hash) == 0 && len(config.Patterns) == 0) {
+		return dimensions
+	}
+
+	// the patterns are applied in a stable order
+	names := make([]string, 0, len(config.Patterns))
+	for name, _ := range config.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scrubbed := make(errplane.Dimensions, len(dimensions))
+	for key, value := range dimensions {
+		if len(config.Allow) > 0 && !matchesAny(config.Allow, key) {
+			continue
+		}
+		if matchesAny(config.Drop, key) {
+			continue
+		}
+		if matchesAny(config.Hash, key) {
+			scrubbed[key] = hashDimension(config.Salt, value)
+			continue
+		}
+		for _, name := range names {
+			value = config.Patterns[name].ReplaceAllString(value, "["+name+"]")
+		}
+		scrubbed[key] = value
+	}
+	return scrubbed
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"regexp"
+	. "utils"
+)
+
+type ScrubSuite struct{}
+
+var _ = Suite(&ScrubSuite{})
+
+func (self *ScrubSuite) TestScrubDimensions(c *C) {
+	dimensions := errplane.Dimensions{"host": "web1", "user": "alice", "client_ip": "10.0.0.1", "url": "/search?q=alice"}
+	c.Assert(scrubDimensions(dimensions), DeepEquals, dimensions)
+
+	defer setTestConfig(func(config *Config) {
+		config.Scrubbing = ScrubbingConfig{
+			Drop: []string{"*_ip"},
+			Hash: []string{"user"},
+			Salt: "salt",
+			Patterns: map[string]*regexp.Regexp{
+				"query": regexp.MustCompile(`\?.*`),
+			},
+		}
+	})()
+	scrubbed := scrubDimensions(dimensions)
+	c.Assert(scrubbed, HasLen, 3)
+	c.Assert(scrubbed["host"], Equals, "web1")
+	c.Assert(scrubbed["user"], Equals, hashDimension("salt", "alice"))
+	c.Assert(scrubbed["user"], Matches, "[0-9a-f]{16}")
+	c.Assert(scrubbed["user"], Not(Equals), hashDimension("other salt", "alice"))
+	c.Assert(scrubbed["url"], Equals, "/search[query]")
+	// the dimensions of the caller are left untouched
+	c.Assert(dimensions["user"], Equals, "alice")
+
+	setTestConfig(func(config *Config) { config.Scrubbing = ScrubbingConfig{Allow: []string{"host", "status*"}} })
+	c.Assert(scrubDimensions(errplane.Dimensions{"host": "web1", "status": "ok", "status_msg": "OK", "user": "alice"}), DeepEquals,
+		errplane.Dimensions{"host": "web1", "status": "ok", "status_msg": "OK"})
+	c.Assert(scrubDimensions(nil), IsNil)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	. "utils"
+)
+
+// agent secrets init | list | set <name> | delete <name>, manages the
+// encrypted secrets file. The values are read from stdin, they would show
+// in ps on the command line.
+func secretsCommand(out io.Writer, in io.Reader, args []string) int {
+	config := AgentConfig().Secrets
+	if config.File == "" {
+		fmt.Fprintf(out, "The secrets file isn't configured, set secrets.file and secrets.key-file\n")
+		return 1
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(out, "Usage: secrets init | list | set <name> | delete <name>\n")
+		return 2
+	}
+
+	switch args[0] {
+	case "init":
+		if _, err := generateSecretsKey(config.KeyFile); err != nil {
+			fmt.Fprintf(out, "Cannot create the key %s. Error: %s\n", config.KeyFile, err)
+			return 1
+		}
+		fmt.Fprintf(out, "Created the key %s, back it up, the secrets can't be decrypted without it\n", config.KeyFile)
+		return 0
+	case "list":
+		secrets, err := readSecretsFile(config.File, config.KeyFile)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot read the secrets. Error: %s\n", err)
+			return 1
+		}
+		names := make([]string, 0, len(secrets))
+		for name, _ := range secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s\n", name)
+		}
+		return 0
+	case "set", "delete":
+		if len(args) != 2 {
+			fmt.Fprintf(out, "Usage: secrets %s <name>\n", args[0])
+			return 2
+		}
+	default:
+		fmt.Fprintf(out, "Unknown command '%s'\n", args[0])
+		return 2
+	}
+
+	name := args[1]
+	if !secretNameRegex.MatchString(name) {
+		fmt.Fprintf(out, "Invalid secret name '%s'\n", name)
+		return 2
+	}
+	secrets, err := readSecretsFile(config.File, config.KeyFile)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot read the secrets. Error: %s\n", err)
+		return 1
+	}
+	if args[0] == "delete" {
+		if _, ok := secrets[name]; !ok {
+			fmt.Fprintf(out, "Unknown secret '%s'\n", name)
+			return 1
+		}
+		delete(secrets, name)
+	} else {
+		value, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(out, "Cannot read the value. Error: %s\n", err)
+			return 1
+		}
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			fmt.Fprintf(out, "The value of the secret is read from stdin and can't be empty\n")
+			return 1
+		}
+		secrets[name] = value
+	}
+	if err := writeSecretsFile(config.File, config.KeyFile, secrets); err != nil {
+		fmt.Fprintf(out, "Cannot write the secrets to %s. Error: %s\n", config.File, err)
+		return 1
+	}
+	return 0
+}
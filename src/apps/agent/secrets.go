@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	SECRETS_KEY_SIZE  = 32 // aes-256
+	SECRETS_CACHE_TTL = 5 * time.Minute
+	SECRET_MASK       = "****"
+)
+
+var (
+	secretNameRegex = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+	// a template calling secret, e.g. {{secret "mysql.password"}}
+	secretRefRegex = regexp.MustCompile(`\{\{[^}]*\bsecret\b`)
+)
+
+// Masks the values of the secrets looked up so far wherever they show up,
+// e.g. in the output of a plugin that echoes its arguments
+type SecretRedactor struct {
+	lock     sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+var revealedSecrets = NewSecretRedactor()
+
+func NewSecretRedactor() *SecretRedactor {
+	return &SecretRedactor{values: make(map[string]bool), replacer: strings.NewReplacer()}
+}
+
+func (self *SecretRedactor) Add(value string) {
+	if value == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.values[value] {
+		return
+	}
+	self.values[value] = true
+
+	// the longest values first, a secret containing another one is masked whole
+	values := make([]string, 0, len(self.values))
+	for value, _ := range self.values {
+		values = append(values, value)
+	}
+	sort.Sort(byLengthDesc(values))
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, SECRET_MASK)
+	}
+	self.replacer = strings.NewReplacer(pairs...)
+}
+
+func (self *SecretRedactor) Redact(s string) string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.replacer.Replace(s)
+}
+
+type byLengthDesc []string
+
+func (self byLengthDesc) Len() int           { return len(self) }
+func (self byLengthDesc) Less(i, j int) bool { return len(self[i]) > len(self[j]) }
+func (self byLengthDesc) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// reads the aes key of the secrets file, 64 hex digits
+func readSecretsKey(keyFile string) ([]byte, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != SECRETS_KEY_SIZE {
+		return nil, fmt.Errorf("The secrets key in %s must be %d hex digits", keyFile, 2*SECRETS_KEY_SIZE)
+	}
+	return key, nil
+}
+
+// creates a random key readable by its owner only, an existing key is
+// never replaced, the secrets encrypted with it would be lost
+func generateSecretsKey(keyFile string) ([]byte, error) {
+	key := make([]byte, SECRETS_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encrypts the secrets with aes-gcm, the nonce comes first
+func encryptSecrets(key []byte, secrets map[string]string) ([]byte, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptSecrets(key []byte, data []byte) (map[string]string, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("The secrets file is truncated")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt the secrets, wrong key or corrupted file")
+	}
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns the secrets of the encrypted file, none if the file doesn't exist yet
+func readSecretsFile(file, keyFile string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := readSecretsKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return decryptSecrets(key, data)
+}
+
+func writeSecretsFile(file, keyFile string, secrets map[string]string) error {
+	key, err := readSecretsKey(keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := encryptSecrets(key, secrets)
+	if err != nil {
+		return err
+	}
+	// the running agent may be reading the file, replace it atomically
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// returns the value of the secret from the secrets file or from the config
+// service, the values fetched from the config service are cached for a few
+// minutes. The value is masked in the logs from now on.
+func lookupSecret(name string) (string, error) {
+	if !secretNameRegex.MatchString(name) {
+		return "", fmt.Errorf("Invalid secret name '%s'", name)
+	}
+	config := AgentConfig().Secrets
+
+	if config.File != "" {
+		secrets, err := readSecretsFile(config.File, config.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read the secrets from %s. Error: %s", config.File, err)
+		}
+		if value, ok := secrets[name]; ok {
+			revealedSecrets.Add(value)
+			return value, nil
+		}
+	}
+
+	if config.ConfigService {
+		value, err := probeCache.Get("secret\x00"+name, SECRETS_CACHE_TTL, func() ([]byte, error) {
+			value, err := GetSecret(name)
+			return []byte(value), err
+		})
+		if err != nil {
+			return "", fmt.Errorf("Cannot get secret '%s' from the config service. Error: %s", name, err)
+		}
+		revealedSecrets.Add(string(value))
+		return string(value), nil
+	}
+	return "", fmt.Errorf("Unknown secret '%s'", name)
+}
+
+// whether the value of the argument is looked up in the secrets
+func usesSecret(value string) bool {
+	return secretRefRegex.MatchString(value)
+}
+
+// the names of the arguments of the instance holding a secret, they're
+// passed to the plugin in the environment instead of the command line
+// where anyone could read them with ps
+func secretArgNames(instance *Instance) map[string]bool {
+	names := make(map[string]bool)
+	for name, value := range instance.Args {
+		if usesSecret(value) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// the environment variable a secret argument is passed in, e.g.
+// ERRPLANE_SECRET_PASSWORD for --password
+func secretArgEnvName(name string) string {
+	return "ERRPLANE_SECRET_" + envNameSuffix(name)
+}
+
+// returns the command line arguments of the plugin and the environment
+// variables holding its secret arguments
+func pluginCommandArgs(instance *Instance, instanceArgs map[string]string, secrets map[string]bool) ([]string, []string) {
+	args := append([]string{}, instance.ArgsList...)
+	env := make([]string, 0, len(secrets))
+	for _, name := range sortedArgNames(instanceArgs) {
+		if secrets[name] {
+			env = append(env, secretArgEnvName(name)+"="+instanceArgs[name])
+			continue
+		}
+		args = append(args, "--"+name, instanceArgs[name])
+	}
+	return args, env
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	"strings"
+	. "utils"
+)
+
+type SecretsSuite struct{}
+
+var _ = Suite(&SecretsSuite{})
+
+func (self *SecretsSuite) TestSecretsFile(c *C) {
+	dir := c.MkDir()
+	defer setTestConfig(func(config *Config) {
+		config.Secrets = SecretsConfig{File: path.Join(dir, "secrets.enc"), KeyFile: path.Join(dir, "secrets.key")}
+	})()
+
+	c.Assert(secretsCommand(ioutil.Discard, nil, []string{"init"}), Equals, 0)
+	// an existing key is never replaced
+	c.Assert(secretsCommand(ioutil.Discard, nil, []string{"init"}), Equals, 1)
+	c.Assert(secretsCommand(ioutil.Discard, strings.NewReader("s3cr3t-pass\n"), []string{"set", "mysql.password"}), Equals, 0)
+
+	data, err := ioutil.ReadFile(AgentConfig().Secrets.File)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(data, []byte("s3cr3t-pass")), Equals, false)
+
+	value, err := lookupSecret("mysql.password")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "s3cr3t-pass")
+	_, err = lookupSecret("postgres.password")
+	c.Assert(err, ErrorMatches, "Unknown secret 'postgres.password'")
+	_, err = lookupSecret("../key")
+	c.Assert(err, ErrorMatches, "Invalid secret name.*")
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(secretsCommand(out, nil, []string{"list"}), Equals, 0)
+	c.Assert(out.String(), Equals, "mysql.password\n")
+
+	// a file encrypted with another key can't be read
+	other, err := encryptSecrets(make([]byte, SECRETS_KEY_SIZE), map[string]string{"name": "value"})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(AgentConfig().Secrets.File, other, 0600), IsNil)
+	_, err = lookupSecret("name")
+	c.Assert(err, ErrorMatches, ".*wrong key or corrupted file")
+}
+
+func (self *SecretsSuite) TestSecretArgumentsStayOffTheCommandLine(c *C) {
+	dir := c.MkDir()
+	defer setTestConfig(func(config *Config) {
+		config.Secrets = SecretsConfig{File: path.Join(dir, "secrets.enc"), KeyFile: path.Join(dir, "secrets.key")}
+	})()
+	_, err := generateSecretsKey(AgentConfig().Secrets.KeyFile)
+	c.Assert(err, IsNil)
+	c.Assert(writeSecretsFile(AgentConfig().Secrets.File, AgentConfig().Secrets.KeyFile, map[string]string{"db": "hunter2"}), IsNil)
+
+	instance := &Instance{Args: map[string]string{"user": "monitor", "password": `{{secret "db"}}`}}
+	secrets := secretArgNames(instance)
+	c.Assert(secrets, DeepEquals, map[string]bool{"password": true})
+	rendered, err := renderInstanceArgs(instance)
+	c.Assert(err, IsNil)
+	args, env := pluginCommandArgs(rendered, rendered.Args, secrets)
+	c.Assert(args, DeepEquals, []string{"--user", "monitor"})
+	c.Assert(env, DeepEquals, []string{"ERRPLANE_SECRET_PASSWORD=hunter2"})
+
+	c.Assert(revealedSecrets.Redact("connecting with hunter2"), Equals, "connecting with ****")
+
+	_, err = renderInstanceArgs(&Instance{ArgsList: []string{`{{secret "db"}}`}})
+	c.Assert(err, ErrorMatches, "Secrets can't be passed as positional arguments.*")
+	_, err = renderInstanceArgs(&Instance{Args: instance.Args, Remote: &RemoteTarget{Host: "db1"}})
+	c.Assert(err, ErrorMatches, "Secrets can't be passed to remote instances")
+}
+
+func (self *SecretsSuite) TestRedactLongestSecretFirst(c *C) {
+	redactor := NewSecretRedactor()
+	c.Assert(redactor.Redact("nothing to hide"), Equals, "nothing to hide")
+	redactor.Add("pass")
+	redactor.Add("password123")
+	redactor.Add("")
+	c.Assert(redactor.Redact("password123 pass"), Equals, "**** ****")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+var (
+	W1_DEVICES_DIR = "/sys/bus/w1/devices"
+	GPIO_DIR       = "/sys/class/gpio"
+)
+
+// reads the temperature in celsius of a ds18b20 like 1-wire sensor, the
+// w1_slave file looks like
+// 72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+// 72 01 4b 46 7f ff 0e 10 57 t=23125
+func readOneWireTemperature(device string) (float64, error) {
+	content, err := ioutil.ReadFile(path.Join(W1_DEVICES_DIR, device, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "YES") {
+		return 0, fmt.Errorf("Invalid crc")
+	}
+	idx := strings.LastIndex(lines[1], "t=")
+	if idx < 0 {
+		return 0, fmt.Errorf("Cannot find the temperature")
+	}
+	value, err := strconv.ParseFloat(lines[1][idx+2:], 64)
+	return value / 1000, err
+}
+
+func readSysfsValue(filename string) (float64, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+}
+
+// reads the value of the gpio, exporting it as an input if necessary
+func readGpio(pin int) (float64, error) {
+	dir := path.Join(GPIO_DIR, fmt.Sprintf("gpio%d", pin))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(path.Join(GPIO_DIR, "export"), []byte(strconv.Itoa(pin)), 0200); err != nil {
+			return 0, err
+		}
+		if err := ioutil.WriteFile(path.Join(dir, "direction"), []byte("in"), 0644); err != nil {
+			return 0, err
+		}
+	}
+	return readSysfsValue(path.Join(dir, "value"))
+}
+
+func readSensor(sensor *Sensor) (string, float64, error) {
+	switch sensor.Type {
+	case "1-wire":
+		value, err := readOneWireTemperature(sensor.Device)
+		return "sensors.temperature", value, err
+	case "i2c":
+		value, err := readSysfsValue(sensor.Path)
+		return "sensors.temperature", value * sensor.Scale, err
+	default:
+		value, err := readGpio(sensor.Pin)
+		return "sensors.gpio", value, err
+	}
+}
+
+func sensorsStats(ep *errplane.Errplane) {
+	if len(AgentConfig().Sensors) == 0 {
+		return
+	}
+
+	for {
+		timestamp := time.Now()
+		for _, sensor := range AgentConfig().Sensors {
+			metric, value, err := readSensor(sensor)
+			if err != nil {
+				log.Error("Cannot read sensor %s. Error: %s", sensor.Name, err)
+				continue
+			}
+
+			dimensions := errplane.Dimensions{
+				"host":   AgentConfig().Hostname,
+				"sensor": sensor.Name,
+			}
+			for key, value := range sensor.Dimensions {
+				dimensions[key] = value
+			}
+			report(ep, metric, value, timestamp, dimensions, nil)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	. "utils"
+)
+
+type SensorsSuite struct {
+	dir string
+}
+
+var _ = Suite(&SensorsSuite{})
+
+func (self *SensorsSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+	W1_DEVICES_DIR = path.Join(self.dir, "w1")
+	GPIO_DIR = path.Join(self.dir, "gpio")
+}
+
+func (self *SensorsSuite) TearDownTest(c *C) {
+	W1_DEVICES_DIR = "/sys/bus/w1/devices"
+	GPIO_DIR = "/sys/class/gpio"
+}
+
+func (self *SensorsSuite) TestOneWire(c *C) {
+	device := path.Join(W1_DEVICES_DIR, "28-000005e2fdc3")
+	c.Assert(os.MkdirAll(device, 0755), IsNil)
+	content := "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	c.Assert(ioutil.WriteFile(path.Join(device, "w1_slave"), []byte(content), 0644), IsNil)
+
+	metric, value, err := readSensor(&Sensor{Name: "greenhouse", Type: "1-wire", Device: "28-000005e2fdc3"})
+	c.Assert(err, IsNil)
+	c.Assert(metric, Equals, "sensors.temperature")
+	c.Assert(value, Equals, 23.125)
+
+	content = "72 01 4b 46 7f ff 0e 10 57 : crc=57 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	c.Assert(ioutil.WriteFile(path.Join(device, "w1_slave"), []byte(content), 0644), IsNil)
+	_, _, err = readSensor(&Sensor{Name: "greenhouse", Type: "1-wire", Device: "28-000005e2fdc3"})
+	c.Assert(err, NotNil)
+}
+
+func (self *SensorsSuite) TestI2cAndGpio(c *C) {
+	input := path.Join(self.dir, "temp1_input")
+	c.Assert(ioutil.WriteFile(input, []byte("41500\n"), 0644), IsNil)
+	metric, value, err := readSensor(&Sensor{Name: "cabinet", Type: "i2c", Path: input, Scale: 0.001})
+	c.Assert(err, IsNil)
+	c.Assert(metric, Equals, "sensors.temperature")
+	c.Assert(value, Equals, 41.5)
+
+	gpio := path.Join(GPIO_DIR, "gpio17")
+	c.Assert(os.MkdirAll(gpio, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(gpio, "value"), []byte("1\n"), 0644), IsNil)
+	metric, value, err = readSensor(&Sensor{Name: "door", Type: "gpio", Pin: 17})
+	c.Assert(err, IsNil)
+	c.Assert(metric, Equals, "sensors.gpio")
+	c.Assert(value, Equals, 1.0)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the previous names that were logged, every one is logged once
+var deprecatedSeriesLogged = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// returns the previous name of the metric during the series-compat
+// transition window, empty if the metric wasn't renamed or the window is
+// over. An exact name wins over the longest matching prefix.
+func previousSeriesName(metric string, now time.Time) string {
+	compat := &AgentConfig().SeriesCompat
+	if len(compat.Names) == 0 || !now.Before(compat.Until) {
+		return ""
+	}
+	previous, ok := compat.Names[metric]
+	if !ok {
+		longest := ""
+		for name, candidate := range compat.Names {
+			prefix := strings.TrimSuffix(name, "*")
+			if prefix == name || !strings.HasPrefix(metric, prefix) || len(prefix) <= len(longest) {
+				continue
+			}
+			longest = prefix
+			previous = strings.TrimSuffix(candidate, "*") + metric[len(prefix):]
+		}
+	}
+	if previous == "" {
+		return ""
+	}
+
+	deprecatedSeriesLogged.Lock()
+	defer deprecatedSeriesLogged.Unlock()
+	if !deprecatedSeriesLogged.names[previous] {
+		deprecatedSeriesLogged.names[previous] = true
+		log.Warn("Also sending %s under its deprecated name %s until %s, update the dashboards and alerts using it", metric, previous, compat.RawUntil)
+	}
+	return previous
+}
+
+// returns the names the metric is sent as, its name and the previous one
+// during the transition window
+func seriesNames(metric string, now time.Time) []string {
+	if previous := previousSeriesName(metric, now); previous != "" {
+		return []string{metric, previous}
+	}
+	return []string{metric}
+}
+
+// adds copies of the writes of the renamed metrics under their previous
+// names, the points are copied so the writes can be changed independently
+func addPreviousSeries(writes []*errplane.JsonPoints, now time.Time) []*errplane.JsonPoints {
+	if len(AgentConfig().SeriesCompat.Names) == 0 {
+		return writes
+	}
+	for _, write := range writes {
+		previous := previousSeriesName(write.Name, now)
+		if previous == "" {
+			continue
+		}
+		copied := &errplane.JsonPoints{Name: previous, Points: make([]*errplane.JsonPoint, 0, len(write.Points))}
+		for _, point := range write.Points {
+			pointCopy := *point
+			copied.Points = append(copied.Points, &pointCopy)
+		}
+		writes = append(writes, copied)
+	}
+	return writes
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	"time"
+	. "utils"
+)
+
+type SeriesCompatSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&SeriesCompatSuite{})
+
+func (self *SeriesCompatSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	config.SeriesCompat = SeriesCompatConfig{
+		RawUntil: "2027-01-01",
+		Until:    time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		Names: map[string]string{
+			"host.cpu.*":               "server.stats.cpu.*",
+			"host.cpu.iowait":          "server.stats.cpu.wait",
+			"host.mem.used_percentage": "server.stats.memory.used_percentage",
+		},
+	}
+	SetAgentConfig(&config)
+}
+
+func (self *SeriesCompatSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+}
+
+func (self *SeriesCompatSuite) TestPreviousNames(c *C) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(previousSeriesName("host.cpu.user", now), Equals, "server.stats.cpu.user")
+	c.Assert(previousSeriesName("host.cpu.iowait", now), Equals, "server.stats.cpu.wait")
+	c.Assert(previousSeriesName("host.mem.used_percentage", now), Equals, "server.stats.memory.used_percentage")
+	c.Assert(previousSeriesName("host.mem.used", now), Equals, "")
+	c.Assert(seriesNames("host.cpu.user", now), DeepEquals, []string{"host.cpu.user", "server.stats.cpu.user"})
+
+	// the transition window is over
+	after := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(seriesNames("host.cpu.user", after), DeepEquals, []string{"host.cpu.user"})
+}
+
+func (self *SeriesCompatSuite) TestWrites(c *C) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	writes := append(batchWrite("host.cpu.user", 10).Writes, batchWrite("host.mem.used", 20).Writes...)
+	writes = addPreviousSeries(writes, now)
+	c.Assert(writes, HasLen, 3)
+	c.Assert(writes[2].Name, Equals, "server.stats.cpu.user")
+	c.Assert(writes[2].Points[0].Value, Equals, 10.0)
+	// the points are copies
+	writes[2].Points[0].Time = 1
+	c.Assert(writes[0].Points[0].Time, Equals, int64(0))
+}
+
+func (self *SeriesCompatSuite) TestConfig(c *C) {
+	filename := path.Join(c.MkDir(), "config.yml")
+	parse := func(seriesCompat string) error {
+		content := "sleep: 10s\nflush-interval: 10s\ntop-n-sleep: 1m\nmonitored-sleep: 10s\nseries-compat: " + seriesCompat + "\n"
+		c.Assert(ioutil.WriteFile(filename, []byte(content), 0644), IsNil)
+		_, err := ParseConfig(filename)
+		return err
+	}
+
+	c.Assert(parse("{until: 2027-01-01, names: {host.cpu.*: server.stats.cpu.*}}"), IsNil)
+	c.Assert(parse("{names: {host.cpu.*: server.stats.cpu.*}}"), ErrorMatches, "series-compat.until is required.*")
+	c.Assert(parse("{until: 2027-01-01, names: {host.cpu.*: server.stats.cpu.user}}"), ErrorMatches, "Invalid series-compat name .*")
+	c.Assert(parse("{until: 2027-01-01, names: {a: b, b: c}}"), ErrorMatches, "The previous name .* can't be renamed itself")
+}
@@ -0,0 +1,56 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"golang.org/x/sys/windows/svc"
+	"os"
+	"time"
+)
+
+const SERVICE_NAME = "errplane-agent"
+
+// Reports the agent as running to the service control manager and stops
+// it when the service is stopped or windows shuts down
+type AgentService struct{}
+
+func (self *AgentService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runs the agent as a windows service when it's started by the service
+// control manager, does nothing when it's started from a console
+func startService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Error("Cannot tell whether the agent runs as a service. Error: %s", err)
+		return
+	}
+	if !isService {
+		return
+	}
+	go func() {
+		status := 0
+		if err := svc.Run(SERVICE_NAME, &AgentService{}); err != nil {
+			log.Error("Cannot run the agent service. Error: %s", err)
+			status = 1
+		} else {
+			log.Info("Agent service stopped")
+		}
+		log.Close()
+		time.Sleep(1 * time.Second) // give the logger a chance to close and write to the file
+		os.Exit(status)
+	}()
+}
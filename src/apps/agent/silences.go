@@ -0,0 +1,173 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A silence stops the notifiers from sending alerts matching the matcher
+// until it expires. The matcher is a comma separated list of key=pattern
+// that must all match the alert dimensions, a matcher without a '=' is
+// matched against the alert title. Patterns use shell globs, e.g.
+// PluginName=mysql* or 'disk space*'
+type Silence struct {
+	Id      string    `json:"id"`
+	Matcher string    `json:"matcher"`
+	Comment string    `json:"comment,omitempty"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (self *Silence) Matches(notification *Notification) bool {
+	for _, part := range strings.Split(self.Matcher, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		value, pattern := notification.Title, part
+		if idx := strings.Index(part, "="); idx >= 0 {
+			value, pattern = notification.Dimensions[strings.TrimSpace(part[:idx])], strings.TrimSpace(part[idx+1:])
+		}
+		if matched, err := path.Match(pattern, value); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+type Silences struct {
+	lock     sync.Mutex
+	silences map[string]*Silence
+}
+
+var silences = NewSilences()
+
+func NewSilences() *Silences {
+	return &Silences{silences: make(map[string]*Silence)}
+}
+
+func newSilenceId() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (self *Silences) Add(matcher, comment, author string, duration time.Duration) (*Silence, error) {
+	if strings.TrimSpace(matcher) == "" {
+		return nil, fmt.Errorf("The matcher cannot be empty")
+	}
+	if _, err := path.Match(matcher, ""); err != nil {
+		return nil, fmt.Errorf("Invalid matcher '%s'. Error: %s", matcher, err)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("The silence duration must be positive")
+	}
+
+	now := time.Now()
+	silence := &Silence{newSilenceId(), matcher, comment, author, now, now.Add(duration)}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.silences[silence.Id] = silence
+	return silence, nil
+}
+
+func (self *Silences) Remove(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.silences[id]
+	delete(self.silences, id)
+	return ok
+}
+
+// returns the active silences sorted by expiration and forgets about the
+// expired ones
+func (self *Silences) List() []*Silence {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	list := make([]*Silence, 0, len(self.silences))
+	for id, silence := range self.silences {
+		if !silence.Expires.After(now) {
+			delete(self.silences, id)
+			continue
+		}
+		list = append(list, silence)
+	}
+	sort.Sort(SilencesSortableByExpiration(list))
+	return list
+}
+
+// returns the active silence that matches the notification if any
+func (self *Silences) Find(notification *Notification) *Silence {
+	for _, silence := range self.List() {
+		if silence.Matches(notification) {
+			return silence
+		}
+	}
+	return nil
+}
+
+type SilencesSortableByExpiration []*Silence
+
+func (self SilencesSortableByExpiration) Len() int { return len(self) }
+func (self SilencesSortableByExpiration) Less(i, j int) bool {
+	return self[i].Expires.Before(self[j].Expires)
+}
+func (self SilencesSortableByExpiration) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+func listSilences(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(silences.List())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func addSilence(w http.ResponseWriter, req *http.Request) {
+	matcher := req.FormValue("matcher")
+	duration, err := time.ParseDuration(req.FormValue("for"))
+	if err != nil {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(req)
+	silence, err := silences.Add(matcher, req.FormValue("comment"), actor, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit(actor, "add_silence", "", "", fmt.Sprintf("id=%s matcher=%s duration=%s", silence.Id, matcher, duration))
+	log.Info("Silenced alerts matching '%s' until %s", matcher, silence.Expires)
+
+	data, _ := json.Marshal(silence)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func removeSilence(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+
+	audit(requestActor(req), "remove_silence", "", "", fmt.Sprintf("id=%s", id))
+
+	if !silences.Remove(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Info("Removed silence %s", id)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type SilencesSuite struct{}
+
+var _ = Suite(&SilencesSuite{})
+
+func (self *SilencesSuite) TestMatches(c *C) {
+	notification := &Notification{
+		Title:      "disk.used is GreaterThan 90 for more than 5m0s",
+		Dimensions: map[string]string{"StatName": "disk.used", "OnlyAfter": "5m0s"},
+	}
+
+	for matcher, expected := range map[string]bool{
+		"disk.used*":                        true,
+		"cpu*":                              false,
+		"StatName=disk.*":                   true,
+		"StatName=disk.used, OnlyAfter=5m*": true,
+		"StatName=disk.used,OnlyAfter=1m*":  false,
+		"PluginName=mysql":                  false,
+	} {
+		silence := &Silence{Matcher: matcher}
+		c.Assert(silence.Matches(notification), Equals, expected, Commentf("matcher: %s", matcher))
+	}
+}
+
+func (self *SilencesSuite) TestAddListRemove(c *C) {
+	s := NewSilences()
+	_, err := s.Add("", "", "test", time.Hour)
+	c.Assert(err, NotNil)
+	_, err = s.Add("foo", "", "test", 0)
+	c.Assert(err, NotNil)
+
+	silence, err := s.Add("foo*", "known issue", "test", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(s.Find(&Notification{Title: "foobar"}), Equals, silence)
+	c.Assert(s.Find(&Notification{Title: "bar"}), IsNil)
+	c.Assert(s.List(), HasLen, 1)
+
+	c.Assert(s.Remove(silence.Id), Equals, true)
+	c.Assert(s.Remove(silence.Id), Equals, false)
+	c.Assert(s.List(), HasLen, 0)
+
+	// expired silences are dropped
+	silence, err = s.Add("foo*", "", "test", time.Hour)
+	c.Assert(err, IsNil)
+	silence.Expires = time.Now().Add(-time.Second)
+	c.Assert(s.Find(&Notification{Title: "foobar"}), IsNil)
+	c.Assert(s.List(), HasLen, 0)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"sort"
+	"time"
+	. "utils"
+)
+
+// the size of a point sent to errplane when the plan doesn't declare it,
+// roughly a json point with a host and an instance_id dimension
+const SIMULATED_POINT_SIZE = 150
+
+// The plugins to simulate, every instance runs for its declared duration
+// and sends the declared number of points
+type SimulationPlan struct {
+	MaxConcurrency int                `yaml:"max-concurrency"` // default is the plugin-concurrency of the agent config
+	Overlap        string             // skip or queue, default is the plugin-concurrency of the agent config
+	Plugins        []*SimulatedPlugin `yaml:"plugins"`
+}
+
+type SimulatedPlugin struct {
+	Name        string
+	Instances   int           // default is 1
+	RawInterval string        `yaml:"interval"` // default is the agent sleep
+	Interval    time.Duration `yaml:"-"`
+	RawDuration string        `yaml:"duration"`
+	Duration    time.Duration `yaml:"-"`
+	Points      int           // the points sent by every run, the status point excluded
+	PointSize   int           `yaml:"point-size"` // in bytes, default is SIMULATED_POINT_SIZE
+}
+
+func loadSimulationPlan(path string) (*SimulationPlan, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &SimulationPlan{}
+	if err := goyaml.Unmarshal(content, plan); err != nil {
+		return nil, err
+	}
+
+	if plan.MaxConcurrency <= 0 {
+		plan.MaxConcurrency = AgentConfig().PluginConcurrency.MaxConcurrency
+	}
+	switch plan.Overlap {
+	case "":
+		plan.Overlap = AgentConfig().PluginConcurrency.Overlap
+	case PLUGIN_OVERLAP_SKIP, PLUGIN_OVERLAP_QUEUE:
+	default:
+		return nil, fmt.Errorf("Unknown overlap '%s', must be skip or queue", plan.Overlap)
+	}
+	for _, plugin := range plan.Plugins {
+		if plugin.Name == "" {
+			return nil, fmt.Errorf("Simulated plugins must have a name")
+		}
+		if plugin.Instances <= 0 {
+			plugin.Instances = 1
+		}
+		plugin.Interval = AgentConfig().Sleep
+		if plugin.RawInterval != "" {
+			plugin.Interval, err = time.ParseDuration(plugin.RawInterval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if plugin.Interval <= 0 {
+			return nil, fmt.Errorf("The interval of plugin %s must be positive", plugin.Name)
+		}
+		plugin.Duration, err = time.ParseDuration(plugin.RawDuration)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration '%s' for plugin %s. Error: %s", plugin.RawDuration, plugin.Name, err)
+		}
+		if plugin.PointSize <= 0 {
+			plugin.PointSize = SIMULATED_POINT_SIZE
+		}
+	}
+	return plan, nil
+}
+
+type SimulatedPluginStats struct {
+	Name       string
+	Runs       int
+	Skipped    int           // runs that were due while the previous one was still in flight
+	AvgDelay   time.Duration // between the run being due and a slot being available
+	totalDelay time.Duration
+}
+
+type SimulationResult struct {
+	Duration       time.Duration
+	MaxConcurrency int
+	PeakRunning    int
+	AvgRunning     float64
+	PeakWaiting    int // runs waiting for a slot
+	Points         int // the status points included
+	PointsPerSec   float64
+	BytesPerSec    float64       // before batching and compression
+	Overrun        time.Duration // what the scheduler would report as agent.plugins.cycle_overrun
+	Plugins        []*SimulatedPluginStats
+}
+
+type simulatedRun struct {
+	key    string
+	plugin *SimulatedPlugin
+	due    time.Time
+	end    time.Time
+}
+
+// Runs the scheduler of monitorPlugins against a virtual clock for the
+// given duration, the plugins aren't run but take their declared duration.
+// Like the plugin pool, a run waits for a free slot and a run due while the
+// previous one of the instance is in flight is skipped or queued. The
+// result only depends on the plan and the duration.
+func simulateScheduler(plan *SimulationPlan, duration time.Duration) *SimulationResult {
+	result := &SimulationResult{Duration: duration, MaxConcurrency: plan.MaxConcurrency}
+	history := NewRunHistory()
+	scheduled := make([]*ScheduledPlugin, 0)
+	plugins := make(map[string]*SimulatedPlugin)
+	stats := make(map[string]*SimulatedPluginStats)
+	for _, plugin := range plan.Plugins {
+		stats[plugin.Name] = &SimulatedPluginStats{Name: plugin.Name}
+		result.Plugins = append(result.Plugins, stats[plugin.Name])
+		for i := 0; i < plugin.Instances; i++ {
+			key := fmt.Sprintf("%s/%d", plugin.Name, i)
+			plugins[key] = plugin
+			history.Record(key, plugin.Duration)
+			scheduled = append(scheduled, &ScheduledPlugin{key: key, interval: plugin.Interval})
+		}
+	}
+	result.Overrun = history.Overrun(scheduled, AgentConfig().Sleep, plan.MaxConcurrency)
+
+	start := time.Unix(0, 0).UTC()
+	lastRuns := make(map[string]time.Time)
+	running := make([]*simulatedRun, 0)
+	waiting := make([]*simulatedRun, 0)
+	inFlight := make(map[string]bool)
+	queued := make(map[string]*simulatedRun)
+	var bytes, runningSum float64
+	ticks := 0
+
+	for now := start; now.Sub(start) < duration; now = now.Add(PLUGIN_SCHEDULER_RESOLUTION) {
+		// finish the runs that are over, their queued run waits for a slot
+		stillRunning := running[:0]
+		for _, run := range running {
+			if run.end.After(now) {
+				stillRunning = append(stillRunning, run)
+				continue
+			}
+			points := run.plugin.Points + 1
+			result.Points += points
+			bytes += float64(points * run.plugin.PointSize)
+			if next := queued[run.key]; next != nil {
+				delete(queued, run.key)
+				waiting = append(waiting, next)
+			} else {
+				delete(inFlight, run.key)
+			}
+		}
+		running = stillRunning
+
+		// every instance is due at the first tick, like at boot
+		due := make([]*ScheduledPlugin, 0)
+		for _, s := range scheduled {
+			if _, ok := lastRuns[s.key]; ok && now.Sub(lastRuns[s.key]) < s.interval {
+				continue
+			}
+			lastRuns[s.key] = now
+			due = append(due, s)
+		}
+		history.Sort(due)
+		for _, s := range due {
+			plugin := plugins[s.key]
+			run := &simulatedRun{key: s.key, plugin: plugin, due: now}
+			if !inFlight[s.key] {
+				inFlight[s.key] = true
+				waiting = append(waiting, run)
+			} else if plan.Overlap == PLUGIN_OVERLAP_QUEUE {
+				queued[s.key] = run
+			} else {
+				stats[plugin.Name].Skipped++
+			}
+		}
+
+		for len(waiting) > 0 && len(running) < plan.MaxConcurrency {
+			run := waiting[0]
+			waiting = waiting[1:]
+			run.end = now.Add(run.plugin.Duration)
+			running = append(running, run)
+			stats[run.plugin.Name].Runs++
+			stats[run.plugin.Name].totalDelay += now.Sub(run.due)
+		}
+
+		if len(running) > result.PeakRunning {
+			result.PeakRunning = len(running)
+		}
+		if len(waiting) > result.PeakWaiting {
+			result.PeakWaiting = len(waiting)
+		}
+		runningSum += float64(len(running))
+		ticks++
+	}
+
+	if ticks > 0 {
+		result.AvgRunning = runningSum / float64(ticks)
+	}
+	if seconds := duration.Seconds(); seconds > 0 {
+		result.PointsPerSec = float64(result.Points) / seconds
+		result.BytesPerSec = bytes / seconds
+	}
+	for _, stat := range result.Plugins {
+		if stat.Runs > 0 {
+			stat.AvgDelay = stat.totalDelay / time.Duration(stat.Runs)
+		}
+	}
+	sort.Stable(SimulatedPluginStatsSortableByDelay(result.Plugins))
+	return result
+}
+
+type SimulatedPluginStatsSortableByDelay []*SimulatedPluginStats
+
+func (self SimulatedPluginStatsSortableByDelay) Len() int {
+	return len(self)
+}
+
+func (self SimulatedPluginStatsSortableByDelay) Less(i, j int) bool {
+	return self[i].AvgDelay > self[j].AvgDelay
+}
+
+func (self SimulatedPluginStatsSortableByDelay) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func renderSimulation(out io.Writer, result *SimulationResult) {
+	fmt.Fprintf(out, "Simulated %s with a max concurrency of %d\n", result.Duration, result.MaxConcurrency)
+	fmt.Fprintf(out, "Running plugins: %.1f on average, %d at peak\n", result.AvgRunning, result.PeakRunning)
+	fmt.Fprintf(out, "Waiting for a slot: %d at peak\n", result.PeakWaiting)
+	fmt.Fprintf(out, "Points: %d, %.1f/s\n", result.Points, result.PointsPerSec)
+	fmt.Fprintf(out, "Bandwidth: %.1f KB/s, %.1f MB/day per host (before batching and compression)\n",
+		result.BytesPerSec/1024, result.BytesPerSec*86400/1024/1024)
+	if result.Overrun > 0 {
+		fmt.Fprintf(out, "Cycle overrun: the plugins take %s more than the %s sleep to run\n", result.Overrun, AgentConfig().Sleep)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%-30s %8s %8s %10s\n", "PLUGIN", "RUNS", "SKIPPED", "AVG DELAY")
+	for _, stat := range result.Plugins {
+		fmt.Fprintf(out, "%-30s %8d %8d %10s\n", stat.Name, stat.Runs, stat.Skipped, stat.AvgDelay)
+	}
+}
+
+// agent simulate -config plan.yml [-duration 1h], runs the plugin scheduler
+// with the plugins declared in the plan to size the intervals and the
+// concurrency before deploying them. Exits with 1 if runs were skipped or
+// had to wait for a slot.
+func simulateCommand(out io.Writer, args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	planFile := flags.String("config", "", "The simulation plan, the plugins with their interval, duration and points")
+	duration := flags.Duration("duration", time.Hour, "The simulated time")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || *planFile == "" || *duration <= 0 {
+		fmt.Fprintf(out, "Usage: agent simulate -config plan.yml [-duration 1h]\n")
+		return 2
+	}
+
+	plan, err := loadSimulationPlan(*planFile)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot load the simulation plan %s. Error: %s\n", *planFile, err)
+		return 2
+	}
+
+	result := simulateScheduler(plan, *duration)
+	renderSimulation(out, result)
+	for _, stat := range result.Plugins {
+		if stat.Skipped > 0 || stat.AvgDelay > 0 {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type SimulateSuite struct{}
+
+var _ = Suite(&SimulateSuite{})
+
+func (self *SimulateSuite) TestSlotContention(c *C) {
+	plan := &SimulationPlan{MaxConcurrency: 1, Overlap: PLUGIN_OVERLAP_SKIP, Plugins: []*SimulatedPlugin{
+		&SimulatedPlugin{Name: "redis", Instances: 1, Interval: 10 * time.Second, Duration: 3 * time.Second, Points: 2, PointSize: 100},
+		&SimulatedPlugin{Name: "mysql", Instances: 1, Interval: 10 * time.Second, Duration: 4 * time.Second, Points: 2, PointSize: 100},
+	}}
+	defer setTestConfig(func(config *Config) { config.Sleep = 10 * time.Second })()
+	result := simulateScheduler(plan, time.Minute)
+	c.Assert(result.PeakRunning, Equals, 1)
+	c.Assert(result.PeakWaiting, Equals, 1)
+	c.Assert(result.Points, Equals, 36)
+	c.Assert(result.BytesPerSec, Equals, float64(60))
+	c.Assert(result.Overrun, Equals, time.Duration(0))
+	// the longest plugin runs first, redis waits for it every cycle
+	c.Assert(result.Plugins, HasLen, 2)
+	c.Assert(result.Plugins[0].Name, Equals, "redis")
+	c.Assert(result.Plugins[0].Runs, Equals, 6)
+	c.Assert(result.Plugins[0].AvgDelay, Equals, 4*time.Second)
+	c.Assert(result.Plugins[1].Name, Equals, "mysql")
+	c.Assert(result.Plugins[1].AvgDelay, Equals, time.Duration(0))
+}
+
+func (self *SimulateSuite) TestOverlap(c *C) {
+	slow := &SimulatedPlugin{Name: "slow", Instances: 1, Interval: 10 * time.Second, Duration: 15 * time.Second, PointSize: 100}
+
+	defer setTestConfig(func(config *Config) { config.Sleep = 10 * time.Second })()
+
+	result := simulateScheduler(&SimulationPlan{MaxConcurrency: 10, Overlap: PLUGIN_OVERLAP_SKIP, Plugins: []*SimulatedPlugin{slow}}, 30*time.Second)
+	c.Assert(result.Plugins[0].Runs, Equals, 2)
+	c.Assert(result.Plugins[0].Skipped, Equals, 1)
+	c.Assert(result.Overrun, Equals, 5*time.Second)
+
+	// the run due at 10s starts when the first one is over
+	result = simulateScheduler(&SimulationPlan{MaxConcurrency: 10, Overlap: PLUGIN_OVERLAP_QUEUE, Plugins: []*SimulatedPlugin{slow}}, 30*time.Second)
+	c.Assert(result.Plugins[0].Runs, Equals, 2)
+	c.Assert(result.Plugins[0].Skipped, Equals, 0)
+	c.Assert(result.Plugins[0].AvgDelay, Equals, 2500*time.Millisecond)
+}
+
+func (self *SimulateSuite) TestSimulateCommand(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.Sleep = 10 * time.Second
+		config.PluginConcurrency = PluginConcurrencyConfig{MaxConcurrency: 1, Overlap: PLUGIN_OVERLAP_SKIP}
+	})()
+	planFile := path.Join(c.MkDir(), "plan.yml")
+	c.Assert(ioutil.WriteFile(planFile, []byte(`
+plugins:
+  - name: mysql
+    instances: 2
+    duration: 8s
+    points: 10
+`), 0644), IsNil)
+
+	out := bytes.NewBuffer(nil)
+	c.Assert(simulateCommand(out, []string{"-config", planFile, "-duration", "1m"}), Equals, 1)
+	c.Assert(strings.Contains(out.String(), "Points: 77, 1.3/s\n"), Equals, true)
+	c.Assert(strings.Contains(out.String(), "Cycle overrun: the plugins take 6s more than the 10s sleep to run\n"), Equals, true)
+	c.Assert(out.String(), Matches, "(?s).*mysql +8 +4 +4.25s\n")
+
+	out.Reset()
+	c.Assert(simulateCommand(out, []string{"-duration", "1m"}), Equals, 2)
+	c.Assert(ioutil.WriteFile(planFile, []byte("plugins:\n  - name: mysql\n    duration: 8\n"), 0644), IsNil)
+	c.Assert(simulateCommand(out, []string{"-config", planFile}), Equals, 2)
+	c.Assert(out.String(), Matches, "(?s).*Invalid duration '8' for plugin mysql.*")
+}
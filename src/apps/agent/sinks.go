@@ -0,0 +1,175 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// the names of the places points are delivered to, used to configure
+// per sink settings like the point ttl
+const (
+	SINK_ERRPLANE = "errplane"
+)
+
+// sends the write operation to errplane, points that were buffered for
+// longer than the sink ttl are dropped and summarized instead
+func sendHttp(ep *errplane.Errplane, operation *errplane.WriteOperation) error {
+	recentMetrics.AddWrites(operation.Writes)
+	skew := int64(chaosFaults.Skew() / time.Second)
+	for _, write := range operation.Writes {
+		for _, point := range write.Points {
+			point.Dimensions = scrubDimensions(addGlobalDimensions(point.Dimensions))
+			point.Time += skew
+		}
+	}
+	operation.Writes = applyDimensionSchemas(filterWrites(operation.Writes))
+	operation.Writes = addPreviousSeries(operation.Writes, time.Now())
+	operation.Writes = expirePoints(ep, SINK_ERRPLANE, operation.Writes, time.Now())
+	if len(operation.Writes) == 0 {
+		return nil
+	}
+	if httpBatcher != nil {
+		httpBatcher.Add(operation)
+		return nil
+	}
+	return deliverHttp(sendBackend, operation)
+}
+
+// stamps and sends the points, or spools them if the backend is
+// unreachable. In scrape mode the points are kept until the backend pulls
+// them.
+func deliverHttp(send func(*errplane.WriteOperation) error, operation *errplane.WriteOperation) error {
+	stampWrites(operation.Writes, time.Now(), false)
+	if scrapeBuffer != nil {
+		scrapeBuffer.Add(operation.Writes)
+		return nil
+	}
+	err := chaosFaults.BackendError()
+	if err == nil {
+		err = send(operation)
+	}
+	err = NetworkError(err)
+	if err != nil {
+		agentStats.Add(STAT_SEND_FAILURES, 1)
+	} else {
+		agentStats.Add(STAT_POINTS_SENT, countPoints(operation.Writes))
+		agentStats.Add(STAT_WRITES_SENT, 1)
+	}
+	if err != nil && spool != nil {
+		log.Warn("Cannot send points to errplane, spooling them. Error: %s", err)
+		if spoolErr := spool.Enqueue(operation); spoolErr != nil {
+			log.Error("Cannot spool points. Error: %s", spoolErr)
+			return err
+		}
+		return nil
+	}
+	return err
+}
+
+func hasGlobalDimensions() bool {
+	return len(AgentConfig().Dimensions) > 0 || kubernetesNode != "" || AgentConfig().HostIp.Dimension || AgentConfig().HostIp.InterfaceDimensions || hostInMaintenance()
+}
+
+// whether a maintenance window covers the whole host
+func hostInMaintenance() bool {
+	return maintenances.Find("", "", time.Now()) != ""
+}
+
+// adds the dimensions configured in the agent config, the node in
+// kubernetes, the host ip and maintenance=true while the whole host is in
+// maintenance to the given ones, the dimensions of the point win over the
+// global ones
+func addGlobalDimensions(dimensions errplane.Dimensions) errplane.Dimensions {
+	if !hasGlobalDimensions() {
+		return dimensions
+	}
+	if dimensions == nil {
+		dimensions = errplane.Dimensions{}
+	}
+	for key, value := range AgentConfig().Dimensions {
+		if _, ok := dimensions[key]; !ok {
+			dimensions[key] = value
+		}
+	}
+	if _, ok := dimensions["node"]; !ok && kubernetesNode != "" {
+		dimensions["node"] = kubernetesNode
+	}
+	if _, ok := dimensions["maintenance"]; !ok && hostInMaintenance() {
+		dimensions["maintenance"] = "true"
+	}
+	if AgentConfig().HostIp.Dimension || AgentConfig().HostIp.InterfaceDimensions {
+		primary, interfaces := hostIps.Get()
+		if _, ok := dimensions["ip"]; !ok && primary != "" && AgentConfig().HostIp.Dimension {
+			dimensions["ip"] = primary
+		}
+		if AgentConfig().HostIp.InterfaceDimensions {
+			for name, ip := range interfaces {
+				if _, ok := dimensions["ip_"+name]; !ok {
+					dimensions["ip_"+name] = ip
+				}
+			}
+		}
+	}
+	return dimensions
+}
+
+// A reporter adding the global dimensions to the points it reports
+type GlobalDimensionsReporter struct {
+	reporter Reporter
+}
+
+func (self *GlobalDimensionsReporter) Report(metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) error {
+	dimensions = scrubDimensions(addGlobalDimensions(dimensions))
+	if scrapeBuffer != nil {
+		point := &errplane.JsonPoint{Value: value, Time: timestamp.Unix(), Context: context, Dimensions: dimensions}
+		scrapeBuffer.Add([]*errplane.JsonPoints{&errplane.JsonPoints{Name: metric, Points: []*errplane.JsonPoint{point}}})
+		return nil
+	}
+	return self.reporter.Report(metric, value, timestamp, context, dimensions)
+}
+
+// removes the points older than the sink ttl and reports the number of
+// dropped points per metric as agent.points.expired
+func expirePoints(ep *errplane.Errplane, sink string, writes []*errplane.JsonPoints, now time.Time) []*errplane.JsonPoints {
+	ttl, ok := AgentConfig().PointTtls[sink]
+	if !ok || ttl <= 0 {
+		return writes
+	}
+
+	threshold := now.Add(-ttl).Unix()
+	expired := make(map[string]int)
+	filteredWrites := make([]*errplane.JsonPoints, 0, len(writes))
+
+	for _, write := range writes {
+		points := make([]*errplane.JsonPoint, 0, len(write.Points))
+		for _, point := range write.Points {
+			// points without a timestamp are stamped by the backend on arrival
+			if point.Time != 0 && point.Time < threshold {
+				expired[write.Name]++
+				continue
+			}
+			points = append(points, point)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		write.Points = points
+		filteredWrites = append(filteredWrites, write)
+	}
+
+	for name, count := range expired {
+		log.Warn("Dropping %d points of %s older than %s instead of delivering them to %s", count, name, ttl, sink)
+		if ep == nil {
+			continue
+		}
+		report(ep, "agent.points.expired", float64(count), now, errplane.Dimensions{
+			"host":   AgentConfig().Hostname,
+			"sink":   sink,
+			"metric": name,
+		}, nil)
+	}
+
+	return filteredWrites
+}
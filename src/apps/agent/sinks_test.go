@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type SinksSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&SinksSuite{})
+
+func (self *SinksSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	config.PointTtls = nil
+	config.Dimensions = nil
+	config.Timestamps = TimestampsConfig{}
+	SetAgentConfig(&config)
+}
+
+func (self *SinksSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+}
+
+func (self *SinksSuite) TestExpirePoints(c *C) {
+	now := time.Now()
+	writes := func() []*errplane.JsonPoints {
+		return []*errplane.JsonPoints{
+			&errplane.JsonPoints{Name: "app.requests", Points: []*errplane.JsonPoint{
+				&errplane.JsonPoint{Value: 1, Time: now.Add(-time.Hour).Unix()},
+				&errplane.JsonPoint{Value: 2, Time: now.Unix()},
+				&errplane.JsonPoint{Value: 3},
+			}},
+			&errplane.JsonPoints{Name: "app.errors", Points: []*errplane.JsonPoint{
+				&errplane.JsonPoint{Value: 1, Time: now.Add(-time.Hour).Unix()},
+			}},
+		}
+	}
+
+	// no ttl configured
+	c.Assert(expirePoints(nil, SINK_ERRPLANE, writes(), now), HasLen, 2)
+
+	setTestConfig(func(config *Config) { config.PointTtls = map[string]time.Duration{SINK_ERRPLANE: 10 * time.Minute} })
+	filtered := expirePoints(nil, SINK_ERRPLANE, writes(), now)
+	c.Assert(filtered, HasLen, 1)
+	c.Assert(filtered[0].Name, Equals, "app.requests")
+	c.Assert(filtered[0].Points, HasLen, 2)
+	c.Assert(filtered[0].Points[0].Value, Equals, 2.0)
+}
+
+func (self *SinksSuite) TestGlobalDimensions(c *C) {
+	c.Assert(addGlobalDimensions(nil), IsNil)
+
+	setTestConfig(func(config *Config) { config.Dimensions = map[string]string{"datacenter": "us-east-1", "role": "db"} })
+	c.Assert(addGlobalDimensions(nil), DeepEquals, errplane.Dimensions{"datacenter": "us-east-1", "role": "db"})
+	dimensions := addGlobalDimensions(errplane.Dimensions{"host": "db1", "role": "replica"})
+	c.Assert(dimensions, DeepEquals, errplane.Dimensions{"host": "db1", "datacenter": "us-east-1", "role": "replica"})
+
+	reporter := &ReporterMock{}
+	(&GlobalDimensionsReporter{reporter}).Report("errplane.anomalies", 1, time.Now(), "", errplane.Dimensions{"host": "db1"})
+	c.Assert(reporter.events, HasLen, 1)
+	c.Assert(reporter.events[0].dimensions["datacenter"], Equals, "us-east-1")
+}
+
+func (self *SinksSuite) TestDeliveryErrorsAreNetworkErrors(c *C) {
+	before := ErrorCounts()
+	failing := func(operation *errplane.WriteOperation) error {
+		return fmt.Errorf("connection refused")
+	}
+
+	err := deliverHttp(failing, &errplane.WriteOperation{})
+	c.Assert(err, ErrorMatches, "connection refused")
+	c.Assert(ErrorCategory(err), Equals, ERROR_NETWORK)
+	// tagging the error again doesn't count it twice
+	c.Assert(NetworkError(err), Equals, err)
+	after := ErrorCounts()
+	c.Assert(after[ERROR_NETWORK]-before[ERROR_NETWORK], Equals, int64(1))
+	c.Assert(after[ERROR_PARSE], Equals, before[ERROR_PARSE])
+
+	c.Assert(deliverHttp(func(*errplane.WriteOperation) error { return nil }, &errplane.WriteOperation{}), IsNil)
+}
+
+func (self *SinksSuite) TestStampWrites(c *C) {
+	now := time.Now()
+	shared := errplane.Dimensions{"host": "web1"}
+	writes := func() []*errplane.JsonPoints {
+		return []*errplane.JsonPoints{
+			&errplane.JsonPoints{Name: "app.requests", Points: []*errplane.JsonPoint{
+				&errplane.JsonPoint{Value: 1, Time: now.Add(-time.Hour).Unix(), Dimensions: shared},
+				&errplane.JsonPoint{Value: 2, Time: now.Unix(), Dimensions: shared},
+				&errplane.JsonPoint{Value: 3},
+			}},
+		}
+	}
+
+	setTestConfig(func(config *Config) {
+		config.Timestamps = TimestampsConfig{Mode: TIMESTAMPS_ORIGIN, LateAfter: time.Minute}
+	})
+	stamped := writes()
+	stampWrites(stamped, now, false)
+	points := stamped[0].Points
+	c.Assert(points[0].Time, Equals, now.Add(-time.Hour).Unix())
+	c.Assert(points[0].Dimensions, DeepEquals, errplane.Dimensions{"host": "web1", "delivery": DELIVERY_LATE})
+	c.Assert(points[1].Dimensions, DeepEquals, errplane.Dimensions{"host": "web1"})
+	c.Assert(points[2].Time, Equals, int64(0))
+	c.Assert(points[2].Dimensions, IsNil)
+
+	setTestConfig(func(config *Config) { config.Timestamps.Mode = TIMESTAMPS_SEND })
+	stamped = writes()
+	stampWrites(stamped, now, true)
+	for _, point := range stamped[0].Points {
+		c.Assert(point.Time, Equals, now.Unix())
+		c.Assert(point.Dimensions["delivery"], Equals, DELIVERY_SPOOLED)
+	}
+	c.Assert(shared, DeepEquals, errplane.Dimensions{"host": "web1"})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	SPOOL_MAX_BACKOFF = 5 * time.Minute
+)
+
+// A directory of write operations that couldn't be delivered, one json
+// file per operation named after the time it was spooled. The oldest files
+// are removed when the spool grows beyond its maximum size.
+type Spool struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+}
+
+var spool *Spool
+
+func NewSpool(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+type spooledFile struct {
+	name      string
+	size      int64
+	timestamp time.Time
+}
+
+// returns the spooled files, oldest first
+func (self *Spool) files() ([]*spooledFile, error) {
+	infos, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*spooledFile, 0, len(infos))
+	for _, info := range infos {
+		nanoseconds, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		files = append(files, &spooledFile{info.Name(), info.Size(), time.Unix(0, nanoseconds)})
+	}
+	sort.Sort(SpooledFilesSortableByTime(files))
+	return files, nil
+}
+
+// returns the number of write operations waiting to be replayed, 0 if
+// spooling is disabled
+func (self *Spool) Depth() int {
+	if self == nil {
+		return 0
+	}
+	files, err := self.files()
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
+
+type SpooledFilesSortableByTime []*spooledFile
+
+func (self SpooledFilesSortableByTime) Len() int { return len(self) }
+func (self SpooledFilesSortableByTime) Less(i, j int) bool {
+	return self[i].timestamp.Before(self[j].timestamp)
+}
+func (self SpooledFilesSortableByTime) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+func (self *Spool) Enqueue(operation *errplane.WriteOperation) error {
+	data, err := json.Marshal(operation)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	name := fmt.Sprintf("%d.json", time.Now().UnixNano())
+	tmp := path.Join(self.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(self.dir, name)); err != nil {
+		return err
+	}
+
+	// drop the oldest operations if the spool is too big
+	files, err := self.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+	for _, file := range files {
+		if size <= self.maxSize {
+			break
+		}
+		log.Warn("Spool is full, dropping the points spooled at %s", file.timestamp)
+		os.Remove(path.Join(self.dir, file.name))
+		size -= file.size
+	}
+	return nil
+}
+
+// tries to send the spooled operations in order, returns false as soon as
+// one of them cannot be sent
+func (self *Spool) replayOnce(send func(*errplane.WriteOperation) error) bool {
+	files, err := self.files()
+	if err != nil {
+		log.Error("Cannot list the spooled points. Error: %s", err)
+		return false
+	}
+
+	for _, file := range files {
+		filename := path.Join(self.dir, file.name)
+		if time.Now().Sub(file.timestamp) > self.maxAge {
+			log.Warn("Dropping the points spooled at %s, they're older than %s", file.timestamp, self.maxAge)
+			os.Remove(filename)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			// probably dropped because the spool was full
+			continue
+		}
+		operation := &errplane.WriteOperation{}
+		if err := json.Unmarshal(data, operation); err != nil {
+			log.Error("Dropping corrupted spool file %s. Error: %s", filename, ParseError(err))
+			os.Remove(filename)
+			continue
+		}
+
+		if err := send(operation); err != nil {
+			log.Debug("Cannot replay the spooled points. Error: %s", err)
+			return false
+		}
+		os.Remove(filename)
+	}
+	return true
+}
+
+// replays the spooled operations, backing off while the backend is unreachable
+func (self *Spool) Replay(send func(*errplane.WriteOperation) error) {
+	backoff := time.Second
+	for {
+		if self.replayOnce(send) {
+			backoff = time.Second
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > SPOOL_MAX_BACKOFF {
+			backoff = SPOOL_MAX_BACKOFF
+		}
+	}
+}
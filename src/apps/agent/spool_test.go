@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type SpoolSuite struct{}
+
+var _ = Suite(&SpoolSuite{})
+
+func spooledOperation(name string) *errplane.WriteOperation {
+	return &errplane.WriteOperation{Writes: []*errplane.JsonPoints{
+		&errplane.JsonPoints{Name: name, Points: []*errplane.JsonPoint{&errplane.JsonPoint{Value: 1}}},
+	}}
+}
+
+func (self *SpoolSuite) TestReplayInOrder(c *C) {
+	s, err := NewSpool(c.MkDir(), 1024*1024, time.Hour)
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(s.Enqueue(spooledOperation(name)), IsNil)
+	}
+
+	// the backend fails after the first operation
+	sent := make([]string, 0)
+	failing := func(operation *errplane.WriteOperation) error {
+		if len(sent) == 1 {
+			return fmt.Errorf("connection refused")
+		}
+		sent = append(sent, operation.Writes[0].Name)
+		return nil
+	}
+	c.Assert(s.replayOnce(failing), Equals, false)
+	c.Assert(sent, DeepEquals, []string{"a"})
+
+	working := func(operation *errplane.WriteOperation) error {
+		sent = append(sent, operation.Writes[0].Name)
+		return nil
+	}
+	c.Assert(s.replayOnce(working), Equals, true)
+	c.Assert(sent, DeepEquals, []string{"a", "b", "c"})
+
+	files, err := s.files()
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+}
+
+func (self *SpoolSuite) TestMaxSizeAndAge(c *C) {
+	s, err := NewSpool(c.MkDir(), 200, time.Hour)
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c.Assert(s.Enqueue(spooledOperation(name)), IsNil)
+	}
+	files, err := s.files()
+	c.Assert(err, IsNil)
+	c.Assert(len(files) < 4, Equals, true)
+
+	// the newest operations are kept
+	sent := make([]string, 0)
+	s.maxAge = time.Hour
+	c.Assert(s.replayOnce(func(operation *errplane.WriteOperation) error {
+		sent = append(sent, operation.Writes[0].Name)
+		return nil
+	}), Equals, true)
+	c.Assert(sent[len(sent)-1], Equals, "d")
+
+	c.Assert(s.Enqueue(spooledOperation("e")), IsNil)
+	s.maxAge = 0
+	sent = make([]string, 0)
+	c.Assert(s.replayOnce(func(operation *errplane.WriteOperation) error {
+		sent = append(sent, operation.Writes[0].Name)
+		return nil
+	}), Equals, true)
+	c.Assert(sent, HasLen, 0)
+}
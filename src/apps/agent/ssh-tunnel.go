@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+	. "utils"
+)
+
+const (
+	SSH_TUNNEL_MAX_BACKOFF = time.Minute
+)
+
+// returns the arguments of the ssh command opening a socks5 proxy on
+// localhost through the jump host, the jump host must be known unless
+// known-hosts is empty
+func sshTunnelCommand(tunnel *SshTunnelConfig) []string {
+	remote := &RemoteTarget{Host: tunnel.Host, User: tunnel.User, Port: tunnel.Port, Key: tunnel.Key}
+	args := append(sshOptions(remote, "-p"), "-N",
+		"-D", fmt.Sprintf("127.0.0.1:%d", tunnel.LocalPort),
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3")
+	if tunnel.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+tunnel.KnownHosts, "-o", "StrictHostKeyChecking=yes")
+	}
+	return append(args, sshDestination(remote))
+}
+
+// keeps the ssh tunnel open, restarting ssh with a backoff when it exits.
+// The requests fail while the tunnel is down and the points are spooled.
+func superviseSshTunnel() {
+	backoff := time.Second
+	for {
+		tunnel := AgentConfig().SshTunnel
+		stderr := bytes.NewBuffer(nil)
+		cmd := exec.Command("ssh", sshTunnelCommand(&tunnel)...)
+		cmd.Stderr = stderr
+
+		log.Info("Opening the ssh tunnel to %s, the socks5 proxy listens on 127.0.0.1:%d", tunnel.Host, tunnel.LocalPort)
+		start := time.Now()
+		err := cmd.Run()
+		if err == nil {
+			err = fmt.Errorf("ssh exited")
+		}
+		output := strings.TrimSpace(stderr.String())
+		if len(output) > MAX_DETAIL_SIZE {
+			output = output[len(output)-MAX_DETAIL_SIZE:]
+		}
+		log.Error("The ssh tunnel to %s is down. Error: %s", tunnel.Host, NetworkError(fmt.Errorf("%s. Output: %s", err, output)))
+
+		// a tunnel that stayed up for a while is reopened right away
+		if time.Now().Sub(start) > SSH_TUNNEL_MAX_BACKOFF {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > SSH_TUNNEL_MAX_BACKOFF {
+			backoff = SSH_TUNNEL_MAX_BACKOFF
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	STATSD_MAX_PACKET_SIZE = 64 * 1024
+	STATSD_MAX_METRICS     = 10000 // distinct metrics per flush interval, the new ones are dropped beyond that
+)
+
+// A statsd sample, e.g. api.requests:1|c|@0.1|#route:/users
+type StatsdSample struct {
+	Name       string
+	Kind       string // c (counter), g (gauge), ms or h (timer), s (set)
+	Value      float64
+	Member     string // the value of a set
+	Delta      bool   // a gauge value starting with + or -
+	SampleRate float64
+	Dimensions errplane.Dimensions // from the dogstatsd #tags
+}
+
+func parseStatsdLine(line string) (*StatsdSample, error) {
+	colon := strings.LastIndex(strings.SplitN(line, "|", 2)[0], ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("Expected 'name:value|type', got '%s'", line)
+	}
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Expected 'name:value|type', got '%s'", line)
+	}
+
+	sample := &StatsdSample{Name: line[:colon], Kind: fields[1], SampleRate: 1, Dimensions: errplane.Dimensions{}}
+	switch sample.Kind {
+	case "s":
+		sample.Member = fields[0]
+	case "c", "g", "ms", "h":
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("Invalid value '%s'", fields[0])
+		}
+		sample.Value = value
+		sample.Delta = sample.Kind == "g" && (strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-"))
+	default:
+		return nil, fmt.Errorf("Unknown metric type '%s'", sample.Kind)
+	}
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("Invalid sample rate '%s'", field)
+			}
+			sample.SampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			for _, tag := range strings.Split(field[1:], ",") {
+				parts := strings.SplitN(tag, ":", 2)
+				if parts[0] == "" {
+					continue
+				}
+				if len(parts) == 1 {
+					sample.Dimensions[parts[0]] = "true"
+					continue
+				}
+				sample.Dimensions[parts[0]] = parts[1]
+			}
+		default:
+			return nil, fmt.Errorf("Invalid field '%s'", field)
+		}
+	}
+	return sample, nil
+}
+
+type statsdMetric struct {
+	kind       string
+	name       string
+	dimensions errplane.Dimensions
+	updated    bool
+	count      float64 // the counter, or the number of timer samples corrected by the sample rate
+	gauge      float64
+	timings    []float64
+	members    map[string]bool
+}
+
+// Aggregates the statsd samples received over a flush interval, the
+// counters, timers and sets start over on every flush while the gauges keep
+// their value (and are only reported when they're updated)
+type StatsdAggregator struct {
+	lock    sync.Mutex
+	metrics map[string]*statsdMetric
+	started time.Time
+}
+
+func NewStatsdAggregator(now time.Time) *StatsdAggregator {
+	return &StatsdAggregator{metrics: make(map[string]*statsdMetric), started: now}
+}
+
+func statsdKey(sample *StatsdSample) string {
+	tags := make([]string, 0, len(sample.Dimensions))
+	for name, value := range sample.Dimensions {
+		tags = append(tags, name+"="+value)
+	}
+	sort.Strings(tags)
+	return sample.Kind + "\x00" + sample.Name + "\x00" + strings.Join(tags, ",")
+}
+
+func (self *StatsdAggregator) Add(sample *StatsdSample) {
+	kind := sample.Kind
+	if kind == "h" {
+		kind = "ms"
+	}
+	sample.Kind = kind
+	key := statsdKey(sample)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	metric, ok := self.metrics[key]
+	if !ok {
+		if len(self.metrics) >= STATSD_MAX_METRICS {
+			log.Debug("Dropping statsd metric %s, more than %d metrics this interval", sample.Name, STATSD_MAX_METRICS)
+			return
+		}
+		metric = &statsdMetric{kind: kind, name: sample.Name, dimensions: sample.Dimensions, members: make(map[string]bool)}
+		self.metrics[key] = metric
+	}
+	metric.updated = true
+	switch kind {
+	case "c":
+		metric.count += sample.Value / sample.SampleRate
+	case "g":
+		if sample.Delta {
+			metric.gauge += sample.Value
+		} else {
+			metric.gauge = sample.Value
+		}
+	case "ms":
+		metric.count += 1 / sample.SampleRate
+		metric.timings = append(metric.timings, sample.Value)
+	case "s":
+		metric.members[sample.Member] = true
+	}
+}
+
+// returns the name of the percentile metric, e.g. p90 or p99_9
+func percentileName(percentile float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+// returns the aggregates of the interval ending now and starts a new one
+func (self *StatsdAggregator) Flush(now time.Time) []*errplane.JsonPoints {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	seconds := now.Sub(self.started).Seconds()
+	self.started = now
+	writes := make(map[string]*errplane.JsonPoints)
+	add := func(metric *statsdMetric, suffix string, value float64) {
+		name := AgentConfig().Statsd.Prefix + metric.name + suffix
+		write, ok := writes[name]
+		if !ok {
+			write = &errplane.JsonPoints{Name: name, Points: make([]*errplane.JsonPoint, 0, 1)}
+			writes[name] = write
+		}
+		dimensions := errplane.Dimensions{}
+		for key, value := range metric.dimensions {
+			dimensions[key] = value
+		}
+		// the host tag of a relayed metric wins over the host of the agent
+		if _, ok := dimensions["host"]; !ok {
+			dimensions["host"] = AgentConfig().Hostname
+		}
+		write.Points = append(write.Points, &errplane.JsonPoint{Value: value, Time: now.Unix(), Dimensions: dimensions})
+	}
+
+	for key, metric := range self.metrics {
+		if !metric.updated {
+			continue
+		}
+		switch metric.kind {
+		case "c":
+			add(metric, ".count", metric.count)
+			if seconds > 0 {
+				add(metric, ".rate", metric.count/seconds)
+			}
+		case "g":
+			add(metric, "", metric.gauge)
+		case "ms":
+			sort.Float64s(metric.timings)
+			sum := 0.0
+			for _, timing := range metric.timings {
+				sum += timing
+			}
+			add(metric, ".count", metric.count)
+			add(metric, ".mean", sum/float64(len(metric.timings)))
+			add(metric, ".min", metric.timings[0])
+			add(metric, ".max", metric.timings[len(metric.timings)-1])
+			for _, percentile := range AgentConfig().Percentiles {
+				// nearest rank
+				rank := int(math.Ceil(percentile / 100 * float64(len(metric.timings))))
+				if rank < 1 {
+					rank = 1
+				}
+				if rank > len(metric.timings) {
+					rank = len(metric.timings)
+				}
+				add(metric, "."+percentileName(percentile), metric.timings[rank-1])
+			}
+		case "s":
+			add(metric, ".count", float64(len(metric.members)))
+		}
+
+		if metric.kind == "g" {
+			metric.updated = false
+		} else {
+			delete(self.metrics, key)
+		}
+	}
+
+	points := make([]*errplane.JsonPoints, 0, len(writes))
+	for _, write := range writes {
+		points = append(points, write)
+	}
+	return points
+}
+
+// a packet can have several samples, one per line
+func (self *StatsdAggregator) Consume(packet string, source string) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sample, err := parseStatsdLine(line)
+		if err != nil {
+			log.Debug("Ignoring statsd line from %s. Error: %s", source, ParseError(err))
+			continue
+		}
+		self.Add(sample)
+	}
+}
+
+// accepts the statsd protocol over udp and reports the aggregates of every
+// flush interval as agent metrics. The socket is closed while the statsd
+// subsystem is stopped and opened again once it's started
+func startStatsdListener(ep *errplane.Errplane) {
+	address := AgentConfig().Statsd.Listen
+	if address == "" {
+		return
+	}
+
+	var conn net.PacketConn
+	var aggregator *StatsdAggregator
+	for {
+		if conn == nil && !subsystems.IsStopped(SUBSYSTEM_STATSD) {
+			var err error
+			conn, err = net.ListenPacket("udp", address)
+			if err != nil {
+				log.Error("Cannot listen for statsd on udp %s. Error: %s", address, err)
+				return
+			}
+			log.Info("Aggregating statsd metrics received on %s", address)
+
+			aggregator = NewStatsdAggregator(time.Now())
+			go serveStatsd(conn, aggregator)
+		}
+
+		time.Sleep(AgentConfig().FlushInterval)
+		if conn == nil {
+			continue
+		}
+		if subsystems.IsStopped(SUBSYSTEM_STATSD) {
+			log.Info("Statsd subsystem stopped, closing %s", address)
+			conn.Close()
+			conn = nil
+		}
+		writes := aggregator.Flush(time.Now())
+		if len(writes) == 0 {
+			continue
+		}
+		if err := sendHttp(ep, &errplane.WriteOperation{Writes: writes}); err != nil {
+			log.Error("Cannot send statsd metrics. Error: %s", err)
+		}
+	}
+}
+
+func serveStatsd(conn net.PacketConn, aggregator *StatsdAggregator) {
+	buffer := make([]byte, STATSD_MAX_PACKET_SIZE)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if subsystems.IsStopped(SUBSYSTEM_STATSD) {
+				return
+			}
+			log.Error("Cannot read statsd packets on %s. Error: %s", conn.LocalAddr(), err)
+			return
+		}
+		aggregator.Consume(string(buffer[:n]), addr.String())
+	}
+}
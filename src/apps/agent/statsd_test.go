@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type StatsdSuite struct{}
+
+var _ = Suite(&StatsdSuite{})
+
+func (self *StatsdSuite) TestParseStatsdLine(c *C) {
+	sample, err := parseStatsdLine("api.requests:2|c|@0.5|#route:/users,canary")
+	c.Assert(err, IsNil)
+	c.Assert(sample.Name, Equals, "api.requests")
+	c.Assert(sample.Kind, Equals, "c")
+	c.Assert(sample.Value, Equals, 2.0)
+	c.Assert(sample.SampleRate, Equals, 0.5)
+	c.Assert(sample.Dimensions, DeepEquals, errplane.Dimensions{"route": "/users", "canary": "true"})
+
+	sample, err = parseStatsdLine("queue.depth:-3|g")
+	c.Assert(err, IsNil)
+	c.Assert(sample.Delta, Equals, true)
+	c.Assert(sample.Value, Equals, -3.0)
+
+	sample, err = parseStatsdLine("users:alice|s")
+	c.Assert(err, IsNil)
+	c.Assert(sample.Member, Equals, "alice")
+
+	for _, line := range []string{"api.requests", "api.requests:1", ":1|c", "api.requests:x|c", "api.requests:1|q", "api.requests:1|c|@2", "api.requests:1|c|bad"} {
+		_, err := parseStatsdLine(line)
+		c.Assert(err, NotNil, Commentf("line %s", line))
+	}
+}
+
+func (self *StatsdSuite) TestAggregation(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.Statsd.Prefix = "statsd."
+		config.Percentiles = []float64{50, 99.9}
+	})()
+	start := time.Unix(1400000000, 0)
+	aggregator := NewStatsdAggregator(start)
+	aggregator.Consume("api.requests:1|c\napi.requests:1|c|@0.5\nqueue.depth:10|g\nqueue.depth:+5|g", "test")
+	aggregator.Consume("api.latency:30|ms\napi.latency:10|ms\napi.latency:20|h\nusers:alice|s\nusers:bob|s\nusers:alice|s", "test")
+	aggregator.Consume("api.requests:1|c|#host:web2\nnot a statsd line", "test")
+
+	values := func(writes []*errplane.JsonPoints) map[string]float64 {
+		result := make(map[string]float64)
+		for _, write := range writes {
+			for _, point := range write.Points {
+				if point.Dimensions["host"] == AgentConfig().Hostname {
+					result[write.Name] = point.Value
+				}
+			}
+		}
+		return result
+	}
+
+	writes := aggregator.Flush(start.Add(10 * time.Second))
+	c.Assert(values(writes), DeepEquals, map[string]float64{
+		"statsd.api.requests.count": 3,
+		"statsd.api.requests.rate":  0.3,
+		"statsd.queue.depth":        15,
+		"statsd.api.latency.count":  3,
+		"statsd.api.latency.mean":   20,
+		"statsd.api.latency.min":    10,
+		"statsd.api.latency.max":    30,
+		"statsd.api.latency.p50":    20,
+		"statsd.api.latency.p99_9":  30,
+		"statsd.users.count":        2,
+	})
+	for _, write := range writes {
+		if write.Name == "statsd.api.requests.count" {
+			c.Assert(write.Points, HasLen, 2)
+		}
+	}
+
+	// the gauges keep their value but are only reported when updated
+	c.Assert(aggregator.Flush(start.Add(20*time.Second)), HasLen, 0)
+	aggregator.Consume("queue.depth:-1|g", "test")
+	c.Assert(values(aggregator.Flush(start.Add(30*time.Second))), DeepEquals, map[string]float64{"statsd.queue.depth": 14})
+}
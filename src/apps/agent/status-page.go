@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type StatusPage struct {
+	Host      string        `json:"host"`
+	State     string        `json:"state"`
+	Timestamp time.Time     `json:"timestamp"`
+	Checks    []*CheckState `json:"checks"`
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.Host}} status</title>
+  <style>
+    body { font-family: sans-serif; }
+    .ok { color: #2a2; } .warning { color: #c80; } .critical { color: #c22; } .unknown { color: #888; }
+    td, th { padding: 4px 12px; text-align: left; }
+  </style>
+</head>
+<body>
+  <h1>{{.Host}} is <span class="{{.State}}">{{.State}}</span></h1>
+  <table>
+    <tr><th>Check</th><th>Instance</th><th>State</th><th>Message</th><th>Last run</th></tr>
+    {{range .Checks}}<tr>
+      <td>{{.Kind}} {{.Name}}</td><td>{{.Instance}}</td><td class="{{.State}}">{{.State}}</td><td>{{.Message}}</td><td>{{.Timestamp.Format "2006-01-02 15:04:05"}}</td>
+    </tr>{{end}}
+  </table>
+  <p>Updated {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
+
+func newStatusPage() *StatusPage {
+	checks := checkStates.List()
+	return &StatusPage{AgentConfig().Hostname, worstState(checks), time.Now(), checks}
+}
+
+func renderStatusPage(page *StatusPage) ([]byte, []byte, error) {
+	jsonContent, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	htmlContent := bytes.NewBufferString("")
+	if err := statusPageTemplate.Execute(htmlContent, page); err != nil {
+		return nil, nil, err
+	}
+	return jsonContent, htmlContent.Bytes(), nil
+}
+
+// writes the file atomically so the web server never serves a partial page
+func writeFileAtomically(filename string, content []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(filename), ".status")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), filename)
+}
+
+// periodically publishes the state of all the checks as a json and/or html
+// file and optionally uploads them to s3
+func updateStatusPage() {
+	config := &AgentConfig().StatusPage
+	if config.Json == "" && config.Html == "" && config.Bucket == "" {
+		return
+	}
+
+	for {
+		time.Sleep(AgentConfig().Sleep)
+
+		jsonContent, htmlContent, err := renderStatusPage(newStatusPage())
+		if err != nil {
+			log.Error("Cannot render the status page. Error: %s", err)
+			continue
+		}
+
+		if config.Json != "" {
+			if err := writeFileAtomically(config.Json, jsonContent); err != nil {
+				log.Error("Cannot write the status page to %s. Error: %s", config.Json, err)
+			}
+		}
+		if config.Html != "" {
+			if err := writeFileAtomically(config.Html, htmlContent); err != nil {
+				log.Error("Cannot write the status page to %s. Error: %s", config.Html, err)
+			}
+		}
+
+		if config.Bucket != "" {
+			if err := PutS3Object(&config.S3Config, AgentConfig().Hostname+".json", "application/json", jsonContent); err != nil {
+				log.Error("Cannot upload the status page to s3. Error: %s", err)
+			}
+			if err := PutS3Object(&config.S3Config, AgentConfig().Hostname+".html", "text/html", htmlContent); err != nil {
+				log.Error("Cannot upload the status page to s3. Error: %s", err)
+			}
+		}
+	}
+}
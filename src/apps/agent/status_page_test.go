@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+type StatusPageSuite struct{}
+
+var _ = Suite(&StatusPageSuite{})
+
+func (self *StatusPageSuite) TestRender(c *C) {
+	states := NewCheckStates()
+	states.Set(CHECK_PLUGIN, "redis", "", "ok", "REDIS OK")
+	states.Set(CHECK_HTTP, "homepage", "", "critical", "<script>")
+	checks := states.List()
+	c.Assert(checks, HasLen, 2)
+	c.Assert(checks[0].Kind, Equals, CHECK_HTTP)
+
+	page := &StatusPage{Host: "web1", State: worstState(checks), Checks: checks}
+	c.Assert(page.State, Equals, "critical")
+
+	jsonContent, htmlContent, err := renderStatusPage(page)
+	c.Assert(err, IsNil)
+
+	parsed := &StatusPage{}
+	c.Assert(json.Unmarshal(jsonContent, parsed), IsNil)
+	c.Assert(parsed.Checks, HasLen, 2)
+	c.Assert(strings.Contains(string(htmlContent), "web1 is <span class=\"critical\">critical</span>"), Equals, true)
+	c.Assert(strings.Contains(string(htmlContent), "<script>"), Equals, false)
+}
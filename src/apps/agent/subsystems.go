@@ -0,0 +1,162 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the subsystems that can be stopped at runtime through the local api, a
+// collector is stopped with collector:<name>
+const (
+	SUBSYSTEM_LOG_TAILER = "log-tailer"
+	SUBSYSTEM_STATSD     = "statsd"
+	SUBSYSTEM_LOADGEN    = "loadgen"
+	SUBSYSTEM_COLLECTOR  = "collector:"
+)
+
+// A subsystem stopped to troubleshoot a production host without restarting
+// the agent. It stays stopped until it's started again, it expires or the
+// agent restarts.
+type StoppedSubsystem struct {
+	Name    string    `json:"name"`
+	Author  string    `json:"author"`
+	Stopped time.Time `json:"stopped"`
+	Expires time.Time `json:"expires"` // zero if it was stopped until started again
+}
+
+type Subsystems struct {
+	lock    sync.Mutex
+	stopped map[string]*StoppedSubsystem
+}
+
+var subsystems = NewSubsystems()
+
+func NewSubsystems() *Subsystems {
+	return &Subsystems{stopped: make(map[string]*StoppedSubsystem)}
+}
+
+func validSubsystem(name string) bool {
+	switch name {
+	case SUBSYSTEM_LOG_TAILER, SUBSYSTEM_STATSD, SUBSYSTEM_LOADGEN:
+		return true
+	}
+	if strings.HasPrefix(name, SUBSYSTEM_COLLECTOR) {
+		_, _, ok := parseCollectorFile(strings.TrimPrefix(name, SUBSYSTEM_COLLECTOR) + "-0.so")
+		return ok
+	}
+	return false
+}
+
+// stops the subsystem, for the duration if it's positive
+func (self *Subsystems) Stop(name, author string, duration time.Duration) (*StoppedSubsystem, error) {
+	if !validSubsystem(name) {
+		return nil, fmt.Errorf("Unknown subsystem '%s', must be %s, %s, %s or %s<name>", name, SUBSYSTEM_LOG_TAILER, SUBSYSTEM_STATSD, SUBSYSTEM_LOADGEN, SUBSYSTEM_COLLECTOR)
+	}
+	if duration < 0 {
+		return nil, fmt.Errorf("The duration cannot be negative")
+	}
+
+	stopped := &StoppedSubsystem{Name: name, Author: author, Stopped: time.Now()}
+	if duration > 0 {
+		stopped.Expires = stopped.Stopped.Add(duration)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopped[name] = stopped
+	return stopped, nil
+}
+
+// returns false if the subsystem wasn't stopped
+func (self *Subsystems) Start(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.stopped[name]
+	delete(self.stopped, name)
+	return ok
+}
+
+// removes the subsystem if its stop expired, the lock must be held
+func (self *Subsystems) expired(name string, now time.Time) bool {
+	stopped := self.stopped[name]
+	if stopped.Expires.IsZero() || stopped.Expires.After(now) {
+		return false
+	}
+	log.Info("Subsystem %s stopped by %s expired, starting it", name, stopped.Author)
+	delete(self.stopped, name)
+	return true
+}
+
+func (self *Subsystems) IsStopped(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.stopped[name]; !ok {
+		return false
+	}
+	return !self.expired(name, time.Now())
+}
+
+// returns the stopped subsystems sorted by name
+func (self *Subsystems) List() []*StoppedSubsystem {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	names := make([]string, 0, len(self.stopped))
+	for name, _ := range self.stopped {
+		if !self.expired(name, now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	list := make([]*StoppedSubsystem, 0, len(names))
+	for _, name := range names {
+		list = append(list, self.stopped[name])
+	}
+	return list
+}
+
+func listSubsystems(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, subsystems.List())
+}
+
+func stopSubsystem(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":subsystem")
+	var duration time.Duration
+	if rawDuration := req.FormValue("for"); rawDuration != "" {
+		var err error
+		if duration, err = time.ParseDuration(rawDuration); err != nil {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor := requestActor(req)
+	stopped, err := subsystems.Stop(name, actor, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit(actor, "stop_subsystem", "", "", fmt.Sprintf("subsystem=%s duration=%s", name, duration))
+	log.Warn("Subsystem %s stopped by %s", name, actor)
+	writeJson(w, http.StatusOK, stopped)
+}
+
+func startSubsystem(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":subsystem")
+	actor := requestActor(req)
+
+	audit(actor, "start_subsystem", "", "", fmt.Sprintf("subsystem=%s", name))
+
+	if !subsystems.Start(name) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Info("Subsystem %s started by %s", name, actor)
+	w.WriteHeader(http.StatusOK)
+}
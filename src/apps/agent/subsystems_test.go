@@ -0,0 +1,64 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+type SubsystemsSuite struct{}
+
+var _ = Suite(&SubsystemsSuite{})
+
+func (self *SubsystemsSuite) TearDownTest(c *C) {
+	subsystems = NewSubsystems()
+}
+
+func (self *SubsystemsSuite) TestStopAndStart(c *C) {
+	s := NewSubsystems()
+	_, err := s.Stop("graphite", "test", 0)
+	c.Assert(err, ErrorMatches, "Unknown subsystem 'graphite'.*")
+	_, err = s.Stop("collector:", "test", 0)
+	c.Assert(err, NotNil)
+	_, err = s.Stop(SUBSYSTEM_STATSD, "test", -time.Minute)
+	c.Assert(err, NotNil)
+
+	_, err = s.Stop(SUBSYSTEM_STATSD, "test", 0)
+	c.Assert(err, IsNil)
+	_, err = s.Stop("collector:oracle", "test", time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(s.IsStopped(SUBSYSTEM_STATSD), Equals, true)
+	c.Assert(s.IsStopped("collector:oracle"), Equals, true)
+	c.Assert(s.IsStopped("collector:mysql"), Equals, false)
+	c.Assert(s.List(), HasLen, 2)
+
+	// a stop with a duration expires, the others last until started again
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(s.IsStopped("collector:oracle"), Equals, false)
+	list := s.List()
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, SUBSYSTEM_STATSD)
+
+	c.Assert(s.Start(SUBSYSTEM_STATSD), Equals, true)
+	c.Assert(s.Start(SUBSYSTEM_STATSD), Equals, false)
+	c.Assert(s.IsStopped(SUBSYSTEM_STATSD), Equals, false)
+}
+
+func (self *SubsystemsSuite) TestStopSubsystemApi(c *C) {
+	call := func(handler http.HandlerFunc, url string) int {
+		req, _ := http.NewRequest("POST", url, nil)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder.Code
+	}
+
+	c.Assert(call(stopSubsystem, "/subsystems/log-tailer/stop?:subsystem=log-tailer&for=soon"), Equals, http.StatusBadRequest)
+	c.Assert(call(stopSubsystem, "/subsystems/snmp/stop?:subsystem=snmp"), Equals, http.StatusBadRequest)
+	c.Assert(call(stopSubsystem, "/subsystems/log-tailer/stop?:subsystem=log-tailer&for=15m"), Equals, http.StatusOK)
+	c.Assert(subsystems.IsStopped(SUBSYSTEM_LOG_TAILER), Equals, true)
+
+	c.Assert(call(startSubsystem, "/subsystems/statsd/start?:subsystem=statsd"), Equals, http.StatusNotFound)
+	c.Assert(call(startSubsystem, "/subsystems/log-tailer/start?:subsystem=log-tailer"), Equals, http.StatusOK)
+	c.Assert(subsystems.IsStopped(SUBSYSTEM_LOG_TAILER), Equals, false)
+}
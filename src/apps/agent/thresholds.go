@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the states of a threshold alert, in increasing severity
+const (
+	ALERT_OK       = "ok"
+	ALERT_WARNING  = "warning"
+	ALERT_CRITICAL = "critical"
+)
+
+var ALERT_SEVERITIES = map[string]int{ALERT_OK: 0, ALERT_WARNING: 1, ALERT_CRITICAL: 2}
+
+// The state of a threshold for a series. An alert starts once warning or
+// critical matched for the for of the threshold and, with a recovery
+// condition, ends only once it matches, so a value hovering around the
+// threshold doesn't flap.
+type AlertState struct {
+	Threshold  string              `json:"threshold"`
+	Metric     string              `json:"metric"`
+	Dimensions errplane.Dimensions `json:"dimensions"`
+	State      string              `json:"state"`
+	Since      time.Time           `json:"since"`
+	Value      float64             `json:"value"`
+	pending    string              // the more severe state warning or critical matched
+	matched    time.Time           // when the pending state first matched
+}
+
+type AlertStates struct {
+	lock   sync.Mutex
+	states map[string]*AlertState
+}
+
+var alertStates = NewAlertStates()
+
+func NewAlertStates() *AlertStates {
+	return &AlertStates{states: make(map[string]*AlertState)}
+}
+
+// the state the conditions of the threshold ask for
+func thresholdState(threshold *Threshold, value float64) string {
+	if threshold.Critical.Matches(value) {
+		return ALERT_CRITICAL
+	}
+	if threshold.Warning.Matches(value) {
+		return ALERT_WARNING
+	}
+	return ALERT_OK
+}
+
+// moves the state of the series through the threshold, returns the new
+// state if it changed, an empty string otherwise
+func (self *AlertState) evaluate(threshold *Threshold, value float64, now time.Time) string {
+	self.Value = value
+	target := thresholdState(threshold, value)
+	current := ALERT_SEVERITIES[self.State]
+
+	if ALERT_SEVERITIES[target] > current {
+		if self.pending != target {
+			self.pending, self.matched = target, now
+		}
+		if now.Sub(self.matched) < threshold.For {
+			return ""
+		}
+	} else {
+		self.pending = ""
+		if target == self.State || threshold.Recovery != nil && !threshold.Recovery.Matches(value) {
+			return ""
+		}
+	}
+
+	self.State, self.Since, self.pending = target, now, ""
+	return target
+}
+
+// evaluates the thresholds matching the metric and reports the state
+// changes as <metric>.alert events
+func (self *AlertStates) Evaluate(ep *errplane.Errplane, metric string, value float64, dimensions errplane.Dimensions, now time.Time) {
+	for _, threshold := range AgentConfig().Thresholds {
+		if !matchesAny([]string{threshold.Metric}, metric) {
+			continue
+		}
+		key := threshold.Name + "/" + seriesName(metric, dimensions)
+
+		self.lock.Lock()
+		state, ok := self.states[key]
+		if !ok {
+			state = &AlertState{Threshold: threshold.Name, Metric: metric, Dimensions: errplane.Dimensions{}, State: ALERT_OK, Since: now}
+			for name, value := range dimensions {
+				state.Dimensions[name] = value
+			}
+			self.states[key] = state
+		}
+		previous := state.State
+		changed := state.evaluate(threshold, value, now)
+		self.lock.Unlock()
+
+		if changed != "" {
+			reportAlertChange(ep, threshold, metric, dimensions, previous, changed, value, now)
+		}
+	}
+}
+
+func reportAlertChange(ep *errplane.Errplane, threshold *Threshold, metric string, pointDimensions errplane.Dimensions, previous, state string, value float64, now time.Time) {
+	severity := EVENT_SEVERITY_INFO
+	switch state {
+	case ALERT_WARNING:
+		severity = EVENT_SEVERITY_WARNING
+	case ALERT_CRITICAL:
+		severity = EVENT_SEVERITY_CRITICAL
+	}
+	title := fmt.Sprintf("%s is %s", threshold.Name, state)
+	body := fmt.Sprintf("%s was %g, it was %s", metric, value, previous)
+	context, _ := json.Marshal(&eventAnnotation{title, body, severity})
+
+	dimensions := errplane.Dimensions{}
+	for name, value := range pointDimensions {
+		dimensions[name] = value
+	}
+	dimensions["threshold"] = threshold.Name
+	dimensions["state"] = state
+	dimensions["previous_state"] = previous
+	dimensions["severity"] = severity
+	reportWithContext(ep, metric+".alert", 1.0, now, string(context), dimensions)
+}
+
+// returns the series that aren't ok sorted by threshold and series
+func (self *AlertStates) Alerting() []*AlertState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := make([]string, 0)
+	for key, state := range self.states {
+		if state.State != ALERT_OK {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	alerting := make([]*AlertState, 0, len(keys))
+	for _, key := range keys {
+		state := *self.states[key]
+		alerting = append(alerting, &state)
+	}
+	return alerting
+}
+
+// forgets the states of the thresholds that are no longer configured, e.g.
+// after a reload
+func (self *AlertStates) Prune() {
+	names := make(map[string]bool)
+	for _, threshold := range AgentConfig().Thresholds {
+		names[threshold.Name] = true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, state := range self.states {
+		if !names[state.Threshold] {
+			delete(self.states, key)
+		}
+	}
+}
+
+func listAlerts(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, alertStates.Alerting())
+}
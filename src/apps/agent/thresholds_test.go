@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type ThresholdsSuite struct{}
+
+var _ = Suite(&ThresholdsSuite{})
+
+func condition(c *C, expression string) *ThresholdCondition {
+	parsed, err := ParseThresholdCondition(expression)
+	c.Assert(err, IsNil)
+	return parsed
+}
+
+// the alert events reported since the previous call
+func takeAlerts() []*errplane.JsonPoint {
+	operation := httpBatcher.take()
+	if operation == nil {
+		return nil
+	}
+	points := make([]*errplane.JsonPoint, 0)
+	for _, write := range operation.Writes {
+		points = append(points, write.Points...)
+	}
+	return points
+}
+
+func (self *ThresholdsSuite) TestConditions(c *C) {
+	c.Assert(condition(c, "> 100").Matches(101), Equals, true)
+	c.Assert(condition(c, "> 100").Matches(100), Equals, false)
+	c.Assert(condition(c, ">=100").Matches(100), Equals, true)
+	c.Assert(condition(c, "< 0.5").Matches(0.25), Equals, true)
+	c.Assert(condition(c, "!= 0").Matches(0), Equals, false)
+	c.Assert(condition(c, ""), IsNil)
+	c.Assert(condition(c, "").Matches(1), Equals, false)
+	_, err := ParseThresholdCondition("over 9000")
+	c.Assert(err, ErrorMatches, "Invalid threshold condition 'over 9000'.*")
+	_, err = ParseThresholdCondition("> lots")
+	c.Assert(err, NotNil)
+}
+
+func (self *ThresholdsSuite) TestStateMachine(c *C) {
+	defer setTestConfig(func(config *Config) {
+		config.Thresholds = []*Threshold{&Threshold{
+			Name:     "too-many-connections",
+			Metric:   "plugins.mysql.conn*",
+			Warning:  condition(c, "> 100"),
+			Critical: condition(c, "> 200"),
+			Recovery: condition(c, "< 80"),
+			For:      time.Minute,
+		}}
+	})()
+	previousBatcher := httpBatcher
+	defer func() { httpBatcher = previousBatcher }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+
+	states := NewAlertStates()
+	dimensions := errplane.Dimensions{"host": "db1", "db": "users"}
+	start := time.Now()
+	evaluate := func(value float64, after time.Duration) {
+		states.Evaluate(nil, "plugins.mysql.connections", value, dimensions, start.Add(after))
+	}
+
+	// warning only starts after matching for a minute
+	evaluate(150, 0)
+	evaluate(150, 30*time.Second)
+	c.Assert(takeAlerts(), IsNil)
+	evaluate(150, time.Minute)
+	alerts := takeAlerts()
+	c.Assert(alerts, HasLen, 1)
+	c.Assert(alerts[0].Dimensions["state"], Equals, ALERT_WARNING)
+	c.Assert(alerts[0].Dimensions["previous_state"], Equals, ALERT_OK)
+	c.Assert(alerts[0].Dimensions["db"], Equals, "users")
+	c.Assert(alerts[0].Context, Equals, `{"title":"too-many-connections is warning","body":"plugins.mysql.connections was 150, it was ok","severity":"warning"}`)
+
+	// critical has to hold for a minute as well, a dip restarts the wait
+	evaluate(250, 2*time.Minute)
+	evaluate(150, 2*time.Minute+30*time.Second)
+	evaluate(250, 3*time.Minute)
+	evaluate(250, 3*time.Minute+30*time.Second)
+	c.Assert(takeAlerts(), IsNil)
+	evaluate(250, 4*time.Minute)
+	alerts = takeAlerts()
+	c.Assert(alerts, HasLen, 1)
+	c.Assert(alerts[0].Dimensions["state"], Equals, ALERT_CRITICAL)
+	c.Assert(states.Alerting(), HasLen, 1)
+
+	// the alert holds until the recovery condition matches
+	evaluate(90, 5*time.Minute)
+	c.Assert(takeAlerts(), IsNil)
+	evaluate(70, 6*time.Minute)
+	alerts = takeAlerts()
+	c.Assert(alerts, HasLen, 1)
+	c.Assert(alerts[0].Dimensions["state"], Equals, ALERT_OK)
+	c.Assert(alerts[0].Dimensions["severity"], Equals, EVENT_SEVERITY_INFO)
+	c.Assert(states.Alerting(), HasLen, 0)
+
+	// other metrics aren't evaluated and removed thresholds are forgotten
+	states.Evaluate(nil, "plugins.mysql.threads", 500, dimensions, start)
+	c.Assert(takeAlerts(), IsNil)
+	setTestConfig(func(config *Config) { config.Thresholds = nil })
+	states.Prune()
+	c.Assert(states.states, HasLen, 0)
+}
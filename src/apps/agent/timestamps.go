@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	"time"
+	. "utils"
+)
+
+// the values of the delivery dimension of the points that aren't real-time
+const (
+	DELIVERY_LATE    = "late"    // sent later than timestamps.late-after after their collection
+	DELIVERY_SPOOLED = "spooled" // replayed from the spool after an outage
+)
+
+// returns the delivery dimension of a point collected at the given unix
+// time and sent now, empty if it's sent in time
+func pointDelivery(collected int64, now time.Time, spooled bool) string {
+	if spooled {
+		return DELIVERY_SPOOLED
+	}
+	lateAfter := AgentConfig().Timestamps.LateAfter
+	if collected > 0 && lateAfter > 0 && now.Sub(time.Unix(collected, 0)) > lateAfter {
+		return DELIVERY_LATE
+	}
+	return ""
+}
+
+// marks the late and spooled points with the delivery dimension and, in
+// the send timestamps mode, stamps the points with the time they're sent
+func stampWrites(writes []*errplane.JsonPoints, now time.Time, spooled bool) {
+	sendTime := AgentConfig().Timestamps.Mode == TIMESTAMPS_SEND
+	for _, write := range writes {
+		for _, point := range write.Points {
+			if delivery := pointDelivery(point.Time, now, spooled); delivery != "" {
+				point.Dimensions = withDimension(point.Dimensions, "delivery", delivery)
+			}
+			if sendTime {
+				point.Time = now.Unix()
+			}
+		}
+	}
+}
+
+// returns a copy of the dimensions with the given one set, the points of a
+// write can share their dimensions
+func withDimension(dimensions errplane.Dimensions, name, value string) errplane.Dimensions {
+	copied := make(errplane.Dimensions, len(dimensions)+1)
+	for key, existing := range dimensions {
+		copied[key] = existing
+	}
+	copied[name] = value
+	return copied
+}
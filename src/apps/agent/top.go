@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	. "utils"
+)
+
+const (
+	TOP_REFRESH_INTERVAL = 2 * time.Second
+	TOP_ERRORS           = 10
+
+	// clears the terminal and moves the cursor to the top left corner
+	CLEAR_SCREEN = "\x1b[H\x1b[2J"
+)
+
+var stateColors = map[string]string{
+	"ok":            "\x1b[32m",
+	"warning":       "\x1b[33m",
+	STATUS_FLAPPING: "\x1b[33m",
+	"critical":      "\x1b[31m",
+	"unknown":       "\x1b[90m",
+}
+
+// A client of the local api of the running agent, using the unix socket
+// if one is configured and the port in PORT_FILE otherwise
+type LocalApiClient struct {
+	client  *http.Client
+	baseUrl string
+	token   string
+}
+
+func NewLocalApiClient() (*LocalApiClient, error) {
+	token := os.Getenv("ERRPLANE_AGENT_TOKEN")
+	if AgentConfig().ApiSocket != "" {
+		socket := AgentConfig().ApiSocket
+		transport := &http.Transport{Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}}
+		return &LocalApiClient{&http.Client{Transport: transport}, "http://localhost", token}, nil
+	}
+
+	port, err := ioutil.ReadFile(PORT_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the port of the agent from %s, is the agent running? Error: %s", PORT_FILE, err)
+	}
+	scheme, client := "http", &http.Client{}
+	if AgentConfig().ApiTlsCert != "" {
+		// the certificate is usually issued for the host name, not localhost
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return &LocalApiClient{client, fmt.Sprintf("%s://localhost:%s", scheme, strings.TrimSpace(string(port))), token}, nil
+}
+
+func (self *LocalApiClient) Get(path string, value interface{}) error {
+	return self.Do("GET", path, nil, value)
+}
+
+func (self *LocalApiClient) Post(path string, form url.Values, value interface{}) error {
+	return self.Do("POST", path, form, value)
+}
+
+// sends the form, if any, and decodes the json response in value unless
+// it's nil
+func (self *LocalApiClient) Do(method, path string, form url.Values, value interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, self.baseUrl+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if self.token != "" {
+		req.Header.Set(TOKEN_HEADER, self.token)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s returned %s %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if value == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func colorState(state string) string {
+	color, ok := stateColors[state]
+	if !ok {
+		return state
+	}
+	return color + state + "\x1b[0m"
+}
+
+// renders a snapshot of the agent, the plugins sorted by state then name
+func renderTop(health *AgentHealth, plugins []*PluginStatus, errors []*RecentError, now time.Time) string {
+	out := bytes.NewBufferString("")
+	fmt.Fprintf(out, "errplane agent  %s  up %s  checks %d  plugins %d  send queue %d\n\n",
+		colorState(health.Status), time.Duration(health.Uptime)*time.Second, health.Checks, health.Plugins, health.SendQueue)
+
+	fmt.Fprintf(out, "%-24s %-20s %-10s %10s %10s  %s\n", "PLUGIN", "INSTANCE", "STATE", "DURATION", "LAST RUN", "MESSAGE")
+	sortPluginStatuses(plugins)
+	for _, plugin := range plugins {
+		instance := plugin.Instance
+		if instance == "" {
+			instance = plugin.InstanceId
+		}
+		state, message := "pending", ""
+		if plugin.State != nil {
+			state, message = plugin.State.State, plugin.State.Message
+		}
+		duration, lastRun := "-", "-"
+		if plugin.LastRun != nil {
+			duration = plugin.LastRun.Duration.String()
+			lastRun = (time.Duration(now.Sub(plugin.LastRun.Start).Seconds()) * time.Second).String() + " ago"
+		}
+		// pad before coloring, the escape sequences would throw the columns off
+		fmt.Fprintf(out, "%-24s %-20s %s %10s %10s  %s\n", plugin.Plugin, instance,
+			strings.Replace(fmt.Sprintf("%-10s", state), state, colorState(state), 1), duration, lastRun, message)
+	}
+
+	fmt.Fprintf(out, "\nRECENT ERRORS\n")
+	if len(errors) > TOP_ERRORS {
+		errors = errors[len(errors)-TOP_ERRORS:]
+	}
+	for _, err := range errors {
+		fmt.Fprintf(out, "%s %s\n", err.Timestamp.Format("15:04:05"), err.Message)
+	}
+	return out.String()
+}
+
+func sortPluginStatuses(plugins []*PluginStatus) {
+	key := func(plugin *PluginStatus) string {
+		severity := -1
+		if plugin.State != nil {
+			severity = stateSeverity[plugin.State.State]
+		}
+		return fmt.Sprintf("%d/%s/%s", 9-severity, plugin.Plugin, plugin.Instance)
+	}
+	for i := 1; i < len(plugins); i++ {
+		for j := i; j > 0 && key(plugins[j]) < key(plugins[j-1]); j-- {
+			plugins[j], plugins[j-1] = plugins[j-1], plugins[j]
+		}
+	}
+}
+
+// refreshes the state of the running agent until interrupted
+func runTop(out io.Writer) int {
+	client, err := NewLocalApiClient()
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+		return 1
+	}
+
+	for {
+		health := &AgentHealth{}
+		plugins := make([]*PluginStatus, 0)
+		errors := make([]*RecentError, 0)
+		if err := client.Get("/health", health); err != nil {
+			fmt.Fprintf(out, "%sCannot talk to the agent. Error: %s\n", CLEAR_SCREEN, err)
+		} else if err := client.Get("/plugins", &plugins); err != nil {
+			fmt.Fprintf(out, "%sCannot list the plugins. Error: %s\n", CLEAR_SCREEN, err)
+		} else if err := client.Get("/errors", &errors); err != nil {
+			fmt.Fprintf(out, "%sCannot list the recent errors. Error: %s\n", CLEAR_SCREEN, err)
+		} else {
+			fmt.Fprint(out, CLEAR_SCREEN+renderTop(health, plugins, errors, time.Now()))
+		}
+		time.Sleep(TOP_REFRESH_INTERVAL)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type TopSuite struct{}
+
+var _ = Suite(&TopSuite{})
+
+func (self *TopSuite) TestRenderTop(c *C) {
+	now := time.Now()
+	health := &AgentHealth{Status: "critical", Uptime: 90, Checks: 2, Plugins: 2, SendQueue: 7}
+	plugins := []*PluginStatus{
+		&PluginStatus{Plugin: "redis", InstanceId: "abc", State: &CheckState{State: "ok"},
+			LastRun: &PluginRun{Start: now.Add(-5 * time.Second), Duration: 120 * time.Millisecond}},
+		&PluginStatus{Plugin: "mysql", Instance: "db1", State: &CheckState{State: "critical", Message: "down"}},
+	}
+	errors := []*RecentError{&RecentError{Timestamp: now, Message: "cannot send"}}
+
+	out := renderTop(health, plugins, errors, now)
+	c.Assert(out, Matches, "(?s).*up 1m30s  checks 2  plugins 2  send queue 7\n.*")
+	c.Assert(out, Matches, "(?s).*cannot send\n$")
+	// the critical plugin comes first
+	c.Assert(strings.Index(out, "mysql") < strings.Index(out, "redis"), Equals, true)
+	c.Assert(out, Matches, "(?s).*redis +abc .*120ms +5s ago.*")
+}
+
+func (self *TopSuite) TestRecentErrorsKeepsTheLastErrors(c *C) {
+	errors := NewRecentErrors(2)
+	for _, message := range []string{"first", "second", "third"} {
+		errors.LogWrite(&log.LogRecord{Level: log.ERROR, Created: time.Now(), Message: message})
+	}
+	list := errors.List()
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].Message, Equals, "second")
+	c.Assert(list[1].Message, Equals, "third")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// the most spans kept between two exports, the newer ones are dropped
+const MAX_PENDING_SPANS = 10000
+
+// A span of the w3c trace context, a scheduling cycle or a plugin run. The
+// runs of a cycle share its trace id so a late run can be followed back to
+// the cycle that scheduled it.
+type Span struct {
+	TraceId    string
+	SpanId     string
+	ParentId   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+func randomHex(size int) string {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		// an id is better than no trace at all
+		return fmt.Sprintf("%0*x", size*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// starts a span, a new trace if the parent is nil
+func NewSpan(parent *Span, name string) *Span {
+	span := &Span{SpanId: randomHex(8), Name: name, Start: time.Now(), Attributes: make(map[string]string)}
+	if parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentId = parent.SpanId
+	} else {
+		span.TraceId = randomHex(16)
+	}
+	return span
+}
+
+// the traceparent header, passed to the plugins as TRACEPARENT
+func (self *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", self.TraceId, self.SpanId)
+}
+
+func (self *Span) Fail(message string) {
+	self.Error = message
+}
+
+// ends the span and queues it for the otlp export if tracing is enabled
+func (self *Span) Finish() {
+	self.End = time.Now()
+	spanExporter.Add(self)
+}
+
+// Exports the spans to an otlp/http endpoint (json encoding) every
+// flush-interval
+type SpanExporter struct {
+	lock    sync.Mutex
+	pending []*Span
+	dropped int
+}
+
+var spanExporter = &SpanExporter{}
+
+func (self *SpanExporter) Add(span *Span) {
+	if AgentConfig().Tracing.OtlpEndpoint == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.pending) >= MAX_PENDING_SPANS {
+		self.dropped++
+		return
+	}
+	self.pending = append(self.pending, span)
+}
+
+func (self *SpanExporter) take() ([]*Span, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	spans, dropped := self.pending, self.dropped
+	self.pending, self.dropped = nil, 0
+	return spans, dropped
+}
+
+func otlpAttributes(attributes map[string]string) []map[string]interface{} {
+	converted := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		converted = append(converted, map[string]interface{}{"key": key, "value": map[string]string{"stringValue": value}})
+	}
+	return converted
+}
+
+// returns the spans as an otlp ExportTraceServiceRequest
+func otlpRequest(spans []*Span) map[string]interface{} {
+	converted := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           span.TraceId,
+			"spanId":            span.SpanId,
+			"name":              span.Name,
+			"kind":              1, // internal
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+		if span.ParentId != "" {
+			otlpSpan["parentSpanId"] = span.ParentId
+		}
+		if span.Error != "" {
+			otlpSpan["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+		converted = append(converted, otlpSpan)
+	}
+	resource := map[string]string{"service.name": AgentConfig().Tracing.ServiceName, "host.name": AgentConfig().Hostname}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "errplane-agent"}, "spans": converted}},
+		}},
+	}
+}
+
+func (self *SpanExporter) Export() error {
+	spans, dropped := self.take()
+	if dropped > 0 {
+		log.Warn("Dropped %d spans, the otlp endpoint %s can't keep up", dropped, AgentConfig().Tracing.OtlpEndpoint)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return NetworkError(postJson(AgentConfig().Tracing.OtlpEndpoint, otlpRequest(spans)))
+}
+
+func exportSpans() {
+	for {
+		time.Sleep(AgentConfig().Tracing.FlushInterval)
+		if AgentConfig().Tracing.OtlpEndpoint == "" {
+			continue
+		}
+		if err := spanExporter.Export(); err != nil {
+			log.Error("Cannot export the spans to %s. Error: %s", AgentConfig().Tracing.OtlpEndpoint, err)
+		}
+	}
+}
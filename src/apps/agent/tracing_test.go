@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type TracingSuite struct {
+	previous *Config
+}
+
+var _ = Suite(&TracingSuite{})
+
+func (self *TracingSuite) SetUpTest(c *C) {
+	self.previous = AgentConfig()
+	config := *self.previous
+	SetAgentConfig(&config)
+	spanExporter.take()
+}
+
+func (self *TracingSuite) TearDownTest(c *C) {
+	SetAgentConfig(self.previous)
+	spanExporter.take()
+}
+
+func (self *TracingSuite) TestSpans(c *C) {
+	cycle := NewSpan(nil, "plugins cycle")
+	c.Assert(cycle.TraceId, Matches, "[0-9a-f]{32}")
+	c.Assert(cycle.SpanId, Matches, "[0-9a-f]{16}")
+	run := NewSpan(cycle, "plugin mysql")
+	c.Assert(run.TraceId, Equals, cycle.TraceId)
+	c.Assert(run.ParentId, Equals, cycle.SpanId)
+	c.Assert(run.Traceparent(), Equals, "00-"+cycle.TraceId+"-"+run.SpanId+"-01")
+}
+
+func (self *TracingSuite) TestPluginRun(c *C) {
+	dir := c.MkDir()
+	script := "#!/bin/sh\necho \"CRITICAL: $TRACEPARENT\"\nexit 2\n"
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte(script), 0755), IsNil)
+	plugin := &PluginMetadata{Name: "traced", Path: dir, Output: "nagios"}
+
+	// the points are kept in the batch
+	previous := httpBatcher
+	defer func() { httpBatcher = previous }()
+	httpBatcher = NewHttpBatcher(1000, time.Hour, nil)
+
+	setTestConfig(func(config *Config) { config.Tracing.OtlpEndpoint = "http://localhost:4318/v1/traces" })
+	cycle := NewSpan(nil, "plugins cycle")
+	runPlugin(nil, &Instance{}, plugin, cycle)
+
+	var status *errplane.JsonPoint
+	for _, write := range httpBatcher.take().Writes {
+		if write.Name == "plugins.traced.status" {
+			status = write.Points[0]
+		}
+	}
+	c.Assert(status, NotNil)
+	c.Assert(status.Dimensions["status_msg"], Matches, ".*00-"+cycle.TraceId+"-[0-9a-f]{16}-01.*")
+	c.Assert(status.Context, Equals, "trace_id: "+cycle.TraceId)
+	_, ok := status.Dimensions["trace_id"]
+	c.Assert(ok, Equals, false)
+
+	spans, _ := spanExporter.take()
+	c.Assert(spans, HasLen, 1)
+	c.Assert(spans[0].ParentId, Equals, cycle.SpanId)
+	c.Assert(spans[0].Attributes["plugin"], Equals, "traced")
+	c.Assert(spans[0].Error, Matches, "critical: .*")
+}
+
+func (self *TracingSuite) TestExport(c *C) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(json.NewDecoder(r.Body).Decode(&received), IsNil)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	setTestConfig(func(config *Config) {
+		config.Tracing = TracingConfig{OtlpEndpoint: server.URL, ServiceName: "errplane-agent"}
+	})
+
+	span := NewSpan(nil, "plugins cycle")
+	span.Fail("boom")
+	span.Finish()
+	c.Assert(spanExporter.Export(), IsNil)
+
+	data, _ := json.Marshal(received)
+	c.Assert(strings.Contains(string(data), `"traceId":"`+span.TraceId+`"`), Equals, true)
+	c.Assert(strings.Contains(string(data), `"status":{"code":2,"message":"boom"}`), Equals, true)
+	c.Assert(strings.Contains(string(data), `"stringValue":"errplane-agent"`), Equals, true)
+	// nothing left to export
+	received = nil
+	c.Assert(spanExporter.Export(), IsNil)
+	c.Assert(received, IsNil)
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// the watchdog alarms go to the application event log, the tag is the
+// event source
+const WATCHDOG_EVENT_ID = 1
+
+type EventLogWriter struct {
+	log *eventlog.Log
+}
+
+func openSyslog(tag string) (SyslogWriter, error) {
+	// registering the source needs administrator rights, the service
+	// installer does it and it fails if it already exists
+	eventlog.InstallAsEventCreate(tag, eventlog.Error|eventlog.Warning|eventlog.Info)
+	log, err := eventlog.Open(tag)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLogWriter{log}, nil
+}
+
+func (self *EventLogWriter) Warning(message string) error {
+	return self.log.Warning(WATCHDOG_EVENT_ID, message)
+}
+
+func (self *EventLogWriter) Info(message string) error {
+	return self.log.Info(WATCHDOG_EVENT_ID, message)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+)
+
+func openSyslog(tag string) (SyslogWriter, error) {
+	return syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, tag)
+}
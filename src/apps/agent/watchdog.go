@@ -0,0 +1,128 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	. "utils"
+)
+
+const (
+	WATCHDOG_SEND_FAILURES   = "send-failures"
+	WATCHDOG_SPOOL_GROWTH    = "spool-growth"
+	WATCHDOG_PLUGIN_FAILURES = "plugin-failures"
+)
+
+// the weight of the latest report in the average of the plugin failures
+const WATCHDOG_FAILURES_WEIGHT = 0.2
+
+type SyslogWriter interface {
+	Warning(message string) error
+	Info(message string) error
+}
+
+// Watches the agent metrics for the agent failing silently: most writes to
+// errplane failing, the spool growing report after report or the plugin
+// failures spiking above their average. Alarms go to the local syslog, so
+// they're seen even when errplane can't be reached, and to the notifiers
+type Watchdog struct {
+	config   *WatchdogConfig
+	notifier *NotificationDispatcher
+	syslog   SyslogWriter
+
+	previousSpooled float64
+	spoolGrowing    int
+	failuresAverage float64
+	firing          map[string]string // rule => title of the alarm
+}
+
+func NewWatchdog(config *WatchdogConfig, notifier *NotificationDispatcher, syslog SyslogWriter) *Watchdog {
+	return &Watchdog{config: config, notifier: notifier, syslog: syslog, firing: make(map[string]string)}
+}
+
+func newConfiguredWatchdog() *Watchdog {
+	config := &AgentConfig().Watchdog
+	if config.Disabled {
+		return nil
+	}
+	var writer SyslogWriter
+	if !config.NoSyslog {
+		var err error
+		writer, err = openSyslog(config.SyslogTag)
+		if err != nil {
+			log.Warn("Cannot connect to syslog, the watchdog alarms will only be sent to the notifiers. Error: %s", err)
+			writer = nil
+		}
+	}
+	return NewWatchdog(config, newConfiguredNotifiers(), writer)
+}
+
+// returns the rules that fire for the given report, updating the state
+// kept across reports
+func (self *Watchdog) evaluate(counts map[string]int64, gauges map[string]float64) map[string]string {
+	alarms := make(map[string]string)
+
+	failures, writes := counts[STAT_SEND_FAILURES], counts[STAT_WRITES_SENT]
+	if failures > 0 && float64(failures)/float64(failures+writes) >= self.config.SendFailureRate {
+		alarms[WATCHDOG_SEND_FAILURES] = fmt.Sprintf("%d of the last %d writes to errplane failed", failures, failures+writes)
+	}
+
+	spooled := gauges["queue.spooled"]
+	if spooled > self.previousSpooled {
+		self.spoolGrowing++
+	} else {
+		self.spoolGrowing = 0
+	}
+	self.previousSpooled = spooled
+	if self.spoolGrowing >= self.config.SpoolGrowth {
+		alarms[WATCHDOG_SPOOL_GROWTH] = fmt.Sprintf("The spool grew for %d reports in a row to %v writes", self.spoolGrowing, spooled)
+	}
+
+	pluginFailures := float64(counts[STAT_PLUGIN_FAILURES])
+	if counts[STAT_PLUGIN_FAILURES] >= self.config.MinPluginFailures && pluginFailures > self.failuresAverage*self.config.PluginFailureSpike {
+		alarms[WATCHDOG_PLUGIN_FAILURES] = fmt.Sprintf("%v plugin instances couldn't be run, %.1f on average", pluginFailures, self.failuresAverage)
+	}
+	self.failuresAverage += WATCHDOG_FAILURES_WEIGHT * (pluginFailures - self.failuresAverage)
+
+	return alarms
+}
+
+// evaluates the rules on the metrics reported by reportAgentStats and
+// escalates the alarms that started or cleared since the previous report
+func (self *Watchdog) Check(counts map[string]int64, gauges map[string]float64) {
+	if self == nil {
+		return
+	}
+
+	alarms := self.evaluate(counts, gauges)
+	for rule, title := range alarms {
+		if _, ok := self.firing[rule]; ok {
+			continue
+		}
+		self.firing[rule] = title
+		log.Warn("Watchdog alarm %s: %s", rule, title)
+		if self.syslog != nil {
+			self.syslog.Warning(fmt.Sprintf("watchdog alarm %s: %s", rule, title))
+		}
+		self.notifier.Alert(self.notification(rule, "Errplane agent: "+title))
+	}
+	for rule, title := range self.firing {
+		if _, ok := alarms[rule]; ok {
+			continue
+		}
+		delete(self.firing, rule)
+		log.Info("Watchdog alarm %s cleared: %s", rule, title)
+		if self.syslog != nil {
+			self.syslog.Info(fmt.Sprintf("watchdog alarm %s cleared", rule))
+		}
+		self.notifier.Resolve(self.notification(rule, fmt.Sprintf("Errplane agent: %s is back to normal", rule)))
+	}
+}
+
+func (self *Watchdog) notification(rule, title string) *Notification {
+	return &Notification{
+		Key:        notificationKey("watchdog." + rule),
+		Title:      title,
+		Severity:   "critical",
+		Dimensions: map[string]string{"host": AgentConfig().Hostname, "watchdog": rule},
+	}
+}
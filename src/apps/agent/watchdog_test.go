@@ -0,0 +1,82 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type WatchdogSuite struct{}
+
+var _ = Suite(&WatchdogSuite{})
+
+type recordingSyslog struct {
+	warnings []string
+	infos    []string
+}
+
+func (self *recordingSyslog) Warning(message string) error {
+	self.warnings = append(self.warnings, message)
+	return nil
+}
+
+func (self *recordingSyslog) Info(message string) error {
+	self.infos = append(self.infos, message)
+	return nil
+}
+
+func watchdogConfig() *WatchdogConfig {
+	return &WatchdogConfig{SendFailureRate: 0.5, SpoolGrowth: 3, PluginFailureSpike: 3, MinPluginFailures: 5}
+}
+
+func (self *WatchdogSuite) TestSendFailures(c *C) {
+	watchdog := NewWatchdog(watchdogConfig(), nil, nil)
+	c.Assert(watchdog.evaluate(map[string]int64{STAT_SEND_FAILURES: 1, STAT_WRITES_SENT: 9}, nil), HasLen, 0)
+	alarms := watchdog.evaluate(map[string]int64{STAT_SEND_FAILURES: 6, STAT_WRITES_SENT: 4}, nil)
+	c.Assert(alarms[WATCHDOG_SEND_FAILURES], Equals, "6 of the last 10 writes to errplane failed")
+	c.Assert(watchdog.evaluate(map[string]int64{}, nil), HasLen, 0)
+}
+
+func (self *WatchdogSuite) TestSpoolGrowth(c *C) {
+	watchdog := NewWatchdog(watchdogConfig(), nil, nil)
+	for _, spooled := range []float64{1, 2} {
+		c.Assert(watchdog.evaluate(nil, map[string]float64{"queue.spooled": spooled}), HasLen, 0)
+	}
+	alarms := watchdog.evaluate(nil, map[string]float64{"queue.spooled": 3})
+	c.Assert(alarms[WATCHDOG_SPOOL_GROWTH], Equals, "The spool grew for 3 reports in a row to 3 writes")
+	// a replay that shrinks the spool resets the rule
+	c.Assert(watchdog.evaluate(nil, map[string]float64{"queue.spooled": 2}), HasLen, 0)
+	c.Assert(watchdog.evaluate(nil, map[string]float64{"queue.spooled": 3}), HasLen, 0)
+}
+
+func (self *WatchdogSuite) TestPluginFailures(c *C) {
+	watchdog := NewWatchdog(watchdogConfig(), nil, nil)
+	for i := 0; i < 20; i++ {
+		c.Assert(watchdog.evaluate(map[string]int64{STAT_PLUGIN_FAILURES: 4}, nil), HasLen, 0)
+	}
+	// failing steadily isn't a spike, three times the average is
+	c.Assert(watchdog.evaluate(map[string]int64{STAT_PLUGIN_FAILURES: 10}, nil), HasLen, 0)
+	c.Assert(watchdog.evaluate(map[string]int64{STAT_PLUGIN_FAILURES: 40}, nil), HasLen, 1)
+}
+
+func (self *WatchdogSuite) TestEscalation(c *C) {
+	notifier := &recordingNotifier{done: make(chan bool, 10)}
+	writer := &recordingSyslog{}
+	watchdog := NewWatchdog(watchdogConfig(), NewNotificationDispatcher([]Notifier{notifier}, time.Hour), writer)
+
+	failing := map[string]int64{STAT_SEND_FAILURES: 10}
+	watchdog.Check(failing, nil)
+	<-notifier.done
+	watchdog.Check(failing, nil)
+	c.Assert(writer.warnings, DeepEquals, []string{"watchdog alarm send-failures: 10 of the last 10 writes to errplane failed"})
+
+	watchdog.Check(map[string]int64{STAT_WRITES_SENT: 10}, nil)
+	<-notifier.done
+	c.Assert(writer.infos, DeepEquals, []string{"watchdog alarm send-failures cleared"})
+	c.Assert(notifier.notifications, HasLen, 2)
+	c.Assert(notifier.notifications[0].Dimensions["watchdog"], Equals, WATCHDOG_SEND_FAILURES)
+	c.Assert(notifier.notifications[1].Resolved, Equals, true)
+
+	var disabled *Watchdog
+	disabled.Check(failing, nil)
+}
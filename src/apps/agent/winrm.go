@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// collects a curated set of metrics from windows hosts by running wql
+// queries over winrm (ws-management enumerations of the cimv2 namespace)
+
+const (
+	WSMAN_WMI_RESOURCE = "http://schemas.microsoft.com/wbem/wsman/1/wmi/root/cimv2/*"
+	WSMAN_ENUMERATE    = "http://schemas.xmlsoap.org/ws/2004/09/enumeration/Enumerate"
+	WSMAN_PULL         = "http://schemas.xmlsoap.org/ws/2004/09/enumeration/Pull"
+	WMI_TIME_FORMAT    = "20060102150405.000000-000"
+)
+
+const wsmanEnvelope = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:n="http://schemas.xmlsoap.org/ws/2004/09/enumeration" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd">
+<s:Header>
+<a:To>%s</a:To>
+<w:ResourceURI s:mustUnderstand="true">` + WSMAN_WMI_RESOURCE + `</w:ResourceURI>
+<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>
+<a:Action s:mustUnderstand="true">%s</a:Action>
+<w:MaxEnvelopeSize s:mustUnderstand="true">512000</w:MaxEnvelopeSize>
+<a:MessageID>uuid:%s</a:MessageID>
+<w:OperationTimeout>PT%dS</w:OperationTimeout>
+</s:Header>
+<s:Body>%s</s:Body>
+</s:Envelope>`
+
+type WinRMClient struct {
+	target *WindowsTarget
+	client *http.Client
+
+	lock       sync.Mutex
+	collecting bool
+	since      time.Time // the end of the period of the previous collection
+}
+
+type WmiObject map[string]string
+
+func NewWinRMClient(target *WindowsTarget) *WinRMClient {
+	tlsConfig := TlsConfig()
+	tlsConfig.InsecureSkipVerify = target.Insecure
+	return &WinRMClient{target: target, client: &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   target.Timeout,
+	}}
+}
+
+// starts a collection unless the previous one is still running, returns
+// the start of the period the collection covers
+func (self *WinRMClient) startCollection(now time.Time) (time.Time, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.collecting {
+		return time.Time{}, false
+	}
+	since := self.since
+	self.collecting, self.since = true, now
+	return since, true
+}
+
+func (self *WinRMClient) endCollection() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.collecting = false
+}
+
+func xmlEscape(str string) string {
+	buffer := bytes.NewBufferString("")
+	xml.EscapeText(buffer, []byte(str))
+	return buffer.String()
+}
+
+func newMessageId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+func (self *WinRMClient) post(action, body string) ([]byte, error) {
+	envelope := fmt.Sprintf(wsmanEnvelope, xmlEscape(self.target.Url), action, newMessageId(), int(self.target.Timeout.Seconds()), body)
+	req, err := http.NewRequest("POST", self.target.Url, strings.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(self.target.Username, self.target.Password)
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received status code %d", resp.StatusCode)
+	}
+	return content, nil
+}
+
+// runs the wql query and returns the matching objects
+func (self *WinRMClient) Query(wql string) ([]WmiObject, error) {
+	body := `<n:Enumerate><w:OptimizeEnumeration/><w:MaxElements>32000</w:MaxElements>` +
+		`<w:Filter Dialect="http://schemas.microsoft.com/wbem/wsman/1/WQL">` + xmlEscape(wql) + `</w:Filter></n:Enumerate>`
+	response, err := self.post(WSMAN_ENUMERATE, body)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, context, done, err := parseEnumerationResponse(response)
+	for err == nil && !done && context != "" {
+		body = `<n:Pull><n:EnumerationContext>` + xmlEscape(context) + `</n:EnumerationContext><n:MaxElements>32000</n:MaxElements></n:Pull>`
+		if response, err = self.post(WSMAN_PULL, body); err != nil {
+			break
+		}
+		var more []WmiObject
+		more, context, done, err = parseEnumerationResponse(response)
+		objects = append(objects, more...)
+	}
+	return objects, err
+}
+
+// parses an enumerate or pull response, returns the objects, the
+// enumeration context to pull the next objects and whether the end of the
+// sequence was reached
+func parseEnumerationResponse(response []byte) ([]WmiObject, string, bool, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(response))
+	objects := make([]WmiObject, 0)
+	context := ""
+	done := false
+
+	depth, itemsDepth := 0, -1
+	var object WmiObject
+	var text *bytes.Buffer
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case itemsDepth < 0 && t.Name.Local == "Items":
+				itemsDepth = depth
+			case itemsDepth > 0 && depth == itemsDepth+1:
+				object = make(WmiObject)
+			case itemsDepth > 0 && depth == itemsDepth+2:
+				text = bytes.NewBufferString("")
+			case t.Name.Local == "EnumerationContext":
+				text = bytes.NewBufferString("")
+			case t.Name.Local == "EndOfSequence":
+				done = true
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case itemsDepth > 0 && depth == itemsDepth+2:
+				object[t.Name.Local] = text.String()
+			case itemsDepth > 0 && depth == itemsDepth+1:
+				objects = append(objects, object)
+			case depth == itemsDepth:
+				itemsDepth = -1
+			case t.Name.Local == "EnumerationContext":
+				context = strings.TrimSpace(text.String())
+			}
+			if itemsDepth < 0 || depth <= itemsDepth+2 {
+				text = nil
+			}
+			depth--
+		}
+	}
+	return objects, context, done, nil
+}
+
+func monitorWindowsTargets(ep *errplane.Errplane) {
+	if len(AgentConfig().WindowsTargets) == 0 {
+		return
+	}
+
+	// the clients are kept so their connections are reused
+	clients := make([]*WinRMClient, 0, len(AgentConfig().WindowsTargets))
+	for _, target := range AgentConfig().WindowsTargets {
+		client := NewWinRMClient(target)
+		client.since = time.Now().Add(-AgentConfig().Sleep)
+		clients = append(clients, client)
+	}
+	for {
+		for _, client := range clients {
+			since, ok := client.startCollection(time.Now())
+			if !ok {
+				// a slow host mustn't pile up collections, the next one
+				// covers the skipped period
+				log.Warn("Skipping %s, the previous collection is still in progress", client.target.Name)
+				continue
+			}
+			go func(client *WinRMClient) {
+				defer client.endCollection()
+				collectWindowsTarget(ep, client, since)
+			}(client)
+		}
+
+		time.Sleep(AgentConfig().Sleep)
+	}
+}
+
+func windowsServicesQuery(target *WindowsTarget) string {
+	if len(target.Services) == 0 {
+		return "SELECT Name, State FROM Win32_Service WHERE StartMode='Auto'"
+	}
+	conditions := make([]string, 0, len(target.Services))
+	for _, service := range target.Services {
+		conditions = append(conditions, "Name='"+strings.Replace(service, "'", "''", -1)+"'")
+	}
+	return "SELECT Name, State FROM Win32_Service WHERE " + strings.Join(conditions, " OR ")
+}
+
+func collectWindowsTarget(ep *errplane.Errplane, client *WinRMClient, since time.Time) {
+	target := client.target
+	timestamp := time.Now()
+	dimensions := errplane.Dimensions{"host": target.Name}
+
+	cpu, err := client.Query("SELECT PercentProcessorTime FROM Win32_PerfFormattedData_PerfOS_Processor WHERE Name='_Total'")
+	if err != nil {
+		log.Error("Cannot query %s over winrm. Error: %s", target.Name, NetworkError(err))
+		checkStates.Set(CHECK_WINDOWS, target.Name, "", "unknown", err.Error())
+		return
+	}
+	if len(cpu) > 0 {
+		if value, err := strconv.ParseFloat(cpu[0]["PercentProcessorTime"], 64); err == nil {
+			report(ep, "windows.cpu.used", value, timestamp, dimensions, nil)
+		}
+	}
+
+	if system, err := client.Query("SELECT FreePhysicalMemory, TotalVisibleMemorySize FROM Win32_OperatingSystem"); err != nil {
+		log.Error("Cannot query the memory of %s. Error: %s", target.Name, NetworkError(err))
+	} else if len(system) > 0 {
+		free, err1 := strconv.ParseFloat(system[0]["FreePhysicalMemory"], 64)
+		total, err2 := strconv.ParseFloat(system[0]["TotalVisibleMemorySize"], 64)
+		if err1 == nil && err2 == nil && total > 0 {
+			report(ep, "windows.mem.free", free*1024, timestamp, dimensions, nil)
+			report(ep, "windows.mem.used_percentage", 100*(total-free)/total, timestamp, dimensions, nil)
+		}
+	}
+
+	state, msg := OK, ""
+	if services, err := client.Query(windowsServicesQuery(target)); err != nil {
+		log.Error("Cannot query the services of %s. Error: %s", target.Name, NetworkError(err))
+		state, msg = UNKNOWN, "Cannot query the services"
+	} else {
+		stopped := make([]string, 0)
+		for _, service := range services {
+			if service["State"] != "Running" {
+				stopped = append(stopped, service["Name"])
+			}
+			report(ep, "windows.services.status", 1.0, timestamp, errplane.Dimensions{
+				"host":    target.Name,
+				"service": service["Name"],
+				"status":  strings.ToLower(service["State"]),
+			}, nil)
+		}
+		report(ep, "windows.services.stopped", float64(len(stopped)), timestamp, dimensions, nil)
+		if len(stopped) > 0 {
+			state, msg = CRITICAL, "Stopped services: "+strings.Join(stopped, ", ")
+		}
+	}
+	checkStates.Set(CHECK_WINDOWS, target.Name, "", state.String(), msg)
+
+	query := fmt.Sprintf("SELECT Logfile FROM Win32_NTLogEvent WHERE (Logfile='System' OR Logfile='Application') AND EventType=1 AND TimeGenerated >= '%s'",
+		since.UTC().Format(WMI_TIME_FORMAT))
+	if events, err := client.Query(query); err != nil {
+		log.Error("Cannot query the event log of %s. Error: %s", target.Name, NetworkError(err))
+	} else {
+		counts := map[string]int{"System": 0, "Application": 0}
+		for _, event := range events {
+			counts[event["Logfile"]]++
+		}
+		for logfile, count := range counts {
+			report(ep, "windows.eventlog.errors", float64(count), timestamp, errplane.Dimensions{
+				"host":    target.Name,
+				"logfile": logfile,
+			}, nil)
+		}
+	}
+}
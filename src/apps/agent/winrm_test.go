@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type WinRMSuite struct{}
+
+var _ = Suite(&WinRMSuite{})
+
+const enumerateResponse = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:n="http://schemas.xmlsoap.org/ws/2004/09/enumeration" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:p="http://schemas.microsoft.com/wbem/wsman/1/wmi/root/cimv2/Win32_Service" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<s:Header/>
+<s:Body>
+<n:EnumerateResponse>
+<n:EnumerationContext>uuid:F6A3C4F1-1</n:EnumerationContext>
+<w:Items>
+<p:Win32_Service><p:Name>W3SVC</p:Name><p:State>Running</p:State></p:Win32_Service>
+<p:Win32_Service><p:Name>Spooler</p:Name><p:State>Stopped</p:State><p:Description xsi:nil="true"/></p:Win32_Service>
+</w:Items>
+</n:EnumerateResponse>
+</s:Body>
+</s:Envelope>`
+
+const pullResponse = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:n="http://schemas.xmlsoap.org/ws/2004/09/enumeration" xmlns:p="http://schemas.microsoft.com/wbem/wsman/1/wmi/root/cimv2/Win32_Service">
+<s:Body>
+<n:PullResponse>
+<n:Items>
+<p:Win32_Service><p:Name>MSSQLSERVER</p:Name><p:State>Running</p:State></p:Win32_Service>
+</n:Items>
+<n:EndOfSequence/>
+</n:PullResponse>
+</s:Body>
+</s:Envelope>`
+
+func (self *WinRMSuite) TestQueryWithPull(c *C) {
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ := req.BasicAuth()
+		c.Assert(user, Equals, "monitoring")
+		c.Assert(password, Equals, "secret")
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, string(body))
+		if strings.Contains(string(body), "<n:Pull>") {
+			w.Write([]byte(pullResponse))
+			return
+		}
+		w.Write([]byte(enumerateResponse))
+	}))
+	defer server.Close()
+
+	client := NewWinRMClient(&WindowsTarget{Name: "win1", Url: server.URL, Username: "monitoring", Password: "secret", Timeout: time.Second})
+	objects, err := client.Query("SELECT Name, State FROM Win32_Service WHERE StartMode='Auto'")
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 2)
+	c.Assert(strings.Contains(requests[0], "StartMode=&#39;Auto&#39;"), Equals, true)
+	c.Assert(strings.Contains(requests[1], "uuid:F6A3C4F1-1"), Equals, true)
+	c.Assert(objects, DeepEquals, []WmiObject{
+		WmiObject{"Name": "W3SVC", "State": "Running"},
+		WmiObject{"Name": "Spooler", "State": "Stopped", "Description": ""},
+		WmiObject{"Name": "MSSQLSERVER", "State": "Running"},
+	})
+}
+
+func (self *WinRMSuite) TestServicesQuery(c *C) {
+	query := windowsServicesQuery(&WindowsTarget{Services: []string{"W3SVC", "it's"}})
+	c.Assert(query, Equals, "SELECT Name, State FROM Win32_Service WHERE Name='W3SVC' OR Name='it''s'")
+}
+
+func (self *WinRMSuite) TestOverlappingCollections(c *C) {
+	client := NewWinRMClient(&WindowsTarget{Name: "win1", Timeout: time.Second})
+	start := time.Unix(1400000000, 0)
+	client.since = start.Add(-10 * time.Second)
+
+	since, ok := client.startCollection(start)
+	c.Assert(ok, Equals, true)
+	c.Assert(since, Equals, start.Add(-10*time.Second))
+	// the previous collection is still running
+	_, ok = client.startCollection(start.Add(10 * time.Second))
+	c.Assert(ok, Equals, false)
+
+	client.endCollection()
+	since, ok = client.startCollection(start.Add(20 * time.Second))
+	c.Assert(ok, Equals, true)
+	c.Assert(since, Equals, start)
+}
@@ -44,6 +44,31 @@ api-key:     %s # your api key (Settings/Organization)
 app-key:     %s # your app key (Settings/Applications)
 environment: %s # your environment (Settings/Applications)
 
+# dimensions:                                 # optional, added to every point the agent reports
+#   datacenter: us-east-1
+#   role: db
+
+# scrubbing:                                  # optional, remove or hash personal data before it leaves the host
+#   allow: [host, instance*, status*]         # only these dimensions (globs) are sent, all of them if empty
+#   drop: ["*_ip"]                            # these dimensions are removed
+#   hash: [user]                              # the values of these dimensions are replaced by a salted hash
+#   salt: some-secret
+#   patterns:                                 # the matches in the other values are replaced by [name]
+#     email: '[^@ ]+@[^@ ]+'
+#     query: '\?.*'
+
+# secrets:                                    # optional, where the {{secret "name"}} plugin arguments are looked up
+#   file: /etc/errplane-agent/secrets.enc     # managed with errplane-agent secrets set <name>
+#   key-file: /etc/errplane-agent/secrets.key # created with errplane-agent secrets init
+#   config-service: true                      # look up the secrets missing from the file on the config service
+
+# role: web                                   # optional, the role of the host, also sent to the backend
+# config-layers:                              # optional, merged in order on top of this file, missing files are skipped
+#   - /etc/errplane-agent/layers/defaults.yml
+#   - /etc/errplane-agent/layers/os/{os}.yml  # {os} is the os family, e.g. debian or rhel
+#   - /etc/errplane-agent/layers/role/{role}.yml
+#   - /etc/errplane-agent/layers/host/{host}.yml
+
 # aggregator configuration
 percentiles:						# the percentiles that will be calculated and sent to Errplane
   - 80.0
@@ -54,21 +79,57 @@ flush-interval: 10s			# the rollup interval
 udp-addr: :8127					# the udp port on which the aggregator will listen
 
 sleep: 1m                                     # frequency of sampling (accepted suffix, s for seconds, m for minutes and h for hours)
-proxy:                                        # proxy to use when making http requests (e.g. https://201.20.177.185:8080/)
+proxy:                                        # proxy to use when making http requests (e.g. https://201.20.177.185:8080/ or socks5://proxy:1080)
 log-file: /data/errplane-agent/shared/log.txt # the log file of the agent
 log-level: info                               # debug, info, warn, error
 top-n-processes: 5                            # For processes stats the agent will report the top n processes (by memory and cpu usage)
 top-n-sleep:     1m                           # Sampling frequency of the top n processes
 monitored-sleep: 10s                          # Sampling frequency of the monitored processes
 config-service:  %s											      # the location of the configuration service
+# plugins-dir: /data/errplane-agent/shared/plugins               # optional, where the plugins of the config service are installed
+# custom-plugins-dir: /data/errplane-agent/shared/custom-plugins # optional, the plugins written for this host
+# run_as: nagios                                                 # optional, the user (or user:group) the plugins run as, default is the agent user
+# local-plugins: /etc/errplane-agent/plugins.yml                # optional, plugins and processes run until the config service answers and merged afterwards
+# local-plugins-mode: remote                                     # remote (the config service wins), local (the file wins) or fallback (ignored once it answered)
+# config-cache: /data/errplane-agent/shared/backend-configuration.json # optional, the last configuration of the config service, run at boot until it answers
+# no-config-cache: false                                         # optional, don't cache the configuration of the config service
+# plugin-limits:                                                 # optional, the default limits of the plugins, overridden by the limits of their info.yml
+#   cpu: 0.5                                                     # in cpus
+#   memory: 268435456                                            # in bytes, the plugins going beyond are killed and reported as plugins.<name>.oom_killed
+# plugin-cgroup: /sys/fs/cgroup/errplane-plugins                 # the cgroup v2 of the limited plugins, rlimits are used if it can't be created
+
+# processes:                                  # optional, watched every monitored-sleep and reported as server.processes.*
+#   - name:   nginx                           # reported in the process dimension
+#     name-regex: ^nginx$                     # exactly one of name-regex, cmdline (regex on the arguments) or pidfile
+#     user:   root                            # optional, only the processes of this user
+#   - name:   postgres
+#     pidfile: /var/run/postgresql/main.pid
+
+# perf-counters:                              # optional, windows only, reported every sleep as server.perf.<name>
+#   - name: cpu
+#     path: '\Processor(_Total)\%% Processor Time'   # the english path of the counter
+
+# dimension-schemas:                          # optional, the dimensions the metrics matching a regex must have
+#   - metric: '^plugins\.mysql\.'
+#     required: [database]
+#     drop: true                              # drop the violating points instead of only counting them
+#   - metric: '^plugins\.'
+#     types:
+#       port: int                             # int, float, bool or string
 
-# processes:
-#   - name:   mysqld
-#     start:  service mysql start             # the command to run to start the service
-#     stop:   service mysql start             # the command to run to stop the service
-#     status: name                            # check the status of the process using the specified method:
-#     regex: .*ruby.*status-monitor.*         # see 'status' above
-#     user:   root                            # the agent will run the start and stop command using 'sudo -u username command-to-run'
+# log-tails:                                  # optional, lines matching the patterns reported every sleep as logs.<name>.count
+#   - path: /var/log/app/app.log
+#     patterns:
+#       - name: app.requests
+#         regex: 'GET .* (?P<latency>[0-9.]+)ms$' # named groups capturing a number are reported as logs.<name>.<group>
+#       - name: app.oom
+#         regex: OutOfMemoryError
+#         critical: true                      # report the matching lines as logs.<name>.events
+
+# collectors-dir: /opt/errplane-agent/collectors   # optional, go plugins named <name>-<version>.so, linux builds only
+# collectors:                                 # optional, the config passed to the Init of every collector
+#   oracle:
+#     dsn: oracle://monitor@localhost/orcl
 
 # enabled-plugins:
 #   - name: redis       # the name of the plugin
@@ -76,6 +137,314 @@ config-service:  %s											      # the location of the configuration service
 #     - name: default   # optional, default value is 'default'
 #       args:
 #         port: 6379    # call the plugin with --port 6379
+
+# http-checks:
+#   - name: homepage                          # the name of the check, reported as the check dimension
+#     url: https://example.com/
+#     protocols: [h2, http/1.1]               # optional, the protocols offered during ALPN
+#     expected-protocol: HTTP/2.0             # optional, the check is critical if another protocol is negotiated
+#     timeout: 10s                            # optional, default is 10s
+
+# dns-checks:
+#   - name: www                               # the name of the check, reported as the check dimension
+#     hostname: www.example.com
+#     resolvers: [8.8.8.8:53, 1.1.1.1:53, 10.0.0.2:53] # the check is critical if the resolvers answers diverge
+#     allowed-answers: [10.0.0.10]            # optional, answers that are allowed to differ (e.g. split horizon)
+#     timeout: 5s                             # optional, default is 5s
+
+# command-checks:                             # checks whose status is the exit code of the command, 0 is ok
+#   - name: config-present
+#     command: test -f /etc/app/config.yml    # run using sh -c
+#   - name: no-oom
+#     command: grep -q "Out of memory" /var/log/kern.log
+#     invert: true                            # optional, the check is ok when the command fails
+#     timeout: 10s                            # optional, default is 10s
+#   - name: root-disk
+#     command: df -h / | tail -1
+#     metrics:                                # optional, values parsed from the output, e.g. 1.2G, 345ms or 87%%
+#       - name: used_percent
+#         regex: '(\d+%%)'                    # the first group is the value, the whole output without a regex
+#         decimal-separator: "."              # or "," for locales like de_DE
+
+# windows-targets:                            # optional, windows hosts to collect cpu, memory, services and event log errors from
+#   - name: win1                              # reported as the host dimension
+#     url: https://win1.example.com:5986/wsman
+#     username: monitoring                    # basic authentication must be enabled on the winrm service
+#     password: ...
+#     insecure: false                         # optional, skip the certificate verification
+#     services: [W3SVC, MSSQLSERVER]          # optional, by default all the automatic services are checked
+#     timeout: 30s                            # optional, default is 30s
+
+# modbus-devices:                             # optional, modbus tcp devices to read registers from
+#   - name: press-1                           # reported as the device dimension
+#     address: 10.0.0.5:502
+#     unit-id: 1
+#     timeout: 5s                             # optional, default is 5s
+#     registers:
+#       - name: oil_temperature               # reported as modbus.oil_temperature
+#         type: input                         # optional, holding (default) or input
+#         address: 100
+#         format: int16                       # optional, uint16 (default), int16, uint32, int32 or float32
+#         word-order: big                     # optional, for 32 bits formats, big (default) or little
+#         scale: 0.1                          # optional, the value is value * scale + offset
+#         offset: 0
+#         dimensions: {line: a}               # optional, added to the point
+
+# host-stats:                                 # optional, report host.cpu.*, host.mem.*, host.disk.* and host.net.* in a single
+#   enabled: false                            # write per sleep instead of the server.stats.* cpu, memory, disk and network stats
+#   per-cpu: false                            # optional, report every cpu (cpu dimension) next to the total
+#   ignore-fs-types: [proc, sysfs, tmpfs]     # optional, default is the pseudo filesystems
+#   ignore-interfaces: [lo, veth]             # optional, interface name prefixes, default is lo
+
+# host-ip:                                    # optional, the host ip of multi-homed hosts
+#   dimension: false                          # add the ip dimension to every point
+#   interface-dimensions: false               # add ip_<interface> with the ipv4 address of every interface
+#   interfaces: [bond0, eth*]                 # optional, the preferred interfaces in order, default is the default route
+#   subnets: [10.0.0.0/8]                     # optional, the preferred subnets in order
+#   ignore-interfaces: [lo, docker*]          # optional, globs, default is lo, docker*, veth* and virbr*
+
+# mqtt:                                       # optional, report the numbers published on mqtt topics
+#   broker: mqtt.example.com:1883
+#   tls: false                                # optional
+#   client-id: errplane-agent-myhost          # optional, default is errplane-agent-<hostname>
+#   username: ...                             # optional
+#   password: ...
+#   subscriptions:
+#     - topic: factory/+/+/temperature
+#       metric: factory.temperature
+#       topic-dimensions: [site, machine]     # optional, the dimension names of the wildcards in the topic
+#       json-path: $.reading.value            # optional, by default the payload must be a number
+#       qos: 1                                # optional, 0 (default) or 1
+
+# sensors:                                    # optional, sensors of edge devices (e.g. raspberry pi)
+#   - name: greenhouse                        # reported as the sensor dimension of sensors.temperature (in celsius)
+#     type: 1-wire
+#     device: 28-000005e2fdc3                 # listed in /sys/bus/w1/devices
+#   - name: cabinet
+#     type: i2c                               # read from the attribute exposed by the kernel driver of the sensor
+#     path: /sys/class/hwmon/hwmon1/temp1_input
+#     scale: 0.001                            # optional, default is 0.001 (millidegrees)
+#   - name: door
+#     type: gpio                              # reported as sensors.gpio, 0 or 1
+#     pin: 17
+#     dimensions: {room: server}              # optional, added to the point
+
+# spool:                                      # optional, queue the points on disk while the backend is unreachable
+#   dir: /data/errplane-agent/spool
+#   max-size: 104857600                       # optional, in bytes, the oldest points are dropped beyond this size, default is 100MB
+#   max-age: 24h                              # optional, older points are dropped instead of replayed, default is 24h
+
+# http-batch:                                 # optional, coalesce the points into fewer http requests
+#   enabled: true
+#   max-points: 5000                          # send a batch as soon as it has this many points
+#   max-latency: 1s                           # or when its oldest point waited this long
+#   gzip: true                                # compress the batches
+
+# local-store:                                # optional, keep the run durations, the rate state and the dashboard
+#   path: /data/errplane-agent/shared/agent.db  # metrics across restarts
+#   max-size: 67108864                        # optional, in bytes, the least recently updated entries are dropped beyond this size, default is 64MB
+
+# power:                                      # batteries in /sys/class/power_supply are always reported
+#   nut-ups: [ups@localhost]                  # optional, upses to query using the nut upsc command
+#   on-battery-critical-after: 5m             # optional, running on battery is critical after this long, default is 5m
+
+# kubernetes:                                 # optional, detected when the agent runs in a pod
+#   node-name: node-1                         # optional, default is the NODE_NAME environment variable, then the hostname
+#   kubelet-url: https://localhost:10250      # optional, list the pods of the kubelet instead of the api server
+#   annotation: errplane.io/plugins           # optional, the pod annotation listing the plugin instances
+
+# docker:                                     # optional, per container stats from the docker daemon
+#   enabled: true
+#   socket: /var/run/docker.sock              # optional, default is /var/run/docker.sock
+#   labels: [com.example.service]             # optional, the container labels added to the dimensions
+
+# plugin-results-socket: /var/run/errplane-agent-results.sock # optional, publish every parsed plugin result on this
+#                                             # unix socket, one json object per line, e.g. nc -U <socket>
+
+# facts:                                      # optional, host specific values plugin instance arguments can use,
+#   mysql.socket: /var/run/mysqld/mysqld.sock # e.g. --socket {{fact "mysql.socket"}}. hostname, primary_ipv4, os,
+#                                             # arch and cpus are always available, e.g. --ip {{primary_ipv4}}
+
+# plugin-concurrency:
+#   max-concurrency: 10                       # optional, the max number of plugins running at the same time, default is 10
+#   overlap: skip                             # optional, skip (default) or queue the next run of an instance while the
+#                                             # previous one is still running, at most one run is queued
+#   stagger: false                            # optional, spread the first runs of the instances over their interval
+#   jitter: 0                                 # optional, every run moves by up to this fraction of its interval, at most 0.5
+
+# missed-markers: [mysql, redis*]             # optional, the plugins reporting plugins.<name>.missed when a due run is skipped
+
+# output-validation: lenient                  # optional, strict makes the plugins whose output doesn't follow the spec of
+#                                             # their output type unknown, plugins can override it in their info.yml
+
+# legacy-instance-dimensions: false           # optional, deprecated, don't add the instance_id dimension to the plugin
+#                                             # metrics so the series reported by older agents are kept
+# series-compat:                              # optional, also send the renamed series under their previous names
+#   until: 2027-01-01                         # required, only the new names are sent from this day on
+#   names:                                    # the new name to the previous name, a trailing * matches the rest
+#     host.cpu.*: server.stats.cpu.*
+
+# api-tokens:                                 # optional, if no tokens are configured the local api is open to local processes
+#   - name: metrics-client
+#     token: some-secret-token                # sent in the X-Errplane-Token header
+#     scopes: [write]                         # read, write, processes, scrape or admin
+#   - name: ops
+#     common-name: ops.example.com            # client certificate common name, requires api-client-ca
+#     scopes: [admin]
+# api-tls-cert: /etc/errplane-agent/api.crt   # optional, serve the local api over tls
+# api-tls-key:  /etc/errplane-agent/api.key
+# api-client-ca: /etc/errplane-agent/ca.crt   # optional, require client certificates signed by this ca
+# api-socket: /var/run/errplane-agent.sock   # optional, serve the local api on this unix socket as well (mode 0660)
+
+# ssh-tunnel:                                 # optional, send the requests through an ssh tunnel instead of the proxy
+#   host: jump.example.com
+#   user: errplane
+#   key: /etc/errplane-agent/id_ed25519
+#   known-hosts: /etc/errplane-agent/known_hosts # the host key of the jump host must be in it
+#   local-port: 1081                          # the port of the socks5 proxy opened by ssh on localhost
+
+# scrape:                                     # optional, the backend pulls the points instead, requires api-tokens
+#   listen: :9273                             # serves /points and /metrics with the tls of the local api
+#   max-points: 100000                        # the oldest points are dropped when the backend doesn't pull them
+
+# audit-log: /data/errplane-agent/shared/audit.log # optional, log of every config change and remote command
+# audit-log-max-size: 10485760                # rotate the audit log when it grows beyond this size (in bytes)
+# audit-log-forward: false                    # report every audit entry to errplane as an agent.audit event
+# history-file: /data/errplane-agent/shared/history.log # optional, local history summarized by errplane-agent report
+# history-retention: 168h                     # drop the history entries older than this
+
+# fips-mode: false                            # restrict tls to fips approved ciphers (always on when built with FIPS=on)
+# backend-tls:                                # optional, mutual tls with the config service and the backend
+#   ca: /etc/errplane-agent/tls/ca.pem        # trusted in addition to the system roots
+#   cert: /etc/errplane-agent/tls/agent.pem   # the client certificate and its key
+#   key: /etc/errplane-agent/tls/agent-key.pem
+#   min-version: "1.2"                        # 1.0, 1.1, 1.2 or 1.3, the older versions are disabled
+#   max-version: "1.3"
+# tracing:                                    # optional, export the spans of the plugin runs
+#   otlp-endpoint: http://localhost:4318/v1/traces # otlp/http with the json encoding, nothing is exported if empty
+#   service-name: errplane-agent
+#   flush-interval: 10s
+
+# plugin-selinux-context: system_u:system_r:errplane_plugin_t:s0 # optional, run plugins in this context when selinux is enforcing
+# plugin-apparmor-profile: errplane-agent//plugins               # optional, run plugins in this profile when apparmor is enabled
+# mac-denials-log: /var/log/audit/audit.log   # optional, report selinux/apparmor denials affecting the agent as events
+
+# plugin-sandboxes:                           # optional, run the given plugins in transient containers
+#   untrusted-plugin:
+#     image: python:2.7-slim                  # must have whatever the plugin needs to run
+#     runtime: docker                         # optional, docker (default) or podman
+#     mounts: [/var/log/app]                  # optional, mounted read-only, the plugin directory is always mounted
+#     network: none                           # optional, default is none
+#     memory: 128m                            # optional
+
+# ring-buffer: /dev/shm/errplane-agent.ring   # optional, shared memory ring buffer applications can write points to
+# ring-buffer-size: 65536                     # the number of points the ring can hold, must be a power of two
+# ring-buffer-group: metrics                  # the group of the applications writing to the ring, default is the group of the agent
+
+# graphite:                                   # optional, relay the graphite plaintext protocol
+#   listen: localhost:2003                    # accept "metric value timestamp" lines over tcp and udp
+#   prefix: graphite.                         # optional, prepended to the metric names
+
+# statsd:                                     # optional, aggregate the statsd protocol every flush-interval
+#   listen: localhost:8125                    # accept counters, gauges, timers and sets over udp
+#   prefix: statsd.                           # optional, prepended to the metric names
+
+# sampling:                                   # optional, sample event streams (ring buffer points, denials) beyond a given rate
+#   mode: head                                # head drops events as they come in, tail keeps a uniform sample per flush interval
+#   max-events-per-second: 1000               # per stream, kept events get a sampling_scale dimension
+
+# point-ttl:                                  # optional, drop buffered points older than this instead of delivering them late
+#   errplane: 10m                             # the number of dropped points is reported as agent.points.expired
+
+# timestamps:                                 # optional
+#   mode: origin                              # origin (default) sends the collection time, send stamps the points when they're sent
+#   late-after: 1m                            # points sent later than this get a delivery: late dimension, spooled ones delivery: spooled
+
+# status-page:                                # optional, publish the state of all checks as a static status page
+#   json: /var/www/status/host.json
+#   html: /var/www/status/host.html
+#   s3-bucket: my-status-pages                # optional, upload <hostname>.json and <hostname>.html to s3
+#   s3-region: us-east-1
+#   s3-prefix: hosts/
+#   s3-access-key: AKIA...
+#   s3-secret-key: ...
+
+# notifiers:                                  # optional, send local alerts (and their resolution) directly
+#   throttle: 30m                             # send the same alert at most once per throttle period
+#   pagerduty-routing-key: ...                # pagerduty events api v2 integration key
+#   slack-webhook: https://hooks.slack.com/services/...
+#   smtp-host: smtp.example.com:587
+#   smtp-username: ...
+#   smtp-password: ...
+#   email-from: agent@example.com
+#   email-to: [oncall@example.com]
+
+# alert-messages:                             # optional, human friendly messages for the alerts on a stat or plugin
+#   server.stats.disk.used: "disk {{device}} is {{value:1}}%% full"   # stats can use value, threshold, only_after and the point dimensions
+#   mysql: "mysql on {{host}} is {{status}}"  # plugins can use plugin, status, only_after and the point dimensions
+
+# watchdog:                                   # optional, alarms on the agent's own metrics, logged to syslog and sent to the notifiers
+#   send-failure-rate: 0.5                    # ratio of the writes to errplane that failed in a report
+#   spool-growth: 5                           # reports in a row the spool grew
+#   plugin-failure-spike: 3                   # times the average plugin failures
+#   min-plugin-failures: 5                    # ignore the spikes below this count
+#   syslog-tag: errplane-agent
+#   no-syslog: false                          # only send the alarms to the notifiers
+#   disabled: false
+
+# loadgen:                                    # optional, synthetic points to load test the backend, off unless metrics is set
+#   metrics: 50                               # loadgen.metric0 to loadgen.metric49
+#   dimensions: 4                             # d0 to d3 on every point
+#   series: 10                                # per metric
+#   rate: 100                                 # points per second
+#   duration: 30m                             # optional, runs until the agent stops by default
+#   prefix: loadgen
+
+# heartbeat:                                  # optional, agent.heartbeat with the version, uptime and config revisions
+#   interval: 1m
+#   url: https://nosnch.in/1a2b3c4d           # optional, also fetched every heartbeat, e.g. by a dead man's switch service
+#   disabled: false
+
+# config-bake:                                # optional, revert a new backend configuration when the plugin failures spike
+#   period: 15m
+#   failure-spike: 2                          # times the failure rate of the previous configuration
+#   min-failures: 5                           # ignore the spikes below this count
+
+# thresholds:                                 # optional, alerts evaluated by the agent on the plugin metrics
+#   - name: mysql-connections                 # defaults to the metric
+#     metric: plugins.mysql.connections       # shell glob on the metric name
+#     warning: "> 100"
+#     critical: "> 200"
+#     for: 2m                                 # how long a condition must match before the alert starts
+#     recovery: "< 80"                        # optional, the alert only ends once it matches
+
+# flapping:                                   # optional, report the instances whose status oscillates as flapping
+#   enabled: false
+#   window: 20                                # the runs considered
+#   high: 0.5                                 # starts flapping when the status changed in more than half of the runs
+#   low: 0.25                                 # stops flapping when it changed in less than a quarter of them
+
+# ephemeral:                                  # optional, for the short lived instances of autoscaling groups
+#   enabled: false                            # registers as ephemeral, deregisters on shutdown and scale in
+#   metadata-url: http://169.254.169.254/latest/meta-data/autoscaling/target-lifecycle-state
+#   token-url: http://169.254.169.254/latest/api/token   # none to send IMDSv1 requests only
+#   scale-in-states: [Terminated, Detached]
+#   poll-interval: 5s
+
+# maintenance:                                # optional, tag (or suppress) the plugin statuses during deploys
+#   - plugins: [mysql*]                       # shell globs, the whole host without plugins and instances
+#     instances: [replica*]
+#     mode: tag                               # tag adds maintenance=true, suppress doesn't report the status
+#     start: "03:30"                          # every day (local time) or once, e.g. 2027-01-10T02:00:00Z
+#     duration: 30m
+#     comment: nightly deploy
+
+# metric-filters:                             # optional, the metrics sent, shell globs or /regexes/
+#   include: []                               # matched against the names sent, e.g. plugins.mysql.threads_running
+#   exclude: [plugins.*.debug_*]
+#   plugins:                                  # matched against the names the plugin prints
+#     check_mysql_health:
+#       include: [threads_*]
 `
 
 	content := fmt.Sprintf(sample, *udpHost, *httpHost, *apiKey, *appKey, *env, *configHost)
@@ -0,0 +1,66 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fakebackend"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	. "utils"
+)
+
+// Serves the config service and the write api in memory, point the agent
+// config-service and http-host to it to run the agent without errplane
+// credentials. Enable http-batch.gzip so the agent posts the points itself
+// and keeps the http:// of http-host:
+//
+//	fake-backend -addr localhost:8090 -plugins src/fakebackend/sample-plugins -config agent.json
+func main() {
+	var (
+		addr       = flag.String("addr", "localhost:8090", "The address to listen on")
+		appKey     = flag.String("app-key", "app", "The app key the agents are configured with")
+		env        = flag.String("environment", "production", "The environment the agents are configured with")
+		apiKey     = flag.String("api-key", "key", "The api key the agents are configured with")
+		configFile = flag.String("config", "", "The plugins and processes of the agents, a json file like the config service returns")
+		plugins    = flag.String("plugins", "", "A directory with a directory per plugin the agents install")
+		version    = flag.String("plugins-version", "1", "The version of the plugins")
+		verbose    = flag.Bool("verbose", false, "Log the requests and the received points")
+	)
+	flag.Parse()
+
+	level := log.INFO
+	if *verbose {
+		level = log.DEBUG
+	}
+	log.AddFilter("stdout", level, log.NewConsoleLogWriter())
+
+	backend := fakebackend.New(*appKey+*env, *apiKey)
+	if *configFile != "" {
+		content, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read %s. Error: %s\n", *configFile, err)
+			os.Exit(1)
+		}
+		config := &AgentConfiguration{}
+		if err := json.Unmarshal(content, config); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse %s. Error: %s\n", *configFile, err)
+			os.Exit(1)
+		}
+		backend.SetConfiguration("", config)
+	}
+	if *plugins != "" {
+		if err := backend.AddPlugins(*version, *plugins); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	log.Info("Listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, backend); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot listen on %s. Error: %s\n", *addr, err)
+		os.Exit(1)
+	}
+}
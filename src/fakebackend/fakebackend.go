@@ -0,0 +1,358 @@
+// An in-memory implementation of the config service and of the write api,
+// so the agent can run end to end without errplane credentials. See
+// apps/fake-backend and the integration tests of the agent.
+package fakebackend
+
+import (
+	"archive/tar"
+	"bytes"
+	log "code.google.com/p/log4go"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// a point received on the write api
+type Point struct {
+	Name       string
+	Value      float64
+	Context    string
+	Time       int64
+	Dimensions errplane.Dimensions
+}
+
+type Backend struct {
+	lock           sync.Mutex
+	database       string
+	apiKey         string
+	configurations map[string]*AgentConfiguration // by host, "" is the configuration of the other hosts
+	monitoring     map[string]string
+	secrets        map[string]string
+	pluginsVersion string
+	pluginArchives map[string][]byte
+	points         []*Point
+	statuses       map[string]*AgentStatus
+	customPlugins  map[string]map[string]*PluginInformation
+	writeStatus    int
+}
+
+// the database is the app key followed by the environment, like
+// AgentConfig.Database()
+func New(database, apiKey string) *Backend {
+	return &Backend{
+		database:       database,
+		apiKey:         apiKey,
+		configurations: make(map[string]*AgentConfiguration),
+		monitoring:     make(map[string]string),
+		secrets:        make(map[string]string),
+		pluginArchives: make(map[string][]byte),
+		statuses:       make(map[string]*AgentStatus),
+		customPlugins:  make(map[string]map[string]*PluginInformation),
+		writeStatus:    http.StatusOK,
+	}
+}
+
+// sets the plugins and processes the agent of the host runs, "" for all the
+// hosts without a configuration of their own
+func (self *Backend) SetConfiguration(host string, config *AgentConfiguration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.configurations[host] = config
+}
+
+func (self *Backend) SetMonitoringConfiguration(host, config string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.monitoring[host] = config
+}
+
+func (self *Backend) SetSecret(name, value string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.secrets[name] = value
+}
+
+// makes the write api answer with the status code, e.g. 500 to simulate an
+// outage
+func (self *Backend) SetWriteStatus(status int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writeStatus = status
+}
+
+// archives the plugins of the directory (a directory per plugin) and makes
+// them the current version, the agents install them on their next check
+func (self *Backend) AddPlugins(version, dir string) error {
+	archive, err := archivePlugins(dir)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pluginArchives[version] = archive
+	self.pluginsVersion = version
+	return nil
+}
+
+// the points received so far, all of them if name is empty
+func (self *Backend) Points(name string) []*Point {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	points := make([]*Point, 0)
+	for _, point := range self.points {
+		if name == "" || point.Name == name {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// waits until count points of the metric are received, returns the points
+// received before the timeout otherwise
+func (self *Backend) WaitForPoints(name string, count int, timeout time.Duration) []*Point {
+	deadline := time.Now().Add(timeout)
+	for {
+		points := self.Points(name)
+		if len(points) >= count || time.Now().After(deadline) {
+			return points
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// the last status the agent of the host posted, nil if it didn't yet
+func (self *Backend) Status(host string) *AgentStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.statuses[host]
+}
+
+func (self *Backend) CustomPlugins(host string) map[string]*PluginInformation {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.customPlugins[host]
+}
+
+func (self *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debug("%s %s", r.Method, r.URL.Path)
+
+	// /databases/:database/...
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "databases" || parts[1] != self.database {
+		http.NotFound(w, r)
+		return
+	}
+	parts = parts[2:]
+
+	switch {
+	case len(parts) == 2 && parts[0] == "plugins" && parts[1] == "current_version" && r.Method == "GET":
+		self.getPluginsVersion(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "plugins" && r.Method == "GET":
+		self.getPlugins(w, r, parts[1])
+		return
+	}
+
+	if r.URL.Query().Get("api_key") != self.apiKey {
+		http.Error(w, "Invalid api key", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "points" && r.Method == "POST":
+		self.postPoints(w, r)
+	case len(parts) == 2 && parts[0] == "agent" && r.Method == "POST":
+		status := &AgentStatus{}
+		if self.readJson(w, r, status) {
+			self.lock.Lock()
+			self.statuses[parts[1]] = status
+			self.lock.Unlock()
+		}
+	case len(parts) == 3 && parts[0] == "agent" && parts[2] == "configuration" && r.Method == "GET":
+		self.getConfiguration(w, parts[1])
+	case len(parts) == 3 && parts[0] == "agent" && parts[2] == "monitoring-configuration" && r.Method == "GET":
+		self.lock.Lock()
+		config, ok := self.monitoring[parts[1]]
+		self.lock.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, config)
+	case len(parts) == 3 && parts[0] == "agent" && parts[2] == "custom-plugins" && r.Method == "POST":
+		plugins := make(map[string]*PluginInformation)
+		if self.readJson(w, r, &plugins) {
+			self.lock.Lock()
+			self.customPlugins[parts[1]] = plugins
+			self.lock.Unlock()
+		}
+	case len(parts) == 4 && parts[0] == "agent" && parts[2] == "secrets" && r.Method == "GET":
+		self.lock.Lock()
+		value, ok := self.secrets[parts[3]]
+		self.lock.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, value)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (self *Backend) getPluginsVersion(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	version := self.pluginsVersion
+	self.lock.Unlock()
+	if version == "" {
+		http.NotFound(w, r)
+		return
+	}
+	io.WriteString(w, version)
+}
+
+func (self *Backend) getPlugins(w http.ResponseWriter, r *http.Request, version string) {
+	self.lock.Lock()
+	archive, ok := self.pluginArchives[version]
+	self.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Write(archive)
+}
+
+func (self *Backend) getConfiguration(w http.ResponseWriter, host string) {
+	self.lock.Lock()
+	config, ok := self.configurations[host]
+	if !ok {
+		config = self.configurations[""]
+	}
+	self.lock.Unlock()
+	if config == nil {
+		config = &AgentConfiguration{Plugins: make(map[string][]*Instance), Processes: make([]*Process, 0)}
+	}
+	writeJson(w, config)
+}
+
+// accepts the writes of errplane-go and the gzipped batches of the agent,
+// either a list of writes or a write operation
+func (self *Backend) postPoints(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	status := self.writeStatus
+	self.lock.Unlock()
+	if status != http.StatusOK {
+		http.Error(w, "Simulated failure", status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writes := make([]*errplane.JsonPoints, 0)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		operation := &errplane.WriteOperation{}
+		err = json.Unmarshal(trimmed, operation)
+		writes = operation.Writes
+	} else {
+		err = json.Unmarshal(data, &writes)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot parse the points. Error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, write := range writes {
+		for _, point := range write.Points {
+			log.Debug("Received %s %f %v", write.Name, point.Value, point.Dimensions)
+			self.points = append(self.points, &Point{write.Name, point.Value, point.Context, point.Time, point.Dimensions})
+		}
+	}
+}
+
+func (self *Backend) readJson(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// the plugins of the directory as a tar.gz like the config service serves
+// them, InstallPlugin extracts it in the version directory
+func archivePlugins(dir string) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	compressed := gzip.NewWriter(buffer)
+	archive := tar.NewWriter(compressed)
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		_, err = archive.Write(content)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot archive the plugins of %s. Error: %s", dir, err)
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
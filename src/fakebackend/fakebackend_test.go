@@ -0,0 +1,130 @@
+package fakebackend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	. "utils"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type FakeBackendSuite struct {
+	backend *Backend
+	server  *httptest.Server
+}
+
+var _ = Suite(&FakeBackendSuite{})
+
+func (self *FakeBackendSuite) SetUpTest(c *C) {
+	self.backend = New("appproduction", "key")
+	self.server = httptest.NewServer(self.backend)
+}
+
+func (self *FakeBackendSuite) TearDownTest(c *C) {
+	self.server.Close()
+}
+
+func (self *FakeBackendSuite) get(c *C, url string) (int, string) {
+	resp, err := http.Get(self.server.URL + url)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(body)
+}
+
+func (self *FakeBackendSuite) post(c *C, url, encoding, body string) int {
+	var data []byte
+	if encoding == "gzip" {
+		buffer := bytes.NewBuffer(nil)
+		writer := gzip.NewWriter(buffer)
+		writer.Write([]byte(body))
+		writer.Close()
+		data = buffer.Bytes()
+	} else {
+		data = []byte(body)
+	}
+	req, err := http.NewRequest("POST", self.server.URL+url, bytes.NewBuffer(data))
+	c.Assert(err, IsNil)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (self *FakeBackendSuite) TestConfiguration(c *C) {
+	status, body := self.get(c, "/databases/appproduction/agent/web1/configuration?api_key=key")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(strings.TrimSpace(body), Equals, `{"plugins":{},"processes":[]}`)
+
+	self.backend.SetConfiguration("", &AgentConfiguration{Plugins: map[string][]*Instance{"redis": []*Instance{&Instance{Name: "default"}}}})
+	self.backend.SetConfiguration("db1", &AgentConfiguration{Plugins: map[string][]*Instance{"mysql": []*Instance{&Instance{Name: "default"}}}})
+	_, body = self.get(c, "/databases/appproduction/agent/web1/configuration?api_key=key")
+	c.Assert(body, Matches, `(?s).*"redis".*`)
+	_, body = self.get(c, "/databases/appproduction/agent/db1/configuration?api_key=key")
+	c.Assert(body, Matches, `(?s).*"mysql".*`)
+
+	status, _ = self.get(c, "/databases/appproduction/agent/web1/configuration?api_key=other")
+	c.Assert(status, Equals, http.StatusUnauthorized)
+	status, _ = self.get(c, "/databases/other/agent/web1/configuration?api_key=key")
+	c.Assert(status, Equals, http.StatusNotFound)
+
+	self.backend.SetSecret("mysql.password", "s3cr3t")
+	_, body = self.get(c, "/databases/appproduction/agent/db1/secrets/mysql.password?api_key=key")
+	c.Assert(body, Equals, "s3cr3t")
+	status, _ = self.get(c, "/databases/appproduction/agent/db1/secrets/missing?api_key=key")
+	c.Assert(status, Equals, http.StatusNotFound)
+
+	c.Assert(self.post(c, "/databases/appproduction/agent/db1?api_key=key", "", `{"plugins": ["mysql"], "timestamp": 1}`), Equals, http.StatusOK)
+	c.Assert(self.backend.Status("db1").Plugins, DeepEquals, []string{"mysql"})
+	c.Assert(self.backend.Status("web1"), IsNil)
+}
+
+func (self *FakeBackendSuite) TestPoints(c *C) {
+	c.Assert(self.post(c, "/databases/appproduction/points?api_key=key", "", `[{"n": "cpu", "p": [{"v": 1.5, "t": 10, "d": {"host": "web1"}}]}]`), Equals, http.StatusOK)
+	c.Assert(self.post(c, "/databases/appproduction/points?api_key=key", "gzip", `{"w": [{"n": "cpu", "p": [{"v": 2}]}, {"n": "mem", "p": [{"v": 3}]}]}`), Equals, http.StatusOK)
+	c.Assert(self.post(c, "/databases/appproduction/points?api_key=key", "", `cpu 1`), Equals, http.StatusBadRequest)
+
+	points := self.backend.Points("cpu")
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].Value, Equals, 1.5)
+	c.Assert(points[0].Dimensions["host"], Equals, "web1")
+	c.Assert(self.backend.Points(""), HasLen, 3)
+
+	self.backend.SetWriteStatus(http.StatusInternalServerError)
+	c.Assert(self.post(c, "/databases/appproduction/points?api_key=key", "", `[]`), Equals, http.StatusInternalServerError)
+}
+
+func (self *FakeBackendSuite) TestPlugins(c *C) {
+	status, _ := self.get(c, "/databases/appproduction/plugins/current_version")
+	c.Assert(status, Equals, http.StatusNotFound)
+
+	c.Assert(self.backend.AddPlugins("2", "sample-plugins"), IsNil)
+	_, version := self.get(c, "/databases/appproduction/plugins/current_version")
+	c.Assert(version, Equals, "2")
+	_, archive := self.get(c, "/databases/appproduction/plugins/2")
+
+	// extracted like InstallPlugin does
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(dir, "2.tar.gz"), []byte(archive), 0644), IsNil)
+	cmd := exec.Command("tar", "-xzf", "2.tar.gz")
+	cmd.Dir = dir
+	c.Assert(cmd.Run(), IsNil)
+	out, err := exec.Command(path.Join(dir, "hello", "status"), "--greeting", "hi").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "OK: hi | greetings=1\n")
+}
@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package ringbuffer
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// maps the file with a file mapping, the other processes mapping the same
+// file share the memory like with MAP_SHARED
+func mmap(file *os.File, size int) ([]byte, error) {
+	mapping, err := syscall.CreateFileMapping(syscall.Handle(file.Fd()), nil, syscall.PAGE_READWRITE, uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// the view keeps the mapping alive
+	defer syscall.CloseHandle(mapping)
+	address, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_READ|syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(address)), size), nil
+}
+
+func munmap(data []byte) error {
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0])))
+}
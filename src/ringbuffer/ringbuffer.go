@@ -0,0 +1,206 @@
+// Package ringbuffer implements a bounded multi producer, single consumer
+// queue of metric points in a memory mapped file, usually in /dev/shm.
+// Applications open the ring and write points without any syscall, the
+// agent is the only consumer and drains the ring periodically.
+//
+// The queue is based on Dmitry Vyukov's bounded mpmc queue, every slot has
+// a sequence number that tells producers and the consumer whether the slot
+// is free or holds a point.
+package ringbuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	MAGIC        = 0x6572726272696e67 // "errbring"
+	HEADER_SIZE  = 192                // magic and capacity, enqueue and dequeue positions on separate cache lines
+	SLOT_SIZE    = 128
+	MAX_NAME_LEN = SLOT_SIZE - 26
+
+	magicOffset    = 0
+	capacityOffset = 8
+	enqueueOffset  = 64
+	dequeueOffset  = 128
+
+	// slot layout
+	seqOffset   = 0
+	timeOffset  = 8
+	valueOffset = 16
+	lenOffset   = 24
+	nameOffset  = 26
+)
+
+type FullError struct{}
+
+func (self *FullError) Error() string {
+	return "Ring buffer is full"
+}
+
+type Point struct {
+	Name      string
+	Value     float64
+	Timestamp time.Time
+}
+
+type RingBuffer struct {
+	data     []byte
+	capacity uint64
+	mask     uint64
+}
+
+func size(capacity uint64) int {
+	return HEADER_SIZE + int(capacity)*SLOT_SIZE
+}
+
+// Creates (or truncates) the ring buffer file with the given capacity,
+// which must be a power of two. This should only be called by the agent.
+// Only the owner and the group of the file can write points to it.
+func Create(path string, capacity uint64) (*RingBuffer, error) {
+	if capacity == 0 || capacity&(capacity-1) != 0 {
+		return nil, fmt.Errorf("Ring buffer capacity must be a power of two, got %d", capacity)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// neither the umask nor the mode of an existing file apply
+	if err := file.Chmod(0660); err != nil {
+		return nil, err
+	}
+
+	if err := file.Truncate(int64(size(capacity))); err != nil {
+		return nil, err
+	}
+
+	data, err := mmap(file, size(capacity))
+	if err != nil {
+		return nil, err
+	}
+
+	self := &RingBuffer{data, capacity, capacity - 1}
+	for i := uint64(0); i < capacity; i++ {
+		atomic.StoreUint64(self.slotUint64(i, seqOffset), i)
+	}
+	binary.LittleEndian.PutUint64(data[capacityOffset:], capacity)
+	atomic.StoreUint64(self.uint64At(magicOffset), MAGIC)
+	return self, nil
+}
+
+// Opens an existing ring buffer created by the agent.
+func Open(path string) (*RingBuffer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < HEADER_SIZE {
+		return nil, fmt.Errorf("%s isn't a ring buffer", path)
+	}
+
+	data, err := mmap(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	self := &RingBuffer{data: data}
+	if atomic.LoadUint64(self.uint64At(magicOffset)) != MAGIC {
+		munmap(data)
+		return nil, fmt.Errorf("%s isn't a ring buffer", path)
+	}
+	self.capacity = binary.LittleEndian.Uint64(data[capacityOffset:])
+	self.mask = self.capacity - 1
+	if size(self.capacity) != len(data) {
+		munmap(data)
+		return nil, fmt.Errorf("%s has an invalid capacity %d", path, self.capacity)
+	}
+	return self, nil
+}
+
+func (self *RingBuffer) Close() error {
+	return munmap(self.data)
+}
+
+func (self *RingBuffer) uint64At(offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&self.data[offset]))
+}
+
+func (self *RingBuffer) slot(position uint64) []byte {
+	offset := HEADER_SIZE + int(position&self.mask)*SLOT_SIZE
+	return self.data[offset : offset+SLOT_SIZE]
+}
+
+func (self *RingBuffer) slotUint64(position uint64, offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&self.slot(position)[offset]))
+}
+
+// Writes a point to the ring, it's safe to call Write from multiple
+// threads and processes. Returns a *FullError if the agent didn't keep up,
+// in which case the point is dropped.
+func (self *RingBuffer) Write(name string, value float64, timestamp time.Time) error {
+	if len(name) > MAX_NAME_LEN {
+		return fmt.Errorf("Metric name %s is longer than %d bytes", name, MAX_NAME_LEN)
+	}
+
+	enqueue := self.uint64At(enqueueOffset)
+	position := atomic.LoadUint64(enqueue)
+	for {
+		seq := atomic.LoadUint64(self.slotUint64(position, seqOffset))
+		diff := int64(seq) - int64(position)
+		if diff == 0 {
+			if atomic.CompareAndSwapUint64(enqueue, position, position+1) {
+				break
+			}
+		} else if diff < 0 {
+			return &FullError{}
+		}
+		position = atomic.LoadUint64(enqueue)
+	}
+
+	slot := self.slot(position)
+	binary.LittleEndian.PutUint64(slot[timeOffset:], uint64(timestamp.UnixNano()))
+	binary.LittleEndian.PutUint64(slot[valueOffset:], math.Float64bits(value))
+	binary.LittleEndian.PutUint16(slot[lenOffset:], uint16(len(name)))
+	copy(slot[nameOffset:], name)
+	atomic.StoreUint64(self.slotUint64(position, seqOffset), position+1)
+	return nil
+}
+
+// Reads the next point from the ring, returns nil if the ring is empty.
+// Only one consumer (the agent) should call Read.
+func (self *RingBuffer) Read() *Point {
+	dequeue := self.uint64At(dequeueOffset)
+	position := atomic.LoadUint64(dequeue)
+	seqPtr := self.slotUint64(position, seqOffset)
+	if atomic.LoadUint64(seqPtr) != position+1 {
+		return nil
+	}
+
+	slot := self.slot(position)
+	length := int(binary.LittleEndian.Uint16(slot[lenOffset:]))
+	if length > MAX_NAME_LEN {
+		length = MAX_NAME_LEN
+	}
+	point := &Point{
+		Name:      string(slot[nameOffset : nameOffset+length]),
+		Value:     math.Float64frombits(binary.LittleEndian.Uint64(slot[valueOffset:])),
+		Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(slot[timeOffset:]))),
+	}
+
+	atomic.StoreUint64(seqPtr, position+self.capacity)
+	atomic.StoreUint64(dequeue, position+1)
+	return point
+}
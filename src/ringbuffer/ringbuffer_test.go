@@ -0,0 +1,111 @@
+package ringbuffer
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type RingBufferSuite struct {
+	path string
+}
+
+var _ = Suite(&RingBufferSuite{})
+
+func (self *RingBufferSuite) SetUpTest(c *C) {
+	self.path = path.Join(c.MkDir(), "ring")
+}
+
+func (self *RingBufferSuite) TestInvalidCapacity(c *C) {
+	_, err := Create(self.path, 3)
+	c.Assert(err, NotNil)
+}
+
+func (self *RingBufferSuite) TestPermissions(c *C) {
+	c.Assert(ioutil.WriteFile(self.path, nil, 0666), IsNil)
+	c.Assert(os.Chmod(self.path, 0666), IsNil)
+	ring, err := Create(self.path, 4)
+	c.Assert(err, IsNil)
+	defer ring.Close()
+	info, err := os.Stat(self.path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0660))
+}
+
+func (self *RingBufferSuite) TestWriteAndRead(c *C) {
+	consumer, err := Create(self.path, 4)
+	c.Assert(err, IsNil)
+	defer consumer.Close()
+	producer, err := Open(self.path)
+	c.Assert(err, IsNil)
+	defer producer.Close()
+
+	c.Assert(consumer.Read(), IsNil)
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		c.Assert(producer.Write("app.requests", float64(i), now), IsNil)
+	}
+	_, full := producer.Write("app.requests", 5, now).(*FullError)
+	c.Assert(full, Equals, true)
+
+	for i := 0; i < 4; i++ {
+		point := consumer.Read()
+		c.Assert(point, NotNil)
+		c.Assert(point.Name, Equals, "app.requests")
+		c.Assert(point.Value, Equals, float64(i))
+		c.Assert(point.Timestamp.UnixNano(), Equals, now.UnixNano())
+	}
+	c.Assert(consumer.Read(), IsNil)
+
+	// the ring wraps around
+	c.Assert(producer.Write("app.errors", 1, now), IsNil)
+	c.Assert(consumer.Read().Name, Equals, "app.errors")
+}
+
+func (self *RingBufferSuite) TestConcurrentProducers(c *C) {
+	consumer, err := Create(self.path, 1024)
+	c.Assert(err, IsNil)
+	defer consumer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			producer, err := Open(self.path)
+			if err != nil {
+				return
+			}
+			defer producer.Close()
+			for j := 0; j < 200; j++ {
+				producer.Write("app.requests", 1, time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	for point := consumer.Read(); point != nil; point = consumer.Read() {
+		count++
+	}
+	c.Assert(count, Equals, 800)
+}
+
+func (self *RingBufferSuite) TestOpenInvalidFile(c *C) {
+	file, err := os.Create(self.path)
+	c.Assert(err, IsNil)
+	file.Write(make([]byte, HEADER_SIZE))
+	file.Close()
+	_, err = Open(self.path)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"time"
+)
+
+// bumped when the Collector interface changes, a .so built against another
+// version isn't loaded
+const COLLECTOR_API_VERSION = 1
+
+// A collector compiled as a go plugin (`go build -buildmode=plugin`) and
+// loaded from the collectors-dir. The .so must export `Collector`, a value
+// implementing this interface, and `CollectorApiVersion`, an int set to
+// COLLECTOR_API_VERSION
+type Collector interface {
+	// called once after the .so is loaded with the config of the collector
+	Init(config map[string]string) error
+	// called every sleep, the names are prefixed with the collector name
+	Collect(now time.Time) ([]*CollectedPoint, error)
+}
+
+type CollectedPoint struct {
+	Name       string
+	Value      float64
+	Context    string
+	Dimensions map[string]string
+}
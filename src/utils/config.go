@@ -1,10 +1,17 @@
 package utils
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"launchpad.net/goyaml"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,59 +33,1623 @@ type Config struct {
 	LogLevel          string `yaml:"log-level"`
 	ConfigService     string `yaml:"config-service"`
 	TopNProcesses     int    `yaml:"top-n-processes"`
+	PluginsDir        string `yaml:"plugins-dir"`        // where the plugins of the config service are installed
+	CustomPluginsDir  string `yaml:"custom-plugins-dir"` // the plugins written for this host
+	PluginRunAs       string `yaml:"run_as"`             // user or user:group the plugins run as, default is the agent user
+
+	// plugins and processes declared in a yaml file, in the format of the
+	// config service, run until it answers and merged with its
+	// configuration afterwards. The mode is remote (default), local or
+	// fallback
+	LocalPlugins     string `yaml:"local-plugins"`
+	LocalPluginsMode string `yaml:"local-plugins-mode"`
+
+	// the last configuration received from the config service, run at boot
+	// until it answers so the plugins keep running during its outages
+	ConfigCache   string `yaml:"config-cache"`
+	NoConfigCache bool   `yaml:"no-config-cache"`
+
+	// the default cpu and memory limits of the plugins, and the cgroup (v2)
+	// the limited plugins run in, default is /sys/fs/cgroup/errplane-plugins
+	PluginLimits PluginLimits `yaml:"plugin-limits"`
+	PluginCgroup string       `yaml:"plugin-cgroup"`
+
+	// configuration files merged in order on top of this one, e.g.
+	// /etc/errplane-agent/layers/{os}.yml, {role}.yml and {host}.yml. The
+	// role is also sent to the backend which can layer the plugins by role.
+	Role         string         `yaml:"role"`
+	ConfigLayers []string       `yaml:"config-layers"`
+	Layers       []*ConfigLayer `yaml:"-"` // the configuration file first
+
+	// added to every point the agent reports, e.g. datacenter or role
+	Dimensions map[string]string `yaml:"dimensions"`
+
+	// removes or hashes the dimensions carrying personal data before they
+	// leave the host
+	Scrubbing ScrubbingConfig `yaml:"scrubbing"`
+
+	// where the {{secret "name"}} templates of the plugin arguments are
+	// looked up, the passwords don't have to be stored in plaintext
+	Secrets SecretsConfig `yaml:"secrets"`
 
 	// aggregator configuration
 	Percentiles      []float64     `yaml:"percentiles,flow"`
 	RawFlushInterval string        `yaml:"flush-interval"`
 	FlushInterval    time.Duration `yaml:"-"`
 	UdpAddr          string        `yaml:"udp-addr"`
+
+	// http checks configuration
+	HttpChecks []*HttpCheck `yaml:"http-checks"`
+
+	// dns checks configuration
+	DnsChecks []*DnsCheck `yaml:"dns-checks"`
+
+	// exit code only checks configuration
+	CommandChecks []*CommandCheck `yaml:"command-checks"`
+
+	// processes watched locally, matched by name, command line or pidfile
+	Processes []*ProcessWatch `yaml:"processes"`
+
+	// the dimensions required on the metrics matching a pattern and their types
+	DimensionSchemas []*DimensionSchema `yaml:"dimension-schemas"`
+
+	// windows performance counters, e.g. \Processor(_Total)\% Processor Time
+	PerfCounters []*PerfCounter `yaml:"perf-counters"`
+
+	// log files tailed locally, the lines matching the patterns are counted
+	LogTails []*LogTail `yaml:"log-tails"`
+
+	// go plugins (<name>-<version>.so) loaded as collectors, with their config
+	CollectorsDir    string                       `yaml:"collectors-dir"`
+	CollectorsConfig map[string]map[string]string `yaml:"collectors"`
+
+	// remote windows hosts queried over winrm
+	WindowsTargets []*WindowsTarget `yaml:"windows-targets"`
+
+	// modbus tcp devices to read registers from
+	ModbusDevices []*ModbusDevice `yaml:"modbus-devices"`
+
+	// built-in host.* cpu, memory, disk and network collectors
+	HostStats HostStatsConfig `yaml:"host-stats"`
+
+	// which address is the host ip on multi-homed hosts and whether it's
+	// added to the dimensions of every metric
+	HostIp HostIpConfig `yaml:"host-ip"`
+
+	// mqtt topics to subscribe to
+	Mqtt MqttConfig `yaml:"mqtt"`
+
+	// 1-wire, i2c and gpio sensors of edge devices
+	Sensors []*Sensor `yaml:"sensors"`
+
+	// queue the points on disk while the backend is unreachable
+	Spool SpoolConfig `yaml:"spool"`
+
+	// coalesce the points sent over http into fewer, compressed requests
+	HttpBatch HttpBatchConfig `yaml:"http-batch"`
+
+	// keep the run history, the rate state and the dashboard metrics across
+	// restarts in an embedded database
+	LocalStore LocalStoreConfig `yaml:"local-store"`
+
+	// ac, battery and ups monitoring
+	Power PowerConfig `yaml:"power"`
+
+	// add the node, namespace and pod dimensions and run the plugin instances
+	// of the pod annotations when the agent runs in kubernetes
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+
+	// per container cpu, memory, network and blkio stats from the docker daemon
+	Docker DockerConfig `yaml:"docker"`
+
+	// publish the parsed plugin results on this unix socket as json lines
+	PluginResultsSocket string `yaml:"plugin-results-socket"`
+
+	// host specific values plugin arguments can refer to, e.g. {{fact "mysql.socket"}}
+	Facts map[string]string `yaml:"facts"`
+
+	PluginConcurrency PluginConcurrencyConfig `yaml:"plugin-concurrency"`
+
+	// the plugins (globs) reporting plugins.<name>.missed when a due run is
+	// skipped, a plugin can also set missed-markers in its info.yml
+	MissedMarkers []string `yaml:"missed-markers,flow"`
+
+	// whether the plugin outputs must follow the spec of their type, lenient
+	// (default) or strict
+	OutputValidation string `yaml:"output-validation"`
+
+	// don't add the instance_id dimension to the plugin metrics, keeps the
+	// series reported by older agents. Deprecated, will be removed.
+	LegacyInstanceDimensions bool `yaml:"legacy-instance-dimensions"`
+
+	// also send the renamed series under their previous names during a
+	// transition window, so the dashboards survive agent upgrades
+	SeriesCompat SeriesCompatConfig `yaml:"series-compat"`
+
+	// local api configuration
+	ApiTokens   []*ApiToken `yaml:"api-tokens"`
+	ApiTlsCert  string      `yaml:"api-tls-cert"`
+	ApiTlsKey   string      `yaml:"api-tls-key"`
+	ApiClientCa string      `yaml:"api-client-ca"` // require client certificates signed by this ca
+	ApiSocket   string      `yaml:"api-socket"`    // serve the local api on this unix socket as well
+
+	// send the metrics and the config requests through a socks5 proxy on an
+	// ssh jump host, proxy is an http(s) or socks5 proxy url otherwise
+	SshTunnel SshTunnelConfig `yaml:"ssh-tunnel"`
+
+	// let the backend pull the points instead of sending them
+	Scrape ScrapeConfig `yaml:"scrape"`
+
+	// let the local api simulate plugin timeouts, parse errors, backend
+	// errors and clock skew, for integration tests and staging only
+	ChaosMode bool `yaml:"chaos-mode"`
+
+	// audit log configuration
+	AuditLog        string `yaml:"audit-log"`
+	AuditLogMaxSize int64  `yaml:"audit-log-max-size"` // in bytes, the log is rotated when it grows beyond this size
+	AuditLogForward bool   `yaml:"audit-log-forward"`  // report audit entries to errplane as agent.audit events
+
+	// local history of the check states, the top processes and the notable
+	// events, summarized by `errplane-agent report`
+	HistoryFile         string        `yaml:"history-file"`
+	RawHistoryRetention string        `yaml:"history-retention"` // 168h by default
+	HistoryRetention    time.Duration `yaml:"-"`
+
+	// restrict tls to fips approved algorithms
+	FipsMode bool `yaml:"fips-mode"`
+
+	// mutual tls with the config service and the backend
+	BackendTls BackendTlsConfig `yaml:"backend-tls"`
+
+	// export the spans of the scheduling cycles and the plugin runs
+	Tracing TracingConfig
+
+	// selinux and apparmor configuration
+	PluginSelinuxContext  string `yaml:"plugin-selinux-context"`  // run plugins using runcon in this context
+	PluginApparmorProfile string `yaml:"plugin-apparmor-profile"` // run plugins using aa-exec in this profile
+	MacDenialsLog         string `yaml:"mac-denials-log"`         // report denials affecting the agent from this log
+
+	// run the given plugins in transient containers
+	PluginSandboxes map[string]*PluginSandbox `yaml:"plugin-sandboxes"`
+
+	// shared memory ingestion configuration
+	RingBuffer      string `yaml:"ring-buffer"`       // e.g. /dev/shm/errplane-agent.ring
+	RingBufferSize  uint64 `yaml:"ring-buffer-size"`  // number of points the ring can hold, must be a power of two
+	RingBufferGroup string `yaml:"ring-buffer-group"` // the group of the applications writing to the ring, default is the group of the agent
+
+	// relay the graphite plaintext protocol
+	Graphite GraphiteConfig `yaml:"graphite"`
+
+	// aggregate the statsd protocol
+	Statsd StatsdConfig `yaml:"statsd"`
+
+	// sampling of high volume event streams
+	Sampling SamplingConfig `yaml:"sampling"`
+
+	// synthetic points sent through the pipeline to load test the backend
+	Loadgen LoadgenConfig `yaml:"loadgen"`
+
+	// the maximum age of buffered points per sink, older points are dropped
+	RawPointTtls map[string]string        `yaml:"point-ttl"`
+	PointTtls    map[string]time.Duration `yaml:"-"`
+
+	// the timestamp the points are sent with and how late ones are marked
+	Timestamps TimestampsConfig `yaml:"timestamps"`
+
+	// publish the state of the checks as a static status page
+	StatusPage StatusPageConfig `yaml:"status-page"`
+
+	// send local alerts to pagerduty, slack or email
+	Notifiers NotifiersConfig `yaml:"notifiers"`
+
+	// message templates for the alerts on the given stat or plugin names
+	AlertMessages map[string]string `yaml:"alert-messages"`
+
+	// alarms on the agent's own metrics so it doesn't fail silently
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// sent at a fixed interval so the backend can alert when an agent stops
+	// reporting
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+
+	// revert a new backend configuration when the plugin failures spike
+	// after it's applied
+	ConfigBake ConfigBakeConfig `yaml:"config-bake"`
+
+	// alert states evaluated by the agent on the plugin metrics, so alerting
+	// works when the backend only receives the raw points
+	Thresholds []*Threshold `yaml:"thresholds"`
+
+	// report the plugin instances whose status oscillates as flapping
+	Flapping FlappingConfig `yaml:"flapping"`
+
+	// short lived instances of autoscaling groups
+	Ephemeral EphemeralConfig `yaml:"ephemeral"`
+
+	// scheduled maintenance windows, more can be opened with the local api
+	Maintenance []*MaintenanceWindow `yaml:"maintenance"`
+
+	// the metrics sent, to trim the noisy plugins to the series that matter
+	MetricFilters MetricFiltersConfig `yaml:"metric-filters"`
+}
+
+// Rules evaluated on the agent metrics every sleep, an alarm is logged to
+// the local syslog and sent to the configured notifiers
+type WatchdogConfig struct {
+	Disabled           bool    `yaml:"disabled"`
+	SendFailureRate    float64 `yaml:"send-failure-rate"`    // ratio of failed writes, default 0.5
+	SpoolGrowth        int     `yaml:"spool-growth"`         // consecutive reports the spool grew, default 5
+	PluginFailureSpike float64 `yaml:"plugin-failure-spike"` // times the average plugin failures, default 3
+	MinPluginFailures  int64   `yaml:"min-plugin-failures"`  // ignore spikes below this count, default 5
+	NoSyslog           bool    `yaml:"no-syslog"`            // only send the alarms to the notifiers
+	SyslogTag          string  `yaml:"syslog-tag"`
+}
+
+type HeartbeatConfig struct {
+	Disabled    bool          `yaml:"disabled"`
+	RawInterval string        `yaml:"interval"` // default 1m
+	Interval    time.Duration `yaml:"-"`
+	Url         string        `yaml:"url"` // also get this url every heartbeat, e.g. a dead man's switch service
+}
+
+type ConfigBakeConfig struct {
+	RawPeriod    string        `yaml:"period"` // empty to apply the configurations without baking them
+	Period       time.Duration `yaml:"-"`
+	FailureSpike float64       `yaml:"failure-spike"` // times the failure rate of the previous configuration, default 2
+	MinFailures  int64         `yaml:"min-failures"`  // ignore spikes below this count, default 5
+}
+
+type NotifiersConfig struct {
+	RawThrottle         string        `yaml:"throttle"`
+	Throttle            time.Duration `yaml:"-"`
+	PagerDutyRoutingKey string        `yaml:"pagerduty-routing-key"`
+	SlackWebhook        string        `yaml:"slack-webhook"`
+	SmtpHost            string        `yaml:"smtp-host"` // host:port
+	SmtpUsername        string        `yaml:"smtp-username"`
+	SmtpPassword        string        `yaml:"smtp-password"`
+	EmailFrom           string        `yaml:"email-from"`
+	EmailTo             []string      `yaml:"email-to,flow"`
+}
+
+type StatusPageConfig struct {
+	Json     string
+	Html     string
+	S3Config `yaml:",inline"`
+}
+
+type GraphiteConfig struct {
+	Listen string // host:port to accept "metric value timestamp" lines on, over tcp and udp, e.g. localhost:2003
+	Prefix string // optional, prepended to the metric names, e.g. graphite.
+}
+
+type StatsdConfig struct {
+	Listen string // host:port to accept statsd packets on over udp, e.g. localhost:8125
+	Prefix string // optional, prepended to the metric names, e.g. statsd.
+}
+
+// Metrics with Series series each, every series has the same Dimensions
+// dimensions d0, d1... with the value v<series>. Nothing is generated unless
+// metrics is positive.
+type LoadgenConfig struct {
+	Metrics     int           `yaml:"metrics"`
+	Dimensions  int           `yaml:"dimensions"`
+	Series      int           `yaml:"series"` // per metric, default 10
+	Rate        int           `yaml:"rate"`   // points per second, default 100
+	RawDuration string        `yaml:"duration"`
+	Duration    time.Duration `yaml:"-"`      // zero to run until the agent stops
+	Prefix      string        `yaml:"prefix"` // default loadgen
+}
+
+type ScrubbingConfig struct {
+	Allow       []string                  `yaml:"allow,flow"` // only the dimensions matching these globs leave the host, all of them if empty
+	Drop        []string                  `yaml:"drop,flow"`  // the dimensions matching these globs are removed
+	Hash        []string                  `yaml:"hash,flow"`  // the values of the dimensions matching these globs are replaced by a salted hash
+	Salt        string                    // keep it secret, the hashes of guessable values can't be reversed without it
+	RawPatterns map[string]string         `yaml:"patterns"` // name: regex, the matches in the remaining values are replaced by [name]
+	Patterns    map[string]*regexp.Regexp `yaml:"-"`
+}
+
+type SecretsConfig struct {
+	File          string // the encrypted secrets, managed with `errplane-agent secrets`
+	KeyFile       string `yaml:"key-file"`       // the aes-256 key the file is encrypted with, 64 hex digits
+	ConfigService bool   `yaml:"config-service"` // look up the secrets missing from the file on the config service
+}
+
+type BackendTlsConfig struct {
+	Ca            string           // pem bundle trusted in addition to the system roots
+	Cert          string           // pem client certificate presented to the backend
+	Key           string           // pem private key of the client certificate
+	RawMinVersion string           `yaml:"min-version"` // e.g. 1.2, the older versions are disabled
+	RawMaxVersion string           `yaml:"max-version"`
+	MinVersion    uint16           `yaml:"-"`
+	MaxVersion    uint16           `yaml:"-"`
+	RootCAs       *x509.CertPool   `yaml:"-" json:"-"`
+	Certificate   *tls.Certificate `yaml:"-" json:"-"` // never shown by the local api, it has the private key
+}
+
+type SshTunnelConfig struct {
+	Host       string // the jump host, no tunnel if empty
+	User       string
+	Port       int
+	Key        string // path of the private key
+	KnownHosts string `yaml:"known-hosts"` // the host key of the jump host must be in this file, default is the ssh known hosts
+	LocalPort  int    `yaml:"local-port"`  // the port of the socks5 proxy on localhost, default is 1081
+}
+
+type ScrapeConfig struct {
+	Listen    string // e.g. :9273, the points are sent to the backend if empty
+	MaxPoints int    `yaml:"max-points"` // the most points kept until they're pulled, the oldest are dropped, default is 100000
+}
+
+const (
+	TIMESTAMPS_ORIGIN = "origin"
+	TIMESTAMPS_SEND   = "send"
+)
+
+type TimestampsConfig struct {
+	Mode         string        // origin (default) keeps the time the point was collected, send stamps it when it's sent
+	RawLateAfter string        `yaml:"late-after"`
+	LateAfter    time.Duration `yaml:"-"` // points sent later than this after their collection are marked late, default is 1m
+}
+
+type TracingConfig struct {
+	OtlpEndpoint     string        `yaml:"otlp-endpoint"` // e.g. http://collector:4318/v1/traces, spans aren't exported if empty
+	ServiceName      string        `yaml:"service-name"`  // default is errplane-agent
+	RawFlushInterval string        `yaml:"flush-interval"`
+	FlushInterval    time.Duration `yaml:"-"` // default is 10s
+}
+
+// An instance starts flapping when its status changed in more than high of
+// its last window runs and stops when it changed in less than low of them
+type FlappingConfig struct {
+	Enabled bool    `yaml:"enabled"`
+	Window  int     `yaml:"window"` // default 20 runs
+	High    float64 `yaml:"high"`   // default 0.5
+	Low     float64 `yaml:"low"`    // default 0.25
+}
+
+// An ephemeral host registers as such, sends its heartbeat more often and
+// deregisters when it's stopped or scaled in, so it doesn't alert as down.
+// The lifecycle state of the instance is polled from the metadata url,
+// the aws autoscaling target-lifecycle-state by default.
+type EphemeralConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	MetadataUrl     string        `yaml:"metadata-url"`
+	TokenUrl        string        `yaml:"token-url"`            // where to get an IMDSv2 session token, none to use IMDSv1
+	ScaleInStates   []string      `yaml:"scale-in-states,flow"` // default Terminated and Detached
+	RawPollInterval string        `yaml:"poll-interval"`        // default 5s
+	PollInterval    time.Duration `yaml:"-"`
+}
+
+// The series are sent under both names until the day before until. A
+// trailing * matches the rest of the name, e.g. host.cpu.*: server.stats.cpu.*
+// A threshold on the plugin metrics matching Metric, a shell glob on the
+// full name, e.g. plugins.mysql.connections. The conditions are an operator
+// and a number, e.g. "> 100".
+type Threshold struct {
+	Name        string              `yaml:"name"` // default the metric
+	Metric      string              `yaml:"metric"`
+	RawWarning  string              `yaml:"warning"`
+	RawCritical string              `yaml:"critical"`
+	RawRecovery string              `yaml:"recovery"` // the alert ends only when it matches, default when neither warning nor critical does
+	RawFor      string              `yaml:"for"`      // how long warning or critical must match before the alert starts
+	Warning     *ThresholdCondition `yaml:"-"`
+	Critical    *ThresholdCondition `yaml:"-"`
+	Recovery    *ThresholdCondition `yaml:"-"`
+	For         time.Duration       `yaml:"-"`
+}
+
+type ThresholdCondition struct {
+	Operator string
+	Value    float64
+}
+
+var THRESHOLD_OPERATORS = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// parses a condition like "> 100", nil if the expression is empty
+func ParseThresholdCondition(expression string) (*ThresholdCondition, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return nil, nil
+	}
+	for _, operator := range THRESHOLD_OPERATORS {
+		if !strings.HasPrefix(expression, operator) {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(expression, operator)), 64)
+		if err != nil {
+			break
+		}
+		return &ThresholdCondition{operator, value}, nil
+	}
+	return nil, fmt.Errorf("Invalid threshold condition '%s', expected an operator (%s) and a number", expression, strings.Join(THRESHOLD_OPERATORS, " "))
+}
+
+func (self *ThresholdCondition) Matches(value float64) bool {
+	if self == nil {
+		return false
+	}
+	switch self.Operator {
+	case ">":
+		return value > self.Value
+	case ">=":
+		return value >= self.Value
+	case "<":
+		return value < self.Value
+	case "<=":
+		return value <= self.Value
+	case "==":
+		return value == self.Value
+	}
+	return value != self.Value
+}
+
+func (self *Threshold) load() error {
+	if self.Metric == "" {
+		return fmt.Errorf("The metric of a threshold is required")
+	}
+	if _, err := filepath.Match(self.Metric, ""); err != nil {
+		return fmt.Errorf("Invalid threshold metric '%s'. Error: %s", self.Metric, err)
+	}
+	if self.Name == "" {
+		self.Name = self.Metric
+	}
+	var err error
+	if self.Warning, err = ParseThresholdCondition(self.RawWarning); err != nil {
+		return err
+	}
+	if self.Critical, err = ParseThresholdCondition(self.RawCritical); err != nil {
+		return err
+	}
+	if self.Recovery, err = ParseThresholdCondition(self.RawRecovery); err != nil {
+		return err
+	}
+	if self.Warning == nil && self.Critical == nil {
+		return fmt.Errorf("The threshold %s needs a warning or a critical condition", self.Name)
+	}
+	self.For = 0
+	if self.RawFor != "" {
+		if self.For, err = time.ParseDuration(self.RawFor); err != nil {
+			return err
+		}
+		if self.For < 0 {
+			return fmt.Errorf("The for of the threshold %s cannot be negative", self.Name)
+		}
+	}
+	return nil
+}
+
+// what a maintenance window does to the plugin runs it covers
+const (
+	MAINTENANCE_TAG      = "tag"      // the points get a maintenance=true dimension
+	MAINTENANCE_SUPPRESS = "suppress" // the status isn't reported and the points are tagged
+)
+
+// A maintenance window once at start (RFC 3339, e.g. 2027-01-10T02:00:00Z)
+// or every day at start (15:04, local time), for the plugins and instances
+// matching the shell globs or the whole host if there are none
+type MaintenanceWindow struct {
+	Plugins     []string      `yaml:"plugins,flow"`
+	Instances   []string      `yaml:"instances,flow"`
+	Mode        string        `yaml:"mode"` // tag (default) or suppress
+	RawStart    string        `yaml:"start"`
+	RawDuration string        `yaml:"duration"`
+	Comment     string        `yaml:"comment"`
+	Start       time.Time     `yaml:"-"` // zero for the daily windows
+	Daily       time.Duration `yaml:"-"` // the start of a daily window after midnight
+	Duration    time.Duration `yaml:"-"`
+}
+
+func (self *MaintenanceWindow) load() error {
+	switch self.Mode {
+	case "":
+		self.Mode = MAINTENANCE_TAG
+	case MAINTENANCE_TAG, MAINTENANCE_SUPPRESS:
+	default:
+		return fmt.Errorf("Unknown maintenance mode '%s', must be %s or %s", self.Mode, MAINTENANCE_TAG, MAINTENANCE_SUPPRESS)
+	}
+	for _, pattern := range append(append([]string{}, self.Plugins...), self.Instances...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid maintenance pattern '%s'. Error: %s", pattern, err)
+		}
+	}
+
+	var err error
+	if self.Duration, err = time.ParseDuration(self.RawDuration); err != nil || self.Duration <= 0 {
+		return fmt.Errorf("Invalid maintenance duration '%s', expected a positive duration like 2h", self.RawDuration)
+	}
+	if daily, err := time.Parse("15:04", self.RawStart); err == nil {
+		if self.Duration > 24*time.Hour {
+			return fmt.Errorf("A daily maintenance window cannot last more than 24h")
+		}
+		self.Start, self.Daily = time.Time{}, time.Duration(daily.Hour())*time.Hour+time.Duration(daily.Minute())*time.Minute
+		return nil
+	}
+	if self.Start, err = time.Parse(time.RFC3339, self.RawStart); err != nil {
+		return fmt.Errorf("Invalid maintenance start '%s', expected a time like 2027-01-10T02:00:00Z or 02:00 every day", self.RawStart)
+	}
+	return nil
+}
+
+// the start of the last occurrence of the window at the given time
+func (self *MaintenanceWindow) occurrence(now time.Time) time.Time {
+	if !self.Start.IsZero() {
+		return self.Start
+	}
+	year, month, day := now.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Add(self.Daily)
+	if now.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// whether the window is open at the given time, a daily window can go on
+// after midnight
+func (self *MaintenanceWindow) Active(now time.Time) bool {
+	start := self.occurrence(now)
+	return !now.Before(start) && now.Before(start.Add(self.Duration))
+}
+
+// when the occurrence of the window open at the given time ends
+func (self *MaintenanceWindow) End(now time.Time) time.Time {
+	return self.occurrence(now).Add(self.Duration)
+}
+
+// A metric name pattern, a shell glob or a regex between slashes, e.g.
+// disk.* or /^threads_(running|connected)$/
+type MetricPattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+func ParseMetricPattern(raw string) (*MetricPattern, error) {
+	if len(raw) > 1 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/") {
+		regex, err := regexp.Compile(raw[1 : len(raw)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metric regex '%s'. Error: %s", raw, err)
+		}
+		return &MetricPattern{regex: regex}, nil
+	}
+	if _, err := filepath.Match(raw, ""); err != nil {
+		return nil, fmt.Errorf("Invalid metric pattern '%s'. Error: %s", raw, err)
+	}
+	return &MetricPattern{glob: raw}, nil
+}
+
+func (self *MetricPattern) Matches(name string) bool {
+	if self.regex != nil {
+		return self.regex.MatchString(name)
+	}
+	matched, _ := filepath.Match(self.glob, name)
+	return matched
+}
+
+// A metric is sent if it matches one of the include patterns, or there are
+// none, and none of the exclude patterns
+type MetricFilter struct {
+	RawInclude []string         `yaml:"include,flow"`
+	RawExclude []string         `yaml:"exclude,flow"`
+	Include    []*MetricPattern `yaml:"-"`
+	Exclude    []*MetricPattern `yaml:"-"`
+}
+
+func parseMetricPatterns(raw []string) ([]*MetricPattern, error) {
+	patterns := make([]*MetricPattern, 0, len(raw))
+	for _, pattern := range raw {
+		parsed, err := ParseMetricPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, parsed)
+	}
+	return patterns, nil
+}
+
+func (self *MetricFilter) load() (err error) {
+	if self.Include, err = parseMetricPatterns(self.RawInclude); err != nil {
+		return err
+	}
+	self.Exclude, err = parseMetricPatterns(self.RawExclude)
+	return err
+}
+
+func (self *MetricFilter) Empty() bool {
+	return len(self.Include) == 0 && len(self.Exclude) == 0
+}
+
+func (self *MetricFilter) Allows(name string) bool {
+	included := len(self.Include) == 0
+	for _, pattern := range self.Include {
+		if pattern.Matches(name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range self.Exclude {
+		if pattern.Matches(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// The global filter is matched against the names the metrics are sent
+// with, e.g. plugins.mysql.threads_running. The filters of the plugins are
+// matched against the names the plugins print, e.g. threads_running, and
+// never drop the status and the events of the plugin.
+type MetricFiltersConfig struct {
+	MetricFilter `yaml:",inline"`
+	Plugins      map[string]*MetricFilter `yaml:"plugins"`
+}
+
+func (self *MetricFiltersConfig) load() error {
+	if err := self.MetricFilter.load(); err != nil {
+		return err
+	}
+	for name, filter := range self.Plugins {
+		if filter == nil {
+			return fmt.Errorf("The metric filter of plugin %s is empty", name)
+		}
+		if err := filter.load(); err != nil {
+			return fmt.Errorf("Invalid metric filter of plugin %s. %s", name, err)
+		}
+	}
+	return nil
+}
+
+type SeriesCompatConfig struct {
+	RawUntil string            `yaml:"until"` // e.g. 2027-01-01
+	Until    time.Time         `yaml:"-"`
+	Names    map[string]string // the new name to the previous name
+}
+
+func (self *SeriesCompatConfig) load() error {
+	if len(self.Names) == 0 {
+		return nil
+	}
+	if self.RawUntil == "" {
+		return fmt.Errorf("series-compat.until is required, the previous names can't be sent forever")
+	}
+	var err error
+	self.Until, err = time.Parse("2006-01-02", self.RawUntil)
+	if err != nil {
+		return fmt.Errorf("Invalid series-compat.until '%s', expected a date like 2027-01-01", self.RawUntil)
+	}
+	for name, previous := range self.Names {
+		if strings.Contains(strings.TrimSuffix(name, "*"), "*") || strings.Contains(strings.TrimSuffix(previous, "*"), "*") ||
+			strings.HasSuffix(name, "*") != strings.HasSuffix(previous, "*") {
+			return fmt.Errorf("Invalid series-compat name %s: %s, only a trailing * on both names is supported", name, previous)
+		}
+		if _, ok := self.Names[previous]; ok {
+			return fmt.Errorf("The previous name %s of %s can't be renamed itself", previous, name)
+		}
+	}
+	return nil
+}
+
+type SamplingConfig struct {
+	Mode               string  // head, tail or empty to disable sampling
+	MaxEventsPerSecond float64 `yaml:"max-events-per-second"` // per stream
+}
+
+// A token (or a client certificate common name when mutual tls is enabled)
+// and the scopes it's allowed to use on the local api
+type ApiToken struct {
+	Name       string
+	Token      string
+	CommonName string   `yaml:"common-name"`
+	Scopes     []string `yaml:"scopes,flow"`
+}
+
+type HttpCheck struct {
+	Name             string
+	Url              string
+	Protocols        []string      `yaml:"protocols,flow"`    // the protocols to offer during ALPN, e.g. h2 and http/1.1
+	ExpectedProtocol string        `yaml:"expected-protocol"` // alert if the negotiated protocol isn't this one, e.g. HTTP/2.0
+	RawTimeout       string        `yaml:"timeout"`
+	Timeout          time.Duration `yaml:"-"`
+}
+
+type DnsCheck struct {
+	Name           string
+	Hostname       string
+	Resolvers      []string      `yaml:"resolvers,flow"`       // host:port of the resolvers to query, e.g. 8.8.8.8:53
+	AllowedAnswers []string      `yaml:"allowed-answers,flow"` // addresses that may legitimately differ between resolvers
+	RawTimeout     string        `yaml:"timeout"`
+	Timeout        time.Duration `yaml:"-"`
+}
+
+// The container a plugin is run in, the plugin directory and the mounts
+// are mounted read-only
+type PluginSandbox struct {
+	Runtime string   // docker or podman, default is docker
+	Image   string   // the image must have the interpreter and the dependencies the plugin needs
+	Mounts  []string `yaml:"mounts,flow"` // host paths mounted read-only at the same path in the container
+	Network string   // default is none
+	Memory  string   // optional memory limit, e.g. 128m
+}
+
+type WindowsTarget struct {
+	Name       string // reported as the host dimension
+	Url        string // the winrm endpoint, e.g. https://win1:5986/wsman
+	Username   string // basic authentication has to be enabled on the winrm service
+	Password   string
+	Insecure   bool          `yaml:"insecure"`      // don't verify the certificate of the endpoint
+	Services   []string      `yaml:"services,flow"` // report the state of these services, by default all auto start services are checked
+	RawTimeout string        `yaml:"timeout"`
+	Timeout    time.Duration `yaml:"-"`
+}
+
+type ModbusDevice struct {
+	Name       string
+	Address    string            // host:port, the port is usually 502
+	UnitId     byte              `yaml:"unit-id"`
+	Registers  []*ModbusRegister `yaml:"registers"`
+	RawTimeout string            `yaml:"timeout"`
+	Timeout    time.Duration     `yaml:"-"`
+}
+
+// A value read from one (16 bits) or two (32 bits) registers, reported as
+// modbus.<name> after being scaled, i.e. value * scale + offset
+type ModbusRegister struct {
+	Name       string
+	Type       string // holding (default) or input
+	Address    uint16
+	Format     string  // uint16 (default), int16, uint32, int32 or float32
+	WordOrder  string  `yaml:"word-order"` // big (default, high word first) or little, for 32 bits formats
+	Scale      float64 // default is 1
+	Offset     float64
+	Dimensions map[string]string `yaml:"dimensions"`
+}
+
+type MqttConfig struct {
+	Broker        string              // host:port of the broker
+	Tls           bool                `yaml:"tls"`
+	ClientId      string              `yaml:"client-id"` // default is errplane-agent-<hostname>
+	Username      string              `yaml:"username"`
+	Password      string              `yaml:"password"`
+	Subscriptions []*MqttSubscription `yaml:"subscriptions"`
+}
+
+// The messages published on the topic are reported as metric, the value is
+// either the whole payload or the number at json-path in a json payload
+type MqttSubscription struct {
+	Topic           string   // may contain the + and # wildcards
+	Metric          string   // the name of the metric
+	JsonPath        string   `yaml:"json-path"`             // e.g. $.sensors[0].temperature
+	TopicDimensions []string `yaml:"topic-dimensions,flow"` // the dimension names of the wildcards in the topic, in order
+	Qos             byte     `yaml:"qos"`                   // 0 (default) or 1
+}
+
+type Sensor struct {
+	Name       string
+	Type       string            // 1-wire, i2c or gpio
+	Device     string            // the 1-wire device id, e.g. 28-000005e2fdc3
+	Path       string            // the sysfs attribute exposed by the i2c sensor driver, e.g. /sys/class/hwmon/hwmon1/temp1_input
+	Pin        int               // the gpio number
+	Scale      float64           // the raw i2c value is multiplied by scale, default is 0.001 (millidegrees)
+	Dimensions map[string]string `yaml:"dimensions"`
+}
+
+type HostStatsConfig struct {
+	Enabled          bool     // report host.* instead of the server.stats.* cpu, memory, disk and network stats
+	PerCpu           bool     `yaml:"per-cpu"`                // report every cpu next to the total
+	IgnoreFsTypes    []string `yaml:"ignore-fs-types,flow"`   // default is the pseudo filesystems, e.g. proc and tmpfs
+	IgnoreInterfaces []string `yaml:"ignore-interfaces,flow"` // interface name prefixes, default is lo
+}
+
+// The host ip is the first ipv4 address of the preferred interfaces, in the
+// order of the interfaces, then of the subnets. Without preference (or if no
+// address matches) it's the address of the default route.
+type HostIpConfig struct {
+	Dimension           bool         `yaml:"dimension"`            // add the ip dimension to every metric
+	InterfaceDimensions bool         `yaml:"interface-dimensions"` // add ip_<interface> for every interface as well
+	Interfaces          []string     `yaml:"interfaces,flow"`      // globs, e.g. [bond0, eth*]
+	RawSubnets          []string     `yaml:"subnets,flow"`         // e.g. [10.0.0.0/8]
+	Subnets             []*net.IPNet `yaml:"-"`
+	IgnoreInterfaces    []string     `yaml:"ignore-interfaces,flow"` // globs, default is lo, docker*, veth* and virbr*
+}
+
+type SpoolConfig struct {
+	Dir       string
+	MaxSize   int64         `yaml:"max-size"` // in bytes, the oldest points are dropped beyond this size, default is 100MB
+	RawMaxAge string        `yaml:"max-age"`  // points older than this aren't replayed, default is 24h
+	MaxAge    time.Duration `yaml:"-"`
+}
+
+type LocalStoreConfig struct {
+	Path    string // e.g. /data/errplane-agent/shared/agent.db
+	MaxSize int64  `yaml:"max-size"` // in bytes, the least recently updated entries are dropped beyond this size, default is 64MB
+}
+
+type HttpBatchConfig struct {
+	Enabled       bool
+	MaxPoints     int           `yaml:"max-points"`  // a batch is sent as soon as it has this many points, default is 5000
+	RawMaxLatency string        `yaml:"max-latency"` // how long a point can wait for its batch, default is 1s
+	MaxLatency    time.Duration `yaml:"-"`
+	Gzip          bool          // compress the batches, the backend must accept Content-Encoding: gzip
+}
+
+const (
+	PLUGIN_OVERLAP_SKIP  = "skip"
+	PLUGIN_OVERLAP_QUEUE = "queue"
+)
+
+type PluginConcurrencyConfig struct {
+	MaxConcurrency int     `yaml:"max-concurrency"` // the max number of plugins running at the same time, default is 10
+	Overlap        string  // what to do when the previous run of an instance is still running, skip (default) or queue
+	Stagger        bool    // spread the first runs of the instances over their interval instead of starting them together
+	Jitter         float64 // every run moves by up to this fraction of its interval either way, e.g. 0.1, at most 0.5
+}
+
+type PowerConfig struct {
+	NutUps                    []string      `yaml:"nut-ups,flow"`              // upses to query with upsc, e.g. ups@localhost
+	RawOnBatteryCriticalAfter string        `yaml:"on-battery-critical-after"` // default is 5m
+	OnBatteryCriticalAfter    time.Duration `yaml:"-"`
+}
+
+type KubernetesConfig struct {
+	Disabled   bool   // don't detect kubernetes
+	NodeName   string `yaml:"node-name"`   // default is the NODE_NAME environment variable, then the hostname
+	KubeletUrl string `yaml:"kubelet-url"` // list the pods of the kubelet instead of the api server, e.g. https://localhost:10250
+	Annotation string // the pod annotation listing the plugin instances, default is errplane.io/plugins
+}
+
+type DockerConfig struct {
+	Enabled bool
+	Socket  string   // the socket of the docker daemon, default is /var/run/docker.sock
+	Labels  []string `yaml:"labels,flow"` // the container labels added to the dimensions, e.g. com.example.service
+}
+
+// The processes a watch reports on, the ones whose name or command line
+// matches the regex or the one in the pidfile, optionally owned by a user
+type ProcessWatch struct {
+	Name         string         // reported in the process dimension
+	RawNameRegex string         `yaml:"name-regex"`
+	NameRegex    *regexp.Regexp `yaml:"-" json:"-"`
+	RawCmdline   string         `yaml:"cmdline"` // regex matched against the arguments joined by spaces
+	Cmdline      *regexp.Regexp `yaml:"-" json:"-"`
+	Pidfile      string
+	User         string
+}
+
+// The dimensions a metric must have, the points violating the schema are
+// counted and dropped if drop is set
+type DimensionSchema struct {
+	RawMetric string            `yaml:"metric"` // regex matched against the metric names
+	Metric    *regexp.Regexp    `yaml:"-" json:"-"`
+	Required  []string          `yaml:"required,flow"`
+	Types     map[string]string // dimension => int, float, bool or string
+	Drop      bool
+}
+
+// A windows performance counter reported as server.perf.<name>
+type PerfCounter struct {
+	Name string
+	Path string // the english path of the counter
+}
+
+// A log file tailed by the agent, it's followed when it's rotated or
+// truncated
+type LogTail struct {
+	Path     string
+	Patterns []*LogPattern
+}
+
+// A pattern counted as logs.<name>.count every sleep, the named groups that
+// capture a number are reported as logs.<name>.<group>
+type LogPattern struct {
+	Name     string
+	RawRegex string         `yaml:"regex"`
+	Regex    *regexp.Regexp `yaml:"-" json:"-"`
+	Critical bool           // report the matching lines as logs.<name>.events
+}
+
+// A command whose exit code is the status of the check, 0 is ok and
+// anything else is critical (or the other way around if inverted)
+type CommandCheck struct {
+	Name       string
+	Command    string        // run using sh -c
+	Invert     bool          // the check is ok if the command fails, e.g. grep -q ERROR /var/log/app.log
+	RawTimeout string        `yaml:"timeout"`
+	Timeout    time.Duration `yaml:"-"`
+	Metrics    []*CommandMetric
+}
+
+// A value parsed from the output of a command check, e.g. 1.2G, 345ms or
+// 87%, and reported in bytes, seconds or percent
+type CommandMetric struct {
+	Name             string
+	RawRegex         string         `yaml:"regex"` // the first group, or the match, is the value, the whole output if empty
+	Regex            *regexp.Regexp `yaml:"-" json:"-"`
+	DecimalSeparator string         `yaml:"decimal-separator"` // . (default) or , for locales like de_DE, the other one groups the thousands
 }
 
 func (self *Config) Database() string {
 	return self.AppKey + self.Environment
 }
 
-var AgentConfig Config
+// the *Config of the agent, a reload replaces it as a whole instead of
+// writing over the configuration the goroutines are reading
+var agentConfig atomic.Value
+
+func init() {
+	agentConfig.Store(&Config{})
+}
+
+// returns the configuration of the agent, it must not be modified. The
+// values read from the same configuration are consistent, e.g. within a
+// cycle, the next call returns the reloaded one.
+func AgentConfig() *Config {
+	return agentConfig.Load().(*Config)
+}
+
+// makes the configuration the one of the agent
+func SetAgentConfig(config *Config) {
+	agentConfig.Store(config)
+}
 
+// reads the configuration and its layers, sets the defaults and makes it
+// the configuration of the agent
 func InitConfig(path string) error {
-	content, err := ioutil.ReadFile(path)
+	config, err := ParseConfig(path)
 	if err != nil {
-		return err
-	}
-	err = goyaml.Unmarshal(content, &AgentConfig)
-	if err != nil {
-		return err
+		return ConfigError(err)
 	}
+	SetAgentConfig(config)
+	return nil
+}
 
-	AgentConfig.Hostname, err = os.Hostname()
+// reads the configuration and its layers and sets the defaults, without
+// changing the configuration of the agent
+func ParseConfig(path string) (*Config, error) {
+	hostname, err := os.Hostname()
 	if err != nil {
 		fmt.Printf("Cannot determine hostname. Error: %s\n", err)
 		os.Exit(1)
 	}
 
+	content, layers, err := loadConfigLayers(path, hostname)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	err = goyaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	config.Hostname = hostname
+	config.Layers = layers
+
+	if config.PluginsDir == "" {
+		config.PluginsDir = PLUGINS_DIR
+	}
+	if config.CustomPluginsDir == "" {
+		config.CustomPluginsDir = CUSTOM_PLUGINS_DIR
+	}
+	if config.ConfigCache == "" {
+		config.ConfigCache = BACKEND_CONFIG_CACHE
+	}
+
 	// setPluginDefaults()
 	// setProcessesDefaults()
 
-	AgentConfig.Sleep, err = time.ParseDuration(AgentConfig.RawSleep)
+	config.Sleep, err = time.ParseDuration(config.RawSleep)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	AgentConfig.FlushInterval, err = time.ParseDuration(AgentConfig.RawFlushInterval)
+	config.FlushInterval, err = time.ParseDuration(config.RawFlushInterval)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	AgentConfig.TopNSleep, err = time.ParseDuration(AgentConfig.RawTopNSleep)
+	config.TopNSleep, err = time.ParseDuration(config.RawTopNSleep)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	AgentConfig.MonitoredSleep, err = time.ParseDuration(AgentConfig.RawMonitoredSleep)
+	config.MonitoredSleep, err = time.ParseDuration(config.RawMonitoredSleep)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if _, ok := config.Dimensions["host"]; ok {
+		return nil, fmt.Errorf("The host dimension is set by the agent and cannot be configured")
+	}
+
+	for _, check := range config.HttpChecks {
+		if check.Name == "" {
+			return nil, fmt.Errorf("Http check name cannot be empty")
+		}
+
+		check.Timeout = 10 * time.Second
+		if check.RawTimeout != "" {
+			check.Timeout, err = time.ParseDuration(check.RawTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(check.Protocols) == 0 {
+			check.Protocols = []string{"h2", "http/1.1"}
+		}
+	}
+
+	config.Notifiers.Throttle = 30 * time.Minute
+	if config.Notifiers.RawThrottle != "" {
+		config.Notifiers.Throttle, err = time.ParseDuration(config.Notifiers.RawThrottle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Watchdog.SendFailureRate == 0 {
+		config.Watchdog.SendFailureRate = 0.5
+	}
+	if config.Watchdog.SendFailureRate < 0 || config.Watchdog.SendFailureRate > 1 {
+		return nil, fmt.Errorf("Watchdog send-failure-rate must be between 0 and 1")
+	}
+	if config.Watchdog.SpoolGrowth == 0 {
+		config.Watchdog.SpoolGrowth = 5
+	}
+	if config.Watchdog.PluginFailureSpike == 0 {
+		config.Watchdog.PluginFailureSpike = 3
+	}
+	if config.Watchdog.MinPluginFailures == 0 {
+		config.Watchdog.MinPluginFailures = 5
+	}
+	if config.Watchdog.SpoolGrowth < 0 || config.Watchdog.PluginFailureSpike < 1 || config.Watchdog.MinPluginFailures < 0 {
+		return nil, fmt.Errorf("Watchdog spool-growth and min-plugin-failures must be positive and plugin-failure-spike at least 1")
+	}
+	if config.Watchdog.SyslogTag == "" {
+		config.Watchdog.SyslogTag = "errplane-agent"
+	}
+
+	config.Heartbeat.Interval = time.Minute
+	if config.Heartbeat.RawInterval != "" {
+		config.Heartbeat.Interval, err = time.ParseDuration(config.Heartbeat.RawInterval)
+		if err != nil {
+			return nil, err
+		}
+		if config.Heartbeat.Interval <= 0 {
+			return nil, fmt.Errorf("The heartbeat interval must be positive")
+		}
+	}
+
+	if config.Ephemeral.MetadataUrl == "" {
+		config.Ephemeral.MetadataUrl = "http://169.254.169.254/latest/meta-data/autoscaling/target-lifecycle-state"
+	}
+	switch config.Ephemeral.TokenUrl {
+	case "":
+		config.Ephemeral.TokenUrl = "http://169.254.169.254/latest/api/token"
+	case "none":
+		config.Ephemeral.TokenUrl = ""
+	}
+	if len(config.Ephemeral.ScaleInStates) == 0 {
+		config.Ephemeral.ScaleInStates = []string{"Terminated", "Detached"}
+	}
+	config.Ephemeral.PollInterval = 5 * time.Second
+	if config.Ephemeral.RawPollInterval != "" {
+		config.Ephemeral.PollInterval, err = time.ParseDuration(config.Ephemeral.RawPollInterval)
+		if err != nil {
+			return nil, err
+		}
+		if config.Ephemeral.PollInterval <= 0 {
+			return nil, fmt.Errorf("The ephemeral poll-interval must be positive")
+		}
+	}
+	if config.Ephemeral.Enabled && config.Heartbeat.RawInterval == "" {
+		// the instances come and go, the backend expects them more often
+		config.Heartbeat.Interval = 15 * time.Second
+	}
+
+	if config.ConfigBake.RawPeriod != "" {
+		config.ConfigBake.Period, err = time.ParseDuration(config.ConfigBake.RawPeriod)
+		if err != nil {
+			return nil, err
+		}
+		if config.ConfigBake.Period <= 0 {
+			return nil, fmt.Errorf("The config-bake period must be positive")
+		}
+	}
+	if config.ConfigBake.FailureSpike == 0 {
+		config.ConfigBake.FailureSpike = 2
+	}
+	if config.ConfigBake.MinFailures == 0 {
+		config.ConfigBake.MinFailures = 5
+	}
+	if config.ConfigBake.FailureSpike < 0 || config.ConfigBake.MinFailures < 0 {
+		return nil, fmt.Errorf("The config-bake failure-spike and min-failures cannot be negative")
+	}
+
+	config.HistoryRetention = 7 * 24 * time.Hour
+	if config.RawHistoryRetention != "" {
+		config.HistoryRetention, err = time.ParseDuration(config.RawHistoryRetention)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	thresholdNames := make(map[string]bool)
+	for _, threshold := range config.Thresholds {
+		if err := threshold.load(); err != nil {
+			return nil, err
+		}
+		if thresholdNames[threshold.Name] {
+			return nil, fmt.Errorf("Duplicate threshold name '%s'", threshold.Name)
+		}
+		thresholdNames[threshold.Name] = true
+	}
+
+	if err := config.MetricFilters.load(); err != nil {
+		return nil, err
+	}
+
+	for _, window := range config.Maintenance {
+		if err := window.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Flapping.Window == 0 {
+		config.Flapping.Window = 20
 	}
-	// for _, process := range AgentConfig.MonitoredProcesses {
+	if config.Flapping.High == 0 {
+		config.Flapping.High = 0.5
+	}
+	if config.Flapping.Low == 0 {
+		config.Flapping.Low = 0.25
+	}
+	if config.Flapping.Window < 3 {
+		return nil, fmt.Errorf("The flapping window must be at least 3 runs")
+	}
+	if config.Flapping.Low < 0 || config.Flapping.Low > config.Flapping.High || config.Flapping.High > 1 {
+		return nil, fmt.Errorf("The flapping low and high must be ratios with low <= high")
+	}
+
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "errplane-agent"
+	}
+	config.Tracing.FlushInterval = 10 * time.Second
+	if config.Tracing.RawFlushInterval != "" {
+		config.Tracing.FlushInterval, err = time.ParseDuration(config.Tracing.RawFlushInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Tracing.FlushInterval <= 0 {
+		return nil, fmt.Errorf("tracing.flush-interval must be positive")
+	}
+
+	switch config.Timestamps.Mode {
+	case "":
+		config.Timestamps.Mode = TIMESTAMPS_ORIGIN
+	case TIMESTAMPS_ORIGIN, TIMESTAMPS_SEND:
+	default:
+		return nil, fmt.Errorf("Unknown timestamps mode '%s', supported modes are 'origin' and 'send'", config.Timestamps.Mode)
+	}
+	config.Timestamps.LateAfter = time.Minute
+	if config.Timestamps.RawLateAfter != "" {
+		config.Timestamps.LateAfter, err = time.ParseDuration(config.Timestamps.RawLateAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Timestamps.LateAfter <= 0 {
+		return nil, fmt.Errorf("timestamps.late-after must be positive")
+	}
+
+	config.PointTtls = make(map[string]time.Duration)
+	for sink, rawTtl := range config.RawPointTtls {
+		config.PointTtls[sink], err = time.ParseDuration(rawTtl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, globs := range [][]string{config.Scrubbing.Allow, config.Scrubbing.Drop, config.Scrubbing.Hash} {
+		for _, glob := range globs {
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("Invalid scrubbing pattern '%s'. Error: %s", glob, err)
+			}
+		}
+	}
+	config.Scrubbing.Patterns = make(map[string]*regexp.Regexp)
+	for name, rawPattern := range config.Scrubbing.RawPatterns {
+		config.Scrubbing.Patterns[name], err = regexp.Compile(rawPattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid scrubbing pattern %s. Error: %s", name, err)
+		}
+	}
+
+	if config.Secrets.File != "" && config.Secrets.KeyFile == "" {
+		return nil, fmt.Errorf("The secrets file %s needs a key-file", config.Secrets.File)
+	}
+
+	if err := config.BackendTls.load(); err != nil {
+		return nil, err
+	}
+
+	if err := config.SeriesCompat.load(); err != nil {
+		return nil, err
+	}
+
+	switch config.Sampling.Mode {
+	case "", "head", "tail":
+	default:
+		return nil, fmt.Errorf("Unknown sampling mode '%s', supported modes are 'head' and 'tail'", config.Sampling.Mode)
+	}
+
+	if config.RingBufferSize == 0 {
+		config.RingBufferSize = 65536
+	}
+
+	if config.Loadgen.Metrics < 0 || config.Loadgen.Dimensions < 0 || config.Loadgen.Series < 0 || config.Loadgen.Rate < 0 {
+		return nil, fmt.Errorf("loadgen.metrics, dimensions, series and rate cannot be negative")
+	}
+	if config.Loadgen.Series == 0 {
+		config.Loadgen.Series = 10
+	}
+	if config.Loadgen.Rate == 0 {
+		config.Loadgen.Rate = 100
+	}
+	if config.Loadgen.Prefix == "" {
+		config.Loadgen.Prefix = "loadgen"
+	}
+	if config.Loadgen.RawDuration != "" {
+		config.Loadgen.Duration, err = time.ParseDuration(config.Loadgen.RawDuration)
+		if err != nil {
+			return nil, err
+		}
+		if config.Loadgen.Duration <= 0 {
+			return nil, fmt.Errorf("loadgen.duration must be positive")
+		}
+	}
+
+	for _, token := range config.ApiTokens {
+		if token.Token == "" && token.CommonName == "" {
+			return nil, fmt.Errorf("Api token %s must have either a token or a common-name", token.Name)
+		}
+	}
+
+	if err := config.PluginLimits.Validate(); err != nil {
+		return nil, fmt.Errorf("plugin-%s", err)
+	}
+	if config.PluginCgroup == "" {
+		config.PluginCgroup = "/sys/fs/cgroup/errplane-plugins"
+	}
+
+	if config.SshTunnel.Host != "" {
+		if config.Proxy != "" {
+			return nil, fmt.Errorf("proxy and ssh-tunnel can't be used together")
+		}
+		if config.SshTunnel.LocalPort == 0 {
+			config.SshTunnel.LocalPort = 1081
+		}
+	}
+	if config.Proxy != "" {
+		proxy, err := ParseProxy(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy %s. Error: %s", config.Proxy, err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("Unsupported proxy scheme '%s', supported schemes are http, https, socks5 and socks5h", proxy.Scheme)
+		}
+	}
+
+	if config.Scrape.MaxPoints == 0 {
+		config.Scrape.MaxPoints = 100000
+	}
+	if config.Scrape.Listen != "" && len(config.ApiTokens) == 0 {
+		return nil, fmt.Errorf("scrape.listen requires api-tokens, the points can't be pulled without authentication")
+	}
+
+	for _, check := range config.DnsChecks {
+		if check.Name == "" {
+			return nil, fmt.Errorf("Dns check name cannot be empty")
+		}
+
+		if len(check.Resolvers) < 2 {
+			return nil, fmt.Errorf("Dns check %s needs at least two resolvers to compare", check.Name)
+		}
+
+		check.Timeout = 5 * time.Second
+		if check.RawTimeout != "" {
+			check.Timeout, err = time.ParseDuration(check.RawTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, sandbox := range config.PluginSandboxes {
+		if sandbox.Image == "" {
+			return nil, fmt.Errorf("The sandbox of plugin %s must have an image", name)
+		}
+		if sandbox.Runtime == "" {
+			sandbox.Runtime = "docker"
+		}
+		if sandbox.Network == "" {
+			sandbox.Network = "none"
+		}
+	}
+
+	for _, target := range config.WindowsTargets {
+		if target.Name == "" || target.Url == "" {
+			return nil, fmt.Errorf("Windows targets must have a name and a url")
+		}
+
+		target.Timeout = 30 * time.Second
+		if target.RawTimeout != "" {
+			target.Timeout, err = time.ParseDuration(target.RawTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, device := range config.ModbusDevices {
+		if device.Name == "" || device.Address == "" {
+			return nil, fmt.Errorf("Modbus devices must have a name and an address")
+		}
+
+		device.Timeout = 5 * time.Second
+		if device.RawTimeout != "" {
+			device.Timeout, err = time.ParseDuration(device.RawTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, register := range device.Registers {
+			switch register.Type {
+			case "":
+				register.Type = "holding"
+			case "holding", "input":
+			default:
+				return nil, fmt.Errorf("Unknown register type '%s' for %s, supported types are 'holding' and 'input'", register.Type, register.Name)
+			}
+			switch register.Format {
+			case "":
+				register.Format = "uint16"
+			case "uint16", "int16", "uint32", "int32", "float32":
+			default:
+				return nil, fmt.Errorf("Unknown register format '%s' for %s", register.Format, register.Name)
+			}
+			if register.Scale == 0 {
+				register.Scale = 1
+			}
+		}
+	}
+
+	if config.Mqtt.ClientId == "" {
+		config.Mqtt.ClientId = "errplane-agent-" + config.Hostname
+	}
+	for _, subscription := range config.Mqtt.Subscriptions {
+		if subscription.Topic == "" || subscription.Metric == "" {
+			return nil, fmt.Errorf("Mqtt subscriptions must have a topic and a metric")
+		}
+		if subscription.Qos > 1 {
+			return nil, fmt.Errorf("Mqtt subscription to %s must use qos 0 or 1", subscription.Topic)
+		}
+	}
+
+	for _, sensor := range config.Sensors {
+		switch sensor.Type {
+		case "1-wire":
+			if sensor.Device == "" {
+				return nil, fmt.Errorf("1-wire sensor %s must have a device", sensor.Name)
+			}
+		case "i2c":
+			if sensor.Path == "" {
+				return nil, fmt.Errorf("i2c sensor %s must have a path", sensor.Name)
+			}
+		case "gpio":
+		default:
+			return nil, fmt.Errorf("Unknown sensor type '%s', supported types are '1-wire', 'i2c' and 'gpio'", sensor.Type)
+		}
+		if sensor.Scale == 0 {
+			sensor.Scale = 0.001
+		}
+	}
+
+	if config.HostStats.IgnoreFsTypes == nil {
+		config.HostStats.IgnoreFsTypes = []string{"proc", "sysfs", "devtmpfs", "devpts", "tmpfs", "cgroup", "cgroup2",
+			"overlay", "squashfs", "nsfs", "tracefs", "debugfs", "securityfs", "pstore", "autofs", "mqueue", "hugetlbfs",
+			"fusectl", "configfs", "binfmt_misc", "rpc_pipefs"}
+	}
+	if config.HostStats.IgnoreInterfaces == nil {
+		config.HostStats.IgnoreInterfaces = []string{"lo"}
+	}
+
+	for _, subnet := range config.HostIp.RawSubnets {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid host ip subnet '%s'. Error: %s", subnet, err)
+		}
+		config.HostIp.Subnets = append(config.HostIp.Subnets, network)
+	}
+	if config.HostIp.IgnoreInterfaces == nil {
+		config.HostIp.IgnoreInterfaces = []string{"lo", "docker*", "veth*", "virbr*"}
+	}
+
+	if config.Spool.MaxSize == 0 {
+		config.Spool.MaxSize = 100 * 1024 * 1024
+	}
+	config.Spool.MaxAge = 24 * time.Hour
+	if config.Spool.RawMaxAge != "" {
+		config.Spool.MaxAge, err = time.ParseDuration(config.Spool.RawMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.LocalStore.MaxSize == 0 {
+		config.LocalStore.MaxSize = 64 * 1024 * 1024
+	}
+
+	if config.HttpBatch.MaxPoints == 0 {
+		config.HttpBatch.MaxPoints = 5000
+	}
+	config.HttpBatch.MaxLatency = time.Second
+	if config.HttpBatch.RawMaxLatency != "" {
+		config.HttpBatch.MaxLatency, err = time.ParseDuration(config.HttpBatch.RawMaxLatency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Kubernetes.Annotation == "" {
+		config.Kubernetes.Annotation = "errplane.io/plugins"
+	}
+
+	if config.Docker.Socket == "" {
+		config.Docker.Socket = "/var/run/docker.sock"
+	}
+
+	config.Power.OnBatteryCriticalAfter = 5 * time.Minute
+	if config.Power.RawOnBatteryCriticalAfter != "" {
+		config.Power.OnBatteryCriticalAfter, err = time.ParseDuration(config.Power.RawOnBatteryCriticalAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PluginConcurrency.MaxConcurrency <= 0 {
+		config.PluginConcurrency.MaxConcurrency = 10
+	}
+	switch config.PluginConcurrency.Overlap {
+	case "":
+		config.PluginConcurrency.Overlap = PLUGIN_OVERLAP_SKIP
+	case PLUGIN_OVERLAP_SKIP, PLUGIN_OVERLAP_QUEUE:
+	default:
+		return nil, fmt.Errorf("Unknown plugin overlap '%s', must be skip or queue", config.PluginConcurrency.Overlap)
+	}
+	if config.PluginConcurrency.Jitter < 0 || config.PluginConcurrency.Jitter > 0.5 {
+		return nil, fmt.Errorf("plugin-concurrency.jitter must be between 0 and 0.5")
+	}
+
+	switch config.LocalPluginsMode {
+	case "":
+		config.LocalPluginsMode = LOCAL_PLUGINS_REMOTE
+	case LOCAL_PLUGINS_REMOTE, LOCAL_PLUGINS_LOCAL, LOCAL_PLUGINS_FALLBACK:
+	default:
+		return nil, fmt.Errorf("Unknown local plugins mode '%s', must be remote, local or fallback", config.LocalPluginsMode)
+	}
+
+	switch config.OutputValidation {
+	case "":
+		config.OutputValidation = OUTPUT_VALIDATION_LENIENT
+	case OUTPUT_VALIDATION_LENIENT, OUTPUT_VALIDATION_STRICT:
+	default:
+		return nil, fmt.Errorf("Unknown output validation '%s', must be lenient or strict", config.OutputValidation)
+	}
+
+	for _, watch := range config.Processes {
+		if watch.Name == "" {
+			return nil, fmt.Errorf("Processes must have a name")
+		}
+		matchers := 0
+		for _, matcher := range []string{watch.RawNameRegex, watch.RawCmdline, watch.Pidfile} {
+			if matcher != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return nil, fmt.Errorf("Process %s must have exactly one of name-regex, cmdline or pidfile", watch.Name)
+		}
+		if watch.RawNameRegex != "" {
+			if watch.NameRegex, err = regexp.Compile(watch.RawNameRegex); err != nil {
+				return nil, fmt.Errorf("Invalid name-regex of process %s. Error: %s", watch.Name, err)
+			}
+		}
+		if watch.RawCmdline != "" {
+			if watch.Cmdline, err = regexp.Compile(watch.RawCmdline); err != nil {
+				return nil, fmt.Errorf("Invalid cmdline of process %s. Error: %s", watch.Name, err)
+			}
+		}
+	}
+
+	for _, schema := range config.DimensionSchemas {
+		if schema.RawMetric == "" {
+			return nil, fmt.Errorf("Dimension schemas must have a metric")
+		}
+		if schema.Metric, err = regexp.Compile(schema.RawMetric); err != nil {
+			return nil, fmt.Errorf("Invalid metric of dimension schema %s. Error: %s", schema.RawMetric, err)
+		}
+		for name, kind := range schema.Types {
+			switch kind {
+			case "int", "float", "bool", "string":
+			default:
+				return nil, fmt.Errorf("Invalid type %s of dimension %s, it must be int, float, bool or string", kind, name)
+			}
+		}
+	}
+
+	for _, counter := range config.PerfCounters {
+		if counter.Name == "" || counter.Path == "" {
+			return nil, fmt.Errorf("Perf counters must have a name and a path")
+		}
+	}
+
+	patterns := make(map[string]bool)
+	for _, tail := range config.LogTails {
+		if tail.Path == "" || len(tail.Patterns) == 0 {
+			return nil, fmt.Errorf("Log tails must have a path and patterns")
+		}
+		for _, pattern := range tail.Patterns {
+			if pattern.Name == "" || pattern.RawRegex == "" {
+				return nil, fmt.Errorf("The patterns of log tail %s must have a name and a regex", tail.Path)
+			}
+			if patterns[pattern.Name] {
+				return nil, fmt.Errorf("Log pattern %s is defined more than once", pattern.Name)
+			}
+			patterns[pattern.Name] = true
+			if pattern.Regex, err = regexp.Compile(pattern.RawRegex); err != nil {
+				return nil, fmt.Errorf("Invalid regex of log pattern %s. Error: %s", pattern.Name, err)
+			}
+		}
+	}
+
+	for _, check := range config.CommandChecks {
+		if check.Name == "" || check.Command == "" {
+			return nil, fmt.Errorf("Command checks must have a name and a command")
+		}
+
+		check.Timeout = 10 * time.Second
+		if check.RawTimeout != "" {
+			check.Timeout, err = time.ParseDuration(check.RawTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, metric := range check.Metrics {
+			if metric.Name == "" {
+				return nil, fmt.Errorf("The metrics of command check %s must have a name", check.Name)
+			}
+			if metric.RawRegex != "" {
+				if metric.Regex, err = regexp.Compile(metric.RawRegex); err != nil {
+					return nil, fmt.Errorf("Invalid regex of metric %s of command check %s. Error: %s", metric.Name, check.Name, err)
+				}
+			}
+			switch metric.DecimalSeparator {
+			case "":
+				metric.DecimalSeparator = "."
+			case ".", ",":
+			default:
+				return nil, fmt.Errorf("Invalid decimal separator '%s' of metric %s of command check %s, must be . or ,", metric.DecimalSeparator, metric.Name, check.Name)
+			}
+		}
+	}
+	// for _, process := range config.MonitoredProcesses {
 	// 	process.CompiledRegex, err = regexp.Compile(process.Regex)
 	// 	if err != nil {
 	// 		return err
@@ -93,9 +1664,9 @@ func InitConfig(path string) error {
 	// 	}
 	// }
 
-	// for _, plugin := range AgentConfig.Plugins {
+	// for _, plugin := range config.Plugins {
 	// 	if plugin.Name == "" {
-	// 		return fmt.Errorf("Plugin name cannot be empty")
+	// 		return nil, fmt.Errorf("Plugin name cannot be empty")
 	// 	}
 
 	// 	if len(plugin.Instances) == 0 {
@@ -127,5 +1698,5 @@ func InitConfig(path string) error {
 	// }
 
 	// return nil
-	return nil
+	return config, nil
 }
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// A configuration file merged on top of the previous ones
+type ConfigLayer struct {
+	Name    string // the path of the file
+	Content map[interface{}]interface{}
+}
+
+// A configuration layer sent by the backend, e.g. the plugins of a role
+type BackendConfigLayer struct {
+	Name      string                 `json:"name"`
+	Plugins   map[string][]*Instance `json:"plugins"`
+	Processes []*Process             `json:"processes"`
+}
+
+// returns the os family of the host, the first ID_LIKE (or the ID) of
+// /etc/os-release, e.g. debian or rhel, or the go os on other systems
+func osFamily() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return runtime.GOOS
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = strings.Trim(parts[1], `"'`)
+		}
+	}
+	if like := strings.Fields(values["ID_LIKE"]); len(like) > 0 {
+		return like[0]
+	}
+	if values["ID"] != "" {
+		return values["ID"]
+	}
+	return runtime.GOOS
+}
+
+// replaces {os}, {role} and {host} in the path of a layer
+func layerPath(path, family, role, host string) string {
+	return strings.NewReplacer("{os}", family, "{role}", role, "{host}", host).Replace(path)
+}
+
+// merges src into dst, the maps are merged recursively and anything else,
+// lists included, is replaced
+func mergeYaml(dst, src map[interface{}]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[key].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeYaml(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// reads the configuration file and the layers it lists in config-layers,
+// missing layers are skipped. Returns the merged configuration and the
+// layers it was merged from.
+func loadConfigLayers(path, hostname string) ([]byte, []*ConfigLayer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := make(map[interface{}]interface{})
+	if err := goyaml.Unmarshal(content, &base); err != nil {
+		return nil, nil, err
+	}
+
+	config := struct {
+		Role         string   `yaml:"role"`
+		ConfigLayers []string `yaml:"config-layers,flow"`
+	}{}
+	if err := goyaml.Unmarshal(content, &config); err != nil {
+		return nil, nil, err
+	}
+
+	layers := []*ConfigLayer{&ConfigLayer{path, base}}
+	if len(config.ConfigLayers) == 0 {
+		return content, layers, nil
+	}
+
+	family := osFamily()
+	mergedDoc := make(map[interface{}]interface{})
+	mergeYaml(mergedDoc, base)
+	for _, rawPath := range config.ConfigLayers {
+		if strings.Contains(rawPath, "{role}") && config.Role == "" {
+			continue
+		}
+		layerFile := layerPath(rawPath, family, config.Role, hostname)
+		content, err := ioutil.ReadFile(layerFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		layer := make(map[interface{}]interface{})
+		if err := goyaml.Unmarshal(content, &layer); err != nil {
+			return nil, nil, fmt.Errorf("Cannot parse configuration layer %s. Error: %s", layerFile, err)
+		}
+		if _, ok := layer["config-layers"]; ok {
+			return nil, nil, fmt.Errorf("Configuration layer %s cannot set config-layers", layerFile)
+		}
+		if _, ok := layer["role"]; ok {
+			return nil, nil, fmt.Errorf("Configuration layer %s cannot set the role", layerFile)
+		}
+		mergeYaml(mergedDoc, layer)
+		layers = append(layers, &ConfigLayer{layerFile, layer})
+	}
+	merged, err := goyaml.Marshal(mergedDoc)
+	return merged, layers, err
+}
+
+// merges the layers sent by the backend in order on top of its plugins and
+// processes, a layer replaces all the instances of the plugins it has and
+// the processes with the same nickname. Keeps where every plugin and
+// process comes from in Origins, e.g. plugins.redis -> role:cache
+func (self *AgentConfiguration) mergeLayers() {
+	origins := make(map[string]string)
+	if self.Plugins == nil {
+		self.Plugins = make(map[string][]*Instance)
+	}
+	for name, _ := range self.Plugins {
+		origins["plugins."+name] = "backend"
+	}
+	for _, process := range self.Processes {
+		origins["processes."+process.Nickname] = "backend"
+	}
+
+	for _, layer := range self.Layers {
+		for name, instances := range layer.Plugins {
+			self.Plugins[name] = instances
+			origins["plugins."+name] = layer.Name
+		}
+		for _, process := range layer.Processes {
+			replaced := false
+			for idx, existing := range self.Processes {
+				if existing.Nickname == process.Nickname {
+					self.Processes[idx] = process
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				self.Processes = append(self.Processes, process)
+			}
+			origins["processes."+process.Nickname] = layer.Name
+		}
+	}
+	self.Layers = nil
+	self.Origins = origins
+}
@@ -8,37 +8,38 @@ import (
 	"github.com/errplane/errplane-go-common/monitoring"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"path"
 )
 
-const (
-	PLUGINS_DIR        = "/data/errplane-agent/shared/plugins"
-	CUSTOM_PLUGINS_DIR = "/data/errplane-agent/shared/custom-plugins"
-)
-
 type PluginInformation struct {
 	BasicStats []struct {
 		Name   string `json:"name"`
 		Metric string `json:"metric"`
 		Units  string `json:"units"`
 	} `yaml:"basic-stats" json:"stats,omitempty"`
-	Arguments []struct {
-		Name         string `json:"name"`
-		Description  string `json:"description"`
-		DefaultValue string `yaml:"default_value" json:"default"`
-	} `yaml:"arguments" json:"arguments,omitempty"`
+	Arguments   []*PluginArgument `yaml:"arguments" json:"arguments,omitempty"`
+	Environment []*PluginArgument `yaml:"environment" json:"environment,omitempty"`
 }
 
 type AgentConfiguration struct {
 	Plugins   map[string][]*Instance `json:"plugins"`
 	Processes []*Process             `json:"processes"`
+
+	// merged in order on top of the plugins and processes
+	Layers  []*BackendConfigLayer `json:"layers,omitempty" yaml:"-"`
+	Origins map[string]string     `json:"-" yaml:"-"`
 }
 
 type AgentStatus struct {
-	Plugins   []string `json:"plugins"`
-	Timestamp int64    `json:"timestamp"`
+	Plugins      []string          `json:"plugins"`
+	Timestamp    int64             `json:"timestamp"`
+	Version      string            `json:"version,omitempty"`
+	Incompatible map[string]string `json:"incompatible,omitempty"` // the plugins this agent can't run and why
+	Ephemeral    bool              `json:"ephemeral,omitempty"`
+	Heartbeat    int64             `json:"heartbeat,omitempty"` // the heartbeat interval in seconds
 }
 
 var AgentInfo *AgentConfiguration
@@ -54,7 +55,7 @@ func configServerUrl(path string, args ...interface{}) string {
 		path = fmt.Sprintf(path, args...)
 	}
 
-	return fmt.Sprintf("http://%s%s%s", AgentConfig.ConfigService, separator, path)
+	return fmt.Sprintf("http://%s%s%s", AgentConfig().ConfigService, separator, path)
 }
 
 func SendCustomPlugins(plugins map[string]*PluginInformation) error {
@@ -63,15 +64,15 @@ func SendCustomPlugins(plugins map[string]*PluginInformation) error {
 		log.Error("Cannot marshal data to json")
 		return err
 	}
-	database := AgentConfig.Database()
-	hostname := AgentConfig.Hostname
-	apiKey := AgentConfig.ApiKey
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
 	url := configServerUrl("/databases/%s/agent/%s/custom-plugins?api_key=%s", database, hostname, apiKey)
 	log.Debug("posting to '%s' -- %s", url, data)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		log.Error("Cannot post agent information to '%s'. Error: %s", url, err)
-		return err
+		return NetworkError(err)
 	}
 	resp.Body.Close()
 	return nil
@@ -83,47 +84,90 @@ func SendPluginStatus(status *AgentStatus) {
 		log.Error("Cannot marshal data to json")
 		return
 	}
-	database := AgentConfig.Database()
-	hostname := AgentConfig.Hostname
-	apiKey := AgentConfig.ApiKey
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
 	url := configServerUrl("/databases/%s/agent/%s?api_key=%s", database, hostname, apiKey)
 	log.Debug("posting to '%s' -- %s", url, data)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		log.Error("Cannot post agent information to '%s'. Error: %s", url, err)
+		log.Error("Cannot post agent information to '%s'. Error: %s", url, NetworkError(err))
 		return
 	}
 	resp.Body.Close()
 }
 
+// marks the host retired on the config service, so it stops alerting when
+// the host stops reporting
+func RetireHost() error {
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
+	url := configServerUrl("/databases/%s/agent/%s/retire?api_key=%s", database, hostname, apiKey)
+	log.Debug("posting to '%s'", url)
+	resp, err := configServiceClient().Post(url, "application/json", nil)
+	if err != nil {
+		return NetworkError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return NetworkError(fmt.Errorf("Received status code %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// removes an ephemeral host from the config service when it stops, so it
+// doesn't alert as down
+func DeregisterHost() error {
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
+	url := configServerUrl("/databases/%s/agent/%s?api_key=%s", database, hostname, apiKey)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	log.Debug("deleting '%s'", url)
+	resp, err := configServiceClient().Do(req)
+	if err != nil {
+		return NetworkError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return NetworkError(fmt.Errorf("Received status code %d", resp.StatusCode))
+	}
+	return nil
+}
+
 func GetMonitoringConfig() (*monitoring.MonitorConfig, error) {
-	database := AgentConfig.Database()
-	hostname := AgentConfig.Hostname
-	apiKey := AgentConfig.ApiKey
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
 
-	if AgentConfig.Hostname == "" {
+	if AgentConfig().Hostname == "" {
 		return nil, fmt.Errorf("Configuration service hostname not configured properly")
 	}
 
 	url := configServerUrl("/databases/%s/agent/%s/monitoring-configuration?api_key=%s", database, hostname, apiKey)
 	resp, err := http.Get(url)
 	if err != nil {
-		return nil, err
+		return nil, NetworkError(err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, NetworkError(err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Received status code %d", resp.StatusCode)
+		return nil, NetworkError(fmt.Errorf("Received status code %d", resp.StatusCode))
 	}
 	log.Debug("Received: %s", string(body))
-	return monitoring.ParseMonitorConfig(string(body), false)
+	config, err := monitoring.ParseMonitorConfig(string(body), false)
+	return config, ParseError(err)
 }
 
 func GetInstalledPluginsVersion() (string, error) {
-	version, err := ioutil.ReadFile(path.Join(PLUGINS_DIR, "version"))
+	version, err := ioutil.ReadFile(path.Join(AgentConfig().PluginsDir, "version"))
 	if err != nil {
 		return "", err
 	}
@@ -131,7 +175,7 @@ func GetInstalledPluginsVersion() (string, error) {
 }
 
 func InstallPlugin(version string) {
-	database := AgentConfig.Database()
+	database := AgentConfig().Database()
 	url := configServerUrl("/databases/%s/plugins/%s", database, version)
 	plugins, err := GetBody(url)
 	if err != nil {
@@ -139,18 +183,18 @@ func InstallPlugin(version string) {
 		return
 	}
 
-	filename := path.Join(PLUGINS_DIR, version+".tar.gz")
+	filename := path.Join(AgentConfig().PluginsDir, version+".tar.gz")
 	if err := ioutil.WriteFile(filename, plugins, 0644); err != nil {
 		log.Error("Cannot write to %s. Error: %s", filename, err)
 		return
 	}
-	versionFilename := path.Join(PLUGINS_DIR, "version")
+	versionFilename := path.Join(AgentConfig().PluginsDir, "version")
 	if err := ioutil.WriteFile(versionFilename, []byte(version), 0644); err != nil {
 		log.Error("Cannot write to %s. Error: %s", filename, err)
 		return
 	}
 
-	dir := path.Join(PLUGINS_DIR, version)
+	dir := path.Join(AgentConfig().PluginsDir, version)
 	err = os.Mkdir(dir, 0755)
 	if err != nil {
 		log.Error("Cannot create directory '%s'", dir)
@@ -166,7 +210,7 @@ func InstallPlugin(version string) {
 }
 
 func GetCurrentPluginsVersion() (string, error) {
-	database := AgentConfig.Database()
+	database := AgentConfig().Database()
 	url := configServerUrl("/databases/%s/plugins/current_version", database)
 	version, err := GetBody(url)
 	if err != nil {
@@ -178,6 +222,15 @@ func GetCurrentPluginsVersion() (string, error) {
 func GetMonitoredProcesses(processes []*Process) ([]*Process, error) {
 	config, err := GetPluginsToRun()
 	if err != nil {
+		// keep monitoring the processes of the last configuration received
+		cached, cacheErr := GetCachedPluginsToRun()
+		if cacheErr == nil {
+			log.Warn("Cannot get the processes to monitor from the backend, using the cached configuration. Error: %s", err)
+		}
+		config = cached
+	}
+	config = MergeLocalPlugins(config, LocalPlugins.Get(), AgentConfig().LocalPluginsMode)
+	if config == nil {
 		return nil, err
 	}
 
@@ -206,20 +259,90 @@ func GetMonitoredProcesses(processes []*Process) ([]*Process, error) {
 }
 
 func GetPluginsToRun() (*AgentConfiguration, error) {
-	config := &AgentConfiguration{}
-	database := AgentConfig.Database()
-	hostname := AgentConfig.Hostname
-	apiKey := AgentConfig.ApiKey
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
 	url := configServerUrl("/databases/%s/agent/%s/configuration?api_key=%s", database, hostname, apiKey)
+	if AgentConfig().Role != "" {
+		url += "&role=" + neturl.QueryEscape(AgentConfig().Role)
+	}
 	body, err := GetBody(url)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug("Received configuration: %s", string(body))
-	err = json.Unmarshal(body, config)
+	config, err := parseAgentConfiguration(body)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug("Parsed response: %v", config)
+
+	writeConfigCache(body)
 	return config, nil
 }
+
+// the plugins scheduler starts with this configuration at boot until the
+// backend answers. It has the environment of the plugins, i.e. secrets, so
+// it's only readable by the agent user, and it's replaced atomically so a
+// crash can't truncate it
+func writeConfigCache(body []byte) {
+	if AgentConfig().NoConfigCache {
+		return
+	}
+	file := AgentConfig().ConfigCache
+	if previous, err := ioutil.ReadFile(file); err == nil && bytes.Equal(previous, body) {
+		return
+	}
+	if err := ioutil.WriteFile(file+".tmp", body, 0600); err != nil {
+		log.Error("Cannot write to %s. Error: %s", file+".tmp", err)
+	} else if err := os.Rename(file+".tmp", file); err != nil {
+		log.Error("Cannot write to %s. Error: %s", file, err)
+	}
+}
+
+// replaces the cached configuration, e.g. with the previous one when a new
+// configuration is reverted
+func CacheAgentConfiguration(config *AgentConfiguration) {
+	body, err := json.Marshal(config)
+	if err != nil {
+		log.Error("Cannot cache the configuration. Error: %s", err)
+		return
+	}
+	writeConfigCache(body)
+}
+
+// returns the last configuration received from the backend, whatever its
+// age. The error is a not exist error if nothing was cached
+func GetCachedPluginsToRun() (*AgentConfiguration, error) {
+	if AgentConfig().NoConfigCache {
+		return nil, os.ErrNotExist
+	}
+	body, err := ioutil.ReadFile(AgentConfig().ConfigCache)
+	if err != nil {
+		return nil, err
+	}
+	return parseAgentConfiguration(body)
+}
+
+func parseAgentConfiguration(body []byte) (*AgentConfiguration, error) {
+	config := &AgentConfiguration{}
+	if err := json.Unmarshal(body, config); err != nil {
+		return nil, ParseError(err)
+	}
+	config.mergeLayers()
+	return config, nil
+}
+
+// returns the value of the secret stored on the config service for this
+// host. The value is never logged.
+func GetSecret(name string) (string, error) {
+	database := AgentConfig().Database()
+	hostname := AgentConfig().Hostname
+	apiKey := AgentConfig().ApiKey
+	url := configServerUrl("/databases/%s/agent/%s/secrets/%s?api_key=%s", database, hostname, neturl.QueryEscape(name), apiKey)
+	body, err := GetBody(url)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
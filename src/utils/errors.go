@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"sync"
+)
+
+// the categories of the errors, e.g. an unreachable backend shows up as
+// network errors while broken plugins show up as exec and parse errors
+const (
+	ERROR_CONFIG  = "config"  // invalid configuration, local or received from the backend
+	ERROR_EXEC    = "exec"    // a plugin or a command couldn't run, failed or timed out
+	ERROR_PARSE   = "parse"   // unexpected output of a plugin, a listener or the backend
+	ERROR_NETWORK = "network" // the backend, the config service or a monitored service is unreachable
+)
+
+var ERROR_CATEGORIES = []string{ERROR_CONFIG, ERROR_EXEC, ERROR_PARSE, ERROR_NETWORK}
+
+// An error tagged with its category. The errors are counted per category
+// when they're tagged, wrapping an error that already has a category
+// doesn't count it again.
+type CategorizedError struct {
+	Category string
+	Err      error
+}
+
+func (self *CategorizedError) Error() string {
+	return self.Err.Error()
+}
+
+type errorCounters struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+var errorCounts = &errorCounters{counts: make(map[string]int64)}
+
+func categorize(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*CategorizedError); ok {
+		return err
+	}
+	errorCounts.lock.Lock()
+	errorCounts.counts[category]++
+	errorCounts.lock.Unlock()
+	return &CategorizedError{category, err}
+}
+
+func ConfigError(err error) error {
+	return categorize(ERROR_CONFIG, err)
+}
+
+func ExecError(err error) error {
+	return categorize(ERROR_EXEC, err)
+}
+
+func ParseError(err error) error {
+	return categorize(ERROR_PARSE, err)
+}
+
+func NetworkError(err error) error {
+	return categorize(ERROR_NETWORK, err)
+}
+
+// returns the category of the error, empty if it has none
+func ErrorCategory(err error) string {
+	if categorized, ok := err.(*CategorizedError); ok {
+		return categorized.Category
+	}
+	return ""
+}
+
+// returns the number of errors of every category since the agent started
+func ErrorCounts() map[string]int64 {
+	errorCounts.lock.Lock()
+	defer errorCounts.lock.Unlock()
+	counts := make(map[string]int64, len(ERROR_CATEGORIES))
+	for _, category := range ERROR_CATEGORIES {
+		counts[category] = errorCounts.counts[category]
+	}
+	return counts
+}
@@ -0,0 +1,7 @@
+//go:build fips
+// +build fips
+
+package utils
+
+// agents built with `-tags fips` always run in fips mode
+const fipsBuild = true
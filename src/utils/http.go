@@ -5,21 +5,57 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// how long a request to the config service can take, a backend that can't
+// be resolved or doesn't answer mustn't hang the agent
+const CONFIG_SERVICE_TIMEOUT = 30 * time.Second
+
+func configServiceClient() *http.Client {
+	return &http.Client{Transport: AgentTransport(), Timeout: CONFIG_SERVICE_TIMEOUT}
+}
+
 func GetBody(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	resp, err := configServiceClient().Get(url)
 	if err != nil {
 		log.Error("Cannot download from '%s'. Error: %s", url, err)
-		return nil, err
+		return nil, NetworkError(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Received status code %d", resp.StatusCode)
+		return nil, NetworkError(fmt.Errorf("Received status code %d", resp.StatusCode))
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, NetworkError(err)
 	}
 	return body, nil
 }
+
+// parses a proxy url, a host:port without a scheme is an http proxy
+func ParseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// returns the proxy of the requests to the backend and the config service,
+// the socks5 proxy of the ssh tunnel if one is configured. Nil without a
+// proxy.
+func ProxyUrl() *url.URL {
+	if AgentConfig().SshTunnel.Host != "" {
+		return &url.URL{Scheme: "socks5", Host: fmt.Sprintf("127.0.0.1:%d", AgentConfig().SshTunnel.LocalPort)}
+	}
+	if AgentConfig().Proxy == "" {
+		return nil
+	}
+	proxy, err := ParseProxy(AgentConfig().Proxy)
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"sync"
+)
+
+// how the local-plugins file is merged with the configuration of the config
+// service. The local plugins and processes run alone until the config
+// service answers in every mode.
+const (
+	LOCAL_PLUGINS_REMOTE   = "remote"   // merged, the config service wins for the plugins and processes in both
+	LOCAL_PLUGINS_LOCAL    = "local"    // merged, the local file wins for the plugins and processes in both
+	LOCAL_PLUGINS_FALLBACK = "fallback" // ignored once the config service answered
+)
+
+// the origin of the plugins and processes of the local-plugins file
+const LOCAL_PLUGINS_ORIGIN = "local"
+
+// converts the maps of a yaml document to maps with string keys so it can
+// be marshalled to json
+func yamlToJson(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			converted[fmt.Sprint(key)] = yamlToJson(child)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for idx, child := range v {
+			converted[idx] = yamlToJson(child)
+		}
+		return converted
+	}
+	return value
+}
+
+// parses the plugins and processes of a local-plugins file, the json format
+// of the config service written as yaml
+func ParseLocalPlugins(content []byte) (*AgentConfiguration, error) {
+	var doc interface{}
+	if err := goyaml.Unmarshal(content, &doc); err != nil {
+		return nil, ParseError(err)
+	}
+	data, err := json.Marshal(yamlToJson(doc))
+	if err != nil {
+		return nil, ParseError(err)
+	}
+	config := &AgentConfiguration{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, ParseError(err)
+	}
+	if config.Plugins == nil {
+		config.Plugins = make(map[string][]*Instance)
+	}
+	return config, nil
+}
+
+// The plugins of the local-plugins file, the last good ones are kept when
+// the file can't be read or parsed
+type LocalPluginsFile struct {
+	lock    sync.Mutex
+	content []byte
+	config  *AgentConfiguration
+}
+
+var LocalPlugins = &LocalPluginsFile{}
+
+// reads the local-plugins file again, returns nil if it isn't set
+func (self *LocalPluginsFile) Get() *AgentConfiguration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if AgentConfig().LocalPlugins == "" {
+		self.content, self.config = nil, nil
+		return nil
+	}
+	content, err := ioutil.ReadFile(AgentConfig().LocalPlugins)
+	if err != nil {
+		log.Error("Cannot read the local plugins from %s, keeping the previous ones. Error: %s", AgentConfig().LocalPlugins, ConfigError(err))
+		return self.config
+	}
+	if self.config != nil && bytes.Equal(content, self.content) {
+		return self.config
+	}
+	config, err := ParseLocalPlugins(content)
+	if err != nil {
+		log.Error("Cannot parse the local plugins in %s, keeping the previous ones. Error: %s", AgentConfig().LocalPlugins, err)
+		return self.config
+	}
+	log.Info("Read %d local plugins and %d local processes from %s", len(config.Plugins), len(config.Processes), AgentConfig().LocalPlugins)
+	self.content, self.config = content, config
+	return config
+}
+
+// returns the configuration of the config service merged with the local
+// plugins, remote is nil until the config service answered. Like a layer,
+// the winning file replaces all the instances of a plugin and an empty list
+// of instances removes it.
+func MergeLocalPlugins(remote, local *AgentConfiguration, mode string) *AgentConfiguration {
+	if local == nil || remote != nil && mode == LOCAL_PLUGINS_FALLBACK {
+		return remote
+	}
+	if remote == nil {
+		remote = &AgentConfiguration{}
+	}
+
+	merged := &AgentConfiguration{
+		Plugins:   make(map[string][]*Instance),
+		Processes: make([]*Process, 0, len(remote.Processes)+len(local.Processes)),
+		Origins:   make(map[string]string),
+	}
+	for name, instances := range remote.Plugins {
+		merged.Plugins[name] = instances
+	}
+	for key, origin := range remote.Origins {
+		merged.Origins[key] = origin
+	}
+	merged.Processes = append(merged.Processes, remote.Processes...)
+
+	for name, instances := range local.Plugins {
+		if _, ok := remote.Plugins[name]; ok && mode != LOCAL_PLUGINS_LOCAL {
+			continue
+		}
+		if len(instances) == 0 {
+			delete(merged.Plugins, name)
+			delete(merged.Origins, "plugins."+name)
+			continue
+		}
+		merged.Plugins[name] = instances
+		merged.Origins["plugins."+name] = LOCAL_PLUGINS_ORIGIN
+	}
+	for _, process := range local.Processes {
+		replaced := false
+		for idx, existing := range merged.Processes {
+			if existing.Nickname == process.Nickname {
+				if mode == LOCAL_PLUGINS_LOCAL {
+					merged.Processes[idx] = process
+					merged.Origins["processes."+process.Nickname] = LOCAL_PLUGINS_ORIGIN
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged.Processes = append(merged.Processes, process)
+			merged.Origins["processes."+process.Nickname] = LOCAL_PLUGINS_ORIGIN
+		}
+	}
+	return merged
+}
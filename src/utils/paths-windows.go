@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package utils
+
+const (
+	DEFAULT_CONFIG_FILE = `C:\ProgramData\errplane-agent\config.yml`
+	DEFAULT_PID_FILE    = `C:\ProgramData\errplane-agent\shared\errplane-agent.pid`
+	PLUGINS_DIR         = `C:\ProgramData\errplane-agent\shared\plugins`
+	CUSTOM_PLUGINS_DIR  = `C:\ProgramData\errplane-agent\shared\custom-plugins`
+	// the default config-cache, the last configuration received from the backend
+	BACKEND_CONFIG_CACHE = `C:\ProgramData\errplane-agent\shared\backend-configuration.json`
+)
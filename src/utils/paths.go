@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+const (
+	DEFAULT_CONFIG_FILE = "/etc/errplane-agent/config.yml"
+	DEFAULT_PID_FILE    = "/data/errplane-agent/shared/errplane-agent.pid"
+	PLUGINS_DIR         = "/data/errplane-agent/shared/plugins"
+	CUSTOM_PLUGINS_DIR  = "/data/errplane-agent/shared/custom-plugins"
+	// the default config-cache, the last configuration received from the backend
+	BACKEND_CONFIG_CACHE = "/data/errplane-agent/shared/backend-configuration.json"
+)
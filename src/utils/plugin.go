@@ -1,19 +1,107 @@
 package utils
 
+import (
+	"fmt"
+	"time"
+)
+
 type Instance struct {
 	Name     string
 	Args     map[string]string
 	ArgsList []string
+	Remote   *RemoteTarget `json:",omitempty"` // run the plugin on this host over ssh
+	Interval string        `json:",omitempty"` // overrides the interval of the plugin, e.g. 5m
+	Timeout  string        `json:",omitempty"` // overrides the timeout of the plugin, e.g. 10s
+	Jitter   string        `json:",omitempty"` // overrides the plugin-concurrency jitter, e.g. 5s
+	// passed to the plugin as environment variables, e.g. passwords that
+	// shouldn't show up in the process list. Not part of the identity of
+	// the instance, rotating a secret keeps the series.
+	Env map[string]string `json:",omitempty"`
+	// added to the dimensions of the points of the instance, e.g. the pod
+	// of the instances configured in kubernetes annotations
+	Dimensions map[string]string `json:",omitempty"`
+}
+
+type RemoteTarget struct {
+	Host    string
+	User    string
+	Port    int
+	Key     string // path of the private key on the agent host
+	Command string // run this command instead of copying the plugin to the remote host
+}
+
+// An argument accepted by a plugin as declared in its info.yml, the
+// schema is sent to the backend so the UI can render a form
+type PluginArgument struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	DefaultValue string `yaml:"default_value" json:"default"`
+	Type         string `json:"type,omitempty"` // string (default), int, float, bool or duration
+	Required     bool   `json:"required,omitempty"`
+	Secret       bool   `json:"secret,omitempty"` // never logged
 }
 
 type PluginMetadata struct {
 	Name            string
 	Verion          string
 	Output          string
-	HasDependencies bool     `yaml:"needs-dependencies"`
-	Path            string   `yaml:"-"`
-	IsCustom        bool     `yaml:"-"`
-	CalculateRates  []string `yaml:"calculate-rates"`
+	FormatVersion   int               `yaml:"format_version"` // the version of the errplane output, default is 1
+	HasDependencies bool              `yaml:"needs-dependencies"`
+	Path            string            `yaml:"-"`
+	IsCustom        bool              `yaml:"-"`
+	CalculateRates  []string          `yaml:"calculate-rates"`
+	StatusMessage   string            `yaml:"status-message"` // template replacing the first line of the output in the status
+	RawInterval     string            `yaml:"interval"`       // how often the plugin runs, default is the agent sleep
+	Interval        time.Duration     `yaml:"-"`
+	RawTimeout      string            `yaml:"timeout"` // the plugin is killed if it runs longer, default is 30s
+	Timeout         time.Duration     `yaml:"-"`
+	Arguments       []*PluginArgument `yaml:"arguments"`
+	Environment     []*PluginArgument `yaml:"environment"` // the environment variables the plugin expects
+	Probes          []*PluginProbe    `yaml:"probes"`      // expensive commands shared with the other plugins
+	// overrides the output-validation of the agent config
+	OutputValidation string `yaml:"output-validation"`
+	// the user or user:group the plugin runs as, overrides the run_as of the agent config
+	RunAs string `yaml:"run_as"`
+	// overrides the plugin-limits of the agent config
+	Limits PluginLimits `yaml:"limits"`
+	// the plugin isn't run by older agents, e.g. 1.4.0
+	MinAgentVersion string `yaml:"min_agent_version"`
+	// the agent features the plugin needs, e.g. [json-output]
+	Capabilities []string `yaml:"capabilities,flow"`
+	// report plugins.<name>.missed when a due run is skipped
+	MissedMarkers bool `yaml:"missed-markers"`
+}
+
+// The resources a plugin run can use, enforced by a cgroup or rlimits. The
+// plugin is killed and reported when it goes beyond its memory.
+type PluginLimits struct {
+	Cpu    float64 // in cpus, e.g. 0.5, no limit if 0
+	Memory int64   // in bytes, no limit if 0
+}
+
+func (self *PluginLimits) Validate() error {
+	if self.Cpu < 0 {
+		return fmt.Errorf("limits.cpu must be positive")
+	}
+	if self.Memory < 0 {
+		return fmt.Errorf("limits.memory must be positive")
+	}
+	return nil
+}
+
+const (
+	OUTPUT_VALIDATION_LENIENT = "lenient" // what the parsers can make sense of is accepted
+	OUTPUT_VALIDATION_STRICT  = "strict"  // the output must follow the spec of its type, e.g. the nagios perfdata
+)
+
+// A command whose output is cached and shared by all the plugins declaring
+// the same probe, e.g. docker ps. The plugin reads the output from the file
+// in the ERRPLANE_PROBE_<NAME> environment variable.
+type PluginProbe struct {
+	Name    string
+	Command string        // run using sh -c
+	RawTtl  string        `yaml:"ttl"` // how long the output is reused, default is 30s
+	Ttl     time.Duration `yaml:"-"`
 }
 
 type Plugin struct {
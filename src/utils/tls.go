@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// cipher suites approved by FIPS 140-2, only AES-GCM with ECDHE key exchange
+var FipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+func FipsMode() bool {
+	return fipsBuild || AgentConfig().FipsMode
+}
+
+// Returns the tls configuration that should be used by every connection
+// the agent makes or accepts. In fips mode the connections are restricted
+// to tls 1.2 (the tls 1.3 cipher suites cannot be restricted) using fips
+// approved cipher suites and curves.
+func TlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if FipsMode() {
+		config.MinVersion = tls.VersionTLS12
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = FipsCipherSuites
+		config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+	return config
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTlsVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	parsed, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("Unknown tls version '%s', supported versions are 1.0, 1.1, 1.2 and 1.3", version)
+	}
+	return parsed, nil
+}
+
+// reads the ca bundle and the client certificate so a missing or invalid
+// file is reported when the config is loaded
+func (self *BackendTlsConfig) load() error {
+	var err error
+	if self.MinVersion, err = parseTlsVersion(self.RawMinVersion); err != nil {
+		return err
+	}
+	if self.MaxVersion, err = parseTlsVersion(self.RawMaxVersion); err != nil {
+		return err
+	}
+	if self.MinVersion != 0 && self.MaxVersion != 0 && self.MinVersion > self.MaxVersion {
+		return fmt.Errorf("backend-tls.min-version %s is greater than max-version %s", self.RawMinVersion, self.RawMaxVersion)
+	}
+
+	if self.Ca != "" {
+		pem, err := ioutil.ReadFile(self.Ca)
+		if err != nil {
+			return err
+		}
+		// the bundle is trusted in addition to the system roots, the
+		// notifiers and the status page still talk to public services
+		self.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			self.RootCAs = x509.NewCertPool()
+		}
+		if !self.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Cannot find any certificate in %s", self.Ca)
+		}
+	}
+
+	if (self.Cert == "") != (self.Key == "") {
+		return fmt.Errorf("backend-tls.cert and backend-tls.key must be set together")
+	}
+	if self.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(self.Cert, self.Key)
+		if err != nil {
+			return fmt.Errorf("Cannot load the client certificate %s. Error: %s", self.Cert, err)
+		}
+		self.Certificate = &certificate
+	}
+	return nil
+}
+
+// Returns the tls configuration of the connections to the config service
+// and the backend: the agent tls configuration with the backend ca bundle,
+// the client certificate and the allowed versions. Fips mode keeps
+// restricting the versions to tls 1.2.
+func BackendTlsClientConfig() *tls.Config {
+	config := TlsConfig()
+	backend := AgentConfig().BackendTls
+	config.RootCAs = backend.RootCAs
+	if backend.Certificate != nil {
+		config.Certificates = []tls.Certificate{*backend.Certificate}
+	}
+	if !FipsMode() {
+		config.MinVersion = backend.MinVersion
+		config.MaxVersion = backend.MaxVersion
+	}
+	return config
+}
+
+// The transport of the requests to the config service and the backend.
+// The default transport of the process is left alone, the libraries using
+// http.DefaultClient don't get the agent tls configuration.
+var agentTransport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+
+// returns the transport honoring the agent tls and proxy configuration
+func AgentTransport() *http.Transport {
+	return agentTransport
+}
+
+// builds the agent transport from the tls and proxy configuration, once at
+// startup: the transport is shared by the goroutines and a reload doesn't
+// change it
+func InitAgentTransport() {
+	transport := &http.Transport{TLSClientConfig: BackendTlsClientConfig(), Proxy: http.ProxyFromEnvironment}
+	if proxy := ProxyUrl(); proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	agentTransport = transport
+}
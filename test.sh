@@ -7,9 +7,10 @@ go get launchpad.net/gocheck
 
 function print_usage {
     echo "  -o|--only: Run the test that matches the given regex"
+    echo "  -i|--integration: Also run the agent binary against the fake backend"
 }
 
-TEMP=`getopt -o ho: --long help,only: \
+TEMP=`getopt -o hio: --long help,integration,only: \
      -n $0 -- "$@"`
 
 if [ $? != 0 ] ; then print_usage ; exit 1 ; fi
@@ -21,6 +22,7 @@ while true ; do
     case "$1" in
         -h|--help) print_usage; exit 1; shift;;
         -o|--only) regex=$2; shift 2;;
+        -i|--integration) tags="-tags integration"; shift;;
         --) shift ; break ;;
         *) echo "Internal error!" ; exit 1 ;;
     esac
@@ -30,4 +32,4 @@ if [ "x$regex" != "x" ]; then
     gocheck_args="-gocheck.f $regex"
 fi
 
-go test -v apps/agent $gocheck_args
+go test -v $tags apps/agent ringbuffer fakebackend $gocheck_args